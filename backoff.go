@@ -0,0 +1,64 @@
+package mesh
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	initialInterval = 2 * time.Second
+	maxInterval     = 6 * time.Minute
+	intervalFactor  = 1.5
+	intervalJitter  = 0.5
+)
+
+// BackoffPolicy is how long the ConnectionMaker waits before retrying a
+// target it failed to connect to, or was disconnected from. The delay
+// before the nth retry is a random value in the range [i-i*j,i+i*j],
+// where i = Initial * Multiplier^(n-1), up to Max, and j is Jitter.
+// Zero values give the defaults: 2s, 6m, 1.5 and 0.5 respectively.
+type BackoffPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter is the fraction of the interval by which the delay is
+	// randomised, so that peers disconnected together don't retry
+	// together; negative means none.
+	Jitter float64
+	// Func, if set, is used in place of all of the above, returning the
+	// delay before the given retry, counting from 1, of a target whose
+	// last attempt failed with lastErr.
+	Func func(attempt int, lastErr error) time.Duration
+}
+
+// delay returns how long to wait before the given retry, jittered by
+// rng.
+func (policy BackoffPolicy) delay(rng Rand, attempt int, lastErr error) time.Duration {
+	if policy.Func != nil {
+		if delay := policy.Func(attempt, lastErr); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+	initial, max, multiplier, jitter := policy.Initial, policy.Max, policy.Multiplier, policy.Jitter
+	if initial <= 0 {
+		initial = initialInterval
+	}
+	if max <= 0 {
+		max = maxInterval
+	}
+	if multiplier < 1 {
+		multiplier = intervalFactor
+	}
+	if jitter == 0 {
+		jitter = intervalJitter
+	} else if jitter < 0 || jitter > 1 {
+		jitter = math.Max(0, math.Min(jitter, 1))
+	}
+	interval := time.Duration(math.Min(float64(initial)*math.Pow(multiplier, float64(attempt-1)), float64(max)))
+	spread := time.Duration(float64(interval) * jitter)
+	if spread <= 0 {
+		return interval
+	}
+	return interval - spread + time.Duration(rng.Int63n(int64(2*spread)))
+}
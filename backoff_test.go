@@ -0,0 +1,47 @@
+package mesh
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffPolicyDefaults(t *testing.T) {
+	var policy BackoffPolicy
+	for i := 0; i < 100; i++ {
+		delay := policy.delay(defaultRand{}, 1, nil)
+		require.True(t, delay >= time.Second && delay < 3*time.Second, delay)
+		delay = policy.delay(defaultRand{}, 100, nil)
+		require.True(t, delay >= 3*time.Minute && delay < 9*time.Minute, delay)
+	}
+}
+
+func TestBackoffPolicyWithoutJitter(t *testing.T) {
+	policy := BackoffPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: -1}
+	var delays []time.Duration
+	for attempt := 1; attempt <= 6; attempt++ {
+		delays = append(delays, policy.delay(defaultRand{}, attempt, nil))
+	}
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, delays)
+}
+
+func TestBackoffPolicyFunc(t *testing.T) {
+	refused := errors.New("refused")
+	var seen []int
+	policy := BackoffPolicy{Func: func(attempt int, lastErr error) time.Duration {
+		require.Equal(t, refused, lastErr)
+		seen = append(seen, attempt)
+		return time.Hour
+	}}
+	tgt := &target{state: targetWaiting}
+	tgt.nextTryNow(realClock{})
+	tgt.lastError = refused
+	tgt.nextTryLater(policy, realClock{}, defaultRand{})
+	tgt.nextTryLater(policy, realClock{}, defaultRand{})
+	require.WithinDuration(t, time.Now().Add(time.Hour), tgt.tryAfter, time.Minute)
+	tgt.nextTryNow(realClock{})
+	tgt.nextTryLater(policy, realClock{}, defaultRand{})
+	require.Equal(t, []int{1, 2, 1}, seen)
+}
@@ -0,0 +1,193 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Bandwidth usage is accumulated in buckets of this duration...
+	bandwidthBucketDuration = time.Minute
+	// ...of which we keep this many, bounding the longest window.
+	bandwidthBuckets = 60
+)
+
+// BandwidthWindows are the time windows over which bandwidth usage is
+// rolled up, in addition to the totals since the router started.
+var BandwidthWindows = []time.Duration{1 * time.Minute, 5 * time.Minute, 15 * time.Minute, 60 * time.Minute}
+
+// BandwidthStats is the number of gossip bytes exchanged with a peer on
+// a channel over some period.
+type BandwidthStats struct {
+	// Window is the period covered; zero means since the router started.
+	Window        time.Duration
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// BandwidthUsage reports the gossip traffic exchanged with one
+// directly connected peer on one channel.
+type BandwidthUsage struct {
+	Peer    string
+	Channel string
+	Total   BandwidthStats
+	Windows []BandwidthStats
+
+	// Throttled is how long, in total, gossip to the peer has been held
+	// back by rate limits; see RateLimit.
+	Throttled time.Duration
+
+	// Dropped is the number of gossip updates for the peer discarded
+	// from full queues; see GossipChannelConfig.QueueLimit.
+	Dropped uint64
+}
+
+type bandwidthKey struct {
+	peer    PeerName
+	channel string
+}
+
+type bandwidthBucket struct {
+	start          time.Time
+	sent, received uint64
+}
+
+type bandwidthCounters struct {
+	total     BandwidthStats
+	buckets   [bandwidthBuckets]bandwidthBucket
+	throttled time.Duration
+	dropped   uint64
+}
+
+// bandwidthMeter aggregates bytes sent and received per (peer, channel).
+type bandwidthMeter struct {
+	sync.Mutex
+	counters map[bandwidthKey]*bandwidthCounters
+	now      func() time.Time
+}
+
+func newBandwidthMeter() *bandwidthMeter {
+	return &bandwidthMeter{counters: make(map[bandwidthKey]*bandwidthCounters), now: time.Now}
+}
+
+func (m *bandwidthMeter) sent(peer PeerName, channel string, n int) {
+	m.add(peer, channel, uint64(n), 0)
+}
+
+func (m *bandwidthMeter) received(peer PeerName, channel string, n int) {
+	m.add(peer, channel, 0, uint64(n))
+}
+
+func (m *bandwidthMeter) throttled(peer PeerName, channel string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.countersFor(peer, channel).throttled += d
+}
+
+func (m *bandwidthMeter) dropped(peer PeerName, channel string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.countersFor(peer, channel).dropped++
+}
+
+func (m *bandwidthMeter) add(peer PeerName, channel string, sent, received uint64) {
+	if m == nil {
+		return
+	}
+	start := m.now().Truncate(bandwidthBucketDuration)
+	m.Lock()
+	defer m.Unlock()
+	counters := m.countersFor(peer, channel)
+	counters.total.BytesSent += sent
+	counters.total.BytesReceived += received
+	bucket := &counters.buckets[start.Unix()/int64(bandwidthBucketDuration/time.Second)%bandwidthBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = bandwidthBucket{start: start}
+	}
+	bucket.sent += sent
+	bucket.received += received
+}
+
+func (m *bandwidthMeter) countersFor(peer PeerName, channel string) *bandwidthCounters {
+	key := bandwidthKey{peer, channel}
+	counters, found := m.counters[key]
+	if !found {
+		counters = &bandwidthCounters{}
+		m.counters[key] = counters
+	}
+	return counters
+}
+
+// usage rolls up the counters over BandwidthWindows, ordered by peer
+// and then channel.
+func (m *bandwidthMeter) usage() []BandwidthUsage {
+	now := m.now()
+	m.Lock()
+	defer m.Unlock()
+	keys := make([]bandwidthKey, 0, len(m.counters))
+	for key := range m.counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].peer != keys[j].peer {
+			return keys[i].peer < keys[j].peer
+		}
+		return keys[i].channel < keys[j].channel
+	})
+	slice := make([]BandwidthUsage, 0, len(keys))
+	for _, key := range keys {
+		counters := m.counters[key]
+		usage := BandwidthUsage{Peer: key.peer.String(), Channel: key.channel, Total: counters.total, Throttled: counters.throttled, Dropped: counters.dropped}
+		for _, window := range BandwidthWindows {
+			stats := BandwidthStats{Window: window}
+			// a bucket is in the window if it overlaps it
+			from := now.Add(-window).Truncate(bandwidthBucketDuration)
+			for _, bucket := range counters.buckets {
+				if !bucket.start.Before(from) && !bucket.start.After(now) {
+					stats.BytesSent += bucket.sent
+					stats.BytesReceived += bucket.received
+				}
+			}
+			usage.Windows = append(usage.Windows, stats)
+		}
+		slice = append(slice, usage)
+	}
+	return slice
+}
+
+// sentByChannel returns the total bytes sent on each channel, to all
+// peers.
+func (m *bandwidthMeter) sentByChannel() map[string]uint64 {
+	m.Lock()
+	defer m.Unlock()
+	sent := make(map[string]uint64)
+	for key, counters := range m.counters {
+		sent[key.channel] += counters.total.BytesSent
+	}
+	return sent
+}
+
+// forget discards the counters of a peer which is no longer known.
+func (m *bandwidthMeter) forget(peer PeerName) {
+	m.Lock()
+	defer m.Unlock()
+	for key := range m.counters {
+		if key.peer == peer {
+			delete(m.counters, key)
+		}
+	}
+}
+
+// BandwidthUsage reports the gossip traffic exchanged with each directly
+// connected peer, per channel, both in total and rolled up over
+// BandwidthWindows.
+func (router *Router) BandwidthUsage() []BandwidthUsage {
+	return router.bandwidth.usage()
+}
@@ -0,0 +1,42 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthMeter(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	myTime := start
+	m := newBandwidthMeter()
+	m.now = func() time.Time { return myTime }
+
+	p1, p2 := PeerName(1), PeerName(2)
+	m.sent(p1, "a", 100)
+	m.received(p1, "a", 10)
+	m.sent(p2, "a", 1)
+	myTime = start.Add(10 * time.Minute)
+	m.sent(p1, "a", 200)
+	m.sent(p1, "b", 5)
+
+	usage := m.usage()
+	require.Len(t, usage, 3)
+	require.Equal(t, "a", usage[0].Channel)
+	require.Equal(t, BandwidthStats{BytesSent: 300, BytesReceived: 10}, usage[0].Total)
+	require.Equal(t, BandwidthStats{Window: time.Minute, BytesSent: 200}, usage[0].Windows[0])
+	require.Equal(t, BandwidthStats{Window: 15 * time.Minute, BytesSent: 300, BytesReceived: 10}, usage[0].Windows[2])
+	require.Equal(t, "b", usage[1].Channel)
+	require.Equal(t, p2.String(), usage[2].Peer)
+
+	// Buckets are reused once they fall out of the longest window
+	myTime = start.Add(time.Duration(bandwidthBuckets) * bandwidthBucketDuration)
+	m.sent(p1, "a", 1)
+	usage = m.usage()
+	require.Equal(t, uint64(301), usage[0].Total.BytesSent)
+	require.Equal(t, uint64(201), usage[0].Windows[3].BytesSent)
+
+	m.forget(p1)
+	require.Len(t, m.usage(), 1)
+}
@@ -0,0 +1,319 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The name of the gossip channel on which bans are distributed.
+const banChannelName = internalChannelPrefix + "bans"
+
+var errPeerBanned = errors.New("peer is banned")
+
+// We relay at most this many bans signed by keys we don't trust, since
+// anyone can sign them.
+const maxUntrustedBans = 1024
+
+// PeerBan identifies a banned peer, by its name or by its UID,
+// whichever is set. A ban by UID outlasts any change of the peer's
+// name, but not a restart, which gives the peer a new UID.
+type PeerBan struct {
+	Name PeerName
+	UID  PeerUID
+}
+
+func (ban PeerBan) String() string {
+	if ban.UID != 0 {
+		return fmt.Sprintf("UID %d", ban.UID)
+	}
+	return ban.Name.String()
+}
+
+func (ban PeerBan) matches(name PeerName, uid PeerUID) bool {
+	return (ban.Name != UnknownPeerName && ban.Name == name) || (ban.UID != 0 && ban.UID == uid)
+}
+
+// signed returns what is signed to revoke a peer by ban in the mesh
+// with meshID, so that the ban can't be used in any other.
+func (ban PeerBan) signed(meshID string) []byte {
+	return []byte(fmt.Sprintf("mesh ban %q %s %d", meshID, ban.Name, ban.UID))
+}
+
+// BanPeer bans the named peer from the mesh, e.g. because it has been
+// compromised; see BanPeerUID.
+func (router *Router) BanPeer(name PeerName) error {
+	return router.ban(PeerBan{Name: name})
+}
+
+// BanPeerUID bans the peer with the UID from the mesh. We close our
+// connections to a banned peer, refuse those it makes or we make to
+// it, and don't discover it. If Config.BanSigningKey is set, the ban is
+// signed with it, for our Config.MeshID, and gossiped, and the peers
+// which trust that key, by Config.BanTrustedKeys, ban the peer
+// likewise, so that it can be removed from the mesh without changing
+// the Password of every peer. Peers which don't trust the key relay
+// the ban all the same. Bans last as long as the router.
+func (router *Router) BanPeerUID(uid PeerUID) error {
+	return router.ban(PeerBan{UID: uid})
+}
+
+// Bans returns the bans we enforce: those made by BanPeer and
+// BanPeerUID, and those received signed by a trusted key.
+func (router *Router) Bans() []PeerBan {
+	router.bans.RLock()
+	defer router.bans.RUnlock()
+	bans := make([]PeerBan, 0, len(router.bans.enforced))
+	for ban := range router.bans.enforced {
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+func (router *Router) ban(ban PeerBan) error {
+	if (ban.Name == UnknownPeerName) == (ban.UID == 0) {
+		return fmt.Errorf("a ban must name a peer or its UID")
+	}
+	if ban.matches(router.Ourself.Name, router.Ourself.UID) {
+		return fmt.Errorf("unable to ban ourself")
+	}
+	var signature []byte
+	if router.BanSigningKey != nil {
+		signature = ed25519.Sign(router.BanSigningKey, ban.signed(router.MeshID))
+	}
+	update := &banState{Bans: map[PeerBan][]byte{ban: signature}}
+	router.bans.Lock()
+	_, enforced := router.bans.enforced[ban]
+	router.bans.enforced[ban] = struct{}{}
+	delta := router.bans.state.merge(update)
+	router.bans.Unlock()
+	if enforced && delta == nil {
+		return nil
+	}
+	router.logger.Printf("Banned peer %s", ban)
+	router.closeBanned()
+	if signature != nil {
+		router.bans.gossip.GossipBroadcast(delta)
+	}
+	return nil
+}
+
+// banned reports whether a peer is banned.
+func (router *Router) banned(name PeerName, uid PeerUID) bool {
+	router.bans.RLock()
+	defer router.bans.RUnlock()
+	for ban := range router.bans.enforced {
+		if ban.matches(name, uid) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeBanned closes our connections to banned peers.
+func (router *Router) closeBanned() {
+	for conn := range router.Ourself.getConnections() {
+		router.Peers.RLock()
+		name, uid := conn.Remote().Name, conn.Remote().UID
+		router.Peers.RUnlock()
+		if router.banned(name, uid) {
+			conn.(ourConnection).shutdown(errPeerBanned)
+		}
+	}
+}
+
+// validateSigningKeys checks the lengths of the keys of Config.
+func validateSigningKeys(config Config) error {
+	if err := validateKeys("ban", config.BanSigningKey, config.BanTrustedKeys); err != nil {
+		return err
+	}
+	return validateKeys("trust bundle", config.TrustSigningKey, config.TrustTrustedKeys)
+}
+
+// validateKeys checks the lengths of a signing key and trusted keys.
+func validateKeys(kind string, signing ed25519.PrivateKey, trusted []ed25519.PublicKey) error {
+	if signing != nil && len(signing) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s signing key must be %d bytes, not %d", kind, ed25519.PrivateKeySize, len(signing))
+	}
+	for _, key := range trusted {
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("trusted %s key must be %d bytes, not %d", kind, ed25519.PublicKeySize, len(key))
+		}
+	}
+	return nil
+}
+
+// banState is the state of the bans channel: the bans, each with the
+// signature revoking the peer, or none if it is only enforced locally.
+// Signed bans are relayed whether or not we trust the key.
+type banState struct {
+	Bans map[PeerBan][]byte
+}
+
+// Encode implements GossipData.
+func (state *banState) Encode() [][]byte {
+	return [][]byte{gobEncode(state)}
+}
+
+// Merge implements GossipData.
+func (state *banState) Merge(other GossipData) GossipData {
+	merged := &banState{Bans: make(map[PeerBan][]byte, len(state.Bans))}
+	merged.merge(state)
+	merged.merge(other.(*banState))
+	return merged
+}
+
+// merge merges other into state, returning what changed, or nil. A
+// signed ban replaces the same ban unsigned.
+func (state *banState) merge(other *banState) *banState {
+	var delta *banState
+	for ban, signature := range other.Bans {
+		if existing, found := state.Bans[ban]; found && (existing != nil || signature == nil) {
+			continue
+		}
+		state.Bans[ban] = signature
+		if delta == nil {
+			delta = &banState{Bans: make(map[PeerBan][]byte)}
+		}
+		delta.Bans[ban] = signature
+	}
+	return delta
+}
+
+// banList is the Gossiper of the bans channel.
+type banList struct {
+	sync.RWMutex
+	router    *Router
+	state     banState
+	enforced  map[PeerBan]struct{} // those of state we made or trust
+	untrusted int                  // the number of the others
+	gossip    Gossip
+}
+
+func newBanList(router *Router) *banList {
+	return &banList{router: router, state: banState{Bans: make(map[PeerBan][]byte)}, enforced: make(map[PeerBan]struct{})}
+}
+
+// trusted reports whether signature revokes a peer by ban, by one of
+// the trusted keys, or our own.
+func (bans *banList) trusted(ban PeerBan, signature []byte) bool {
+	config := bans.router.Config
+	return signedBy(ban.signed(config.MeshID), signature, config.BanSigningKey, config.BanTrustedKeys)
+}
+
+// signedBy reports whether signature signs msg by one of the trusted
+// keys, or that of own, if set.
+func signedBy(msg, signature []byte, own ed25519.PrivateKey, trusted []ed25519.PublicKey) bool {
+	if signature == nil {
+		return false
+	}
+	if own != nil && ed25519.Verify(own.Public().(ed25519.PublicKey), msg, signature) {
+		return true
+	}
+	for _, key := range trusted {
+		if ed25519.Verify(key, msg, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// receive merges the signed bans of msg, and enforces any new ones
+// signed by a trusted key. It returns those signed, and what was new
+// to us, if anything. Bans of ourself aren't enforced, so that a
+// banned peer doesn't cut itself off from the peers which don't trust
+// the key banning it.
+func (bans *banList) receive(msg []byte) (received, delta *banState, err error) {
+	var state banState
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&state); err != nil {
+		return nil, nil, err
+	}
+	received = &banState{Bans: make(map[PeerBan][]byte)}
+	trusted := make(map[PeerBan]bool)
+	ourself := bans.router.Ourself
+	for ban, signature := range state.Bans {
+		if len(signature) != ed25519.SignatureSize {
+			continue
+		}
+		received.Bans[ban] = signature
+		trusted[ban] = !ban.matches(ourself.Name, ourself.UID) && bans.trusted(ban, signature)
+	}
+	var enforced []PeerBan
+	bans.Lock()
+	for ban, signature := range received.Bans {
+		// a trusted signature replaces an untrusted one, so that
+		// peers can't suppress bans by relaying them signed otherwise
+		if existing, found := bans.state.Bans[ban]; found && existing != nil {
+			if !trusted[ban] || bans.trusted(ban, existing) {
+				continue
+			}
+			bans.untrusted--
+		}
+		if trusted[ban] {
+			bans.enforced[ban] = struct{}{}
+			enforced = append(enforced, ban)
+		} else if bans.untrusted < maxUntrustedBans {
+			bans.untrusted++
+		} else {
+			delete(received.Bans, ban)
+			continue
+		}
+		if delta == nil {
+			delta = &banState{Bans: make(map[PeerBan][]byte)}
+		}
+		bans.state.Bans[ban] = signature
+		delta.Bans[ban] = signature
+	}
+	bans.Unlock()
+	for _, ban := range enforced {
+		bans.router.logger.Printf("[gossip %s]: banned peer %s", banChannelName, ban)
+	}
+	if len(enforced) > 0 {
+		bans.router.closeBanned()
+	}
+	return received, delta, nil
+}
+
+// OnGossipUnicast implements Gossiper.
+func (bans *banList) OnGossipUnicast(src PeerName, msg []byte) error {
+	return fmt.Errorf("unexpected ban gossip unicast from %s", src)
+}
+
+// OnGossipBroadcast implements Gossiper, relaying the signed bans it
+// received even if they aren't news to us.
+func (bans *banList) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	received, _, err := bans.receive(update)
+	if err != nil || len(received.Bans) == 0 {
+		return nil, err
+	}
+	return received, nil
+}
+
+// Gossip implements Gossiper, with the bans which are signed.
+func (bans *banList) Gossip() GossipData {
+	bans.RLock()
+	defer bans.RUnlock()
+	complete := &banState{Bans: make(map[PeerBan][]byte)}
+	for ban, signature := range bans.state.Bans {
+		if signature != nil {
+			complete.Bans[ban] = signature
+		}
+	}
+	if len(complete.Bans) == 0 {
+		return nil
+	}
+	return complete
+}
+
+// OnGossip implements Gossiper.
+func (bans *banList) OnGossip(msg []byte) (GossipData, error) {
+	_, delta, err := bans.receive(msg)
+	if delta == nil {
+		return nil, err
+	}
+	return delta, nil
+}
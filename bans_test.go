@@ -0,0 +1,80 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestBanPeer(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, untrusted, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{BanSigningKey: private})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{BanTrustedKeys: []ed25519.PublicKey{public}})
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{BanSigningKey: untrusted})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+	addr2, close2 := listenTest(t, r2)
+	defer close2()
+	addr3, close3 := listenTest(t, r3)
+	defer close3()
+	r1.ConnectionMaker.InitiateConnections([]string{addr2, addr3}, false)
+	r3.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool {
+		return len(establishedTo(r1)) == 2 && len(establishedTo(r2)) == 2
+	})
+
+	// bans by untrusted keys are enforced only by those who make them
+	require.NoError(t, r3.BanPeer(r2.Ourself.Name))
+	waitUntil(t, func() bool { return len(establishedTo(r3)) == 1 })
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, r1.Bans())
+	require.Len(t, establishedTo(r1), 2)
+
+	// those by trusted keys are enforced by all who trust them
+	require.Error(t, r1.BanPeer(r1.Ourself.Name))
+	require.NoError(t, r1.BanPeerUID(r3.Ourself.UID))
+	waitUntil(t, func() bool {
+		return len(establishedTo(r1)) == 1 && len(r2.Bans()) == 1 && len(establishedTo(r3)) == 0
+	})
+	require.Equal(t, []PeerBan{{UID: r3.Ourself.UID}}, r2.Bans())
+	require.True(t, r2.banned(r3.Ourself.Name, r3.Ourself.UID))
+
+	// and further connections are refused
+	r3.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	time.Sleep(200 * time.Millisecond)
+	require.Empty(t, establishedTo(r3))
+}
+
+func TestBansRelayedByPeersNotTrustingThem(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	trusting := Config{BanTrustedKeys: []ed25519.PublicKey{public}}
+
+	// create the topology r1 <-> r2 <-> r3, where only r3 trusts r1
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{BanSigningKey: private})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", trusting)
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	ban := PeerBan{Name: r2.Ourself.Name}
+	require.NoError(t, r1.BanPeer(ban.Name))
+	sendPendingGossip(routers...)
+	require.Equal(t, []PeerBan{ban}, r3.Bans())
+	require.Empty(t, r2.Bans())
+	require.NotNil(t, r2.bans.Gossip())
+
+	// a ban signed for one mesh isn't trusted in another
+	other := newTestRouterWithConfig(t, "04:00:00:04:00:00", Config{MeshID: "other", BanTrustedKeys: trusting.BanTrustedKeys})
+	signature := ed25519.Sign(private, ban.signed(""))
+	require.True(t, r3.bans.trusted(ban, signature))
+	require.False(t, other.bans.trusted(ban, signature))
+}
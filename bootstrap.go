@@ -0,0 +1,224 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	defaultBootstrapTimeout  = 30 * time.Second
+	defaultBootstrapValidity = 24 * time.Hour
+	maxBootstrapClockSkew    = 5 * time.Minute
+	maxBootstrapDocSize      = 1 << 20
+)
+
+// BootstrapConfig describes where and how to fetch the initial peer list
+// and mesh parameters from a central control plane.
+type BootstrapConfig struct {
+	// URL of the bootstrap document. It must be https.
+	URL string
+	// PinnedKeys, if set, restricts the server to presenting a
+	// certificate whose SubjectPublicKeyInfo has one of these SHA-256
+	// hashes, in addition to the usual chain verification.
+	PinnedKeys [][]byte
+	// SigningKey verifies the signature on the bootstrap document.
+	SigningKey ed25519.PublicKey
+	// TLSConfig, if set, is used as the basis of the TLS client
+	// configuration, e.g. to supply RootCAs.
+	TLSConfig *tls.Config
+	// Timeout bounds the whole fetch; zero means 30s.
+	Timeout time.Duration
+	// MeshID must match that of the bootstrap document; see
+	// Config.MeshID.
+	MeshID string
+	// Clock, if set, is used to check the document hasn't expired,
+	// instead of the system clock.
+	Clock Clock
+}
+
+// BootstrapInfo is the initial peer list and mesh parameters served by
+// the control plane.
+type BootstrapInfo struct {
+	// Peers to connect to initially, in host:port format.
+	Peers []string `json:"peers"`
+	// The remaining fields override the corresponding Config fields
+	// when set.
+	ConnLimit          int    `json:"connLimit,omitempty"`
+	ProtocolMinVersion byte   `json:"protocolMinVersion,omitempty"`
+	PeerDiscovery      *bool  `json:"peerDiscovery,omitempty"`
+	GossipInterval     string `json:"gossipInterval,omitempty"`
+	GossipFanout       int    `json:"gossipFanout,omitempty"`
+	// IssuedAt and Expires bound when the document may be used, so
+	// that an old one can't be replayed, e.g. from a stale cache;
+	// FetchBootstrap rejects documents without an expiry.
+	IssuedAt time.Time `json:"issuedAt"`
+	Expires  time.Time `json:"expires"`
+	// MeshID is that of the mesh the document is for, so that it
+	// can't be used for any other.
+	MeshID string `json:"meshID,omitempty"`
+}
+
+// The signed envelope served at the bootstrap URL. Payload is the JSON
+// encoding of a BootstrapInfo, and Signature the ed25519 signature of
+// Payload.
+type bootstrapDocument struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// SignBootstrapInfo produces a bootstrap document for info, signed with
+// key, suitable for serving to FetchBootstrap. If info has no IssuedAt
+// or Expires, the document is issued now, to expire in 24h.
+func SignBootstrapInfo(info *BootstrapInfo, key ed25519.PrivateKey) ([]byte, error) {
+	signed := *info
+	if signed.IssuedAt.IsZero() {
+		signed.IssuedAt = time.Now().UTC()
+	}
+	if signed.Expires.IsZero() {
+		signed.Expires = signed.IssuedAt.Add(defaultBootstrapValidity)
+	}
+	payload, err := json.Marshal(&signed)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(bootstrapDocument{Payload: payload, Signature: ed25519.Sign(key, payload)})
+}
+
+// FetchBootstrap retrieves and verifies the bootstrap document described
+// by config.
+func FetchBootstrap(config BootstrapConfig) (*BootstrapInfo, error) {
+	if len(config.SigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bootstrap signing key must be %d bytes", ed25519.PublicKeySize)
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultBootstrapTimeout
+	}
+	transport := &http.Transport{TLSClientConfig: config.tlsConfig()}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: timeout, Transport: transport}
+	req, err := http.NewRequest("GET", config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("bootstrap URL %q is not https", config.URL)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bootstrap fetch from %s failed: %s", config.URL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBootstrapDocSize))
+	if err != nil {
+		return nil, err
+	}
+	return verifyBootstrapDocument(body, config)
+}
+
+// verifyBootstrapDocument checks the signature on the document in body,
+// and that it is current, and for our mesh, as configured by config.
+func verifyBootstrapDocument(body []byte, config BootstrapConfig) (*BootstrapInfo, error) {
+	var doc bootstrapDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("malformed bootstrap document: %v", err)
+	}
+	if !ed25519.Verify(config.SigningKey, doc.Payload, doc.Signature) {
+		return nil, fmt.Errorf("bootstrap document signature verification failed")
+	}
+	var info BootstrapInfo
+	if err := json.Unmarshal(doc.Payload, &info); err != nil {
+		return nil, fmt.Errorf("malformed bootstrap payload: %v", err)
+	}
+	now := config.clock().Now()
+	switch {
+	case info.Expires.IsZero():
+		return nil, fmt.Errorf("bootstrap document has no expiry")
+	case now.After(info.Expires):
+		return nil, fmt.Errorf("bootstrap document expired at %v", info.Expires)
+	case info.IssuedAt.After(now.Add(maxBootstrapClockSkew)):
+		return nil, fmt.Errorf("bootstrap document issued in the future, at %v", info.IssuedAt)
+	case info.MeshID != config.MeshID:
+		return nil, fmt.Errorf("bootstrap document is for mesh %q, not %q", info.MeshID, config.MeshID)
+	}
+	return &info, nil
+}
+
+func (config BootstrapConfig) clock() Clock {
+	if config.Clock == nil {
+		return realClock{}
+	}
+	return config.Clock
+}
+
+func (config BootstrapConfig) tlsConfig() *tls.Config {
+	var tlsConfig *tls.Config
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if len(config.PinnedKeys) > 0 {
+		pins := config.PinnedKeys
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("bootstrap server presented no certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(pin, hash[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("bootstrap server certificate does not match any pinned key")
+		}
+	}
+	return tlsConfig
+}
+
+// Apply overrides the parameters of config with those set in info.
+func (info *BootstrapInfo) Apply(config *Config) error {
+	if info.GossipInterval != "" {
+		interval, err := time.ParseDuration(info.GossipInterval)
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap gossip interval: %v", err)
+		}
+		config.GossipInterval = &interval
+	}
+	if info.ConnLimit != 0 {
+		config.ConnLimit = info.ConnLimit
+	}
+	if info.ProtocolMinVersion != 0 {
+		config.ProtocolMinVersion = info.ProtocolMinVersion
+	}
+	if info.PeerDiscovery != nil {
+		config.PeerDiscovery = *info.PeerDiscovery
+	}
+	if info.GossipFanout != 0 {
+		config.GossipFanout = info.GossipFanout
+	}
+	return nil
+}
+
+// Bootstrap initiates connections to the peers listed in info, as
+// targets of SourceBootstrap.
+func (router *Router) Bootstrap(info *BootstrapInfo) []error {
+	return router.ConnectionMaker.AddTargets(SourceBootstrap, info.Peers)
+}
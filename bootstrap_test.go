@@ -0,0 +1,95 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestFetchBootstrap(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	discovery := false
+	clock := NewManualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	info := &BootstrapInfo{
+		Peers:          []string{"10.0.0.1:6783"},
+		GossipInterval: "5s",
+		PeerDiscovery:  &discovery,
+		IssuedAt:       clock.Now(),
+		Expires:        clock.Now().Add(time.Hour),
+		MeshID:         "test",
+	}
+	doc, err := SignBootstrapInfo(info, priv)
+	require.NoError(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(doc)
+	}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	pin := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	config := BootstrapConfig{
+		URL:        server.URL,
+		PinnedKeys: [][]byte{pin[:]},
+		SigningKey: pub,
+		TLSConfig:  &tls.Config{RootCAs: roots},
+		MeshID:     "test",
+		Clock:      clock,
+	}
+
+	fetched, err := FetchBootstrap(config)
+	require.NoError(t, err)
+	require.Equal(t, info, fetched)
+	var meshConfig Config
+	require.NoError(t, fetched.Apply(&meshConfig))
+	require.Equal(t, 5*time.Second, *meshConfig.GossipInterval)
+	require.False(t, meshConfig.PeerDiscovery)
+
+	// a document for another mesh
+	config.MeshID = "other"
+	_, err = FetchBootstrap(config)
+	require.Error(t, err)
+	config.MeshID = "test"
+
+	// wrong pin
+	wrongPin := sha256.Sum256([]byte("not the server's key"))
+	config.PinnedKeys = [][]byte{wrongPin[:]}
+	_, err = FetchBootstrap(config)
+	require.Error(t, err)
+
+	// wrong signing key
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	config.PinnedKeys = nil
+	config.SigningKey = otherPub
+	_, err = FetchBootstrap(config)
+	require.Error(t, err)
+
+	// an expired document
+	config.SigningKey = pub
+	clock.Advance(2 * time.Hour)
+	_, err = FetchBootstrap(config)
+	require.Error(t, err)
+}
+
+func TestSignBootstrapInfoExpires(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	doc, err := SignBootstrapInfo(&BootstrapInfo{Peers: []string{"10.0.0.1:6783"}}, priv)
+	require.NoError(t, err)
+	info, err := verifyBootstrapDocument(doc, BootstrapConfig{SigningKey: pub})
+	require.NoError(t, err)
+	require.Equal(t, defaultBootstrapValidity, info.Expires.Sub(info.IssuedAt))
+
+	clock := NewManualClock(time.Now().Add(defaultBootstrapValidity + time.Minute))
+	_, err = verifyBootstrapDocument(doc, BootstrapConfig{SigningKey: pub, Clock: clock})
+	require.Error(t, err)
+}
@@ -0,0 +1,152 @@
+package mesh
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// BroadcastStrategy chooses the neighbours to which a channel sends the
+// broadcasts it originates and relays; see
+// GossipChannelConfig.Broadcast. It is invoked concurrently, on the hot
+// path, so must be fast.
+type BroadcastStrategy interface {
+	Targets(BroadcastHop) []PeerName
+}
+
+// BroadcastHop describes a broadcast about to be sent on by us.
+type BroadcastHop struct {
+	Origin PeerName // the peer which originated the broadcast, perhaps us
+	Sender PeerName // the neighbour we received it from, or us
+
+	// Tree is the next hops of the spanning tree rooted at Origin, as
+	// calculated from our view of the topology.
+	Tree []PeerName
+
+	// Neighbours are the peers we have connections to, and Peers the
+	// number of peers we can reach, including us.
+	Neighbours []PeerName
+	Peers      int
+
+	Rand Rand
+}
+
+// SpanningTreeBroadcast sends each broadcast along the spanning tree
+// rooted at its origin, so that each peer receives it once, as long as
+// the views of the topology of the peers on the way agree. Channels
+// without a BroadcastStrategy behave likewise.
+type SpanningTreeBroadcast struct{}
+
+// Targets implements BroadcastStrategy.
+func (SpanningTreeBroadcast) Targets(hop BroadcastHop) []PeerName {
+	return hop.Tree
+}
+
+// EpidemicBroadcast sends each broadcast to Fanout neighbours chosen at
+// random, other than the one it came from, each of which does likewise
+// the first time it receives it. That sends more frames than spanning
+// trees do, but reaches every peer with high probability, whatever
+// their views of the topology, so fares better while it is changing,
+// when the spanning trees of different peers can momentarily disagree
+// and leave some peers out.
+type EpidemicBroadcast struct {
+	// Fanout is the number of neighbours each peer sends a broadcast
+	// to. Zero means one more than log2 of the number of peers.
+	Fanout int
+}
+
+// Targets implements BroadcastStrategy.
+func (e EpidemicBroadcast) Targets(hop BroadcastHop) []PeerName {
+	fanout := e.Fanout
+	if fanout <= 0 {
+		fanout = int(math.Ceil(math.Log2(float64(hop.Peers)))) + 1
+	}
+	candidates := make([]PeerName, 0, len(hop.Neighbours))
+	for _, name := range hop.Neighbours {
+		if name != hop.Sender && name != hop.Origin {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) <= fanout {
+		return candidates
+	}
+	hop.Rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return candidates[:fanout]
+}
+
+// The number of broadcast IDs each channel remembers, so as to ignore
+// the broadcasts it has already seen.
+const recentBroadcasts = 4096
+
+// broadcastIDs remembers the IDs of the broadcasts seen most recently,
+// on channels with a BroadcastStrategy, whose broadcasts may reach a
+// peer more than once.
+type broadcastIDs struct {
+	sync.Mutex
+	ids  map[uint64]struct{}
+	ring []uint64
+	next int
+}
+
+func newBroadcastIDs() *broadcastIDs {
+	return &broadcastIDs{ids: make(map[uint64]struct{}), ring: make([]uint64, recentBroadcasts)}
+}
+
+// add records ids, returning whether any of them hadn't been seen.
+func (b *broadcastIDs) add(ids []uint64) bool {
+	b.Lock()
+	defer b.Unlock()
+	fresh := false
+	for _, id := range ids {
+		if _, found := b.ids[id]; found {
+			continue
+		}
+		fresh = true
+		delete(b.ids, b.ring[b.next])
+		b.ring[b.next] = id
+		b.next = (b.next + 1) % len(b.ring)
+		b.ids[id] = struct{}{}
+	}
+	return fresh
+}
+
+// stampBroadcastID gives a broadcast originating from us an ID, if the
+// channel has a BroadcastStrategy, remembering it so that we ignore the
+// broadcast should it come back.
+func (c *GossipChannel) stampBroadcastID(meta *gossipFrameMeta) {
+	if c.seen == nil {
+		return
+	}
+	id := c.ourself.router.rng().Uint64()
+	meta.BroadcastIDs = []uint64{id}
+	c.seen.add(meta.BroadcastIDs)
+}
+
+// duplicateBroadcast reports, and counts, whether a broadcast received
+// has been seen already. Broadcasts without IDs never have.
+func (c *GossipChannel) duplicateBroadcast(meta gossipFrameMeta) bool {
+	if c.seen == nil || len(meta.BroadcastIDs) == 0 || c.seen.add(meta.BroadcastIDs) {
+		return false
+	}
+	atomic.AddUint64(&c.counters.duplicates, 1)
+	return true
+}
+
+// broadcastTargets returns the neighbours to which the channel's
+// BroadcastStrategy sends a broadcast from srcName received from
+// sender.
+func (c *GossipChannel) broadcastTargets(srcName, sender PeerName) []PeerName {
+	hop := BroadcastHop{
+		Origin: srcName,
+		Sender: sender,
+		Tree:   c.routes.BroadcastAll(srcName),
+		Rand:   c.ourself.router.rng(),
+	}
+	c.routes.RLock()
+	hop.Peers = len(c.routes.unicastAll)
+	c.routes.RUnlock()
+	for conn := range c.ourself.getConnections() {
+		hop.Neighbours = append(hop.Neighbours, conn.Remote().Name)
+	}
+	return c.config.Broadcast.Targets(hop)
+}
@@ -0,0 +1,85 @@
+package mesh
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEpidemicBroadcastTargets(t *testing.T) {
+	hop := BroadcastHop{
+		Origin:     PeerName(1),
+		Sender:     PeerName(2),
+		Neighbours: []PeerName{1, 2, 3, 4, 5, 6},
+		Peers:      8,
+		Rand:       rand.New(rand.NewSource(1)),
+	}
+	require.Len(t, EpidemicBroadcast{Fanout: 2}.Targets(hop), 2)
+	// log2(8)+1 is more than the neighbours left
+	require.ElementsMatch(t, []PeerName{3, 4, 5, 6}, EpidemicBroadcast{}.Targets(hop))
+}
+
+func TestBroadcastIDs(t *testing.T) {
+	seen := newBroadcastIDs()
+	require.True(t, seen.add([]uint64{1, 2}))
+	require.False(t, seen.add([]uint64{2}))
+	require.True(t, seen.add([]uint64{2, 3}))
+	for id := uint64(4); id < 4+recentBroadcasts; id++ {
+		seen.add([]uint64{id})
+	}
+	require.True(t, seen.add([]uint64{1}), "oldest forgotten")
+}
+
+type countingGossiper struct {
+	*testGossiper
+	broadcasts int32
+}
+
+func (g *countingGossiper) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	atomic.AddInt32(&g.broadcasts, 1)
+	return g.testGossiper.OnGossipBroadcast(src, update)
+}
+
+func TestEpidemicBroadcast(t *testing.T) {
+	var routers []*Router
+	var gossipers []*countingGossiper
+	var channels []*GossipChannel
+	for _, name := range []string{"01:00:00:01:00:00", "02:00:00:02:00:00", "03:00:00:03:00:00"} {
+		r := newTestRouter(t, name)
+		defer r.Stop()
+		g := &countingGossiper{testGossiper: newTestGossiper()}
+		c, err := r.NewGossipChannel("Test", g, GossipChannelConfig{Broadcast: EpidemicBroadcast{}})
+		require.NoError(t, err)
+		routers, gossipers, channels = append(routers, r), append(gossipers, g), append(channels, c)
+	}
+	// a triangle, so that each broadcast reaches the others twice
+	addr1, close1 := listenTest(t, routers[0])
+	defer close1()
+	addr2, close2 := listenTest(t, routers[1])
+	defer close2()
+	routers[1].ConnectionMaker.InitiateConnections([]string{addr1}, false)
+	routers[2].ConnectionMaker.InitiateConnections([]string{addr1, addr2}, false)
+	waitUntil(t, func() bool {
+		for _, r := range routers {
+			if len(establishedTo(r)) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// a peer which hears of it from the other first relays it nowhere,
+	// so only one duplicate is sure to arrive
+	broadcast(channels[0], 7)
+	waitUntil(t, func() bool {
+		return atomic.LoadInt32(&gossipers[1].broadcasts) > 0 && atomic.LoadInt32(&gossipers[2].broadcasts) > 0 &&
+			channels[1].Stats().Duplicates+channels[2].Stats().Duplicates > 0
+	})
+	for _, g := range gossipers[1:] {
+		g.checkHas(t, 7)
+		require.Equal(t, int32(1), atomic.LoadInt32(&g.broadcasts))
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&gossipers[0].broadcasts))
+}
@@ -0,0 +1,132 @@
+package mesh
+
+import (
+	"encoding"
+	"encoding/gob"
+	"reflect"
+	"sync"
+)
+
+// Frames are assembled in scratch buffers on their way to the network,
+// which are finished with as soon as the frames have been written, so
+// are recycled rather than left to the garbage collector. Buffers
+// larger than this aren't, so that the occasional large frame doesn't
+// pin its memory.
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// getBuffer returns an empty scratch buffer with room for n bytes.
+func getBuffer(n int) *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, 0, n)
+	}
+	*b = (*b)[:0]
+	return b
+}
+
+// putBuffer recycles b, which must no longer be referenced.
+func putBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledBuffer {
+		bufferPool.Put(b)
+	}
+}
+
+// gobEncode gob-encodes each item and returns the resulting byte slice.
+// Items of the basic types which make up most of each frame - strings,
+// byte slices, unsigned integers and PeerNames - are encoded directly,
+// as gob would, without the expense of an encoder, and the rest with
+// one, all into a scratch buffer, so the result is only allocated, at
+// its final size, once.
+func gobEncode(items ...interface{}) []byte {
+	w := &appendWriter{buf: getBuffer(256)}
+	defer putBuffer(w.buf)
+	var enc *gob.Encoder
+	for _, i := range items {
+		if buf, ok := appendGobBasic(*w.buf, i); ok {
+			*w.buf = buf
+			continue
+		}
+		if enc == nil {
+			enc = gob.NewEncoder(w)
+		}
+		if err := enc.Encode(i); err != nil {
+			panic(err)
+		}
+	}
+	return append([]byte(nil), *w.buf...)
+}
+
+// appendWriter is an io.Writer appending to a buffer.
+type appendWriter struct {
+	buf *[]byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	*w.buf = append(*w.buf, p...)
+	return len(p), nil
+}
+
+// The ids gob gives its predefined types.
+const (
+	gobUintID   = 3
+	gobBytesID  = 5
+	gobStringID = 6
+)
+
+// appendGobBasic appends the gob encoding of item, as a message on its
+// own, to buf, if it is of one of the basic types, whose encoding
+// doesn't depend on the state of the encoder.
+func appendGobBasic(buf []byte, item interface{}) ([]byte, bool) {
+	switch item.(type) {
+	case gob.GobEncoder, encoding.BinaryMarshaler, encoding.TextMarshaler:
+		return buf, false
+	}
+	v := reflect.ValueOf(item)
+	var scratch [9]byte
+	var id byte
+	var prefix []byte // the value, or the length of a string or bytes
+	var s string
+	var b []byte
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		id, prefix = gobUintID, appendGobUint(scratch[:0], v.Uint())
+	case reflect.String:
+		s = v.String()
+		id, prefix = gobStringID, appendGobUint(scratch[:0], uint64(len(s)))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return buf, false
+		}
+		b = v.Bytes()
+		id, prefix = gobBytesID, appendGobUint(scratch[:0], uint64(len(b)))
+	default:
+		return buf, false
+	}
+	// a message is its length, then the type id, then a zero field
+	// delta, as for all values other than structs, then the value
+	buf = appendGobUint(buf, uint64(2+len(prefix)+len(s)+len(b)))
+	buf = append(buf, id<<1, 0)
+	buf = append(buf, prefix...)
+	buf = append(buf, s...)
+	return append(buf, b...), true
+}
+
+// appendGobUint appends x as gob encodes unsigned integers: as a byte,
+// if less than 128, and otherwise as a big-endian byte string preceded
+// by its negated length.
+func appendGobUint(buf []byte, x uint64) []byte {
+	if x < 0x80 {
+		return append(buf, byte(x))
+	}
+	n := 0
+	for y := x; y > 0; y >>= 8 {
+		n++
+	}
+	buf = append(buf, byte(-n))
+	for i := n - 1; i >= 0; i-- {
+		buf = append(buf, byte(x>>(8*uint(i))))
+	}
+	return buf
+}
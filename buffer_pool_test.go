@@ -0,0 +1,109 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// referenceGobEncode encodes items with a gob encoder, as gobEncode
+// used to.
+func referenceGobEncode(items ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	for _, i := range items {
+		if err := enc.Encode(i); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestGobEncode(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	long := strings.Repeat("x", 300)
+	meta := gossipFrameMeta{MsgIDs: []uint64{1, 2}, TTL: 64}
+	for _, items := range [][]interface{}{
+		{"", []byte{}, uint64(0)},
+		{"channel", name, []byte("payload"), uint64(127), uint64(128), uint32(1 << 31), uint64(1<<64 - 1)},
+		{long, []byte(long)},
+		{"channel", name, name, []byte("payload"), meta},
+		{meta, "between", meta, map[string]int{"a": 1}},
+	} {
+		require.Equal(t, referenceGobEncode(items...), gobEncode(items...))
+	}
+
+	// which decodes as usual
+	dec := gob.NewDecoder(bytes.NewReader(gobEncode("channel", name, meta, []byte("payload"))))
+	var channel string
+	var decodedName PeerName
+	var decodedMeta gossipFrameMeta
+	var payload []byte
+	require.NoError(t, dec.Decode(&channel))
+	require.NoError(t, dec.Decode(&decodedName))
+	require.NoError(t, dec.Decode(&decodedMeta))
+	require.NoError(t, dec.Decode(&payload))
+	require.Equal(t, "channel", channel)
+	require.Equal(t, name, decodedName)
+	require.Equal(t, meta, decodedMeta)
+	require.Equal(t, []byte("payload"), payload)
+}
+
+func BenchmarkGobEncode(b *testing.B) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	payload := make([]byte, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		gobEncode("channel", name, payload)
+	}
+}
+
+func BenchmarkGobEncodeReference(b *testing.B) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	payload := make([]byte, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		referenceGobEncode("channel", name, payload)
+	}
+}
+
+func BenchmarkLengthPrefixSend(b *testing.B) {
+	sender := newLengthPrefixTCPSender(ioutil.Discard)
+	msg := make([]byte, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := sender.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLengthPrefixSendReference(b *testing.B) {
+	msg := make([]byte, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		prefixedMsg := make([]byte, 4+len(msg))
+		binary.BigEndian.PutUint32(prefixedMsg, uint32(len(msg)))
+		copy(prefixedMsg[4:], msg)
+		if _, err := ioutil.Discard.Write(prefixedMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptedSend(b *testing.B) {
+	var key [32]byte
+	sender := newEncryptedTCPSender(newLengthPrefixTCPSender(ioutil.Discard), &key, true)
+	msg := make([]byte, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := sender.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package mesh
+
+// ChannelACL restricts which peers may send and receive on a gossip
+// channel, so that a channel can be kept to a subset of the mesh even
+// though the topology is shared with all of it. Frames the ACL denies
+// are neither sent nor delivered, and so not relayed either: the
+// peers allowed on the channel must be connected amongst themselves.
+//
+// Gossip, being merged state, counts as sent by the peer gossiping it,
+// as does a broadcast by the peer which originates it. Unicasts may
+// also be sent to Senders by any of the Receivers, e.g. to reply to
+// them, or to acknowledge what they sent.
+//
+// Frames are only accepted from neighbours which may receive them
+// themselves, and gossip only from the neighbour it claims to come
+// from. The origin of a frame relayed by a Receiver can't be checked
+// any further, so the ACL keeps a channel from the rest of the mesh,
+// not its members from one another.
+type ChannelACL struct {
+	// Senders may originate frames on the channel, and receive them;
+	// nil means any peer may.
+	Senders []PeerName
+	// Receivers may receive frames on the channel; nil means any peer
+	// may.
+	Receivers []PeerName
+}
+
+// compiledACL is a ChannelACL as sets, for the checks on the hot path.
+// A nil set allows every peer.
+type compiledACL struct {
+	senders, receivers peerNameSet
+}
+
+func compileACL(acl *ChannelACL) *compiledACL {
+	if acl == nil {
+		return nil
+	}
+	compiled := &compiledACL{}
+	if acl.Senders != nil {
+		compiled.senders = make(peerNameSet)
+		for _, name := range acl.Senders {
+			compiled.senders[name] = struct{}{}
+		}
+	}
+	if acl.Receivers != nil {
+		compiled.receivers = make(peerNameSet)
+		for _, name := range acl.Receivers {
+			compiled.receivers[name] = struct{}{}
+		}
+		for name := range compiled.senders {
+			compiled.receivers[name] = struct{}{}
+		}
+	}
+	return compiled
+}
+
+func (acl *compiledACL) sender(name PeerName) bool {
+	_, found := acl.senders[name]
+	return acl.senders == nil || found
+}
+
+func (acl *compiledACL) receiver(name PeerName) bool {
+	_, found := acl.receivers[name]
+	return acl.receivers == nil || found
+}
+
+// carriesPayload returns whether frames with tag carry a payload of the
+// channel, unlike digests and error reports.
+func carriesPayload(tag protocolTag) bool {
+	switch tag {
+	case ProtocolGossip, ProtocolGossipBroadcast, ProtocolGossipMulticast, ProtocolGossipUnicast:
+		return true
+	}
+	return false
+}
+
+// permits reports whether the frame m, by route, may be sent to, or
+// received by, the peer hop.
+func (acl *compiledACL) permits(m protocolMsg, route frameRoute, hop PeerName) bool {
+	if !acl.receiver(hop) {
+		return false
+	}
+	if !carriesPayload(m.tag) || acl.senders == nil {
+		return true
+	}
+	return acl.sender(route.origin) ||
+		(m.tag == ProtocolGossipUnicast && acl.receiver(route.origin) && acl.sender(route.dst))
+}
+
+// admits reports whether the frame m, received by us, ourName, from
+// the neighbour sender, may be delivered and relayed. Unlike permits,
+// it checks the claimed origin against the peer the frame came from.
+func (acl *compiledACL) admits(m protocolMsg, ourName, sender PeerName) bool {
+	if !acl.receiver(ourName) || !acl.receiver(sender) {
+		return false
+	}
+	if !carriesPayload(m.tag) || acl.senders == nil {
+		return true
+	}
+	req, err := decodeRelayRequest(m)
+	if err != nil || !acl.permits(m, frameRoute{req.Origin, req.Destination}, ourName) {
+		return false
+	}
+	// gossip isn't relayed as is, but merged, so always comes from
+	// its origin
+	return m.tag != ProtocolGossip || req.Origin == sender
+}
+
+// allowedBy checks m, by route, against the channel's ACL, if any, as
+// sent to the peer hop.
+func (c *GossipChannel) allowedBy(m protocolMsg, route frameRoute, hop PeerName) bool {
+	return c.acl == nil || c.acl.permits(m, route, hop)
+}
+
+// admittedFrom checks m, received from the neighbour sender, against
+// the channel's ACL, if any.
+func (c *GossipChannel) admittedFrom(m protocolMsg, sender PeerName) bool {
+	return c.acl == nil || c.acl.admits(m, c.ourself.Name, sender)
+}
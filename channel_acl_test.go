@@ -0,0 +1,64 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelACL(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3, where only r1 may send on
+	// the "Secret" channel, and only r2 receive
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	config := GossipChannelConfig{ACL: &ChannelACL{
+		Senders:   []PeerName{r1.Ourself.Name},
+		Receivers: []PeerName{r2.Ourself.Name},
+	}}
+	g1 := &unicastChannel{newTestGossiper(), make(chan []byte, 1)}
+	g2, g3 := newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewGossipChannel("Secret", g1, config)
+	require.NoError(t, err)
+	s2, err := r2.NewGossipChannel("Secret", g2, config)
+	require.NoError(t, err)
+	// r3 doesn't know of the ACL, so would send and receive anything
+	s3, err := r3.NewGossipChannel("Secret", g3, GossipChannelConfig{})
+	require.NoError(t, err)
+
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 1)
+	require.Empty(t, g3.state)
+
+	// receivers may reply to senders, but not send to others
+	require.NoError(t, s2.GossipUnicast(r1.Ourself.Name, []byte{2}))
+	require.Equal(t, []byte{2}, <-g1.unicasts)
+	require.Equal(t, errRelayDenied, s2.GossipUnicast(r3.Ourself.Name, []byte{3}))
+	broadcast(s2, 4)
+	sendPendingGossip(routers...)
+	require.Empty(t, g3.state)
+	_, found := g1.state[4]
+	require.False(t, found)
+
+	// and what others send is dropped on receipt
+	broadcast(s3, 5)
+	sendPendingGossip(routers...)
+	_, found = g2.state[5]
+	require.False(t, found)
+
+	// as is what they relay, whatever origin it claims, or whoever it
+	// is addressed to
+	conn, found := r3.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, found)
+	require.NoError(t, s3.sendTo(conn, s3.makeBroadcastMsg(r1.Ourself.Name, []byte{6}, gossipFrameMeta{}), frameRoute{origin: r1.Ourself.Name}))
+	_, found = g2.state[6]
+	require.False(t, found)
+	require.NoError(t, s3.GossipUnicast(r1.Ourself.Name, []byte{7}))
+	require.Empty(t, g1.unicasts)
+}
@@ -0,0 +1,100 @@
+package mesh
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ChannelStats counts the traffic of a gossip channel since it was
+// made, so that the channels which dominate it can be told apart.
+type ChannelStats struct {
+	Channel string
+
+	// MessagesSent and BytesSent count the frames we sent neighbours,
+	// once for each neighbour, whether we originated them or relayed
+	// them; MessagesReceived and BytesReceived count those neighbours
+	// sent us.
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+
+	// MessagesRelayed counts the broadcasts and unicasts received
+	// which we relayed on towards other peers.
+	MessagesRelayed uint64
+
+	// Merges counts the gossip received which the Gossiper merged into
+	// its state, changing it.
+	Merges uint64
+
+	// Dropped counts the frames received which were denied by the
+	// channel's ACL, or whose TTL was exhausted, the unicasts we
+	// couldn't relay, and the gossip discarded from full queues.
+	Dropped uint64
+
+	// Duplicates counts the broadcasts received which had been seen
+	// already, on channels with a BroadcastStrategy.
+	Duplicates uint64
+}
+
+// channelCounters are the counters behind ChannelStats, accessed
+// atomically.
+type channelCounters struct {
+	sent, received           uint64
+	bytesSent, bytesReceived uint64
+	relayed, merges          uint64
+	denied, queueDropped     uint64
+	duplicates               uint64
+}
+
+func (c *GossipChannel) countSent(n int) {
+	atomic.AddUint64(&c.counters.sent, 1)
+	atomic.AddUint64(&c.counters.bytesSent, uint64(n))
+}
+
+func (c *GossipChannel) countReceived(n int) {
+	atomic.AddUint64(&c.counters.received, 1)
+	atomic.AddUint64(&c.counters.bytesReceived, uint64(n))
+}
+
+func (c *GossipChannel) countRelayed() { atomic.AddUint64(&c.counters.relayed, 1) }
+
+func (c *GossipChannel) countDenied() { atomic.AddUint64(&c.counters.denied, 1) }
+
+func (c *GossipChannel) countQueueDropped() { atomic.AddUint64(&c.counters.queueDropped, 1) }
+
+// countMerge counts the update which the Gossiper returned for gossip
+// received, if it changed the Gossiper's state.
+func (c *GossipChannel) countMerge(update GossipData, err error) {
+	if err == nil && update != nil {
+		atomic.AddUint64(&c.counters.merges, 1)
+	}
+}
+
+// Stats returns the channel's traffic since it was made.
+func (c *GossipChannel) Stats() ChannelStats {
+	return ChannelStats{
+		Channel:          c.name,
+		MessagesSent:     atomic.LoadUint64(&c.counters.sent),
+		MessagesReceived: atomic.LoadUint64(&c.counters.received),
+		BytesSent:        atomic.LoadUint64(&c.counters.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&c.counters.bytesReceived),
+		MessagesRelayed:  atomic.LoadUint64(&c.counters.relayed),
+		Merges:           atomic.LoadUint64(&c.counters.merges),
+		Dropped: atomic.LoadUint64(&c.counters.denied) +
+			atomic.LoadUint64(&c.counters.queueDropped) +
+			atomic.LoadUint64(&c.ttlExceeded) +
+			atomic.LoadUint64(&c.deadLetters),
+		Duplicates: atomic.LoadUint64(&c.counters.duplicates),
+	}
+}
+
+// ChannelStats returns the Stats of every channel, sorted by channel.
+func (router *Router) ChannelStats() []ChannelStats {
+	var result []ChannelStats
+	for channel := range router.gossipChannelSet() {
+		result = append(result, channel.Stats())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Channel < result[j].Channel })
+	return result
+}
@@ -0,0 +1,58 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelStats(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+	g1, g2, g3 := newTestGossiper(), newTestGossiper(), newTestGossiper()
+	c1, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	c2, err := r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	addr2, close2 := listenTest(t, r2)
+	defer close2()
+	r1.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	r3.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool {
+		r1.Routes.recalculate()
+		_, found := r1.Routes.Unicast(r3.Ourself.Name)
+		return found
+	})
+
+	// r2 relays r1's broadcast to r3, merging it on the way
+	broadcast(c1, 7)
+	waitUntil(t, func() bool {
+		g3.RLock()
+		defer g3.RUnlock()
+		_, found := g3.state[7]
+		return found
+	})
+	stats := c2.(*GossipChannel).Stats()
+	require.Equal(t, "Test", stats.Channel)
+	require.True(t, stats.MessagesReceived >= 1)
+	require.True(t, stats.BytesReceived > 0)
+	require.True(t, stats.MessagesRelayed >= 1)
+	require.True(t, stats.Merges >= 1)
+	require.True(t, stats.MessagesSent >= 1)
+
+	var found bool
+	for _, s := range NewStatus(r1).Channels {
+		if s.Channel == "Test" {
+			found = true
+			require.True(t, s.MessagesSent >= 1)
+		}
+	}
+	require.True(t, found)
+}
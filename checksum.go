@@ -0,0 +1,131 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Neighbours which advertise this feature append CRC-32Cs to each frame,
+// on connections which aren't encrypted, where nothing else would catch
+// frames corrupted on the way, e.g. by faulty NICs or middleboxes: one
+// of its body, and one of its header, i.e. its length and tag. Frames
+// with a corrupt body are dropped, rather than being decoded, and the
+// remote is asked, with ProtocolResync, to send us the complete state
+// of every channel, in place of whatever we missed. A corrupt header
+// means the framing can't be relied on, and a corrupt flow control or
+// fragment frame leaves the connection's windows or reassembly wrong,
+// so either closes the connection.
+const featureChecksums = "checksums"
+
+// Resyncs are requested at most this often per connection, lest a
+// corrupting link be swamped by the state sent in reply.
+const resyncInterval = 5 * time.Second
+
+var (
+	errCorruptFrame       = errors.New("frame checksum mismatch")
+	errCorruptHeader      = errors.New("frame header checksum mismatch")
+	errCorruptFlowControl = errors.New("flow control or fragment frame checksum mismatch")
+	crc32c                = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// The bytes of checksums appended to each frame.
+const checksumsSize = 2 * crc32.Size
+
+// checksumTCPSender implements tcpSender by appending a checksum to
+// each msg.
+type checksumTCPSender struct {
+	sender tcpSender
+}
+
+func newChecksumTCPSender(sender tcpSender) *checksumTCPSender {
+	return &checksumTCPSender{sender: sender}
+}
+
+// Send implements tcpSender.
+func (sender *checksumTCPSender) Send(msg []byte) error {
+	buf := getBuffer(len(msg) + checksumsSize)
+	defer putBuffer(buf)
+	summed := append(append(*buf, msg...), make([]byte, checksumsSize)...)
+	binary.BigEndian.PutUint32(summed[len(msg):], crc32.Checksum(msg, crc32c))
+	binary.BigEndian.PutUint32(summed[len(msg)+crc32.Size:], headerChecksum(summed))
+	return sender.sender.Send(summed)
+}
+
+// headerChecksum returns the checksum of the header of frame, with its
+// checksums appended: its length, as prefixed to it on the wire, and
+// its tag.
+func headerChecksum(frame []byte) uint32 {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(frame)))
+	if len(frame) > checksumsSize {
+		header[4] = frame[0]
+	}
+	return crc32.Checksum(header[:], crc32c)
+}
+
+// fatalCorruption reports whether a corrupt frame with tag must close
+// the connection, rather than just being dropped.
+func fatalCorruption(tag protocolTag) bool {
+	return tag == ProtocolWindowUpdate || tag == ProtocolFragment || tag == ProtocolStreamFragment
+}
+
+// checksumTCPReceiver implements tcpReceiver by checking, and removing,
+// the checksums of each msg, returning errCorruptFrame if the body's is
+// wrong, or another error, which should close the connection, if the
+// header's is, or the frame is one which can't be dropped.
+type checksumTCPReceiver struct {
+	receiver tcpReceiver
+}
+
+func newChecksumTCPReceiver(receiver tcpReceiver) *checksumTCPReceiver {
+	return &checksumTCPReceiver{receiver: receiver}
+}
+
+// Receive implements tcpReceiver.
+func (receiver *checksumTCPReceiver) Receive() ([]byte, error) {
+	msg, err := receiver.receiver.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < checksumsSize {
+		return nil, errCorruptHeader
+	}
+	l := len(msg) - checksumsSize
+	if binary.BigEndian.Uint32(msg[l+crc32.Size:]) != headerChecksum(msg) {
+		return nil, errCorruptHeader
+	}
+	if binary.BigEndian.Uint32(msg[l:]) != crc32.Checksum(msg[:l], crc32c) {
+		if l > 0 && fatalCorruption(protocolTag(msg[0])) {
+			return nil, errCorruptFlowControl
+		}
+		return nil, errCorruptFrame
+	}
+	return msg[:l], nil
+}
+
+// useChecksums wraps the sender and receiver of the connection with
+// checksums, if the remote supports them and the connection isn't
+// encrypted.
+func (conn *LocalConnection) useChecksums(intro *protocolIntroResults) {
+	if intro.Cipher != "" || !conn.features.both(featureChecksums) {
+		return
+	}
+	conn.tcpSender = newChecksumTCPSender(conn.tcpSender)
+	intro.Receiver = newChecksumTCPReceiver(intro.Receiver)
+}
+
+// corruptFrame counts a corrupt frame received, and asks the remote to
+// resync, unless it has been asked to recently. Only called by the
+// receiving goroutine, which mustn't block on writes.
+func (conn *LocalConnection) corruptFrame() error {
+	conn.stats.corrupt()
+	now := conn.router.clock().Now()
+	if now.Sub(conn.lastResync) < resyncInterval {
+		return nil
+	}
+	conn.logf("dropped a corrupt frame; asking for resync")
+	conn.lastResync = now
+	return conn.frames.post([]byte{ProtocolResync})
+}
@@ -0,0 +1,112 @@
+package mesh
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumTCPSenderReceiver(t *testing.T) {
+	var buf bytes.Buffer
+	sender := newChecksumTCPSender(newLengthPrefixTCPSender(&buf))
+	receiver := newChecksumTCPReceiver(newLengthPrefixTCPReceiver(&buf))
+
+	require.NoError(t, sender.Send([]byte("hello")))
+	msg, err := receiver.Receive()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), msg)
+
+	require.NoError(t, sender.Send([]byte("hello")))
+	buf.Bytes()[5] ^= 1
+	_, err = receiver.Receive()
+	require.Equal(t, errCorruptFrame, err)
+	// framing is intact, so the next frame is fine
+	require.NoError(t, sender.Send([]byte("world")))
+	msg, err = receiver.Receive()
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), msg)
+
+	// a corrupt length or tag, or flow control frame, is fatal
+	require.NoError(t, sender.Send([]byte("hello")))
+	buf.Bytes()[3] ^= 1
+	_, err = receiver.Receive()
+	require.Equal(t, errCorruptHeader, err)
+	buf.Reset()
+	require.NoError(t, sender.Send([]byte("hello")))
+	buf.Bytes()[4] ^= 1
+	_, err = receiver.Receive()
+	require.Equal(t, errCorruptHeader, err)
+	for _, tag := range []protocolTag{ProtocolWindowUpdate, ProtocolFragment, ProtocolStreamFragment} {
+		buf.Reset()
+		require.NoError(t, sender.Send([]byte{byte(tag), 1, 2, 3}))
+		buf.Bytes()[5] ^= 1
+		_, err = receiver.Receive()
+		require.Equal(t, errCorruptFlowControl, err)
+	}
+}
+
+// corruptingConn flips a bit of the body of the first frame read once
+// armed which may be dropped, sparing the length prefixes, which are
+// read on their own, and the tag, which comes first.
+type corruptingConn struct {
+	net.Conn
+	armed int32
+}
+
+func (c *corruptingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 1 && len(p) != 4 && !fatalCorruption(protocolTag(p[0])) && atomic.CompareAndSwapInt32(&c.armed, 1, 0) {
+		p[1] ^= 1
+	}
+	return n, err
+}
+
+func TestCorruptFrameResync(t *testing.T) {
+	heartbeat, gossipInterval := 50*time.Millisecond, time.Hour
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{HeartbeatInterval: heartbeat, GossipInterval: &gossipInterval})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{HeartbeatInterval: heartbeat, GossipInterval: &gossipInterval})
+	defer r1.Stop()
+	defer r2.Stop()
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	_, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	conns := make(chan *corruptingConn, 1)
+	go func() {
+		tcpConn, err := ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		conn := &corruptingConn{Conn: tcpConn}
+		conns <- conn
+		r2.acceptPreread(conn, nil)
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool { return len(establishedTo(r2)) == 1 })
+
+	// state r2 would otherwise only hear of in an hour
+	g1.Lock()
+	g1.state[7] = struct{}{}
+	g1.Unlock()
+	atomic.StoreInt32(&(<-conns).armed, 1)
+	waitUntil(t, func() bool {
+		g2.RLock()
+		defer g2.RUnlock()
+		_, found := g2.state[7]
+		return found
+	})
+	conn, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+	require.True(t, found)
+	stats, _ := conn.(*LocalConnection).stats.snapshot()
+	require.Equal(t, uint64(1), stats.CorruptFrames)
+	require.Len(t, establishedTo(r2), 1)
+}
@@ -0,0 +1,221 @@
+package mesh
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for a Router: the timers and tickers of
+// gossip, heartbeats, retries and rate limits, and the timestamps they
+// are compared with. Setting Config.Clock to a ManualClock, along with
+// Config.Rand, makes a Router deterministic enough to simulate, and to
+// test timeouts without waiting for them. The deadlines of real
+// network connections always follow the wall clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a time.Timer from a Clock. Chan is nil for timers made by
+// AfterFunc.
+type Timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker from a Clock.
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+type realTimer struct{ *time.Timer }
+
+type realTicker struct{ *time.Ticker }
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
+
+// sleep blocks for d according to clock.
+func sleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-clock.NewTimer(d).Chan()
+}
+
+// sleepContext blocks for d according to clock, or until ctx is done,
+// returning false if it is.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) bool {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.Chan():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// clock returns the Clock of the router, which may be nil, e.g. in
+// tests of a lone localPeer.
+func (router *Router) clock() Clock {
+	if router == nil || router.Clock == nil {
+		return realClock{}
+	}
+	return router.Clock
+}
+
+func (c *GossipChannel) clock() Clock {
+	return c.ourself.router.clock()
+}
+
+// ManualClock is a Clock which only moves when told to, by Advance.
+type ManualClock struct {
+	sync.Mutex
+	now    time.Time
+	timers map[*manualTimer]struct{} // active ones
+	seq    uint64                    // to fire timers due together in order
+}
+
+// NewManualClock returns a ManualClock reading start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start, timers: make(map[*manualTimer]struct{})}
+}
+
+type manualTimer struct {
+	clock  *ManualClock
+	when   time.Time
+	period time.Duration // for tickers
+	seq    uint64
+	c      chan time.Time
+	f      func()
+}
+
+type manualTicker struct{ *manualTimer }
+
+// Now implements Clock.
+func (clock *ManualClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+// NewTimer implements Clock.
+func (clock *ManualClock) NewTimer(d time.Duration) Timer {
+	return clock.start(&manualTimer{c: make(chan time.Time, 1)}, d)
+}
+
+// NewTicker implements Clock.
+func (clock *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return manualTicker{clock.start(&manualTimer{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+// AfterFunc implements Clock. Advance calls f itself, rather than in
+// a goroutine of its own.
+func (clock *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	return clock.start(&manualTimer{f: f}, d)
+}
+
+func (clock *ManualClock) start(timer *manualTimer, d time.Duration) *manualTimer {
+	clock.Lock()
+	defer clock.Unlock()
+	timer.clock = clock
+	clock.schedule(timer, d)
+	return timer
+}
+
+func (clock *ManualClock) schedule(timer *manualTimer, d time.Duration) {
+	clock.seq++
+	timer.when, timer.seq = clock.now.Add(d), clock.seq
+	clock.timers[timer] = struct{}{}
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers
+// which fall due, in order, at the times they fall due.
+func (clock *ManualClock) Advance(d time.Duration) {
+	clock.Lock()
+	end := clock.now.Add(d)
+	for {
+		timer := clock.next(end)
+		if timer == nil {
+			break
+		}
+		clock.now = timer.when
+		if timer.period > 0 {
+			clock.schedule(timer, timer.period)
+		} else {
+			delete(clock.timers, timer)
+		}
+		if timer.f != nil {
+			clock.Unlock()
+			timer.f()
+			clock.Lock()
+			continue
+		}
+		select {
+		case timer.c <- clock.now:
+		default: // like a time.Ticker, drop ticks nobody is reading
+		}
+	}
+	if end.After(clock.now) {
+		clock.now = end
+	}
+	clock.Unlock()
+}
+
+// next returns the earliest timer due by end, if any.
+func (clock *ManualClock) next(end time.Time) *manualTimer {
+	var first *manualTimer
+	for timer := range clock.timers {
+		if timer.when.After(end) {
+			continue
+		}
+		if first == nil || timer.when.Before(first.when) ||
+			(timer.when.Equal(first.when) && timer.seq < first.seq) {
+			first = timer
+		}
+	}
+	return first
+}
+
+func (timer *manualTimer) Chan() <-chan time.Time { return timer.c }
+
+func (timer *manualTimer) Stop() bool {
+	timer.clock.Lock()
+	defer timer.clock.Unlock()
+	_, active := timer.clock.timers[timer]
+	delete(timer.clock.timers, timer)
+	return active
+}
+
+func (ticker manualTicker) Stop() { ticker.manualTimer.Stop() }
+
+func (timer *manualTimer) Reset(d time.Duration) bool {
+	timer.clock.Lock()
+	defer timer.clock.Unlock()
+	_, active := timer.clock.timers[timer]
+	timer.clock.schedule(timer, d)
+	return active
+}
@@ -0,0 +1,100 @@
+package mesh
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(300 * time.Millisecond)
+	var fired []time.Time
+	clock.AfterFunc(500*time.Millisecond, func() {
+		fired = append(fired, clock.Now())
+		clock.AfterFunc(time.Second, func() { fired = append(fired, clock.Now()) })
+	})
+
+	clock.Advance(999 * time.Millisecond)
+	require.Equal(t, start.Add(999*time.Millisecond), clock.Now())
+	require.Equal(t, []time.Time{start.Add(500 * time.Millisecond)}, fired)
+	select {
+	case <-timer.Chan():
+		require.FailNow(t, "timer fired early")
+	default:
+	}
+	// ticks nobody reads are dropped
+	require.Equal(t, start.Add(300*time.Millisecond), <-ticker.Chan())
+
+	clock.Advance(time.Millisecond)
+	require.Equal(t, start.Add(time.Second), <-timer.Chan())
+	require.False(t, timer.Stop())
+	require.False(t, timer.Reset(time.Second))
+	ticker.Stop()
+
+	clock.Advance(time.Second)
+	require.Equal(t, start.Add(2*time.Second), <-timer.Chan())
+	require.Equal(t, []time.Time{start.Add(500 * time.Millisecond), start.Add(1500 * time.Millisecond)}, fired)
+	select {
+	case <-ticker.Chan():
+		require.FailNow(t, "stopped ticker ticked")
+	default:
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	timers := func() int {
+		clock.Lock()
+		defer clock.Unlock()
+		return len(clock.timers)
+	}
+	slept := make(chan bool)
+	sleep := func() {
+		go func() { slept <- sleepContext(ctx, clock, time.Second) }()
+		waitUntil(t, func() bool { return timers() == 1 })
+	}
+
+	sleep()
+	clock.Advance(time.Second)
+	require.True(t, <-slept)
+
+	sleep()
+	cancel()
+	require.False(t, <-slept)
+	require.Zero(t, timers())
+}
+
+func TestRouterRand(t *testing.T) {
+	router := func(seed int64) *Router {
+		return newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Rand: rand.New(rand.NewSource(seed))})
+	}
+	r1, r2, r3 := router(1), router(1), router(2)
+	require.Equal(t, r1.Ourself.UID, r2.Ourself.UID)
+	require.Equal(t, r1.Ourself.ShortID, r2.Ourself.ShortID)
+	require.NotEqual(t, r1.Ourself.UID, r3.Ourself.UID)
+}
+
+func TestGossipOrderedTimeout(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Clock: clock})
+	g := &recordingGossiper{}
+	c, err := r.NewGossipChannel("Ordered", g, GossipChannelConfig{Ordered: true, OrderTimeout: time.Minute})
+	require.NoError(t, err)
+	receive := func(seq uint64) {
+		require.NoError(t, c.ordering.receive(PeerName(2), []byte{byte(seq)}, gossipFrameMeta{SeqEpoch: 1, SeqFirst: seq, SeqLast: seq}))
+	}
+
+	receive(1)
+	receive(3)
+	clock.Advance(time.Minute - time.Nanosecond)
+	require.Equal(t, []byte{1}, g.received())
+	clock.Advance(time.Nanosecond)
+	require.Equal(t, []byte{1, 3}, g.received())
+}
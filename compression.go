@@ -0,0 +1,67 @@
+package mesh
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// Gossip frames smaller than this are never compressed, since
+	// the saving would not be worth the CPU.
+	defaultCompressionThreshold = 1024
+
+	// The compression algorithm we advertise in the handshake, as
+	// the value of featureCompression.
+	compressionSnappy = "snappy"
+)
+
+// compressible returns true if frames with this tag may be compressed.
+func compressible(tag protocolTag) bool {
+	return tag == ProtocolGossip || tag == ProtocolGossipBroadcast
+}
+
+// compressionThreshold returns the frame size at or above which gossip
+// is compressed, and whether compression is enabled at all.
+func (router *Router) compressionThreshold() (int, bool) {
+	if !router.Config.CompressGossip {
+		return 0, false
+	}
+	if router.Config.CompressionThreshold > 0 {
+		return router.Config.CompressionThreshold, true
+	}
+	return defaultCompressionThreshold, true
+}
+
+// compressMsg wraps m in a ProtocolGossipCompressed frame, which
+// carries the original tag followed by the snappy-compressed message.
+func compressMsg(m protocolMsg) protocolMsg {
+	buf := make([]byte, 1+snappy.MaxEncodedLen(len(m.msg)))
+	buf[0] = byte(m.tag)
+	return protocolMsg{ProtocolGossipCompressed, buf[:1+len(snappy.Encode(buf[1:], m.msg))]}
+}
+
+// decompressMsg reverses compressMsg. The length the frame declares is
+// checked before decoding, so that a peer can't make us allocate more
+// than maxTCPMsgSize for it.
+func decompressMsg(payload []byte) (protocolMsg, error) {
+	if len(payload) < 1 {
+		return protocolMsg{}, fmt.Errorf("empty compressed gossip frame")
+	}
+	tag := protocolTag(payload[0])
+	if !compressible(tag) {
+		return protocolMsg{}, fmt.Errorf("unexpected tag %v in compressed gossip frame", tag)
+	}
+	n, err := snappy.DecodedLen(payload[1:])
+	if err != nil {
+		return protocolMsg{}, err
+	}
+	if n > maxTCPMsgSize {
+		return protocolMsg{}, fmt.Errorf("compressed gossip frame declares %d bytes, more than the limit of %d", n, maxTCPMsgSize)
+	}
+	msg, err := snappy.Decode(nil, payload[1:])
+	if err != nil {
+		return protocolMsg{}, err
+	}
+	return protocolMsg{tag, msg}, nil
+}
@@ -0,0 +1,30 @@
+package mesh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressMsg(t *testing.T) {
+	m := protocolMsg{ProtocolGossipBroadcast, bytes.Repeat([]byte("mesh"), 1000)}
+	compressed := compressMsg(m)
+	require.Equal(t, protocolTag(ProtocolGossipCompressed), compressed.tag)
+	require.True(t, len(compressed.msg) < len(m.msg))
+	decompressed, err := decompressMsg(compressed.msg)
+	require.NoError(t, err)
+	require.Equal(t, m, decompressed)
+
+	// only gossip may be wrapped
+	_, err = decompressMsg(append([]byte{ProtocolHeartbeat}, compressed.msg[1:]...))
+	require.Error(t, err)
+	_, err = decompressMsg([]byte{ProtocolGossip, 0xff})
+	require.Error(t, err)
+
+	// a header declaring 1GB, as a varint, with nothing following; not
+	// more, which 32-bit snappy would reject before we could
+	_, err = decompressMsg([]byte{ProtocolGossip, 0x80, 0x80, 0x80, 0x80, 0x04})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "more than the limit")
+}
@@ -0,0 +1,112 @@
+package mesh
+
+import (
+	"net"
+	"time"
+)
+
+// ApplyConfig updates the router's Config with the fields of config
+// which can be changed while it runs, ignoring the rest:
+//
+//   - Password, for new connections, so that the password can be
+//     rotated by applying the new one to every peer in turn, each of
+//     which keeps its connections to those still using the old one;
+//   - HeartbeatInterval and HandshakeTimeout, for new connections;
+//   - WriteTimeout, SlowPeer and IdleTimeout, for all connections;
+//   - ConnectionRateLimit and StateTransferRateLimit, for all
+//     connections, whose limiters start afresh;
+//   - TrustedSubnets and SelectiveEncryption, for new connections;
+//   - Backoff, for the next retry of each target.
+//
+// It returns an error, changing nothing, if any of those are invalid.
+func (router *Router) ApplyConfig(config Config) error {
+	if err := validateTimeouts(config); err != nil {
+		return err
+	}
+	router.configLock.Lock()
+	router.Password = config.Password
+	router.HeartbeatInterval = config.HeartbeatInterval
+	router.HandshakeTimeout = config.HandshakeTimeout
+	router.WriteTimeout = config.WriteTimeout
+	router.SlowPeer = config.SlowPeer
+	router.IdleTimeout = config.IdleTimeout
+	router.ConnectionRateLimit = config.ConnectionRateLimit
+	router.StateTransferRateLimit = config.StateTransferRateLimit
+	router.TrustedSubnets = append([]*net.IPNet(nil), config.TrustedSubnets...)
+	router.SelectiveEncryption = config.SelectiveEncryption
+	router.Backoff = config.Backoff
+	router.configLock.Unlock()
+
+	router.ConnectionMaker.setBackoff(config.Backoff)
+	for conn := range router.Ourself.getConnections() {
+		if lc, ok := conn.(*LocalConnection); ok {
+			if lc.frames != nil {
+				lc.frames.setLimits(router.writeTimeout(), config.SlowPeer)
+			}
+			lc.gossipSenders().limiters.reset()
+		}
+	}
+	return nil
+}
+
+// password returns the password of new connections.
+func (router *Router) password() []byte {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	return router.Password
+}
+
+// idleTimeout returns Config.IdleTimeout.
+func (router *Router) idleTimeout() time.Duration {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	return router.IdleTimeout
+}
+
+// slowPeer returns Config.SlowPeer.
+func (router *Router) slowPeer() SlowPeerPolicy {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	return router.SlowPeer
+}
+
+// rateLimits returns the limits of the gossip sent on each connection,
+// and of the state transferred.
+func (router *Router) rateLimits() (connection, transfer RateLimit) {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	return router.ConnectionRateLimit, router.StateTransferRateLimit
+}
+
+// trustedSubnets returns Config.TrustedSubnets.
+func (router *Router) trustedSubnets() []*net.IPNet {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	return router.TrustedSubnets
+}
+
+// setBackoff sets the policy of the retries scheduled hereafter.
+func (cm *connectionMaker) setBackoff(policy BackoffPolicy) {
+	cm.actionChan <- func() bool {
+		cm.backoff = policy
+		return false
+	}
+}
+
+// reset discards the limiters of the connection, so that they are made
+// afresh, with the current limits, as gossip is next sent.
+func (ls *rateLimiters) reset() {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.channels = nil
+}
+
+// setLimits changes the limits of a frameWriter already running.
+func (w *frameWriter) setLimits(timeout time.Duration, slow SlowPeerPolicy) {
+	w.Lock()
+	defer w.Unlock()
+	if w.limits != nil {
+		w.limits.timeout, w.limits.slow = timeout, slow
+		w.overSince = time.Time{}
+	}
+}
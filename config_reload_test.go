@@ -0,0 +1,61 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfig(t *testing.T) {
+	old, rotated := Config{Password: []byte("old")}, Config{Password: []byte("new")}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", old)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", old)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", rotated)
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+	addr2, close2 := listenTest(t, r2)
+	defer close2()
+	r1.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool { return len(establishedTo(r2)) == 1 })
+
+	require.Error(t, r2.ApplyConfig(Config{HeartbeatInterval: time.Nanosecond}))
+
+	// connections made with the old password survive its rotation,
+	// while new ones use the new one
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	rotated.TrustedSubnets = []*net.IPNet{subnet}
+	rotated.ConnectionRateLimit = RateLimit{BytesPerSecond: 1000}
+	rotated.Backoff = BackoffPolicy{Initial: time.Minute}
+	require.NoError(t, r2.ApplyConfig(rotated))
+	r3.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool { return len(establishedTo(r2)) == 2 })
+	require.Len(t, establishedTo(r1), 1)
+
+	status := NewStatus(r2)
+	require.Equal(t, []string{"10.0.0.0/8"}, status.TrustedSubnets)
+	require.Equal(t, rotated.Backoff, r2.ConnectionMaker.backoff)
+	connection, _ := r2.rateLimits()
+	require.Equal(t, rotated.ConnectionRateLimit, connection)
+}
+
+func TestApplyHeartbeatInterval(t *testing.T) {
+	config := Config{HeartbeatInterval: 50 * time.Millisecond}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	defer r2.Stop()
+	connectTo(t, r1, r2)
+
+	// the connection keeps the interval of its handshake
+	require.NoError(t, r1.ApplyConfig(Config{HeartbeatInterval: time.Minute}))
+	conn, ok := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, ok)
+	require.Equal(t, 2*config.HeartbeatInterval, conn.(*LocalConnection).readTimeout())
+	time.Sleep(10 * config.HeartbeatInterval)
+	_, ok = r2.Ourself.ConnectionTo(r1.Ourself.Name)
+	require.True(t, ok)
+}
@@ -1,9 +1,11 @@
 package mesh
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +18,8 @@ type Connection interface {
 	remoteTCPAddress() string
 	isOutbound() bool
 	isEstablished() bool
+	isDegraded() bool
+	roundTripTime() time.Duration
 }
 
 type ourConnection interface {
@@ -34,6 +38,8 @@ type remoteConnection struct {
 	remoteTCPAddr string
 	outbound      bool
 	established   bool
+	degraded      bool          // see Router.SetConnectionDegraded
+	roundTrip     time.Duration // see Config.LatencyRouting
 }
 
 func newRemoteConnection(from, to *Peer, tcpAddr string, outbound bool, established bool) *remoteConnection {
@@ -56,30 +62,70 @@ func (conn *remoteConnection) isOutbound() bool { return conn.outbound }
 
 func (conn *remoteConnection) isEstablished() bool { return conn.established }
 
+func (conn *remoteConnection) isDegraded() bool { return conn.degraded }
+
+func (conn *remoteConnection) roundTripTime() time.Duration { return conn.roundTrip }
+
+// setRoundTripTime sets the published round-trip time, returning
+// whether it changed.
+func (conn *remoteConnection) setRoundTripTime(rtt time.Duration) bool {
+	changed := conn.roundTrip != rtt
+	conn.roundTrip = rtt
+	return changed
+}
+
+// setDegraded sets the degraded flag, returning whether it changed.
+func (conn *remoteConnection) setDegraded(degraded bool) bool {
+	changed := conn.degraded != degraded
+	conn.degraded = degraded
+	return changed
+}
+
 // LocalConnection is the local (our) side of a connection.
 // It implements ProtocolSender, and manages per-channel GossipSenders.
 type LocalConnection struct {
 	OverlayConn OverlayConnection
 
 	remoteConnection
-	tcpConn         *net.TCPConn
-	trustRemote     bool // is remote on a trusted subnet?
-	trustedByRemote bool // does remote trust us?
+	tcpConn         net.Conn // a *net.TCPConn, unless over WebSockets
+	via             string   // the Config.DialVia dialled through, if any
+	trustRemote     bool     // is remote on a trusted subnet?
+	trustedByRemote bool     // does remote trust us?
 	version         byte
 	tcpSender       tcpSender
 	sessionKey      *[32]byte
-	heartbeatTCP    *time.Ticker
+	cipher          string // the cipher in use, if encrypted
+	heartbeatTCP    Ticker
+	heartbeat       time.Duration // our HeartbeatInterval, fixed for the connection
+	remoteHeartbeat time.Duration // the remote's HeartbeatInterval
 	router          *Router
 	uid             uint64
 	errorChan       chan<- error
 	finished        <-chan struct{} // closed to signal that actorLoop has finished
 	senders         *gossipSenders
+	features        negotiatedFeatures
+	compress        bool // should we compress gossip sent to remote?
+	topoCodec       topologyCodec
+	observer        bool // is remote a read-only observer?
+	stats           connectionStats
+	detector        FailureDetector
+	rtt             rttEstimator
+	power           connectionPower
+	frames          *frameWriter
+	reassembly      []byte // of a fragmented msg being received
+	streams         recvStreams
+	datagramSocket  *net.UDPConn  // see Config.Datagrams
+	datagrams       *datagramLink // nil unless both ends have a socket
+	lastActive      int64         // accessed atomically; see noteActive
+	establishedFlag int32         // accessed atomically; see isEstablished
+	started         time.Time     // see Router.HealthCheck
+	lastResync      time.Time     // asked for; see corruptFrame
 	logger          Logger
 }
 
 // If the connection is successful, it will end up in the local peer's
 // connections map.
-func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, router *Router, acceptNewPeer bool, logger Logger) {
+func startLocalConnection(connRemote *remoteConnection, tcpConn net.Conn, via string, preread []byte, router *Router, acceptNewPeer bool, logger Logger) {
 	if connRemote.local != router.Ourself.Peer {
 		panic("attempt to create local connection from a peer which is not ourself")
 	}
@@ -89,14 +135,19 @@ func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, ro
 		remoteConnection: *connRemote, // NB, we're taking a copy of connRemote here.
 		router:           router,
 		tcpConn:          tcpConn,
-		trustRemote:      router.trusts(connRemote),
-		uid:              randUint64(),
+		via:              via,
+		trustRemote:      via == "" && router.trustsConn(tcpConn),
+		uid:              router.rng().Uint64(),
 		errorChan:        errorChan,
 		finished:         finished,
+		heartbeat:        router.heartbeatInterval(),
+		power:            newConnectionPower(),
+		lastActive:       router.clock().Now().UnixNano(),
+		started:          router.clock().Now(),
 		logger:           logger,
 	}
 	conn.senders = newGossipSenders(conn, finished)
-	go conn.run(errorChan, finished, acceptNewPeer)
+	go conn.run(errorChan, finished, preread, acceptNewPeer)
 }
 
 func (conn *LocalConnection) logf(format string, args ...interface{}) {
@@ -116,10 +167,11 @@ func (conn *LocalConnection) breakTie(dupConn ourConnection) connectionTieBreak
 	return tieBreakTied
 }
 
-// Established returns true if the connection is established.
-// TODO(pb): data race?
+// Established returns true if the connection is established. Unlike
+// established, which only actorLoop reads, it may be called from any
+// goroutine.
 func (conn *LocalConnection) isEstablished() bool {
-	return conn.established
+	return atomic.LoadInt32(&conn.establishedFlag) != 0
 }
 
 // SendProtocolMsg implements ProtocolSender.
@@ -135,6 +187,14 @@ func (conn *LocalConnection) gossipSenders() *gossipSenders {
 	return conn.senders
 }
 
+func (conn *LocalConnection) supportsDigests() bool {
+	return conn.features.both(featureGossipDigests)
+}
+
+func (conn *LocalConnection) topologyCodec() topologyCodec {
+	return conn.topoCodec
+}
+
 // ACTOR methods
 
 // NB: The conn.* fields are only written by the connection actor
@@ -151,34 +211,65 @@ func (conn *LocalConnection) shutdown(err error) {
 
 	select {
 	case conn.errorChan <- err:
+		conn.stats.failed(err)
 	default:
 	}
 }
 
 // ACTOR server
 
-func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{}, acceptNewPeer bool) {
+func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{}, preread []byte, acceptNewPeer bool) {
 	var err error // important to use this var and not create another one with 'err :='
 	defer func() { conn.teardown(err) }()
 	defer close(finished)
 
-	if err = conn.tcpConn.SetLinger(0); err != nil {
-		return
+	if tcpConn, ok := conn.tcpConn.(*net.TCPConn); ok {
+		if err = tcpConn.SetLinger(0); err != nil {
+			return
+		}
+		if err = conn.router.setKeepAlive(tcpConn); err != nil {
+			return
+		}
 	}
 
+	password, err := conn.introPassword()
+	if err != nil {
+		return
+	}
+	var introConn protocolIntroConn = conn.tcpConn
+	if len(preread) > 0 {
+		introConn = &prereadConn{conn.tcpConn, preread}
+	}
+	stopAbort := abortOnDone(conn.router.ctx, conn.tcpConn)
+	if conn.outbound {
+		if err = writeMeshID(conn.tcpConn, conn.router.MeshID); err != nil {
+			stopAbort()
+			return
+		}
+	}
 	intro, err := protocolIntroParams{
 		MinVersion: conn.router.ProtocolMinVersion,
 		MaxVersion: ProtocolMaxVersion,
 		Features:   conn.makeFeatures(),
-		Conn:       conn.tcpConn,
-		Password:   conn.router.Password,
+		Conn:       introConn,
+		Password:   password,
+		Ciphers:    conn.router.Ciphers,
 		Outbound:   conn.outbound,
+		Context:    conn.router.ctx,
+
+		HeaderTimeout: conn.router.handshakeTimeout(),
+		Heartbeat:     conn.heartbeat,
 	}.doIntro()
+	stopAbort()
+	if err == errExpectedNoCrypto && conn.router.password() != nil {
+		err = errRemoteDistrusts
+	}
 	if err != nil {
 		return
 	}
 
 	conn.sessionKey = intro.SessionKey
+	conn.cipher = intro.Cipher
 	conn.tcpSender = intro.Sender
 	conn.version = intro.Version
 
@@ -186,13 +277,41 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 	if err != nil {
 		return
 	}
+	conn.detector = conn.router.newFailureDetector(conn.remoteHeartbeat)
+	if conn.router.banned(remote.Name, remote.UID) {
+		err = errPeerBanned
+		return
+	}
+	conn.features = negotiateFeatures(conn.router.features, intro.Features)
+	_, compress := conn.router.compressionThreshold()
+	conn.compress = compress && len(conn.features.common(featureCompression)) > 0
+	conn.topoCodec = chooseTopologyCodec(conn.features.common(featureTopologyCodec))
+	conn.useChecksums(&intro)
+	conn.frames = newFrameWriter(conn.tcpSender, conn.features.both(featureFragments), conn.features.both(featureStreams), &writeLimits{
+		conn:    conn.tcpConn,
+		timeout: conn.router.writeTimeout(),
+		slow:    conn.router.slowPeer(),
+		clock:   conn.router.clock(),
+		evict:   conn.shutdown,
+	})
+
+	if _, observer := intro.Features["Observer"]; observer {
+		err = conn.runObserver(remote, intro, errorChan)
+		return
+	}
 
 	if err = conn.registerRemote(remote, acceptNewPeer); err != nil {
 		return
 	}
+	conn.router.Peers.RLock()
 	isRestartedPeer := conn.Remote().UID != remote.UID
+	conn.router.Peers.RUnlock()
 
-	conn.logf("connection ready; using protocol version %v", conn.version)
+	if intro.Cipher != "" {
+		conn.logf("connection ready; using protocol version %v, cipher %s", conn.version, intro.Cipher)
+	} else {
+		conn.logf("connection ready; using protocol version %v", conn.version)
+	}
 
 	// only use negotiated session key for untrusted connections
 	var sessionKey *[32]byte
@@ -202,8 +321,8 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 
 	params := OverlayConnectionParams{
 		RemotePeer:         conn.remote,
-		LocalAddr:          conn.tcpConn.LocalAddr().(*net.TCPAddr),
-		RemoteAddr:         conn.tcpConn.RemoteAddr().(*net.TCPAddr),
+		LocalAddr:          tcpAddrOf(conn.tcpConn.LocalAddr()),
+		RemoteAddr:         tcpAddrOf(conn.tcpConn.RemoteAddr()),
 		Outbound:           conn.outbound,
 		ConnUID:            conn.uid,
 		SessionKey:         sessionKey,
@@ -214,6 +333,8 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 		return
 	}
 
+	conn.startDatagrams(intro.Features)
+
 	// As soon as we do AddConnection, the new connection becomes
 	// visible to the packet routing logic.  So AddConnection must
 	// come after PrepareConnection
@@ -243,7 +364,11 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 	// will have a positive ref count), leaving behind dangling
 	// references to peers. Hence we must invoke AddConnection,
 	// which is *synchronous*, first.
-	conn.heartbeatTCP = time.NewTicker(tcpHeartbeat)
+	conn.heartbeatTCP = conn.router.clock().NewTicker(conn.heartbeat)
+	conn.detector.Heartbeat(conn.router.clock().Now())
+	if conn.router.PowerMode() == PowerLow {
+		conn.power.setOurs(true)
+	}
 	go conn.receiveTCP(intro.Receiver)
 
 	// AddConnection must precede actorLoop. More precisely, it
@@ -256,17 +381,36 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 	err = conn.actorLoop(errorChan)
 }
 
+// abortOnDone closes tcpConn if ctx is done before the returned function
+// is called, so that e.g. a handshake in progress is abandoned promptly
+// when the router stops.
+func abortOnDone(ctx context.Context, tcpConn net.Conn) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			tcpConn.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
 func (conn *LocalConnection) makeFeatures() map[string]string {
 	features := map[string]string{
-		"PeerNameFlavour": PeerNameFlavour,
-		"Name":            conn.local.Name.String(),
-		"NickName":        conn.local.NickName,
-		"ShortID":         fmt.Sprint(conn.local.ShortID),
-		"UID":             fmt.Sprint(conn.local.UID),
-		"ConnID":          fmt.Sprint(conn.uid),
-		"Trusted":         fmt.Sprint(conn.trustRemote),
+		"PeerNameFlavour":   peerNameFlavour(),
+		"Name":              conn.local.Name.String(),
+		"NickName":          conn.local.NickName,
+		"ShortID":           fmt.Sprint(conn.local.ShortID),
+		"ShortIDBits":       fmt.Sprint(conn.router.shortIDBits()),
+		"UID":               fmt.Sprint(conn.local.UID),
+		"ConnID":            fmt.Sprint(conn.uid),
+		"Trusted":           fmt.Sprint(conn.trustRemote),
+		"HeartbeatInterval": conn.heartbeat.String(),
+		protocolFeaturesKey: conn.router.features.encode(),
 	}
 	conn.router.Overlay.AddFeaturesTo(features)
+	conn.listenDatagrams(features)
 	return features
 }
 
@@ -276,8 +420,8 @@ func (conn *LocalConnection) parseFeatures(features map[string]string) (*Peer, e
 	}
 
 	remotePeerNameFlavour := features["PeerNameFlavour"]
-	if remotePeerNameFlavour != PeerNameFlavour {
-		return nil, fmt.Errorf("Peer name flavour mismatch (ours: '%s', theirs: '%s')", PeerNameFlavour, remotePeerNameFlavour)
+	if remotePeerNameFlavour != peerNameFlavour() {
+		return nil, fmt.Errorf("Peer name flavour mismatch (ours: '%s', theirs: '%s')", peerNameFlavour(), remotePeerNameFlavour)
 	}
 
 	name, err := PeerNameFromString(features["Name"])
@@ -287,11 +431,24 @@ func (conn *LocalConnection) parseFeatures(features map[string]string) (*Peer, e
 
 	nickName := features["NickName"]
 
+	// Peers which don't say otherwise have short IDs of the default
+	// width. Those of all peers in a mesh must be the same width for
+	// collisions to be detected.
+	shortIDBits := uint64(peerShortIDBits)
+	if bitsStr, ok := features["ShortIDBits"]; ok {
+		if shortIDBits, err = strconv.ParseUint(bitsStr, 10, 8); err != nil {
+			return nil, err
+		}
+	}
+	if uint(shortIDBits) != conn.router.shortIDBits() {
+		return nil, fmt.Errorf("Short ID width mismatch (ours: %d, theirs: %d)", conn.router.shortIDBits(), shortIDBits)
+	}
+
 	var shortID uint64
 	var hasShortID bool
 	if shortIDStr, ok := features["ShortID"]; ok {
 		hasShortID = true
-		shortID, err = strconv.ParseUint(shortIDStr, 10, peerShortIDBits)
+		shortID, err = strconv.ParseUint(shortIDStr, 10, int(shortIDBits))
 		if err != nil {
 			return nil, err
 		}
@@ -306,6 +463,18 @@ func (conn *LocalConnection) parseFeatures(features map[string]string) (*Peer, e
 	}
 	conn.trustedByRemote = trusted
 
+	// Peers which don't say otherwise send heartbeats at the default
+	// interval.
+	conn.remoteHeartbeat = tcpHeartbeat
+	if heartbeatStr, ok := features["HeartbeatInterval"]; ok {
+		if conn.remoteHeartbeat, err = time.ParseDuration(heartbeatStr); err != nil {
+			return nil, err
+		}
+		if conn.remoteHeartbeat < minTimeout {
+			return nil, fmt.Errorf("heartbeat interval of %v is too short", conn.remoteHeartbeat)
+		}
+	}
+
 	uid, err := parsePeerUID(features["UID"])
 	if err != nil {
 		return nil, err
@@ -333,7 +502,9 @@ func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) er
 	}
 
 	if remote.Name == conn.local.Name && remote.UID != conn.local.UID {
-		return &peerNameCollisionError{conn.local, remote}
+		err := &peerNameCollisionError{conn.local, remote}
+		conn.router.nameCollided(err)
+		return err
 	}
 	if conn.remote == conn.local {
 		return errConnectToSelf
@@ -345,6 +516,11 @@ func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) er
 func (conn *LocalConnection) actorLoop(errorChan <-chan error) (err error) {
 	fwdErrorChan := conn.OverlayConn.ErrorChannel()
 	fwdEstablishedChan := conn.OverlayConn.EstablishedChannel()
+	suspicionCheck := conn.router.clock().NewTicker(suspicionCheckInterval)
+	defer suspicionCheck.Stop()
+	ping := conn.router.clock().NewTicker(rttPingInterval)
+	defer ping.Stop()
+	heartbeat := conn.heartbeatTCP.Chan()
 
 	for err == nil {
 		select {
@@ -352,12 +528,27 @@ func (conn *LocalConnection) actorLoop(errorChan <-chan error) (err error) {
 		case err = <-fwdErrorChan:
 		default:
 			select {
-			case <-conn.heartbeatTCP.C:
-				err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat)
+			case now := <-heartbeat:
+				if err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat); err == nil {
+					err = conn.checkIdle(now)
+				}
+			case now := <-suspicionCheck.Chan():
+				if !conn.power.isLow() {
+					err = conn.checkSuspicion(now)
+				}
+			case <-ping.Chan():
+				if conn.established && !conn.power.isLow() {
+					err = conn.sendPing()
+				}
+			case <-conn.power.changed:
+				heartbeat, err = conn.applyPower(heartbeat)
 			case <-fwdEstablishedChan:
 				conn.established = true
+				atomic.StoreInt32(&conn.establishedFlag, 1)
+				conn.stats.established(conn.router.clock().Now())
 				fwdEstablishedChan = nil
 				conn.router.Ourself.doConnectionEstablished(conn)
+				err = conn.sendPing()
 			case err = <-errorChan:
 			case err = <-fwdErrorChan:
 			}
@@ -380,20 +571,29 @@ func (conn *LocalConnection) teardown(err error) {
 		}
 	}
 
-	if conn.remote != nil {
+	if conn.remote != nil && !conn.observer {
 		conn.router.Peers.dereference(conn.remote)
 		conn.router.Ourself.doDeleteConnection(conn)
+		conn.router.connectionTerminated(conn, err)
 	}
 
 	if conn.heartbeatTCP != nil {
 		conn.heartbeatTCP.Stop()
 	}
 
+	if conn.frames != nil {
+		conn.frames.close(err)
+	}
+	conn.streams.close()
+	conn.closeDatagrams()
+
 	if conn.OverlayConn != nil {
 		conn.OverlayConn.Stop()
 	}
 
-	conn.router.ConnectionMaker.connectionTerminated(conn, err)
+	if !conn.observer {
+		conn.router.ConnectionMaker.connectionTerminated(conn, err)
+	}
 }
 
 func (conn *LocalConnection) sendOverlayControlMessage(tag byte, msg []byte) error {
@@ -407,7 +607,32 @@ func (conn *LocalConnection) sendSimpleProtocolMsg(tag protocolTag) error {
 }
 
 func (conn *LocalConnection) sendProtocolMsg(m protocolMsg) error {
-	return conn.tcpSender.Send(append([]byte{byte(m.tag)}, m.msg...))
+	return conn.sendProtocolMsgAs(m, frameControl, "")
+}
+
+func (conn *LocalConnection) sendProtocolMsgAs(m protocolMsg, class frameClass, stream string) error {
+	conn.router.tap(TapSent, conn.remote.Name, m)
+	if conn.compress && compressible(m.tag) {
+		if threshold, _ := conn.router.compressionThreshold(); len(m.msg) >= threshold {
+			m = compressMsg(m)
+		}
+	}
+	// both ways of sending wait until msg has been written, so it can
+	// be recycled afterwards
+	buf := getBuffer(1 + len(m.msg))
+	defer putBuffer(buf)
+	msg := append(append(*buf, byte(m.tag)), m.msg...)
+	var err error
+	if conn.frames != nil {
+		err = conn.frames.send(msg, class, stream)
+	} else {
+		err = conn.tcpSender.Send(msg)
+	}
+	if err != nil {
+		return err
+	}
+	conn.stats.sent(len(msg))
+	return nil
 }
 
 func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
@@ -417,9 +642,15 @@ func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
 			break
 		}
 		var msg []byte
-		if msg, err = receiver.Receive(); err != nil {
+		if msg, err = receiver.Receive(); err == errCorruptFrame {
+			if err = conn.corruptFrame(); err != nil {
+				break
+			}
+			continue
+		} else if err != nil {
 			break
 		}
+		conn.stats.received(len(msg))
 		if len(msg) < 1 {
 			conn.logf("ignoring blank msg")
 			continue
@@ -432,20 +663,74 @@ func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
 }
 
 func (conn *LocalConnection) handleProtocolMsg(tag protocolTag, payload []byte) error {
+	conn.router.tap(TapReceived, conn.remote.Name, protocolMsg{tag, payload})
 	switch tag {
 	case ProtocolHeartbeat:
+		conn.detector.Heartbeat(conn.router.clock().Now())
 	case ProtocolReserved1, ProtocolReserved2, ProtocolReserved3, ProtocolOverlayControlMsg:
 		conn.OverlayConn.ControlMessage(byte(tag), payload)
-	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip:
-		return conn.router.handleGossip(tag, payload)
+	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip, ProtocolGossipDigest, ProtocolGossipError, ProtocolGossipMulticast:
+		return conn.handleGossip(tag, payload)
+	case ProtocolGossipCompressed:
+		m, err := decompressMsg(payload)
+		if err != nil {
+			return err
+		}
+		conn.router.tap(TapReceived, conn.remote.Name, m)
+		return conn.handleGossip(m.tag, m.msg)
+	case ProtocolDeparture:
+		return errPeerDeparted
+	case ProtocolIdle:
+		return errConnectionIdle
+	case ProtocolPing:
+		return conn.SendProtocolMsg(protocolMsg{ProtocolPong, payload})
+	case ProtocolPong:
+		return conn.handlePong(payload)
+	case ProtocolPowerMode:
+		return conn.handlePowerMode(payload)
+	case ProtocolFragment:
+		return conn.handleFragment(payload)
+	case ProtocolStreamFragment:
+		return conn.handleStreamFragment(payload)
+	case ProtocolWindowUpdate:
+		return conn.handleWindowUpdate(payload)
+	case ProtocolResync:
+		conn.router.sendAllGossipDown(conn)
 	default:
 		conn.logf("ignoring unknown protocol tag: %v", tag)
 	}
 	return nil
 }
 
+// handleGossip delivers a gossip frame, noting traffic on the
+// application's channels.
+func (conn *LocalConnection) handleGossip(tag protocolTag, payload []byte) error {
+	channelName, err := conn.router.receiveGossip(conn.remote.Name, tag, payload)
+	if channelName != "" && !internalChannel(channelName) {
+		conn.noteActive()
+	}
+	return err
+}
+
 func (conn *LocalConnection) extendReadDeadline() error {
-	return conn.tcpConn.SetReadDeadline(time.Now().Add(tcpHeartbeat * 2))
+	if conn.power.isLow() {
+		// failure is detected by TCP keepalive instead
+		return conn.tcpConn.SetReadDeadline(time.Time{})
+	}
+	return conn.tcpConn.SetReadDeadline(time.Now().Add(conn.readTimeout()))
+}
+
+// readTimeout returns how long the connection may go without hearing
+// from the remote: twice the longer of the heartbeat intervals of its
+// ends, since the remote sends heartbeats at its own. Both are those of
+// the handshake, so that changing Config.HeartbeatInterval affects only
+// new connections.
+func (conn *LocalConnection) readTimeout() time.Duration {
+	heartbeat := conn.heartbeat
+	if conn.remoteHeartbeat > heartbeat {
+		heartbeat = conn.remoteHeartbeat
+	}
+	return heartbeat * 2
 }
 
 // Untrusted returns true if either we don't trust our remote, or are not
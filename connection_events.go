@@ -0,0 +1,83 @@
+package mesh
+
+import "sync"
+
+// ConnectionEvent describes a connection to a remote peer being
+// established or terminated.
+type ConnectionEvent struct {
+	Peer       PeerName
+	NickName   string
+	RemoteAddr string
+	Outbound   bool
+
+	// Established is whether the connection had been established,
+	// i.e. had passed traffic in both directions. It is always true
+	// for OnConnectionEstablished.
+	Established bool
+
+	// Err is the cause of termination; nil for
+	// OnConnectionEstablished.
+	Err error
+}
+
+// connectionEvents holds the callbacks for ConnectionEvents.
+type connectionEvents struct {
+	sync.Mutex
+	onEstablished []func(ConnectionEvent)
+	onTerminated  []func(ConnectionEvent)
+}
+
+// OnConnectionEstablished adds a function to be called whenever a
+// connection to a remote peer is established. Callbacks are invoked
+// synchronously, and so must not block.
+func (router *Router) OnConnectionEstablished(callback func(ConnectionEvent)) {
+	router.connEvents.Lock()
+	defer router.connEvents.Unlock()
+	router.connEvents.onEstablished = append(router.connEvents.onEstablished, callback)
+}
+
+// OnConnectionTerminated adds a function to be called whenever a
+// connection to a remote peer terminates, after the handshake has
+// completed, whether or not it was established. Callbacks are invoked
+// synchronously, and so must not block.
+func (router *Router) OnConnectionTerminated(callback func(ConnectionEvent)) {
+	router.connEvents.Lock()
+	defer router.connEvents.Unlock()
+	router.connEvents.onTerminated = append(router.connEvents.onTerminated, callback)
+}
+
+func (router *Router) connectionEstablished(conn Connection) {
+	router.lifecycle.connectionEstablished(conn.Remote().Name)
+	router.connEvents.Lock()
+	callbacks := router.connEvents.onEstablished
+	router.connEvents.Unlock()
+	notifyConnectionEvent(callbacks, conn, nil)
+}
+
+func (router *Router) connectionTerminated(conn Connection, err error) {
+	router.flaps.record(conn.Remote().Name)
+	if router.lifecycle.connectionTerminated(conn.Remote().Name, err) {
+		router.refreshPeerStates()
+	}
+	router.connEvents.Lock()
+	callbacks := router.connEvents.onTerminated
+	router.connEvents.Unlock()
+	notifyConnectionEvent(callbacks, conn, err)
+}
+
+func notifyConnectionEvent(callbacks []func(ConnectionEvent), conn Connection, err error) {
+	if len(callbacks) == 0 {
+		return
+	}
+	event := ConnectionEvent{
+		Peer:        conn.Remote().Name,
+		NickName:    conn.Remote().nickName(),
+		RemoteAddr:  conn.remoteTCPAddress(),
+		Outbound:    conn.isOutbound(),
+		Established: conn.isEstablished(),
+		Err:         err,
+	}
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
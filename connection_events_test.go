@@ -0,0 +1,62 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionEvents(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+
+	var lock sync.Mutex
+	var events []string
+	record := func(kind string) func(ConnectionEvent) {
+		return func(event ConnectionEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, fmt.Sprint(kind, " ", event.Peer, " ", event.Outbound, " ", event.Err != nil))
+		}
+	}
+	r1.OnConnectionEstablished(record("established"))
+	r1.OnConnectionTerminated(record("terminated"))
+	recorded := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, events...)
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	established := fmt.Sprint("established ", r2.Ourself.Name, " true false")
+	require.Eventually(t, func() bool {
+		return len(recorded()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{established}, recorded())
+
+	r1.ConnectionMaker.ForgetConnections([]string{ln.Addr().String()})
+	conn, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, found)
+	conn.(ourConnection).shutdown(fmt.Errorf("test"))
+	require.Eventually(t, func() bool {
+		return len(recorded()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{established, fmt.Sprint("terminated ", r2.Ourself.Name, " true true")}, recorded())
+}
@@ -2,18 +2,16 @@ package mesh
 
 import (
 	"fmt"
-	"math/rand"
 	"net"
+	"sort"
 	"time"
 	"unicode"
 )
 
-const (
-	initialInterval = 2 * time.Second
-	maxInterval     = 6 * time.Minute
-	resetAfter      = 1 * time.Minute
-)
+const resetAfter = 1 * time.Minute
 
+// peerAddrs are the resolved addresses of targets; nil for WebSocket
+// URLs, which are dialled as given.
 type peerAddrs map[string]*net.TCPAddr
 
 // ConnectionMaker initiates and manages connections to peers.
@@ -25,9 +23,15 @@ type connectionMaker struct {
 	discovery        bool
 	targets          map[string]*target
 	connections      map[Connection]struct{}
-	directPeers      peerAddrs
+	directPeers      map[string]*directPeer
 	terminationCount int
+	backoff          BackoffPolicy
+	handshakes       handshakeLimit
+	idle             idlePeers
+	blockedAddrs     map[string]time.Time   // see ForgetMatching
+	blockedPeers     map[PeerName]time.Time // likewise
 	actionChan       chan<- connectionMakerAction
+	stopChan         chan struct{}
 	logger           Logger
 }
 
@@ -43,10 +47,13 @@ const (
 
 // Information about an address where we may find a peer.
 type target struct {
-	state       targetState
-	lastError   error         // reason for disconnection last time
-	tryAfter    time.Time     // next time to try this address
-	tryInterval time.Duration // retry delay on next failure
+	state     targetState
+	lastError error     // reason for disconnection last time
+	tryAfter  time.Time // next time to try this address
+	attempts  int       // retries since the last success
+	peer      PeerName  // last connected to, if any
+	queued    bool      // due, but held back by the handshake limit
+	attempted time.Time // when the current attempt began
 }
 
 // The actor closure used by ConnectionMaker. If an action returns true, the
@@ -61,31 +68,52 @@ type connectionMakerAction func() bool
 func newConnectionMaker(ourself *localPeer, peers *Peers, localAddr string, port int, discovery bool, logger Logger) *connectionMaker {
 	actionChan := make(chan connectionMakerAction, ChannelSize)
 	cm := &connectionMaker{
-		ourself:     ourself,
-		peers:       peers,
-		localAddr:   localAddr,
-		port:        port,
-		discovery:   discovery,
-		directPeers: peerAddrs{},
-		targets:     make(map[string]*target),
-		connections: make(map[Connection]struct{}),
-		actionChan:  actionChan,
-		logger:      logger,
+		ourself:      ourself,
+		peers:        peers,
+		localAddr:    localAddr,
+		port:         port,
+		discovery:    discovery,
+		directPeers:  make(map[string]*directPeer),
+		targets:      make(map[string]*target),
+		connections:  make(map[Connection]struct{}),
+		blockedAddrs: make(map[string]time.Time),
+		blockedPeers: make(map[PeerName]time.Time),
+		actionChan:   actionChan,
+		stopChan:     make(chan struct{}),
+		logger:       logger,
 	}
 	go cm.queryLoop(actionChan)
 	return cm
 }
 
 // InitiateConnections creates new connections to the provided peers,
-// specified in host:port format. If replace is true, any existing direct
-// peers are forgotten.
+// specified in host:port format, or as ws:// or wss:// URLs to be dialled
+// over WebSockets, as targets of SourceManual. If replace
+// is true, any other targets of SourceManual are forgotten.
 //
 // TODO(pb): Weave Net invokes router.ConnectionMaker.InitiateConnections;
 // it may be better to provide that on Router directly.
 func (cm *connectionMaker) InitiateConnections(peers []string, replace bool) []error {
+	if replace {
+		return cm.ReconcileTargets(SourceManual, peers)
+	}
+	return cm.AddTargets(SourceManual, peers)
+}
+
+// parsePeerAddrs resolves peers specified in host[:port] format, and
+// checks those specified as ws:// or wss:// URLs.
+func parsePeerAddrs(peers []string) (peerAddrs, []error) {
 	errors := []error{}
 	addrs := peerAddrs{}
 	for _, peer := range peers {
+		if isWebSocketURL(peer) {
+			if _, _, err := parseWebSocketURL(peer); err != nil {
+				errors = append(errors, err)
+			} else {
+				addrs[peer] = nil
+			}
+			continue
+		}
 		host, port, err := net.SplitHostPort(peer)
 		if err != nil {
 			host = peer
@@ -93,26 +121,13 @@ func (cm *connectionMaker) InitiateConnections(peers []string, replace bool) []e
 		}
 		if host == "" || !isAlnum(port) {
 			errors = append(errors, fmt.Errorf("invalid peer name %q, should be host[:port]", peer))
-		} else if addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%s", host, port)); err != nil {
+		} else if addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port)); err != nil {
 			errors = append(errors, err)
 		} else {
 			addrs[peer] = addr
 		}
 	}
-	cm.actionChan <- func() bool {
-		if replace {
-			cm.directPeers = peerAddrs{}
-		}
-		for peer, addr := range addrs {
-			cm.directPeers[peer] = addr
-			// curtail any existing reconnect interval
-			if target, found := cm.targets[cm.completeAddr(*addr)]; found {
-				target.nextTryNow()
-			}
-		}
-		return true
-	}
-	return errors
+	return addrs, errors
 }
 
 func isAlnum(s string) bool {
@@ -125,17 +140,13 @@ func isAlnum(s string) bool {
 }
 
 // ForgetConnections removes direct connections to the provided peers,
-// specified in host:port format.
+// specified in host:port format, as targets of SourceManual; those which
+// other sources contributed remain.
 //
 // TODO(pb): Weave Net invokes router.ConnectionMaker.ForgetConnections;
 // it may be better to provide that on Router directly.
 func (cm *connectionMaker) ForgetConnections(peers []string) {
-	cm.actionChan <- func() bool {
-		for _, peer := range peers {
-			delete(cm.directPeers, peer)
-		}
-		return true
-	}
+	cm.RemoveTargets(SourceManual, peers)
 }
 
 // Targets takes a snapshot of the targets (direct peers),
@@ -146,9 +157,9 @@ func (cm *connectionMaker) Targets(activeOnly bool) []string {
 	resultChan := make(chan []string)
 	cm.actionChan <- func() bool {
 		var slice []string
-		for peer, addr := range cm.directPeers {
+		for peer, direct := range cm.directPeers {
 			if activeOnly {
-				if target, ok := cm.targets[cm.completeAddr(*addr)]; ok && target.tryAfter.IsZero() {
+				if target, ok := cm.targets[cm.targetAddr(peer, direct)]; ok && target.tryAfter.IsZero() {
 					continue
 				}
 			}
@@ -160,6 +171,17 @@ func (cm *connectionMaker) Targets(activeOnly bool) []string {
 	return <-resultChan
 }
 
+// terminations returns the number of connections which have
+// terminated, other than those to ourself.
+func (cm *connectionMaker) terminations() int {
+	resultChan := make(chan int)
+	cm.actionChan <- func() bool {
+		resultChan <- cm.terminationCount
+		return false
+	}
+	return <-resultChan
+}
+
 // connectionAborted marks the target identified by address as broken, and
 // puts it in the TargetWaiting state.
 func (cm *connectionMaker) connectionAborted(address string, err error) {
@@ -167,7 +189,7 @@ func (cm *connectionMaker) connectionAborted(address string, err error) {
 		target := cm.targets[address]
 		target.state = targetWaiting
 		target.lastError = err
-		target.nextTryLater()
+		cm.retryLater(address, target)
 		return true
 	}
 }
@@ -178,11 +200,14 @@ func (cm *connectionMaker) connectionAborted(address string, err error) {
 func (cm *connectionMaker) connectionCreated(conn Connection) {
 	cm.actionChan <- func() bool {
 		cm.connections[conn] = struct{}{}
-		if conn.isOutbound() {
-			target := cm.targets[conn.remoteTCPAddress()]
+		cm.idle.unpark(conn.Remote().Name)
+		// outbound connections made to traverse NAT have no target
+		if target, found := cm.targets[conn.remoteTCPAddress()]; found && conn.isOutbound() {
 			target.state = targetConnected
+			target.peer = conn.Remote().Name
 		}
-		return false
+		// a handshake has completed, perhaps making way for another
+		return cm.handshakes.queued > 0
 	}
 }
 
@@ -194,18 +219,29 @@ func (cm *connectionMaker) connectionTerminated(conn Connection, err error) {
 			cm.terminationCount++
 		}
 		delete(cm.connections, conn)
-		if conn.isOutbound() {
-			target := cm.targets[conn.remoteTCPAddress()]
+		address := conn.remoteTCPAddress()
+		target, found := cm.targets[address]
+		found = found && conn.isOutbound()
+		if err == errConnectionIdle {
+			if !found {
+				address = ""
+			}
+			cm.idle.park(conn.Remote().Name, address)
+		}
+		if found {
 			target.state = targetWaiting
 			target.lastError = err
 			_, peerNameCollision := err.(*peerNameCollisionError)
 			switch {
-			case peerNameCollision || err == errConnectToSelf:
+			case peerNameCollision || err == errConnectToSelf || err == errConnectionIdle:
 				target.nextTryNever()
-			case time.Now().After(target.tryAfter.Add(resetAfter)):
-				target.nextTryNow()
+			case err == errPeerDeparted:
+				// it won't be back soon
+				cm.retryLater(address, target)
+			case cm.ourself.router.clock().Now().After(target.tryAfter.Add(resetAfter)):
+				target.nextTryNow(cm.ourself.router.clock())
 			default:
-				target.nextTryLater()
+				cm.retryLater(address, target)
 			}
 		}
 		return true
@@ -219,8 +255,13 @@ func (cm *connectionMaker) refresh() {
 	cm.actionChan <- func() bool { return true }
 }
 
+// stop stops the actor, for a router which failed to start.
+func (cm *connectionMaker) stop() {
+	close(cm.stopChan)
+}
+
 func (cm *connectionMaker) queryLoop(actionChan <-chan connectionMakerAction) {
-	timer := time.NewTimer(maxDuration)
+	timer := cm.ourself.router.clock().NewTimer(maxDuration)
 	run := func() { timer.Reset(cm.checkStateAndAttemptConnections()) }
 	for {
 		select {
@@ -228,8 +269,11 @@ func (cm *connectionMaker) queryLoop(actionChan <-chan connectionMakerAction) {
 			if action() {
 				run()
 			}
-		case <-timer.C:
+		case <-timer.Chan():
 			run()
+		case <-cm.stopChan:
+			timer.Stop()
+			return
 		}
 	}
 }
@@ -241,14 +285,24 @@ func (cm *connectionMaker) completeAddr(addr net.TCPAddr) string {
 	return addr.String()
 }
 
+// targetAddr returns the address to connect to for a direct peer.
+func (cm *connectionMaker) targetAddr(peer string, direct *directPeer) string {
+	if direct.addr == nil {
+		return peer // a WebSocket URL
+	}
+	return cm.completeAddr(*direct.addr)
+}
+
 func (cm *connectionMaker) checkStateAndAttemptConnections() time.Duration {
 	var (
 		validTarget  = make(map[string]struct{})
 		directTarget = make(map[string]struct{})
 	)
+	cm.wakeUnreachable()
+	cm.pruneBlocks(cm.ourself.router.clock().Now())
 	ourConnectedPeers, ourConnectedTargets, ourInboundIPs := cm.ourConnections()
 
-	addTarget := func(address string) {
+	addTarget := func(address string, delay time.Duration) {
 		if _, connected := ourConnectedTargets[address]; connected {
 			return
 		}
@@ -257,26 +311,43 @@ func (cm *connectionMaker) checkStateAndAttemptConnections() time.Duration {
 			return
 		}
 		tgt := &target{state: targetWaiting}
-		tgt.nextTryNow()
+		tgt.nextTryNow(cm.ourself.router.clock())
+		tgt.tryAfter = tgt.tryAfter.Add(delay)
 		cm.targets[address] = tgt
 	}
 
 	// Add direct targets that are not connected
-	for _, addr := range cm.directPeers {
-		attempt := true
-		if addr.Port == 0 {
+	connected := func(peer string, direct *directPeer) bool {
+		if addr := direct.addr; addr != nil && addr.Port == 0 {
 			// If a peer was specified w/o a port, then we do not
 			// attempt to connect to it if we have any inbound
 			// connections from that IP.
 			if _, connected := ourInboundIPs[addr.IP.String()]; connected {
-				attempt = false
+				return true
 			}
 		}
-		address := cm.completeAddr(*addr)
+		_, connected := ourConnectedTargets[cm.targetAddr(peer, direct)]
+		return connected
+	}
+	// Secondary targets are held back unless all the others have
+	// failed.
+	primaryReachable := false
+	for peer, direct := range cm.directPeers {
+		if direct.priority == PrioritySecondary {
+			continue
+		}
+		if target, found := cm.targets[cm.targetAddr(peer, direct)]; !found || target.lastError == nil || connected(peer, direct) {
+			primaryReachable = true
+			break
+		}
+	}
+	for peer, direct := range cm.directPeers {
+		address := cm.targetAddr(peer, direct)
 		directTarget[address] = struct{}{}
-		if attempt {
-			addTarget(address)
+		if connected(peer, direct) || (direct.priority == PrioritySecondary && primaryReachable) {
+			continue
 		}
+		addTarget(address, 0)
 	}
 
 	// Add targets for peers that someone else is connected to, but we
@@ -308,14 +379,44 @@ func (cm *connectionMaker) ourConnections() (peerNameSet, map[string]struct{}, m
 	return ourConnectedPeers, ourConnectedTargets, ourInboundIPs
 }
 
-func (cm *connectionMaker) addPeerTargets(ourConnectedPeers peerNameSet, addTarget func(string)) {
-	cm.peers.forEach(func(peer *Peer) {
+func (cm *connectionMaker) addPeerTargets(ourConnectedPeers peerNameSet, addTarget func(string, time.Duration)) {
+	var (
+		nat    *natTraversal
+		policy TopologyPolicy
+		scored bool
+	)
+	if router := cm.ourself.router; router != nil {
+		nat, policy, scored = router.nat, router.TopologyPolicy, router.PeerScorer != nil
+	}
+	// Connections, made or being made, counting those to peers the
+	// policy has allowed so far.
+	degree := len(ourConnectedPeers) + cm.attempting()
+	allowed := make(map[PeerName]bool)
+	allow := func(peer *Peer) bool {
+		if policy == nil {
+			return true
+		}
+		ok, decided := allowed[peer.Name]
+		if !decided {
+			ok = policy(ConnectRequest{Peer: peer.Name, NickName: peer.NickName, Connections: degree})
+			if ok {
+				degree++
+			}
+			allowed[peer.Name] = ok
+		}
+		return ok
+	}
+	parked := cm.idle.names()
+	// Modifying peer.connections requires a write lock on Peers, and
+	// since we are holding a read lock, access without locking the peer
+	// is safe.
+	cm.peers.RLock()
+	defer cm.peers.RUnlock()
+	var conns []Connection
+	for _, peer := range cm.peers.byName {
 		if peer == cm.ourself.Peer {
-			return
+			continue
 		}
-		// Modifying peer.connections requires a write lock on Peers,
-		// and since we are holding a read lock (due to the ForEach),
-		// access without locking the peer is safe.
 		for otherPeer, conn := range peer.connections {
 			if otherPeer == cm.ourself.Name {
 				continue
@@ -323,27 +424,83 @@ func (cm *connectionMaker) addPeerTargets(ourConnectedPeers peerNameSet, addTarg
 			if _, connected := ourConnectedPeers[otherPeer]; connected {
 				continue
 			}
-			address := conn.remoteTCPAddress()
-			if conn.isOutbound() {
-				addTarget(address)
-			} else if ip, _, err := net.SplitHostPort(address); err == nil {
-				// There is no point connecting to the (likely
-				// ephemeral) remote port of an inbound connection
-				// that some peer has. Let's try to connect on the
-				// weave port instead.
-				addTarget(fmt.Sprintf("%s:%d", ip, cm.port))
+			conns = append(conns, conn)
+		}
+	}
+	if scored {
+		// best first, so that the policy allows them first
+		scores := make(map[PeerName]float64)
+		for _, conn := range conns {
+			scores[conn.Remote().Name] = cm.ourself.router.scorePeer(conn.Remote(), true)
+		}
+		sort.SliceStable(conns, func(i, j int) bool {
+			return scores[conns[i].Remote().Name] > scores[conns[j].Remote().Name]
+		})
+	}
+	// The addresses of each peer, as others see it, in order.
+	var (
+		candidates = make(map[PeerName][]string)
+		order      []*Peer
+	)
+	for _, conn := range conns {
+		peer := conn.Remote()
+		if _, found := parked[peer.Name]; found {
+			continue
+		}
+		if _, blocked := cm.blockedPeers[peer.Name]; blocked || cm.ourself.router.banned(peer.Name, peer.UID) || !allow(peer) {
+			continue
+		}
+		if nat != nil && nat.behind(peer) {
+			// It can't be dialled, but may be reached another way.
+			nat.reach(peer.Name)
+			continue
+		}
+		address := conn.remoteTCPAddress()
+		if !conn.isOutbound() {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				continue
 			}
+			// There is no point connecting to the (likely
+			// ephemeral) remote port of an inbound connection
+			// that some peer has. Let's try to connect on the
+			// port it advertises listening on instead.
+			address = dialAddr(peer, ip, cm.port)
+		}
+		if _, found := candidates[peer.Name]; !found {
+			order = append(order, peer)
+		}
+		candidates[peer.Name] = append(candidates[peer.Name], address)
+	}
+	// Then those it advertises, trying one after another, alternating
+	// address families, until one connects.
+	for _, peer := range order {
+		for i, address := range happyEyeballs(append(candidates[peer.Name], peer.Addrs...)) {
+			addTarget(address, time.Duration(i)*happyEyeballsDelay)
 		}
-	})
+	}
+}
+
+// attempting returns the number of targets we are connecting to.
+func (cm *connectionMaker) attempting() int {
+	n := 0
+	for _, target := range cm.targets {
+		if target.state == targetAttempting {
+			n++
+		}
+	}
+	return n
 }
 
 func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, directTarget map[string]struct{}) time.Duration {
-	now := time.Now() // make sure we catch items just added
+	now := cm.ourself.router.clock().Now() // make sure we catch items just added
 	after := maxDuration
+	var due []string
 	for address, target := range cm.targets {
 		if target.state != targetWaiting && target.state != targetSuspended {
 			continue
 		}
+		target.queued = false
 		if _, valid := validTarget[address]; !valid {
 			// Not valid: suspend reconnects if direct peer,
 			// otherwise forget this target entirely
@@ -358,15 +515,20 @@ func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, dir
 			continue
 		}
 		target.state = targetWaiting
+		if until, blocked := cm.blockedUntil(address, target.peer); blocked && until.After(now) {
+			if duration := until.Sub(now); duration < after {
+				after = duration
+			}
+			continue
+		}
 		switch duration := target.tryAfter.Sub(now); {
 		case duration <= 0:
-			target.state = targetAttempting
-			_, isCmdLineTarget := directTarget[address]
-			go cm.attemptConnection(address, isCmdLineTarget)
+			due = append(due, address)
 		case duration < after:
 			after = duration
 		}
 	}
+	cm.dialDue(due, directTarget)
 	return after
 }
 
@@ -380,20 +542,15 @@ func (cm *connectionMaker) attemptConnection(address string, acceptNewPeer bool)
 
 func (t *target) nextTryNever() {
 	t.tryAfter = time.Time{}
-	t.tryInterval = maxInterval
 }
 
-func (t *target) nextTryNow() {
-	t.tryAfter = time.Now()
-	t.tryInterval = initialInterval
+func (t *target) nextTryNow(clock Clock) {
+	t.tryAfter = clock.Now()
+	t.attempts = 0
 }
 
-// The delay at the nth retry is a random value in the range
-// [i-i/2,i+i/2], where i = InitialInterval * 1.5^(n-1).
-func (t *target) nextTryLater() {
-	t.tryAfter = time.Now().Add(t.tryInterval/2 + time.Duration(rand.Int63n(int64(t.tryInterval))))
-	t.tryInterval = t.tryInterval * 3 / 2
-	if t.tryInterval > maxInterval {
-		t.tryInterval = maxInterval
-	}
+// nextTryLater schedules the next retry according to policy.
+func (t *target) nextTryLater(policy BackoffPolicy, clock Clock, rng Rand) {
+	t.attempts++
+	t.tryAfter = clock.Now().Add(policy.delay(rng, t.attempts, t.lastError))
 }
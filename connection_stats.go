@@ -0,0 +1,64 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionStats are the counters of a local connection, as reported
+// in Status.
+type ConnectionStats struct {
+	BytesSent        uint64
+	BytesReceived    uint64
+	MessagesSent     uint64
+	MessagesReceived uint64
+	EstablishedAt    time.Time // zero if not yet established
+	CorruptFrames    uint64    // dropped, failing their checksums
+}
+
+// connectionStats accumulates the ConnectionStats of a LocalConnection,
+// which are updated by its sending and receiving goroutines and read by
+// NewStatus.
+type connectionStats struct {
+	sync.Mutex
+	stats     ConnectionStats
+	lastError string // the cause of the connection shutting down
+}
+
+func (s *connectionStats) sent(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.BytesSent += uint64(n)
+	s.stats.MessagesSent++
+}
+
+func (s *connectionStats) received(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.BytesReceived += uint64(n)
+	s.stats.MessagesReceived++
+}
+
+func (s *connectionStats) corrupt() {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.CorruptFrames++
+}
+
+func (s *connectionStats) established(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.stats.EstablishedAt = now
+}
+
+func (s *connectionStats) failed(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastError = err.Error()
+}
+
+func (s *connectionStats) snapshot() (ConnectionStats, string) {
+	s.Lock()
+	defer s.Unlock()
+	return s.stats, s.lastError
+}
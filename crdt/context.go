@@ -0,0 +1,93 @@
+package crdt
+
+import "github.com/weaveworks/mesh"
+
+// dot identifies an update: the Seq'th made at its origin.
+type dot struct {
+	Origin mesh.PeerName
+	Seq    uint64
+}
+
+// causalContext is the set of the dots of all the updates a replica
+// has seen, whether or not they are still part of its state: all those
+// from each origin up to a sequence number, plus a cloud of those
+// received out of order.
+type causalContext struct {
+	Compact map[mesh.PeerName]uint64
+	Cloud   map[dot]bool
+}
+
+func newCausalContext() *causalContext {
+	return &causalContext{Compact: make(map[mesh.PeerName]uint64), Cloud: make(map[dot]bool)}
+}
+
+// init makes the maps of a decoded context usable, since gob leaves
+// those which were empty nil.
+func (c *causalContext) init() {
+	if c.Compact == nil {
+		c.Compact = make(map[mesh.PeerName]uint64)
+	}
+	if c.Cloud == nil {
+		c.Cloud = make(map[dot]bool)
+	}
+}
+
+func (c *causalContext) contains(d dot) bool {
+	return d.Seq <= c.Compact[d.Origin] || c.Cloud[d]
+}
+
+// next returns the dot for the next update originating at origin.
+func (c *causalContext) next(origin mesh.PeerName) dot {
+	return dot{origin, c.Compact[origin] + 1}
+}
+
+func (c *causalContext) add(d dot) {
+	if !c.contains(d) {
+		c.Cloud[d] = true
+		c.compact()
+	}
+}
+
+// join adds the dots of other, returning whether there were any new
+// ones.
+func (c *causalContext) join(other *causalContext) bool {
+	changed := false
+	for origin, seq := range other.Compact {
+		if seq > c.Compact[origin] {
+			c.Compact[origin] = seq
+			changed = true
+		}
+	}
+	for d := range other.Cloud {
+		if !c.contains(d) {
+			c.Cloud[d] = true
+			changed = true
+		}
+	}
+	c.compact()
+	return changed
+}
+
+// compact moves dots from the cloud to the compact part, where they
+// have caught up.
+func (c *causalContext) compact() {
+	for changed := true; changed; {
+		changed = false
+		for d := range c.Cloud {
+			switch {
+			case d.Seq <= c.Compact[d.Origin]:
+				delete(c.Cloud, d)
+			case d.Seq == c.Compact[d.Origin]+1:
+				c.Compact[d.Origin] = d.Seq
+				delete(c.Cloud, d)
+				changed = true
+			}
+		}
+	}
+}
+
+func (c *causalContext) copy() *causalContext {
+	result := newCausalContext()
+	result.join(c)
+	return result
+}
@@ -0,0 +1,183 @@
+// Package crdt provides conflict-free replicated data types, CRDTs,
+// which replicate themselves over mesh gossip channels: a
+// last-writer-wins map, an observed-remove set, and a counter.
+//
+// Each is a mesh.Gossiper, to be registered with a router, and then
+// given the channel it was registered on, over which it broadcasts the
+// delta of each update made locally:
+//
+//	m := crdt.NewLWWMap(router.Ourself.Name)
+//	gossip, err := router.NewGossip("config", m)
+//	if err != nil {
+//		return err
+//	}
+//	m.Register(gossip)
+//	err = m.Set("greeting", "hello")
+//
+// Peers which miss broadcasts catch up with the periodic gossip, in
+// which neighbours exchange digests of what they have seen, and send
+// each other only the updates the other is missing.
+//
+// The values of an LWWMap are gob-encoded, so their concrete types
+// must be registered with gob.Register, as for any value sent as an
+// interface; Set returns an error for values which can't be encoded.
+package crdt
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Hook to mock time for testing
+var now = time.Now
+
+// LWWMap is a last-writer-wins map from strings to values: of
+// concurrent updates to a key, that made at the latest wall-clock time
+// wins, with ties broken by peer name.
+type LWWMap struct {
+	*replica
+}
+
+// NewLWWMap returns an empty LWWMap, replicated from the peer self.
+func NewLWWMap(self mesh.PeerName) *LWWMap {
+	return &LWWMap{newReplica(self)}
+}
+
+// Set sets the value of key, returning an error if the value can't be
+// gob-encoded, e.g. because its type isn't registered.
+func (m *LWWMap) Set(key string, value interface{}) error {
+	if err := gob.NewEncoder(ioutil.Discard).Encode(&entry{Value: value}); err != nil {
+		return fmt.Errorf("unable to encode value of %s: %v", key, err)
+	}
+	m.update(func(s *state, d dot) *state {
+		return s.delta(key, d, &entry{Value: value, Time: now().UnixNano()})
+	})
+	return nil
+}
+
+// Delete removes key, unless it is concurrently set elsewhere.
+func (m *LWWMap) Delete(key string) {
+	m.update(func(s *state, d dot) *state { return s.delta(key, d, nil) })
+}
+
+// Get returns the value of key, and whether it has one.
+func (m *LWWMap) Get(key string) (value interface{}, found bool) {
+	m.read(func(s *state) {
+		var winner dot
+		var latest int64
+		for d, e := range s.Store[key] {
+			if !found || e.Time > latest || (e.Time == latest && d.Origin > winner.Origin) {
+				value, winner, latest, found = e.Value, d, e.Time, true
+			}
+		}
+	})
+	return value, found
+}
+
+// Keys returns the keys which have values, sorted.
+func (m *LWWMap) Keys() []string {
+	var keys []string
+	m.read(func(s *state) { keys = sortedKeys(s.Store) })
+	return keys
+}
+
+// ORSet is an observed-remove set of strings: removing an element only
+// removes the additions of it which have been seen, so of a concurrent
+// addition and removal, the addition wins.
+type ORSet struct {
+	*replica
+}
+
+// NewORSet returns an empty ORSet, replicated from the peer self.
+func NewORSet(self mesh.PeerName) *ORSet {
+	return &ORSet{newReplica(self)}
+}
+
+// Add adds element to the set.
+func (set *ORSet) Add(element string) {
+	set.update(func(s *state, d dot) *state { return s.delta(element, d, &entry{}) })
+}
+
+// Remove removes element from the set.
+func (set *ORSet) Remove(element string) {
+	set.update(func(s *state, d dot) *state { return s.delta(element, d, nil) })
+}
+
+// Contains returns whether element is in the set.
+func (set *ORSet) Contains(element string) (found bool) {
+	set.read(func(s *state) { _, found = s.Store[element] })
+	return found
+}
+
+// Elements returns the elements of the set, sorted.
+func (set *ORSet) Elements() []string {
+	var elements []string
+	set.read(func(s *state) { elements = sortedKeys(s.Store) })
+	return elements
+}
+
+// Counter is a counter which may be incremented and decremented.
+type Counter struct {
+	*replica
+}
+
+// NewCounter returns a zero Counter, replicated from the peer self.
+func NewCounter(self mesh.PeerName) *Counter {
+	return &Counter{newReplica(self)}
+}
+
+// Add adds n, which may be negative, to the counter.
+func (c *Counter) Add(n int64) {
+	c.update(func(s *state, d dot) *state {
+		key := c.self.String()
+		e := counterEntry(s.Store[key])
+		if n >= 0 {
+			e.Inc += uint64(n)
+		} else {
+			e.Dec += uint64(-n)
+		}
+		return s.delta(key, d, &e)
+	})
+}
+
+// Value returns the value of the counter.
+func (c *Counter) Value() (value int64) {
+	c.read(func(s *state) {
+		for _, dots := range s.Store {
+			e := counterEntry(dots)
+			value += int64(e.Inc) - int64(e.Dec)
+		}
+	})
+	return value
+}
+
+// counterEntry returns the entry of a peer's key in a Counter. Only
+// the peer updates it, so there is only ever one current entry, but
+// should there be more, their counts only grow, so the largest is the
+// latest.
+func counterEntry(dots map[dot]entry) entry {
+	var result entry
+	for _, e := range dots {
+		if e.Inc > result.Inc {
+			result.Inc = e.Inc
+		}
+		if e.Dec > result.Dec {
+			result.Dec = e.Dec
+		}
+	}
+	return result
+}
+
+func sortedKeys(store dotStore) []string {
+	keys := make([]string, 0, len(store))
+	for key := range store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,174 @@
+package crdt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// peerName returns the ith of some names which are valid, and ordered
+// by i, whatever the flavour of peer names.
+func peerName(t *testing.T, i byte) mesh.PeerName {
+	nameBytes := make([]byte, mesh.NameSize)
+	nameBytes[len(nameBytes)-1] = i
+	name, err := mesh.PeerNameFromBytes(nameBytes)
+	require.NoError(t, err)
+	return name
+}
+
+// exchange has a and b send each other their complete state.
+func exchange(t *testing.T, a, b mesh.Gossiper) {
+	for _, pair := range [][2]mesh.Gossiper{{a, b}, {b, a}} {
+		for _, msg := range pair[0].Gossip().Encode() {
+			_, err := pair[1].OnGossip(msg)
+			require.NoError(t, err)
+		}
+	}
+}
+
+type broadcastRecorder struct {
+	updates []mesh.GossipData
+}
+
+func (b *broadcastRecorder) GossipUnicast(mesh.PeerName, []byte) error { return nil }
+
+func (b *broadcastRecorder) GossipBroadcast(update mesh.GossipData) {
+	b.updates = append(b.updates, update)
+}
+
+func (b *broadcastRecorder) GossipNeighbourSubset(mesh.GossipData) {}
+
+func TestLWWMap(t *testing.T) {
+	defer func(prev func() time.Time) { now = prev }(now)
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	a := NewLWWMap(peerName(t, 1))
+	b := NewLWWMap(peerName(t, 2))
+
+	// the later of concurrent sets wins
+	require.NoError(t, a.Set("k", "from a"))
+	clock = clock.Add(time.Second)
+	require.NoError(t, b.Set("k", "from b"))
+	exchange(t, a, b)
+	for _, m := range []*LWWMap{a, b} {
+		value, found := m.Get("k")
+		require.True(t, found)
+		require.Equal(t, "from b", value)
+	}
+
+	// and ties are broken by peer name
+	require.NoError(t, a.Set("tie", "from a"))
+	require.NoError(t, b.Set("tie", "from b"))
+	exchange(t, a, b)
+	value, _ := a.Get("tie")
+	require.Equal(t, "from b", value)
+
+	// deletions replicate
+	a.Delete("k")
+	exchange(t, a, b)
+	_, found := b.Get("k")
+	require.False(t, found)
+	require.Equal(t, []string{"tie"}, b.Keys())
+
+	// values which can't be encoded are refused up front
+	type unregistered struct{ X int }
+	require.Error(t, a.Set("bad", unregistered{1}))
+	require.Equal(t, []string{"tie"}, a.Keys())
+}
+
+func TestORSet(t *testing.T) {
+	a := NewORSet(peerName(t, 1))
+	b := NewORSet(peerName(t, 2))
+	a.Add("x")
+	a.Add("y")
+	exchange(t, a, b)
+	require.Equal(t, []string{"x", "y"}, b.Elements())
+
+	// of a concurrent addition and removal, the addition wins
+	a.Remove("x")
+	b.Add("x")
+	b.Remove("y")
+	exchange(t, a, b)
+	for _, set := range []*ORSet{a, b} {
+		require.Equal(t, []string{"x"}, set.Elements())
+		require.True(t, set.Contains("x"))
+		require.False(t, set.Contains("y"))
+	}
+}
+
+func TestCounter(t *testing.T) {
+	a := NewCounter(peerName(t, 1))
+	b := NewCounter(peerName(t, 2))
+	a.Add(3)
+	b.Add(-1)
+	exchange(t, a, b)
+	a.Add(2)
+	exchange(t, a, b)
+	exchange(t, a, b)
+	require.Equal(t, int64(4), a.Value())
+	require.Equal(t, int64(4), b.Value())
+}
+
+func TestBroadcastDeltas(t *testing.T) {
+	src := peerName(t, 1)
+	a := NewORSet(src)
+	b := NewORSet(peerName(t, 2))
+	var recorder broadcastRecorder
+	a.Register(&recorder)
+	a.Add("x")
+	a.Add("y")
+	a.Remove("x")
+	require.Len(t, recorder.updates, 3)
+
+	// deltas may arrive in any order: here the addition of x arrives
+	// after its removal, so is no news
+	for i := len(recorder.updates) - 1; i >= 0; i-- {
+		received, err := b.OnGossipBroadcast(src, recorder.updates[i].Encode()[0])
+		require.NoError(t, err)
+		require.Equal(t, i != 0, received != nil)
+	}
+	require.Equal(t, []string{"y"}, b.Elements())
+	require.Empty(t, b.state.Context.Cloud)
+
+	// and are only relayed the first time
+	received, err := b.OnGossipBroadcast(src, recorder.updates[0].Encode()[0])
+	require.NoError(t, err)
+	require.Nil(t, received)
+
+	// merged deltas have the effect of all of them
+	c := NewORSet(peerName(t, 3))
+	merged := recorder.updates[0].Merge(recorder.updates[1]).Merge(recorder.updates[2])
+	_, err = c.OnGossip(merged.Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{"y"}, c.Elements())
+}
+
+func TestDigests(t *testing.T) {
+	aName, bName := peerName(t, 1), peerName(t, 2)
+	a, b := NewLWWMap(aName), NewLWWMap(bName)
+	require.NoError(t, a.Set("one", 1))
+	exchange(t, a, b)
+	require.NoError(t, a.Set("two", 2))
+	a.Delete("one")
+
+	// a sends b just what it is missing
+	delta, err := a.OnDigest(bName, b.Digest())
+	require.NoError(t, err)
+	require.Len(t, delta.(*state).Store, 1)
+	_, err = b.OnGossip(delta.Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, []string{"two"}, b.Keys())
+
+	// until there is nothing
+	for _, pair := range []struct {
+		from *LWWMap
+		to   mesh.PeerName
+		of   *LWWMap
+	}{{a, bName, b}, {b, aName, a}} {
+		delta, err := pair.from.OnDigest(pair.to, pair.of.Digest())
+		require.NoError(t, err)
+		require.Nil(t, delta)
+	}
+}
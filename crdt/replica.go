@@ -0,0 +1,115 @@
+package crdt
+
+import (
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// replica is the machinery common to the CRDTs: it holds the state of
+// one, applies updates to it, and replicates it over a gossip channel,
+// implementing mesh.Gossiper, and mesh.DigestGossiper, so that
+// anti-entropy only sends neighbours the updates they are missing.
+type replica struct {
+	sync.RWMutex
+	self   mesh.PeerName
+	state  *state
+	gossip mesh.Gossip
+}
+
+var _ mesh.DigestGossiper = &replica{}
+
+func newReplica(self mesh.PeerName) *replica {
+	return &replica{self: self, state: newState()}
+}
+
+// Register sets the channel on which updates made here are broadcast,
+// as returned by mesh.Router.NewGossip when registering the CRDT. Until
+// then, updates made here only reach other peers with the periodic
+// gossip.
+func (r *replica) Register(gossip mesh.Gossip) {
+	r.Lock()
+	defer r.Unlock()
+	r.gossip = gossip
+}
+
+// update applies the delta made by f, which is given the state and the
+// dot of the update, and broadcasts it.
+func (r *replica) update(f func(s *state, d dot) *state) {
+	r.Lock()
+	delta := f(r.state, r.state.Context.next(r.self))
+	r.state.join(delta)
+	gossip := r.gossip
+	r.Unlock()
+	if gossip != nil {
+		gossip.GossipBroadcast(delta)
+	}
+}
+
+// read calls f with the state, which f must not modify.
+func (r *replica) read(f func(s *state)) {
+	r.RLock()
+	defer r.RUnlock()
+	f(r.state)
+}
+
+// receive joins the encoded delta or state in msg, returning it if it
+// was news.
+func (r *replica) receive(msg []byte) (mesh.GossipData, error) {
+	delta, err := decodeState(msg)
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	changed := r.state.join(delta)
+	r.Unlock()
+	if !changed {
+		return nil, nil
+	}
+	return delta, nil
+}
+
+// OnGossipUnicast implements mesh.Gossiper. CRDTs have no use for
+// unicasts, and ignore them.
+func (r *replica) OnGossipUnicast(src mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+// OnGossipBroadcast implements mesh.Gossiper.
+func (r *replica) OnGossipBroadcast(src mesh.PeerName, update []byte) (mesh.GossipData, error) {
+	return r.receive(update)
+}
+
+// Gossip implements mesh.Gossiper.
+func (r *replica) Gossip() mesh.GossipData {
+	r.RLock()
+	defer r.RUnlock()
+	return r.state.copy()
+}
+
+// OnGossip implements mesh.Gossiper.
+func (r *replica) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return r.receive(msg)
+}
+
+// Digest implements mesh.DigestGossiper, summarising the state by its
+// causal context.
+func (r *replica) Digest() []byte {
+	r.RLock()
+	defer r.RUnlock()
+	return (&state{Store: make(dotStore), Context: r.state.Context}).Encode()[0]
+}
+
+// OnDigest implements mesh.DigestGossiper.
+func (r *replica) OnDigest(src mesh.PeerName, digest []byte) (mesh.GossipData, error) {
+	theirs, err := decodeState(digest)
+	if err != nil {
+		return nil, err
+	}
+	r.RLock()
+	defer r.RUnlock()
+	if delta := r.state.missing(theirs.Context); delta != nil {
+		return delta, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,145 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/weaveworks/mesh"
+)
+
+// entry is the content of an update.
+type entry struct {
+	Value interface{} // of an LWWMap
+	Time  int64       // of an LWWMap update, in Unix nanoseconds
+	Inc   uint64      // of a Counter
+	Dec   uint64      // of a Counter
+}
+
+// dotStore holds, for each key, the updates to it which are current,
+// by their dots. Several concurrent updates may be current.
+type dotStore map[string]map[dot]entry
+
+// state is a dot store and its causal context. It is both the state of
+// a replica, and a delta of it, as exchanged by replicas: the delta of
+// an update has the new entry in its store, and the dots of the entries
+// it supersedes in its context.
+type state struct {
+	Store   dotStore
+	Context *causalContext
+}
+
+var _ mesh.GossipData = &state{}
+
+func newState() *state {
+	return &state{Store: make(dotStore), Context: newCausalContext()}
+}
+
+func decodeState(msg []byte) (*state, error) {
+	var s state
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Store == nil {
+		s.Store = make(dotStore)
+	}
+	if s.Context == nil {
+		s.Context = newCausalContext()
+	}
+	s.Context.init()
+	return &s, nil
+}
+
+// Encode implements GossipData. The values of entries are checked by
+// LWWMap.Set, so encoding can't fail.
+func (s *state) Encode() [][]byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+// Merge implements GossipData.
+func (s *state) Merge(other mesh.GossipData) mesh.GossipData {
+	result := s.copy()
+	result.join(other.(*state))
+	return result
+}
+
+func (s *state) add(key string, d dot, e entry) {
+	dots, found := s.Store[key]
+	if !found {
+		dots = make(map[dot]entry)
+		s.Store[key] = dots
+	}
+	dots[d] = e
+}
+
+// join merges other into s, returning whether s changed: updates in
+// other which s hasn't seen are added, and those in s which other has
+// seen superseded are removed.
+func (s *state) join(other *state) bool {
+	changed := false
+	for key, dots := range other.Store {
+		for d, e := range dots {
+			if _, found := s.Store[key][d]; !found && !s.Context.contains(d) {
+				s.add(key, d, e)
+				changed = true
+			}
+		}
+	}
+	for key, dots := range s.Store {
+		for d := range dots {
+			if _, found := other.Store[key][d]; !found && other.Context.contains(d) {
+				delete(dots, d)
+				changed = true
+			}
+		}
+		if len(dots) == 0 {
+			delete(s.Store, key)
+		}
+	}
+	return s.Context.join(other.Context) || changed
+}
+
+// missing returns the delta of s which a replica which has seen the
+// dots in context lacks, or nil if there is none.
+func (s *state) missing(context *causalContext) *state {
+	delta := &state{Store: make(dotStore), Context: s.Context.copy()}
+	for key, dots := range s.Store {
+		for d, e := range dots {
+			if !context.contains(d) {
+				delta.add(key, d, e)
+			}
+		}
+	}
+	if len(delta.Store) == 0 && !context.copy().join(s.Context) {
+		return nil
+	}
+	return delta
+}
+
+func (s *state) copy() *state {
+	result := &state{Store: make(dotStore, len(s.Store)), Context: s.Context.copy()}
+	for key, dots := range s.Store {
+		for d, e := range dots {
+			result.add(key, d, e)
+		}
+	}
+	return result
+}
+
+// delta returns the delta of an update to key, with the dot d, which
+// supersedes the current entries of key, and, if e is non-nil, adds a
+// new one.
+func (s *state) delta(key string, d dot, e *entry) *state {
+	delta := newState()
+	for old := range s.Store[key] {
+		delta.Context.add(old)
+	}
+	delta.Context.add(d)
+	if e != nil {
+		delta.add(key, d, *e)
+	}
+	return delta
+}
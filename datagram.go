@@ -0,0 +1,224 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// With Config.Datagrams, each connection has a UDP socket of its own,
+// whose port it advertises in the handshake under this key. Where both
+// ends advertise one, the unicasts of channels configured with
+// GossipChannelConfig.Datagrams which are small enough to fit in a
+// datagram are sent over UDP, sparing them the head-of-line blocking of
+// the TCP connection; they may be lost. Everything else, and unicasts
+// whose datagrams can't be sent, go over TCP as usual.
+const datagramPortKey = "DatagramPort"
+
+const (
+	// maxDatagramMsg bounds the msgs sent as datagrams, so that the
+	// datagrams aren't fragmented by IP on common paths.
+	maxDatagramMsg = 1200
+
+	maxDatagramSize = 64 * 1024
+
+	// datagramReplayWindow is how far behind the latest datagram
+	// received one may be reordered and still be accepted.
+	datagramReplayWindow = 64
+)
+
+// datagramLink is the UDP path of a connection.
+type datagramLink struct {
+	socket *net.UDPConn
+	remote *net.UDPAddr
+	// keys of each direction, nil unless the connection is encrypted,
+	// so that our own datagrams reflected back at us don't open
+	sendKey  *[32]byte
+	recvKey  *[32]byte
+	seq      uint64 // of the last datagram sealed, accessed atomically
+	replay   datagramReplay
+	sent     uint64 // datagrams, accessed atomically
+	received uint64
+}
+
+// datagramReplay drops datagrams already received, or too old to tell,
+// by their sequence numbers. Only the receiving goroutine uses it.
+type datagramReplay struct {
+	latest uint64
+	seen   uint64 // bit i is set if latest-i has been received
+}
+
+func (r *datagramReplay) accept(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return false
+	case seq > r.latest:
+		if shift := seq - r.latest; shift < datagramReplayWindow {
+			r.seen = r.seen<<shift | 1
+		} else {
+			r.seen = 1
+		}
+		r.latest = seq
+		return true
+	case r.latest-seq >= datagramReplayWindow:
+		return false
+	default:
+		bit := uint64(1) << (r.latest - seq)
+		if r.seen&bit != 0 {
+			return false
+		}
+		r.seen |= bit
+		return true
+	}
+}
+
+// datagramKey derives the key of datagrams sent by one end of a
+// connection from its session key, whose nonces the TCP connection uses.
+func datagramKey(sessionKey *[32]byte, outbound bool) *[32]byte {
+	direction := "mesh datagrams from acceptor"
+	if outbound {
+		direction = "mesh datagrams from initiator"
+	}
+	key := sha256.Sum256(append([]byte(direction), sessionKey[:]...))
+	return &key
+}
+
+// seal prefixes msg with its sequence number, which is also its nonce,
+// and encrypts it if the link is encrypted.
+func (link *datagramLink) seal(msg []byte) []byte {
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, atomic.AddUint64(&link.seq, 1))
+	if link.sendKey == nil {
+		return append(seq, msg...)
+	}
+	var nonce [24]byte
+	copy(nonce[:], seq)
+	return secretbox.Seal(seq, msg, &nonce, link.sendKey)
+}
+
+// open checks, and decrypts, a datagram received, returning false if it
+// should be dropped.
+func (link *datagramLink) open(datagram []byte, from *net.UDPAddr) ([]byte, bool) {
+	if len(datagram) < 8 {
+		return nil, false
+	}
+	seq := binary.BigEndian.Uint64(datagram)
+	var msg []byte
+	if link.recvKey == nil {
+		// all we have to go on is where it came from
+		if !from.IP.Equal(link.remote.IP) || from.Port != link.remote.Port {
+			return nil, false
+		}
+		msg = append([]byte(nil), datagram[8:]...)
+	} else {
+		// the key authenticates the sender, wherever it is
+		var nonce [24]byte
+		copy(nonce[:], datagram[:8])
+		var ok bool
+		if msg, ok = secretbox.Open(nil, datagram[8:], &nonce, link.recvKey); !ok {
+			return nil, false
+		}
+	}
+	// only once authenticated, lest forgeries advance the window
+	if !link.replay.accept(seq) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// listenDatagrams opens the UDP socket of a connection, if configured,
+// adding its port to the handshake features.
+func (conn *LocalConnection) listenDatagrams(features map[string]string) {
+	tcpConn, ok := conn.tcpConn.(*net.TCPConn)
+	if !conn.router.Datagrams || !ok {
+		// not over WebSockets, which are for peers UDP can't reach
+		return
+	}
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		conn.logf("unable to open datagram socket: %v", err)
+		return
+	}
+	conn.datagramSocket = socket
+	features[datagramPortKey] = strconv.Itoa(socket.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// startDatagrams starts the UDP path, if both ends have a socket for it,
+// given the handshake features of the remote.
+func (conn *LocalConnection) startDatagrams(features map[string]string) {
+	socket := conn.datagramSocket
+	if socket == nil {
+		return
+	}
+	port, err := strconv.Atoi(features[datagramPortKey])
+	if err != nil {
+		socket.Close()
+		return
+	}
+	remote := conn.tcpConn.RemoteAddr().(*net.TCPAddr)
+	link := &datagramLink{socket: socket, remote: &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone}}
+	if conn.sessionKey != nil {
+		link.sendKey = datagramKey(conn.sessionKey, conn.outbound)
+		link.recvKey = datagramKey(conn.sessionKey, !conn.outbound)
+	}
+	conn.datagrams = link
+	go conn.receiveDatagrams(link)
+}
+
+// datagramSender is implemented by connections with a UDP path.
+type datagramSender interface {
+	sendDatagram(m protocolMsg) bool
+}
+
+// sendDatagram sends m over the UDP path, returning false if it can't,
+// in which case it should be sent over TCP.
+func (conn *LocalConnection) sendDatagram(m protocolMsg) bool {
+	link := conn.datagrams
+	if link == nil || len(m.msg) > maxDatagramMsg {
+		return false
+	}
+	msg := link.seal(append([]byte{byte(m.tag)}, m.msg...))
+	if _, err := link.socket.WriteToUDP(msg, link.remote); err != nil {
+		return false
+	}
+	atomic.AddUint64(&link.sent, 1)
+	conn.stats.sent(len(msg))
+	conn.router.tap(TapSent, conn.remote.Name, m)
+	conn.noteActive()
+	return true
+}
+
+func (conn *LocalConnection) receiveDatagrams(link *datagramLink) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := link.socket.ReadFromUDP(buf)
+		if err != nil {
+			return // closed by teardown
+		}
+		msg, ok := link.open(buf[:n], from)
+		if !ok {
+			continue
+		}
+		if len(msg) < 1 || protocolTag(msg[0]) != ProtocolGossipUnicast {
+			continue
+		}
+		atomic.AddUint64(&link.received, 1)
+		conn.stats.received(n)
+		// datagrams may be lost, so errors handling them needn't
+		// break the connection
+		if err := conn.handleProtocolMsg(protocolTag(msg[0]), msg[1:]); err != nil {
+			conn.logf("error handling datagram: %v", err)
+		}
+	}
+}
+
+func (conn *LocalConnection) closeDatagrams() {
+	if conn.datagramSocket != nil {
+		conn.datagramSocket.Close()
+	}
+}
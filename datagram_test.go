@@ -0,0 +1,100 @@
+package mesh
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// unicastChannel passes on the unicasts it receives.
+type unicastChannel struct {
+	*testGossiper
+	unicasts chan []byte
+}
+
+func (g *unicastChannel) OnGossipUnicast(_ PeerName, msg []byte) error {
+	g.unicasts <- msg
+	return nil
+}
+
+func TestDatagrams(t *testing.T) {
+	for _, password := range [][]byte{nil, []byte("secret")} {
+		config := Config{Datagrams: true, Password: password}
+		r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+		r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+		channelConfig := GossipChannelConfig{Datagrams: true}
+		c1, err := r1.NewGossipChannel("test", newTestGossiper(), channelConfig)
+		require.NoError(t, err)
+		g2 := &unicastChannel{newTestGossiper(), make(chan []byte, 2)}
+		_, err = r2.NewGossipChannel("test", g2, channelConfig)
+		require.NoError(t, err)
+
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		go func() {
+			for {
+				tcpConn, err := ln.AcceptTCP()
+				if err != nil {
+					return
+				}
+				r2.acceptTCP(tcpConn)
+			}
+		}()
+		r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+		waitUntil(t, func() bool {
+			r1.Routes.ensureRecalculated()
+			_, found := r1.Routes.UnicastAll(r2.Ourself.Name)
+			return found
+		})
+		conn, _ := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		link := conn.(*LocalConnection).datagrams
+		require.NotNil(t, link)
+		require.Equal(t, password != nil, link.sendKey != nil)
+
+		// small unicasts go by UDP, large ones by TCP
+		require.NoError(t, c1.GossipUnicast(r2.Ourself.Name, []byte("small")))
+		require.Equal(t, []byte("small"), <-g2.unicasts)
+		require.Equal(t, uint64(1), atomic.LoadUint64(&link.sent))
+		large := make([]byte, maxDatagramMsg*2)
+		require.NoError(t, c1.GossipUnicast(r2.Ourself.Name, large))
+		require.Equal(t, large, <-g2.unicasts)
+		require.Equal(t, uint64(1), atomic.LoadUint64(&link.sent))
+
+		if password != nil {
+			// encrypted datagrams are accepted from any address, but
+			// only once
+			remote, _ := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+			to := remote.(*LocalConnection).datagramSocket.LocalAddr().(*net.UDPAddr)
+			elsewhere, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			require.NoError(t, err)
+			datagram := link.seal(append([]byte{byte(ProtocolGossipUnicast)}, gobEncode("test", r1.Ourself.Name, r2.Ourself.Name, []byte("moved"), gossipFrameMeta{})...))
+			for i := 0; i < 2; i++ {
+				_, err = elsewhere.WriteToUDP(datagram, to)
+				require.NoError(t, err)
+			}
+			require.Equal(t, []byte("moved"), <-g2.unicasts)
+			require.NoError(t, c1.GossipUnicast(r2.Ourself.Name, []byte("after")))
+			require.Equal(t, []byte("after"), <-g2.unicasts)
+			elsewhere.Close()
+		}
+
+		ln.Close()
+		r1.Stop()
+		r2.Stop()
+	}
+}
+
+func TestDatagramReplay(t *testing.T) {
+	var r datagramReplay
+	require.False(t, r.accept(0))
+	require.True(t, r.accept(2))
+	require.True(t, r.accept(1))  // reordered
+	require.False(t, r.accept(2)) // replayed
+	require.False(t, r.accept(1))
+	require.True(t, r.accept(2+datagramReplayWindow))
+	require.False(t, r.accept(2)) // too old to tell
+	require.True(t, r.accept(3))
+	require.False(t, r.accept(3))
+}
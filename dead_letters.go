@@ -0,0 +1,84 @@
+package mesh
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// DeadLetter is a unicast which a peer on the way to its destination
+// couldn't relay, e.g. because it had no route to the destination, or
+// the destination had left the mesh. Dead letters are returned to the
+// peer which sent the unicast, so the application can retry or alert.
+type DeadLetter struct {
+	Channel string
+	Dst     PeerName // the destination of the unicast
+	Relay   PeerName // the peer which dropped it
+	Payload []byte   // nil if the unicast was sealed
+	Reason  string
+}
+
+// DeadLetterStats counts the dead letters on a channel.
+type DeadLetterStats struct {
+	Channel  string
+	Dropped  uint64 // unicasts from other peers we couldn't relay
+	Returned uint64 // our unicasts returned to us as dead letters
+}
+
+// unroutableError is returned by relayUnicastMsg when there is no way
+// towards the destination, as opposed to a failure to send.
+type unroutableError struct{ error }
+
+// returnDeadLetter returns a unicast, from origin to dst, which we
+// couldn't relay to origin. Unlike other error reports these aren't
+// rate limited, since they carry the payload, and each unicast
+// results in at most one. The payloads of sealed unicasts are only of
+// use to the destination, so aren't returned. Like error reports, dead
+// letters can't be returned via peers which predate them.
+func (c *GossipChannel) returnDeadLetter(origin, dst PeerName, payload []byte, meta gossipFrameMeta, reason error) {
+	atomic.AddUint64(&c.deadLetters, 1)
+	if origin == c.ourself.Name {
+		return
+	}
+	if meta.Sealed {
+		payload = nil
+	}
+	report := GossipError{Channel: c.name, Peer: c.ourself.Name, Reason: reason.Error(), Dst: dst, Payload: payload}
+	if err := c.relayErrorReport(c.ourself.Name, origin, gobEncode(c.name, c.ourself.Name, origin, report)); err != nil {
+		c.logf("unable to return dead letter to %s: %v", origin, err)
+	}
+}
+
+// deliverDeadLetter hands a returned unicast to the channel's
+// OnDeadLetter, returning false if there is none.
+func (c *GossipChannel) deliverDeadLetter(report *GossipError) bool {
+	atomic.AddUint64(&c.deadLettersReturned, 1)
+	if c.config.OnDeadLetter == nil {
+		return false
+	}
+	c.config.OnDeadLetter(DeadLetter{
+		Channel: report.Channel,
+		Dst:     report.Dst,
+		Relay:   report.Peer,
+		Payload: report.Payload,
+		Reason:  report.Reason,
+	})
+	return true
+}
+
+// DeadLetters returns the dead letter counts of each channel which has
+// had any, sorted by channel.
+func (router *Router) DeadLetters() []DeadLetterStats {
+	var result []DeadLetterStats
+	for channel := range router.gossipChannelSet() {
+		stats := DeadLetterStats{
+			Channel:  channel.name,
+			Dropped:  atomic.LoadUint64(&channel.deadLetters),
+			Returned: atomic.LoadUint64(&channel.deadLettersReturned),
+		}
+		if stats.Dropped > 0 || stats.Returned > 0 {
+			result = append(result, stats)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Channel < result[j].Channel })
+	return result
+}
@@ -0,0 +1,48 @@
+package mesh
+
+import "time"
+
+// Delivery describes how a unicast or broadcast reached us.
+type Delivery struct {
+	// Origin is the peer the gossip originated from.
+	Origin PeerName
+
+	// Sender is the neighbour we received it from, which is Origin
+	// unless the gossip was relayed.
+	Sender PeerName
+
+	// Hops is the number of connections the gossip crossed, 1 if it
+	// came straight from Origin. Peers running versions of mesh which
+	// don't count hops don't add to it, so it is a lower bound.
+	Hops int
+
+	// Received is when we received it.
+	Received time.Time
+
+	// Trace is the context of the span of its handling here, if it is
+	// traced, for the Gossiper to start spans of its own under; see
+	// SpanTracer.
+	Trace TraceContext
+}
+
+// DeliveryGossiper is an optional extension of Gossiper for
+// applications which want to know how gossip reached them, e.g. to
+// prefer nearby peers, or to measure how long gossip takes to
+// propagate without stamping it into their payloads. Its methods are
+// called in place of OnGossipUnicast and OnGossipBroadcast.
+type DeliveryGossiper interface {
+	Gossiper
+
+	// OnGossipUnicastDelivery is OnGossipUnicast, with the delivery
+	// metadata of msg.
+	OnGossipUnicastDelivery(delivery Delivery, msg []byte) error
+
+	// OnGossipBroadcastDelivery is OnGossipBroadcast, with the
+	// delivery metadata of update.
+	OnGossipBroadcastDelivery(delivery Delivery, update []byte) (received GossipData, err error)
+}
+
+// deliveryOf returns the delivery metadata of a frame from srcName.
+func deliveryOf(srcName PeerName, meta gossipFrameMeta) Delivery {
+	return Delivery{Origin: srcName, Sender: meta.sender, Hops: int(meta.Hops) + 1, Received: meta.received, Trace: meta.trace()}
+}
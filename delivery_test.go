@@ -0,0 +1,58 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// deliveryRecorder records the delivery metadata of what it receives.
+type deliveryRecorder struct {
+	*testGossiper
+	deliveries []Delivery
+}
+
+func (g *deliveryRecorder) OnGossipUnicastDelivery(delivery Delivery, msg []byte) error {
+	g.deliveries = append(g.deliveries, delivery)
+	return g.OnGossipUnicast(delivery.Origin, msg)
+}
+
+func (g *deliveryRecorder) OnGossipBroadcastDelivery(delivery Delivery, update []byte) (GossipData, error) {
+	g.deliveries = append(g.deliveries, delivery)
+	return g.OnGossipBroadcast(delivery.Origin, update)
+}
+
+func TestDeliveryMetadata(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	g2 := &deliveryRecorder{testGossiper: newTestGossiper()}
+	g3 := &deliveryRecorder{testGossiper: newTestGossiper()}
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	start := time.Now()
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	require.Len(t, g2.deliveries, 1)
+	require.Equal(t, Delivery{Origin: r1.Ourself.Name, Sender: r1.Ourself.Name, Hops: 1, Received: g2.deliveries[0].Received}, g2.deliveries[0])
+	require.Len(t, g3.deliveries, 1)
+	require.Equal(t, Delivery{Origin: r1.Ourself.Name, Sender: r2.Ourself.Name, Hops: 2, Received: g3.deliveries[0].Received}, g3.deliveries[0])
+	require.False(t, g3.deliveries[0].Received.Before(start))
+
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte("hello")))
+	require.Len(t, g3.deliveries, 2)
+	require.Equal(t, r2.Ourself.Name, g3.deliveries[1].Sender)
+	require.Equal(t, 2, g3.deliveries[1].Hops)
+}
@@ -0,0 +1,69 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Neighbours which advertise this feature close their connection to a
+// peer as soon as it sends ProtocolDeparture, acknowledging that it is
+// leaving the mesh.
+const featureDeparture = "departure"
+
+var (
+	errRouterDeparting = errors.New("router is leaving the mesh")
+	errPeerDeparted    = errors.New("peer left the mesh")
+)
+
+// departure records whether the router is leaving the mesh.
+type departure struct {
+	sync.Mutex
+	departing bool
+}
+
+// Drain gracefully removes the router from the mesh, and stops it. It
+// stops accepting and making connections, flushes the gossip queued for
+// each neighbour, and tells the neighbours we are leaving, so they drop
+// their connections to us straight away rather than waiting for them to
+// time out. It returns once every neighbour has done so, or ctx is
+// done, when it returns ctx.Err(). Either way, the router is stopped.
+//
+// Neighbours which predate Drain can't acknowledge our departure, so
+// their connections are simply closed.
+func (router *Router) Drain(ctx context.Context) error {
+	router.departure.Lock()
+	router.departure.departing = true
+	router.departure.Unlock()
+	router.detachTransport()
+
+	router.sendPendingGossip()
+	for conn := range router.Ourself.getConnections() {
+		lc, ok := conn.(*LocalConnection)
+		if !ok || !lc.features.both(featureDeparture) {
+			conn.(ourConnection).shutdown(errRouterDeparting)
+			continue
+		}
+		lc.SendProtocolMsg(protocolMsg{tag: ProtocolDeparture})
+	}
+
+	ticker := router.clock().NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	var err error
+	for len(router.Ourself.getConnections()) > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.Chan():
+		}
+	}
+	router.Stop()
+	return err
+}
+
+// departing reports whether Drain has been called.
+func (router *Router) departing() bool {
+	router.departure.Lock()
+	defer router.departure.Unlock()
+	return router.departure.departing
+}
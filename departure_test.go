@@ -0,0 +1,57 @@
+package mesh
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrain(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+
+	var lock sync.Mutex
+	var terminated []error
+	r2.OnConnectionTerminated(func(event ConnectionEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		terminated = append(terminated, event.Err)
+	})
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		conn, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+		return found && conn.isEstablished()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, r1.Drain(ctx))
+	require.Empty(t, r1.Ourself.getConnections())
+	waitUntil(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(terminated) == 1
+	})
+	require.Equal(t, []error{errPeerDeparted}, terminated)
+
+	// a drained router makes no more connections
+	require.Equal(t, errRouterDeparting, r1.Ourself.createConnection("127.0.0.1:0", ln.Addr().String(), false, r1.logger))
+}
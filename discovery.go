@@ -0,0 +1,56 @@
+package mesh
+
+import "context"
+
+// Discovery finds targets for the ConnectionMaker, e.g. from Consul,
+// etcd, a cloud provider's API or Kubernetes Endpoints, so that
+// applications can plug in discovery mechanisms of their own; see
+// Router.Discover. DiscoverDNS and DiscoverMDNS are built in.
+type Discovery interface {
+	// Start discovers targets, in host:port format, sending each on
+	// targets, until ctx is done, after which it must stop sending. It
+	// may block, or return at once and discover in the background.
+	Start(ctx context.Context, targets chan<- string) error
+}
+
+// DiscoveryFunc adapts a function to Discovery.
+type DiscoveryFunc func(ctx context.Context, targets chan<- string) error
+
+// Start implements Discovery.
+func (f DiscoveryFunc) Start(ctx context.Context, targets chan<- string) error {
+	return f(ctx, targets)
+}
+
+// Discover runs discovery until ctx is done or the router stops, adding
+// the targets it finds to those of source, which are then connected to.
+// Targets are only ever added; those which go away can be removed with
+// ConnectionMaker.RemoveTargets, and are otherwise retried with backoff
+// like any other. Errors, including that returned by Start, are logged.
+func (router *Router) Discover(ctx context.Context, source TargetSource, discovery Discovery) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-router.ctx.Done():
+		}
+		cancel()
+	}()
+	targets := make(chan string)
+	go func() {
+		for {
+			select {
+			case target := <-targets:
+				for _, err := range router.ConnectionMaker.AddTargets(source, []string{target}) {
+					router.logger.Printf("%s discovery: %v", source, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		if err := discovery.Start(ctx, targets); err != nil {
+			router.logger.Printf("%s discovery: %v", source, err)
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package mesh
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscover(t *testing.T) {
+	router := newTestRouter(t, "01:00:00:01:00:00")
+	defer router.Stop()
+	const consul TargetSource = "consul"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router.Discover(ctx, consul, DiscoveryFunc(func(ctx context.Context, targets chan<- string) error {
+		for _, target := range []string{"10.0.0.1:6783", "10.0.0.2:6783"} {
+			select {
+			case targets <- target:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}))
+	targets := func() map[string][]TargetSource { return router.ConnectionMaker.TargetSources() }
+	waitUntil(t, func() bool { return len(targets()) == 2 })
+	require.Equal(t, map[string][]TargetSource{
+		"10.0.0.1:6783": {consul},
+		"10.0.0.2:6783": {consul},
+	}, targets())
+}
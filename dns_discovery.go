@@ -0,0 +1,124 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDNSDiscoveryInterval = 30 * time.Second
+
+// DNSResolver looks up the records DNS discovery needs. *net.Resolver
+// is a DNSResolver.
+type DNSResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSDiscoveryConfig describes the DNS names to find targets at, e.g.
+// those of a Kubernetes headless service.
+type DNSDiscoveryConfig struct {
+	// Names to resolve. Those beginning with an underscore, e.g.
+	// _mesh._tcp.example.com, are looked up as SRV records, which give
+	// the port of each target; the rest as A and AAAA records.
+	Names []string
+	// Port of the targets found by A and AAAA records. Zero means
+	// Config.Port.
+	Port int
+	// Interval between resolutions; zero means 30s.
+	Interval time.Duration
+	// Resolver, if set, is used in place of net.DefaultResolver.
+	Resolver DNSResolver
+}
+
+// DiscoverDNS resolves the names in config now and periodically until
+// ctx is done or the router stops, making the addresses found the
+// targets of SourceDNS: those which appear are connected to, and those
+// which disappear are forgotten. If a name can't be resolved, the
+// addresses last found for it are kept.
+func (router *Router) DiscoverDNS(ctx context.Context, config DNSDiscoveryConfig) error {
+	if len(config.Names) == 0 {
+		return fmt.Errorf("no names for DNS discovery")
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultDNSDiscoveryInterval
+	}
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+	go func() {
+		found := make(map[string][]string)
+		ticker := router.clock().NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			router.resolveTargets(ctx, config, found)
+			select {
+			case <-ticker.Chan():
+			case <-ctx.Done():
+				return
+			case <-router.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// resolveTargets resolves the names in config, updating the addresses
+// found for each, and reconciles the targets of SourceDNS with them.
+func (router *Router) resolveTargets(ctx context.Context, config DNSDiscoveryConfig, found map[string][]string) {
+	for _, name := range config.Names {
+		addrs, err := lookupTargets(ctx, config, name)
+		if err != nil {
+			router.logger.Printf("DNS discovery: unable to resolve %s: %v", name, err)
+			continue
+		}
+		found[name] = addrs
+	}
+	var targets []string
+	for _, addrs := range found {
+		targets = append(targets, addrs...)
+	}
+	sort.Strings(targets)
+	for _, err := range router.ConnectionMaker.ReconcileTargets(SourceDNS, targets) {
+		router.logger.Printf("DNS discovery: %v", err)
+	}
+}
+
+// lookupTargets returns the addresses of the targets at name.
+func lookupTargets(ctx context.Context, config DNSDiscoveryConfig, name string) ([]string, error) {
+	if !strings.HasPrefix(name, "_") {
+		return lookupAddrs(ctx, config.Resolver, name, config.Port)
+	}
+	_, srvs, err := config.Resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, srv := range srvs {
+		addrs, err := lookupAddrs(ctx, config.Resolver, strings.TrimSuffix(srv.Target, "."), int(srv.Port))
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, addrs...)
+	}
+	return targets, nil
+}
+
+// lookupAddrs returns host's addresses, with port, which if zero is
+// later taken to be Config.Port.
+func lookupAddrs(ctx context.Context, resolver DNSResolver, host string, port int) ([]string, error) {
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.IP.String(), strconv.Itoa(port)))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,74 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	sync.Mutex
+	srvs map[string][]*net.SRV
+	ips  map[string][]net.IPAddr
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+	srvs, found := r.srvs[name]
+	if !found {
+		return "", nil, fmt.Errorf("no such host: %s", name)
+	}
+	return name, srvs, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.Lock()
+	defer r.Unlock()
+	ips, found := r.ips[host]
+	if !found {
+		return nil, fmt.Errorf("no such host: %s", host)
+	}
+	return ips, nil
+}
+
+func TestDiscoverDNS(t *testing.T) {
+	router := newTestRouter(t, "01:00:00:01:00:00")
+	defer router.Stop()
+	resolver := &fakeResolver{
+		srvs: map[string][]*net.SRV{"_mesh._tcp.example.com": {{Target: "a.example.com.", Port: 7000}}},
+		ips: map[string][]net.IPAddr{
+			"a.example.com": {{IP: net.ParseIP("10.0.0.1")}},
+			"b.example.com": {{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("fd00::2")}},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, router.DiscoverDNS(ctx, DNSDiscoveryConfig{
+		Names:    []string{"_mesh._tcp.example.com", "b.example.com"},
+		Interval: 10 * time.Millisecond,
+		Resolver: resolver,
+	}))
+	targets := func() map[string][]TargetSource { return router.ConnectionMaker.TargetSources() }
+	waitUntil(t, func() bool { return len(targets()) == 3 })
+	require.Equal(t, map[string][]TargetSource{
+		"10.0.0.1:7000": {SourceDNS},
+		"10.0.0.2:0":    {SourceDNS},
+		"[fd00::2]:0":   {SourceDNS},
+	}, targets())
+
+	// a disappears; b can't be resolved, so its addresses are kept
+	resolver.Lock()
+	resolver.srvs["_mesh._tcp.example.com"] = nil
+	delete(resolver.ips, "b.example.com")
+	resolver.Unlock()
+	waitUntil(t, func() bool { return len(targets()) == 2 })
+	require.Contains(t, targets(), "10.0.0.2:0")
+
+	require.Error(t, router.DiscoverDNS(ctx, DNSDiscoveryConfig{}))
+}
@@ -0,0 +1,116 @@
+package mesh
+
+import (
+	"net"
+	"time"
+)
+
+// The delay between attempts to connect to successive addresses of a
+// discovered peer, as recommended by RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Address families.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// PeerAddress is an address at which a peer may be reached.
+type PeerAddress struct {
+	Addr   string
+	Family string // FamilyIPv4 or FamilyIPv6; empty for a hostname
+}
+
+// addressFamily returns the family of address, in host:port format.
+func addressFamily(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// makePeerAddresses describes each of addrs.
+func makePeerAddresses(addrs []string) []PeerAddress {
+	var result []PeerAddress
+	for _, addr := range addrs {
+		result = append(result, PeerAddress{addr, addressFamily(addr)})
+	}
+	return result
+}
+
+// reachableAddrs returns the addresses at which we may be reached, given
+// those we listen on: those which are unspecified are replaced by each
+// of the host's interface addresses, in hostAddrs, of the families
+// listened on, other than those which are loopback or link-local.
+func reachableAddrs(listenAddrs []string, hostAddrs []net.Addr) []string {
+	var addrs []string
+	seen := make(map[string]struct{})
+	add := func(address string) {
+		if _, found := seen[address]; !found {
+			seen[address] = struct{}{}
+			addrs = append(addrs, address)
+		}
+	}
+	for _, address := range listenAddrs {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if host != "" && (ip == nil || !ip.IsUnspecified()) {
+			add(address)
+			continue
+		}
+		// "::" listens on both families, "0.0.0.0" only on IPv4
+		v4only := ip != nil && ip.To4() != nil
+		for _, hostAddr := range hostAddrs {
+			ipnet, ok := hostAddr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() || (v4only && ipnet.IP.To4() == nil) {
+				continue
+			}
+			add(net.JoinHostPort(ipnet.IP.String(), port))
+		}
+	}
+	return addrs
+}
+
+// happyEyeballs orders addrs, without duplicates, for connecting to one
+// after another, alternating between address families, starting with
+// that of the first, so that a peer which is reachable by only one of
+// them is reached promptly; see RFC 8305.
+func happyEyeballs(addrs []string) []string {
+	var (
+		families = make(map[string][]string)
+		order    []string
+		seen     = make(map[string]struct{})
+	)
+	for _, address := range addrs {
+		if _, found := seen[address]; found {
+			continue
+		}
+		seen[address] = struct{}{}
+		family := addressFamily(address)
+		if _, found := families[family]; !found {
+			order = append(order, family)
+		}
+		families[family] = append(families[family], address)
+	}
+	result := make([]string, 0, len(seen))
+	for len(result) < len(seen) {
+		for _, family := range order {
+			if len(families[family]) > 0 {
+				result = append(result, families[family][0])
+				families[family] = families[family][1:]
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,47 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReachableAddrs(t *testing.T) {
+	hostAddrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	require.Equal(t, []string{"10.0.0.1:6783", "[2001:db8::1]:6783"}, reachableAddrs([]string{"[::]:6783"}, hostAddrs))
+	require.Equal(t, []string{"10.0.0.1:6783"}, reachableAddrs([]string{"0.0.0.0:6783"}, hostAddrs))
+	require.Equal(t, []string{"127.0.0.1:1000", "10.0.0.1:2000", "[2001:db8::1]:2000"}, reachableAddrs([]string{"127.0.0.1:1000", ":2000"}, hostAddrs))
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	require.Equal(t,
+		[]string{"10.0.0.1:1", "[2001:db8::1]:1", "10.0.0.2:1", "[2001:db8::2]:1", "10.0.0.3:1"},
+		happyEyeballs([]string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.1:1", "10.0.0.3:1", "[2001:db8::1]:1", "[2001:db8::2]:1"}))
+	require.Equal(t,
+		[]PeerAddress{{"10.0.0.1:1", FamilyIPv4}, {"[2001:db8::1]:1", FamilyIPv6}, {"example.com:1", ""}},
+		makePeerAddresses([]string{"10.0.0.1:1", "[2001:db8::1]:1", "example.com:1"}))
+}
+
+func TestDiscoveryTriesAdvertisedAddrs(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{Host: "127.0.0.1", ListenOn: []string{"127.0.0.2:0"}})
+	defer r2.Stop()
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{PeerDiscovery: true})
+	defer r3.Stop()
+
+	connectTo(t, r2, r1)
+	connectTo(t, r3, r1)
+	waitUntil(t, func() bool {
+		_, found := r3.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+	conn, _ := r3.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.Contains(t, r2.ListenAddrs(), conn.remoteTCPAddress())
+}
@@ -0,0 +1,79 @@
+package mesh
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+var errChannelClosed = fmt.Errorf("gossip channel closed")
+
+// Close stops the channel: it no longer delivers to its Gossiper or
+// sends gossip, and any gossip pending for neighbours is dropped.
+// Unicasts on a closed channel return an error, and other gossip is
+// discarded. Gossip from other peers is relayed by a surrogate, as
+// for any channel not registered here, until a Gossiper for the
+// channel is registered afresh with NewGossip.
+func (c *GossipChannel) Close() {
+	router := c.ourself.router
+	if router == nil {
+		atomic.StoreInt32(&c.closed, 1)
+		return
+	}
+	router.gossipLock.Lock()
+	defer router.gossipLock.Unlock()
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) && router.gossipChannels[c.name] == c {
+		router.retireSenders(c.name)
+		surrogate := newGossipChannel(c.name, GossipChannelConfig{}, router.Ourself, router.Routes, newSurrogateGossiper(c.name, router), router.logger)
+		surrogate.logf("created surrogate channel")
+		router.gossipChannels[c.name] = surrogate
+	}
+}
+
+func (c *GossipChannel) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+// replaceable returns whether a Gossiper registering for the channel
+// may take it over, i.e. whether the channel is closed, or a surrogate
+// for one we hadn't registered.
+func (c *GossipChannel) replaceable() bool {
+	_, surrogate := c.gossiper.(*surrogateGossiper)
+	return surrogate || c.isClosed()
+}
+
+// retireSenders stops the senders of the named channel on all our
+// connections, so that those of a channel taking over the name start
+// afresh, with its configuration. Must be called with gossipLock held.
+func (router *Router) retireSenders(channelName string) {
+	for conn := range router.Ourself.getConnections() {
+		if gc, ok := conn.(gossipConnection); ok {
+			gc.gossipSenders().retire(channelName)
+		}
+	}
+}
+
+// replaceChannel completes the registration of channel in place of prev,
+// closed by now, once the router had started: the updates which prev
+// relayed recently, if it was a surrogate, are replayed to the new
+// Gossiper, and its state is sent to our neighbours, which would
+// otherwise wait for it until the next gossip.
+func (router *Router) replaceChannel(prev, channel *GossipChannel) {
+	if surrogate, ok := prev.gossiper.(*surrogateGossiper); ok {
+		for _, p := range surrogate.takeUpdates() {
+			err := channel.protect(func() (err error) {
+				if p.broadcast {
+					_, err = channel.onGossipBroadcast(p.src, p.update, gossipFrameMeta{})
+				} else {
+					_, err = channel.onGossip(p.update)
+				}
+				return err
+			})
+			if err != nil {
+				channel.logf("unable to replay update relayed before registration: %v", err)
+			}
+		}
+	}
+	for conn := range router.Ourself.getConnections() {
+		channel.protect(func() error { channel.gossipDown(conn); return nil })
+	}
+}
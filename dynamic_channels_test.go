@@ -0,0 +1,65 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterAndCloseChannels(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	// r2 relays broadcasts on a channel it hasn't registered yet
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g3 := newTestGossiper()
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	g3.checkHas(t, 1)
+
+	// when it registers, the broadcast is replayed to it
+	g2 := newTestGossiper()
+	c2, err := r2.NewGossipChannel("Test", g2, GossipChannelConfig{})
+	require.NoError(t, err)
+	g2.checkHas(t, 1)
+	_, err = r2.NewGossip("Test", newTestGossiper())
+	require.Error(t, err)
+
+	// mesh's own channel names are reserved, but not those of
+	// applications which merely resemble them
+	for _, reserved := range []string{"topology", trustChannelName, internalChannelPrefix + "other"} {
+		_, err = r2.NewGossip(reserved, newTestGossiper())
+		require.Error(t, err)
+	}
+	_, err = r2.NewGossip("trust", newTestGossiper())
+	require.NoError(t, err)
+
+	// once closed, the channel no longer delivers, but a surrogate
+	// relays for the other peers
+	c2.Close()
+	broadcast(s1, 2)
+	sendPendingGossip(routers...)
+	require.NotContains(t, g2.state, byte(2))
+	g3.checkHas(t, 2)
+	require.Equal(t, errChannelClosed, c2.GossipUnicast(r3.Ourself.Name, []byte("hello")))
+
+	// and the name may be registered again, taking over what the
+	// surrogate relayed
+	g2 = newTestGossiper()
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	g2.checkHas(t, 2)
+	broadcast(s1, 3)
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 2, 3)
+	g3.checkHas(t, 3)
+}
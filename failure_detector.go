@@ -0,0 +1,166 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// The suspicion at which a connection is closed, by default. With
+	// the default phi-accrual detector, that is reached about a minute
+	// after the last heartbeat, in line with the TCP read deadline.
+	defaultSuspicionThreshold = 8.0
+
+	// How often each connection consults its failure detector.
+	suspicionCheckInterval = 1 * time.Second
+
+	defaultPhiWindowSize = 100
+)
+
+// FailureDetector judges whether the remote peer of a connection has
+// failed, from the arrival times of its heartbeats. Implementations
+// must be safe for concurrent use.
+type FailureDetector interface {
+	// Heartbeat records the arrival of a heartbeat. It is also called
+	// when the connection starts.
+	Heartbeat(at time.Time)
+
+	// Suspicion returns how strongly the remote peer is suspected of
+	// having failed at the given time, from zero up. The connection is
+	// closed once it reaches Config.SuspicionThreshold.
+	Suspicion(at time.Time) float64
+}
+
+// PhiAccrualConfig defines the parameters of a phi-accrual failure
+// detector.
+type PhiAccrualConfig struct {
+	// WindowSize is the number of recent heartbeat intervals from
+	// which the distribution of intervals is estimated. Zero means 100.
+	WindowSize int
+
+	// MinStdDeviation bounds the estimated standard deviation of the
+	// intervals from below, so that very regular heartbeats don't make
+	// the detector hair-triggered. Zero means 3s.
+	MinStdDeviation time.Duration
+
+	// AcceptablePause is added to the estimated mean interval, to
+	// tolerate the occasional late heartbeat, e.g. due to a GC pause
+	// or a burst of gossip. Zero means 15s.
+	AcceptablePause time.Duration
+
+	// HeartbeatInterval is the expected interval between heartbeats,
+	// of which the defaults above are a tenth and a half respectively.
+	// Zero means 30s.
+	HeartbeatInterval time.Duration
+}
+
+// phiAccrualDetector is the phi-accrual failure detector of Hayashibara
+// et al. The suspicion it reports is phi, i.e. -log10 of the
+// probability of a heartbeat arriving later than now, given a normal
+// distribution of the recent intervals between heartbeats. So a phi of
+// 8 means the chance of the remote peer being alive is 1 in 10^8.
+type phiAccrualDetector struct {
+	sync.Mutex
+	config    PhiAccrualConfig
+	intervals []float64 // seconds, as a ring buffer
+	next      int
+	last      time.Time
+}
+
+// NewPhiAccrualDetector returns a phi-accrual FailureDetector, the
+// default for connections.
+func NewPhiAccrualDetector(config PhiAccrualConfig) FailureDetector {
+	if config.WindowSize <= 0 {
+		config.WindowSize = defaultPhiWindowSize
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = tcpHeartbeat
+	}
+	if config.MinStdDeviation <= 0 {
+		config.MinStdDeviation = config.HeartbeatInterval / 10
+	}
+	if config.AcceptablePause <= 0 {
+		config.AcceptablePause = config.HeartbeatInterval / 2
+	}
+	// Until we have observed some intervals, assume they are about
+	// the HeartbeatInterval.
+	estimate, deviation := config.HeartbeatInterval.Seconds(), config.HeartbeatInterval.Seconds()/4
+	return &phiAccrualDetector{
+		config:    config,
+		intervals: []float64{estimate - deviation, estimate + deviation},
+	}
+}
+
+func (d *phiAccrualDetector) Heartbeat(at time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.last.IsZero() {
+		d.record(at.Sub(d.last).Seconds())
+	}
+	d.last = at
+}
+
+func (d *phiAccrualDetector) record(interval float64) {
+	if len(d.intervals) < d.config.WindowSize {
+		d.intervals = append(d.intervals, interval)
+		return
+	}
+	d.intervals[d.next] = interval
+	d.next = (d.next + 1) % len(d.intervals)
+}
+
+func (d *phiAccrualDetector) Suspicion(at time.Time) float64 {
+	d.Lock()
+	defer d.Unlock()
+	if d.last.IsZero() {
+		return 0
+	}
+	var sum, sumSquares float64
+	for _, interval := range d.intervals {
+		sum += interval
+		sumSquares += interval * interval
+	}
+	n := float64(len(d.intervals))
+	mean := sum / n
+	stdDev := math.Sqrt(math.Max(sumSquares/n-mean*mean, 0))
+	stdDev = math.Max(stdDev, d.config.MinStdDeviation.Seconds())
+	return phi(at.Sub(d.last).Seconds(), mean+d.config.AcceptablePause.Seconds(), stdDev)
+}
+
+// phi uses a logistic approximation of the normal cumulative
+// distribution function.
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// newFailureDetector returns a detector for a remote which sends
+// heartbeats at the interval given.
+func (router *Router) newFailureDetector(heartbeat time.Duration) FailureDetector {
+	if router.Config.FailureDetector != nil {
+		return router.Config.FailureDetector()
+	}
+	return NewPhiAccrualDetector(PhiAccrualConfig{HeartbeatInterval: heartbeat})
+}
+
+func (router *Router) suspicionThreshold() float64 {
+	if router.Config.SuspicionThreshold > 0 {
+		return router.Config.SuspicionThreshold
+	}
+	return defaultSuspicionThreshold
+}
+
+// checkSuspicion fails the connection if its remote is suspected of
+// having failed.
+func (conn *LocalConnection) checkSuspicion(now time.Time) error {
+	if suspicion := conn.detector.Suspicion(now); suspicion >= conn.router.suspicionThreshold() {
+		return fmt.Errorf("remote suspected of failure (suspicion %.1f)", suspicion)
+	}
+	return nil
+}
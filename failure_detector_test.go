@@ -0,0 +1,115 @@
+package mesh
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhiAccrualDetector(t *testing.T) {
+	d := NewPhiAccrualDetector(PhiAccrualConfig{MinStdDeviation: 100 * time.Millisecond, AcceptablePause: time.Millisecond})
+	start := time.Now()
+	require.Equal(t, 0.0, d.Suspicion(start))
+
+	// regular heartbeats every second
+	at := start
+	for i := 0; i < 200; i++ {
+		d.Heartbeat(at)
+		at = at.Add(time.Second)
+	}
+	last := at.Add(-time.Second)
+	require.True(t, d.Suspicion(last.Add(500*time.Millisecond)) < 1)
+	slow := d.Suspicion(last.Add(1200 * time.Millisecond))
+	dead := d.Suspicion(last.Add(2 * time.Second))
+	require.True(t, slow > 1 && slow < defaultSuspicionThreshold, "slow: %v", slow)
+	require.True(t, dead > defaultSuspicionThreshold, "dead: %v", dead)
+}
+
+// testFailureDetector suspects the remote once told to, counting how
+// often it is asked.
+type testFailureDetector struct {
+	sync.Mutex
+	suspicion float64
+	checks    int
+}
+
+func (d *testFailureDetector) Heartbeat(time.Time) {}
+
+func (d *testFailureDetector) Suspicion(time.Time) float64 {
+	d.Lock()
+	defer d.Unlock()
+	d.checks++
+	return d.suspicion
+}
+
+func (d *testFailureDetector) suspect(suspicion float64) {
+	d.Lock()
+	defer d.Unlock()
+	d.suspicion = suspicion
+}
+
+func (d *testFailureDetector) checked() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.checks
+}
+
+func TestFailureDetectorClosesConnection(t *testing.T) {
+	detector := &testFailureDetector{}
+	clock := NewManualClock(time.Now())
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		FailureDetector:    func() FailureDetector { return detector },
+		SuspicionThreshold: 5,
+		Clock:              clock,
+	})
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		conn, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found && conn.isEstablished()
+	})
+
+	// a slow peer is reported, but stays connected
+	detector.suspect(3)
+	var status []LocalConnectionStatus
+	for _, conn := range NewStatus(r1).Connections {
+		if conn.Peer == r2.Ourself.Name.String() {
+			status = append(status, conn)
+		}
+	}
+	require.Len(t, status, 1)
+	require.Equal(t, 3.0, status[0].Suspicion)
+	checks := detector.checked()
+	waitUntil(t, func() bool {
+		clock.Advance(suspicionCheckInterval)
+		return detector.checked() >= checks+2
+	})
+	_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, found)
+
+	// a dead one is disconnected
+	detector.suspect(6)
+	waitUntil(t, func() bool {
+		clock.Advance(suspicionCheckInterval)
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return !found
+	})
+}
@@ -0,0 +1,73 @@
+// +build mesh_faults
+
+package mesh
+
+// Artificial delay and loss of gossip, for testing how Gossipers cope
+// with them. Only built with the mesh_faults tag, so it can't be
+// enabled by accident in production.
+
+import (
+	"sync"
+	"time"
+)
+
+// Faults describes the delay and loss artificially injected into the
+// gossip a router receives on a channel.
+type Faults struct {
+	Delay    time.Duration // added to the delivery of every frame
+	Jitter   time.Duration // random additional delay, up to this
+	DropRate float64       // fraction of frames dropped, from 0 to 1
+}
+
+// InjectFaults delays and drops the gossip received on the named
+// channel, by this router only. Frames are checked and accounted for
+// as usual, but their delivery to the channel's Gossiper, including
+// any relaying, is delayed or skipped. Zero Faults stop the injection.
+func (router *Router) InjectFaults(channelName string, faults Faults) {
+	router.faults.Lock()
+	defer router.faults.Unlock()
+	if faults == (Faults{}) {
+		delete(router.faults.channels, channelName)
+		return
+	}
+	if router.faults.channels == nil {
+		router.faults.channels = make(map[string]Faults)
+	}
+	router.faults.channels[channelName] = faults
+}
+
+type faultInjector struct {
+	sync.Mutex
+	channels map[string]Faults
+}
+
+// injectFaults applies the faults of the named channel to the delivery of a
+// frame, returning false if there are none, when the caller should
+// deliver it as usual. Errors from delayed deliveries are logged,
+// since the connection the frame arrived on may be long gone.
+func (router *Router) injectFaults(channelName string, deliver func() error) bool {
+	router.faults.Lock()
+	faults, found := router.faults.channels[channelName]
+	drop := found && router.rng().Float64() < faults.DropRate
+	delay := faults.Delay
+	if found && faults.Jitter > 0 {
+		delay += time.Duration(router.rng().Int63n(int64(faults.Jitter)))
+	}
+	router.faults.Unlock()
+	switch {
+	case !found:
+		return false
+	case drop:
+	case delay == 0:
+		router.logFaultyDelivery(channelName, deliver())
+	default:
+		router.clock().AfterFunc(delay, func() { router.logFaultyDelivery(channelName, deliver()) })
+	}
+	return true
+}
+
+func (router *Router) logFaultyDelivery(channelName string, err error) {
+	if err != nil {
+		router.logger.Printf("[gossip %s]: error delivering frame with injected faults: %v", channelName, err)
+	}
+}
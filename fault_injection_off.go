@@ -0,0 +1,12 @@
+// +build !mesh_faults
+
+package mesh
+
+// Without the mesh_faults tag, there is no fault injection; see
+// fault_injection.go.
+
+type faultInjector struct{}
+
+func (router *Router) injectFaults(channelName string, deliver func() error) bool {
+	return false
+}
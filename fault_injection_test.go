@@ -0,0 +1,45 @@
+// +build mesh_faults
+
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectFaults(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	routers := []*Router{r1, r2}
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+
+	g2 := newTestGossiper()
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+
+	r2.InjectFaults("Test", Faults{DropRate: 1})
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	require.Empty(t, g2.state)
+
+	r2.InjectFaults("Test", Faults{Delay: 100 * time.Millisecond})
+	broadcast(s1, 2)
+	sendPendingGossip(routers...)
+	require.Empty(t, g2.state)
+	waitUntil(t, func() bool {
+		g2.RLock()
+		defer g2.RUnlock()
+		return len(g2.state) == 1
+	})
+	g2.checkHas(t, 2)
+
+	r2.InjectFaults("Test", Faults{})
+	broadcast(s1, 3)
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 2, 3)
+}
@@ -0,0 +1,304 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Frames are sent in one of two priority classes. Control frames, i.e.
+// heartbeats, overlay control messages, and the gossip of the channels
+// mesh uses itself, such as the topology, go ahead of bulk frames, i.e.
+// application gossip, queued on the same connection. Neighbours which
+// advertise this feature also accept bulk frames split into
+// ProtocolFragment frames, so a control frame waits for at most one
+// fragment rather than a whole large frame, and heartbeats aren't held
+// up for long enough that the remote suspects us of having failed.
+const featureFragments = "fragments"
+
+const (
+	// Bulk frames larger than this are fragmented.
+	fragmentSize = 16 * 1024
+
+	// fragmentLast flags the last fragment of a frame.
+	fragmentLast = 1
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+type frameClass int
+
+const (
+	frameControl frameClass = iota
+	frameBulk
+)
+
+type queuedFrame struct {
+	msg  []byte // tag, then payload
+	done chan<- error
+}
+
+// sendStream is the queue of the bulk frames of one stream; see
+// featureStreams.
+type sendStream struct {
+	name    string
+	frames  []queuedFrame
+	written int // bytes of frames[0] already written
+	credit  int // bytes we may send before the remote grants more
+}
+
+// frameWriter writes the frames of a connection from a single
+// goroutine, control frames first, then a fragment of each stream of
+// bulk frames in turn.
+type frameWriter struct {
+	sync.Mutex
+	ready     *sync.Cond
+	control   []queuedFrame
+	streams   map[string]*sendStream
+	active    []*sendStream // streams with frames queued, in turn
+	err       error         // set once closed
+	sender    tcpSender
+	fragment  bool
+	multiplex bool
+	limits    *writeLimits // nil for none
+	queued    int          // bytes of the frames queued
+	overSince time.Time    // when queued went beyond limits.slow
+}
+
+func newFrameWriter(sender tcpSender, fragment, multiplex bool, limits *writeLimits) *frameWriter {
+	w := &frameWriter{sender: sender, fragment: fragment, multiplex: fragment && multiplex, limits: limits, streams: make(map[string]*sendStream)}
+	w.ready = sync.NewCond(w)
+	go w.run()
+	return w
+}
+
+// send queues the frame, on the named stream if bulk, and waits until
+// it has been written.
+func (w *frameWriter) send(msg []byte, class frameClass, stream string) error {
+	done := make(chan error, 1)
+	if err := w.queue(msg, class, stream, done); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// post queues a control frame without waiting for it to be written,
+// for the receive goroutine, which mustn't block on writes lest both
+// ends of a connection stop reading.
+func (w *frameWriter) post(msg []byte) error {
+	return w.queue(msg, frameControl, "", make(chan error, 1))
+}
+
+func (w *frameWriter) queue(msg []byte, class frameClass, stream string, done chan<- error) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if class == frameControl {
+		w.control = append(w.control, queuedFrame{msg, done})
+	} else {
+		s := w.stream(stream)
+		if s.frames = append(s.frames, queuedFrame{msg, done}); len(s.frames) == 1 {
+			w.active = append(w.active, s)
+		}
+	}
+	w.queued += len(msg)
+	w.checkSlow()
+	w.ready.Signal()
+	return nil
+}
+
+// stream returns the named stream, creating it if need be; the lock
+// must be held.
+func (w *frameWriter) stream(name string) *sendStream {
+	if !w.multiplex {
+		name = ""
+	}
+	s, found := w.streams[name]
+	if !found {
+		s = &sendStream{name: name, credit: streamWindow}
+		w.streams[name] = s
+	}
+	return s
+}
+
+// grant lets the named stream send another n bytes. It is an error for
+// the remote to grant a stream we never opened.
+func (w *frameWriter) grant(name string, n int) error {
+	w.Lock()
+	defer w.Unlock()
+	if !w.multiplex {
+		name = ""
+	}
+	s, found := w.streams[name]
+	if !found {
+		return fmt.Errorf("window update for stream %q, which we never opened", name)
+	}
+	s.credit += n
+	w.ready.Signal()
+	return nil
+}
+
+// close fails the frames still queued, and stops the writer.
+func (w *frameWriter) close(err error) {
+	if err == nil {
+		err = errConnectionClosed
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.ready.Signal()
+}
+
+// next waits for something to write, returning it along with where to
+// report the outcome once it completes a frame, or false once closed.
+func (w *frameWriter) next() ([]byte, chan<- error, bool) {
+	w.Lock()
+	defer w.Unlock()
+	for {
+		if w.err != nil {
+			for _, f := range w.control {
+				f.done <- w.err
+			}
+			for _, s := range w.active {
+				for _, f := range s.frames {
+					f.done <- w.err
+				}
+				s.frames = nil
+			}
+			w.control, w.active = nil, nil
+			return nil, nil, false
+		}
+		if len(w.control) > 0 {
+			f := w.control[0]
+			w.control[0] = queuedFrame{}
+			w.control = w.control[1:]
+			w.written(len(f.msg))
+			return f.msg, f.done, true
+		}
+		for i, s := range w.active {
+			if w.multiplex && s.credit <= 0 {
+				continue
+			}
+			out, done := w.take(s)
+			// round-robin
+			w.active = append(w.active[:i], w.active[i+1:]...)
+			if len(s.frames) > 0 {
+				w.active = append(w.active, s)
+			}
+			return out, done, true
+		}
+		w.ready.Wait()
+	}
+}
+
+// take returns the next fragment of the stream's first frame, along
+// with where to report the outcome if that is the last; the lock must
+// be held.
+func (w *frameWriter) take(s *sendStream) ([]byte, chan<- error) {
+	f := s.frames[0]
+	var out []byte
+	last := true
+	if !w.fragment {
+		out = f.msg
+	} else {
+		chunk := f.msg[s.written:]
+		if len(chunk) > fragmentSize {
+			chunk, last = chunk[:fragmentSize], false
+		}
+		var flags byte
+		if last {
+			flags = fragmentLast
+		}
+		if w.multiplex {
+			out = appendStreamHeader([]byte{ProtocolStreamFragment}, s.name)
+		} else {
+			out = []byte{ProtocolFragment}
+		}
+		out = append(append(out, flags), chunk...)
+		s.written += len(chunk)
+		s.credit -= len(chunk)
+	}
+	if !last {
+		return out, nil
+	}
+	s.frames[0] = queuedFrame{}
+	s.frames, s.written = s.frames[1:], 0
+	w.written(len(f.msg))
+	return out, f.done
+}
+
+// written notes that a frame of n bytes is no longer queued, being
+// written; the lock must be held.
+func (w *frameWriter) written(n int) {
+	w.queued -= n
+	w.checkSlow()
+}
+
+func (w *frameWriter) run() {
+	for {
+		out, done, ok := w.next()
+		if !ok {
+			return
+		}
+		err := w.deadline()
+		if err == nil {
+			err = w.sender.Send(out)
+		}
+		if done != nil {
+			done <- err
+		}
+		if err != nil {
+			w.close(err)
+		}
+	}
+}
+
+// handleFragment reassembles fragmented frames, handling each once
+// complete.
+func (conn *LocalConnection) handleFragment(payload []byte) error {
+	if len(payload) < 1 {
+		return fmt.Errorf("empty fragment")
+	}
+	conn.reassembly = append(conn.reassembly, payload[1:]...)
+	if len(conn.reassembly) > maxTCPMsgSize {
+		return fmt.Errorf("fragmented message exceeds maximum size: %d > %d", len(conn.reassembly), maxTCPMsgSize)
+	}
+	if payload[0]&fragmentLast == 0 {
+		return nil
+	}
+	msg := conn.reassembly
+	conn.reassembly = nil
+	if len(msg) < 1 || !bulkTag(protocolTag(msg[0])) {
+		return fmt.Errorf("malformed fragmented message")
+	}
+	return conn.handleProtocolMsg(protocolTag(msg[0]), msg[1:])
+}
+
+// bulkTag returns whether frames with the tag may be sent as bulk.
+func bulkTag(tag protocolTag) bool {
+	switch tag {
+	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip, ProtocolGossipDigest, ProtocolGossipError, ProtocolGossipCompressed, ProtocolGossipMulticast:
+		return true
+	}
+	return false
+}
+
+// bulkSender is implemented by connections which send bulk frames
+// behind control frames.
+type bulkSender interface {
+	sendBulkProtocolMsg(channel string, m protocolMsg) error
+}
+
+func (conn *LocalConnection) sendBulkProtocolMsg(channel string, m protocolMsg) error {
+	if err := conn.sendProtocolMsgAs(m, frameBulk, channel); err != nil {
+		conn.shutdown(err)
+		return err
+	}
+	conn.noteActive()
+	return nil
+}
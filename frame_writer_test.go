@@ -0,0 +1,108 @@
+package mesh
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stallingTCPSender records the frames sent, holding up the first until
+// released.
+type stallingTCPSender struct {
+	frames  chan []byte
+	stalled chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *stallingTCPSender) Send(msg []byte) error {
+	s.once.Do(func() {
+		close(s.stalled)
+		<-s.release
+	})
+	s.frames <- msg
+	return nil
+}
+
+func TestFrameWriterPriority(t *testing.T) {
+	sender := &stallingTCPSender{frames: make(chan []byte, 16), stalled: make(chan struct{}), release: make(chan struct{})}
+	w := newFrameWriter(sender, true, false, nil)
+	defer w.close(nil)
+
+	bulk := make([]byte, fragmentSize*2+1)
+	bulk[0] = ProtocolGossipBroadcast
+	errs := make(chan error, 3)
+	go func() { errs <- w.send(bulk, frameBulk, "") }()
+	<-sender.stalled
+	// queued while the first fragment is being written
+	go func() { errs <- w.send([]byte{ProtocolHeartbeat}, frameControl, "") }()
+	waitUntil(t, func() bool {
+		w.Lock()
+		defer w.Unlock()
+		return len(w.control) == 1
+	})
+	close(sender.release)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	var reassembled []byte
+	for _, expected := range []struct {
+		tag  protocolTag
+		last bool
+	}{{ProtocolFragment, false}, {ProtocolHeartbeat, false}, {ProtocolFragment, false}, {ProtocolFragment, true}} {
+		frame := <-sender.frames
+		require.Equal(t, expected.tag, protocolTag(frame[0]))
+		if expected.tag == ProtocolFragment {
+			require.Equal(t, expected.last, frame[1]&fragmentLast != 0)
+			reassembled = append(reassembled, frame[2:]...)
+		}
+	}
+	require.Equal(t, bulk, reassembled)
+
+	w.close(nil)
+	require.Equal(t, errConnectionClosed, w.send([]byte{ProtocolHeartbeat}, frameControl, ""))
+}
+
+func TestFragmentedGossip(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	c1, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", g2)
+	require.NoError(t, err)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+
+	// random, so that it stays large when compressed
+	large := make([]byte, fragmentSize*4)
+	rand.Read(large)
+	c1.GossipBroadcast(newSurrogateGossipData(large))
+	waitUntil(t, func() bool {
+		g2.RLock()
+		defer g2.RUnlock()
+		return len(g2.state) == 256
+	})
+}
@@ -0,0 +1,433 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	defaultMaxElements = 1 << 16
+	defaultMaxDepth    = 16
+)
+
+// DecodeLimits bound what may be decoded from gob streams received from
+// other peers, so that a malicious or buggy peer can't exhaust our
+// memory or CPU with crafted messages.
+type DecodeLimits struct {
+	// MaxMessageSize is the largest message accepted, in bytes. Zero
+	// means no limit beyond that of the transport.
+	MaxMessageSize int
+
+	// MaxElements is the largest number of elements accepted in any
+	// slice, array or map. Zero means defaultMaxElements.
+	MaxElements int
+
+	// MaxDepth is the deepest nesting of structs, slices, arrays, maps
+	// and interfaces accepted. Zero means defaultMaxDepth.
+	MaxDepth int
+
+	// AllowedTypes are the names of the named types, as they appear in
+	// the gob stream, which may be decoded; gob uses the unqualified
+	// type name for structs, and the name passed to gob.Register for
+	// interface values. Unnamed types such as slices and maps are
+	// always allowed, subject to their element types being allowed.
+	// Nil allows any type.
+	AllowedTypes []string
+}
+
+func (limits DecodeLimits) maxElements() int {
+	if limits.MaxElements > 0 {
+		return limits.MaxElements
+	}
+	return defaultMaxElements
+}
+
+func (limits DecodeLimits) maxDepth() int {
+	if limits.MaxDepth > 0 {
+		return limits.MaxDepth
+	}
+	return defaultMaxDepth
+}
+
+// set returns whether any of the limits is set.
+func (limits DecodeLimits) set() bool {
+	return limits.MaxMessageSize > 0 || limits.MaxElements > 0 || limits.MaxDepth > 0 || limits.AllowedTypes != nil
+}
+
+// with returns limits which also allow the named types.
+func (limits DecodeLimits) with(types ...string) DecodeLimits {
+	if limits.AllowedTypes != nil {
+		limits.AllowedTypes = append(append([]string{}, limits.AllowedTypes...), types...)
+	}
+	return limits
+}
+
+// Names of the types in the gob streams mesh itself sends. A gossip
+// channel always allows these, in addition to its own AllowedTypes.
+var meshGobTypes = []string{"gossipFrameMeta", "GossipError", "peerSummary", "connectionSummary"}
+
+// CheckGob checks that the gob stream in data, e.g. a payload received
+// by a Gossiper, is within limits, without decoding it. A stream which
+// passes may still fail to decode, but decoding it will not consume
+// more resources than the limits imply.
+func CheckGob(data []byte, limits DecodeLimits) error {
+	if limits.MaxMessageSize > 0 && len(data) > limits.MaxMessageSize {
+		return fmt.Errorf("gob message of %d bytes exceeds limit of %d", len(data), limits.MaxMessageSize)
+	}
+	checker := &gobChecker{limits: limits, types: make(map[int]gobWireType), stream: gobBuffer{data}}
+	if limits.AllowedTypes != nil {
+		checker.allowed = make(map[string]struct{})
+		for _, name := range limits.AllowedTypes {
+			checker.allowed[name] = struct{}{}
+		}
+	}
+	for len(checker.stream.b) > 0 {
+		msg, err := checker.nextMessage()
+		if err != nil {
+			return err
+		}
+		if err := checker.message(&gobBuffer{msg}); err != nil {
+			return err
+		}
+	}
+	if checker.defined {
+		// as for the decoder, types must be followed by a value
+		return errGobTruncated
+	}
+	return nil
+}
+
+// The ids of gob's predefined types.
+const (
+	gobBool      = 1
+	gobInt       = 2
+	gobUint      = 3
+	gobFloat     = 4
+	gobBytes     = 5
+	gobString    = 6
+	gobComplex   = 7
+	gobInterface = 8
+)
+
+// gobWireType is what we need to know of a type defined in a gob stream.
+type gobWireType struct {
+	kind     int // one of gobArray etc.
+	name     string
+	elem     int
+	key      int
+	fieldIDs []int
+}
+
+// Kinds of gobWireType; these are the field numbers of gob's wireType.
+const (
+	gobArray = iota
+	gobSlice
+	gobStruct
+	gobMap
+	gobEncoder
+	gobBinaryMarshaler
+	gobTextMarshaler
+)
+
+type gobChecker struct {
+	limits  DecodeLimits
+	allowed map[string]struct{}
+	types   map[int]gobWireType
+	stream  gobBuffer // the messages not yet read
+	defined bool      // whether the last message defined a type
+}
+
+func (c *gobChecker) nextMessage() ([]byte, error) {
+	n, err := c.stream.uint()
+	if err != nil {
+		return nil, err
+	}
+	return c.stream.next(n)
+}
+
+func (c *gobChecker) message(buf *gobBuffer) error {
+	id, err := buf.int()
+	if err != nil {
+		return err
+	}
+	if c.defined = id < 0; c.defined {
+		return c.defineType(int(-id), buf)
+	}
+	if t, found := c.types[int(id)]; !found || t.kind != gobStruct {
+		// non-struct values are preceded by a zero field delta
+		if delta, err := buf.uint(); err != nil {
+			return err
+		} else if delta != 0 {
+			return fmt.Errorf("malformed gob singleton value")
+		}
+	}
+	return c.value(int(id), buf, 0)
+}
+
+func (c *gobChecker) defineType(id int, buf *gobBuffer) error {
+	var t gobWireType
+	err := buf.fields(func(kind int) error {
+		t.kind = kind
+		return buf.fields(func(field int) error {
+			switch {
+			case field == 0: // CommonType
+				return buf.fields(func(field int) error {
+					switch field {
+					case 0:
+						name, err := buf.bytes()
+						t.name = string(name)
+						return err
+					case 1:
+						_, err := buf.int()
+						return err
+					}
+					return fmt.Errorf("malformed gob type definition")
+				})
+			case field == 1 && kind == gobStruct:
+				// the definition is bounded by the size of the message
+				n, err := buf.count(len(buf.b))
+				for i := 0; err == nil && i < n; i++ {
+					err = buf.fields(func(field int) error {
+						switch field {
+						case 0:
+							_, err := buf.bytes()
+							return err
+						case 1:
+							fieldID, err := buf.int()
+							t.fieldIDs = append(t.fieldIDs, int(fieldID))
+							return err
+						}
+						return fmt.Errorf("malformed gob struct definition")
+					})
+				}
+				return err
+			case field == 1 && (kind == gobArray || kind == gobSlice || kind == gobMap):
+				// the key of a map, or the element of the others
+				elem, err := buf.int()
+				t.elem, t.key = int(elem), int(elem)
+				return err
+			case field == 2 && kind == gobArray:
+				_, err := buf.int() // length
+				return err
+			case field == 2 && kind == gobMap:
+				elem, err := buf.int()
+				t.elem = int(elem)
+				return err
+			}
+			return fmt.Errorf("malformed gob type definition")
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if kind := t.kind; kind == gobStruct || kind == gobEncoder || kind == gobBinaryMarshaler || kind == gobTextMarshaler {
+		if err := c.checkAllowed(t.name); err != nil {
+			return err
+		}
+	}
+	c.types[id] = t
+	return nil
+}
+
+func (c *gobChecker) checkAllowed(name string) error {
+	if c.allowed == nil || name == "" || strings.HasPrefix(name, "[") || strings.HasPrefix(name, "map[") {
+		return nil
+	}
+	if _, found := c.allowed[name]; !found {
+		return fmt.Errorf("gob type %q is not allowed", name)
+	}
+	return nil
+}
+
+func (c *gobChecker) value(id int, buf *gobBuffer, depth int) error {
+	switch id {
+	case gobBool, gobInt, gobUint, gobFloat:
+		_, err := buf.uint()
+		return err
+	case gobComplex:
+		if _, err := buf.uint(); err != nil {
+			return err
+		}
+		_, err := buf.uint()
+		return err
+	case gobBytes, gobString:
+		_, err := buf.bytes()
+		return err
+	}
+	if depth >= c.limits.maxDepth() {
+		return fmt.Errorf("gob value nested deeper than %d", c.limits.maxDepth())
+	}
+	if id == gobInterface {
+		return c.interfaceValue(buf, depth)
+	}
+	t, found := c.types[id]
+	if !found {
+		return fmt.Errorf("gob value of undefined type %d", id)
+	}
+	switch t.kind {
+	case gobArray, gobSlice:
+		n, err := buf.count(c.limits.maxElements())
+		for i := 0; err == nil && i < n; i++ {
+			err = c.value(t.elem, buf, depth+1)
+		}
+		return err
+	case gobMap:
+		n, err := buf.count(c.limits.maxElements())
+		for i := 0; err == nil && i < n; i++ {
+			if err = c.value(t.key, buf, depth+1); err == nil {
+				err = c.value(t.elem, buf, depth+1)
+			}
+		}
+		return err
+	case gobStruct:
+		return buf.fields(func(field int) error {
+			if field >= len(t.fieldIDs) {
+				return fmt.Errorf("gob field %d out of range for %s", field, t.name)
+			}
+			return c.value(t.fieldIDs[field], buf, depth+1)
+		})
+	}
+	_, err := buf.bytes() // GobEncoder etc.
+	return err
+}
+
+func (c *gobChecker) interfaceValue(buf *gobBuffer, depth int) error {
+	name, err := buf.bytes()
+	if err != nil || len(name) == 0 { // nil interface value
+		return err
+	}
+	if err := c.checkAllowed(string(name)); err != nil {
+		return err
+	}
+	// The concrete type id may be preceded by definitions of the types
+	// it needs, which may end the message, in which case the rest of the
+	// value continues in the next one.
+	var id int64
+	for {
+		if len(buf.b) == 0 {
+			if buf.b, err = c.nextMessage(); err != nil {
+				return err
+			}
+		}
+		if id, err = buf.int(); err != nil || id >= 0 {
+			break
+		}
+		if err = c.defineType(int(-id), buf); err == nil && len(buf.b) > 0 {
+			_, err = buf.uint()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	n, err := buf.uint()
+	if err != nil {
+		return err
+	}
+	inner, err := buf.next(n)
+	if err != nil {
+		return err
+	}
+	ibuf := &gobBuffer{inner}
+	if t, found := c.types[int(id)]; !found || t.kind != gobStruct {
+		if _, err := ibuf.uint(); err != nil {
+			return err
+		}
+	}
+	return c.value(int(id), ibuf, depth+1)
+}
+
+// gobBuffer reads the primitives of the gob wire format.
+type gobBuffer struct {
+	b []byte
+}
+
+var errGobTruncated = fmt.Errorf("truncated gob stream")
+
+func (buf *gobBuffer) uint() (uint64, error) {
+	if len(buf.b) == 0 {
+		return 0, errGobTruncated
+	}
+	if buf.b[0] < 0x80 {
+		x := uint64(buf.b[0])
+		buf.b = buf.b[1:]
+		return x, nil
+	}
+	n := int(-int8(buf.b[0]))
+	if n > 8 || len(buf.b) < 1+n {
+		return 0, errGobTruncated
+	}
+	var x uint64
+	for _, b := range buf.b[1 : 1+n] {
+		x = x<<8 | uint64(b)
+	}
+	buf.b = buf.b[1+n:]
+	return x, nil
+}
+
+func (buf *gobBuffer) int() (int64, error) {
+	u, err := buf.uint()
+	if u&1 != 0 {
+		return ^int64(u >> 1), err
+	}
+	return int64(u >> 1), err
+}
+
+func (buf *gobBuffer) next(n uint64) ([]byte, error) {
+	if n > uint64(len(buf.b)) {
+		return nil, errGobTruncated
+	}
+	b := buf.b[:n]
+	buf.b = buf.b[n:]
+	return b, nil
+}
+
+func (buf *gobBuffer) bytes() ([]byte, error) {
+	n, err := buf.uint()
+	if err != nil {
+		return nil, err
+	}
+	return buf.next(n)
+}
+
+// count reads the number of elements of a slice, array or map. Every
+// element takes at least a byte, so there can't be more than there are
+// bytes left.
+func (buf *gobBuffer) count(max int) (int, error) {
+	n, err := buf.uint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(max) || n > math.MaxInt32 {
+		return 0, fmt.Errorf("gob collection of %d elements exceeds limit of %d", n, max)
+	}
+	if n > uint64(len(buf.b)) {
+		return 0, errGobTruncated
+	}
+	return int(n), nil
+}
+
+// fields reads the fields of a struct, calling f with the number of
+// each, which must consume the field's value.
+func (buf *gobBuffer) fields(f func(field int) error) error {
+	field := -1
+	for {
+		delta, err := buf.uint()
+		if err != nil {
+			return err
+		}
+		if delta == 0 {
+			return nil
+		}
+		if delta > math.MaxInt32 {
+			return fmt.Errorf("malformed gob struct")
+		}
+		field += int(delta)
+		if err := f(field); err != nil {
+			return err
+		}
+	}
+}
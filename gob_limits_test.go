@@ -0,0 +1,66 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testGobNode struct {
+	Name     string
+	Children []*testGobNode
+	Attrs    map[string]interface{}
+}
+
+type testGobAttr struct {
+	Value uint64
+}
+
+func init() {
+	gob.Register(testGobAttr{})
+}
+
+func TestCheckGob(t *testing.T) {
+	tree := &testGobNode{Name: "root", Attrs: map[string]interface{}{"a": testGobAttr{1}}}
+	leaf := tree
+	for i := 0; i < 5; i++ {
+		child := &testGobNode{Name: "child", Attrs: map[string]interface{}{}}
+		leaf.Children = []*testGobNode{child, {}}
+		leaf = child
+	}
+	data := gobEncode(tree, []uint64{1, 2, 3}, "trailer", gossipFrameMeta{MsgIDs: []uint64{1}, SeqEpoch: 2})
+
+	require.NoError(t, CheckGob(data, DecodeLimits{}))
+	// interface values are checked by both their registered and type names
+	attr := []string{"github.com/weaveworks/mesh.testGobAttr", "testGobAttr"}
+	require.NoError(t, CheckGob(data, DecodeLimits{AllowedTypes: append(attr, "testGobNode", "gossipFrameMeta")}))
+	require.Error(t, CheckGob(data, DecodeLimits{AllowedTypes: []string{"testGobNode", "testGobAttr", "gossipFrameMeta"}}))
+	require.Error(t, CheckGob(data, DecodeLimits{AllowedTypes: append(attr, "gossipFrameMeta")}))
+	require.Error(t, CheckGob(data, DecodeLimits{MaxMessageSize: len(data) - 1}))
+	require.Error(t, CheckGob(data, DecodeLimits{MaxElements: 2}))
+	require.NoError(t, CheckGob(data, DecodeLimits{MaxElements: 3}))
+	require.Error(t, CheckGob(data, DecodeLimits{MaxDepth: 8}))
+
+	// the checked stream still decodes
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var decoded testGobNode
+	require.NoError(t, dec.Decode(&decoded))
+	require.Equal(t, testGobAttr{1}, decoded.Attrs["a"])
+
+	// truncation anywhere within a value is detected
+	data = gobEncode(tree)
+	for i := 1; i < len(data); i++ {
+		require.Error(t, CheckGob(data[:i], DecodeLimits{}), "truncated at %d", i)
+	}
+	// as are collections claiming more elements than there are bytes
+	require.Error(t, CheckGob(gobEncode(make([]bool, 100))[:20], DecodeLimits{}))
+}
+
+func TestDecodeLimitsSet(t *testing.T) {
+	// channels without limits don't check their frames
+	require.False(t, DecodeLimits{}.set())
+	require.True(t, DecodeLimits{MaxDepth: 4}.set())
+	require.True(t, DecodeLimits{AllowedTypes: []string{}}.set())
+}
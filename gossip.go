@@ -1,6 +1,11 @@
 package mesh
 
-import "sync"
+import (
+	"encoding/gob"
+	"io"
+	"sync"
+	"time"
+)
 
 // Gossip is the sending interface.
 //
@@ -69,19 +74,23 @@ type GossipData interface {
 type gossipSender struct {
 	sync.Mutex
 	makeMsg          func(msg []byte) protocolMsg
-	makeBroadcastMsg func(srcName PeerName, msg []byte) protocolMsg
+	makeBroadcastMsg func(srcName PeerName, msg []byte, meta gossipFrameMeta) protocolMsg
 	sender           protocolSender
-	gossip           GossipData
-	broadcasts       map[PeerName]GossipData
+	queue            gossipQueue
+	pending          []pendingGossip // in order of arrival
+	room             *sync.Cond      // signalled when pending shrinks, or we stop
+	stopped          bool
 	more             chan<- struct{}
 	flush            chan<- chan<- bool // for testing
+	retired          chan struct{}      // closed when its channel closes
 }
 
 // NewGossipSender constructs a usable GossipSender.
 func newGossipSender(
 	makeMsg func(msg []byte) protocolMsg,
-	makeBroadcastMsg func(srcName PeerName, msg []byte) protocolMsg,
+	makeBroadcastMsg func(srcName PeerName, msg []byte, meta gossipFrameMeta) protocolMsg,
 	sender protocolSender,
+	queue gossipQueue,
 	stop <-chan struct{},
 ) *gossipSender {
 	more := make(chan struct{}, 1)
@@ -90,20 +99,25 @@ func newGossipSender(
 		makeMsg:          makeMsg,
 		makeBroadcastMsg: makeBroadcastMsg,
 		sender:           sender,
-		broadcasts:       make(map[PeerName]GossipData),
+		queue:            queue,
 		more:             more,
 		flush:            flush,
+		retired:          make(chan struct{}),
 	}
+	s.room = sync.NewCond(s)
 	go s.run(stop, more, flush)
 	return s
 }
 
 func (s *gossipSender) run(stop <-chan struct{}, more <-chan struct{}, flush <-chan chan<- bool) {
+	defer s.halt()
 	sent := false
 	for {
 		select {
 		case <-stop:
 			return
+		case <-s.retired:
+			return
 		case <-more:
 			sentSomething, err := s.deliver(stop)
 			if err != nil {
@@ -140,12 +154,22 @@ func (s *gossipSender) deliver(stop <-chan struct{}) (bool, error) {
 			return sent, nil
 		default:
 		}
-		data, makeProtocolMsg := s.pick()
+		data, makeProtocolMsg, srcName := s.pick()
 		if data == nil {
 			return sent, nil
 		}
-		for _, msg := range data.Encode() {
-			if err := s.sender.SendProtocolMsg(makeProtocolMsg(msg)); err != nil {
+		var msgs []protocolMsg
+		size := 0
+		for _, msg := range s.encode(data) {
+			m := makeProtocolMsg(msg)
+			msgs = append(msgs, m)
+			size += len(m.msg)
+		}
+		if bs, ok := s.sender.(batchSender); ok {
+			bs.begin(size)
+		}
+		for _, m := range msgs {
+			if err := s.send(m, srcName); err != nil {
 				return sent, err
 			}
 		}
@@ -153,58 +177,99 @@ func (s *gossipSender) deliver(stop <-chan struct{}) (bool, error) {
 	}
 }
 
-func (s *gossipSender) pick() (data GossipData, makeProtocolMsg func(msg []byte) protocolMsg) {
+// send sends m, from srcName if it is a broadcast, telling a channel's
+// sender where it comes from, so that it needn't decode it.
+func (s *gossipSender) send(m protocolMsg, srcName PeerName) error {
+	if cs, ok := s.sender.(*channelSender); ok && srcName != UnknownPeerName {
+		return cs.sendFrom(m, srcName)
+	}
+	return s.sender.SendProtocolMsg(m)
+}
+
+// batchSender is implemented by senders which want to know the size of
+// each batch of msgs, encoded from one piece of data, before they are
+// sent.
+type batchSender interface {
+	begin(size int)
+}
+
+// connectionEncoder is implemented by GossipData whose encoding depends
+// on the connection it is sent on.
+type connectionEncoder interface {
+	encodeFor(conn Connection) [][]byte
+}
+
+func (s *gossipSender) encode(data GossipData) [][]byte {
+	if ce, ok := data.(connectionEncoder); ok {
+		if cs, ok := s.sender.(*channelSender); ok {
+			return ce.encodeFor(cs.conn)
+		}
+	}
+	return data.Encode()
+}
+
+// pick takes the pending data of one bucket, merged, preferring gossip,
+// which is usually more important than broadcasts, along with the
+// source of the broadcasts, if they are.
+func (s *gossipSender) pick() (data GossipData, makeProtocolMsg func(msg []byte) protocolMsg, srcName PeerName) {
 	s.Lock()
 	defer s.Unlock()
-	switch {
-	case s.gossip != nil: // usually more important than broadcasts
-		data = s.gossip
-		makeProtocolMsg = s.makeMsg
-		s.gossip = nil
-	case len(s.broadcasts) > 0:
-		for srcName, d := range s.broadcasts {
-			data = d
-			makeProtocolMsg = func(msg []byte) protocolMsg { return s.makeBroadcastMsg(srcName, msg) }
-			delete(s.broadcasts, srcName)
+	if len(s.pending) == 0 {
+		return
+	}
+	first := 0
+	for i, p := range s.pending {
+		if !p.broadcast {
+			first = i
 			break
 		}
 	}
-	return
+	head := s.pending[first]
+	data = head.data
+	remaining := s.pending[:0]
+	for i, p := range s.pending {
+		switch {
+		case i == first:
+		case i > first && p.sameBucket(head):
+			data = mergeGossipData(data, p.data)
+		default:
+			remaining = append(remaining, p)
+		}
+	}
+	for i := len(remaining); i < len(s.pending); i++ {
+		s.pending[i] = pendingGossip{}
+	}
+	s.pending = remaining
+	s.room.Broadcast()
+
+	if !head.broadcast {
+		return data, s.makeMsg, UnknownPeerName
+	}
+	var meta gossipFrameMeta
+	data, meta = splitFrameMeta(data)
+	return data, func(msg []byte) protocolMsg { return s.makeBroadcastMsg(head.srcName, msg, meta) }, head.srcName
 }
 
 // Send accumulates the GossipData and will send it eventually.
 // Send and Broadcast accumulate into different buckets.
 func (s *gossipSender) Send(data GossipData) {
-	s.Lock()
-	defer s.Unlock()
-	if s.empty() {
-		defer s.prod()
-	}
-	if s.gossip == nil {
-		s.gossip = data
-	} else {
-		s.gossip = s.gossip.Merge(data)
-	}
+	s.enqueue(pendingGossip{data: data})
 }
 
 // Broadcast accumulates the GossipData under the given srcName and will send
 // it eventually. Send and Broadcast accumulate into different buckets.
 func (s *gossipSender) Broadcast(srcName PeerName, data GossipData) {
+	s.enqueue(pendingGossip{broadcast: true, srcName: srcName, data: data})
+}
+
+// halt releases any callers blocked on a full queue, once we stop.
+func (s *gossipSender) halt() {
 	s.Lock()
 	defer s.Unlock()
-	if s.empty() {
-		defer s.prod()
-	}
-	d, found := s.broadcasts[srcName]
-	if !found {
-		s.broadcasts[srcName] = data
-	} else {
-		s.broadcasts[srcName] = d.Merge(data)
-	}
+	s.stopped = true
+	s.room.Broadcast()
 }
 
-func (s *gossipSender) empty() bool { return s.gossip == nil && len(s.broadcasts) == 0 }
-
 func (s *gossipSender) prod() {
 	select {
 	case s.more <- struct{}{}:
@@ -225,18 +290,21 @@ func (s *gossipSender) Flush() bool {
 // TODO(pb): may be able to remove this and use makeGossipSender directly
 type gossipSenders struct {
 	sync.Mutex
-	sender  protocolSender
-	stop    <-chan struct{}
-	senders map[string]*gossipSender
+	sender    protocolSender
+	stop      <-chan struct{}
+	senders   map[string]*gossipSender
+	transfers map[string]*gossipSender // of state; see StateTransfer
+	limiters  rateLimiters
 }
 
 // NewGossipSenders returns a usable GossipSenders leveraging the ProtocolSender.
 // TODO(pb): is stop chan the best way to do that?
 func newGossipSenders(sender protocolSender, stop <-chan struct{}) *gossipSenders {
 	return &gossipSenders{
-		sender:  sender,
-		stop:    stop,
-		senders: make(map[string]*gossipSender),
+		sender:    sender,
+		stop:      stop,
+		senders:   make(map[string]*gossipSender),
+		transfers: make(map[string]*gossipSender),
 	}
 }
 
@@ -253,6 +321,35 @@ func (gs *gossipSenders) Sender(channelName string, makeGossipSender func(sender
 	return s
 }
 
+// Transfer yields the GossipSender for state transfers of the named
+// channel, using the factory function if none yet exists.
+func (gs *gossipSenders) Transfer(channelName string, makeGossipSender func(sender protocolSender, stop <-chan struct{}) *gossipSender) *gossipSender {
+	gs.Lock()
+	defer gs.Unlock()
+	s, found := gs.transfers[channelName]
+	if !found {
+		s = makeGossipSender(gs.sender, gs.stop)
+		gs.transfers[channelName] = s
+	}
+	return s
+}
+
+// retire stops and forgets the senders, and rate limiter, of the named
+// channel, dropping any gossip still pending.
+func (gs *gossipSenders) retire(channelName string) {
+	gs.Lock()
+	defer gs.Unlock()
+	for _, senders := range []map[string]*gossipSender{gs.senders, gs.transfers} {
+		if s, found := senders[channelName]; found {
+			close(s.retired)
+			delete(senders, channelName)
+		}
+	}
+	gs.limiters.Lock()
+	delete(gs.limiters.channels, channelName)
+	gs.limiters.Unlock()
+}
+
 // Flush flushes all managed senders. Used for testing.
 func (gs *gossipSenders) Flush() bool {
 	sent := false
@@ -261,11 +358,144 @@ func (gs *gossipSenders) Flush() bool {
 	for _, sender := range gs.senders {
 		sent = sender.Flush() || sent
 	}
+	for _, sender := range gs.transfers {
+		sent = sender.Flush() || sent
+	}
 	return sent
 }
 
+// gossipFrameMeta carries optional metadata about a gossip frame. It is
+// encoded after the payload, and only when non-empty, so peers which
+// don't know about it simply never decode it.
+type gossipFrameMeta struct {
+	MsgIDs     []uint64 // reliable broadcasts, or confirmed unicast, carried by the frame
+	Acks       []uint64 // reliable broadcasts, or confirmed unicasts, acknowledged by the frame
+	Retransmit bool     // unicast frame carrying a retransmitted broadcast
+	Sealed     bool     // unicast payload sealed for the destination
+	HopAck     bool     // confirmed unicast to be acknowledged by its first hop
+
+	// Range of per-origin sequence numbers of the broadcasts carried
+	// by the frame, on ordered channels. The epoch identifies the
+	// incarnation of the origin's channel.
+	SeqEpoch uint64
+	SeqFirst uint64
+	SeqLast  uint64
+
+	// Hops counts the peers which relayed the frame since its origin;
+	// those which don't know about it don't count.
+	Hops uint32
+
+	// TTL is the number of connections the frame may yet cross,
+	// including the one it is sent on; zero means no limit.
+	TTL uint32
+
+	// The context of the span of the previous hop, if the frame is
+	// traced; see SpanTracer.
+	TraceParent string
+	TraceState  string
+
+	// IDs of the broadcasts carried by the frame, on channels with a
+	// BroadcastStrategy.
+	BroadcastIDs []uint64
+
+	// Not encoded: the neighbour the frame was received from, and when.
+	sender   PeerName
+	received time.Time
+}
+
+func (meta gossipFrameMeta) empty() bool {
+	return len(meta.MsgIDs) == 0 && len(meta.Acks) == 0 && !meta.Retransmit && !meta.Sealed && !meta.HopAck && meta.SeqEpoch == 0 && meta.Hops == 0 && meta.TTL == 0 && meta.TraceParent == "" && len(meta.BroadcastIDs) == 0
+}
+
+func (meta gossipFrameMeta) merge(other gossipFrameMeta) gossipFrameMeta {
+	merged := gossipFrameMeta{
+		MsgIDs:     append(append([]uint64{}, meta.MsgIDs...), other.MsgIDs...),
+		Acks:       append(append([]uint64{}, meta.Acks...), other.Acks...),
+		Retransmit: meta.Retransmit || other.Retransmit,
+		Sealed:     meta.Sealed || other.Sealed,
+		HopAck:     meta.HopAck || other.HopAck,
+		Hops:       meta.Hops,
+	}
+	if len(meta.BroadcastIDs) > 0 || len(other.BroadcastIDs) > 0 {
+		merged.BroadcastIDs = append(append([]uint64{}, meta.BroadcastIDs...), other.BroadcastIDs...)
+	}
+	merged.TraceParent, merged.TraceState = meta.TraceParent, meta.TraceState
+	if merged.TraceParent == "" {
+		merged.TraceParent, merged.TraceState = other.TraceParent, other.TraceState
+	}
+	if other.Hops > merged.Hops {
+		merged.Hops = other.Hops
+	}
+	// The merged frame may be relayed as far as either would have
+	// been, so that it reaches the peers that both would have.
+	if meta.TTL != 0 && other.TTL != 0 {
+		merged.TTL = meta.TTL
+		if other.TTL > merged.TTL {
+			merged.TTL = other.TTL
+		}
+	}
+	merged.SeqEpoch, merged.SeqFirst, merged.SeqLast = meta.SeqEpoch, meta.SeqFirst, meta.SeqLast
+	switch {
+	case other.SeqEpoch == 0:
+	case meta.SeqEpoch != other.SeqEpoch:
+		// the origin restarted; the older sequence is meaningless
+		merged.SeqEpoch, merged.SeqFirst, merged.SeqLast = other.SeqEpoch, other.SeqFirst, other.SeqLast
+	default:
+		if other.SeqFirst < merged.SeqFirst {
+			merged.SeqFirst = other.SeqFirst
+		}
+		if other.SeqLast > merged.SeqLast {
+			merged.SeqLast = other.SeqLast
+		}
+	}
+	return merged
+}
+
+// decodeFrameMeta decodes the metadata following a frame's payload, if
+// there is any.
+func decodeFrameMeta(dec *gob.Decoder) (meta gossipFrameMeta, err error) {
+	if err = dec.Decode(&meta); err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// gossipDataWithMeta attaches frame metadata to GossipData which is
+// queued for sending.
+type gossipDataWithMeta struct {
+	GossipData
+	meta gossipFrameMeta
+}
+
+// Merge implements GossipData.
+func (d *gossipDataWithMeta) Merge(other GossipData) GossipData {
+	return mergeGossipData(d, other)
+}
+
+func withFrameMeta(data GossipData, meta gossipFrameMeta) GossipData {
+	if meta.empty() {
+		return data
+	}
+	return &gossipDataWithMeta{GossipData: data, meta: meta}
+}
+
+func splitFrameMeta(data GossipData) (GossipData, gossipFrameMeta) {
+	if d, ok := data.(*gossipDataWithMeta); ok {
+		return d.GossipData, d.meta
+	}
+	return data, gossipFrameMeta{}
+}
+
+// mergeGossipData merges two pieces of GossipData, either of which may
+// carry frame metadata.
+func mergeGossipData(a, b GossipData) GossipData {
+	aData, aMeta := splitFrameMeta(a)
+	bData, bMeta := splitFrameMeta(b)
+	return withFrameMeta(aData.Merge(bData), aMeta.merge(bMeta))
+}
+
 // GossipChannels is an index of channel name to gossip channel.
-type gossipChannels map[string]*gossipChannel
+type gossipChannels map[string]*GossipChannel
 
 type gossipConnection interface {
 	gossipSenders() *gossipSenders
@@ -1,158 +1,545 @@
 package mesh
 
 import (
-	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
+	"sync"
+	"time"
 )
 
-// gossipChannel is a logical communication channel within a physical mesh.
-type gossipChannel struct {
+// GossipChannel is a logical communication channel within a physical mesh.
+// The Gossip returned by Router.NewGossip is a *GossipChannel.
+type GossipChannel struct {
 	name     string
+	config   GossipChannelConfig
 	ourself  *localPeer
 	routes   *routes
 	gossiper Gossiper
+	delivery sync.RWMutex // held for writing by Snapshot
+	reliable *reliableBroadcasts
+	confirms unicastConfirms
+	acl      *compiledACL // nil unless config.ACL is set
+	ordering *broadcastOrdering
+	seen     *broadcastIDs // nil unless config.Broadcast is set
+	errors   *gossipErrorLimiter
 	logger   Logger
+	// frames not relayed because their TTL was exhausted, accessed
+	// atomically
+	ttlExceeded uint64
+	// unicasts we couldn't relay, and ours returned to us as dead
+	// letters, accessed atomically
+	deadLetters         uint64
+	deadLettersReturned uint64
+	// panics in the Gossiper, and whether that has quarantined the
+	// channel, accessed atomically
+	panics      uint64
+	quarantined int32
+	closed      int32 // see Close
+	// relays frames for other peers once the channel is quarantined
+	surrogate     *GossipChannel
+	surrogateOnce sync.Once
+	counters      channelCounters
+}
+
+// GossipChannelConfig defines optional behaviour of a gossip channel.
+// All peers using a channel should configure it identically.
+type GossipChannelConfig struct {
+	// Ordered causes broadcasts from each origin peer to be delivered
+	// to Gossiper.OnGossipBroadcast in the order they were sent.
+	Ordered bool
+
+	// OrderTimeout bounds how long an out-of-order broadcast is held
+	// back waiting for the broadcasts preceding it, which may have
+	// been lost, e.g. when a connection fails. Zero means
+	// defaultOrderTimeout.
+	OrderTimeout time.Duration
+
+	// DecodeLimits bound the gob-encoded frames received on the
+	// channel. The types which mesh itself uses in frames are always
+	// allowed. Frames are only checked, which costs a pass over each,
+	// if some limit is set. Gossipers which decode their payloads with
+	// gob should check them with CheckGob too.
+	DecodeLimits DecodeLimits
+
+	// EncryptUnicast seals unicasts with the destination peer's public
+	// key, as advertised in the topology, so that the peers relaying
+	// them can't read them. It guards against relays which are merely
+	// curious, not ones which tamper with the topology to substitute
+	// their own keys.
+	EncryptUnicast bool
+
+	// RateLimit bounds the gossip sent on the channel over each
+	// connection, so that a chatty channel can't crowd out the others.
+	// Gossip and broadcasts are held back, and merged, while over the
+	// limit; unicasts and digests are never held back, but count
+	// against it.
+	RateLimit RateLimit
+
+	// QueueLimit bounds the updates pending for each neighbour, e.g.
+	// while it is slow or the channel is over its RateLimit; QueuePolicy
+	// says what happens to updates beyond it. Zero means unlimited,
+	// with all the updates merged as they arrive.
+	QueueLimit  int
+	QueuePolicy QueuePolicy
+
+	// Datagrams sends unicasts small enough to fit in a datagram over
+	// UDP, on connections where both peers have set Config.Datagrams.
+	// Such unicasts may be lost, duplicated or reordered, but aren't
+	// held up behind other traffic.
+	Datagrams bool
+
+	// OnDeadLetter, if set, is called with each unicast sent from here
+	// which a peer on the way to its destination couldn't relay.
+	// Otherwise these are reported like other errors; see
+	// GossipErrorHandler.
+	OnDeadLetter func(DeadLetter)
+
+	// OnPanic, if set, is called when the channel's Gossiper panics,
+	// after the channel has been quarantined; see GossipPanic.
+	OnPanic func(*GossipPanic)
+
+	// ACL, if set, restricts which peers may send and receive on the
+	// channel.
+	ACL *ChannelACL
+
+	// Broadcast, if set, chooses the neighbours broadcasts are sent
+	// to, in place of the spanning tree rooted at their origin; see
+	// EpidemicBroadcast. Broadcasts on such channels carry IDs, so that
+	// peers can ignore those they have already seen.
+	Broadcast BroadcastStrategy
 }
 
 // newGossipChannel returns a named, usable channel.
 // It delegates receiving duties to the passed Gossiper.
-func newGossipChannel(channelName string, ourself *localPeer, r *routes, g Gossiper, logger Logger) *gossipChannel {
-	return &gossipChannel{
+func newGossipChannel(channelName string, config GossipChannelConfig, ourself *localPeer, r *routes, g Gossiper, logger Logger) *GossipChannel {
+	c := &GossipChannel{
 		name:     channelName,
+		config:   config,
 		ourself:  ourself,
 		routes:   r,
 		gossiper: g,
+		reliable: newReliableBroadcasts(),
+		acl:      compileACL(config.ACL),
+		errors:   newGossipErrorLimiter(),
 		logger:   logger,
 	}
+	if config.Ordered {
+		c.ordering = newBroadcastOrdering(c)
+	}
+	if config.Broadcast != nil {
+		c.seen = newBroadcastIDs()
+	}
+	return c
 }
 
-func (c *gossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
+// checkFrame checks a frame received on the channel against its limits,
+// if it has any.
+func (c *GossipChannel) checkFrame(payload []byte) error {
+	if !c.config.DecodeLimits.set() {
+		return nil
+	}
+	return CheckGob(payload, c.config.DecodeLimits.with(meshGobTypes...))
+}
+
+func (c *GossipChannel) deliverUnicast(sender, srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
 	var destName PeerName
 	if err := dec.Decode(&destName); err != nil {
 		return err
 	}
+	var payload []byte
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+	meta, err := decodeFrameMeta(dec)
+	if err != nil {
+		return err
+	}
+	meta.sender = sender
 	if c.ourself.Name == destName {
-		var payload []byte
-		if err := dec.Decode(&payload); err != nil {
+		meta.received = c.clock().Now()
+		span := c.traceHop(spanReceive, srcName, &meta)
+		err := c.receiveUnicast(srcName, payload, meta)
+		span.End(err)
+		return err
+	}
+	c.ackHop(srcName, meta)
+	if !c.hop(&meta) {
+		return nil
+	}
+	c.noteTransit()
+	span := c.traceHop(spanRelay, srcName, &meta)
+	err = c.relayUnicast(srcName, destName, gobEncode(c.name, srcName, destName, payload, meta))
+	span.End(err)
+	if err != nil {
+		c.logf("%v", err)
+		if _, unroutable := err.(unroutableError); unroutable {
+			c.returnDeadLetter(srcName, destName, payload, meta, err)
+		} else {
+			c.reportError(srcName, err)
+		}
+	}
+	return nil
+}
+
+// receiveUnicast handles a unicast addressed to us.
+func (c *GossipChannel) receiveUnicast(srcName PeerName, payload []byte, meta gossipFrameMeta) (err error) {
+	switch {
+	case len(meta.Acks) > 0:
+		c.ackReliable(srcName, meta.Acks)
+		c.confirms.ack(meta.Acks)
+		return nil
+	case meta.Retransmit:
+		if _, err := c.onGossipBroadcast(srcName, payload, meta); err != nil {
+			c.reportError(srcName, err)
+			return err
+		}
+		c.sendAcks(srcName, meta.MsgIDs)
+		return nil
+	case meta.Sealed:
+		if payload, err = c.ourself.router.openUnicast(srcName, payload); err != nil {
+			c.reportError(srcName, err)
 			return err
 		}
-		return c.gossiper.OnGossipUnicast(srcName, payload)
+	case c.config.EncryptUnicast:
+		err := fmt.Errorf("unencrypted unicast from %s on encrypted channel", srcName)
+		c.reportError(srcName, err)
+		return err
 	}
-	if err := c.relayUnicast(destName, origPayload); err != nil {
-		c.logf("%v", err)
+	c.ackHop(srcName, meta)
+	if err := c.onGossipUnicast(srcName, payload, meta); err != nil {
+		c.reportError(srcName, err)
+		return err
+	}
+	if !meta.HopAck {
+		c.sendAcks(srcName, meta.MsgIDs)
 	}
 	return nil
 }
 
-func (c *gossipChannel) deliverBroadcast(srcName PeerName, _ []byte, dec *gob.Decoder) error {
+func (c *GossipChannel) deliverBroadcast(sender, srcName PeerName, _ []byte, dec *gob.Decoder) error {
 	var payload []byte
 	if err := dec.Decode(&payload); err != nil {
 		return err
 	}
-	data, err := c.gossiper.OnGossipBroadcast(srcName, payload)
-	if err != nil || data == nil {
+	meta, err := decodeFrameMeta(dec)
+	if err != nil {
+		return err
+	}
+	meta.sender, meta.received = sender, c.clock().Now()
+	if c.duplicateBroadcast(meta) {
+		return nil
+	}
+	if c.ordering != nil && meta.SeqEpoch != 0 {
+		return c.ordering.receive(srcName, payload, meta)
+	}
+	return c.deliverBroadcastPayload(srcName, payload, meta)
+}
+
+func (c *GossipChannel) deliverBroadcastPayload(srcName PeerName, payload []byte, meta gossipFrameMeta) error {
+	span := c.traceHop(spanReceive, srcName, &meta)
+	data, err := c.onGossipBroadcast(srcName, payload, meta)
+	span.End(err)
+	if err != nil {
+		c.reportError(srcName, err)
 		return err
 	}
-	c.relayBroadcast(srcName, data)
+	c.sendAcks(srcName, meta.MsgIDs)
+	if data == nil {
+		return nil
+	}
+	meta.Acks, meta.Retransmit = nil, false
+	if !c.hop(&meta) {
+		return nil
+	}
+	c.noteTransit()
+	conns := c.broadcastConnections(srcName, meta.sender)
+	if len(conns) == 0 {
+		return nil
+	}
+	span = c.traceHop(spanRelay, srcName, &meta)
+	c.broadcastTo(conns, srcName, withFrameMeta(data, meta))
+	span.End(nil)
 	return nil
 }
 
-func (c *gossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) error {
+func (c *GossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) error {
 	var payload []byte
 	if err := dec.Decode(&payload); err != nil {
 		return err
 	}
-	update, err := c.gossiper.OnGossip(payload)
-	if err != nil || update == nil {
+	update, err := c.onGossip(payload)
+	if err != nil {
+		c.reportError(srcName, err)
 		return err
 	}
+	if update == nil {
+		return nil
+	}
 	c.relay(srcName, update)
 	return nil
 }
 
 // GossipUnicast implements Gossip, relaying msg to dst, which must be a
 // member of the channel.
-func (c *gossipChannel) GossipUnicast(dstPeerName PeerName, msg []byte) error {
-	return c.relayUnicast(dstPeerName, gobEncode(c.name, c.ourself.Name, dstPeerName, msg))
+func (c *GossipChannel) GossipUnicast(dstPeerName PeerName, msg []byte) error {
+	if c.isClosed() {
+		return errChannelClosed
+	}
+	return c.originateUnicast(dstPeerName, msg, gossipFrameMeta{})
+}
+
+// originateUnicast sends a unicast of ours, with meta, to dst.
+func (c *GossipChannel) originateUnicast(dstPeerName PeerName, msg []byte, meta gossipFrameMeta) error {
+	if router := c.ourself.router; router != nil && router.ConnectionMaker != nil {
+		router.ConnectionMaker.wake(dstPeerName)
+	}
+	span := c.traceOrigin(spanUnicast, dstPeerName, &meta)
+	err := c.gossipUnicast(dstPeerName, msg, meta)
+	span.End(err)
+	return err
+}
+
+func (c *GossipChannel) gossipUnicast(dstPeerName PeerName, msg []byte, meta gossipFrameMeta) error {
+	if c.config.EncryptUnicast {
+		sealed, err := c.ourself.router.sealUnicast(dstPeerName, msg)
+		if err != nil {
+			return err
+		}
+		msg, meta.Sealed = sealed, true
+	}
+	return c.relayUnicast(c.ourself.Name, dstPeerName, gobEncode(c.name, c.ourself.Name, dstPeerName, msg, c.stampTTL(meta)))
+}
+
+// GossipUnicastContext is GossipUnicast, except that it stops waiting
+// for msg to be sent when ctx is done, returning ctx.Err(). msg may
+// still be sent after that.
+func (c *GossipChannel) GossipUnicastContext(ctx context.Context, dstPeerName PeerName, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	go func() { result <- c.GossipUnicast(dstPeerName, msg) }()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // GossipBroadcast implements Gossip, relaying update to all members of the
 // channel.
-func (c *gossipChannel) GossipBroadcast(update GossipData) {
-	c.relayBroadcast(c.ourself.Name, update)
+func (c *GossipChannel) GossipBroadcast(update GossipData) {
+	if c.isClosed() {
+		return
+	}
+	var meta gossipFrameMeta
+	span := c.traceOrigin(spanBroadcast, UnknownPeerName, &meta)
+	c.relayBroadcast(c.ourself.Name, c.stampBroadcast(update, meta))
+	span.End(nil)
+	c.forwardToObservers(update)
+}
+
+// forwardToObservers shows observers a broadcast originating here,
+// which they would otherwise never see.
+func (c *GossipChannel) forwardToObservers(update GossipData) {
+	if c.ourself.router == nil {
+		return
+	}
+	c.ourself.router.observers.forEach(func(o *observerConnection) {
+		if o.observes(c) {
+			for _, msg := range update.Encode() {
+				o.send(c.makeBroadcastMsg(c.ourself.Name, msg, gossipFrameMeta{}))
+			}
+		}
+	})
+}
+
+// stampBroadcast attaches meta to a broadcast originating from us,
+// adding a sequence number if the channel is ordered.
+func (c *GossipChannel) stampBroadcast(update GossipData, meta gossipFrameMeta) GossipData {
+	if c.ordering != nil {
+		meta.SeqEpoch, meta.SeqFirst = c.ordering.nextSeq()
+		meta.SeqLast = meta.SeqFirst
+	}
+	c.stampBroadcastID(&meta)
+	return withFrameMeta(update, c.stampTTL(meta))
 }
 
 // GossipNeighbourSubset implements Gossip, relaying update to subset of members of the
 // channel.
-func (c *gossipChannel) GossipNeighbourSubset(update GossipData) {
+func (c *GossipChannel) GossipNeighbourSubset(update GossipData) {
 	c.relay(c.ourself.Name, update)
 }
 
 // Send relays data into the channel topology via random neighbours.
-func (c *gossipChannel) Send(data GossipData) {
+func (c *GossipChannel) Send(data GossipData) {
 	c.relay(c.ourself.Name, data)
 }
 
 // SendDown relays data into the channel topology via conn.
-func (c *gossipChannel) SendDown(conn Connection, data GossipData) {
+func (c *GossipChannel) SendDown(conn Connection, data GossipData) {
+	if c.isClosed() {
+		return
+	}
 	c.senderFor(conn).Send(data)
 }
 
-func (c *gossipChannel) relayUnicast(dstPeerName PeerName, buf []byte) (err error) {
-	if relayPeerName, found := c.routes.UnicastAll(dstPeerName); !found {
-		err = fmt.Errorf("unknown relay destination: %s", dstPeerName)
-	} else if conn, found := c.ourself.ConnectionTo(relayPeerName); !found {
-		err = fmt.Errorf("unable to find connection to relay peer %s", relayPeerName)
-	} else {
-		err = conn.(protocolSender).SendProtocolMsg(protocolMsg{ProtocolGossipUnicast, buf})
+func (c *GossipChannel) relayUnicast(srcName, dstPeerName PeerName, buf []byte) error {
+	return c.relayUnicastMsg(srcName, dstPeerName, protocolMsg{ProtocolGossipUnicast, buf})
+}
+
+// relayUnicastMsg relays m, from srcName, towards dstPeerName.
+func (c *GossipChannel) relayUnicastMsg(srcName, dstPeerName PeerName, m protocolMsg) error {
+	conn, err := c.nextHop(srcName, dstPeerName)
+	if err != nil {
+		return err
+	}
+	return c.sendTo(conn, m, frameRoute{srcName, dstPeerName})
+}
+
+// nextHop returns the connection on the unicast route, from srcName,
+// to dstPeerName.
+func (c *GossipChannel) nextHop(srcName, dstPeerName PeerName) (Connection, error) {
+	relayPeerName, found := c.routes.UnicastAllFlow(dstPeerName, srcName.String()+"/"+c.name)
+	if !found {
+		return nil, unroutableError{fmt.Errorf("unknown relay destination: %s", dstPeerName)}
+	}
+	conn, found := c.ourself.ConnectionTo(relayPeerName)
+	if !found {
+		return nil, unroutableError{fmt.Errorf("unable to find connection to relay peer %s", relayPeerName)}
+	}
+	return conn, nil
+}
+
+// sendTo sends a protocol msg, by route, on conn, subject to the relay
+// policy and the channel's ACL, accounting for the bytes sent,
+// including against the rate limits.
+func (c *GossipChannel) sendTo(conn Connection, m protocolMsg, route frameRoute) error {
+	if !c.ourself.router.allowRelay(conn, c.name, m, route) || !c.allowedBy(m, route, conn.Remote().Name) {
+		return errRelayDenied
+	}
+	err := c.send(conn, m)
+	if err == nil {
+		c.throttle(conn, len(m.msg))
+		c.countSent(len(m.msg))
+	}
+	if err == nil && c.ourself.router != nil {
+		c.ourself.router.bandwidth.sent(conn.Remote().Name, c.name, len(m.msg))
 	}
 	return err
 }
 
-func (c *gossipChannel) relayBroadcast(srcName PeerName, update GossipData) {
+// send sends a protocol msg on conn by the best path it has.
+func (c *GossipChannel) send(conn Connection, m protocolMsg) error {
+	if ds, ok := conn.(datagramSender); ok && c.config.Datagrams && m.tag == ProtocolGossipUnicast && ds.sendDatagram(m) {
+		return nil
+	}
+	if bs, ok := conn.(bulkSender); ok && !internalChannel(c.name) {
+		return bs.sendBulkProtocolMsg(c.name, m)
+	}
+	return conn.(protocolSender).SendProtocolMsg(m)
+}
+
+func (c *GossipChannel) relayBroadcast(srcName PeerName, update GossipData) {
+	c.broadcastTo(c.broadcastConnections(srcName, c.ourself.Name), srcName, update)
+}
+
+// broadcastConnections returns the connections to relay broadcasts
+// from srcName, received from sender, on.
+func (c *GossipChannel) broadcastConnections(srcName, sender PeerName) []Connection {
 	c.routes.ensureRecalculated()
-	for _, conn := range c.ourself.ConnectionsTo(c.routes.BroadcastAll(srcName)) {
+	if c.config.Broadcast != nil {
+		return c.ourself.ConnectionsTo(c.broadcastTargets(srcName, sender))
+	}
+	return c.ourself.ConnectionsTo(c.routes.BroadcastAll(srcName))
+}
+
+func (c *GossipChannel) broadcastTo(conns []Connection, srcName PeerName, update GossipData) {
+	for _, conn := range conns {
 		c.senderFor(conn).Broadcast(srcName, update)
 	}
 }
 
-func (c *gossipChannel) relay(srcName PeerName, data GossipData) {
+func (c *GossipChannel) relay(srcName PeerName, data GossipData) {
+	if c.isClosed() {
+		return
+	}
 	c.routes.ensureRecalculated()
 	for _, conn := range c.ourself.ConnectionsTo(c.routes.randomNeighbours(srcName)) {
 		c.senderFor(conn).Send(data)
 	}
 }
 
-func (c *gossipChannel) senderFor(conn Connection) *gossipSender {
+func (c *GossipChannel) senderFor(conn Connection) *gossipSender {
 	return conn.(gossipConnection).gossipSenders().Sender(c.name, c.makeGossipSender)
 }
 
-func (c *gossipChannel) makeGossipSender(sender protocolSender, stop <-chan struct{}) *gossipSender {
-	return newGossipSender(c.makeMsg, c.makeBroadcastMsg, sender, stop)
+func (c *GossipChannel) makeGossipSender(sender protocolSender, stop <-chan struct{}) *gossipSender {
+	queue := gossipQueue{limit: c.config.QueueLimit, policy: c.config.QueuePolicy}
+	if conn, ok := sender.(Connection); ok {
+		sender = &channelSender{channel: c, conn: conn, stop: stop}
+		if router := c.ourself.router; router != nil {
+			queue.dropped = func() {
+				c.countQueueDropped()
+				router.bandwidth.dropped(conn.Remote().Name, c.name)
+			}
+		}
+	}
+	return newGossipSender(c.makeMsg, c.makeBroadcastMsg, sender, queue, stop)
 }
 
-func (c *gossipChannel) makeMsg(msg []byte) protocolMsg {
-	return protocolMsg{ProtocolGossip, gobEncode(c.name, c.ourself.Name, msg)}
+// channelSender is the protocolSender used by the gossipSenders of a
+// channel; it sends via GossipChannel.sendTo, paced by the rate limits.
+type channelSender struct {
+	channel  *GossipChannel
+	conn     Connection
+	stop     <-chan struct{}
+	transfer bool // of state, paced by Config.StateTransferRateLimit
 }
 
-func (c *gossipChannel) makeBroadcastMsg(srcName PeerName, msg []byte) protocolMsg {
-	return protocolMsg{ProtocolGossipBroadcast, gobEncode(c.name, srcName, msg)}
+// SendProtocolMsg implements ProtocolSender, for msgs originating here.
+func (s *channelSender) SendProtocolMsg(m protocolMsg) error {
+	return s.sendFrom(m, s.channel.ourself.Name)
 }
 
-func (c *gossipChannel) logf(format string, args ...interface{}) {
-	format = "[gossip " + c.name + "]: " + format
-	c.logger.Printf(format, args...)
+// sendFrom sends a msg originating from origin. Messages denied by the
+// relay policy are dropped silently, since an error would stop the
+// gossipSender. While it waits for the rate limits, the gossipSender
+// merges any more gossip into what it has pending.
+func (s *channelSender) sendFrom(m protocolMsg, origin PeerName) error {
+	route := frameRoute{origin: origin}
+	if s.transfer {
+		if !s.channel.paceTransfer(s.conn, s.stop) {
+			return nil
+		}
+		if err := s.channel.sendTransfer(s.conn, m, route); err != errRelayDenied {
+			return err
+		}
+		return nil
+	}
+	if !s.channel.pace(s.conn, s.stop) {
+		return nil
+	}
+	if err := s.channel.sendTo(s.conn, m, route); err != errRelayDenied {
+		return err
+	}
+	return nil
 }
 
-// GobEncode gob-encodes each item and returns the resulting byte slice.
-func gobEncode(items ...interface{}) []byte {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	for _, i := range items {
-		if err := enc.Encode(i); err != nil {
-			panic(err)
-		}
+func (c *GossipChannel) makeMsg(msg []byte) protocolMsg {
+	return protocolMsg{ProtocolGossip, gobEncode(c.name, c.ourself.Name, msg)}
+}
+
+func (c *GossipChannel) makeBroadcastMsg(srcName PeerName, msg []byte, meta gossipFrameMeta) protocolMsg {
+	if meta.empty() {
+		return protocolMsg{ProtocolGossipBroadcast, gobEncode(c.name, srcName, msg)}
 	}
-	return buf.Bytes()
+	return protocolMsg{ProtocolGossipBroadcast, gobEncode(c.name, srcName, msg, meta)}
+}
+
+func (c *GossipChannel) logf(format string, args ...interface{}) {
+	format = "[gossip " + c.name + "]: " + format
+	c.logger.Printf(format, args...)
 }
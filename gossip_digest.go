@@ -0,0 +1,135 @@
+package mesh
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// DigestGossiper is an optional extension of Gossiper for channels whose
+// complete state is large. Rather than periodically sending the whole of
+// Gossip() to neighbours, peers exchange digests summarising their
+// state, and each side then sends the other only what it is missing.
+//
+// Neighbours running a version of mesh without digest support still
+// receive the complete state from Gossip().
+type DigestGossiper interface {
+	Gossiper
+
+	// Digest returns a compact summary of the state, e.g. a version
+	// vector or a set of hashes.
+	Digest() []byte
+
+	// OnDigest is given the digest of the state of the neighbour src,
+	// and returns the data which src is missing, or nil if there is
+	// nothing. The data is delivered to src's OnGossip.
+	OnDigest(src PeerName, digest []byte) (delta GossipData, err error)
+}
+
+// digestConnection is implemented by connections which know whether
+// the remote peer understands ProtocolGossipDigest.
+type digestConnection interface {
+	supportsDigests() bool
+}
+
+func supportsDigests(conn Connection) bool {
+	dc, ok := conn.(digestConnection)
+	return ok && dc.supportsDigests()
+}
+
+// gossipDown sends the complete state of the channel via conn, or just
+// its digest if both we and the remote peer support that.
+func (c *GossipChannel) gossipDown(conn Connection) {
+	if dg, ok := c.gossiper.(DigestGossiper); ok && supportsDigests(conn) {
+		if err := c.sendDigest(conn, dg, false); err != nil {
+			c.logf("unable to send digest to %s: %v", conn.Remote(), err)
+		}
+		return
+	}
+	if gossip := c.gossiper.Gossip(); gossip != nil {
+		c.transferDown(conn, gossip)
+	}
+}
+
+// gossipNeighbours is the periodic counterpart of gossipDown: it sends
+// to random neighbours, and only computes the complete state if one of
+// them needs it.
+func (c *GossipChannel) gossipNeighbours() {
+	dg, digests := c.gossiper.(DigestGossiper)
+	var gossip GossipData
+	c.routes.ensureRecalculated()
+	for _, conn := range c.ourself.ConnectionsTo(c.routes.randomNeighbours(c.ourself.Name)) {
+		if digests && supportsDigests(conn) {
+			if err := c.sendDigest(conn, dg, false); err != nil {
+				c.logf("unable to send digest to %s: %v", conn.Remote(), err)
+			}
+			continue
+		}
+		if gossip == nil {
+			if gossip = c.gossiper.Gossip(); gossip == nil {
+				return
+			}
+		}
+		c.transferDown(conn, gossip)
+	}
+}
+
+// sendDigest sends our digest to conn. reply is set when we are
+// answering the digest of the remote peer, so it shouldn't answer ours.
+func (c *GossipChannel) sendDigest(conn Connection, dg DigestGossiper, reply bool) error {
+	return c.sendTo(conn, protocolMsg{ProtocolGossipDigest, gobEncode(c.name, c.ourself.Name, dg.Digest(), reply)}, frameRoute{origin: c.ourself.Name})
+}
+
+func (c *GossipChannel) deliverDigest(srcName PeerName, _ []byte, dec *gob.Decoder) error {
+	var digest []byte
+	if err := dec.Decode(&digest); err != nil {
+		return err
+	}
+	var reply bool
+	if err := dec.Decode(&reply); err != nil {
+		return err
+	}
+	conn, found := c.ourself.ConnectionTo(srcName)
+	if !found {
+		return fmt.Errorf("received digest from %s, which is not a neighbour", srcName)
+	}
+	dg, ok := c.gossiper.(DigestGossiper)
+	if !ok {
+		if _, surrogate := c.gossiper.(*surrogateGossiper); surrogate {
+			// We have no state to compare, so answer with an empty
+			// digest: the sender then sends us everything, which
+			// we relay onward as we do any other gossip.
+			if reply {
+				return nil
+			}
+			return c.sendTo(conn, protocolMsg{ProtocolGossipDigest, gobEncode(c.name, c.ourself.Name, []byte{}, true)}, frameRoute{origin: c.ourself.Name})
+		}
+		// A Gossiper without digest support can still send
+		// everything.
+		if !reply {
+			c.gossipDown(conn)
+		}
+		return nil
+	}
+	if len(digest) == 0 {
+		// The sender has nothing, or is a surrogate relaying for
+		// peers beyond it, so a delta would not reach them.
+		if gossip := c.gossiper.Gossip(); gossip != nil {
+			c.transferDown(conn, gossip)
+		}
+		if reply {
+			return nil
+		}
+		return c.sendDigest(conn, dg, true)
+	}
+	delta, err := dg.OnDigest(srcName, digest)
+	if err != nil {
+		return err
+	}
+	if delta != nil {
+		c.transferDown(conn, delta)
+	}
+	if reply {
+		return nil
+	}
+	return c.sendDigest(conn, dg, true)
+}
@@ -0,0 +1,104 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// digestGossiper is a testGossiper whose digest is its complete state,
+// counting how often the complete state is asked for.
+type digestGossiper struct {
+	*testGossiper
+	gossips int
+}
+
+func (g *digestGossiper) Gossip() GossipData {
+	g.Lock()
+	g.gossips++
+	g.Unlock()
+	return g.testGossiper.Gossip()
+}
+
+func (g *digestGossiper) Digest() []byte {
+	g.RLock()
+	defer g.RUnlock()
+	var digest []byte
+	for v := range g.state {
+		digest = append(digest, v)
+	}
+	return digest
+}
+
+func (g *digestGossiper) OnDigest(_ PeerName, digest []byte) (GossipData, error) {
+	g.RLock()
+	defer g.RUnlock()
+	has := make(map[byte]struct{})
+	for _, v := range digest {
+		has[v] = struct{}{}
+	}
+	var missing []byte
+	for v := range g.state {
+		if _, found := has[v]; !found {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return newSurrogateGossipData(missing), nil
+}
+
+func TestGossipDigests(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	routers := []*Router{r1, r2}
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+
+	g1 := &digestGossiper{testGossiper: newTestGossiper()}
+	g2 := &digestGossiper{testGossiper: newTestGossiper()}
+	_, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	g1.state[1] = struct{}{}
+	g2.state[2] = struct{}{}
+
+	// a single push-pull exchange initiated by r1 brings both sides
+	// up to date, without either sending its complete state
+	r1.sendAllGossip()
+	sendPendingGossip(routers...)
+	g1.checkHas(t, 1, 2)
+	g2.checkHas(t, 1, 2)
+	require.Equal(t, 0, g1.gossips)
+	require.Equal(t, 0, g2.gossips)
+}
+
+func TestGossipDigestsThroughSurrogate(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	// r2 doesn't host the channel, so relays it via a surrogate
+	g1 := &digestGossiper{testGossiper: newTestGossiper()}
+	g3 := &digestGossiper{testGossiper: newTestGossiper()}
+	_, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+	g1.state[1] = struct{}{}
+	g3.state[3] = struct{}{}
+
+	r1.sendAllGossip()
+	sendPendingGossip(routers...)
+	g3.checkHas(t, 1)
+	r3.sendAllGossip()
+	sendPendingGossip(routers...)
+	g1.checkHas(t, 1, 3)
+	g3.checkHas(t, 1, 3)
+}
@@ -0,0 +1,119 @@
+package mesh
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Peers report at most one error per channel to each origin peer in
+// this interval, so a flood of bad messages doesn't cause a flood of
+// error reports.
+const gossipErrorInterval = time.Second
+
+// Neighbours which advertise this feature understand ProtocolGossipError
+// frames. Those which don't would drop them, so error reports aren't
+// sent or relayed to them.
+const featureGossipErrors = "gossip-errors"
+
+// GossipError reports that a peer dropped, or failed to process, a
+// gossip message originating from us.
+type GossipError struct {
+	Channel string
+	Peer    PeerName // the peer which dropped the message
+	Reason  string
+	// Set when the message was a unicast the peer couldn't relay; see
+	// DeadLetter.
+	Dst     PeerName
+	Payload []byte
+}
+
+func (e *GossipError) Error() string {
+	return fmt.Sprintf("gossip on channel %s dropped by %s: %s", e.Channel, e.Peer, e.Reason)
+}
+
+// GossipErrorHandler is an optional extension of Gossiper, for
+// applications which want to know when their messages are lost, e.g.
+// because there is no route to the destination or the receiving
+// Gossiper returned an error. Reports are best effort, and rate
+// limited.
+type GossipErrorHandler interface {
+	OnGossipError(err *GossipError)
+}
+
+// gossipErrorLimiter rate-limits the error reports sent by a channel.
+type gossipErrorLimiter struct {
+	sync.Mutex
+	lastSent map[PeerName]time.Time
+}
+
+func newGossipErrorLimiter() *gossipErrorLimiter {
+	return &gossipErrorLimiter{lastSent: make(map[PeerName]time.Time)}
+}
+
+func (l *gossipErrorLimiter) allow(origin PeerName, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if last, found := l.lastSent[origin]; found && now.Sub(last) < gossipErrorInterval {
+		return false
+	}
+	l.lastSent[origin] = now
+	return true
+}
+
+func (l *gossipErrorLimiter) forget(origin PeerName) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.lastSent, origin)
+}
+
+// reportError tells the origin of a message we couldn't deliver or
+// process why. Errors are not reported back to ourself.
+func (c *GossipChannel) reportError(origin PeerName, reason error) {
+	if origin == c.ourself.Name || !c.errors.allow(origin, c.clock().Now()) {
+		return
+	}
+	report := GossipError{Channel: c.name, Peer: c.ourself.Name, Reason: reason.Error()}
+	if err := c.relayErrorReport(c.ourself.Name, origin, gobEncode(c.name, c.ourself.Name, origin, report)); err != nil {
+		c.logf("unable to report error to %s: %v", origin, err)
+	}
+}
+
+// relayErrorReport relays an error report, from srcName, towards dst,
+// unless the next hop predates error reports, when it is dropped.
+func (c *GossipChannel) relayErrorReport(srcName, dst PeerName, payload []byte) error {
+	conn, err := c.nextHop(srcName, dst)
+	if err != nil || !supportsFeature(conn, featureGossipErrors) {
+		return err
+	}
+	return c.sendTo(conn, protocolMsg{ProtocolGossipError, payload}, frameRoute{srcName, dst})
+}
+
+// deliverError handles an error report, relaying it if it isn't for us.
+func (c *GossipChannel) deliverError(srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
+	var destName PeerName
+	if err := dec.Decode(&destName); err != nil {
+		return err
+	}
+	if c.ourself.Name != destName {
+		// Failure to relay an error report is not itself reported.
+		if err := c.relayErrorReport(srcName, destName, origPayload); err != nil {
+			c.logf("unable to relay error report: %v", err)
+		}
+		return nil
+	}
+	var report GossipError
+	if err := dec.Decode(&report); err != nil {
+		return err
+	}
+	if report.Dst != UnknownPeerName && c.deliverDeadLetter(&report) {
+		return nil
+	}
+	if handler, ok := c.gossiper.(GossipErrorHandler); ok {
+		handler.OnGossipError(&report)
+	} else {
+		c.logf("%v", &report)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type failingGossiper struct {
+	*testGossiper
+	errors []*GossipError
+}
+
+func (g *failingGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return fmt.Errorf("cannot decode %q", msg)
+}
+
+func (g *failingGossiper) OnGossipError(err *GossipError) {
+	g.errors = append(g.errors, err)
+}
+
+func TestGossipErrorReports(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	g1 := &failingGossiper{testGossiper: newTestGossiper()}
+	s1, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", &failingGossiper{testGossiper: newTestGossiper()})
+	require.NoError(t, err)
+
+	r1.Routes.ensureRecalculated()
+	r2.Routes.ensureRecalculated()
+	r3.Routes.ensureRecalculated()
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte("bad")))
+	require.NotEmpty(t, g1.errors)
+	require.Equal(t, &GossipError{Channel: "Test", Peer: r3.Ourself.Name, Reason: `cannot decode "bad"`}, g1.errors[0])
+
+	// further errors are rate limited
+	reported := len(g1.errors)
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte("bad")))
+	require.Equal(t, reported, len(g1.errors))
+}
+
+func TestGossipErrorReportsOnlyToPeersWhichUnderstandThem(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, []*Router{r1, r2}, r1.tp(r2), r2.tp(r1))
+	r1.Routes.ensureRecalculated()
+	r2.Routes.ensureRecalculated()
+
+	g1 := &failingGossiper{testGossiper: newTestGossiper()}
+	s1, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", &failingGossiper{testGossiper: newTestGossiper()})
+	require.NoError(t, err)
+
+	// r1 predates error reports, so r2 doesn't send them
+	conn, _ := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+	conn.(*mockGossipConnection).legacy = true
+	require.Error(t, s1.GossipUnicast(r2.Ourself.Name, []byte("bad")))
+	require.Empty(t, g1.errors)
+}
+
+func TestDeadLetters(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	var returned []DeadLetter
+	config := GossipChannelConfig{OnDeadLetter: func(letter DeadLetter) {
+		returned = append(returned, letter)
+	}}
+	s1, err := r1.NewGossipChannel("Test", newTestGossiper(), config)
+	require.NoError(t, err)
+	_, err = r2.NewGossipChannel("Test", newTestGossiper(), config)
+	require.NoError(t, err)
+
+	// r2 loses its connection to r3 before r1 hears about it
+	r2.DeleteTestGossipConnection(r3)
+	r2.Routes.ensureRecalculated()
+
+	// unicasts r2 can't relay, even many in quick succession, are all
+	// returned to r1
+	for _, msg := range []string{"one", "two"} {
+		require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte(msg)))
+	}
+	require.Len(t, returned, 2)
+	require.Equal(t, "Test", returned[0].Channel)
+	require.Equal(t, r3.Ourself.Name, returned[0].Dst)
+	require.Equal(t, r2.Ourself.Name, returned[0].Relay)
+	require.Equal(t, []byte("one"), returned[0].Payload)
+	require.Equal(t, []byte("two"), returned[1].Payload)
+	require.NotEmpty(t, returned[0].Reason)
+
+	require.Equal(t, []DeadLetterStats{{Channel: "Test", Dropped: 2}}, r2.DeadLetters())
+	require.Equal(t, []DeadLetterStats{{Channel: "Test", Returned: 2}}, r1.DeadLetters())
+}
@@ -0,0 +1,239 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOrderTimeout = 1 * time.Second
+	maxMissedRanges     = 64
+)
+
+// broadcastOrdering stamps the broadcasts we originate on an ordered
+// channel with sequence numbers, and holds back received broadcasts
+// until those preceding them from the same origin have been delivered.
+type broadcastOrdering struct {
+	sync.Mutex
+	channel *GossipChannel
+	epoch   uint64
+	seq     uint64
+	origins map[PeerName]*originOrdering
+}
+
+// Delivery state for broadcasts from one origin.
+type originOrdering struct {
+	epoch   uint64
+	next    uint64 // sequence number we expect next
+	base    uint64 // sequence number of the first broadcast we received
+	floor   uint64 // below which we no longer know what was missed
+	missed  []seqRange
+	pending []orderedFrame
+	timer   Timer
+}
+
+// A range of sequence numbers below next which weren't delivered,
+// either because they preceded base, or because we gave up waiting
+// for them.
+type seqRange struct {
+	first, last uint64
+}
+
+type orderedFrame struct {
+	payload []byte
+	meta    gossipFrameMeta
+}
+
+func newBroadcastOrdering(channel *GossipChannel) *broadcastOrdering {
+	return &broadcastOrdering{
+		channel: channel,
+		epoch:   channel.ourself.router.rng().Uint64() | 1, // zero means unordered
+		origins: make(map[PeerName]*originOrdering),
+	}
+}
+
+func (o *broadcastOrdering) timeout() time.Duration {
+	if o.channel.config.OrderTimeout > 0 {
+		return o.channel.config.OrderTimeout
+	}
+	return defaultOrderTimeout
+}
+
+func (o *broadcastOrdering) nextSeq() (epoch, seq uint64) {
+	o.Lock()
+	defer o.Unlock()
+	o.seq++
+	return o.epoch, o.seq
+}
+
+// receive delivers the broadcast from src if it is next in sequence,
+// along with any held back broadcasts it unblocks. Broadcasts which
+// are ahead of the sequence are held back for up to the order timeout,
+// and stale ones are dropped, and only acknowledged if they were
+// delivered. Those sent before the first broadcast we received from
+// the origin are delivered late, since no order was promised them. The
+// lock is held during delivery so that
+// deliveries from an origin cannot overtake one another.
+func (o *broadcastOrdering) receive(src PeerName, payload []byte, meta gossipFrameMeta) error {
+	o.Lock()
+	defer o.Unlock()
+	origin, found := o.origins[src]
+	if !found || origin.epoch != meta.SeqEpoch {
+		// First we've heard from this incarnation of the origin, so
+		// we can only start from here.
+		if found && origin.timer != nil {
+			origin.timer.Stop()
+		}
+		origin = &originOrdering{epoch: meta.SeqEpoch, next: meta.SeqFirst, base: meta.SeqFirst}
+		if meta.SeqFirst > 1 {
+			origin.miss(seqRange{1, meta.SeqFirst - 1})
+		}
+		o.origins[src] = origin
+	}
+	switch {
+	case meta.SeqLast < origin.base:
+		// Sent before the first broadcast we received, and overtaken
+		// by it, so it can't be delivered in order; deliver it
+		// anyway, unless it already has been.
+		if origin.delivered(meta.SeqFirst, meta.SeqLast) {
+			o.channel.sendAcks(src, meta.MsgIDs)
+			return nil
+		}
+		if meta.SeqFirst < origin.floor {
+			return nil
+		}
+		origin.recover(meta.SeqFirst, meta.SeqLast)
+		return o.channel.deliverBroadcastPayload(src, payload, meta)
+	case meta.SeqLast < origin.next:
+		// Stale. Acknowledge it if we did deliver it; if we gave up
+		// waiting for it, delivering it now would be out of order.
+		if origin.delivered(meta.SeqFirst, meta.SeqLast) {
+			o.channel.sendAcks(src, meta.MsgIDs)
+		}
+		return nil
+	case meta.SeqFirst > origin.next:
+		origin.pending = append(origin.pending, orderedFrame{payload, meta})
+		sort.Slice(origin.pending, func(i, j int) bool {
+			return origin.pending[i].meta.SeqFirst < origin.pending[j].meta.SeqFirst
+		})
+		o.waitForGap(src, origin)
+		return nil
+	}
+	if err := o.deliver(src, origin, orderedFrame{payload, meta}); err != nil {
+		return err
+	}
+	return o.deliverPending(src, origin)
+}
+
+// skipGap gives up waiting for missing broadcasts from src, delivering
+// held back broadcasts from the earliest one onwards.
+func (o *broadcastOrdering) skipGap(src PeerName, epoch uint64) {
+	o.Lock()
+	defer o.Unlock()
+	origin, found := o.origins[src]
+	if !found || origin.epoch != epoch {
+		return
+	}
+	origin.timer = nil
+	if len(origin.pending) == 0 {
+		return
+	}
+	o.channel.logf("gave up waiting for broadcasts %d to %d from %s", origin.next, origin.pending[0].meta.SeqFirst-1, src)
+	origin.miss(seqRange{origin.next, origin.pending[0].meta.SeqFirst - 1})
+	origin.next = origin.pending[0].meta.SeqFirst
+	if err := o.deliverPending(src, origin); err != nil {
+		o.channel.logf("%v", err)
+	}
+}
+
+func (o *broadcastOrdering) deliverPending(src PeerName, origin *originOrdering) error {
+	for len(origin.pending) > 0 && origin.pending[0].meta.SeqFirst <= origin.next {
+		frame := origin.pending[0]
+		origin.pending = origin.pending[1:]
+		if frame.meta.SeqLast < origin.next {
+			continue
+		}
+		if err := o.deliver(src, origin, frame); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(origin.pending) > 0:
+		o.waitForGap(src, origin)
+	case origin.timer != nil:
+		origin.timer.Stop()
+		origin.timer = nil
+	}
+	return nil
+}
+
+// waitForGap arranges to skip the gap before the held back broadcasts
+// from src if it hasn't been filled by the time the order timeout
+// elapses.
+func (o *broadcastOrdering) waitForGap(src PeerName, origin *originOrdering) {
+	if origin.timer == nil {
+		epoch := origin.epoch
+		origin.timer = o.channel.ourself.router.clock().AfterFunc(o.timeout(), func() { o.skipGap(src, epoch) })
+	}
+}
+
+func (o *broadcastOrdering) deliver(src PeerName, origin *originOrdering, frame orderedFrame) error {
+	origin.next = frame.meta.SeqLast + 1
+	return o.channel.deliverBroadcastPayload(src, frame.payload, frame.meta)
+}
+
+// miss records that the broadcasts in r won't be delivered in order,
+// forgetting the oldest such range once there are too many.
+func (origin *originOrdering) miss(r seqRange) {
+	origin.missed = append(origin.missed, r)
+	if len(origin.missed) > maxMissedRanges {
+		origin.floor = origin.missed[0].last + 1
+		origin.missed = origin.missed[1:]
+	}
+}
+
+// recover records the late delivery of the broadcasts from first to
+// last, all of which precede base.
+func (origin *originOrdering) recover(first, last uint64) {
+	var missed []seqRange
+	for _, r := range origin.missed {
+		if r.last < first || r.first > last {
+			missed = append(missed, r)
+			continue
+		}
+		if r.first < first {
+			missed = append(missed, seqRange{r.first, first - 1})
+		}
+		if r.last > last {
+			missed = append(missed, seqRange{last + 1, r.last})
+		}
+	}
+	origin.missed = missed
+}
+
+// delivered returns whether all of the broadcasts from first to last,
+// none of which are ahead of next, have been delivered.
+func (origin *originOrdering) delivered(first, last uint64) bool {
+	if first < origin.floor {
+		return false
+	}
+	for _, r := range origin.missed {
+		if r.first <= last && first <= r.last {
+			return false
+		}
+	}
+	return true
+}
+
+// forget discards the delivery state for an origin which has departed.
+func (o *broadcastOrdering) forget(src PeerName) {
+	o.Lock()
+	defer o.Unlock()
+	if origin, found := o.origins[src]; found {
+		if origin.timer != nil {
+			origin.timer.Stop()
+		}
+		delete(o.origins, src)
+	}
+}
@@ -0,0 +1,98 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingGossiper struct {
+	sync.Mutex
+	testGossiper
+	broadcasts []byte
+}
+
+func (g *recordingGossiper) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	g.Lock()
+	defer g.Unlock()
+	g.broadcasts = append(g.broadcasts, update...)
+	return nil, nil
+}
+
+func (g *recordingGossiper) received() []byte {
+	g.Lock()
+	defer g.Unlock()
+	return append([]byte{}, g.broadcasts...)
+}
+
+func TestGossipOrderedDelivery(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	g := &recordingGossiper{}
+	c, err := r.NewGossipChannel("Ordered", g, GossipChannelConfig{Ordered: true, OrderTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	src := PeerName(2)
+	receive := func(epoch, first, last uint64, payload ...byte) {
+		require.NoError(t, c.ordering.receive(src, payload, gossipFrameMeta{SeqEpoch: epoch, SeqFirst: first, SeqLast: last}))
+	}
+
+	// The first frame from an origin sets the expected sequence
+	receive(7, 10, 10, 10)
+	// Out of order frames are held back until the gap is filled,
+	// including by frames covering a range of sequence numbers
+	receive(7, 13, 13, 13)
+	receive(7, 11, 12, 11, 12)
+	require.Equal(t, []byte{10, 11, 12, 13}, g.received())
+	// Stale frames are dropped
+	receive(7, 12, 12, 12)
+	require.Equal(t, []byte{10, 11, 12, 13}, g.received())
+
+	// Gaps which aren't filled in time are skipped
+	receive(7, 16, 16, 16)
+	receive(7, 15, 15, 15)
+	require.Equal(t, []byte{10, 11, 12, 13}, g.received())
+	require.Eventually(t, func() bool { return len(g.received()) == 6 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []byte{10, 11, 12, 13, 15, 16}, g.received())
+
+	// A restarted origin starts a new sequence
+	receive(8, 1, 1, 1)
+	require.Equal(t, []byte{10, 11, 12, 13, 15, 16, 1}, g.received())
+}
+
+func TestGossipOrderedFirstContact(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	g := &recordingGossiper{}
+	c, err := r.NewGossipChannel("Ordered", g, GossipChannelConfig{Ordered: true, OrderTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	src := PeerName(2)
+	receive := func(first, last uint64, payload ...byte) {
+		require.NoError(t, c.ordering.receive(src, payload, gossipFrameMeta{SeqEpoch: 7, SeqFirst: first, SeqLast: last}))
+	}
+	delivered := func(first, last uint64) bool {
+		c.ordering.Lock()
+		defer c.ordering.Unlock()
+		return c.ordering.origins[src].delivered(first, last)
+	}
+
+	// A broadcast overtaken by the first we receive is still
+	// delivered, though late, and only once
+	receive(2, 2, 2)
+	require.False(t, delivered(1, 1))
+	receive(1, 1, 1)
+	require.Equal(t, []byte{2, 1}, g.received())
+	require.True(t, delivered(1, 2))
+	receive(1, 1, 1)
+	require.Equal(t, []byte{2, 1}, g.received())
+
+	// One we gave up waiting for is neither delivered out of order,
+	// nor counted as delivered
+	receive(4, 4, 4)
+	require.Eventually(t, func() bool { return len(g.received()) == 3 }, time.Second, 10*time.Millisecond)
+	receive(3, 3, 3)
+	require.Equal(t, []byte{2, 1, 4}, g.received())
+	require.False(t, delivered(3, 3))
+	require.True(t, delivered(4, 4))
+}
@@ -0,0 +1,103 @@
+package mesh
+
+// QueuePolicy says what a gossip sender does with an update when its
+// queue is full; see GossipChannelConfig.QueueLimit.
+type QueuePolicy int
+
+const (
+	// QueueCoalesce merges the update into the newest one pending from
+	// the same origin, or queues it anyway if there is none, so the
+	// queue holds at most one more update per origin than the limit.
+	// It relies on GossipData.Merge to bound the size of the data.
+	QueueCoalesce QueuePolicy = iota
+	// QueueDropOldest discards the oldest pending update.
+	QueueDropOldest
+	// QueueDropNewest discards the update.
+	QueueDropNewest
+	// QueueBlock makes Send, Broadcast etc. wait for room, so a slow
+	// neighbour holds up the callers, including the relaying of other
+	// peers' broadcasts.
+	QueueBlock
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueCoalesce:
+		return "coalesce"
+	case QueueDropOldest:
+		return "drop-oldest"
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// gossipQueue bounds the updates pending in a gossipSender.
+type gossipQueue struct {
+	limit   int
+	policy  QueuePolicy
+	dropped func() // called for each update discarded
+}
+
+func (q gossipQueue) drop() {
+	if q.dropped != nil {
+		q.dropped()
+	}
+}
+
+// pendingGossip is an update waiting to be sent. Updates in the same
+// bucket, i.e. gossip, or broadcasts from one origin, are merged when
+// they are sent.
+type pendingGossip struct {
+	broadcast bool
+	srcName   PeerName
+	data      GossipData
+}
+
+func (p pendingGossip) sameBucket(other pendingGossip) bool {
+	return p.broadcast == other.broadcast && p.srcName == other.srcName
+}
+
+func (s *gossipSender) enqueue(p pendingGossip) {
+	s.Lock()
+	defer s.Unlock()
+	defer s.prod()
+	if s.queue.limit <= 0 {
+		s.coalesce(p)
+		return
+	}
+	for len(s.pending) >= s.queue.limit {
+		switch s.queue.policy {
+		case QueueDropNewest:
+			s.queue.drop()
+			return
+		case QueueDropOldest:
+			s.pending[0] = pendingGossip{}
+			s.pending = s.pending[1:]
+			s.queue.drop()
+		case QueueBlock:
+			if s.stopped {
+				return
+			}
+			s.room.Wait()
+		default:
+			s.coalesce(p)
+			return
+		}
+	}
+	s.pending = append(s.pending, p)
+}
+
+// coalesce merges the update into the newest pending one in its
+// bucket, or queues it if there is none.
+func (s *gossipSender) coalesce(p pendingGossip) {
+	for i := len(s.pending) - 1; i >= 0; i-- {
+		if s.pending[i].sameBucket(p) {
+			s.pending[i].data = mergeGossipData(s.pending[i].data, p.data)
+			return
+		}
+	}
+	s.pending = append(s.pending, p)
+}
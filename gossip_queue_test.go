@@ -0,0 +1,84 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stalledSender holds up every message until released, like a slow
+// neighbour.
+type stalledSender struct {
+	sync.Mutex
+	started chan struct{}
+	release chan struct{}
+	msgs    []string
+}
+
+func (s *stalledSender) SendProtocolMsg(m protocolMsg) error {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+	<-s.release
+	s.Lock()
+	defer s.Unlock()
+	s.msgs = append(s.msgs, string(m.msg))
+	return nil
+}
+
+// testQueuePolicy stalls a sender while send queues more updates, then
+// checks what was sent; send can return a function to wait for, once
+// the sender resumes.
+func testQueuePolicy(t *testing.T, policy QueuePolicy, limit int, send func(*gossipSender) func(), wantDropped int, want ...string) {
+	stop := make(chan struct{})
+	defer close(stop)
+	sender := &stalledSender{started: make(chan struct{}, 1), release: make(chan struct{})}
+	dropped := 0
+	makeMsg := func(msg []byte) protocolMsg { return protocolMsg{ProtocolGossip, msg} }
+	makeBroadcastMsg := func(_ PeerName, msg []byte, _ gossipFrameMeta) protocolMsg { return makeMsg(msg) }
+	s := newGossipSender(makeMsg, makeBroadcastMsg, sender, gossipQueue{limit, policy, func() { dropped++ }}, stop)
+
+	// the first update is taken straight away, then the sender stalls
+	s.Send(newSurrogateGossipData([]byte("a")))
+	<-sender.started
+	wait := send(s)
+	close(sender.release)
+	if wait != nil {
+		wait()
+	}
+	s.Flush()
+	require.Equal(t, wantDropped, dropped, policy.String())
+	require.Equal(t, want, sender.msgs, policy.String())
+}
+
+func TestGossipQueuePolicies(t *testing.T) {
+	sendBCD := func(s *gossipSender) func() {
+		for _, v := range []string{"b", "c", "d"} {
+			s.Send(newSurrogateGossipData([]byte(v)))
+		}
+		return nil
+	}
+	testQueuePolicy(t, QueueDropOldest, 2, sendBCD, 1, "a", "c", "d")
+	testQueuePolicy(t, QueueDropNewest, 2, sendBCD, 1, "a", "b", "c")
+	testQueuePolicy(t, QueueCoalesce, 1, sendBCD, 0, "a", "b", "c", "d")
+	testQueuePolicy(t, QueueCoalesce, 0, sendBCD, 0, "a", "b", "c", "d")
+
+	// a blocked caller waits until there is room
+	testQueuePolicy(t, QueueBlock, 1, func(s *gossipSender) func() {
+		s.Send(newSurrogateGossipData([]byte("b")))
+		done := make(chan struct{})
+		go func() {
+			s.Send(newSurrogateGossipData([]byte("c")))
+			close(done)
+		}()
+		select {
+		case <-done:
+			require.FailNow(t, "send should block while the queue is full")
+		case <-time.After(20 * time.Millisecond):
+		}
+		return func() { <-done }
+	}, 0, "a", "b", "c")
+}
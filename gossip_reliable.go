@@ -0,0 +1,229 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How long we wait for a peer to acknowledge a reliable broadcast
+	// before retransmitting it to that peer; the wait doubles with each
+	// retransmission to the peer, up to reliableMaxRetransmitInterval.
+	reliableRetransmitInterval    = 2 * time.Second
+	reliableMaxRetransmitInterval = 30 * time.Second
+)
+
+// BroadcastResult reports the outcome of a reliable broadcast.
+type BroadcastResult struct {
+	// Acked holds the peers which acknowledged delivery.
+	Acked []PeerName
+	// Missing holds the peers which were still known, but had not
+	// acknowledged delivery, when the deadline passed.
+	Missing []PeerName
+}
+
+// Complete returns true if every peer acknowledged the broadcast.
+func (res BroadcastResult) Complete() bool {
+	return len(res.Missing) == 0
+}
+
+// An in-flight reliable broadcast.
+type reliableBroadcast struct {
+	data     GossipData
+	pending  peerNameSet
+	acked    peerNameSet
+	retries  map[PeerName]reliableRetry // of the pending peers
+	deadline time.Time
+	timer    Timer
+	done     func(BroadcastResult)
+}
+
+// reliableRetry is when a reliable broadcast is next retransmitted to a
+// peer which hasn't acknowledged it, and how often it has been.
+type reliableRetry struct {
+	due     time.Time
+	retries uint
+}
+
+// next returns the retry following r, made at now.
+func (r reliableRetry) next(now time.Time) reliableRetry {
+	interval := reliableRetransmitInterval << (r.retries + 1)
+	if interval > reliableMaxRetransmitInterval || interval <= 0 {
+		interval = reliableMaxRetransmitInterval
+	}
+	return reliableRetry{due: now.Add(interval), retries: r.retries + 1}
+}
+
+func (rb *reliableBroadcast) result() BroadcastResult {
+	return BroadcastResult{Acked: sortedPeerNames(rb.acked), Missing: sortedPeerNames(rb.pending)}
+}
+
+// reliableBroadcasts tracks the in-flight reliable broadcasts of a
+// channel, keyed by message ID.
+type reliableBroadcasts struct {
+	sync.Mutex
+	byID map[uint64]*reliableBroadcast
+}
+
+func newReliableBroadcasts() *reliableBroadcasts {
+	return &reliableBroadcasts{byID: make(map[uint64]*reliableBroadcast)}
+}
+
+// GossipBroadcastReliable relays update to all members of the channel,
+// like GossipBroadcast, but additionally tracks which peers acknowledge
+// delivery. Peers which haven't acknowledged the update, e.g. because a
+// connection flapped while it was in flight, have it retransmitted
+// periodically. done is invoked once all currently known peers have
+// acknowledged the update, or once timeout has elapsed, whichever comes
+// first.
+//
+// Peers which haven't registered the channel, or which run a version
+// of mesh without support for reliable broadcast, never acknowledge.
+func (c *GossipChannel) GossipBroadcastReliable(update GossipData, timeout time.Duration, done func(BroadcastResult)) {
+	id := c.ourself.router.rng().Uint64()
+	rb := &reliableBroadcast{
+		data:     update,
+		pending:  make(peerNameSet),
+		acked:    make(peerNameSet),
+		retries:  make(map[PeerName]reliableRetry),
+		deadline: c.clock().Now().Add(timeout),
+		done:     done,
+	}
+	firstRetry := reliableRetry{due: c.clock().Now().Add(reliableRetransmitInterval)}
+	for name := range c.routes.PeerNames() {
+		if name != c.ourself.Name {
+			rb.pending[name] = struct{}{}
+			rb.retries[name] = firstRetry
+		}
+	}
+	if len(rb.pending) == 0 || c.isClosed() {
+		done(rb.result())
+		return
+	}
+	c.reliable.Lock()
+	c.reliable.byID[id] = rb
+	rb.timer = c.clock().AfterFunc(rb.nextCheck(c.clock().Now()), func() { c.checkReliable(id) })
+	c.reliable.Unlock()
+
+	meta := gossipFrameMeta{MsgIDs: []uint64{id}}
+	span := c.traceOrigin(spanBroadcast, UnknownPeerName, &meta)
+	c.relayBroadcast(c.ourself.Name, c.stampBroadcast(update, meta))
+	span.End(nil)
+}
+
+// nextCheck returns how long after now the broadcast is next due to be
+// retransmitted to any of the pending peers, or its deadline passes.
+func (rb *reliableBroadcast) nextCheck(now time.Time) time.Duration {
+	next := rb.deadline
+	for name := range rb.pending {
+		if due := rb.retries[name].due; due.Before(next) {
+			next = due
+		}
+	}
+	return next.Sub(now)
+}
+
+// checkReliable completes the reliable broadcast with the given id if
+// its deadline has passed, or otherwise retransmits it to the peers
+// which haven't acknowledged it yet and are due a retransmission.
+func (c *GossipChannel) checkReliable(id uint64) {
+	known := c.routes.PeerNames()
+	c.reliable.Lock()
+	rb, found := c.reliable.byID[id]
+	if !found {
+		c.reliable.Unlock()
+		return
+	}
+	// Peers which have departed since we started the broadcast
+	// will never acknowledge it.
+	for name := range rb.pending {
+		if _, found := known[name]; !found {
+			delete(rb.pending, name)
+			delete(rb.retries, name)
+		}
+	}
+	now := c.clock().Now()
+	if len(rb.pending) == 0 || !now.Before(rb.deadline) {
+		delete(c.reliable.byID, id)
+		c.reliable.Unlock()
+		rb.done(rb.result())
+		return
+	}
+	var due []PeerName
+	for _, name := range sortedPeerNames(rb.pending) {
+		if retry := rb.retries[name]; !now.Before(retry.due) {
+			due = append(due, name)
+			rb.retries[name] = retry.next(now)
+		}
+	}
+	rb.timer.Reset(rb.nextCheck(now))
+	c.reliable.Unlock()
+
+	meta := gossipFrameMeta{MsgIDs: []uint64{id}, Retransmit: true}
+	for _, dst := range due {
+		for _, msg := range rb.data.Encode() {
+			if err := c.relayUnicast(c.ourself.Name, dst, gobEncode(c.name, c.ourself.Name, dst, msg, meta)); err != nil {
+				c.logf("unable to retransmit broadcast to %s: %v", dst, err)
+			}
+		}
+	}
+}
+
+// ackReliable records that src has acknowledged the reliable broadcasts
+// with the given ids.
+func (c *GossipChannel) ackReliable(src PeerName, ids []uint64) {
+	var completed []*reliableBroadcast
+	c.reliable.Lock()
+	for _, id := range ids {
+		rb, found := c.reliable.byID[id]
+		if !found {
+			continue
+		}
+		if _, found := rb.pending[src]; !found {
+			continue
+		}
+		delete(rb.pending, src)
+		delete(rb.retries, src)
+		rb.acked[src] = struct{}{}
+		if len(rb.pending) == 0 {
+			rb.timer.Stop()
+			delete(c.reliable.byID, id)
+			completed = append(completed, rb)
+		}
+	}
+	c.reliable.Unlock()
+	for _, rb := range completed {
+		rb.done(rb.result())
+	}
+}
+
+// sendAcks acknowledges receipt of the reliable broadcasts with the
+// given ids to their origin.
+func (c *GossipChannel) sendAcks(origin PeerName, ids []uint64) {
+	if len(ids) == 0 || origin == c.ourself.Name {
+		return
+	}
+	if _, surrogate := c.gossiper.(*surrogateGossiper); surrogate {
+		return
+	}
+	c.acknowledge(origin, ids)
+}
+
+// acknowledge sends an acknowledgement of the frames with the given ids
+// to their origin.
+func (c *GossipChannel) acknowledge(origin PeerName, ids []uint64) {
+	meta := gossipFrameMeta{Acks: ids}
+	if err := c.relayUnicast(c.ourself.Name, origin, gobEncode(c.name, c.ourself.Name, origin, []byte(nil), meta)); err != nil {
+		c.logf("unable to acknowledge gossip from %s: %v", origin, err)
+	}
+}
+
+func sortedPeerNames(names peerNameSet) []PeerName {
+	slice := make([]PeerName, 0, len(names))
+	for name := range names {
+		slice = append(slice, name)
+	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i] < slice[j] })
+	return slice
+}
@@ -0,0 +1,54 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+)
+
+// The weight of each tick in the smoothed load of a channel: the load
+// follows a new level of traffic within a few ticks.
+const gossipLoadSmoothing = 4
+
+// gossipScheduler decides the order in which channels are serviced on
+// each tick of the periodic gossip. Channels which have lately sent the
+// fewest bytes go first, so a chatty channel can't monopolise the early
+// slots; channels with equal loads, e.g. idle ones, are shuffled, so
+// none of them is always first.
+type gossipScheduler struct {
+	sync.Mutex
+	lastSent map[string]uint64  // bytes sent by each channel, as of the previous tick
+	load     map[string]float64 // smoothed bytes sent by each channel per tick
+	rng      Rand               // to break ties
+}
+
+func newGossipScheduler(rng Rand) *gossipScheduler {
+	return &gossipScheduler{lastSent: make(map[string]uint64), load: make(map[string]float64), rng: rng}
+}
+
+// order accounts for the bytes each channel has sent since the previous
+// tick, given the totals sent so far, and returns the channels in the
+// order to service them.
+func (s *gossipScheduler) order(channels map[*GossipChannel]struct{}, sent map[string]uint64) []*GossipChannel {
+	s.Lock()
+	defer s.Unlock()
+	ordered := make([]*GossipChannel, 0, len(channels))
+	lastSent := make(map[string]uint64, len(channels))
+	load := make(map[string]float64, len(channels))
+	for channel := range channels {
+		var delta uint64
+		// totals drop when peers are forgotten
+		if total, last := sent[channel.name], s.lastSent[channel.name]; total > last {
+			delta = total - last
+		}
+		lastSent[channel.name] = sent[channel.name]
+		load[channel.name] = s.load[channel.name] + (float64(delta)-s.load[channel.name])/gossipLoadSmoothing
+		ordered = append(ordered, channel)
+	}
+	s.lastSent, s.load = lastSent, load
+
+	s.rng.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return load[ordered[i].name] < load[ordered[j].name]
+	})
+	return ordered
+}
@@ -0,0 +1,38 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipScheduleOrder(t *testing.T) {
+	chatty := &GossipChannel{name: "chatty"}
+	quiet := &GossipChannel{name: "quiet"}
+	idle := &GossipChannel{name: "idle"}
+	channels := map[*GossipChannel]struct{}{chatty: {}, quiet: {}, idle: {}}
+	s := newGossipScheduler(defaultRand{})
+
+	// the chatty channel is serviced last; the others share the
+	// first slot, while they are equally loaded
+	sent := make(map[string]uint64)
+	first := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		ordered := s.order(channels, sent)
+		require.Len(t, ordered, 3)
+		if i > 0 {
+			require.Equal(t, chatty, ordered[2])
+			first[ordered[0].name]++
+		}
+		sent["chatty"] += 10000
+	}
+	require.True(t, first["quiet"] > 0 && first["idle"] > 0)
+
+	// a channel which starts sending falls behind the idle one
+	for i := 0; i < 5; i++ {
+		sent["quiet"] += 100
+		s.order(channels, sent)
+	}
+	ordered := s.order(channels, sent)
+	require.Equal(t, []*GossipChannel{idle, quiet, chatty}, ordered)
+}
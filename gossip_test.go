@@ -7,6 +7,7 @@ import (
 	"math"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -19,13 +20,18 @@ type mockGossipConnection struct {
 	dest    *Router
 	senders *gossipSenders
 	start   chan struct{}
+	legacy  bool
 }
 
 var _ gossipConnection = &mockGossipConnection{}
 
 func newTestRouter(t *testing.T, name string) *Router {
+	return newTestRouterWithConfig(t, name, Config{})
+}
+
+func newTestRouterWithConfig(t *testing.T, name string, config Config) *Router {
 	peerName, _ := PeerNameFromString(name)
-	router, err := NewRouter(Config{}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	router, err := NewRouter(config, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
 	require.NoError(t, err)
 	router.Start()
 	return router
@@ -48,13 +54,23 @@ func (conn *mockGossipConnection) logf(format string, args ...interface{}) {
 
 func (conn *mockGossipConnection) SendProtocolMsg(pm protocolMsg) error {
 	<-conn.start
-	return conn.dest.handleGossip(pm.tag, pm.msg)
+	return conn.dest.handleGossip(conn.local.Name, pm.tag, pm.msg)
 }
 
 func (conn *mockGossipConnection) gossipSenders() *gossipSenders {
 	return conn.senders
 }
 
+func (conn *mockGossipConnection) supportsDigests() bool {
+	return true
+}
+
+// SupportsFeature returns true for every feature, unless the remote
+// peer is made to predate them all.
+func (conn *mockGossipConnection) SupportsFeature(name string) bool {
+	return !conn.legacy
+}
+
 func (conn *mockGossipConnection) Start() {
 	close(conn.start)
 }
@@ -309,3 +325,161 @@ func TestRandomNeighbours(t *testing.T) {
 		})
 	}
 }
+
+func TestGossipBroadcastReliable(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	// every peer has a gossiper on the channel, so all acknowledge
+	g3 := newTestGossiper()
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	results := make(chan BroadcastResult, 1)
+	s1.(*GossipChannel).GossipBroadcastReliable(newSurrogateGossipData([]byte{1}), time.Minute, func(res BroadcastResult) { results <- res })
+	sendPendingGossip(routers...)
+	res := <-results
+	require.True(t, res.Complete())
+	require.Equal(t, []PeerName{r2.Ourself.Name, r3.Ourself.Name}, res.Acked)
+	g3.checkHas(t, 1)
+
+	// r3 has no gossiper on this channel, so never acknowledges
+	p1, err := r1.NewGossip("Partial", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Partial", newTestGossiper())
+	require.NoError(t, err)
+
+	p1.(*GossipChannel).GossipBroadcastReliable(newSurrogateGossipData([]byte{2}), 50*time.Millisecond, func(res BroadcastResult) { results <- res })
+	sendPendingGossip(routers...)
+	res = <-results
+	require.False(t, res.Complete())
+	require.Equal(t, []PeerName{r2.Ourself.Name}, res.Acked)
+	require.Equal(t, []PeerName{r3.Ourself.Name}, res.Missing)
+}
+
+func TestGossipBroadcastReliableRetransmits(t *testing.T) {
+	// create the topology r2 <-> r1 <-> r3, where r1 drops the first
+	// broadcast it sends to r3
+	r3Name, _ := PeerNameFromString("03:00:00:03:00:00")
+	var lock sync.Mutex
+	sent := make(map[PeerName]int)
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{RelayPolicy: func(req RelayRequest) bool {
+		if req.Channel != "Test" {
+			return true
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		sent[req.NextHop]++
+		return req.NextHop != r3Name || sent[req.NextHop] > 1
+	}})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1), r3.tp(r1))
+
+	g3 := newTestGossiper()
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	results := make(chan BroadcastResult, 1)
+	s1.(*GossipChannel).GossipBroadcastReliable(newSurrogateGossipData([]byte{1}), time.Minute, func(res BroadcastResult) { results <- res })
+	sendPendingGossip(routers...)
+	g3.RLock()
+	require.NotContains(t, g3.state, byte(1))
+	g3.RUnlock()
+
+	// only r3, which didn't acknowledge, has the broadcast retransmitted
+	var res BroadcastResult
+	select {
+	case res = <-results:
+	case <-time.After(2 * reliableRetransmitInterval):
+		require.FailNow(t, "broadcast not retransmitted")
+	}
+	require.True(t, res.Complete())
+	g3.checkHas(t, 1)
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, map[PeerName]int{r2.Ourself.Name: 1, r3Name: 2}, sent)
+}
+
+func TestReliableRetryBackoff(t *testing.T) {
+	now := time.Now()
+	retry := reliableRetry{due: now}
+	var waits []time.Duration
+	for i := 0; i < 6; i++ {
+		retry = retry.next(now)
+		waits = append(waits, retry.due.Sub(now))
+	}
+	require.Equal(t, []time.Duration{4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second}, waits)
+}
+
+func TestRandomNeighboursFanout(t *testing.T) {
+	r := routes{unicastAll: unicastRoutes{PeerName(0): UnknownPeerName}, fanout: 3}
+	for i := 1; i < 100; i++ {
+		r.unicastAll[PeerName(i)] = PeerName(i)
+	}
+	require.Len(t, r.randomNeighbours(PeerName(0)), 3)
+	r.fanout = 200
+	require.Len(t, r.randomNeighbours(PeerName(0)), 99)
+}
+
+func TestGossipRelayPolicy(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3, where r2 refuses to let
+	// the "Secret" channel leave r1 and r2
+	r3Name, _ := PeerNameFromString("03:00:00:03:00:00")
+	var denied []RelayRequest
+	var lock sync.Mutex
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{RelayPolicy: func(req RelayRequest) bool {
+		if req.Channel == "Secret" && req.NextHop == r3Name {
+			lock.Lock()
+			denied = append(denied, req)
+			lock.Unlock()
+			return false
+		}
+		return true
+	}})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	g2, g3 := newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewGossip("Secret", newTestGossiper())
+	require.NoError(t, err)
+	s2, err := r2.NewGossip("Secret", g2)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Secret", g3)
+	require.NoError(t, err)
+
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 1)
+	require.Empty(t, g3.state)
+	require.Len(t, denied, 1)
+	require.Equal(t, RelayRequest{Channel: "Secret", Origin: r1.Ourself.Name, NextHop: r3Name, Size: denied[0].Size}, denied[0])
+
+	// unicasts relayed via r2 are dropped too, and ones originating
+	// there fail outright
+	require.NoError(t, s1.GossipUnicast(r3Name, []byte{2}))
+	require.Len(t, denied, 2)
+	require.Equal(t, r3Name, denied[1].Destination)
+	require.Equal(t, errRelayDenied, s2.GossipUnicast(r3Name, []byte{3}))
+}
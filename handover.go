@@ -0,0 +1,95 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+)
+
+// Handover is what a standby process needs to take over from an active
+// peer without appearing to the mesh as a new peer: the active peer's
+// identity, the key pair unicasts to it are sealed with, and the
+// complete state of its channels. The active peer's router gives it by
+// Router.Handover, which the application should send to the standby
+// whenever the state changes, or periodically, keeping it warm; the
+// standby takes over with NewRouterFromHandover once the active peer has
+// stopped. The active and standby peers must not run at the same time.
+//
+// Handovers are gob-encodable. They contain the peer's private key, so
+// must be kept secret.
+type Handover struct {
+	Name       PeerName
+	NickName   string
+	UID        PeerUID
+	ShortID    PeerShortID
+	Version    uint64
+	PublicKey  []byte
+	PrivateKey []byte
+	Channels   map[string][][]byte // the encoded complete state of each channel
+}
+
+// Handover returns what a standby needs to take over from us; see
+// Handover. The topology isn't included, since the standby learns it
+// from its neighbours.
+func (router *Router) Handover() Handover {
+	ourself := router.Ourself
+	ourself.RLock()
+	handover := Handover{
+		Name:       ourself.Name,
+		NickName:   ourself.NickName,
+		UID:        ourself.UID,
+		ShortID:    ourself.ShortID,
+		Version:    ourself.Version,
+		PublicKey:  append([]byte{}, ourself.PublicKey...),
+		PrivateKey: append([]byte{}, router.unicastKey[:]...),
+		Channels:   make(map[string][][]byte),
+	}
+	ourself.RUnlock()
+	for channel := range router.gossipChannelSet() {
+		if channel.name == "topology" {
+			continue
+		}
+		if _, surrogate := channel.gossiper.(*surrogateGossiper); surrogate {
+			continue
+		}
+		if data := channel.gossiper.Gossip(); data != nil {
+			handover.Channels[channel.name] = data.Encode()
+		}
+	}
+	return handover
+}
+
+// NewRouterFromHandover returns a new router taking over from the peer
+// which gave handover, with its name, UID, keys and, as its gossipers
+// are registered, the state of its channels. It must be started.
+func NewRouterFromHandover(config Config, handover Handover, overlay Overlay, logger Logger) (*Router, error) {
+	if len(handover.PublicKey) != 32 || len(handover.PrivateKey) != 32 {
+		return nil, fmt.Errorf("handover of %s has no key pair", handover.Name)
+	}
+	return newRouter(context.Background(), config, handover.Name, handover.NickName, &handover, overlay, logger)
+}
+
+// takeOver assumes the identity of the peer which gave handover.
+func (router *Router) takeOver(handover *Handover) {
+	ourself := router.Ourself
+	ourself.Lock()
+	defer ourself.Unlock()
+	ourself.UID = handover.UID
+	ourself.ShortID = handover.ShortID
+	ourself.Version = handover.Version
+	ourself.PublicKey = append([]byte{}, handover.PublicKey...)
+	router.unicastKey = new([32]byte)
+	copy(router.unicastKey[:], handover.PrivateKey)
+}
+
+// restoreChannel delivers the state of a channel in the handover we
+// took over with, if any, to its gossiper as if received by gossip.
+func (router *Router) restoreChannel(channel *GossipChannel) {
+	if router.handover == nil {
+		return
+	}
+	for _, msg := range router.handover.Channels[channel.name] {
+		if _, err := channel.gossiper.OnGossip(msg); err != nil {
+			channel.logf("unable to restore state from handover: %v", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandover(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	g1 := newTestGossiper()
+	_, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	g1.OnGossipBroadcast(r1.Ourself.Name, []byte{1, 2})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	connectTo(t, r1, r2)
+
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(r1.Handover()))
+	var handover Handover
+	require.NoError(t, gob.NewDecoder(&buf).Decode(&handover))
+
+	// the active peer carries on for a while after the handover
+	r1.SetDegraded(true)
+	r1.Stop()
+
+	standby, err := NewRouterFromHandover(Config{}, handover, nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	defer standby.Stop()
+	g2 := newTestGossiper()
+	_, err = standby.NewGossip("test", g2)
+	require.NoError(t, err)
+	g2.checkHas(t, 1, 2)
+	require.Equal(t, r1.Ourself.Name, standby.Ourself.Name)
+	require.Equal(t, r1.Ourself.UID, standby.Ourself.UID)
+	require.Equal(t, r1.Ourself.PublicKey, standby.Ourself.PublicKey)
+	require.Equal(t, *r1.unicastKey, *standby.unicastKey)
+
+	standby.Start()
+	connectTo(t, standby, r2)
+	waitUntil(t, func() bool {
+		peer := r2.Peers.Fetch(standby.Ourself.Name)
+		r2.Peers.RLock()
+		defer r2.Peers.RUnlock()
+		return peer != nil && peer.UID == r1.Ourself.UID && !peer.Degraded
+	})
+
+	_, err = NewRouterFromHandover(Config{}, Handover{Name: handover.Name}, nil, log.New(ioutil.Discard, "", 0))
+	require.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// HandshakeQueuePolicy decides which of the targets due to be dialled
+// go first while Config.HandshakeLimit holds the rest back.
+type HandshakeQueuePolicy int
+
+// HandshakeQueuePolicies.
+const (
+	// HandshakeOldestFirst dials the targets which have been due the
+	// longest first. It is the default.
+	HandshakeOldestFirst HandshakeQueuePolicy = iota
+	// HandshakeRandomOrder dials the targets in a random order, so that
+	// peers restarting together don't all dial the same ones first.
+	HandshakeRandomOrder
+	// HandshakePinnedFirst dials pinned targets first, then the others
+	// but secondary ones, then secondary ones, each oldest first.
+	HandshakePinnedFirst
+)
+
+func (policy HandshakeQueuePolicy) String() string {
+	switch policy {
+	case HandshakeOldestFirst:
+		return "oldest-first"
+	case HandshakeRandomOrder:
+		return "random"
+	case HandshakePinnedFirst:
+		return "pinned-first"
+	}
+	return fmt.Sprintf("HandshakeQueuePolicy(%d)", int(policy))
+}
+
+// handshakeLimit bounds the outbound connections whose handshakes are
+// in progress at once.
+type handshakeLimit struct {
+	limit  int // zero for no limit
+	policy HandshakeQueuePolicy
+	queued int // targets due but held back, as of the last check
+}
+
+// ConnectionMakerStatus describes the outbound handshakes of the
+// ConnectionMaker.
+type ConnectionMakerStatus struct {
+	Handshakes     int // in progress
+	HandshakeLimit int // zero for no limit
+	HandshakeQueue string
+	Queued         int // targets due but held back by the limit
+}
+
+// Status returns the state of the outbound handshakes.
+func (cm *connectionMaker) Status() ConnectionMakerStatus {
+	resultChan := make(chan ConnectionMakerStatus)
+	cm.actionChan <- func() bool {
+		resultChan <- ConnectionMakerStatus{
+			Handshakes:     cm.attempting(),
+			HandshakeLimit: cm.handshakes.limit,
+			HandshakeQueue: cm.handshakes.policy.String(),
+			Queued:         cm.handshakes.queued,
+		}
+		return false
+	}
+	return <-resultChan
+}
+
+// dialDue dials as many of the targets due as the limit allows, in the
+// order of the policy, leaving the rest waiting until handshakes
+// complete.
+func (cm *connectionMaker) dialDue(due []string, directTarget map[string]struct{}) {
+	slots := len(due)
+	if cm.handshakes.limit > 0 {
+		cm.orderDue(due)
+		slots = cm.handshakes.limit - cm.attempting()
+	}
+	cm.handshakes.queued = 0
+	for i, address := range due {
+		target := cm.targets[address]
+		if i >= slots {
+			target.queued = true
+			cm.handshakes.queued++
+			continue
+		}
+		target.state, target.queued = targetAttempting, false
+		target.attempted = cm.ourself.router.clock().Now()
+		_, isCmdLineTarget := directTarget[address]
+		go cm.attemptConnection(address, isCmdLineTarget)
+	}
+}
+
+// orderDue orders the addresses of targets due per the policy.
+func (cm *connectionMaker) orderDue(due []string) {
+	oldestFirst := func(i, j int) bool {
+		ti, tj := cm.targets[due[i]], cm.targets[due[j]]
+		if !ti.tryAfter.Equal(tj.tryAfter) {
+			return ti.tryAfter.Before(tj.tryAfter)
+		}
+		return due[i] < due[j]
+	}
+	switch cm.handshakes.policy {
+	case HandshakeRandomOrder:
+		sort.Strings(due)
+		cm.ourself.router.rng().Shuffle(len(due), func(i, j int) { due[i], due[j] = due[j], due[i] })
+	case HandshakePinnedFirst:
+		rank := make(map[string]int, len(due))
+		for peer, direct := range cm.directPeers {
+			switch direct.priority {
+			case PriorityPinned:
+				rank[cm.targetAddr(peer, direct)] = -1
+			case PrioritySecondary:
+				rank[cm.targetAddr(peer, direct)] = 1
+			}
+		}
+		sort.Slice(due, func(i, j int) bool {
+			if rank[due[i]] != rank[due[j]] {
+				return rank[due[i]] < rank[due[j]]
+			}
+			return oldestFirst(i, j)
+		})
+	default:
+		sort.Slice(due, oldestFirst)
+	}
+}
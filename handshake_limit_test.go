@@ -0,0 +1,62 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeLimit(t *testing.T) {
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{HandshakeLimit: 2, HandshakeTimeout: time.Minute})
+	defer r.Stop()
+
+	// listeners which never accept, so handshakes with them hang
+	var addrs []string
+	var listeners []net.Listener
+	for i := 0; i < 5; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		listeners = append(listeners, ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	r.ConnectionMaker.InitiateConnections(addrs, false)
+	waitUntil(t, func() bool {
+		status := r.ConnectionMaker.Status()
+		return status.Handshakes == 2 && status.Queued == 3
+	})
+	require.Equal(t, ConnectionMakerStatus{Handshakes: 2, HandshakeLimit: 2, HandshakeQueue: "oldest-first", Queued: 3}, NewStatus(r).ConnectionMaker)
+
+	// as handshakes fail, those queued are dialled in turn
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	waitUntil(t, func() bool {
+		status := r.ConnectionMaker.Status()
+		return status.Handshakes == 0 && status.Queued == 0
+	})
+}
+
+func TestHandshakeQueueOrder(t *testing.T) {
+	now := time.Now()
+	cm := &connectionMaker{
+		port: 6783,
+		targets: map[string]*target{
+			"10.0.0.1:6783": {tryAfter: now},
+			"10.0.0.2:6783": {tryAfter: now.Add(-time.Second)},
+			"10.0.0.3:6783": {tryAfter: now.Add(-2 * time.Second)},
+		},
+		directPeers: map[string]*directPeer{
+			"10.0.0.1": {addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, priority: PriorityPinned},
+			"10.0.0.3": {addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3)}, priority: PrioritySecondary},
+		},
+	}
+	due := []string{"10.0.0.1:6783", "10.0.0.2:6783", "10.0.0.3:6783"}
+	cm.orderDue(due)
+	require.Equal(t, []string{"10.0.0.3:6783", "10.0.0.2:6783", "10.0.0.1:6783"}, due)
+	cm.handshakes.policy = HandshakePinnedFirst
+	cm.orderDue(due)
+	require.Equal(t, []string{"10.0.0.1:6783", "10.0.0.2:6783", "10.0.0.3:6783"}, due)
+}
@@ -0,0 +1,91 @@
+package mesh
+
+import "fmt"
+
+// Detours are the tiers of routing cost, by which degraded and draining
+// peers, and degraded connections, are avoided; see Peer.routes.
+const (
+	detourNone = iota
+	detourDegraded
+	detourDraining
+	maxDetour = detourDraining
+)
+
+// detour returns the routing cost of passing through the peer.
+func (peer *Peer) detour() int {
+	switch {
+	case peer.Draining:
+		return detourDraining
+	case peer.Degraded:
+		return detourDegraded
+	}
+	return detourNone
+}
+
+// connectionDetour returns the routing cost of passing from one peer to
+// another, which counts as degraded if either end says so.
+func connectionDetour(from, to *Peer) int {
+	if conn, found := from.connections[to.Name]; found && conn.isDegraded() {
+		return detourDegraded
+	}
+	if conn, found := to.connections[from.Name]; found && conn.isDegraded() {
+		return detourDegraded
+	}
+	return detourNone
+}
+
+// SetDegraded marks our peer as degraded, or not, e.g. because the
+// application has detected a local problem such as an overloaded host.
+// This is gossiped to the other peers, who then route traffic around us
+// where they can.
+func (router *Router) SetDegraded(degraded bool) {
+	router.Ourself.setDegraded(degraded)
+	router.Routes.recalculate()
+}
+
+// SetConnectionDegraded marks our connection to the named peer as
+// degraded, or not, e.g. because the application has detected that it
+// is slow or lossy. This is gossiped to the other peers; all peers then
+// route unicast traffic around the connection where they can.
+func (router *Router) SetConnectionDegraded(name PeerName, degraded bool) error {
+	if err := router.Ourself.setConnectionDegraded(name, degraded); err != nil {
+		return err
+	}
+	router.Routes.recalculate()
+	return nil
+}
+
+// degradableConnection is implemented by our connections, via
+// remoteConnection.
+type degradableConnection interface {
+	setDegraded(degraded bool) (changed bool)
+}
+
+func (peer *localPeer) setDegraded(degraded bool) {
+	peer.Lock()
+	if peer.Degraded == degraded {
+		peer.Unlock()
+		return
+	}
+	peer.Degraded = degraded
+	peer.Version++
+	peer.Unlock()
+	peer.broadcastPeerUpdate()
+}
+
+func (peer *localPeer) setConnectionDegraded(name PeerName, degraded bool) error {
+	peer.Lock()
+	conn, found := peer.connections[name]
+	if !found {
+		peer.Unlock()
+		return fmt.Errorf("no connection to %s", name)
+	}
+	if !conn.(degradableConnection).setDegraded(degraded) {
+		peer.Unlock()
+		return nil
+	}
+	peer.Version++
+	peer.Unlock()
+	peer.broadcastPeerUpdate()
+	return nil
+}
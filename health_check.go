@@ -0,0 +1,202 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The checks of a HealthReport.
+const (
+	HealthLocalPeer   = "local-peer"
+	HealthRoutes      = "routes"
+	HealthConnections = "connections"
+	HealthShortIDs    = "short-ids"
+)
+
+// HealthReport is the outcome of Router.HealthCheck, e.g. for
+// readiness and liveness probes.
+type HealthReport struct {
+	Healthy bool // whether all the checks passed
+	Checks  []HealthCheckResult
+}
+
+// HealthCheckResult is the outcome of one of the checks of a
+// HealthReport, with the problems it found, if any.
+type HealthCheckResult struct {
+	Name     string
+	Healthy  bool
+	Problems []string
+}
+
+// HealthCheck checks the router's invariants:
+//
+//   - HealthLocalPeer: our peer is the one the topology knows by our
+//     name, and the peers at the other ends of our connections are the
+//     ones it knows by theirs;
+//   - HealthRoutes: there is a route to every peer reachable in the
+//     topology;
+//   - HealthConnections: no connection has been attempted, or pending
+//     establishment, for longer than Config.StuckConnectionAge;
+//   - HealthShortIDs: our short ID doesn't collide with that of another
+//     peer. Collisions between other peers are reported, but are theirs
+//     to resolve.
+//
+// Routes which are merely being recalculated aren't reported. It
+// returns the context's error if that is done before the checks are.
+func (router *Router) HealthCheck(ctx context.Context) (HealthReport, error) {
+	result := make(chan HealthReport, 1)
+	go func() { result <- router.healthCheck(ctx) }()
+	select {
+	case report := <-result:
+		return report, nil
+	case <-ctx.Done():
+		return HealthReport{}, ctx.Err()
+	}
+}
+
+func (router *Router) healthCheck(ctx context.Context) HealthReport {
+	check := func(name string, problems []string) HealthCheckResult {
+		return HealthCheckResult{Name: name, Healthy: len(problems) == 0, Problems: problems}
+	}
+	collisions, ours := router.Peers.shortIDCollisions()
+	report := HealthReport{Healthy: true, Checks: []HealthCheckResult{
+		check(HealthLocalPeer, router.Peers.localPeerProblems()),
+		check(HealthRoutes, router.Routes.routeProblems()),
+		check(HealthConnections, router.ConnectionMaker.stuckConnections(ctx, router.stuckConnectionAge())),
+		{Name: HealthShortIDs, Healthy: !ours, Problems: collisions},
+	}}
+	for _, check := range report.Checks {
+		report.Healthy = report.Healthy && check.Healthy
+	}
+	return report
+}
+
+// stuckConnectionAge returns Config.StuckConnectionAge, defaulting to
+// twice the heartbeat interval.
+func (router *Router) stuckConnectionAge() time.Duration {
+	if router.StuckConnectionAge > 0 {
+		return router.StuckConnectionAge
+	}
+	return 2 * router.heartbeatInterval()
+}
+
+// localPeerProblems checks that we, and our neighbours, are the peers
+// known by our names.
+func (peers *Peers) localPeerProblems() []string {
+	var problems []string
+	peers.RLock()
+	defer peers.RUnlock()
+	ourself := peers.ourself
+	if peers.byName[ourself.Name] != ourself.Peer {
+		problems = append(problems, fmt.Sprintf("%s is not the peer known by our name", ourself))
+	}
+	if peers.loadView().byName[ourself.Name] != ourself.Peer {
+		problems = append(problems, fmt.Sprintf("%s is not the peer in the published view", ourself))
+	}
+	ourself.RLock()
+	defer ourself.RUnlock()
+	for name, conn := range ourself.connections {
+		if peers.byName[name] != conn.Remote() {
+			problems = append(problems, fmt.Sprintf("connection to %s is not to the peer known by its name", conn.Remote()))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// routeProblems returns the peers reachable in the topology to which
+// there is no route, even once the routes have been recalculated.
+func (r *routes) routeProblems() []string {
+	var missing []PeerName
+	for attempt := 0; attempt < 2; attempt++ {
+		r.ensureRecalculated()
+		r.peers.RLock()
+		r.ourself.RLock()
+		reachable := r.calculateUnicast(false)
+		r.ourself.RUnlock()
+		r.peers.RUnlock()
+		missing = missing[:0]
+		r.RLock()
+		for name := range reachable {
+			if _, found := r.unicastAll[name]; !found {
+				missing = append(missing, name)
+			}
+		}
+		r.RUnlock()
+		if len(missing) == 0 {
+			return nil
+		}
+		// the topology may have changed since the recalculation
+		r.recalculate()
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	problems := make([]string, len(missing))
+	for i, name := range missing {
+		problems[i] = fmt.Sprintf("no route to %s", name)
+	}
+	return problems
+}
+
+// stuckConnections describes the connections which have been pending
+// for longer than age, whether still being attempted, or awaiting
+// establishment once the handshake is done. It gives up, returning
+// nil, if ctx is done before the connectionMaker gets to it.
+func (cm *connectionMaker) stuckConnections(ctx context.Context, age time.Duration) []string {
+	resultChan := make(chan []string, 1)
+	action := func() bool {
+		var problems []string
+		now := cm.ourself.router.clock().Now()
+		for address, target := range cm.targets {
+			if pending := now.Sub(target.attempted); target.state == targetAttempting && pending > age {
+				problems = append(problems, fmt.Sprintf("connection to %s attempted for %v", address, pending))
+			}
+		}
+		for conn := range cm.connections {
+			lc, ok := conn.(*LocalConnection)
+			if !ok || conn.isEstablished() {
+				continue
+			}
+			if pending := now.Sub(lc.started); pending > age {
+				problems = append(problems, fmt.Sprintf("connection to %s pending for %v", conn.remoteTCPAddress(), pending))
+			}
+		}
+		sort.Strings(problems)
+		resultChan <- problems
+		return false
+	}
+	select {
+	case cm.actionChan <- action:
+	case <-ctx.Done():
+		return nil
+	}
+	select {
+	case problems := <-resultChan:
+		return problems
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// shortIDCollisions describes the short IDs shared by several peers,
+// and whether we are one of them.
+func (peers *Peers) shortIDCollisions() (collisions []string, ours bool) {
+	peers.RLock()
+	defer peers.RUnlock()
+	for shortID, entry := range peers.byShortID {
+		if len(entry.others) == 0 {
+			continue
+		}
+		names := []string{entry.peer.String()}
+		ours = ours || entry.peer == peers.ourself.Peer
+		for _, other := range entry.others {
+			names = append(names, other.String())
+			ours = ours || other == peers.ourself.Peer
+		}
+		sort.Strings(names)
+		collisions = append(collisions, fmt.Sprintf("short ID %d shared by %v", shortID, names))
+	}
+	sort.Strings(collisions)
+	return collisions, ours
+}
@@ -0,0 +1,84 @@
+package mesh
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func healthCheckOf(report HealthReport, name string) HealthCheckResult {
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	return HealthCheckResult{}
+}
+
+func TestHealthCheck(t *testing.T) {
+	config := Config{HandshakeTimeout: 5 * time.Second, StuckConnectionAge: 50 * time.Millisecond}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	defer r1.Stop()
+	defer r2.Stop()
+	addr2, close2 := listenTest(t, r2)
+	defer close2()
+	r1.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool { return len(establishedTo(r1)) == 1 && len(establishedTo(r2)) == 1 })
+
+	report, err := r1.HealthCheck(context.Background())
+	require.NoError(t, err)
+	require.True(t, report.Healthy, "%+v", report)
+	require.Len(t, report.Checks, 4)
+
+	// a listener which never completes the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		report, err = r1.HealthCheck(context.Background())
+		require.NoError(t, err)
+		return !report.Healthy
+	})
+	stuck := healthCheckOf(report, HealthConnections)
+	require.False(t, stuck.Healthy)
+	require.Len(t, stuck.Problems, 1)
+	require.Contains(t, stuck.Problems[0], ln.Addr().String())
+	require.True(t, healthCheckOf(report, HealthRoutes).Healthy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r1.Routes.recalculate()
+	if _, err := r1.HealthCheck(ctx); err != nil {
+		require.Equal(t, context.Canceled, err)
+	}
+}
+
+func TestHealthCheckGivesUp(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	// keep the connectionMaker busy
+	release := make(chan struct{})
+	defer close(release)
+	r.ConnectionMaker.actionChan <- func() bool { <-release; return false }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := r.HealthCheck(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	// nor is the check itself left waiting
+	require.Nil(t, r.ConnectionMaker.stuckConnections(ctx, time.Minute))
+}
@@ -0,0 +1,66 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDegradedPeerReroutes(t *testing.T) {
+	routers, route := newTestDiamond(t)
+	r1, r2, r4 := routers[0], routers[1], routers[3]
+	require.Equal(t, r2.Ourself.Name, route())
+
+	r2.SetDegraded(true)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.True(t, r1.Peers.Fetch(r2.Ourself.Name).Degraded)
+	require.Equal(t, r4.Ourself.Name, route())
+
+	// a draining peer is avoided in preference to a degraded one
+	r4.Ourself.setDraining(true)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.Equal(t, r2.Ourself.Name, route())
+}
+
+func TestDegradedConnectionReroutes(t *testing.T) {
+	routers, route := newTestDiamond(t)
+	r1, r2, r3, r4 := routers[0], routers[1], routers[2], routers[3]
+	require.Equal(t, r2.Ourself.Name, route())
+
+	require.Error(t, r2.SetConnectionDegraded(r4.Ourself.Name, true))
+	require.NoError(t, r3.SetConnectionDegraded(r2.Ourself.Name, true))
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.Equal(t, r4.Ourself.Name, route())
+
+	// broadcast routes are unaffected
+	r1.Routes.ensureRecalculated()
+	require.ElementsMatch(t, []PeerName{r2.Ourself.Name, r4.Ourself.Name}, r1.Routes.BroadcastAll(r1.Ourself.Name))
+}
+
+func TestLeafIsNotATransitHop(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{Leaf: true})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	require.True(t, r1.Peers.Fetch(r2.Ourself.Name).Leaf)
+
+	r1.Routes.ensureRecalculated()
+	hop, found := r1.Routes.UnicastAll(r2.Ourself.Name)
+	require.True(t, found)
+	require.Equal(t, r2.Ourself.Name, hop)
+	_, found = r1.Routes.UnicastAll(r3.Ourself.Name)
+	require.False(t, found)
+
+	// the leaf reaches everyone, but doesn't relay broadcasts
+	r2.Routes.ensureRecalculated()
+	_, found = r2.Routes.UnicastAll(r3.Ourself.Name)
+	require.True(t, found)
+	require.Empty(t, r2.Routes.BroadcastAll(r1.Ourself.Name))
+	require.ElementsMatch(t, []PeerName{r1.Ourself.Name, r3.Ourself.Name}, r2.Routes.BroadcastAll(r2.Ourself.Name))
+}
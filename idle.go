@@ -0,0 +1,157 @@
+package mesh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Neighbours which advertise this feature understand ProtocolIdle, and
+// so don't redial a connection closed as idle.
+const featureIdle = "idle"
+
+var errConnectionIdle = errors.New("connection idle")
+
+// noteActive records traffic on the application's channels, which
+// keeps the connection from being idle; see Config.IdleTimeout.
+func (conn *LocalConnection) noteActive() {
+	if conn.router.idleTimeout() > 0 {
+		atomic.StoreInt64(&conn.lastActive, conn.router.clock().Now().UnixNano())
+	}
+}
+
+func (conn *LocalConnection) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&conn.lastActive)))
+}
+
+// checkIdle closes the connection, telling the remote why, if it has
+// been idle for longer than Config.IdleTimeout, and the remote supports
+// that, and every peer would still be reachable without it, and those
+// being closed likewise. Only the end which dialled the connection
+// closes it, so the ends don't race to do so. Only called by the actor.
+func (conn *LocalConnection) checkIdle(now time.Time) error {
+	timeout := conn.router.idleTimeout()
+	if timeout <= 0 || !conn.outbound || !conn.established || !conn.features.both(featureIdle) || conn.idleFor(now) < timeout {
+		return nil
+	}
+	idle := &conn.router.ConnectionMaker.idle
+	idle.Lock()
+	links := [][2]PeerName{{conn.local.Name, conn.remote.Name}}
+	for peer := range idle.peers {
+		links = append(links, [2]PeerName{conn.local.Name, peer})
+	}
+	report, err := conn.router.WhatIf(TopologyChange{RemoveLinks: links})
+	if err != nil || len(report.Unreachable) > 0 {
+		idle.Unlock()
+		return nil
+	}
+	idle.parkLocked(conn.remote.Name, conn.remoteTCPAddress())
+	idle.Unlock()
+	if err := conn.sendSimpleProtocolMsg(ProtocolIdle); err != nil {
+		return err
+	}
+	return errConnectionIdle
+}
+
+// setKeepAlive applies Config.TCPKeepAlive to a TCP connection.
+func (router *Router) setKeepAlive(tcpConn *net.TCPConn) error {
+	switch period := router.TCPKeepAlive; {
+	case period < 0:
+		return tcpConn.SetKeepAlive(false)
+	case period > 0:
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tcpConn.SetKeepAlivePeriod(period)
+	}
+	return nil
+}
+
+// idlePeers are the peers whose connections to us were closed as idle,
+// or are being closed, which aren't redialled, by either end, until
+// woken: when the peer becomes unreachable, or we originate a unicast
+// to it. Its lock is taken before that of Peers.
+type idlePeers struct {
+	sync.Mutex
+	count int32               // accessed atomically, so that checking is all but free
+	peers map[PeerName]string // to the address of the target, if we dialled it
+}
+
+func (idle *idlePeers) park(peer PeerName, address string) {
+	idle.Lock()
+	defer idle.Unlock()
+	idle.parkLocked(peer, address)
+}
+
+func (idle *idlePeers) parkLocked(peer PeerName, address string) {
+	if idle.peers == nil {
+		idle.peers = make(map[PeerName]string)
+	}
+	idle.peers[peer] = address
+	atomic.StoreInt32(&idle.count, int32(len(idle.peers)))
+}
+
+// unpark returns the address of the target of peer, and whether it was
+// parked.
+func (idle *idlePeers) unpark(peer PeerName) (string, bool) {
+	if atomic.LoadInt32(&idle.count) == 0 {
+		return "", false
+	}
+	idle.Lock()
+	defer idle.Unlock()
+	address, found := idle.peers[peer]
+	delete(idle.peers, peer)
+	atomic.StoreInt32(&idle.count, int32(len(idle.peers)))
+	return address, found
+}
+
+func (idle *idlePeers) names() peerNameSet {
+	names := make(peerNameSet)
+	if atomic.LoadInt32(&idle.count) == 0 {
+		return names
+	}
+	idle.Lock()
+	defer idle.Unlock()
+	for name := range idle.peers {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// wake redials peer, if its connection was closed as idle.
+func (cm *connectionMaker) wake(peer PeerName) {
+	address, found := cm.idle.unpark(peer)
+	if !found {
+		return
+	}
+	cm.actionChan <- func() bool {
+		cm.retryNow(address)
+		return true
+	}
+}
+
+// wakeUnreachable unparks the peers which have become unreachable, so
+// that they are redialled. Only called by the actor.
+func (cm *connectionMaker) wakeUnreachable() {
+	if atomic.LoadInt32(&cm.idle.count) == 0 || cm.ourself.router == nil {
+		return
+	}
+	for peer := range cm.idle.names() {
+		if _, reachable := cm.ourself.router.Routes.UnicastAll(peer); reachable {
+			continue
+		}
+		if address, found := cm.idle.unpark(peer); found {
+			cm.retryNow(address)
+		}
+	}
+}
+
+// retryNow schedules an immediate attempt at the target of address, if
+// it is parked. Only called by the actor.
+func (cm *connectionMaker) retryNow(address string) {
+	if target, found := cm.targets[address]; found && target.tryAfter.IsZero() && target.lastError == errConnectionIdle {
+		target.nextTryNow(cm.ourself.router.clock())
+	}
+}
@@ -0,0 +1,92 @@
+package mesh
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// listenTest accepts connections to router on a loopback address,
+// which it returns.
+func listenTest(t *testing.T, router *Router) (string, func()) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			router.acceptTCP(tcpConn)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func establishedTo(router *Router) peerNameSet {
+	peers := make(peerNameSet)
+	for conn := range router.Ourself.getConnections() {
+		if conn.isEstablished() {
+			peers[conn.Remote().Name] = struct{}{}
+		}
+	}
+	return peers
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// Only r1 closes idle connections, all of which it dials.
+	heartbeat := 50 * time.Millisecond
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{IdleTimeout: 4 * heartbeat, HeartbeatInterval: heartbeat, TCPKeepAlive: time.Minute})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{HeartbeatInterval: heartbeat, TCPKeepAlive: -1})
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{HeartbeatInterval: heartbeat})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+	addr2, close2 := listenTest(t, r2)
+	defer close2()
+	addr3, close3 := listenTest(t, r3)
+	defer close3()
+	c1, err := r1.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	for _, r := range []*Router{r2, r3} {
+		_, err := r.NewGossip("test", newTestGossiper())
+		require.NoError(t, err)
+	}
+	var (
+		lock        sync.Mutex
+		established = make(map[PeerName]int)
+	)
+	r1.OnConnectionEstablished(func(event ConnectionEvent) {
+		lock.Lock()
+		established[event.Peer]++
+		lock.Unlock()
+	})
+	r2.ConnectionMaker.InitiateConnections([]string{addr3}, false)
+	r1.ConnectionMaker.InitiateConnections([]string{addr2, addr3}, false)
+
+	// Closing both of r1's connections would cut it off, so it closes
+	// just one, and doesn't redial it.
+	waitUntil(t, func() bool {
+		return len(r1.ConnectionMaker.idle.names()) == 1 && len(establishedTo(r1)) == 1
+	})
+	var parked PeerName
+	for parked = range r1.ConnectionMaker.idle.names() {
+	}
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, establishedTo(r1), 1)
+	require.NotContains(t, establishedTo(r1), parked)
+	lock.Lock()
+	require.Equal(t, 1, established[parked])
+	lock.Unlock()
+
+	// A unicast to it redials it.
+	require.NoError(t, c1.GossipUnicast(parked, []byte("hello")))
+	waitUntil(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return established[parked] == 2
+	})
+}
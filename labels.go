@@ -0,0 +1,114 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Limits on a peer's labels, which are gossiped with every topology
+// update that includes the peer.
+const (
+	maxLabels     = 32
+	maxLabelsSize = 1024 // bytes of keys and values
+)
+
+// validateLabels checks that labels are within the limits above.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%d labels is more than the limit of %d", len(labels), maxLabels)
+	}
+	size := 0
+	for key, value := range labels {
+		if key == "" {
+			return fmt.Errorf("label with empty key")
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxLabelsSize {
+		return fmt.Errorf("labels of %d bytes are more than the limit of %d", size, maxLabelsSize)
+	}
+	return nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(labels))
+	for key, value := range labels {
+		result[key] = value
+	}
+	return result
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, found := b[key]; !found || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedLabelKeys returns the keys of labels in order, so that they
+// are encoded deterministically.
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetLabels replaces our labels, which are gossiped to all peers with
+// the topology, e.g. so that they can discover our role, or the
+// version of the application we run. Peers' labels are in their Labels
+// field, which is replaced rather than modified when they change.
+func (peer *localPeer) SetLabels(labels map[string]string) error {
+	unlock := peer.lockWithPeers()
+	changed, err := peer.setLabelsLocked(labels)
+	unlock()
+	if changed {
+		peer.broadcastPeerUpdate()
+	}
+	return err
+}
+
+// SetLabel sets one of our labels, or removes it if value is empty.
+func (peer *localPeer) SetLabel(key, value string) error {
+	unlock := peer.lockWithPeers()
+	labels := copyLabels(peer.Labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	if value == "" {
+		delete(labels, key)
+	} else {
+		labels[key] = value
+	}
+	changed, err := peer.setLabelsLocked(labels)
+	unlock()
+	if changed {
+		peer.broadcastPeerUpdate()
+	}
+	return err
+}
+
+// setLabelsLocked replaces our labels, returning whether they changed.
+// The caller holds the locks taken by lockWithPeers, since peers'
+// labels are read under the Peers lock, e.g. to select them.
+func (peer *localPeer) setLabelsLocked(labels map[string]string) (bool, error) {
+	if err := validateLabels(labels); err != nil {
+		return false, err
+	}
+	if labelsEqual(peer.Labels, labels) {
+		return false, nil
+	}
+	peer.Labels = copyLabels(labels)
+	peer.Version++
+	return true, nil
+}
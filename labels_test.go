@@ -0,0 +1,96 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Labels: map[string]string{"role": "db"}})
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r2.Peers.Watch(ctx)
+
+	labels := func() map[string]string {
+		r2.Peers.RLock()
+		defer r2.Peers.RUnlock()
+		if peer := r2.Peers.byName[r1.Ourself.Name]; peer != nil {
+			return peer.Labels
+		}
+		return nil
+	}
+	connectTo(t, r1, r2)
+	waitUntil(t, func() bool { return labels()["role"] == "db" })
+
+	require.NoError(t, r1.Ourself.SetLabel("version", "1.2"))
+	waitUntil(t, func() bool { return labels()["version"] == "1.2" })
+	for event := range events {
+		if event.Type == PeerLabelsChanged && event.Peer == r1.Ourself.Name {
+			break
+		}
+	}
+
+	require.NoError(t, r1.Ourself.SetLabel("role", ""))
+	waitUntil(t, func() bool { _, found := labels()["role"]; return !found })
+	require.Equal(t, map[string]string{"version": "1.2"}, labels())
+
+	require.Error(t, r1.Ourself.SetLabel("", "x"))
+	require.Error(t, r1.Ourself.SetLabel("big", strings.Repeat("x", maxLabelsSize)))
+}
+
+func TestSetLabelConcurrently(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			require.NoError(t, r.Ourself.SetLabel(key, "x"))
+		}(fmt.Sprint("key", i))
+	}
+	wg.Wait()
+	r.Ourself.RLock()
+	defer r.Ourself.RUnlock()
+	require.Len(t, r.Ourself.Labels, 10)
+}
+
+func TestSetNickName(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Clock: clock})
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r2.Peers.Watch(ctx)
+	connectTo(t, r1, r2)
+
+	r1.Ourself.SetNickName("renamed")
+	renamed := func() bool {
+		// the topology update carrying the new name is deferred
+		clock.Advance(deferTopologyUpdateDuration)
+		for {
+			select {
+			case event := <-events:
+				if event.Type == PeerRenamed && event.Peer == r1.Ourself.Name {
+					require.Equal(t, "renamed", event.NickName)
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}
+	waitUntil(t, renamed)
+	require.Equal(t, "renamed", NewStatus(r1).NickName)
+}
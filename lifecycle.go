@@ -0,0 +1,198 @@
+package mesh
+
+import "sync"
+
+// PeerState is the state of a peer in its lifecycle, as seen by us.
+type PeerState int
+
+// The states of a peer. Each peer starts out PeerDiscovered or
+// PeerConnecting, and ends up PeerForgotten.
+const (
+	// PeerDiscovered peers are known from the topology, but we have no
+	// connection to them.
+	PeerDiscovered PeerState = iota
+	// PeerConnecting peers have completed the handshake of a connection
+	// with us, which is not yet established.
+	PeerConnecting
+	// PeerEstablished peers have an established connection with us.
+	PeerEstablished
+	// PeerDegraded peers are marked degraded, or our connection to them
+	// is; see Router.SetDegraded and Router.SetConnectionDegraded.
+	PeerDegraded
+	// PeerDraining peers are in maintenance mode; see
+	// Router.EnterMaintenance.
+	PeerDraining
+	// PeerDeparted peers have left the mesh, with Router.Drain, but are
+	// still in the topology.
+	PeerDeparted
+	// PeerForgotten peers are no longer in the topology. No more
+	// transitions are reported for them, unless they are discovered
+	// again.
+	PeerForgotten
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerDiscovered:
+		return "discovered"
+	case PeerConnecting:
+		return "connecting"
+	case PeerEstablished:
+		return "established"
+	case PeerDegraded:
+		return "degraded"
+	case PeerDraining:
+		return "draining"
+	case PeerDeparted:
+		return "departed"
+	case PeerForgotten:
+		return "forgotten"
+	}
+	return "unknown"
+}
+
+// PeerTransition describes a peer changing state.
+type PeerTransition struct {
+	Peer     PeerName
+	NickName string
+	From, To PeerState
+}
+
+// PeerState returns the state of the named peer, which is
+// PeerForgotten for peers we don't know.
+func (router *Router) PeerState(name PeerName) PeerState {
+	router.lifecycle.Lock()
+	defer router.lifecycle.Unlock()
+	if state, found := router.lifecycle.states[name]; found {
+		return state
+	}
+	return PeerForgotten
+}
+
+// PeerStates returns the state of every peer we know, other than
+// ourself.
+func (router *Router) PeerStates() map[PeerName]PeerState {
+	router.lifecycle.Lock()
+	defer router.lifecycle.Unlock()
+	states := make(map[PeerName]PeerState, len(router.lifecycle.states))
+	for name, state := range router.lifecycle.states {
+		states[name] = state
+	}
+	return states
+}
+
+// OnPeerTransition adds a function to be called whenever a peer changes
+// state. A newly discovered peer transitions from PeerForgotten.
+// Callbacks are invoked synchronously, in the order of the transitions,
+// and so must not block.
+func (router *Router) OnPeerTransition(callback func(PeerTransition)) {
+	router.lifecycle.Lock()
+	defer router.lifecycle.Unlock()
+	router.lifecycle.onTransition = append(router.lifecycle.onTransition, callback)
+}
+
+// peerLifecycle tracks the states of peers, which it derives from the
+// topology, our connections, and the departures we've been told of.
+type peerLifecycle struct {
+	sync.Mutex
+	refreshLock  sync.Mutex // serialises refreshes, so transitions are reported in order
+	states       map[PeerName]PeerState
+	nickNames    map[PeerName]string
+	departed     peerNameSet
+	onTransition []func(PeerTransition)
+}
+
+func newPeerLifecycle() *peerLifecycle {
+	return &peerLifecycle{states: make(map[PeerName]PeerState), nickNames: make(map[PeerName]string), departed: make(peerNameSet)}
+}
+
+// connectionEstablished clears any departure of a peer which has
+// returned.
+func (l *peerLifecycle) connectionEstablished(name PeerName) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.departed, name)
+}
+
+// connectionTerminated records the departure of a peer which told us it
+// was leaving, returning whether it did.
+func (l *peerLifecycle) connectionTerminated(name PeerName, err error) bool {
+	if err != errPeerDeparted {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.departed[name] = struct{}{}
+	return true
+}
+
+// refreshPeerStates recomputes the state of each peer, reporting the
+// transitions.
+func (router *Router) refreshPeerStates() {
+	l := router.lifecycle
+	l.refreshLock.Lock()
+	defer l.refreshLock.Unlock()
+
+	ourConns := make(map[PeerName]Connection)
+	for conn := range router.Ourself.getConnections() {
+		ourConns[conn.Remote().Name] = conn
+	}
+	l.Lock()
+	departed := make(peerNameSet, len(l.departed))
+	for name := range l.departed {
+		departed[name] = struct{}{}
+	}
+	l.Unlock()
+
+	states := make(map[PeerName]PeerState)
+	nickNames := make(map[PeerName]string)
+	router.Peers.forEach(func(peer *Peer) {
+		if peer.Name == router.Ourself.Name {
+			return
+		}
+		conn, connected := ourConns[peer.Name]
+		_, hasDeparted := departed[peer.Name]
+		var state PeerState
+		switch {
+		case hasDeparted:
+			state = PeerDeparted
+		case peer.Draining:
+			state = PeerDraining
+		case peer.Degraded || (connected && conn.isDegraded()):
+			state = PeerDegraded
+		case connected && conn.isEstablished():
+			state = PeerEstablished
+		case connected:
+			state = PeerConnecting
+		default:
+			state = PeerDiscovered
+		}
+		states[peer.Name] = state
+		nickNames[peer.Name] = peer.NickName
+	})
+
+	var transitions []PeerTransition
+	l.Lock()
+	for name, state := range states {
+		if from, found := l.states[name]; !found {
+			transitions = append(transitions, PeerTransition{name, nickNames[name], PeerForgotten, state})
+		} else if from != state {
+			transitions = append(transitions, PeerTransition{name, nickNames[name], from, state})
+		}
+	}
+	for name, from := range l.states {
+		if _, found := states[name]; !found {
+			transitions = append(transitions, PeerTransition{name, l.nickNames[name], from, PeerForgotten})
+			delete(l.departed, name)
+		}
+	}
+	l.states, l.nickNames = states, nickNames
+	callbacks := l.onTransition
+	l.Unlock()
+
+	for _, transition := range transitions {
+		for _, callback := range callbacks {
+			callback(transition)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerLifecycle(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+
+	var lock sync.Mutex
+	var transitions []PeerTransition
+	r1.OnPeerTransition(func(transition PeerTransition) {
+		lock.Lock()
+		defer lock.Unlock()
+		transitions = append(transitions, transition)
+	})
+	flush := func() []PeerTransition {
+		sendPendingTopologyUpdates(routers...)
+		sendPendingGossip(routers...)
+		r1.Routes.ensureRecalculated()
+		lock.Lock()
+		defer lock.Unlock()
+		result := transitions
+		transitions = nil
+		return result
+	}
+
+	// r1 <-> r2 <-> r3
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flush()
+	require.Equal(t, map[PeerName]PeerState{r2.Ourself.Name: PeerEstablished, r3.Ourself.Name: PeerDiscovered}, r1.PeerStates())
+
+	r2.SetDegraded(true)
+	require.Equal(t, []PeerTransition{{r2.Ourself.Name, "nick", PeerEstablished, PeerDegraded}}, flush())
+	r2.SetDegraded(false)
+	r2.Ourself.setDraining(true) // as EnterMaintenance does
+	require.Equal(t, []PeerTransition{{r2.Ourself.Name, "nick", PeerDegraded, PeerDraining}}, flush())
+	r2.LeaveMaintenance()
+	require.Equal(t, []PeerTransition{{r2.Ourself.Name, "nick", PeerDraining, PeerEstablished}}, flush())
+
+	// a departing peer is departed until it is forgotten
+	r1.lifecycle.connectionTerminated(r2.Ourself.Name, errPeerDeparted)
+	r1.refreshPeerStates()
+	require.Equal(t, PeerDeparted, r1.PeerState(r2.Ourself.Name))
+	r1.DeleteTestGossipConnection(r2)
+	r2.DeleteTestGossipConnection(r1)
+	flush()
+	require.Equal(t, PeerForgotten, r1.PeerState(r2.Ourself.Name))
+	require.Empty(t, r1.PeerStates())
+}
@@ -0,0 +1,102 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// AddListener starts the router listening on a further address, in
+// host:port format, e.g. that of another interface, or of the other
+// address family, and advertises it to our peers. It returns the
+// address listened on. If the router was started on a shared
+// Transport, the other routers on it accept connections there too.
+func (router *Router) AddListener(address string) (net.Addr, error) {
+	router.transportLock.Lock()
+	defer router.transportLock.Unlock()
+	if router.transport == nil {
+		return nil, fmt.Errorf("router not started")
+	}
+	addr, err := router.transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	router.advertiseListenAddrs()
+	return addr, nil
+}
+
+// RemoveListener stops the router listening on an address added by
+// AddListener, or Config.ListenOn, and stops advertising it.
+func (router *Router) RemoveListener(address string) error {
+	router.transportLock.Lock()
+	defer router.transportLock.Unlock()
+	if router.transport == nil {
+		return fmt.Errorf("router not started")
+	}
+	if err := router.transport.Unlisten(address); err != nil {
+		return err
+	}
+	router.advertiseListenAddrs()
+	return nil
+}
+
+// ListenAddrs returns the addresses the router is listening on.
+func (router *Router) ListenAddrs() []string {
+	router.transportLock.Lock()
+	defer router.transportLock.Unlock()
+	return router.listenAddrs()
+}
+
+// listenAddrs returns the addresses the router is listening on.
+// transportLock must be held.
+func (router *Router) listenAddrs() []string {
+	var addrs []string
+	if router.transport != nil {
+		for _, addr := range router.transport.Addrs() {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	return addrs
+}
+
+// advertiseListenAddrs tells our peers the addresses we are listening
+// on, unless we are behind NAT, when they can't be dialled anyway.
+// transportLock must be held.
+func (router *Router) advertiseListenAddrs() {
+	var listenAddrs, addrs []string
+	if !router.NAT.BehindNAT {
+		listenAddrs = router.listenAddrs()
+		hostAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			router.logger.Printf("Unable to list interface addresses: %v", err)
+		}
+		addrs = reachableAddrs(listenAddrs, hostAddrs)
+	}
+	router.Ourself.setListenAddrs(listenAddrs, addrs)
+}
+
+func (peer *localPeer) setListenAddrs(listenAddrs, addrs []string) {
+	peer.Lock()
+	peer.ListenAddrs = listenAddrs
+	peer.Addrs = addrs
+	peer.Version++
+	peer.Unlock()
+	peer.broadcastPeerUpdate()
+}
+
+// dialAddr returns the address at which to dial peer, which has a
+// connection from ip: the first address it advertises listening on,
+// either at ip or all the host's addresses, or failing that, port at ip.
+// Peers must be read-locked.
+func dialAddr(peer *Peer, ip string, port int) string {
+	for _, address := range peer.ListenAddrs {
+		host, listenPort, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		if listenIP := net.ParseIP(host); host == "" || (listenIP != nil && (listenIP.IsUnspecified() || listenIP.Equal(net.ParseIP(ip)))) {
+			return net.JoinHostPort(ip, listenPort)
+		}
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
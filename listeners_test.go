@@ -0,0 +1,52 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListeners(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Host: "127.0.0.1", ListenOn: []string{"127.0.0.1:0"}})
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	require.Len(t, r1.ListenAddrs(), 2)
+
+	added, err := r1.AddListener("127.0.0.1:0")
+	require.NoError(t, err)
+	require.Contains(t, r1.ListenAddrs(), added.String())
+
+	// connect by the added listener, and learn of all of them
+	require.Empty(t, r2.ConnectionMaker.InitiateConnections([]string{added.String()}, false))
+	waitUntil(t, func() bool {
+		_, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+		return found
+	})
+	waitUntil(t, func() bool {
+		var addrs []string
+		r2.Peers.forEach(func(peer *Peer) {
+			if peer.Name == r1.Ourself.Name {
+				addrs = peer.ListenAddrs
+			}
+		})
+		return len(addrs) == 3
+	})
+
+	require.NoError(t, r1.RemoveListener(added.String()))
+	require.NotContains(t, r1.ListenAddrs(), added.String())
+	_, err = net.Dial("tcp", added.String())
+	require.Error(t, err)
+	require.Error(t, r1.RemoveListener(r1.ListenAddrs()[0]))
+}
+
+func TestDialAddr(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer := newPeer(name, "", randomPeerUID(defaultRand{}), 0, randomPeerShortID(defaultRand{}, peerShortIDBits))
+	require.Equal(t, "10.0.0.1:6783", dialAddr(peer, "10.0.0.1", 6783))
+	peer.ListenAddrs = []string{"10.0.0.2:1000", "[::]:2000"}
+	require.Equal(t, "10.0.0.1:2000", dialAddr(peer, "10.0.0.1", 6783))
+	peer.ListenAddrs = []string{"10.0.0.1:1000", "0.0.0.0:2000"}
+	require.Equal(t, "10.0.0.1:1000", dialAddr(peer, "10.0.0.1", 6783))
+}
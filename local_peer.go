@@ -1,7 +1,7 @@
 package mesh
 
 import (
-	"encoding/gob"
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -18,9 +18,12 @@ type localPeer struct {
 	sync.RWMutex
 	*Peer
 	router                *Router
+	shortIDBits           uint
 	actionChan            chan<- localPeerAction
+	powerChan             chan<- PowerMode
+	stopChan              chan struct{}
 	topologyUpdates       peerNameSet
-	timer                 *time.Timer
+	timer                 Timer
 	pendingTopologyUpdate bool
 }
 
@@ -30,16 +33,25 @@ type localPeerAction func()
 // newLocalPeer returns a usable LocalPeer.
 func newLocalPeer(name PeerName, nickName string, router *Router) *localPeer {
 	actionChan := make(chan localPeerAction, ChannelSize)
+	powerChan := make(chan PowerMode)
+	stopChan := make(chan struct{})
 	topologyUpdates := make(peerNameSet)
+	shortIDBits := uint(peerShortIDBits)
+	if router != nil {
+		shortIDBits = router.shortIDBits()
+	}
 	peer := &localPeer{
-		Peer:            newPeer(name, nickName, randomPeerUID(), 0, randomPeerShortID()),
+		Peer:            newPeer(name, nickName, randomPeerUID(router.rng()), 0, randomPeerShortID(router.rng(), shortIDBits)),
 		router:          router,
+		shortIDBits:     shortIDBits,
 		actionChan:      actionChan,
+		powerChan:       powerChan,
+		stopChan:        stopChan,
 		topologyUpdates: topologyUpdates,
-		timer:           time.NewTimer(deferTopologyUpdateDuration),
+		timer:           router.clock().NewTimer(deferTopologyUpdateDuration),
 	}
 	peer.timer.Stop()
-	go peer.actorLoop(actionChan)
+	go peer.actorLoop(actionChan, powerChan, stopChan)
 	return peer
 }
 
@@ -87,26 +99,56 @@ func (peer *localPeer) ConnectionsTo(names []PeerName) []Connection {
 }
 
 // createConnection creates a new connection, originating from
-// localAddr, to peerAddr. If acceptNewPeer is false, peerAddr must
+// localAddr, to peerAddr, which may be a WebSocket URL. If acceptNewPeer is false, peerAddr must
 // already be a member of the mesh.
 func (peer *localPeer) createConnection(localAddr string, peerAddr string, acceptNewPeer bool, logger Logger) error {
+	return peer.createConnectionContext(peer.router.ctx, localAddr, peerAddr, acceptNewPeer, logger)
+}
+
+// createConnectionContext is createConnection, abandoning dialling when
+// ctx is done.
+func (peer *localPeer) createConnectionContext(ctx context.Context, localAddr string, peerAddr string, acceptNewPeer bool, logger Logger) error {
 	if err := peer.checkConnectionLimit(); err != nil {
 		return err
 	}
+	if peer.router.departing() {
+		return errRouterDeparting
+	}
 	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
 	if err != nil {
 		return err
 	}
-	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", peerAddr)
+	var remoteTCPAddr *net.TCPAddr
+	if !isWebSocketURL(peerAddr) && peer.router.DialVia == nil {
+		if remoteTCPAddr, err = net.ResolveTCPAddr("tcp", peerAddr); err != nil {
+			return err
+		}
+		localTCPAddr, err = peer.router.sourceAddr(localTCPAddr, remoteTCPAddr.IP)
+	} else {
+		localTCPAddr, err = peer.router.sourceAddr(localTCPAddr, nil)
+	}
 	if err != nil {
 		return err
 	}
-	tcpConn, err := net.DialTCP("tcp", localTCPAddr, remoteTCPAddr)
+	var dialer Dialer = peer.router.natDialer(localTCPAddr)
+	var via string
+	if peer.router.DialVia != nil {
+		dialer, via = peer.router.DialVia, describeDialer(peer.router.DialVia)
+	}
+	var conn net.Conn
+	if isWebSocketURL(peerAddr) {
+		conn, err = dialWebSocket(ctx, dialer, peerAddr, peer.router.WebSocketTLS, peer.router.handshakeTimeout())
+	} else if via != "" {
+		// the proxy resolves the address, which we may be unable to
+		conn, err = dialer.DialContext(ctx, "tcp", peerAddr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", remoteTCPAddr.String())
+	}
 	if err != nil {
 		return err
 	}
 	connRemote := newRemoteConnection(peer.Peer, nil, peerAddr, true, false)
-	startLocalConnection(connRemote, tcpConn, peer.router, acceptNewPeer, logger)
+	startLocalConnection(connRemote, conn, via, nil, peer.router, acceptNewPeer, logger)
 	return nil
 }
 
@@ -138,7 +180,7 @@ func (peer *localPeer) doDeleteConnection(conn ourConnection) {
 	<-resultChan
 }
 
-func (peer *localPeer) encode(enc *gob.Encoder) {
+func (peer *localPeer) encode(enc topologyEncoder) {
 	peer.RLock()
 	defer peer.RUnlock()
 	peer.Peer.encode(enc)
@@ -146,24 +188,82 @@ func (peer *localPeer) encode(enc *gob.Encoder) {
 
 // ACTOR server
 
-func (peer *localPeer) actorLoop(actionChan <-chan localPeerAction) {
-	gossipInterval := defaultGossipInterval
+// stop stops the actor, for a router which failed to start.
+func (peer *localPeer) stop() {
+	close(peer.stopChan)
+}
+
+func (peer *localPeer) actorLoop(actionChan <-chan localPeerAction, powerChan <-chan PowerMode, stopChan <-chan struct{}) {
+	mode := PowerNormal
 	if peer.router != nil {
-		gossipInterval = peer.router.gossipInterval()
+		mode = peer.router.PowerMode()
 	}
-	gossipTimer := time.Tick(gossipInterval)
+	gossipTicker, antiEntropyTicker := peer.gossipTickers(mode)
+	clock := peer.router.clock()
+	var lastAntiEntropy time.Time
 	for {
+		var gossipTimer, antiEntropyTimer <-chan time.Time
+		if gossipTicker != nil {
+			gossipTimer = gossipTicker.Chan()
+		}
+		if antiEntropyTicker != nil {
+			antiEntropyTimer = antiEntropyTicker.Chan()
+		}
 		select {
 		case action := <-actionChan:
 			action()
 		case <-gossipTimer:
 			peer.router.sendAllGossip()
-		case <-peer.timer.C:
+			if interval, enabled := peer.router.antiEntropyInterval(); enabled && mode == PowerLow && clock.Now().Sub(lastAntiEntropy) >= interval {
+				// batched with gossip, so as to wake up less
+				peer.router.sendAntiEntropy()
+				lastAntiEntropy = clock.Now()
+			}
+		case <-antiEntropyTimer:
+			peer.router.sendAntiEntropy()
+			lastAntiEntropy = clock.Now()
+		case mode = <-powerChan:
+			if gossipTicker != nil {
+				gossipTicker.Stop()
+			}
+			if antiEntropyTicker != nil {
+				antiEntropyTicker.Stop()
+			}
+			gossipTicker, antiEntropyTicker = peer.gossipTickers(mode)
+		case <-peer.timer.Chan():
 			peer.broadcastPendingTopologyUpdates()
+		case <-stopChan:
+			if gossipTicker != nil {
+				gossipTicker.Stop()
+			}
+			if antiEntropyTicker != nil {
+				antiEntropyTicker.Stop()
+			}
+			return
 		}
 	}
 }
 
+// gossipTickers returns the tickers of periodic gossip and, if it is
+// enabled and has a timer of its own in mode, anti-entropy. Peers
+// without a router, as in tests, gossip neither.
+func (peer *localPeer) gossipTickers(mode PowerMode) (gossip, antiEntropy Ticker) {
+	if peer.router == nil {
+		return nil, nil
+	}
+	gossipInterval := peer.router.gossipInterval()
+	if mode == PowerLow {
+		gossipInterval = peer.router.lowPowerGossipInterval()
+	}
+	gossip = peer.router.clock().NewTicker(gossipInterval)
+	if mode != PowerLow {
+		if interval, enabled := peer.router.antiEntropyInterval(); enabled {
+			antiEntropy = peer.router.clock().NewTicker(interval)
+		}
+	}
+	return
+}
+
 func (peer *localPeer) broadcastPendingTopologyUpdates() {
 	peer.Lock()
 	gossipData := peer.topologyUpdates
@@ -202,11 +302,12 @@ func (peer *localPeer) handleAddConnection(conn ourConnection, isRestartedPeer b
 			return dupErr
 		}
 	}
-	if err := peer.checkConnectionLimit(); err != nil {
+	if err := peer.makeRoomFor(conn); err != nil {
 		return err
 	}
 	_, isConnectedPeer := peer.router.Routes.Unicast(toName)
 	peer.addConnection(conn)
+	peer.router.Peers.watchers.publish(diffConnections(peer.Peer, nil, map[PeerName]Connection{toName: conn}))
 	switch {
 	case isRestartedPeer:
 		conn.logf("connection added (restarted peer)")
@@ -233,6 +334,7 @@ func (peer *localPeer) handleConnectionEstablished(conn ourConnection) {
 	}
 	peer.connectionEstablished(conn)
 	conn.logf("connection fully established")
+	peer.router.connectionEstablished(conn)
 
 	peer.router.Routes.recalculate()
 	peer.broadcastPeerUpdate()
@@ -250,6 +352,7 @@ func (peer *localPeer) handleDeleteConnection(conn ourConnection) {
 		return
 	}
 	peer.deleteConnection(conn)
+	peer.router.Peers.watchers.publish(diffConnections(peer.Peer, map[PeerName]Connection{toName: conn}, nil))
 	conn.logf("connection deleted")
 	// Must do garbage collection first to ensure we don't send out an
 	// update with unreachable peers (can cause looping)
@@ -286,6 +389,32 @@ func (peer *localPeer) checkConnectionLimit() error {
 	return nil
 }
 
+// makeRoomFor checks the connection limit before conn is added. With a
+// PeerScorer, rather than being refused, conn displaces our
+// lowest-scoring connection if its peer scores higher.
+func (peer *localPeer) makeRoomFor(conn ourConnection) error {
+	err := peer.checkConnectionLimit()
+	if err == nil || peer.router.PeerScorer == nil {
+		return err
+	}
+	var (
+		worst      ourConnection
+		worstScore float64
+	)
+	for _, c := range peer.connections {
+		if score := peer.router.scoreNeighbour(c.Remote().Name); worst == nil || score < worstScore {
+			worst, worstScore = c.(ourConnection), score
+		}
+	}
+	if worst == nil || peer.router.scoreNeighbour(conn.Remote().Name) <= worstScore {
+		return err
+	}
+	conn.logf("displacing connection to %s", worst.Remote())
+	worst.shutdown(fmt.Errorf("Displaced by connection to %s", conn.Remote()))
+	peer.handleDeleteConnection(worst)
+	return nil
+}
+
 func (peer *localPeer) addConnection(conn Connection) {
 	peer.Lock()
 	defer peer.Unlock()
@@ -312,6 +441,41 @@ func (peer *localPeer) connectionCount() int {
 	return len(peer.connections)
 }
 
+// SetNickName changes our nickname, e.g. after a DNS change, and
+// propagates it to our peers, which see a PeerRenamed event.
+func (peer *localPeer) SetNickName(nickName string) {
+	unlock := peer.lockWithPeers()
+	if peer.NickName == nickName {
+		unlock()
+		return
+	}
+	peer.setNickName(nickName)
+	peer.Version++
+	unlock()
+	peer.broadcastPeerUpdate()
+}
+
+// lockWithPeers locks ourself, after Peers if we have a router, to
+// change those of our fields which are also read holding only the
+// Peers lock, like those of any other peer. It returns the function
+// to unlock both.
+func (peer *localPeer) lockWithPeers() (unlock func()) {
+	var peers *Peers
+	if peer.router != nil {
+		peers = peer.router.Peers
+	}
+	if peers != nil {
+		peers.Lock()
+	}
+	peer.Lock()
+	return func() {
+		peer.Unlock()
+		if peers != nil {
+			peers.Unlock()
+		}
+	}
+}
+
 func (peer *localPeer) setShortID(shortID PeerShortID) {
 	peer.Lock()
 	defer peer.Unlock()
@@ -319,6 +483,12 @@ func (peer *localPeer) setShortID(shortID PeerShortID) {
 	peer.Version++
 }
 
+func (peer *localPeer) version() uint64 {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.Version
+}
+
 func (peer *localPeer) setVersionBeyond(version uint64) bool {
 	peer.Lock()
 	defer peer.Unlock()
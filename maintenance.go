@@ -0,0 +1,104 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// How long there must have been no transit traffic through a
+	// draining peer before it is considered drained. This allows for
+	// the other peers to learn of the draining, and re-route.
+	drainQuietPeriod = 3 * time.Second
+
+	// How often a draining peer checks whether it has drained.
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+var errDrainTimeout = errors.New("timed out waiting for transit traffic to drain")
+
+// maintenance tracks the transit traffic through a router, i.e. the
+// gossip it relays on behalf of other peers.
+type maintenance struct {
+	sync.Mutex
+	lastTransit time.Time
+}
+
+func (m *maintenance) transit(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.lastTransit = now
+}
+
+func (m *maintenance) sinceTransit(now time.Time) time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return now.Sub(m.lastTransit)
+}
+
+// EnterMaintenance puts the router into maintenance mode, in
+// preparation for stopping it. It marks our peer as draining, which is
+// gossiped to the other peers so they route around it where they can,
+// then waits until no transit traffic has passed through the router for
+// a while. A nil result means it is safe to stop the router. Otherwise
+// the error is errDrainTimeout, if transit traffic has not ceased within
+// drainTimeout, or ctx.Err(). A zero drainTimeout means wait for ctx.
+//
+// Unicast traffic to and from this peer continues to flow, as does
+// transit traffic which cannot be routed any other way.
+func (router *Router) EnterMaintenance(ctx context.Context, drainTimeout time.Duration) error {
+	router.Ourself.setDraining(true)
+	router.Routes.recalculate()
+	// Traffic routed before other peers learn of the draining counts
+	// towards the quiet period, so start it afresh.
+	router.maintenance.transit(router.clock().Now())
+
+	var timeout <-chan time.Time
+	if drainTimeout > 0 {
+		timer := router.clock().NewTimer(drainTimeout)
+		defer timer.Stop()
+		timeout = timer.Chan()
+	}
+	ticker := router.clock().NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for router.maintenance.sinceTransit(router.clock().Now()) < drainQuietPeriod {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return errDrainTimeout
+		case <-ticker.Chan():
+		}
+	}
+	router.logger.Printf("Drained transit traffic; safe to stop")
+	return nil
+}
+
+// LeaveMaintenance takes the router out of maintenance mode, so other
+// peers may route through it again.
+func (router *Router) LeaveMaintenance() {
+	router.Ourself.setDraining(false)
+	router.Routes.recalculate()
+}
+
+// noteTransit records that c relayed traffic on behalf of other peers.
+func (c *GossipChannel) noteTransit() {
+	c.countRelayed()
+	if c.ourself.router != nil {
+		c.ourself.router.maintenance.transit(c.clock().Now())
+	}
+}
+
+func (peer *localPeer) setDraining(draining bool) {
+	peer.Lock()
+	if peer.Draining == draining {
+		peer.Unlock()
+		return
+	}
+	peer.Draining = draining
+	peer.Version++
+	peer.Unlock()
+	peer.broadcastPeerUpdate()
+}
@@ -0,0 +1,54 @@
+package mesh
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDiamond creates routers r1 to r4, where r1 reaches r3 via
+// either r2 or r4, and returns them along with a function returning
+// r1's next hop to r3.
+func newTestDiamond(t *testing.T) ([]*Router, func() PeerName) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r1, r4)
+	addTestGossipConnection(t, r4, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2, r4), r4.tp(r1, r3))
+
+	return routers, func() PeerName {
+		r1.Routes.ensureRecalculated()
+		hop, found := r1.Routes.UnicastAll(r3.Ourself.Name)
+		require.True(t, found)
+		return hop
+	}
+}
+
+func TestMaintenanceReroutes(t *testing.T) {
+	routers, route := newTestDiamond(t)
+	r1, r2, r4 := routers[0], routers[1], routers[3]
+	require.Equal(t, r2.Ourself.Name, route())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, r2.EnterMaintenance(ctx, 0))
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.True(t, r1.Peers.Fetch(r2.Ourself.Name).Draining)
+	require.Equal(t, r4.Ourself.Name, route())
+
+	// the draining peer itself is still reachable
+	hop, _ := r1.Routes.UnicastAll(r2.Ourself.Name)
+	require.Equal(t, r2.Ourself.Name, hop)
+
+	r2.LeaveMaintenance()
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.Equal(t, r2.Ourself.Name, route())
+}
@@ -0,0 +1,414 @@
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Zero-configuration discovery of the peers on a network segment, by
+// multicast DNS (RFC 6762) service discovery (RFC 6763). Each peer
+// announces an instance of the mesh service, whose SRV record gives the
+// port it listens on, and whose TXT record gives its name, nickname and
+// MeshID; its address is the source of the announcement.
+
+const (
+	defaultMDNSService  = "_weavemesh._tcp"
+	defaultMDNSInterval = time.Minute
+
+	// Announcements are valid for this many intervals, so that an
+	// announcement or two can be lost.
+	mdnsLifetimeIntervals = 3
+
+	mdnsMaxMessageSize = 9000
+
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSConfig configures discovery by multicast DNS.
+type MDNSConfig struct {
+	// Service is the DNS-SD service type announced and browsed for;
+	// empty means "_weavemesh._tcp". Peers find only those which have
+	// the same Service and MeshID.
+	Service string
+	// Interface to announce on and browse; nil means the system's
+	// choice.
+	Interface *net.Interface
+	// Interval between announcements; zero means one minute. Peers
+	// which haven't been heard from for three intervals are forgotten.
+	Interval time.Duration
+}
+
+// DiscoverMDNS announces our peer on the local network segment by
+// multicast DNS, and makes the peers announced by others the targets of
+// SourceMDNS, until ctx is done or the router stops, when it announces
+// our departure.
+func (router *Router) DiscoverMDNS(ctx context.Context, config MDNSConfig) error {
+	conn, err := net.ListenMulticastUDP("udp4", config.Interface, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	go router.discoverMDNS(ctx, config, conn, mdnsGroup)
+	return nil
+}
+
+// mdnsAnnouncement is a peer announced by a received message.
+type mdnsAnnouncement struct {
+	target string        // the address to connect to
+	ttl    time.Duration // zero for a departure
+}
+
+// discoverMDNS runs DiscoverMDNS, sending to group over conn.
+func (router *Router) discoverMDNS(ctx context.Context, config MDNSConfig, conn net.PacketConn, group net.Addr) {
+	if config.Service == "" {
+		config.Service = defaultMDNSService
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultMDNSInterval
+	}
+	service := config.Service + ".local"
+	send := func(msg *dnsMessage) {
+		if _, err := conn.WriteTo(msg.encode(), group); err != nil {
+			router.logger.Printf("mDNS discovery: %v", err)
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	queries := make(chan struct{}, 1)
+	announcements := make(chan []mdnsAnnouncement)
+	go func() {
+		buf := make([]byte, mdnsMaxMessageSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := decodeDNSMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			if !msg.response {
+				if msg.asks(service) {
+					select {
+					case queries <- struct{}{}:
+					default:
+					}
+				}
+				continue
+			}
+			if found := router.mdnsAnnouncements(msg, service, from); len(found) > 0 {
+				select {
+				case announcements <- found:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	lifetime := config.Interval * mdnsLifetimeIntervals
+	found := make(map[string]time.Time) // target -> expiry
+	reconcile := func() {
+		targets := make([]string, 0, len(found))
+		for target, expiry := range found {
+			if router.clock().Now().After(expiry) {
+				delete(found, target)
+				continue
+			}
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, err := range router.ConnectionMaker.ReconcileTargets(SourceMDNS, targets) {
+			router.logger.Printf("mDNS discovery: %v", err)
+		}
+	}
+	ticker := router.clock().NewTicker(config.Interval)
+	defer ticker.Stop()
+	send(&dnsMessage{questions: []dnsQuestion{{service, dnsTypePTR}}})
+	send(router.mdnsAnnouncement(service, lifetime))
+	for {
+		select {
+		case <-ticker.Chan():
+			send(router.mdnsAnnouncement(service, lifetime))
+			reconcile()
+		case <-queries:
+			send(router.mdnsAnnouncement(service, lifetime))
+		case announced := <-announcements:
+			for _, a := range announced {
+				if a.ttl == 0 {
+					delete(found, a.target)
+				} else {
+					found[a.target] = router.clock().Now().Add(a.ttl)
+				}
+			}
+			reconcile()
+		case <-ctx.Done():
+			send(router.mdnsAnnouncement(service, 0))
+			conn.Close()
+			return
+		case <-router.ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+// mdnsAnnouncement returns the announcement of our peer as an instance
+// of service, valid for ttl.
+func (router *Router) mdnsAnnouncement(service string, ttl time.Duration) *dnsMessage {
+	instance := router.Ourself.Name.String() + "." + service
+	host := strings.Replace(router.Ourself.Name.String(), ":", "", -1) + ".local"
+	secs := uint32(ttl / time.Second)
+	return &dnsMessage{response: true, records: []dnsRecord{
+		{name: service, rrtype: dnsTypePTR, ttl: secs, target: instance},
+		{name: instance, rrtype: dnsTypeSRV, ttl: secs, target: host, port: uint16(router.listenPort())},
+		{name: instance, rrtype: dnsTypeTXT, ttl: secs, txt: []string{
+			"name=" + router.Ourself.Name.String(),
+			"nick=" + router.Ourself.nickName(),
+			"mesh=" + router.MeshID,
+		}},
+	}}
+}
+
+// mdnsAnnouncements returns the peers other than ourself which msg,
+// received from from, announces as instances of service.
+func (router *Router) mdnsAnnouncements(msg *dnsMessage, service string, from net.Addr) []mdnsAnnouncement {
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	srvs := make(map[string]dnsRecord)
+	txts := make(map[string]map[string]string)
+	for _, rec := range msg.records {
+		switch rec.rrtype {
+		case dnsTypeSRV:
+			srvs[rec.name] = rec
+		case dnsTypeTXT:
+			txts[rec.name] = parseTXT(rec.txt)
+		}
+	}
+	var found []mdnsAnnouncement
+	for _, rec := range msg.records {
+		if rec.rrtype != dnsTypePTR || !strings.EqualFold(rec.name, service) {
+			continue
+		}
+		srv, ok := srvs[rec.target]
+		txt := txts[rec.target]
+		if !ok || txt == nil || txt["mesh"] != router.MeshID {
+			continue
+		}
+		if name, err := PeerNameFromString(txt["name"]); err != nil || name == router.Ourself.Name {
+			continue
+		}
+		found = append(found, mdnsAnnouncement{
+			target: net.JoinHostPort(udpAddr.IP.String(), strconv.Itoa(int(srv.port))),
+			ttl:    time.Duration(srv.ttl) * time.Second,
+		})
+	}
+	return found
+}
+
+func parseTXT(strs []string) map[string]string {
+	txt := make(map[string]string)
+	for _, s := range strs {
+		if i := strings.IndexByte(s, '='); i > 0 {
+			txt[s[:i]] = s[i+1:]
+		}
+	}
+	return txt
+}
+
+// Minimal DNS message support, enough for service discovery.
+
+type dnsMessage struct {
+	response  bool
+	questions []dnsQuestion
+	records   []dnsRecord // answers, authorities and additionals alike
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type dnsRecord struct {
+	name   string
+	rrtype uint16
+	ttl    uint32
+	target string   // of PTR and SRV records
+	port   uint16   // of SRV records
+	txt    []string // of TXT records
+}
+
+// asks returns whether msg asks for instances of service.
+func (msg *dnsMessage) asks(service string) bool {
+	for _, q := range msg.questions {
+		if q.qtype == dnsTypePTR && strings.EqualFold(q.name, service) {
+			return true
+		}
+	}
+	return false
+}
+
+func (msg *dnsMessage) encode() []byte {
+	buf := make([]byte, 12)
+	if msg.response {
+		binary.BigEndian.PutUint16(buf[2:], 0x8400) // response, authoritative
+	}
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(msg.questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(msg.records)))
+	for _, q := range msg.questions {
+		buf = appendDNSName(buf, q.name)
+		buf = appendUint16(buf, q.qtype)
+		buf = appendUint16(buf, dnsClassIN)
+	}
+	for _, rec := range msg.records {
+		buf = appendDNSName(buf, rec.name)
+		buf = appendUint16(buf, rec.rrtype)
+		buf = appendUint16(buf, dnsClassIN)
+		buf = appendUint16(buf, uint16(rec.ttl>>16))
+		buf = appendUint16(buf, uint16(rec.ttl))
+		var data []byte
+		switch rec.rrtype {
+		case dnsTypePTR:
+			data = appendDNSName(nil, rec.target)
+		case dnsTypeSRV:
+			data = appendUint16(make([]byte, 4), rec.port) // zero priority and weight
+			data = appendDNSName(data, rec.target)
+		case dnsTypeTXT:
+			for _, s := range rec.txt {
+				data = append(append(data, byte(len(s))), s...)
+			}
+		}
+		buf = appendUint16(buf, uint16(len(data)))
+		buf = append(buf, data...)
+	}
+	return buf
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			continue
+		}
+		buf = append(append(buf, byte(len(label))), label...)
+	}
+	return append(buf, 0)
+}
+
+func decodeDNSMessage(buf []byte) (*dnsMessage, error) {
+	if len(buf) < 12 {
+		return nil, fmt.Errorf("truncated DNS message")
+	}
+	msg := &dnsMessage{response: buf[2]&0x80 != 0}
+	qdcount := int(binary.BigEndian.Uint16(buf[4:]))
+	rrcount := int(binary.BigEndian.Uint16(buf[6:])) + int(binary.BigEndian.Uint16(buf[8:])) + int(binary.BigEndian.Uint16(buf[10:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(buf, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(buf) {
+			return nil, fmt.Errorf("truncated DNS question")
+		}
+		msg.questions = append(msg.questions, dnsQuestion{name, binary.BigEndian.Uint16(buf[next:])})
+		off = next + 4
+	}
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readDNSName(buf, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(buf) {
+			return nil, fmt.Errorf("truncated DNS record")
+		}
+		rec := dnsRecord{
+			name:   name,
+			rrtype: binary.BigEndian.Uint16(buf[next:]),
+			ttl:    binary.BigEndian.Uint32(buf[next+4:]),
+		}
+		start := next + 10
+		end := start + int(binary.BigEndian.Uint16(buf[next+8:]))
+		if end > len(buf) {
+			return nil, fmt.Errorf("truncated DNS record")
+		}
+		switch rec.rrtype {
+		case dnsTypePTR:
+			if rec.target, _, err = readDNSName(buf, start); err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if end-start < 7 {
+				return nil, fmt.Errorf("truncated SRV record")
+			}
+			rec.port = binary.BigEndian.Uint16(buf[start+4:])
+			if rec.target, _, err = readDNSName(buf, start+6); err != nil {
+				return nil, err
+			}
+		case dnsTypeTXT:
+			for data := buf[start:end]; len(data) > 0; {
+				n := int(data[0])
+				if 1+n > len(data) {
+					return nil, fmt.Errorf("truncated TXT record")
+				}
+				rec.txt = append(rec.txt, string(data[1:1+n]))
+				data = data[1+n:]
+			}
+		}
+		msg.records = append(msg.records, rec)
+		off = end
+	}
+	return msg, nil
+}
+
+// readDNSName reads the possibly compressed name at off in buf,
+// returning it and the offset following it.
+func readDNSName(buf []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(buf) {
+			return "", 0, fmt.Errorf("truncated DNS name")
+		}
+		n := int(buf[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xC0 == 0xC0:
+			if off+2 > len(buf) {
+				return "", 0, fmt.Errorf("truncated DNS name")
+			}
+			if jumps++; jumps > len(buf) {
+				return "", 0, fmt.Errorf("DNS name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(buf[off:]) & 0x3FFF)
+		default:
+			if off+1+n > len(buf) {
+				return "", 0, fmt.Errorf("truncated DNS name")
+			}
+			labels = append(labels, string(buf[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
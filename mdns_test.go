@@ -0,0 +1,57 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSMessageCodec(t *testing.T) {
+	msg := &dnsMessage{response: true, records: []dnsRecord{
+		{name: "_svc._tcp.local", rrtype: dnsTypePTR, ttl: 120, target: "a._svc._tcp.local"},
+		{name: "a._svc._tcp.local", rrtype: dnsTypeSRV, ttl: 120, target: "a.local", port: 6783},
+		{name: "a._svc._tcp.local", rrtype: dnsTypeTXT, ttl: 120, txt: []string{"name=a", "mesh="}},
+	}}
+	decoded, err := decodeDNSMessage(msg.encode())
+	require.NoError(t, err)
+	require.Equal(t, msg, decoded)
+
+	// a query for _svc._tcp.local, followed by a compressed pointer to it
+	query := []byte{0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0,
+		4, '_', 's', 'v', 'c', 4, '_', 't', 'c', 'p', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, dnsTypePTR, 0, 1,
+		0xC0, 12, 0, dnsTypeSRV, 0, 1}
+	decoded, err = decodeDNSMessage(query)
+	require.NoError(t, err)
+	require.Equal(t, []dnsQuestion{{"_svc._tcp.local", dnsTypePTR}, {"_svc._tcp.local", dnsTypeSRV}}, decoded.questions)
+	require.True(t, decoded.asks("_SVC._tcp.local"))
+
+	_, err = decodeDNSMessage(query[:len(query)-6])
+	require.Error(t, err)
+}
+
+func TestDiscoverMDNS(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+
+	// Stand in for the multicast group by sending each router's
+	// messages straight to the other.
+	conn1, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	conn2, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r1.discoverMDNS(ctx, MDNSConfig{}, conn1, conn2.LocalAddr())
+	go r2.discoverMDNS(ctx, MDNSConfig{}, conn2, conn1.LocalAddr())
+
+	waitUntil(t, func() bool {
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+	require.Contains(t, r1.ConnectionMaker.Targets(false), fmt.Sprintf("127.0.0.1:%d", r2.listenPort()))
+}
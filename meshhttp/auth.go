@@ -0,0 +1,376 @@
+package meshhttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// The headers carrying the credentials of a request; see SignRequest.
+const (
+	HeaderPeer = "X-Mesh-Peer"
+	HeaderAuth = "X-Mesh-Auth"
+)
+
+const (
+	defaultMaxClockSkew = 30 * time.Second
+
+	// Bodies larger than this aren't accepted by Authenticate.
+	maxSignedBody = 1 << 20
+
+	// Unless configured otherwise, each remote address may make this
+	// many times the requests of each peer, to allow for peers sharing
+	// an address.
+	defaultAddressRateFactor = 10
+
+	// The buckets of remote addresses are pruned of those which are
+	// full once there are this many, and of the least recently used if
+	// none is.
+	maxAddressBuckets = 1024
+)
+
+// AuthConfig configures Authenticate.
+type AuthConfig struct {
+	// Authorize decides whether the authenticated peer may make the
+	// request. Nil allows any peer known to the router. Peers are
+	// authenticated by the keys they advertise in the topology, which
+	// any member of the mesh can forge, so Authorize distinguishes
+	// peers from outsiders, but not from each other.
+	Authorize func(peer mesh.PeerName, r *http.Request) bool
+
+	// RequestsPerSecond limits the rate of the requests of each peer;
+	// zero means unlimited. Burst is how many requests a peer may make
+	// at once after a quiet period; zero means one.
+	RequestsPerSecond float64
+	Burst             int
+
+	// AddressRequestsPerSecond and AddressBurst limit the requests from
+	// each remote address likewise, before their credentials, which are
+	// costly to check, are checked, so that clients without any can't
+	// make us check them without limit. Zero means ten times
+	// RequestsPerSecond and Burst respectively.
+	AddressRequestsPerSecond float64
+	AddressBurst             int
+
+	// MaxClockSkew bounds the age of the signature of a request, and
+	// how far in the future it may be. Zero means 30s.
+	MaxClockSkew time.Duration
+
+	// Audit, if not nil, is called for every request, whether or not it
+	// is allowed.
+	Audit func(AuditRecord)
+}
+
+// AuditRecord describes a request to endpoints wrapped by Authenticate.
+type AuditRecord struct {
+	Time       time.Time
+	Peer       mesh.PeerName // UnknownPeerName unless authenticated
+	RemoteAddr string
+	Method     string
+	Path       string
+	Status     int
+	Reason     string // why the request was refused, if it was
+}
+
+// SignRequest adds credentials to req, to be sent to the endpoints of
+// the peer named server wrapped by Authenticate, showing that it comes
+// from router's peer. The credentials are sealed for server with the
+// router's key, and cover the method, URL and body of the request and
+// the time, so they can't be used for another request, or replayed.
+func SignRequest(req *http.Request, router *mesh.Router, server mesh.PeerName) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sealed, err := router.Seal(server, requestStamp(req, body, time.Now()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderPeer, router.Ourself.Name.String())
+	req.Header.Set(HeaderAuth, base64.StdEncoding.EncodeToString(sealed))
+	return nil
+}
+
+// requestStamp is what is sealed to authenticate a request.
+func requestStamp(req *http.Request, body []byte, now time.Time) []byte {
+	hash := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("%s %s %x %d", req.Method, req.URL.RequestURI(), hash, now.UnixNano()))
+}
+
+// parseStampTime checks that stamp is for req, returning its time.
+func parseStampTime(stamp []byte, req *http.Request, body []byte) (time.Time, bool) {
+	i := bytes.LastIndexByte(stamp, ' ')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(string(stamp[i+1:]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t := time.Unix(0, nanos)
+	return t, bytes.Equal(stamp, requestStamp(req, body, t))
+}
+
+// Authenticate returns middleware admitting only requests signed, with
+// SignRequest, by a peer the router knows, as authorized and within the
+// rate limit of config. Refused requests get 401 Unauthorized, 403
+// Forbidden or 429 Too Many Requests.
+//
+// Authentication relies on the public keys the peers advertise in the
+// topology, so it is only as trustworthy as the mesh is closed; use it
+// with a mesh password or trust bundle. Even then, a member of the mesh
+// can advertise another peer's name with its own key, as it can to
+// read unicasts sealed for that peer, so it keeps out outsiders, not
+// insiders.
+func Authenticate(router *mesh.Router, config AuthConfig) Middleware {
+	auth := &authenticator{
+		router:    router,
+		config:    config,
+		seen:      make(map[string]struct{}),
+		buckets:   make(map[mesh.PeerName]*requestBucket),
+		addresses: make(map[string]*requestBucket),
+	}
+	if auth.config.MaxClockSkew <= 0 {
+		auth.config.MaxClockSkew = defaultMaxClockSkew
+	}
+	if auth.config.AddressRequestsPerSecond <= 0 {
+		auth.config.AddressRequestsPerSecond = defaultAddressRateFactor * auth.config.RequestsPerSecond
+	}
+	if auth.config.AddressBurst <= 0 {
+		auth.config.AddressBurst = defaultAddressRateFactor * auth.config.Burst
+	}
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth.serve(handler, w, r)
+		})
+	}
+}
+
+type authenticator struct {
+	sync.Mutex
+	router    *mesh.Router
+	config    AuthConfig
+	seen      map[string]struct{} // credentials already used
+	expiries  []seenCredentials   // seen, in the order they were used
+	buckets   map[mesh.PeerName]*requestBucket
+	addresses map[string]*requestBucket
+}
+
+// seenCredentials are credentials used, which can be forgotten once
+// they have expired.
+type seenCredentials struct {
+	credentials string
+	expires     time.Time
+}
+
+func (auth *authenticator) serve(handler http.Handler, w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	record := AuditRecord{Time: now, Peer: mesh.UnknownPeerName, RemoteAddr: r.RemoteAddr, Method: r.Method, Path: r.URL.Path}
+	refuse := func(status int, reason string) {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, reason, status)
+		record.Status, record.Reason = status, reason
+		auth.audit(record)
+	}
+
+	if !auth.allowAddress(r.RemoteAddr, now) {
+		refuse(http.StatusTooManyRequests, "too many requests")
+		return
+	}
+	peer, err := mesh.PeerNameFromString(r.Header.Get(HeaderPeer))
+	if err != nil {
+		refuse(http.StatusUnauthorized, "missing or malformed "+HeaderPeer)
+		return
+	}
+	sealed, err := base64.StdEncoding.DecodeString(r.Header.Get(HeaderAuth))
+	if err != nil || len(sealed) == 0 {
+		refuse(http.StatusUnauthorized, "missing or malformed "+HeaderAuth)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+	if err != nil {
+		refuse(http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	stamp, err := auth.router.Open(peer, sealed)
+	if err != nil {
+		refuse(http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	signed, ok := parseStampTime(stamp, r, body)
+	if !ok {
+		refuse(http.StatusUnauthorized, "credentials are for another request")
+		return
+	}
+	if skew := now.Sub(signed); skew > auth.config.MaxClockSkew || -skew > auth.config.MaxClockSkew {
+		refuse(http.StatusUnauthorized, "credentials expired")
+		return
+	}
+	record.Peer = peer
+	if !auth.fresh(string(sealed), now) {
+		refuse(http.StatusUnauthorized, "credentials already used")
+		return
+	}
+	if auth.config.Authorize != nil && !auth.config.Authorize(peer, r) {
+		refuse(http.StatusForbidden, "forbidden")
+		return
+	}
+	if !auth.allow(peer, now) {
+		refuse(http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler.ServeHTTP(recorder, r)
+	record.Status = recorder.status
+	auth.audit(record)
+}
+
+func (auth *authenticator) audit(record AuditRecord) {
+	if auth.config.Audit != nil {
+		auth.config.Audit(record)
+	}
+}
+
+// fresh records the use of credentials, returning false if they have
+// been used before. Credentials are accepted for MaxClockSkew either
+// side of when they were signed, so are forgotten twice that after
+// they were first used, when they have certainly expired.
+func (auth *authenticator) fresh(credentials string, now time.Time) bool {
+	auth.Lock()
+	defer auth.Unlock()
+	for len(auth.expiries) > 0 && now.After(auth.expiries[0].expires) {
+		delete(auth.seen, auth.expiries[0].credentials)
+		auth.expiries = auth.expiries[1:]
+	}
+	if _, found := auth.seen[credentials]; found {
+		return false
+	}
+	auth.seen[credentials] = struct{}{}
+	auth.expiries = append(auth.expiries, seenCredentials{credentials, now.Add(2 * auth.config.MaxClockSkew)})
+	return true
+}
+
+func (auth *authenticator) allow(peer mesh.PeerName, now time.Time) bool {
+	if auth.config.RequestsPerSecond <= 0 {
+		return true
+	}
+	auth.Lock()
+	defer auth.Unlock()
+	bucket, found := auth.buckets[peer]
+	if !found {
+		bucket = newRequestBucket(auth.config.Burst, now)
+		auth.buckets[peer] = bucket
+	}
+	return bucket.take(auth.config.RequestsPerSecond, now)
+}
+
+// allowAddress applies the limit of the requests from the host of
+// remoteAddr.
+func (auth *authenticator) allowAddress(remoteAddr string, now time.Time) bool {
+	rate := auth.config.AddressRequestsPerSecond
+	if rate <= 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	auth.Lock()
+	defer auth.Unlock()
+	bucket, found := auth.addresses[host]
+	if !found {
+		if len(auth.addresses) >= maxAddressBuckets {
+			auth.pruneAddresses(rate, now)
+		}
+		bucket = newRequestBucket(auth.config.AddressBurst, now)
+		auth.addresses[host] = bucket
+	}
+	return bucket.take(rate, now)
+}
+
+// pruneAddresses makes room for the bucket of another address, by
+// deleting the full buckets, which are no different from new ones, or
+// else the least recently used, whose address is then limited afresh.
+func (auth *authenticator) pruneAddresses(rate float64, now time.Time) {
+	var oldest string
+	var oldestBucket *requestBucket
+	for address, b := range auth.addresses {
+		if b.full(rate, now) {
+			delete(auth.addresses, address)
+		} else if oldestBucket == nil || b.last.Before(oldestBucket.last) {
+			oldest, oldestBucket = address, b
+		}
+	}
+	if len(auth.addresses) >= maxAddressBuckets {
+		delete(auth.addresses, oldest)
+	}
+}
+
+// requestBucket is a token bucket of requests.
+type requestBucket struct {
+	tokens, burst float64
+	last          time.Time
+}
+
+func newRequestBucket(burst int, now time.Time) *requestBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &requestBucket{tokens: float64(burst), burst: float64(burst), last: now}
+}
+
+// full returns true if the bucket would be full at now.
+func (b *requestBucket) full(rate float64, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= b.burst
+}
+
+func (b *requestBucket) take(rate float64, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// String formats the record as a line of an audit log.
+func (record AuditRecord) String() string {
+	s := fmt.Sprintf("%s peer=%s remote=%s %s %s %d", record.Time.Format(time.RFC3339), record.Peer, record.RemoteAddr, record.Method, record.Path, record.Status)
+	if record.Reason != "" {
+		s += " reason=" + strings.Replace(record.Reason, " ", "_", -1)
+	}
+	return s
+}
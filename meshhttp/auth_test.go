@@ -0,0 +1,138 @@
+package meshhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// testPeerName returns a name which is valid whatever the flavour of
+// peer names.
+func testPeerName(t *testing.T) mesh.PeerName {
+	nameBytes := make([]byte, mesh.NameSize)
+	nameBytes[len(nameBytes)-1] = 1
+	name, err := mesh.PeerNameFromBytes(nameBytes)
+	require.NoError(t, err)
+	return name
+}
+
+func TestAuthenticate(t *testing.T) {
+	name := testPeerName(t)
+	router, err := mesh.NewRouter(mesh.Config{}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+
+	var audit []AuditRecord
+	mux := http.NewServeMux()
+	Mount(mux, router, MountConfig{
+		Middleware: map[Endpoint]Middleware{
+			EndpointAdmin: Authenticate(router, AuthConfig{
+				Authorize: func(peer mesh.PeerName, r *http.Request) bool {
+					return r.URL.Path != "/forget"
+				},
+				RequestsPerSecond: 0.001,
+				Burst:             2,
+				Audit:             func(record AuditRecord) { audit = append(audit, record) },
+			}),
+		},
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	newRequest := func(path string, peers ...string) *http.Request {
+		form := url.Values{"peer": peers}
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	do := func(req *http.Request) int {
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	signed := func(path string, peers ...string) *http.Request {
+		req := newRequest(path, peers...)
+		require.NoError(t, SignRequest(req, router, router.Ourself.Name))
+		return req
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do(newRequest("/connect", "10.0.0.1:6783")))
+	require.Empty(t, router.ConnectionMaker.Targets(false))
+
+	req := signed("/connect", "10.0.0.1:6783")
+	auth := req.Header.Get(HeaderAuth)
+	require.Equal(t, http.StatusNoContent, do(req))
+	require.Equal(t, []string{"10.0.0.1:6783"}, router.ConnectionMaker.Targets(false))
+
+	// the credentials can't be replayed, nor used for another request
+	replay := newRequest("/connect", "10.0.0.1:6783")
+	replay.Header.Set(HeaderPeer, router.Ourself.Name.String())
+	replay.Header.Set(HeaderAuth, auth)
+	require.Equal(t, http.StatusUnauthorized, do(replay))
+	tampered := newRequest("/connect", "10.0.0.2:6783")
+	tampered.Header.Set(HeaderPeer, router.Ourself.Name.String())
+	tampered.Header.Set(HeaderAuth, auth)
+	require.Equal(t, http.StatusUnauthorized, do(tampered))
+
+	require.Equal(t, http.StatusForbidden, do(signed("/forget", "10.0.0.1:6783")))
+	require.Equal(t, http.StatusNoContent, do(signed("/connect", "10.0.0.2:6783")))
+	require.Equal(t, http.StatusTooManyRequests, do(signed("/connect", "10.0.0.3:6783")))
+
+	require.Len(t, audit, 7)
+	require.Equal(t, mesh.UnknownPeerName, audit[0].Peer)
+	require.Equal(t, http.StatusUnauthorized, audit[0].Status)
+	require.Equal(t, router.Ourself.Name, audit[1].Peer)
+	require.Equal(t, http.StatusNoContent, audit[1].Status)
+	require.Equal(t, "forbidden", audit[4].Reason)
+}
+
+func TestAuthenticateLimitsAddresses(t *testing.T) {
+	name := testPeerName(t)
+	router, err := mesh.NewRouter(mesh.Config{}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+
+	auth := Authenticate(router, AuthConfig{AddressRequestsPerSecond: 0.001, AddressBurst: 1})
+	handler := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/connect", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(HeaderPeer, name.String())
+		req.Header.Set(HeaderAuth, "Zm9yZ2Vk")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// credentials aren't checked once an address is over its limit,
+	// whatever its port
+	require.Equal(t, http.StatusUnauthorized, do("10.0.0.1:1000"))
+	require.Equal(t, http.StatusTooManyRequests, do("10.0.0.1:1001"))
+	require.Equal(t, http.StatusUnauthorized, do("10.0.0.2:1000"))
+}
+
+func TestAllowAddressBounded(t *testing.T) {
+	auth := &authenticator{
+		config:    AuthConfig{AddressRequestsPerSecond: 0.001, AddressBurst: 2},
+		addresses: make(map[string]*requestBucket),
+	}
+	now := time.Now()
+	address := func(i int) string { return fmt.Sprintf("10.0.%d.%d:6783", i>>8, i&0xff) }
+	// buckets which have been used, so aren't full, are evicted least
+	// recently used first
+	for i := 0; i < 2*maxAddressBuckets; i++ {
+		require.True(t, auth.allowAddress(address(i), now.Add(time.Duration(i)*time.Millisecond)))
+	}
+	require.Len(t, auth.addresses, maxAddressBuckets)
+	require.NotContains(t, auth.addresses, "10.0.0.0")
+	require.Contains(t, auth.addresses, "10.0.7.255")
+}
@@ -0,0 +1,109 @@
+// Package meshhttp provides an HTTP handler for inspecting and
+// controlling a mesh router.
+package meshhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/weaveworks/mesh"
+)
+
+// NewHandler returns a handler serving the following endpoints, relative
+// to wherever it is mounted; use http.StripPrefix to mount it under a
+// path other than the root.
+//
+//	GET  /status   the router's mesh.Status, as JSON
+//	GET  /peers    descriptions of all known peers, as JSON
+//	POST /connect  connect to the addresses given by the "peer" form
+//	               values; if "replace" is true, forget all others. If
+//	               any address is invalid, none are connected to, and
+//	               the errors are returned, as JSON
+//	POST /forget   forget the addresses given by the "peer" form values
+//
+// The handler performs no authentication of its own.
+func NewHandler(router *mesh.Router) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/status", statusHandler(router))
+	mux.Handle("/peers", peersHandler(router))
+	mux.Handle("/connect", connectHandler(router))
+	mux.Handle("/forget", forgetHandler(router))
+	return mux
+}
+
+func statusHandler(router *mesh.Router) http.HandlerFunc {
+	return get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mesh.NewStatus(router))
+	})
+}
+
+func peersHandler(router *mesh.Router) http.HandlerFunc {
+	return get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, router.Peers.Descriptions())
+	})
+}
+
+func connectHandler(router *mesh.Router) http.HandlerFunc {
+	return post(func(w http.ResponseWriter, r *http.Request) {
+		replace, _ := strconv.ParseBool(r.Form.Get("replace"))
+		if errs := router.ConnectionMaker.CheckTargets(r.Form["peer"]); len(errs) > 0 {
+			writeErrors(w, http.StatusBadRequest, errs)
+			return
+		}
+		// addresses which resolved a moment ago may no longer
+		if errs := router.ConnectionMaker.InitiateConnections(r.Form["peer"], replace); len(errs) > 0 {
+			writeErrors(w, http.StatusInternalServerError, errs)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func forgetHandler(router *mesh.Router) http.HandlerFunc {
+	return post(func(w http.ResponseWriter, r *http.Request) {
+		router.ConnectionMaker.ForgetConnections(r.Form["peer"])
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func get(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeErrors(w http.ResponseWriter, status int, errs []error) {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct{ Errors []string }{messages})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
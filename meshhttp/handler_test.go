@@ -0,0 +1,55 @@
+package meshhttp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestHandler(t *testing.T) {
+	name := testPeerName(t)
+	router, err := mesh.NewRouter(mesh.Config{}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	server := httptest.NewServer(NewHandler(router))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/status")
+	require.NoError(t, err)
+	var status mesh.Status
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	require.Equal(t, name.String(), status.Name)
+
+	resp, err = http.Get(server.URL + "/connect")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.PostForm(server.URL+"/connect", url.Values{"peer": {"10.0.0.1:6783", "not an address:x:y"}})
+	require.NoError(t, err)
+	var result struct{ Errors []string }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Len(t, result.Errors, 1)
+	require.Empty(t, router.ConnectionMaker.Targets(false))
+
+	resp, err = http.PostForm(server.URL+"/connect", url.Values{"peer": {"10.0.0.1:6783"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, []string{"10.0.0.1:6783"}, router.ConnectionMaker.Targets(false))
+
+	resp, err = http.PostForm(server.URL+"/forget", url.Values{"peer": {"10.0.0.1:6783"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Empty(t, router.ConnectionMaker.Targets(false))
+}
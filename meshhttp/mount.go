@@ -0,0 +1,206 @@
+package meshhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Endpoint identifies a group of the endpoints mounted by Mount, so that
+// each may be given its own Middleware.
+type Endpoint string
+
+// The groups of endpoints mounted by Mount.
+const (
+	// EndpointStatus is GET /status and GET /peers, as for NewHandler.
+	EndpointStatus Endpoint = "status"
+	// EndpointMetrics is GET /metrics, in the Prometheus text format.
+	EndpointMetrics Endpoint = "metrics"
+	// EndpointHealth is GET /health, which responds 200 OK unless we
+	// have connection targets but no established connections, when it
+	// responds 503 Service Unavailable.
+	EndpointHealth Endpoint = "health"
+	// EndpointPprof is the net/http/pprof endpoints, under /debug/pprof/.
+	EndpointPprof Endpoint = "pprof"
+	// EndpointAdmin is POST /connect and POST /forget, as for NewHandler.
+	EndpointAdmin Endpoint = "admin"
+)
+
+// Middleware wraps a handler, e.g. to authenticate requests.
+type Middleware func(http.Handler) http.Handler
+
+// MountConfig configures Mount.
+type MountConfig struct {
+	// Prefix is prepended to the paths of all endpoints, e.g. "/mesh".
+	Prefix string
+
+	// Middleware wraps the endpoints in each group; groups without an
+	// entry use DefaultMiddleware. Groups mapped to nil are not mounted.
+	Middleware map[Endpoint]Middleware
+
+	// DefaultMiddleware wraps the endpoints of groups not in Middleware.
+	// Nil means no wrapping.
+	DefaultMiddleware Middleware
+}
+
+func (config MountConfig) wrap(endpoint Endpoint, handler http.Handler) (http.Handler, bool) {
+	middleware, found := config.Middleware[endpoint]
+	if !found {
+		middleware = config.DefaultMiddleware
+	} else if middleware == nil {
+		return nil, false
+	}
+	if middleware != nil {
+		handler = middleware(handler)
+	}
+	return handler, true
+}
+
+// Mount registers the operational endpoints of router on mux, so that
+// applications embedding mesh can serve them alongside their own. As
+// with NewHandler, authentication is left to the caller, via
+// config.Middleware; the admin and pprof endpoints in particular should
+// not be exposed without it.
+func Mount(mux *http.ServeMux, router *mesh.Router, config MountConfig) {
+	prefix := strings.TrimSuffix(config.Prefix, "/")
+	handle := func(endpoint Endpoint, path string, handler http.Handler) {
+		if handler, ok := config.wrap(endpoint, handler); ok {
+			mux.Handle(prefix+path, handler)
+		}
+	}
+	handle(EndpointStatus, "/status", statusHandler(router))
+	handle(EndpointStatus, "/peers", peersHandler(router))
+	handle(EndpointMetrics, "/metrics", metricsHandler(router))
+	handle(EndpointHealth, "/health", healthHandler(router))
+	// pprof.Index expects to be served at /debug/pprof/ exactly.
+	handle(EndpointPprof, "/debug/pprof/", http.StripPrefix(prefix, http.HandlerFunc(pprof.Index)))
+	handle(EndpointPprof, "/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+	handle(EndpointPprof, "/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+	handle(EndpointPprof, "/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+	handle(EndpointPprof, "/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	handle(EndpointAdmin, "/connect", connectHandler(router))
+	handle(EndpointAdmin, "/forget", forgetHandler(router))
+}
+
+func healthHandler(router *mesh.Router) http.HandlerFunc {
+	return get(func(w http.ResponseWriter, r *http.Request) {
+		status := mesh.NewStatus(router)
+		established := 0
+		for _, conn := range status.Connections {
+			if conn.State == "established" {
+				established++
+			}
+		}
+		if established == 0 && len(status.Targets) > 0 {
+			http.Error(w, "no established connections", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok: %d established connections\n", established)
+	})
+}
+
+func metricsHandler(router *mesh.Router) http.HandlerFunc {
+	return get(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, mesh.NewStatus(router))
+	})
+}
+
+// writeMetrics writes status in the Prometheus text exposition format.
+func writeMetrics(w http.ResponseWriter, status *mesh.Status) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("mesh_peers", "gauge", "Number of peers in the mesh, including ourself.")
+	fmt.Fprintf(w, "mesh_peers %d\n", len(status.Peers))
+
+	states := make(map[string]int)
+	for _, conn := range status.Connections {
+		states[conn.State]++
+	}
+	metric("mesh_connections", "gauge", "Number of local connections and connection attempts, by state.")
+	for _, state := range sortedKeys(states) {
+		fmt.Fprintf(w, "mesh_connections{state=%q} %d\n", state, states[state])
+	}
+
+	metric("mesh_connection_terminations_total", "counter", "Number of local connections which have terminated.")
+	fmt.Fprintf(w, "mesh_connection_terminations_total %d\n", status.TerminationCount)
+
+	for _, counter := range []struct {
+		name, help string
+		value      func(*mesh.ConnectionStats) uint64
+	}{
+		{"mesh_connection_sent_bytes_total", "Bytes sent on a local connection.", func(s *mesh.ConnectionStats) uint64 { return s.BytesSent }},
+		{"mesh_connection_received_bytes_total", "Bytes received on a local connection.", func(s *mesh.ConnectionStats) uint64 { return s.BytesReceived }},
+		{"mesh_connection_sent_messages_total", "Messages sent on a local connection.", func(s *mesh.ConnectionStats) uint64 { return s.MessagesSent }},
+		{"mesh_connection_received_messages_total", "Messages received on a local connection.", func(s *mesh.ConnectionStats) uint64 { return s.MessagesReceived }},
+	} {
+		metric(counter.name, "counter", counter.help)
+		for _, conn := range status.Connections {
+			if conn.Stats != nil {
+				fmt.Fprintf(w, "%s{peer=%q,address=%q} %d\n", counter.name, conn.Peer, conn.Address, counter.value(conn.Stats))
+			}
+		}
+	}
+
+	metric("mesh_gossip_sent_bytes_total", "counter", "Gossip bytes sent to a directly connected peer, by channel.")
+	for _, usage := range status.BandwidthUsage {
+		fmt.Fprintf(w, "mesh_gossip_sent_bytes_total{peer=%q,channel=%q} %d\n", usage.Peer, usage.Channel, usage.Total.BytesSent)
+	}
+	metric("mesh_gossip_received_bytes_total", "counter", "Gossip bytes received from a directly connected peer, by channel.")
+	for _, usage := range status.BandwidthUsage {
+		fmt.Fprintf(w, "mesh_gossip_received_bytes_total{peer=%q,channel=%q} %d\n", usage.Peer, usage.Channel, usage.Total.BytesReceived)
+	}
+	metric("mesh_gossip_dropped_total", "counter", "Gossip updates for a directly connected peer dropped from full queues, by channel.")
+	for _, usage := range status.BandwidthUsage {
+		fmt.Fprintf(w, "mesh_gossip_dropped_total{peer=%q,channel=%q} %d\n", usage.Peer, usage.Channel, usage.Dropped)
+	}
+	metric("mesh_gossip_ttl_exceeded_total", "counter", "Gossip frames not relayed because their TTL was exhausted, by channel.")
+	channels := make([]string, 0, len(status.TTLExceeded))
+	for channel := range status.TTLExceeded {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		fmt.Fprintf(w, "mesh_gossip_ttl_exceeded_total{channel=%q} %d\n", channel, status.TTLExceeded[channel])
+	}
+	metric("mesh_gossip_dead_letters_dropped_total", "counter", "Unicasts from other peers which couldn't be relayed, by channel.")
+	for _, stats := range status.DeadLetters {
+		fmt.Fprintf(w, "mesh_gossip_dead_letters_dropped_total{channel=%q} %d\n", stats.Channel, stats.Dropped)
+	}
+	metric("mesh_gossip_dead_letters_returned_total", "counter", "Unicasts sent from here returned as undeliverable, by channel.")
+	for _, stats := range status.DeadLetters {
+		fmt.Fprintf(w, "mesh_gossip_dead_letters_returned_total{channel=%q} %d\n", stats.Channel, stats.Returned)
+	}
+	metric("mesh_gossip_panics_total", "counter", "Panics in Gossipers, each quarantining its channel, by channel.")
+	channels = channels[:0]
+	for channel := range status.GossipPanics {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		fmt.Fprintf(w, "mesh_gossip_panics_total{channel=%q} %d\n", channel, status.GossipPanics[channel])
+	}
+	metric("mesh_surrogate_buffered_bytes", "gauge", "Bytes of recent updates remembered for channels relayed but not registered, by channel.")
+	for _, surrogate := range status.Surrogates {
+		fmt.Fprintf(w, "mesh_surrogate_buffered_bytes{channel=%q} %d\n", surrogate.Channel, surrogate.Bytes)
+	}
+	metric("mesh_surrogate_evicted_total", "counter", "Updates evicted from the memory of channels relayed but not registered, by channel.")
+	for _, surrogate := range status.Surrogates {
+		fmt.Fprintf(w, "mesh_surrogate_evicted_total{channel=%q} %d\n", surrogate.Channel, surrogate.Evicted)
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package meshhttp
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestMount(t *testing.T) {
+	name := testPeerName(t)
+	router, err := mesh.NewRouter(mesh.Config{}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+
+	var defaulted []string
+	requireToken := func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+	mux := http.NewServeMux()
+	Mount(mux, router, MountConfig{
+		Prefix: "/mesh/",
+		Middleware: map[Endpoint]Middleware{
+			EndpointAdmin: requireToken,
+			EndpointPprof: nil,
+		},
+		DefaultMiddleware: func(handler http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defaulted = append(defaulted, r.URL.Path)
+				handler.ServeHTTP(w, r)
+			})
+		},
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, _ := get("/mesh/status")
+	require.Equal(t, http.StatusOK, code)
+	code, body := get("/mesh/metrics")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, "mesh_peers 1\n")
+	code, _ = get("/mesh/health")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get("/mesh/debug/pprof/")
+	require.Equal(t, http.StatusNotFound, code)
+	require.Equal(t, []string{"/mesh/status", "/mesh/metrics", "/mesh/health"}, defaulted)
+
+	form := url.Values{"peer": {"10.0.0.1:6783"}}
+	resp, err := http.PostForm(server.URL+"/mesh/connect", form)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Empty(t, router.ConnectionMaker.Targets(false))
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/mesh/connect", nil)
+	require.NoError(t, err)
+	req.URL.RawQuery = form.Encode()
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, []string{"10.0.0.1:6783"}, router.ConnectionMaker.Targets(false))
+
+	// with a target but no connections, we're unhealthy
+	code, _ = get("/mesh/health")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -0,0 +1,174 @@
+package mesh
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+)
+
+// Limits on a peer's multicast groups, which are gossiped with every
+// topology update that includes the peer.
+const (
+	maxGroups       = 64
+	maxGroupNameLen = 64
+)
+
+// Neighbours which advertise this feature understand
+// ProtocolGossipMulticast frames.
+const featureMulticast = "multicast"
+
+// JoinGroup makes us a member of the multicast group, so that we receive
+// what peers multicast to it; see GossipChannel.GossipMulticast. Groups
+// are mesh-wide, rather than per channel.
+func (router *Router) JoinGroup(group string) error {
+	if group == "" || len(group) > maxGroupNameLen {
+		return fmt.Errorf("invalid group name %q", group)
+	}
+	return router.Ourself.setGroup(group, true)
+}
+
+// LeaveGroup stops us being a member of the multicast group.
+func (router *Router) LeaveGroup(group string) error {
+	return router.Ourself.setGroup(group, false)
+}
+
+func (peer *localPeer) setGroup(group string, member bool) error {
+	peer.Lock()
+	i := sort.SearchStrings(peer.Groups, group)
+	found := i < len(peer.Groups) && peer.Groups[i] == group
+	if found == member {
+		peer.Unlock()
+		return nil
+	}
+	// Groups is replaced rather than modified, since it is read
+	// without locking this peer.
+	groups := make([]string, 0, len(peer.Groups)+1)
+	if member {
+		if len(peer.Groups) >= maxGroups {
+			peer.Unlock()
+			return fmt.Errorf("already a member of the maximum of %d groups", maxGroups)
+		}
+		groups = append(append(append(groups, peer.Groups[:i]...), group), peer.Groups[i:]...)
+	} else {
+		groups = append(append(groups, peer.Groups[:i]...), peer.Groups[i+1:]...)
+	}
+	peer.Groups = groups
+	peer.Version++
+	peer.Unlock()
+	peer.broadcastPeerUpdate()
+	return nil
+}
+
+// inGroup returns whether peer is a member of group.
+func (peer *Peer) inGroup(group string) bool {
+	i := sort.SearchStrings(peer.Groups, group)
+	return i < len(peer.Groups) && peer.Groups[i] == group
+}
+
+// groupMembers returns the names of the members of group, other than
+// ourselves.
+func (c *GossipChannel) groupMembers(group string) []PeerName {
+	var members []PeerName
+	c.ourself.router.Peers.forEach(func(peer *Peer) {
+		if peer.Name != c.ourself.Name && peer.inGroup(group) {
+			members = append(members, peer.Name)
+		}
+	})
+	return members
+}
+
+// GossipMulticast relays update to the members of group, other than
+// ourselves, which receive it as a broadcast, in OnGossipBroadcast.
+// Unlike GossipBroadcast, it only reaches peers which are members, or
+// relay to them: each frame carries the members it is yet to reach,
+// and each peer relays it towards them by their unicast routes, so
+// the frames follow a spanning tree pruned of the branches without
+// members. Peers which predate multicasts don't understand these
+// frames, so the members beyond them are sent update as unicasts
+// instead, which they receive in OnGossipUnicast.
+func (c *GossipChannel) GossipMulticast(group string, update GossipData) {
+	members := c.groupMembers(group)
+	if len(members) == 0 || c.isClosed() {
+		return
+	}
+	for _, msg := range update.Encode() {
+		c.relayMulticast(c.ourself.Name, group, members, msg, c.stampTTL(gossipFrameMeta{}))
+	}
+}
+
+// relayMulticast relays payload, from srcName, towards each of members,
+// sending it once to each of the next hops of their unicast routes,
+// along with the members it leads to, or, if the next hop predates
+// multicasts, as a unicast to each of them.
+func (c *GossipChannel) relayMulticast(srcName PeerName, group string, members []PeerName, payload []byte, meta gossipFrameMeta) {
+	byHop := make(map[PeerName][]PeerName)
+	for _, member := range members {
+		if hop, found := c.routes.UnicastAll(member); found && hop != UnknownPeerName {
+			byHop[hop] = append(byHop[hop], member)
+		}
+	}
+	for hop, members := range byHop {
+		conn, found := c.ourself.ConnectionTo(hop)
+		if !found {
+			continue
+		}
+		if !supportsFeature(conn, featureMulticast) {
+			for _, member := range members {
+				msg := protocolMsg{ProtocolGossipUnicast, gobEncode(c.name, srcName, member, payload, meta)}
+				if err := c.sendTo(conn, msg, frameRoute{srcName, member}); err != nil {
+					c.logf("unable to relay multicast to %s via %s: %v", member, hop, err)
+				}
+			}
+			continue
+		}
+		msg := protocolMsg{ProtocolGossipMulticast, gobEncode(c.name, srcName, group, members, payload, meta)}
+		if err := c.sendTo(conn, msg, frameRoute{origin: srcName}); err != nil {
+			c.logf("unable to relay multicast to %s: %v", hop, err)
+		}
+	}
+}
+
+// deliverMulticast delivers a multicast frame to our gossiper, if we
+// are one of the members it is for, and relays it towards the others.
+func (c *GossipChannel) deliverMulticast(sender, srcName PeerName, dec *gob.Decoder) error {
+	var (
+		group   string
+		members []PeerName
+		payload []byte
+	)
+	if err := dec.Decode(&group); err != nil {
+		return err
+	}
+	if err := dec.Decode(&members); err != nil {
+		return err
+	}
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+	meta, err := decodeFrameMeta(dec)
+	if err != nil {
+		return err
+	}
+	meta.sender, meta.received = sender, c.clock().Now()
+	others := make([]PeerName, 0, len(members))
+	member := false
+	for _, name := range members {
+		if name == c.ourself.Name {
+			member = true
+		} else {
+			others = append(others, name)
+		}
+	}
+	if member {
+		if _, err := c.onGossipBroadcast(srcName, payload, meta); err != nil {
+			c.reportError(srcName, err)
+			return err
+		}
+	}
+	if len(others) == 0 || !c.hop(&meta) {
+		return nil
+	}
+	c.noteTransit()
+	c.relayMulticast(srcName, group, others, payload, meta)
+	return nil
+}
@@ -0,0 +1,86 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type broadcastRecorder struct {
+	*testGossiper
+	received [][]byte
+	unicasts [][]byte
+}
+
+func (g *broadcastRecorder) OnGossipUnicast(src PeerName, msg []byte) error {
+	g.unicasts = append(g.unicasts, msg)
+	return nil
+}
+
+func (g *broadcastRecorder) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	g.received = append(g.received, update)
+	return g.testGossiper.OnGossipBroadcast(src, update)
+}
+
+func TestGossipMulticast(t *testing.T) {
+	// r1 is the hub of r2, r3, r4 and r6, and r5 hangs off r4;
+	// r3 and r5 are the members of the group
+	var routers []*Router
+	var gossipers []*broadcastRecorder
+	var channels []*GossipChannel
+	for _, name := range []string{"01:00:00:01:00:00", "02:00:00:02:00:00", "03:00:00:03:00:00", "04:00:00:04:00:00", "05:00:00:05:00:00", "06:00:00:06:00:00"} {
+		r := newTestRouter(t, name)
+		g := &broadcastRecorder{testGossiper: newTestGossiper()}
+		c, err := r.NewGossipChannel("Test", g, GossipChannelConfig{})
+		require.NoError(t, err)
+		routers, gossipers, channels = append(routers, r), append(gossipers, g), append(channels, c)
+	}
+	r1, r2, r3, r4, r5, r6 := routers[0], routers[1], routers[2], routers[3], routers[4], routers[5]
+	require.NoError(t, r3.JoinGroup("shard-1"))
+	require.NoError(t, r5.JoinGroup("shard-1"))
+	require.NoError(t, r5.JoinGroup("shard-2"))
+	require.Error(t, r5.JoinGroup(""))
+	for _, r := range []*Router{r2, r3, r4, r6} {
+		addTestGossipConnection(t, r1, r)
+	}
+	addTestGossipConnection(t, r4, r5)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3, r4, r6), r2.tp(r1), r3.tp(r1), r4.tp(r1, r5), r5.tp(r4), r6.tp(r1))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+	require.Equal(t, []string{"shard-1", "shard-2"}, r2.Peers.Fetch(r5.Ourself.Name).Groups)
+
+	received := func(r *Router) (total uint64) {
+		for _, usage := range r.BandwidthUsage() {
+			if usage.Channel == "Test" {
+				total += usage.Total.BytesReceived
+			}
+		}
+		return
+	}
+	r6Received := received(r6)
+	channels[1].GossipMulticast("shard-1", newSurrogateGossipData([]byte{1}))
+	for i, g := range gossipers {
+		if i == 2 || i == 4 {
+			require.Equal(t, [][]byte{{1}}, g.received, "member %d", i+1)
+		} else {
+			require.Empty(t, g.received, "non-member %d", i+1)
+		}
+	}
+	// the branch to r6 is pruned
+	require.Equal(t, r6Received, received(r6))
+
+	require.NoError(t, r3.LeaveGroup("shard-1"))
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3, r4, r6), r2.tp(r1), r3.tp(r1), r4.tp(r1, r5), r5.tp(r4), r6.tp(r1))
+	channels[1].GossipMulticast("shard-1", newSurrogateGossipData([]byte{2}))
+	require.Len(t, gossipers[2].received, 1)
+	require.Equal(t, [][]byte{{1}, {2}}, gossipers[4].received)
+
+	// r4 predates multicasts, so r1 unicasts to the members beyond it
+	conn, _ := r1.Ourself.ConnectionTo(r4.Ourself.Name)
+	conn.(*mockGossipConnection).legacy = true
+	channels[1].GossipMulticast("shard-1", newSurrogateGossipData([]byte{3}))
+	require.Equal(t, [][]byte{{1}, {2}}, gossipers[4].received)
+	require.Equal(t, [][]byte{{3}}, gossipers[4].unicasts)
+	require.Empty(t, gossipers[3].unicasts)
+}
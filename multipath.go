@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+type multipathRoutes map[PeerName][]PeerName
+
+// equalCostRoutes returns, for each peer reachable from peer, the first
+// hops of all the paths to it with the fewest hops, in order, leaving
+// out those through leaves, and through peers and connections which are
+// degraded or draining.
+//
+// NB: This function should generally be invoked while holding a read lock on
+// Peers and LocalPeer.
+func (peer *Peer) equalCostRoutes(establishedAndSymmetric bool) multipathRoutes {
+	distance := map[PeerName]int{peer.Name: 0}
+	hops := make(map[PeerName]map[PeerName]struct{})
+	worklist := []*Peer{peer}
+	for d := 1; len(worklist) > 0; d++ {
+		var nextWorklist []*Peer
+		for _, curPeer := range worklist {
+			if curPeer != peer && (curPeer.Leaf || curPeer.detour() > detourNone) {
+				continue
+			}
+			curPeer.forEachConnectedPeer(establishedAndSymmetric, nil, func(remotePeer *Peer) {
+				if connectionDetour(curPeer, remotePeer) > detourNone {
+					return
+				}
+				if dist, found := distance[remotePeer.Name]; !found {
+					distance[remotePeer.Name] = d
+					hops[remotePeer.Name] = make(map[PeerName]struct{})
+					nextWorklist = append(nextWorklist, remotePeer)
+				} else if dist < d {
+					return
+				}
+				// the hops to curPeer are complete, having been
+				// found at the previous distance
+				if curPeer == peer {
+					hops[remotePeer.Name][remotePeer.Name] = struct{}{}
+				}
+				for hop := range hops[curPeer.Name] {
+					hops[remotePeer.Name][hop] = struct{}{}
+				}
+			})
+		}
+		worklist = nextWorklist
+	}
+	routes := make(multipathRoutes, len(hops))
+	for name, set := range hops {
+		list := make([]PeerName, 0, len(set))
+		for hop := range set {
+			list = append(list, hop)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		routes[name] = list
+	}
+	return routes
+}
+
+// calculateMultipath returns the destinations for which there is more
+// than one next hop as good as that in unicast, and those hops.
+func (r *routes) calculateMultipath(unicast unicastRoutes) multipathRoutes {
+	multipath := make(multipathRoutes)
+	for name, hops := range r.ourself.equalCostRoutes(false) {
+		if len(hops) < 2 {
+			continue
+		}
+		// If the unicast route isn't one of them, it avoids something
+		// which these don't.
+		for _, hop := range hops {
+			if hop == unicast[name] {
+				multipath[name] = hops
+				break
+			}
+		}
+	}
+	return multipath
+}
+
+// UnicastAllFlow returns the next hop on a unicast route to the named
+// peer, based on all connections, for a flow, e.g. of the frames from
+// an origin on a channel, spreading flows across the next hops of all
+// the equal-cost routes if Config.Multipath is set, while keeping the
+// frames of each flow on one of them, and so in order.
+func (r *routes) UnicastAllFlow(name PeerName, flow string) (PeerName, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if hops := r.multipath[name]; len(hops) > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(flow))
+		return hops[h.Sum32()%uint32(len(hops))], true
+	}
+	hop, found := r.unicastAll[name]
+	return hop, found
+}
+
+// Multipath returns the next hops of the equal-cost routes to the named
+// peer, if there is more than one, based on all connections.
+func (r *routes) Multipath(name PeerName) []PeerName {
+	r.RLock()
+	defer r.RUnlock()
+	return r.multipath[name]
+}
@@ -0,0 +1,50 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipath(t *testing.T) {
+	// create the diamond r1 <-> r2 <-> r4, r1 <-> r3 <-> r4
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Multipath: true})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	addTestGossipConnection(t, r2, r4)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1, r4), r3.tp(r1, r4), r4.tp(r2, r3))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	require.Equal(t, []PeerName{r2.Ourself.Name, r3.Ourself.Name}, r1.Routes.Multipath(r4.Ourself.Name))
+	require.Empty(t, r1.Routes.Multipath(r2.Ourself.Name))
+	require.Empty(t, r2.Routes.Multipath(r3.Ourself.Name), "not configured")
+	require.Len(t, NewStatus(r1).MultipathRoutes, 1)
+
+	// flows are spread across the hops, each keeping to one
+	used := make(map[PeerName]struct{})
+	for i := 0; i < 20; i++ {
+		flow := fmt.Sprint("flow", i)
+		hop, found := r1.Routes.UnicastAllFlow(r4.Ourself.Name, flow)
+		require.True(t, found)
+		again, _ := r1.Routes.UnicastAllFlow(r4.Ourself.Name, flow)
+		require.Equal(t, hop, again)
+		used[hop] = struct{}{}
+	}
+	require.Len(t, used, 2)
+
+	// routes avoid degraded peers
+	r2.SetDegraded(true)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1, r4), r3.tp(r1, r4), r4.tp(r2, r3))
+	r1.Routes.ensureRecalculated()
+	require.Empty(t, r1.Routes.Multipath(r4.Ourself.Name))
+	hop, _ := r1.Routes.UnicastAllFlow(r4.Ourself.Name, "flow")
+	require.Equal(t, r3.Ourself.Name, hop)
+}
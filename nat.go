@@ -0,0 +1,476 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Peers behind NAT can dial out but can't be dialled, so they announce
+// themselves on the NAT channel, and peers which discover them don't
+// try. Instead:
+//
+//  - a reachable peer asks the NATed peer, by gossip unicast, to dial it
+//    back ("connection reversal"), at the addresses its neighbours see
+//    it at;
+//  - a NATed peer asks a neighbour which both it and the other NATed
+//    peer are connected to, the rendezvous, to introduce them. The
+//    rendezvous offers the introduction to the other peer, which asks
+//    for it in turn, and once both have asked, it tells each the
+//    address it sees the other at, and they punch through their NATs
+//    to each other. The peer with the greater name dials first,
+//    opening its NAT to the other, which then dials it. Peers only
+//    punch through to addresses from a rendezvous they asked.
+//
+// Peers behind NAT dial from their listening port, where supported, so
+// that the addresses their neighbours see them at are those of their
+// NAT's mapping of that port. Until a direct connection is made, or if
+// none can be, gossip between the peers is relayed by others as usual.
+
+// The name of the gossip channel on which peers behind NAT announce
+// themselves and traversal is coordinated.
+const natChannelName = internalChannelPrefix + "nat"
+
+const (
+	// How often a peer tries to reach each peer behind NAT.
+	natReachInterval = 10 * time.Second
+
+	// How long the peer which dials first waits for its dial to
+	// succeed, in case there is no NAT in the way after all.
+	natPrimeTimeout = 500 * time.Millisecond
+
+	// How long the other peer waits before dialling, and how many
+	// times it tries.
+	natPunchDelay    = time.Second
+	natPunchAttempts = 3
+
+	// How long introductions asked of a rendezvous, and of peers by
+	// the rendezvous, are awaited.
+	natIntroductionTimeout = natReachInterval
+)
+
+// NATConfig configures NAT traversal.
+type NATConfig struct {
+	// BehindNAT declares that this peer can't be dialled, so other
+	// peers ask it to dial them instead, or coordinate with it to
+	// punch through NAT. All peers should run a version of mesh
+	// supporting this.
+	BehindNAT bool
+}
+
+type natMessageKind uint8
+
+const (
+	natReverse   natMessageKind = iota // asks the recipient to dial the sender
+	natIntroduce                       // asks the recipient to introduce the sender to Target
+	natPunch                           // tells the recipient to punch through to Target at Addr
+	natOffer                           // tells the recipient Target asked the sender to introduce them
+)
+
+type natMessage struct {
+	Kind   natMessageKind
+	Port   int // the sender's listening port, of natReverse
+	Target PeerName
+	Addr   string
+}
+
+// natState is the state of the NAT channel: the peers behind NAT, by
+// the UID of the incarnation which announced it.
+type natState struct {
+	Peers map[PeerName]PeerUID
+}
+
+// Encode implements GossipData.
+func (state *natState) Encode() [][]byte {
+	return [][]byte{gobEncode(state)}
+}
+
+// Merge implements GossipData.
+func (state *natState) Merge(other GossipData) GossipData {
+	merged := &natState{Peers: make(map[PeerName]PeerUID, len(state.Peers))}
+	merged.merge(state)
+	merged.merge(other.(*natState))
+	return merged
+}
+
+// merge merges other into state, returning what changed, or nil.
+func (state *natState) merge(other *natState) *natState {
+	var delta *natState
+	for name, uid := range other.Peers {
+		if known, found := state.Peers[name]; found && known == uid {
+			continue
+		}
+		state.Peers[name] = uid
+		if delta == nil {
+			delta = &natState{Peers: make(map[PeerName]PeerUID)}
+		}
+		delta.Peers[name] = uid
+	}
+	return delta
+}
+
+// natIntroduction is a request, of a rendezvous, to introduce src to
+// target.
+type natIntroduction struct {
+	src, target PeerName
+}
+
+// natPending is an introduction we asked a rendezvous for.
+type natPending struct {
+	rendezvous PeerName
+	asked      time.Time
+}
+
+// natTraversal is the Gossiper of the NAT channel.
+type natTraversal struct {
+	sync.Mutex
+	router        *Router
+	state         natState
+	reached       map[PeerName]time.Time        // when we last tried to reach each peer
+	pending       map[PeerName]natPending       // introductions we asked for, by target
+	introductions map[natIntroduction]time.Time // asked of us, awaiting the target asking too
+	gossip        Gossip
+}
+
+func newNATTraversal(router *Router) *natTraversal {
+	nat := &natTraversal{
+		router:        router,
+		state:         natState{Peers: make(map[PeerName]PeerUID)},
+		reached:       make(map[PeerName]time.Time),
+		pending:       make(map[PeerName]natPending),
+		introductions: make(map[natIntroduction]time.Time),
+	}
+	if router.NAT.BehindNAT {
+		nat.state.Peers[router.Ourself.Name] = router.Ourself.UID
+	}
+	return nat
+}
+
+// behind reports whether peer has announced that it is behind NAT.
+func (nat *natTraversal) behind(peer *Peer) bool {
+	nat.Lock()
+	defer nat.Unlock()
+	uid, found := nat.state.Peers[peer.Name]
+	return found && uid == peer.UID
+}
+
+// forget drops a departed peer.
+func (nat *natTraversal) forget(name PeerName) {
+	nat.Lock()
+	defer nat.Unlock()
+	delete(nat.state.Peers, name)
+	delete(nat.reached, name)
+	delete(nat.pending, name)
+	for intro := range nat.introductions {
+		if intro.src == name || intro.target == name {
+			delete(nat.introductions, intro)
+		}
+	}
+}
+
+// reach tries to get a direct connection to peer, which is behind NAT,
+// unless it has tried recently.
+func (nat *natTraversal) reach(peer PeerName) {
+	nat.Lock()
+	if last, found := nat.reached[peer]; found && nat.router.clock().Now().Sub(last) < natReachInterval {
+		nat.Unlock()
+		return
+	}
+	nat.reached[peer] = nat.router.clock().Now()
+	nat.Unlock()
+	go nat.tryReach(peer)
+}
+
+func (nat *natTraversal) tryReach(peer PeerName) {
+	router := nat.router
+	if !router.NAT.BehindNAT {
+		port := router.listenPort()
+		if port == 0 {
+			return
+		}
+		router.Routes.ensureRecalculated()
+		if nat.send(peer, natMessage{Kind: natReverse, Port: port}) != nil {
+			nat.retry(peer)
+		}
+		return
+	}
+	var rendezvous PeerName
+	router.Peers.forEach(func(p *Peer) {
+		if rendezvous != UnknownPeerName || p == router.Ourself.Peer {
+			return
+		}
+		if _, found := p.connections[peer]; !found {
+			return
+		}
+		if _, found := router.Ourself.ConnectionTo(p.Name); found {
+			rendezvous = p.Name
+		}
+	})
+	router.Routes.ensureRecalculated()
+	if rendezvous == UnknownPeerName {
+		router.logger.Printf("[gossip %s]: no rendezvous for %s", natChannelName, peer)
+		nat.retry(peer)
+		return
+	}
+	nat.expect(peer, rendezvous)
+	if nat.send(rendezvous, natMessage{Kind: natIntroduce, Target: peer}) != nil {
+		nat.retry(peer)
+	}
+}
+
+// expect records that we asked rendezvous to introduce us to peer, so
+// that we punch through to peer when it does.
+func (nat *natTraversal) expect(peer, rendezvous PeerName) {
+	nat.Lock()
+	defer nat.Unlock()
+	nat.pending[peer] = natPending{rendezvous: rendezvous, asked: nat.router.clock().Now()}
+}
+
+// expected reports whether we recently asked rendezvous to introduce us
+// to peer, and forgets that we did.
+func (nat *natTraversal) expected(peer, rendezvous PeerName) bool {
+	nat.Lock()
+	defer nat.Unlock()
+	pending, found := nat.pending[peer]
+	if !found || pending.rendezvous != rendezvous {
+		return false
+	}
+	delete(nat.pending, peer)
+	return nat.router.clock().Now().Sub(pending.asked) < natIntroductionTimeout
+}
+
+// retry lets the next reach of peer try again straight away, since
+// this one didn't get started.
+func (nat *natTraversal) retry(peer PeerName) {
+	nat.Lock()
+	defer nat.Unlock()
+	delete(nat.reached, peer)
+}
+
+func (nat *natTraversal) send(dst PeerName, msg natMessage) error {
+	err := nat.gossip.GossipUnicast(dst, gobEncode(&msg))
+	if err != nil {
+		nat.router.logger.Printf("[gossip %s]: unable to send to %s: %v", natChannelName, dst, err)
+	}
+	return err
+}
+
+// connected reports whether we are directly connected to peer.
+func (nat *natTraversal) connected(peer PeerName) bool {
+	_, found := nat.router.Ourself.ConnectionTo(peer)
+	return found
+}
+
+// reverse dials peer, which asked us to because we are behind NAT, at
+// the addresses our neighbours see it at. We may not have heard of its
+// connections yet, so it tries a few times.
+func (nat *natTraversal) reverse(peer PeerName, port int) {
+	for attempt := 0; attempt < natPunchAttempts; attempt++ {
+		if attempt > 0 && !sleepContext(nat.router.ctx, nat.router.clock(), natPunchDelay) {
+			return
+		}
+		if nat.connected(peer) {
+			return
+		}
+		for _, addr := range nat.addrsOf(peer, port) {
+			nat.router.logger.Printf("->[%s] dialling %s behind NAT", addr, peer)
+			err := nat.router.Ourself.createConnection(nat.router.ConnectionMaker.localAddr, addr, false, nat.router.logger)
+			if err == nil {
+				return
+			}
+			nat.router.logger.Printf("->[%s] error dialling %s: %v", addr, peer, err)
+		}
+	}
+}
+
+// addrsOf returns the addresses our neighbours see peer at, with port
+// as its listening port.
+func (nat *natTraversal) addrsOf(peer PeerName, port int) []string {
+	var addrs []string
+	nat.router.Peers.forEach(func(p *Peer) {
+		conn, found := p.connections[peer]
+		if !found {
+			return
+		}
+		address := conn.remoteTCPAddress()
+		if conn.isOutbound() {
+			addrs = append(addrs, address)
+		} else if ip, _, err := net.SplitHostPort(address); err == nil {
+			addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(port)))
+		}
+	})
+	return addrs
+}
+
+// introduce tells src and target, which we are connected to, the
+// address we see the other at, once both have asked; until then, it
+// offers the introduction to target.
+func (nat *natTraversal) introduce(src, target PeerName) {
+	srcConn, found := nat.router.Ourself.ConnectionTo(src)
+	if !found {
+		return
+	}
+	targetConn, found := nat.router.Ourself.ConnectionTo(target)
+	if !found {
+		nat.router.logger.Printf("[gossip %s]: unable to introduce %s to %s: not connected", natChannelName, src, target)
+		return
+	}
+	if !nat.bothAsked(src, target) {
+		nat.send(target, natMessage{Kind: natOffer, Target: src})
+		return
+	}
+	nat.send(src, natMessage{Kind: natPunch, Target: target, Addr: targetConn.remoteTCPAddress()})
+	nat.send(target, natMessage{Kind: natPunch, Target: src, Addr: srcConn.remoteTCPAddress()})
+}
+
+// bothAsked reports whether target has recently asked us to introduce
+// it to src, now that src has asked likewise, or otherwise records that
+// src has.
+func (nat *natTraversal) bothAsked(src, target PeerName) bool {
+	nat.Lock()
+	defer nat.Unlock()
+	now := nat.router.clock().Now()
+	for intro, asked := range nat.introductions {
+		if now.Sub(asked) >= natIntroductionTimeout {
+			delete(nat.introductions, intro)
+		}
+	}
+	reverse := natIntroduction{src: target, target: src}
+	if _, found := nat.introductions[reverse]; found {
+		delete(nat.introductions, reverse)
+		return true
+	}
+	nat.introductions[natIntroduction{src: src, target: target}] = now
+	return false
+}
+
+// punch dials peer at addr, as introduced by a rendezvous. The peer with
+// the greater name dials once, briefly, to open its NAT to the other,
+// which then dials it.
+func (nat *natTraversal) punch(peer PeerName, addr string) {
+	router := nat.router
+	if router.Ourself.Name > peer {
+		ctx, cancel := context.WithTimeout(router.ctx, natPrimeTimeout)
+		defer cancel()
+		router.logger.Printf("->[%s] opening NAT to %s", addr, peer)
+		router.Ourself.createConnectionContext(ctx, router.ConnectionMaker.localAddr, addr, false, router.logger)
+		return
+	}
+	for attempt := 0; attempt < natPunchAttempts; attempt++ {
+		if !sleepContext(router.ctx, router.clock(), natPunchDelay) {
+			return
+		}
+		if nat.connected(peer) {
+			return
+		}
+		router.logger.Printf("->[%s] punching through NAT to %s", addr, peer)
+		err := router.Ourself.createConnection(router.ConnectionMaker.localAddr, addr, false, router.logger)
+		if err == nil {
+			return
+		}
+		router.logger.Printf("->[%s] error punching through NAT to %s: %v", addr, peer, err)
+	}
+}
+
+// OnGossipUnicast implements Gossiper.
+func (nat *natTraversal) OnGossipUnicast(src PeerName, msg []byte) error {
+	var m natMessage
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+		return err
+	}
+	switch m.Kind {
+	case natReverse:
+		if !nat.connected(src) {
+			go nat.reverse(src, m.Port)
+		}
+	case natIntroduce:
+		go nat.introduce(src, m.Target)
+	case natOffer:
+		// src, a rendezvous, was asked by Target to introduce it to us
+		if nat.router.NAT.BehindNAT && nat.connected(src) && !nat.connected(m.Target) {
+			nat.expect(m.Target, src)
+			go nat.send(src, natMessage{Kind: natIntroduce, Target: m.Target})
+		}
+	case natPunch:
+		if nat.router.NAT.BehindNAT && nat.expected(m.Target, src) && !nat.connected(m.Target) {
+			go nat.punch(m.Target, m.Addr)
+		}
+	default:
+		return fmt.Errorf("unknown NAT message kind %d from %s", m.Kind, src)
+	}
+	return nil
+}
+
+// OnGossipBroadcast implements Gossiper.
+func (nat *natTraversal) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	return nat.receive(update)
+}
+
+// Gossip implements Gossiper.
+func (nat *natTraversal) Gossip() GossipData {
+	nat.Lock()
+	defer nat.Unlock()
+	if len(nat.state.Peers) == 0 {
+		return nil
+	}
+	complete := &natState{Peers: make(map[PeerName]PeerUID, len(nat.state.Peers))}
+	for name, uid := range nat.state.Peers {
+		complete.Peers[name] = uid
+	}
+	return complete
+}
+
+// OnGossip implements Gossiper.
+func (nat *natTraversal) OnGossip(msg []byte) (GossipData, error) {
+	return nat.receive(msg)
+}
+
+// receive merges a received state, returning what was new to us, if
+// anything, and has the ConnectionMaker stop dialling any newly
+// announced peers.
+func (nat *natTraversal) receive(msg []byte) (GossipData, error) {
+	received := &natState{}
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(received); err != nil {
+		return nil, err
+	}
+	nat.Lock()
+	delta := nat.state.merge(received)
+	nat.Unlock()
+	if delta == nil {
+		return nil, nil
+	}
+	nat.router.ConnectionMaker.refresh()
+	return delta, nil
+}
+
+// listenPort returns the port we are listening on, or zero if we
+// aren't.
+func (router *Router) listenPort() int {
+	router.transportLock.Lock()
+	defer router.transportLock.Unlock()
+	if router.transport == nil {
+		return 0
+	}
+	return router.transport.Addr().(*net.TCPAddr).Port
+}
+
+// natDialer returns a dialer dialling from localAddr, or from our
+// listening port if we are behind NAT and it can be shared; see
+// NATConfig.
+func (router *Router) natDialer(localAddr *net.TCPAddr) *net.Dialer {
+	if !router.NAT.BehindNAT || !reusePortSupported {
+		return &net.Dialer{LocalAddr: localAddr}
+	}
+	router.transportLock.Lock()
+	shared := router.transport != nil && router.ownTransport
+	router.transportLock.Unlock()
+	if !shared {
+		return &net.Dialer{LocalAddr: localAddr}
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: localAddr.IP, Port: router.listenPort()}, Control: reusePort}
+}
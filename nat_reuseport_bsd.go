@@ -0,0 +1,11 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package mesh
+
+import "syscall"
+
+// reusePort lets a socket share its port with others which do too; see
+// NATConfig.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return setReusePort(c, syscall.SO_REUSEPORT)
+}
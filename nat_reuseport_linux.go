@@ -0,0 +1,14 @@
+// +build linux
+
+package mesh
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which package syscall lacks on Linux.
+const soReusePort = 0xf
+
+// reusePort lets a socket share its port with others which do too; see
+// NATConfig.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return setReusePort(c, soReusePort)
+}
@@ -0,0 +1,13 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package mesh
+
+import "syscall"
+
+// Peers behind NAT dial from ephemeral ports where sockets can't share
+// ports.
+const reusePortSupported = false
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
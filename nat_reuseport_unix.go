@@ -0,0 +1,19 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package mesh
+
+import "syscall"
+
+const reusePortSupported = true
+
+func setReusePort(c syscall.RawConn, option int) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, option, 1)
+		}
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
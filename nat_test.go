@@ -0,0 +1,131 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func connectTo(t *testing.T, r1, r2 *Router) {
+	target := fmt.Sprintf("127.0.0.1:%d", r2.listenPort())
+	require.Empty(t, r1.ConnectionMaker.InitiateConnections([]string{target}, false))
+	waitUntil(t, func() bool {
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+}
+
+func TestNATConnectionReversal(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	natted := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{NAT: NATConfig{BehindNAT: true}})
+	defer natted.Stop()
+	discoverer := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{PeerDiscovery: true})
+	defer discoverer.Stop()
+
+	connectTo(t, natted, r)
+	connectTo(t, discoverer, r)
+	waitUntil(t, func() bool {
+		_, found := natted.Ourself.ConnectionTo(discoverer.Ourself.Name)
+		return found
+	})
+	conn, _ := natted.Ourself.ConnectionTo(discoverer.Ourself.Name)
+	require.True(t, conn.isOutbound(), "the peer behind NAT should have dialled")
+}
+
+func TestNATHolePunching(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	config := Config{NAT: NATConfig{BehindNAT: true}, PeerDiscovery: true}
+	r1 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "03:00:00:03:00:00", config)
+	defer r2.Stop()
+
+	connectTo(t, r1, r)
+	connectTo(t, r2, r)
+	if reusePortSupported {
+		// peers behind NAT dial from their listening port
+		conn, _ := r.Ourself.ConnectionTo(r1.Ourself.Name)
+		require.Equal(t, fmt.Sprintf("127.0.0.1:%d", r1.listenPort()), conn.remoteTCPAddress())
+	}
+	waitUntil(t, func() bool {
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+}
+
+func TestNATStateMerge(t *testing.T) {
+	a := &natState{Peers: map[PeerName]PeerUID{1: 10}}
+	b := &natState{Peers: map[PeerName]PeerUID{1: 11, 2: 20}}
+	merged := a.Merge(b).(*natState)
+	require.Equal(t, map[PeerName]PeerUID{1: 11, 2: 20}, merged.Peers)
+	require.Equal(t, map[PeerName]PeerUID{1: 10}, a.Peers)
+	require.Nil(t, merged.merge(b))
+}
+
+func TestNATPunchOnlyWhenAsked(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{NAT: NATConfig{BehindNAT: true}, Clock: clock})
+	defer r.Stop()
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	listen := func() (string, chan struct{}) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, listener)
+		dialled := make(chan struct{}, 4)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				dialled <- struct{}{}
+			}
+		}()
+		return listener.Addr().String(), dialled
+	}
+	// Punches which should be ignored point at a decoy, so we needn't
+	// wait to see that they aren't acted on: with the greater name, r
+	// dials as soon as it punches, so they would have been dialled by
+	// the time the one we accept is.
+	decoy, decoyDialled := listen()
+	addr, dialled := listen()
+	target, rendezvous := PeerName(1), PeerName(3)
+	punchTo := func(addr string) []byte {
+		return gobEncode(&natMessage{Kind: natPunch, Target: target, Addr: addr})
+	}
+
+	// a punch we didn't ask for is ignored
+	require.NoError(t, r.nat.OnGossipUnicast(rendezvous, punchTo(decoy)))
+
+	// as is one from another peer than the rendezvous we asked
+	r.nat.expect(target, rendezvous)
+	require.NoError(t, r.nat.OnGossipUnicast(PeerName(4), punchTo(decoy)))
+
+	// and one which comes too late
+	clock.Advance(natIntroductionTimeout)
+	require.NoError(t, r.nat.OnGossipUnicast(rendezvous, punchTo(decoy)))
+
+	r.nat.expect(target, rendezvous)
+	require.NoError(t, r.nat.OnGossipUnicast(rendezvous, punchTo(addr)))
+	select {
+	case <-dialled:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "didn't punch through when asked")
+	}
+	select {
+	case <-decoyDialled:
+		require.FailNow(t, "dialled an address we didn't ask for")
+	default:
+	}
+}
@@ -0,0 +1,333 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many frames may be queued for an observer before we start
+// dropping them, rather than let a slow observer hold up the mesh.
+const observerQueueSize = 256
+
+// ObserverConfig configures a read-only observer connection to a peer.
+type ObserverConfig struct {
+	// Password must match the mesh password, if there is one.
+	Password []byte
+	// MeshID must match the MeshID of the observed peer.
+	MeshID string
+	// Channels are the gossip channels whose broadcasts the
+	// observer wants to receive. Topology is always received.
+	Channels []string
+	// Name and NickName identify the observer in the peer's logs.
+	Name     PeerName
+	NickName string
+	// HeartbeatInterval must be that of the observed peer; see
+	// Config.HeartbeatInterval. Zero means 30s.
+	HeartbeatInterval time.Duration
+}
+
+// ObservedPeer describes a peer in the topology seen by an observer.
+type ObservedPeer struct {
+	Name        PeerName
+	NickName    string
+	UID         PeerUID
+	Version     uint64
+	Connections []PeerName
+}
+
+// ObserverHandler receives what an observer sees.
+type ObserverHandler interface {
+	// OnTopology is called with the complete topology, initially
+	// and whenever it changes.
+	OnTopology(peers []ObservedPeer)
+	// OnBroadcast is called with each broadcast received by the
+	// observed peer on one of the observed channels.
+	OnBroadcast(channel string, src PeerName, payload []byte)
+}
+
+// Observer is a connection to a peer which receives topology and
+// channel traffic, but is never added to routing and cannot send, so
+// cannot perturb the mesh. It is intended for dashboards and monitors.
+// Peers only accept observers if Config.AllowObservers is set.
+type Observer struct {
+	tcpConn           *net.TCPConn
+	sender            tcpSender
+	stop              chan struct{}
+	once              sync.Once
+	heartbeatInterval time.Duration
+	logger            Logger
+}
+
+// Observe connects to the peer at addr as an observer, delivering what
+// it sees to handler until Close is called or the connection fails.
+func Observe(addr string, config ObserverConfig, handler ObserverHandler, logger Logger) (*Observer, error) {
+	heartbeat := config.HeartbeatInterval
+	if heartbeat <= 0 {
+		heartbeat = tcpHeartbeat
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMeshID(tcpConn, config.MeshID); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	intro, err := protocolIntroParams{
+		MinVersion: 2,
+		MaxVersion: ProtocolMaxVersion,
+		Features: map[string]string{
+			"PeerNameFlavour": peerNameFlavour(),
+			"Name":            config.Name.String(),
+			"NickName":        config.NickName,
+			"UID":             fmt.Sprint(randomPeerUID(defaultRand{})),
+			"ConnID":          fmt.Sprint(randUint64()),
+			"Observer":        "1",
+			"ObserveChannels": strings.Join(config.Channels, ","),
+		},
+		Conn:      tcpConn,
+		Password:  config.Password,
+		Outbound:  true,
+		Heartbeat: heartbeat,
+	}.doIntro()
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	o := &Observer{tcpConn: tcpConn, sender: intro.Sender, stop: make(chan struct{}), heartbeatInterval: heartbeat, logger: logger}
+	go o.heartbeat()
+	go o.receive(intro.Receiver, handler)
+	return o, nil
+}
+
+// Close disconnects the observer.
+func (o *Observer) Close() error {
+	var err error
+	o.once.Do(func() {
+		close(o.stop)
+		err = o.tcpConn.Close()
+	})
+	return err
+}
+
+func (o *Observer) heartbeat() {
+	ticker := time.NewTicker(o.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+			if err := o.sender.Send([]byte{ProtocolHeartbeat}); err != nil {
+				o.Close()
+				return
+			}
+		}
+	}
+}
+
+func (o *Observer) receive(receiver tcpReceiver, handler ObserverHandler) {
+	defer o.Close()
+	for {
+		if err := o.tcpConn.SetReadDeadline(time.Now().Add(o.heartbeatInterval * 2)); err != nil {
+			return
+		}
+		msg, err := receiver.Receive()
+		if err != nil {
+			select {
+			case <-o.stop:
+			default:
+				o.logger.Printf("observer connection to %s failed: %v", o.tcpConn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(msg) < 1 || (msg[0] != ProtocolGossip && msg[0] != ProtocolGossipBroadcast) {
+			continue
+		}
+		if err := o.deliver(msg[1:], handler); err != nil {
+			o.logger.Printf("observer received malformed frame: %v", err)
+		}
+	}
+}
+
+func (o *Observer) deliver(frame []byte, handler ObserverHandler) error {
+	dec := gob.NewDecoder(bytes.NewReader(frame))
+	var channelName string
+	var srcName PeerName
+	var payload []byte
+	if err := dec.Decode(&channelName); err != nil {
+		return err
+	}
+	if err := dec.Decode(&srcName); err != nil {
+		return err
+	}
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+	if channelName != "topology" {
+		handler.OnBroadcast(channelName, srcName, payload)
+		return nil
+	}
+	var peers []ObservedPeer
+	topology := decodeTopology(payload)
+	for {
+		ps, conns, err := topology.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		peer := ObservedPeer{Name: PeerNameFromBin(ps.NameByte), NickName: ps.NickName, UID: ps.UID, Version: ps.Version}
+		for _, conn := range conns {
+			peer.Connections = append(peer.Connections, PeerNameFromBin(conn.NameByte))
+		}
+		peers = append(peers, peer)
+	}
+	handler.OnTopology(peers)
+	return nil
+}
+
+// The peer side of an observer connection.
+type observerConnection struct {
+	conn     *LocalConnection
+	name     PeerName
+	channels map[string]struct{}
+	queue    chan protocolMsg
+}
+
+// observers is the set of observers connected to a router.
+type observers struct {
+	sync.Mutex
+	set map[*observerConnection]struct{}
+}
+
+func newObservers() *observers {
+	return &observers{set: make(map[*observerConnection]struct{})}
+}
+
+func (obs *observers) add(o *observerConnection) {
+	obs.Lock()
+	defer obs.Unlock()
+	obs.set[o] = struct{}{}
+}
+
+func (obs *observers) remove(o *observerConnection) {
+	obs.Lock()
+	defer obs.Unlock()
+	delete(obs.set, o)
+}
+
+func (obs *observers) forEach(f func(*observerConnection)) {
+	obs.Lock()
+	defer obs.Unlock()
+	for o := range obs.set {
+		f(o)
+	}
+}
+
+// forward queues a copy of a gossip frame received on channel for the
+// observers of that channel.
+func (obs *observers) forward(channel *GossipChannel, tag protocolTag, payload []byte) {
+	if tag != ProtocolGossip && tag != ProtocolGossipBroadcast {
+		return
+	}
+	obs.forEach(func(o *observerConnection) {
+		if o.observes(channel) {
+			o.send(protocolMsg{tag, payload})
+		}
+	})
+}
+
+// observes returns whether o asked to observe channel, and may: an
+// observer is only as trusted as any peer named as it, so sees no more
+// of a channel than the channel's ACL lets that peer receive.
+func (o *observerConnection) observes(channel *GossipChannel) bool {
+	_, found := o.channels[channel.name]
+	return found && (channel.acl == nil || channel.acl.receiver(o.name))
+}
+
+// sendTopology queues the complete topology for all observers.
+func (obs *observers) sendTopology(router *Router) {
+	obs.forEach(func(o *observerConnection) {
+		o.sendTopology(router)
+	})
+}
+
+func (o *observerConnection) sendTopology(router *Router) {
+	for _, msg := range router.Gossip().Encode() {
+		o.send(protocolMsg{ProtocolGossip, gobEncode("topology", router.Ourself.Name, msg)})
+	}
+}
+
+// send queues m for the observer, dropping it if the observer isn't
+// keeping up.
+func (o *observerConnection) send(m protocolMsg) {
+	select {
+	case o.queue <- m:
+	default:
+	}
+}
+
+// runObserver serves an observer connection, as an alternative to
+// registering the connection with the router.
+func (conn *LocalConnection) runObserver(remote *Peer, intro protocolIntroResults, errorChan <-chan error) error {
+	if !conn.router.AllowObservers {
+		return fmt.Errorf("observer connections are not allowed")
+	}
+	conn.observer = true
+	conn.remote = remote
+	conn.logf("observer connected")
+	o := &observerConnection{
+		conn:     conn,
+		name:     remote.Name,
+		channels: make(map[string]struct{}),
+		queue:    make(chan protocolMsg, observerQueueSize),
+	}
+	if channels := intro.Features["ObserveChannels"]; channels != "" {
+		for _, name := range strings.Split(channels, ",") {
+			o.channels[name] = struct{}{}
+		}
+	}
+	o.sendTopology(conn.router)
+	conn.router.observers.add(o)
+	defer conn.router.observers.remove(o)
+
+	// Observers may not send; we only read to detect failure.
+	go func() {
+		for {
+			if err := conn.extendReadDeadline(); err != nil {
+				conn.shutdown(err)
+				return
+			}
+			if _, err := intro.Receiver.Receive(); err != nil {
+				conn.shutdown(err)
+				return
+			}
+		}
+	}()
+
+	conn.heartbeatTCP = conn.router.clock().NewTicker(conn.heartbeat)
+	for {
+		var err error
+		select {
+		case err = <-errorChan:
+		case m := <-o.queue:
+			err = conn.sendProtocolMsg(m)
+		case <-conn.heartbeatTCP.Chan():
+			err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testObserverHandler struct {
+	sync.Mutex
+	topology   []ObservedPeer
+	broadcasts []string
+}
+
+func (h *testObserverHandler) OnTopology(peers []ObservedPeer) {
+	h.Lock()
+	defer h.Unlock()
+	h.topology = peers
+}
+
+func (h *testObserverHandler) OnBroadcast(channel string, src PeerName, payload []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.broadcasts = append(h.broadcasts, channel+":"+string(payload))
+}
+
+func TestObserver(t *testing.T) {
+	router := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{AllowObservers: true, Password: []byte("secret")})
+	s, err := router.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = router.NewGossip("Other", newTestGossiper())
+	require.NoError(t, err)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			router.acceptTCP(tcpConn)
+		}
+	}()
+
+	observerName, _ := PeerNameFromString("0f:00:00:0f:00:00")
+	h := &testObserverHandler{}
+	o, err := Observe(ln.Addr().String(), ObserverConfig{Password: []byte("secret"), Channels: []string{"Test"}, Name: observerName}, h, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	defer o.Close()
+
+	require.Eventually(t, func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return len(h.topology) == 1 && h.topology[0].Name == router.Ourself.Name
+	}, 5*time.Second, 10*time.Millisecond)
+
+	broadcast(s, 'x')
+	router.gossipChannel("Other").GossipBroadcast(newSurrogateGossipData([]byte("y")))
+	require.Eventually(t, func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return len(h.broadcasts) == 1 && h.broadcasts[0] == "Test:x"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the observer never became part of the mesh
+	require.Equal(t, 0, router.Ourself.connectionCount())
+	require.Nil(t, router.Peers.Fetch(observerName))
+}
+
+func TestObserverChannelACL(t *testing.T) {
+	router := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{AllowObservers: true, Password: []byte("secret")})
+	s, err := router.NewGossipChannel("Secret", newTestGossiper(), GossipChannelConfig{ACL: &ChannelACL{
+		Receivers: []PeerName{router.Ourself.Name},
+	}})
+	require.NoError(t, err)
+	open, err := router.NewGossip("Open", newTestGossiper())
+	require.NoError(t, err)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			router.acceptTCP(tcpConn)
+		}
+	}()
+
+	observerName, _ := PeerNameFromString("0f:00:00:0f:00:00")
+	h := &testObserverHandler{}
+	o, err := Observe(ln.Addr().String(), ObserverConfig{Password: []byte("secret"), Channels: []string{"Secret", "Open"}, Name: observerName}, h, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	defer o.Close()
+
+	require.Eventually(t, func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return len(h.topology) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the observer isn't a receiver on the restricted channel, so sees
+	// only what is broadcast on the other, queued after it
+	broadcast(s, 'x')
+	broadcast(open, 'y')
+	require.Eventually(t, func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return len(h.broadcasts) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	h.Lock()
+	defer h.Unlock()
+	require.Equal(t, []string{"Open:y"}, h.broadcasts)
+}
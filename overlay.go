@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"fmt"
 	"net"
 )
 
@@ -125,3 +126,46 @@ func (NullOverlay) ControlMessage(byte, []byte) {}
 
 // Attrs implements OverlayConnection.
 func (NullOverlay) Attrs() map[string]interface{} { return nil }
+
+// OverlayProber is implemented by overlays which depend on platform
+// capabilities (kernel modules, privileges, particular operating
+// systems) that may not be present at runtime, e.g. in binaries
+// cross-compiled for ARM edge devices.
+type OverlayProber interface {
+	// Probe reports whether the overlay is able to operate on this
+	// host. A non-nil error means that the overlay must not be used.
+	Probe() error
+}
+
+// SelectOverlay returns the first of the candidate overlays which is
+// usable on this host. Candidates which implement OverlayProber are
+// probed; a failing or panicking probe causes that candidate to be
+// skipped. If no candidate is usable, the pure-Go NullOverlay is
+// returned, in which case all traffic is carried by the TCP
+// connections between peers.
+func SelectOverlay(logger Logger, candidates ...Overlay) Overlay {
+	for _, overlay := range candidates {
+		if overlay == nil {
+			continue
+		}
+		if err := probeOverlay(overlay); err != nil {
+			logger.Printf("Overlay %T unavailable, skipping: %v", overlay, err)
+			continue
+		}
+		return overlay
+	}
+	return NullOverlay{}
+}
+
+func probeOverlay(overlay Overlay) (err error) {
+	prober, ok := overlay.(OverlayProber)
+	if !ok {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("probe panicked: %v", r)
+		}
+	}()
+	return prober.Probe()
+}
@@ -0,0 +1,29 @@
+package mesh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type probedOverlay struct {
+	NullOverlay
+	probe func() error
+}
+
+func (o probedOverlay) Probe() error { return o.probe() }
+
+func TestSelectOverlay(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	failing := probedOverlay{probe: func() error { return fmt.Errorf("no kernel support") }}
+	panicking := probedOverlay{probe: func() error { panic("unsupported platform") }}
+	working := probedOverlay{probe: func() error { return nil }}
+
+	require.Equal(t, NullOverlay{}, SelectOverlay(logger))
+	require.Equal(t, NullOverlay{}, SelectOverlay(logger, nil))
+	require.Equal(t, NullOverlay{}, SelectOverlay(logger, failing, panicking))
+	require.IsType(t, probedOverlay{}, SelectOverlay(logger, failing, panicking, working))
+}
@@ -0,0 +1,91 @@
+package mesh
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+)
+
+// GossipPanic reports that a channel's Gossiper panicked, in a
+// callback made while receiving a frame or sending gossip. The
+// channel is then quarantined: it no longer delivers to the Gossiper,
+// but relays for other peers as it would if the channel weren't
+// registered here, and the connections carrying it, and all the other
+// channels, carry on.
+type GossipPanic struct {
+	Channel string
+	Value   interface{} // as passed to panic
+	Stack   []byte
+}
+
+func (p *GossipPanic) Error() string {
+	return fmt.Sprintf("gossiper on channel %s panicked: %v", p.Channel, p.Value)
+}
+
+// protect calls f, which calls into the channel's Gossiper, unless
+// the channel is quarantined or closed, quarantining it if f panics.
+func (c *GossipChannel) protect(f func() error) (err error) {
+	if c.Quarantined() || c.isClosed() {
+		return nil
+	}
+	defer func() {
+		if value := recover(); value != nil {
+			c.quarantine(&GossipPanic{Channel: c.name, Value: value, Stack: debug.Stack()})
+			err = nil
+		}
+	}()
+	return f()
+}
+
+func (c *GossipChannel) quarantine(p *GossipPanic) {
+	atomic.AddUint64(&c.panics, 1)
+	atomic.StoreInt32(&c.quarantined, 1)
+	c.logf("%v; channel quarantined\n%s", p, p.Stack)
+	if c.config.OnPanic != nil {
+		c.config.OnPanic(p)
+	}
+}
+
+// relayOnly returns the channel which frames received on c are
+// delivered through once it is quarantined: a surrogate, relaying
+// them for other peers, subject to the same ACL, without calling c's
+// Gossiper.
+func (c *GossipChannel) relayOnly() *GossipChannel {
+	c.surrogateOnce.Do(func() {
+		router := c.ourself.router
+		c.surrogate = newGossipChannel(c.name, GossipChannelConfig{ACL: c.config.ACL}, c.ourself, c.routes, newSurrogateGossiper(c.name, router), c.logger)
+	})
+	return c.surrogate
+}
+
+// Quarantined returns whether the channel's Gossiper has panicked, so
+// the channel no longer delivers to it.
+func (c *GossipChannel) Quarantined() bool {
+	return atomic.LoadInt32(&c.quarantined) != 0
+}
+
+// GossipPanics returns the number of panics in the Gossipers of each
+// channel which has had any.
+func (router *Router) GossipPanics() map[string]uint64 {
+	result := make(map[string]uint64)
+	for channel := range router.gossipChannelSet() {
+		if n := atomic.LoadUint64(&channel.panics); n > 0 {
+			result[channel.name] = n
+		}
+	}
+	return result
+}
+
+// QuarantinedChannels returns the names of the channels quarantined
+// after their Gossipers panicked, sorted.
+func (router *Router) QuarantinedChannels() []string {
+	var result []string
+	for channel := range router.gossipChannelSet() {
+		if channel.Quarantined() {
+			result = append(result, channel.name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,110 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type panickingGossiper struct {
+	*testGossiper
+	calls int
+}
+
+func (g *panickingGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
+	g.calls++
+	panic("cannot cope with " + string(msg))
+}
+
+func (g *panickingGossiper) Gossip() GossipData {
+	panic("no gossip")
+}
+
+func TestGossipPanic(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, []*Router{r1, r2}, r1.tp(r2), r2.tp(r1))
+	r1.Routes.ensureRecalculated()
+	r2.Routes.ensureRecalculated()
+
+	var panics []*GossipPanic
+	config := GossipChannelConfig{OnPanic: func(p *GossipPanic) { panics = append(panics, p) }}
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := &panickingGossiper{testGossiper: newTestGossiper()}
+	c2, err := r2.NewGossipChannel("Test", g2, config)
+	require.NoError(t, err)
+	other1, err := r1.NewGossip("Other", newTestGossiper())
+	require.NoError(t, err)
+	other2 := &unicastRecorder{testGossiper: newTestGossiper()}
+	_, err = r2.NewGossip("Other", other2)
+	require.NoError(t, err)
+
+	// the panic is recovered, without an error which would close the
+	// connection, and the channel quarantined
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("this")))
+	require.Len(t, panics, 1)
+	require.Equal(t, "Test", panics[0].Channel)
+	require.Equal(t, "cannot cope with this", panics[0].Value)
+	require.NotEmpty(t, panics[0].Stack)
+	require.True(t, c2.Quarantined())
+	require.Equal(t, []string{"Test"}, r2.QuarantinedChannels())
+
+	// the quarantined channel no longer calls its Gossiper
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("that")))
+	r2.sendAllGossip()
+	require.Equal(t, 1, g2.calls)
+	require.Equal(t, map[string]uint64{"Test": 1}, r2.GossipPanics())
+
+	// but the other channels carry on
+	require.NoError(t, other1.GossipUnicast(r2.Ourself.Name, []byte("hello")))
+	require.Equal(t, [][]byte{[]byte("hello")}, other2.received)
+}
+
+func TestGossipPanicWhileSending(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	c1, err := r1.NewGossip("Test", &panickingGossiper{testGossiper: newTestGossiper()})
+	require.NoError(t, err)
+
+	r1.sendAllGossip()
+	require.True(t, c1.(*GossipChannel).Quarantined())
+}
+
+func TestQuarantinedChannelRelays(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := &panickingGossiper{testGossiper: newTestGossiper()}
+	c2, err := r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	g3 := &unicastRecorder{testGossiper: newTestGossiper()}
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("this")))
+	require.True(t, c2.(*GossipChannel).Quarantined())
+
+	// r2 still relays unicasts and broadcasts between r1 and r3,
+	// without calling its Gossiper
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte("hello")))
+	require.Equal(t, [][]byte{[]byte("hello")}, g3.received)
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	g3.checkHas(t, 1)
+	require.NotContains(t, g2.state, byte(1))
+	require.Equal(t, 1, g2.calls)
+}
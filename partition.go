@@ -0,0 +1,79 @@
+package mesh
+
+import "sort"
+
+// The default number of peers we must learn of at once, from one
+// topology update, for it to be deemed the healing of a partition.
+const defaultPartitionHealThreshold = 2
+
+// OnPartitionHealed adds a function to be called when a partition of
+// the mesh heals, with the peers on our side of it and those on the
+// other, as for the PartitionHealed event of Watch, e.g. to call
+// Router.AntiEntropy so that CRDTs reconcile straight away rather than
+// over the periodic gossip. Callbacks are invoked synchronously, and so
+// must not block.
+func (peers *Peers) OnPartitionHealed(callback func(ours, theirs []PeerName)) {
+	peers.Lock()
+	defer peers.Unlock()
+
+	// Safe, as in OnGC
+	peers.onHealed = append(peers.onHealed, callback)
+}
+
+// AntiEntropy sends the complete state of every channel to every
+// neighbour, as at each Config.AntiEntropyInterval, without waiting for
+// the next interval. It returns straight away.
+func (router *Router) AntiEntropy() {
+	router.Ourself.actionChan <- func() {
+		router.sendAntiEntropy()
+	}
+}
+
+// detectHeal decides whether an update describing peers which were
+// hitherto unknown to us heals a partition: it brings at least
+// Config.PartitionHealThreshold of them, and we knew of others besides
+// ourself, so that it isn't just us joining the mesh, or it brings back
+// peers we had collected as unreachable. Peers only known to us by name,
+// e.g. from connecting to them, count as unknown. Only called with the
+// lock held, before the update is applied. Ourself is tested for before
+// the version of a peer is read, since ours is written under the lock
+// of the local peer, not that of Peers.
+func (peers *Peers) detectHeal(decodedUpdate []*Peer, pending *peersPendingNotifications) {
+	if peers.healThreshold < 0 {
+		return
+	}
+	var (
+		theirs   []PeerName
+		returned bool
+		now      = peers.ourself.router.clock().Now()
+	)
+	for _, update := range decodedUpdate {
+		if peer, found := peers.byName[update.Name]; found && (peer == peers.ourself.Peer || peer.Version > 0) {
+			continue
+		}
+		theirs = append(theirs, update.Name)
+		if t, found := peers.gc.tombstones[update.Name]; found && now.Sub(t.at) < peers.gc.retention {
+			returned = true
+		}
+	}
+	if len(theirs) == 0 {
+		return
+	}
+	var ours []PeerName
+	for name, peer := range peers.byName {
+		if peer == peers.ourself.Peer || peer.Version > 0 {
+			ours = append(ours, name)
+		}
+	}
+	if !returned && (len(ours) < 2 || len(theirs) < peers.healThreshold) {
+		return
+	}
+	sortPeerNames(ours)
+	sortPeerNames(theirs)
+	pending.healed = &TopologyEvent{Type: PartitionHealed, Ours: ours, Theirs: theirs}
+	pending.events = append(pending.events, *pending.healed)
+}
+
+func sortPeerNames(names []PeerName) {
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+}
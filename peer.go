@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"sync/atomic"
 )
 
 // Peer is a local representation of a peer, including connections to other
@@ -15,6 +16,9 @@ type Peer struct {
 	peerSummary
 	localRefCount uint64 // maintained by Peers
 	connections   map[PeerName]Connection
+	// nick is NickName, for String, which is called without holding
+	// the lock guarding NickName, e.g. when logging; see setNickName.
+	nick atomic.Value // string
 }
 
 type peerSummary struct {
@@ -24,6 +28,23 @@ type peerSummary struct {
 	Version    uint64
 	ShortID    PeerShortID
 	HasShortID bool
+	Draining   bool   // in maintenance mode; see Router.EnterMaintenance
+	Degraded   bool   // see Router.SetDegraded
+	PublicKey  []byte // for sealing unicasts; see GossipChannelConfig.EncryptUnicast
+	Leaf       bool   // never a transit hop; see Config.Leaf
+	Zone       string // see Config.Zone
+	// ListenAddrs are the addresses the peer listens on, some of which
+	// may be unspecified, i.e. all of the host's; see Router.AddListener.
+	ListenAddrs []string
+	// Addrs are the addresses at which the peer may be reached, of
+	// either address family, i.e. ListenAddrs with those which are
+	// unspecified replaced by the host's addresses.
+	Addrs []string
+	// Labels are application-defined; see localPeer.SetLabels.
+	Labels map[string]string
+	// Groups are the multicast groups the peer is a member of, in
+	// order; see Router.JoinGroup.
+	Groups []string
 }
 
 // PeerDescription collects information about peers that is useful to clients.
@@ -38,11 +59,13 @@ type PeerDescription struct {
 type connectionSet map[Connection]struct{}
 
 func newPeerFromSummary(summary peerSummary) *Peer {
-	return &Peer{
+	peer := &Peer{
 		Name:        PeerNameFromBin(summary.NameByte),
 		peerSummary: summary,
 		connections: make(map[PeerName]Connection),
 	}
+	peer.nick.Store(summary.NickName)
+	return peer
 }
 
 func newPeer(name PeerName, nickName string, uid PeerUID, version uint64, shortID PeerShortID) *Peer {
@@ -62,7 +85,20 @@ func newPeerPlaceholder(name PeerName) *Peer {
 
 // String returns the peer name and nickname.
 func (peer *Peer) String() string {
-	return fmt.Sprint(peer.Name, "(", peer.NickName, ")")
+	return fmt.Sprint(peer.Name, "(", peer.nickName(), ")")
+}
+
+// nickName returns NickName, as last set, without the lock guarding it.
+func (peer *Peer) nickName() string {
+	nickName, _ := peer.nick.Load().(string)
+	return nickName
+}
+
+// setNickName sets NickName, holding the lock guarding it: that of
+// Peers, or, for ourself, of the localPeer.
+func (peer *Peer) setNickName(nickName string) {
+	peer.NickName = nickName
+	peer.nick.Store(nickName)
 }
 
 // Routes calculates the routing table from this peer to all peers reachable
@@ -84,34 +120,82 @@ func (peer *Peer) String() string {
 // When a non-nil stopAt peer is supplied, the widening stops when it reaches
 // that peer. The boolean return indicates whether that has happened.
 //
+// Widening from peers which are degraded or draining is deferred until
+// all other peers have been widened from, so that routes pass through
+// them only as a last resort; see detour. When calculating unicast
+// routes, i.e. when stopAt is nil, the same goes for widening along
+// degraded connections. Broadcast routes must not take connections into
+// account in this way, since every peer must calculate the same
+// broadcast routes. Since all peers know which peers and connections are
+// degraded or draining, this is deterministic too.
+//
 // NB: This function should generally be invoked while holding a read lock on
 // Peers and LocalPeer.
 func (peer *Peer) routes(stopAt *Peer, establishedAndSymmetric bool) (bool, map[PeerName]PeerName) {
+	return peer.rankedRoutes(stopAt, establishedAndSymmetric, nil)
+}
+
+// rankedRoutes is routes, widening from peers of higher rank first, and
+// so preferring them as hops, where rank is given. The rank of each peer
+// must be the same for all peers, for them to calculate the same
+// broadcast routes.
+func (peer *Peer) rankedRoutes(stopAt *Peer, establishedAndSymmetric bool, rank func(*Peer) float64) (bool, map[PeerName]PeerName) {
 	routes := make(unicastRoutes)
 	routes[peer.Name] = UnknownPeerName
+	// We now know how to get to remotePeer: the same way we get to
+	// curPeer. Except, if curPeer is the starting peer in which case
+	// we know we can reach remotePeer directly.
+	addRoute := func(curPeer, remotePeer *Peer) {
+		if curPeer == peer {
+			routes[remotePeer.Name] = remotePeer.Name
+		} else {
+			routes[remotePeer.Name] = routes[curPeer.Name]
+		}
+	}
 	nextWorklist := []*Peer{peer}
-	for len(nextWorklist) > 0 {
-		worklist := nextWorklist
-		sort.Sort(listOfPeers(worklist))
-		nextWorklist = []*Peer{}
-		for _, curPeer := range worklist {
-			if curPeer == stopAt {
-				return true, routes
+	var deferredPeers [maxDetour + 1][]*Peer
+	var deferredHops [maxDetour + 1][][2]*Peer
+	for tier := 0; tier <= maxDetour; tier++ {
+		nextWorklist = append(nextWorklist, deferredPeers[tier]...)
+		for _, hop := range deferredHops[tier] {
+			if _, found := routes[hop[1].Name]; !found {
+				addRoute(hop[0], hop[1])
+				nextWorklist = append(nextWorklist, hop[1])
+			}
+		}
+		for len(nextWorklist) > 0 {
+			worklist := nextWorklist
+			sort.Sort(listOfPeers(worklist))
+			if rank != nil {
+				ranks := make(map[PeerName]float64, len(worklist))
+				for _, p := range worklist {
+					ranks[p.Name] = rank(p)
+				}
+				sort.SliceStable(worklist, func(i, j int) bool { return ranks[worklist[i].Name] > ranks[worklist[j].Name] })
+			}
+			nextWorklist = []*Peer{}
+			for _, curPeer := range worklist {
+				if detour := curPeer.detour(); detour > tier && curPeer != peer {
+					deferredPeers[detour] = append(deferredPeers[detour], curPeer)
+					continue
+				}
+				if curPeer == stopAt {
+					return true, routes
+				}
+				if curPeer.Leaf && curPeer != peer {
+					// reachable, but not a transit hop
+					continue
+				}
+				curPeer.forEachConnectedPeer(establishedAndSymmetric, routes,
+					func(remotePeer *Peer) {
+						if detour := connectionDetour(curPeer, remotePeer); stopAt == nil && detour > tier {
+							deferredHops[detour] = append(deferredHops[detour], [2]*Peer{curPeer, remotePeer})
+							return
+						}
+						nextWorklist = append(nextWorklist, remotePeer)
+						addRoute(curPeer, remotePeer)
+					})
 			}
-			curPeer.forEachConnectedPeer(establishedAndSymmetric, routes,
-				func(remotePeer *Peer) {
-					nextWorklist = append(nextWorklist, remotePeer)
-					remoteName := remotePeer.Name
-					// We now know how to get to remoteName: the same
-					// way we get to curPeer. Except, if curPeer is
-					// the starting peer in which case we know we can
-					// reach remoteName directly.
-					if curPeer == peer {
-						routes[remoteName] = remoteName
-					} else {
-						routes[remoteName] = routes[curPeer.Name]
-					}
-				})
 		}
 	}
 	return false, routes
@@ -138,31 +222,64 @@ func (peer *Peer) forEachConnectedPeer(establishedAndSymmetric bool, exclude map
 // PeerUID uniquely identifies a peer in a mesh.
 type PeerUID uint64
 
-// ParsePeerUID parses a decimal peer UID from a string.
+// parsePeerUID parses a decimal peer UID from a string.
 func parsePeerUID(s string) (PeerUID, error) {
 	uid, err := strconv.ParseUint(s, 10, 64)
 	return PeerUID(uid), err
 }
 
-func randomPeerUID() PeerUID {
+// ParsePeerUID parses a decimal peer UID, as produced by PeerUID's
+// formatting with fmt, rejecting the reserved UID 0.
+func ParsePeerUID(s string) (PeerUID, error) {
+	uid, err := parsePeerUID(s)
+	if err != nil {
+		return 0, err
+	}
+	if uid == 0 {
+		return 0, fmt.Errorf("reserved peer UID: %q", s)
+	}
+	return uid, nil
+}
+
+// PeerUIDFromBytes returns the peer UID of 8 big-endian bytes, e.g. from
+// an external identity system, rejecting the reserved UID 0. UIDs
+// distinguish incarnations of a peer, so a peer must have a different
+// one each time it starts.
+func PeerUIDFromBytes(uidBytes []byte) (PeerUID, error) {
+	if len(uidBytes) != 8 {
+		return 0, fmt.Errorf("peer UID must be 8 bytes, not %d", len(uidBytes))
+	}
+	uid := PeerUID(binary.BigEndian.Uint64(uidBytes))
+	if uid == 0 {
+		return 0, fmt.Errorf("reserved peer UID: 0")
+	}
+	return uid, nil
+}
+
+func randomPeerUID(rng Rand) PeerUID {
 	for {
-		uid := randUint64()
+		uid := rng.Uint64()
 		if uid != 0 { // uid 0 is reserved for peer placeholder
 			return PeerUID(uid)
 		}
 	}
 }
 
-// PeerShortID exists for the sake of fast datapath. They are 12 bits,
-// randomly assigned, but we detect and recover from collisions. This
-// does limit us to 4096 peers, but that should be sufficient for a
-// while.
-type PeerShortID uint16
+// PeerShortID exists for the sake of fast datapath. They are 12 bits
+// by default, randomly assigned, but we detect and recover from
+// collisions. This limits us to 4096 peers, and collisions become
+// frequent with more than about a thousand, so larger meshes should
+// configure wider ones; see Config.ShortIDBits.
+type PeerShortID uint32
 
-const peerShortIDBits = 12
+// The default and range of widths of short IDs.
+const (
+	peerShortIDBits    = 12
+	maxPeerShortIDBits = 20
+)
 
-func randomPeerShortID() PeerShortID {
-	return PeerShortID(randUint16() & (1<<peerShortIDBits - 1))
+func randomPeerShortID(rng Rand, bits uint) PeerShortID {
+	return PeerShortID(rng.Uint64() & (1<<bits - 1))
 }
 
 func randBytes(n int) []byte {
@@ -177,10 +294,6 @@ func randUint64() (r uint64) {
 	return binary.LittleEndian.Uint64(randBytes(8))
 }
 
-func randUint16() (r uint16) {
-	return binary.LittleEndian.Uint16(randBytes(2))
-}
-
 // ListOfPeers implements sort.Interface on a slice of Peers.
 type listOfPeers []*Peer
 
@@ -0,0 +1,175 @@
+package mesh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	// The peer cache is saved this long after the topology changes, so
+	// that a flurry of changes is saved once.
+	peerCacheSaveDelay = time.Second
+
+	// The most addresses kept in the peer cache.
+	maxCachedAddresses = 64
+)
+
+// PeerCache is what a peer remembers of the mesh across restarts. A
+// restarted peer takes the name and nickname it had, unless given
+// others, but never its UID, lest the other peers take it for the
+// incarnation which preceded the restart.
+type PeerCache struct {
+	Name     PeerName
+	NickName string
+	// Addresses, in host[:port] format, of the peers in the mesh.
+	Addresses []string
+}
+
+// PeerStore persists a PeerCache; see Config.PeerStore.
+type PeerStore interface {
+	// Load returns the cache last saved, or a zero PeerCache if there
+	// is none.
+	Load() (PeerCache, error)
+	Save(PeerCache) error
+}
+
+// NewFilePeerStore returns a PeerStore which keeps the cache as JSON in
+// the file at path.
+func NewFilePeerStore(path string) PeerStore {
+	return filePeerStore(path)
+}
+
+type filePeerStore string
+
+func (path filePeerStore) Load() (PeerCache, error) {
+	var cache PeerCache
+	data, err := ioutil.ReadFile(string(path))
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return cache, err
+	}
+	return cache, json.Unmarshal(data, &cache)
+}
+
+// Save replaces the file atomically, so a crash can't leave it
+// truncated.
+func (path filePeerStore) Save(cache PeerCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(string(path)), filepath.Base(string(path))+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), string(path))
+}
+
+// restorePeerCache makes the addresses in the peer cache, as loaded
+// from store, the targets of SourceCache, and keeps the cache up to
+// date while the router runs.
+func (router *Router) restorePeerCache(store PeerStore, cache PeerCache) {
+	if cache.Name != UnknownPeerName {
+		router.logger.Printf("Restarted; %d cached peer addresses", len(cache.Addresses))
+	}
+	if len(cache.Addresses) > 0 {
+		for _, err := range router.ConnectionMaker.AddTargets(SourceCache, cache.Addresses) {
+			router.logger.Printf("Peer cache: %v", err)
+		}
+	}
+	changed := make(chan struct{}, 1)
+	changed <- struct{}{} // to record our name
+	router.Routes.OnChange(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	go router.savePeerCache(store, cache, changed)
+}
+
+// savePeerCache saves the peer cache shortly after being signalled on
+// changed, until the router stops.
+func (router *Router) savePeerCache(store PeerStore, cache PeerCache, changed <-chan struct{}) {
+	for {
+		select {
+		case <-changed:
+		case <-router.ctx.Done():
+			return
+		}
+		if !sleepContext(router.ctx, router.clock(), peerCacheSaveDelay) {
+			return
+		}
+		router.Ourself.RLock()
+		nickName := router.Ourself.NickName
+		router.Ourself.RUnlock()
+		updated := PeerCache{Name: router.Ourself.Name, NickName: nickName, Addresses: router.peerAddresses()}
+		if len(updated.Addresses) == 0 {
+			// Having lost touch with the mesh is no reason to forget
+			// how to rejoin it.
+			updated.Addresses = cache.Addresses
+		}
+		if !reflect.DeepEqual(updated, cache) {
+			if err := store.Save(updated); err != nil {
+				router.logger.Printf("Unable to save peer cache: %v", err)
+			} else {
+				cache = updated
+			}
+		}
+	}
+}
+
+// peerAddresses returns the addresses at which the peers in the mesh
+// can be reached, as far as the connections between them tell.
+func (router *Router) peerAddresses() []string {
+	found := make(map[string]struct{})
+	router.Peers.forEach(func(peer *Peer) {
+		var connections []Connection
+		if peer == router.Ourself.Peer {
+			// our connections change under the lock of the local
+			// peer, not that of Peers
+			for conn := range router.Ourself.getConnections() {
+				connections = append(connections, conn)
+			}
+		} else {
+			for _, conn := range peer.connections {
+				connections = append(connections, conn)
+			}
+		}
+		for _, conn := range connections {
+			address := conn.remoteTCPAddress()
+			if conn.isOutbound() {
+				found[address] = struct{}{}
+			} else if ip, _, err := net.SplitHostPort(address); err == nil {
+				// the remote port is likely ephemeral, so leave it
+				// to default to Config.Port
+				found[ip] = struct{}{}
+			}
+		}
+	})
+	addresses := make([]string, 0, len(found))
+	for address := range found {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	if len(addresses) > maxCachedAddresses {
+		addresses = addresses[:maxCachedAddresses]
+	}
+	return addresses
+}
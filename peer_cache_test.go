@@ -0,0 +1,62 @@
+package mesh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilePeerStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := NewFilePeerStore(filepath.Join(dir, "peers.json"))
+
+	cache, err := store.Load()
+	require.NoError(t, err)
+	require.Equal(t, PeerCache{}, cache)
+
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	saved := PeerCache{Name: name, NickName: "nick", Addresses: []string{"10.0.0.1:6783", "10.0.0.2"}}
+	require.NoError(t, store.Save(saved))
+	cache, err = store.Load()
+	require.NoError(t, err)
+	require.Equal(t, saved, cache)
+}
+
+func TestPeerCacheRejoins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := NewFilePeerStore(filepath.Join(dir, "peers.json"))
+
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{PeerStore: store})
+	connectTo(t, r2, r1)
+	waitUntil(t, func() bool {
+		cache, err := store.Load()
+		return err == nil && len(cache.Addresses) > 0
+	})
+	r2.Stop()
+	cache, err := store.Load()
+	require.NoError(t, err)
+	require.Equal(t, r2.Ourself.Name, cache.Name)
+	uid := r2.Ourself.UID
+
+	// restarted, with no name or targets but those cached
+	r2 = newTestRouterWithConfig(t, "", Config{PeerStore: store})
+	defer r2.Stop()
+	require.Equal(t, cache.Name, r2.Ourself.Name)
+	require.NotEqual(t, uid, r2.Ourself.UID)
+	target := fmt.Sprintf("127.0.0.1:%d", r1.listenPort())
+	require.Equal(t, []TargetSource{SourceCache}, r2.ConnectionMaker.TargetSources()[target])
+	waitUntil(t, func() bool {
+		_, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+		return found
+	})
+}
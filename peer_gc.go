@@ -0,0 +1,114 @@
+package mesh
+
+import "time"
+
+const defaultPeerTombstoneRetention = time.Minute
+
+// peerGC configures the garbage collection of unreachable peers, and
+// records what it has collected. Only accessed under the Peers lock.
+type peerGC struct {
+	interval  time.Duration
+	grace     time.Duration
+	retention time.Duration
+
+	unreachableSince map[PeerName]time.Time
+	tombstones       map[PeerName]tombstone
+	recheck          time.Duration // until a peer's grace is up, if any
+	collected        uint64
+}
+
+// tombstone records the incarnation of a collected peer, so that stale
+// gossip of it, still being propagated when the peer rejoins as a new
+// incarnation, doesn't displace the new one.
+type tombstone struct {
+	uid     PeerUID
+	version uint64
+	at      time.Time
+}
+
+func newPeerGC(config Config) peerGC {
+	gc := peerGC{interval: config.PeerGCInterval, grace: config.PeerGCGrace, retention: config.PeerTombstoneRetention}
+	if gc.interval <= 0 {
+		gc.interval = gcInterval
+	}
+	if gc.retention == 0 {
+		gc.retention = defaultPeerTombstoneRetention
+	}
+	return gc
+}
+
+// due reports whether the unreachable peer is due for collection,
+// having been unreachable for the grace period.
+func (gc *peerGC) due(name PeerName, now time.Time) bool {
+	if gc.grace <= 0 {
+		return true
+	}
+	if gc.unreachableSince == nil {
+		gc.unreachableSince = make(map[PeerName]time.Time)
+	}
+	since, found := gc.unreachableSince[name]
+	if !found {
+		since = now
+		gc.unreachableSince[name] = since
+	}
+	if wait := since.Add(gc.grace).Sub(now); wait > 0 {
+		if gc.recheck == 0 || wait < gc.recheck {
+			gc.recheck = wait
+		}
+		return false
+	}
+	return true
+}
+
+// reachable notes that a peer is reachable, or referenced, again.
+func (gc *peerGC) reachable(name PeerName) {
+	delete(gc.unreachableSince, name)
+}
+
+// bury records the collection of peer.
+func (gc *peerGC) bury(peer *Peer, now time.Time) {
+	delete(gc.unreachableSince, peer.Name)
+	gc.collected++
+	if gc.retention < 0 {
+		return
+	}
+	if gc.tombstones == nil {
+		gc.tombstones = make(map[PeerName]tombstone)
+	}
+	gc.tombstones[peer.Name] = tombstone{uid: peer.UID, version: peer.Version, at: now}
+}
+
+// prune drops the tombstones older than the retention period.
+func (gc *peerGC) prune(now time.Time) {
+	for name, t := range gc.tombstones {
+		if now.Sub(t.at) >= gc.retention {
+			delete(gc.tombstones, name)
+		}
+	}
+}
+
+// stale reports whether update, of a peer known to us as peer, is of an
+// incarnation of it we have collected, and no newer than when we did,
+// while we know of another. Placeholders, of which we know nothing but
+// the name, don't count, lest a peer which was merely unreachable for a
+// while never be known again.
+func (gc *peerGC) stale(peer, update *Peer, now time.Time) bool {
+	t, found := gc.tombstones[update.Name]
+	if !found || peer.Version == 0 || update.UID == peer.UID || update.UID != t.uid || now.Sub(t.at) >= gc.retention {
+		return false
+	}
+	return update.Version <= t.version
+}
+
+// PeerGCStats are the counts of the garbage collection of peers.
+type PeerGCStats struct {
+	Collected  uint64 // peers collected since the router started
+	Tombstones int    // incarnations of collected peers remembered
+}
+
+// GCStats returns the counts of the garbage collection of peers.
+func (peers *Peers) GCStats() PeerGCStats {
+	peers.RLock()
+	defer peers.RUnlock()
+	return PeerGCStats{Collected: peers.gc.collected, Tombstones: len(peers.gc.tombstones)}
+}
@@ -0,0 +1,31 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// PeerNames of peers whose identity comes from elsewhere, e.g. a
+// Kubernetes pod UID or a certificate's subject, can be derived from it
+// with PeerNameFromExternalID, which hashes the identity along with a
+// namespace distinguishing the identity system, so that the same
+// identity in different systems maps to different names. The names are
+// a hash, so two identities collide with probability 2^-b, where b is
+// externalNameBits, and the chance of any collision among n peers is
+// about n²/2^(b+1): with MAC names, under one in a hundred million for
+// a thousand peers, and one in a million for ten thousand. Collisions
+// are detected when the peers meet, as for any other names.
+
+// PeerNameFromPublicKey derives a PeerName deterministically from a
+// public key, e.g. that of the peer's certificate, as
+// PeerNameFromExternalID does from an identity.
+func PeerNameFromPublicKey(key []byte) PeerName {
+	return PeerNameFromExternalID("public-key", string(key))
+}
+
+// externalIDHash hashes an identity from an external system.
+func externalIDHash(namespace, id string) [sha256.Size]byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(namespace)+len(id))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(namespace)))], namespace...)
+	return sha256.Sum256(append(buf, id...))
+}
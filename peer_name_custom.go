@@ -0,0 +1,163 @@
+// +build peer_name_custom
+
+package mesh
+
+// Let peer names be of a scheme chosen by the application, e.g. UUIDs,
+// or hashes of public keys. To choose this flavour, run
+//
+//   go build -tags 'peer_name_alternative peer_name_custom'
+//
+// and register the scheme with RegisterPeerNameScheme, in an init
+// function, before any names are parsed. Without one, names are UUIDs.
+// The scheme's name is checked when peers connect, along with the
+// flavour, so peers using different schemes refuse to connect.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// PeerName holds the bytes of a name, as a string so that it can be used
+// as a map key. Names are ordered by their bytes, e.g. to break ties, so
+// schemes which care about the order should encode names to suit.
+type PeerName string
+
+const (
+	// PeerNameFlavour is the type of peer names we use.
+	PeerNameFlavour = "custom"
+
+	// UnknownPeerName is used as a sentinel value.
+	UnknownPeerName = PeerName("")
+)
+
+// NameSize is the number of bytes in a peer name, as given by the
+// registered scheme.
+var NameSize = UUIDPeerNames.Size
+
+// PeerNameScheme defines the names of peers.
+type PeerNameScheme struct {
+	// Name identifies the scheme to the peers we connect to.
+	Name string
+	// Size is the number of bytes in a name, at most 32.
+	Size int
+	// Parse parses a name, as written by Format, into Size bytes.
+	Parse func(string) ([]byte, error)
+	// Format writes a name of Size bytes as a string.
+	Format func([]byte) string
+}
+
+// UUIDPeerNames is the scheme of names which are UUIDs, in their usual
+// lower-case format.
+var UUIDPeerNames = PeerNameScheme{Name: "uuid", Size: 16, Parse: parseUUID, Format: formatUUID}
+
+// HexPeerNames returns the scheme of names of size bytes, in lower-case
+// hex, e.g. for names derived by PeerNameFromPublicKey.
+func HexPeerNames(size int) PeerNameScheme {
+	return PeerNameScheme{
+		Name: fmt.Sprintf("hex%d", size),
+		Size: size,
+		Parse: func(nameStr string) ([]byte, error) {
+			if strings.ToLower(nameStr) != nameStr {
+				return nil, fmt.Errorf("peer name must be lower case: %q", nameStr)
+			}
+			return hex.DecodeString(nameStr)
+		},
+		Format: hex.EncodeToString,
+	}
+}
+
+var peerNameScheme = UUIDPeerNames
+
+// RegisterPeerNameScheme sets the scheme of peer names, which must be
+// done before any are parsed, e.g. in an init function.
+func RegisterPeerNameScheme(scheme PeerNameScheme) error {
+	if scheme.Name == "" || scheme.Parse == nil || scheme.Format == nil {
+		return fmt.Errorf("peer name scheme must have a name, a parser and a formatter")
+	}
+	if scheme.Size <= 0 || scheme.Size > 32 {
+		return fmt.Errorf("peer names must be from 1 to 32 bytes, not %d", scheme.Size)
+	}
+	peerNameScheme, NameSize = scheme, scheme.Size
+	return nil
+}
+
+func peerNameFlavour() string {
+	return PeerNameFlavour + "/" + peerNameScheme.Name
+}
+
+// PeerNameFromUserInput parses PeerName from a user-provided string.
+func PeerNameFromUserInput(userInput string) (PeerName, error) {
+	return PeerNameFromString(userInput)
+}
+
+// PeerNameFromString parses PeerName from a generic string.
+func PeerNameFromString(nameStr string) (PeerName, error) {
+	nameBytes, err := peerNameScheme.Parse(nameStr)
+	if err != nil {
+		return UnknownPeerName, err
+	}
+	return PeerNameFromBytes(nameBytes)
+}
+
+// ParsePeerName parses a PeerName strictly, accepting only the format
+// of PeerName.String, and rejecting UnknownPeerName.
+func ParsePeerName(nameStr string) (PeerName, error) {
+	name, err := PeerNameFromString(nameStr)
+	if err != nil {
+		return UnknownPeerName, err
+	}
+	if name.String() != nameStr {
+		return UnknownPeerName, fmt.Errorf("invalid peer name format: %q", nameStr)
+	}
+	return name, nil
+}
+
+// PeerNameFromBytes returns the PeerName of NameSize bytes, rejecting
+// those of other lengths, which PeerNameFromBin doesn't.
+func PeerNameFromBytes(nameBytes []byte) (PeerName, error) {
+	if len(nameBytes) != NameSize {
+		return UnknownPeerName, fmt.Errorf("peer name must be %d bytes, not %d", NameSize, len(nameBytes))
+	}
+	return PeerNameFromBin(nameBytes), nil
+}
+
+// PeerNameFromExternalID derives a PeerName deterministically from id,
+// an identity in the external system named by namespace.
+func PeerNameFromExternalID(namespace, id string) PeerName {
+	sum := externalIDHash(namespace, id)
+	return PeerNameFromBin(sum[:NameSize])
+}
+
+// PeerNameFromBin parses PeerName from a byte slice.
+func PeerNameFromBin(nameByte []byte) PeerName {
+	return PeerName(nameByte)
+}
+
+// bytes encodes PeerName as a byte slice.
+func (name PeerName) bytes() []byte {
+	return []byte(name)
+}
+
+// String encodes PeerName as a string.
+func (name PeerName) String() string {
+	if name == UnknownPeerName {
+		return ""
+	}
+	return peerNameScheme.Format([]byte(name))
+}
+
+func parseUUID(nameStr string) ([]byte, error) {
+	if len(nameStr) != 36 || nameStr[8] != '-' || nameStr[13] != '-' || nameStr[18] != '-' || nameStr[23] != '-' {
+		return nil, fmt.Errorf("invalid UUID: %q", nameStr)
+	}
+	return hex.DecodeString(strings.Replace(nameStr, "-", "", -1))
+}
+
+func formatUUID(uuid []byte) string {
+	s := hex.EncodeToString(uuid)
+	if len(uuid) != 16 {
+		return s
+	}
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,34 @@
+// +build peer_name_custom
+
+package mesh_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestCustomUUIDPeerNames(t *testing.T) {
+	nameStr := "00112233-4455-6677-8899-aabbccddeeff"
+	name, err := mesh.ParsePeerName(nameStr)
+	require.NoError(t, err)
+	require.Equal(t, nameStr, name.String())
+	require.Len(t, name, mesh.NameSize)
+
+	for _, nameStr := range []string{"00112233445566778899aabbccddeeff", "00112233-4455-6677-8899-AABBCCDDEEFF", "00112233-4455-6677-8899-aabbccddeefg"} {
+		_, err := mesh.ParsePeerName(nameStr)
+		require.Error(t, err, nameStr)
+	}
+}
+
+func TestCustomHexPeerNames(t *testing.T) {
+	defer mesh.RegisterPeerNameScheme(mesh.UUIDPeerNames)
+	require.Error(t, mesh.RegisterPeerNameScheme(mesh.HexPeerNames(33)))
+	require.NoError(t, mesh.RegisterPeerNameScheme(mesh.HexPeerNames(32)))
+	name := mesh.PeerNameFromPublicKey([]byte("key"))
+	require.Len(t, name, 32)
+	parsed, err := mesh.ParsePeerName(name.String())
+	require.NoError(t, err)
+	require.Equal(t, name, parsed)
+}
@@ -7,6 +7,7 @@ package mesh
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 )
 
 // PeerName must be globally unique and usable as a map key.
@@ -23,6 +24,10 @@ const (
 	UnknownPeerName = PeerName("")
 )
 
+func peerNameFlavour() string {
+	return PeerNameFlavour
+}
+
 // PeerNameFromUserInput parses PeerName from a user-provided string.
 func PeerNameFromUserInput(userInput string) (PeerName, error) {
 	// fixed-length identity
@@ -38,6 +43,44 @@ func PeerNameFromString(nameStr string) (PeerName, error) {
 	return PeerName(nameStr), nil
 }
 
+// ParsePeerName parses a PeerName strictly, accepting only the format
+// of PeerName.String, i.e. 2*NameSize lower-case hex digits. Names are
+// compared as strings, so unlike PeerNameFromString it rejects upper
+// case, which would name a different peer.
+func ParsePeerName(nameStr string) (PeerName, error) {
+	if len(nameStr) != 2*NameSize {
+		return UnknownPeerName, fmt.Errorf("peer name must be %d hex digits: %q", 2*NameSize, nameStr)
+	}
+	nameBytes, err := hex.DecodeString(nameStr)
+	if err != nil {
+		return UnknownPeerName, err
+	}
+	if name := PeerNameFromBin(nameBytes); string(name) == nameStr {
+		return name, nil
+	}
+	return UnknownPeerName, fmt.Errorf("peer name must be lower case: %q", nameStr)
+}
+
+// PeerNameFromBytes returns the PeerName of NameSize bytes, rejecting
+// those of other lengths, which PeerNameFromBin doesn't.
+func PeerNameFromBytes(nameBytes []byte) (PeerName, error) {
+	if len(nameBytes) != NameSize {
+		return UnknownPeerName, fmt.Errorf("peer name must be %d bytes, not %d", NameSize, len(nameBytes))
+	}
+	return PeerNameFromBin(nameBytes), nil
+}
+
+// externalNameBits is the number of bits of the names derived by
+// PeerNameFromExternalID.
+const externalNameBits = NameSize * 8
+
+// PeerNameFromExternalID derives a PeerName deterministically from id,
+// an identity in the external system named by namespace.
+func PeerNameFromExternalID(namespace, id string) PeerName {
+	sum := externalIDHash(namespace, id)
+	return PeerNameFromBin(sum[:NameSize])
+}
+
 // PeerNameFromBin parses PeerName from a byte slice.
 func PeerNameFromBin(nameByte []byte) PeerName {
 	return PeerName(hex.EncodeToString(nameByte))
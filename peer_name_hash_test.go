@@ -2,7 +2,12 @@
 
 package mesh_test
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
 
 func TestHashPeerNameFromUserInput(t *testing.T) {
 	t.Skip("TODO")
@@ -15,3 +20,22 @@ func TestHashPeerNameFromString(t *testing.T) {
 func TestHashPeerNameFromBin(t *testing.T) {
 	t.Skip("TODO")
 }
+
+func TestHashParsePeerName(t *testing.T) {
+	nameStr := "00112233445566778899aabbccddeeff"
+	name, err := mesh.ParsePeerName(nameStr)
+	require.NoError(t, err)
+	require.Equal(t, mesh.PeerName(nameStr), name)
+
+	for _, nameStr := range []string{"00112233", "00112233445566778899AABBCCDDEEFF", "00112233445566778899aabbccddeefg"} {
+		_, err := mesh.ParsePeerName(nameStr)
+		require.Error(t, err, nameStr)
+	}
+}
+
+func TestHashPeerNameFromBytes(t *testing.T) {
+	_, err := mesh.PeerNameFromBytes(make([]byte, mesh.NameSize))
+	require.NoError(t, err)
+	_, err = mesh.PeerNameFromBytes(make([]byte, mesh.NameSize+1))
+	require.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// PeerNameSource derives the name of a peer, e.g. from the identity of
+// its host; see Config.NameSources.
+type PeerNameSource func() (PeerName, error)
+
+// The files holding the identity of the host, in the order they're read.
+var (
+	machineIDFiles  = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+	instanceIDFiles = []string{"/var/lib/cloud/data/instance-id", "/sys/hypervisor/uuid", "/sys/class/dmi/id/product_uuid"}
+)
+
+// PeerNameFromMachineID derives a PeerName from the machine ID of the
+// host, as systemd and D-Bus record it. Containers often share the
+// machine ID of their host, so their names collide.
+func PeerNameFromMachineID() (PeerName, error) {
+	return peerNameFromIDFiles("machine-id", machineIDFiles)
+}
+
+// PeerNameFromInstanceID derives a PeerName from the ID of the cloud
+// instance or virtual machine of the host, as recorded by cloud-init,
+// or else by the hypervisor, without asking any metadata service.
+func PeerNameFromInstanceID() (PeerName, error) {
+	return peerNameFromIDFiles("instance-id", instanceIDFiles)
+}
+
+func peerNameFromIDFiles(namespace string, paths []string) (PeerName, error) {
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(content)); id != "" {
+			return PeerNameFromExternalID(namespace, id), nil
+		}
+	}
+	return UnknownPeerName, fmt.Errorf("no %s found in %s", namespace, strings.Join(paths, ", "))
+}
+
+// PeerNameFromFile reads the PeerName persisted in the file at path. If
+// there is no such file, it makes up a name and persists it there, so
+// that the peer keeps its name across restarts.
+func PeerNameFromFile(path string) (PeerName, error) {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		name, err := ParsePeerName(strings.TrimSpace(string(content)))
+		if err != nil {
+			return UnknownPeerName, fmt.Errorf("%s: %v", path, err)
+		}
+		return name, nil
+	}
+	if !os.IsNotExist(err) {
+		return UnknownPeerName, err
+	}
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return UnknownPeerName, err
+	}
+	name := PeerNameFromExternalID("random", hex.EncodeToString(random[:]))
+	// write it atomically, lest a crash leave the file empty
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return UnknownPeerName, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(name.String() + "\n"); err != nil {
+		tmp.Close()
+		return UnknownPeerName, err
+	}
+	if err := tmp.Close(); err != nil {
+		return UnknownPeerName, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return UnknownPeerName, err
+	}
+	return name, nil
+}
+
+// PeerNameFile returns the PeerNameSource of PeerNameFromFile(path).
+func PeerNameFile(path string) PeerNameSource {
+	return func() (PeerName, error) { return PeerNameFromFile(path) }
+}
+
+// DerivePeerName returns the name from the first of sources which
+// yields one.
+func DerivePeerName(sources ...PeerNameSource) (PeerName, error) {
+	var errs []string
+	for _, source := range sources {
+		name, err := source()
+		if err == nil {
+			return name, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return UnknownPeerName, fmt.Errorf("no sources of peer names")
+	}
+	return UnknownPeerName, fmt.Errorf("cannot derive peer name: %s", strings.Join(errs, "; "))
+}
+
+// derivedNames are the names claimed by the routers of this process
+// whose names were derived, to catch collisions between them.
+var derivedNames = struct {
+	sync.Mutex
+	byName map[PeerName]*Router
+}{byName: make(map[PeerName]*Router)}
+
+// nameClaim records whether our name was derived, and whether it has
+// turned out to collide with another peer's.
+type nameClaim struct {
+	sync.Mutex
+	derived   bool
+	collision error
+}
+
+// claimName claims our derived name, failing if another router of this
+// process has claimed the same one.
+func (router *Router) claimName() error {
+	derivedNames.Lock()
+	defer derivedNames.Unlock()
+	if _, found := derivedNames.byName[router.Ourself.Name]; found {
+		return fmt.Errorf("derived peer name %s is already in use in this process", router.Ourself.Name)
+	}
+	derivedNames.byName[router.Ourself.Name] = router
+	return nil
+}
+
+// releaseName releases the claim on our derived name, if any.
+func (router *Router) releaseName() {
+	derivedNames.Lock()
+	defer derivedNames.Unlock()
+	if derivedNames.byName[router.Ourself.Name] == router {
+		delete(derivedNames.byName, router.Ourself.Name)
+	}
+}
+
+// nameCollided is called when a peer we connect to turns out to have
+// our name. If our name was derived, and we have yet to join the mesh,
+// it's taken to be a misconfiguration, e.g. of hosts cloned with the
+// same machine ID, and the router stops, returning err from Stop, and
+// so Run. Otherwise only the connection fails.
+func (router *Router) nameCollided(err error) {
+	router.nameClaim.Lock()
+	defer router.nameClaim.Unlock()
+	if !router.nameClaim.derived || router.nameClaim.collision != nil {
+		return
+	}
+	for conn := range router.Ourself.getConnections() {
+		if conn.isEstablished() {
+			return
+		}
+	}
+	router.nameClaim.collision = err
+	router.logger.Printf("Stopping: %v", err)
+	go router.Stop()
+}
+
+func (router *Router) nameCollision() error {
+	router.nameClaim.Lock()
+	defer router.nameClaim.Unlock()
+	return router.nameClaim.collision
+}
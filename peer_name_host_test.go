@@ -0,0 +1,78 @@
+package mesh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerivePeerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(files []string) { machineIDFiles = files }(machineIDFiles)
+	machineIDFiles = []string{filepath.Join(dir, "missing"), filepath.Join(dir, "machine-id")}
+	_, err = PeerNameFromMachineID()
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(machineIDFiles[1], []byte("0123456789abcdef\n"), 0644))
+	name, err := PeerNameFromMachineID()
+	require.NoError(t, err)
+	require.Equal(t, PeerNameFromExternalID("machine-id", "0123456789abcdef"), name)
+
+	// the file is made up on first use, and kept thereafter
+	path := filepath.Join(dir, "name")
+	fromFile, err := PeerNameFromFile(path)
+	require.NoError(t, err)
+	again, err := PeerNameFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, fromFile, again)
+	require.NotEqual(t, name, fromFile)
+
+	failing := func() (PeerName, error) { return UnknownPeerName, fmt.Errorf("no") }
+	derived, err := DerivePeerName(failing, PeerNameFile(path), PeerNameFromMachineID)
+	require.NoError(t, err)
+	require.Equal(t, fromFile, derived)
+	_, err = DerivePeerName(failing)
+	require.Error(t, err)
+}
+
+func TestDerivedPeerNameCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sources := []PeerNameSource{PeerNameFile(filepath.Join(dir, "name"))}
+
+	r1 := newTestRouterWithConfig(t, "", Config{NameSources: sources})
+	name, err := PeerNameFromFile(filepath.Join(dir, "name"))
+	require.NoError(t, err)
+	require.Equal(t, name, r1.Ourself.Name)
+
+	// routers of the same process can't share derived names, and
+	// those which fail to claim one leave nothing running
+	goroutines := runtime.NumGoroutine()
+	_, err = NewRouter(Config{NameSources: sources, Membership: MembershipSWIM}, UnknownPeerName, "", nil, log.New(ioutil.Discard, "", 0))
+	require.Error(t, err)
+	waitUntil(t, func() bool { return runtime.NumGoroutine() <= goroutines })
+
+	// nor can peers we connect to, when we've yet to join the mesh
+	r2 := newTestRouterWithConfig(t, name.String(), Config{})
+	defer r2.Stop()
+	addr, closeListener := listenTest(t, r2)
+	defer closeListener()
+	r1.ConnectionMaker.InitiateConnections([]string{addr}, false)
+	waitUntil(t, func() bool { return r1.ctx.Err() != nil })
+	_, collision := r1.Stop().(*peerNameCollisionError)
+	require.True(t, collision)
+
+	// whereupon the name is released
+	r3, err := NewRouter(Config{NameSources: sources}, UnknownPeerName, "", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	require.NoError(t, r3.Stop())
+}
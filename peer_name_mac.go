@@ -39,6 +39,10 @@ const (
 	UnknownPeerName = PeerName(0)
 )
 
+func peerNameFlavour() string {
+	return PeerNameFlavour
+}
+
 // PeerNameFromUserInput parses PeerName from a user-provided string.
 func PeerNameFromUserInput(userInput string) (PeerName, error) {
 	return PeerNameFromString(userInput)
@@ -77,6 +81,57 @@ func PeerNameFromString(nameStr string) (PeerName, error) {
 	return PeerName(a<<40 | b<<32 | c<<24 | d<<16 | e<<8 | f), nil
 }
 
+// ParsePeerName parses a PeerName strictly, accepting only the format
+// of PeerName.String, i.e. six colon-separated two-digit hex octets, and
+// rejecting UnknownPeerName. Unlike PeerNameFromString, it is suitable
+// for validating names from external identity systems.
+func ParsePeerName(nameStr string) (PeerName, error) {
+	if len(nameStr) != 3*NameSize-1 {
+		return UnknownPeerName, fmt.Errorf("invalid peer name format: %q", nameStr)
+	}
+	for i := 2; i < len(nameStr); i += 3 {
+		if nameStr[i] != ':' {
+			return UnknownPeerName, fmt.Errorf("invalid peer name format: %q", nameStr)
+		}
+	}
+	name, err := PeerNameFromString(nameStr)
+	if err != nil {
+		return UnknownPeerName, err
+	}
+	if name == UnknownPeerName {
+		return UnknownPeerName, fmt.Errorf("reserved peer name: %q", nameStr)
+	}
+	return name, nil
+}
+
+// PeerNameFromBytes returns the PeerName of NameSize bytes, rejecting
+// those of other lengths, which PeerNameFromBin doesn't, and
+// UnknownPeerName.
+func PeerNameFromBytes(nameBytes []byte) (PeerName, error) {
+	if len(nameBytes) != NameSize {
+		return UnknownPeerName, fmt.Errorf("peer name must be %d bytes, not %d", NameSize, len(nameBytes))
+	}
+	name := PeerNameFromBin(nameBytes)
+	if name == UnknownPeerName {
+		return UnknownPeerName, fmt.Errorf("reserved peer name: %s", name)
+	}
+	return name, nil
+}
+
+// externalNameBits is the number of bits of the names derived by
+// PeerNameFromExternalID.
+const externalNameBits = NameSize*8 - 2
+
+// PeerNameFromExternalID derives a PeerName deterministically from id,
+// an identity in the external system named by namespace. The name is a
+// locally administered unicast MAC, so it can't clash with the MAC of a
+// network interface, nor be UnknownPeerName.
+func PeerNameFromExternalID(namespace, id string) PeerName {
+	sum := externalIDHash(namespace, id)
+	sum[0] = sum[0]&^0x01 | 0x02
+	return PeerNameFromBin(sum[:NameSize])
+}
+
 // PeerNameFromBin parses PeerName from a byte slice.
 func PeerNameFromBin(nameByte []byte) PeerName {
 	return PeerName(macint(net.HardwareAddr(nameByte)))
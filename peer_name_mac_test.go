@@ -68,3 +68,24 @@ func TestMacPeerNameFromString(t *testing.T) {
 func TestMacPeerNameFromBin(t *testing.T) {
 	t.Skip("TODO")
 }
+
+func TestMacParsePeerName(t *testing.T) {
+	name, err := mesh.ParsePeerName("12:34:56:78:9a:BC")
+	require.NoError(t, err)
+	require.Equal(t, mesh.PeerName(0x123456789ABC), name)
+
+	for _, nameStr := range []string{"12::", "1:2:3:4:5:6", "12-34-56-78-9A-BC", "00:00:00:00:00:00", "12:34:56:78:9A:BC "} {
+		_, err := mesh.ParsePeerName(nameStr)
+		require.Error(t, err, nameStr)
+	}
+}
+
+func TestMacPeerNameFromBytes(t *testing.T) {
+	name, err := mesh.PeerNameFromBytes([]byte{0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC})
+	require.NoError(t, err)
+	require.Equal(t, mesh.PeerName(0x123456789ABC), name)
+	_, err = mesh.PeerNameFromBytes([]byte{0x12, 0x34})
+	require.Error(t, err)
+	_, err = mesh.PeerNameFromBytes(make([]byte, 6))
+	require.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerNameFromExternalID(t *testing.T) {
+	name := PeerNameFromExternalID("k8s", "pod-1")
+	require.Equal(t, name, PeerNameFromExternalID("k8s", "pod-1"))
+	require.NotEqual(t, name, PeerNameFromExternalID("x509", "pod-1"))
+	require.NotEqual(t, PeerNameFromExternalID("ab", "c"), PeerNameFromExternalID("a", "bc"))
+	parsed, err := ParsePeerName(name.String())
+	require.NoError(t, err)
+	require.Equal(t, name, parsed)
+
+	seen := make(map[PeerName]struct{})
+	for i := 0; i < 100000; i++ {
+		name := PeerNameFromExternalID("test", fmt.Sprint(i))
+		require.NotEqual(t, UnknownPeerName, name)
+		_, collision := seen[name]
+		require.False(t, collision)
+		seen[name] = struct{}{}
+	}
+}
+
+func TestPeerNameFromPublicKey(t *testing.T) {
+	name := PeerNameFromPublicKey([]byte("key"))
+	require.Equal(t, name, PeerNameFromPublicKey([]byte("key")))
+	require.NotEqual(t, name, PeerNameFromPublicKey([]byte("other key")))
+	require.NotEqual(t, name, PeerNameFromExternalID("k8s", "key"))
+}
+
+// The collision probabilities given by the documentation of
+// PeerNameFromExternalID.
+func TestExternalNameCollisionProbability(t *testing.T) {
+	collision := func(peers float64) float64 {
+		return peers * peers / math.Exp2(externalNameBits+1)
+	}
+	require.True(t, collision(1000) < 1e-8)
+	require.True(t, collision(10000) < 1e-6)
+}
@@ -0,0 +1,168 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Roles of peers, as seen by a PeerScorer.
+const (
+	RolePeer = "peer"
+	RoleLeaf = "leaf" // see Config.Leaf
+)
+
+// Connections to a peer which terminated longer ago than this no longer
+// count as flaps.
+const peerFlapWindow = 10 * time.Minute
+
+// PeerScoreInput describes a peer being considered as a neighbour.
+type PeerScoreInput struct {
+	Peer     PeerName
+	NickName string
+	Zone     string // see Config.Zone
+	Role     string // RolePeer or RoleLeaf
+	Load     int    // the number of connections the peer has
+
+	// The rest describe our own dealings with the peer, so are zero
+	// when scoring for broadcast trees, which all peers must agree on.
+	RTT   time.Duration // smoothed round-trip time of our connection; zero if unmeasured
+	Loss  float64       // smoothed fraction of our pings the peer failed to answer
+	Flaps int           // our connections to the peer which terminated in the last 10 minutes
+}
+
+// PeerScorer scores a peer as a neighbour; the higher the better. It is
+// consulted wherever neighbours are chosen:
+//
+// - Gossip is sent to neighbours with a probability weighted by their
+// score, and never to those scoring zero or less while there are others.
+// - The ConnectionMaker connects to the peers it discovers in order of
+// score, so a TopologyPolicy such as MaxDegree keeps the best.
+// - Once ConnLimit is reached, a new connection displaces our
+// lowest-scoring one, if the new peer scores higher.
+// - Broadcasts are relayed preferentially through higher-scoring peers.
+// Since every peer must calculate the same broadcast trees, all peers
+// should use the same scorer.
+//
+// It is invoked with the topology locked, so must be fast and must not
+// call the Router.
+type PeerScorer func(PeerScoreInput) float64
+
+// scorePeer scores peer as a neighbour, including our own dealings with
+// it if local. Peers must be locked.
+func (router *Router) scorePeer(peer *Peer, local bool) float64 {
+	input := PeerScoreInput{
+		Peer:     peer.Name,
+		NickName: peer.NickName,
+		Zone:     peer.Zone,
+		Role:     RolePeer,
+		Load:     len(peer.connections),
+	}
+	if peer.Leaf {
+		input.Role = RoleLeaf
+	}
+	if local {
+		if conn, found := router.Ourself.ConnectionTo(peer.Name); found {
+			if lc, ok := conn.(*LocalConnection); ok {
+				input.RTT = lc.rtt.estimate()
+				input.Loss = lc.rtt.lossRate()
+			}
+		}
+		input.Flaps = router.flaps.count(peer.Name)
+	}
+	return router.PeerScorer(input)
+}
+
+// scoreNeighbour scores the named peer as a neighbour, returning zero
+// if it is unknown.
+func (router *Router) scoreNeighbour(name PeerName) float64 {
+	router.Peers.RLock()
+	defer router.Peers.RUnlock()
+	peer, found := router.Peers.byName[name]
+	if !found {
+		return 0
+	}
+	return router.scorePeer(peer, true)
+}
+
+// rankForBroadcast scores peer as a relay of broadcasts, on what all
+// peers know of it.
+func (router *Router) rankForBroadcast(peer *Peer) float64 {
+	return router.scorePeer(peer, false)
+}
+
+// pickWeighted removes and returns a random one of the names in
+// weights, with probability proportional to its weight, choosing
+// uniformly among them if none has a positive weight.
+func pickWeighted(rng Rand, weights map[PeerName]float64) PeerName {
+	var total float64
+	names := make([]PeerName, 0, len(weights))
+	for name, weight := range weights {
+		names = append(names, name)
+		if weight > 0 {
+			total += weight
+		}
+	}
+	// sort, so that the outcome depends only on the random number
+	sort.Sort(peerNames(names))
+	chosen := names[rng.Intn(len(names))]
+	if total > 0 {
+		rnd := rng.Float64() * total
+		for _, name := range names {
+			if weight := weights[name]; weight > 0 {
+				chosen = name
+				if rnd < weight {
+					break
+				}
+				rnd -= weight
+			}
+		}
+	}
+	delete(weights, chosen)
+	return chosen
+}
+
+// flapCounter records when our connections to each peer terminated.
+type flapCounter struct {
+	sync.Mutex
+	flaps map[PeerName][]time.Time
+	clock Clock
+}
+
+func newFlapCounter(clock Clock) *flapCounter {
+	return &flapCounter{flaps: make(map[PeerName][]time.Time), clock: clock}
+}
+
+func (fc *flapCounter) record(name PeerName) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.flaps[name] = append(fc.recent(name), fc.clock.Now())
+}
+
+func (fc *flapCounter) count(name PeerName) int {
+	fc.Lock()
+	defer fc.Unlock()
+	return len(fc.recent(name))
+}
+
+// recent prunes and returns the flaps of the named peer within
+// peerFlapWindow. fc must be locked.
+func (fc *flapCounter) recent(name PeerName) []time.Time {
+	flaps := fc.flaps[name]
+	cutoff := fc.clock.Now().Add(-peerFlapWindow)
+	for len(flaps) > 0 && flaps[0].Before(cutoff) {
+		flaps = flaps[1:]
+	}
+	if len(flaps) == 0 {
+		delete(fc.flaps, name)
+		return nil
+	}
+	fc.flaps[name] = flaps
+	return flaps
+}
+
+func (fc *flapCounter) forget(name PeerName) {
+	fc.Lock()
+	defer fc.Unlock()
+	delete(fc.flaps, name)
+}
@@ -0,0 +1,86 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// preferring returns a PeerScorer which scores the named peer 1 and
+// all others 0.
+func preferring(name PeerName) PeerScorer {
+	return func(input PeerScoreInput) float64 {
+		if input.Peer == name {
+			return 1
+		}
+		return 0
+	}
+}
+
+func TestPeerScorerChoosesNeighbours(t *testing.T) {
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	hub := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{PeerScorer: preferring(r4.Ourself.Name)})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{hub, r2, r3, r4}
+	addTestGossipConnection(t, hub, r2)
+	addTestGossipConnection(t, hub, r3)
+	addTestGossipConnection(t, hub, r4)
+	flushAndCheckTopology(t, routers, hub.tp(r2, r3, r4), r2.tp(hub), r3.tp(hub), r4.tp(hub))
+
+	// only once the topology is known, lest the others not learn it
+	hub.PeerScorer, hub.Routes.score, hub.Routes.fanout = preferring(r4.Ourself.Name), hub.scoreNeighbour, 1
+	for i := 0; i < 10; i++ {
+		require.Equal(t, []PeerName{r4.Ourself.Name}, hub.Routes.randomNeighbours(UnknownPeerName))
+	}
+	require.Equal(t, peerNameSet{r4.Ourself.Name: {}}, discoveredPeers(r2, MaxDegree(2)))
+}
+
+func TestPeerScorerRanksBroadcastRelays(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	addTestGossipConnection(t, r2, r4)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1, r4), r3.tp(r1, r4), r4.tp(r2, r3))
+
+	rank := func(peer *Peer) float64 { return preferring(r3.Ourself.Name)(PeerScoreInput{Peer: peer.Name}) }
+	r1.Peers.RLock()
+	defer r1.Peers.RUnlock()
+	_, routes := r1.Ourself.Peer.routes(nil, true)
+	require.Equal(t, r2.Ourself.Name, routes[r4.Ourself.Name])
+	_, routes = r1.Ourself.Peer.rankedRoutes(nil, true, rank)
+	require.Equal(t, r3.Ourself.Name, routes[r4.Ourself.Name])
+}
+
+func TestPeerScorerDisplacesConnections(t *testing.T) {
+	bad := newTestRouter(t, "02:00:00:02:00:00")
+	defer bad.Stop()
+	good := newTestRouter(t, "03:00:00:03:00:00")
+	defer good.Stop()
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{ConnLimit: 1, PeerScorer: preferring(good.Ourself.Name)})
+	defer r.Stop()
+
+	connectTo(t, bad, r)
+	connectTo(t, good, r)
+	waitUntil(t, func() bool {
+		_, found := r.Ourself.ConnectionTo(bad.Ourself.Name)
+		return !found
+	})
+	require.Equal(t, 1, r.Ourself.connectionCount())
+}
+
+func TestRTTEstimatorLoss(t *testing.T) {
+	var e rttEstimator
+	e.pinged(time.Unix(0, 0))
+	e.sample(1)
+	require.Zero(t, e.lossRate())
+	e.pinged(time.Unix(0, 0))
+	e.pinged(time.Unix(0, 0))
+	require.InDelta(t, 1.0/rttSmoothing, e.lossRate(), 1e-9)
+}
@@ -0,0 +1,85 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PeerSelector selects peers by nickname and labels, which needn't be
+// unique, so it may select any number of peers. The zero PeerSelector
+// selects all of them.
+type PeerSelector struct {
+	// NickName, if set, is the nickname of the selected peers.
+	NickName string
+	// Labels are labels that the selected peers all have; see
+	// localPeer.SetLabels.
+	Labels map[string]string
+}
+
+func (selector PeerSelector) String() string {
+	s := ""
+	if selector.NickName != "" {
+		s = fmt.Sprintf("nickname %q", selector.NickName)
+	}
+	for _, key := range sortedLabelKeys(selector.Labels) {
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s=%s", key, selector.Labels[key])
+	}
+	if s == "" {
+		return "all peers"
+	}
+	return s
+}
+
+func (selector PeerSelector) matches(peer *Peer) bool {
+	if selector.NickName != "" && peer.NickName != selector.NickName {
+		return false
+	}
+	for key, value := range selector.Labels {
+		if other, found := peer.Labels[key]; !found || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the names of the peers that selector selects, in
+// order.
+func (peers *Peers) Select(selector PeerSelector) []PeerName {
+	var names []PeerName
+	peers.forEach(func(peer *Peer) {
+		if selector.matches(peer) {
+			names = append(names, peer.Name)
+		}
+	})
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// GossipUnicastTo relays msg to each of the peers, other than
+// ourselves, which selector selects, as GossipUnicast would, returning
+// the names of those it was relayed to. It is an error for selector to
+// select none of them; otherwise the error, if any, is the first one
+// relaying to them.
+func (c *GossipChannel) GossipUnicastTo(selector PeerSelector, msg []byte) ([]PeerName, error) {
+	var sent []PeerName
+	var firstErr error
+	for _, name := range c.ourself.router.Peers.Select(selector) {
+		if name == c.ourself.Name {
+			continue
+		}
+		if err := c.GossipUnicast(name, msg); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent = append(sent, name)
+	}
+	if sent == nil && firstErr == nil {
+		return nil, fmt.Errorf("no peers match %s", selector)
+	}
+	return sent, firstErr
+}
@@ -0,0 +1,46 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipUnicastTo(t *testing.T) {
+	db := Config{Labels: map[string]string{"role": "db"}}
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", db)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", db)
+	r3.Ourself.SetNickName("three")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1), r3.tp(r1))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	c1, err := r1.NewGossipChannel("Test", newTestGossiper(), GossipChannelConfig{})
+	require.NoError(t, err)
+	g2 := &unicastRecorder{testGossiper: newTestGossiper()}
+	g3 := &unicastRecorder{testGossiper: newTestGossiper()}
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	require.Len(t, r1.Peers.Select(PeerSelector{}), 3)
+
+	sent, err := c1.GossipUnicastTo(PeerSelector{Labels: db.Labels}, []byte("both"))
+	require.NoError(t, err)
+	require.Equal(t, []PeerName{r2.Ourself.Name, r3.Ourself.Name}, sent)
+
+	sent, err = c1.GossipUnicastTo(PeerSelector{NickName: "three"}, []byte("one"))
+	require.NoError(t, err)
+	require.Equal(t, []PeerName{r3.Ourself.Name}, sent)
+	require.Equal(t, [][]byte{[]byte("both")}, g2.received)
+	require.Equal(t, [][]byte{[]byte("both"), []byte("one")}, g3.received)
+
+	_, err = c1.GossipUnicastTo(PeerSelector{Labels: map[string]string{"role": "web"}}, []byte("none"))
+	require.Error(t, err)
+}
@@ -1,6 +1,10 @@
 package mesh
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
 
 func newPeerFrom(peer *Peer) *Peer {
 	return newPeerFromSummary(peer.peerSummary)
@@ -26,3 +30,21 @@ func forcePendingGC(routers ...*Router) {
 		}
 	}
 }
+
+func TestPeerUIDConstructors(t *testing.T) {
+	uid, err := ParsePeerUID("1234")
+	require.NoError(t, err)
+	require.Equal(t, PeerUID(1234), uid)
+	for _, s := range []string{"0", "-1", "12a", ""} {
+		_, err := ParsePeerUID(s)
+		require.Error(t, err, s)
+	}
+
+	uid, err = PeerUIDFromBytes([]byte{0, 0, 0, 0, 0, 0, 0x04, 0xd2})
+	require.NoError(t, err)
+	require.Equal(t, PeerUID(1234), uid)
+	_, err = PeerUIDFromBytes(make([]byte, 8))
+	require.Error(t, err)
+	_, err = PeerUIDFromBytes(make([]byte, 4))
+	require.Error(t, err)
+}
@@ -2,10 +2,10 @@ package mesh
 
 import (
 	"bytes"
-	"encoding/gob"
 	"io"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,8 +23,27 @@ type Peers struct {
 
 	// Called when the mapping from short IDs to peers changes
 	onInvalidateShortIDs []func()
-	timer                *time.Timer
+	onHealed             []func(ours, theirs []PeerName)
+	healThreshold        int
+	timer                Timer
+	stopChan             chan struct{}
 	pendingGC            bool
+	gc                   peerGC
+	watchers             *topologyWatchers
+
+	// A copy-on-write view of byName and byShortID, for lookups
+	// that don't need the lock. Writers set stale when they change
+	// either map, and unlockAndNotify publishes a fresh view.
+	view  atomic.Value // *peersView
+	stale bool
+}
+
+// peersView is an immutable snapshot of which peers are known. Only
+// the maps are immutable: the peers in them are still updated in
+// place, under the Peers lock.
+type peersView struct {
+	byName    map[PeerName]*Peer
+	byShortID map[PeerShortID]*Peer
 }
 
 type shortIDPeers struct {
@@ -44,6 +63,8 @@ type connectionSummary struct {
 	RemoteTCPAddr string
 	Outbound      bool
 	Established   bool
+	Degraded      bool
+	RTT           time.Duration
 }
 
 // Due to changes to Peers that need to be sent out
@@ -60,14 +81,32 @@ type peersPendingNotifications struct {
 
 	// The local peer was modified
 	localPeerModified bool
+
+	// A partition healed
+	healed *TopologyEvent
+
+	// For Watch
+	events []TopologyEvent
 }
 
 func newPeers(ourself *localPeer) *Peers {
+	var config Config
+	if ourself.router != nil {
+		config = ourself.router.Config
+	}
+	gc := newPeerGC(config)
 	peers := &Peers{
-		ourself:   ourself,
-		byName:    make(map[PeerName]*Peer),
-		byShortID: make(map[PeerShortID]shortIDPeers),
-		timer:     time.NewTimer(gcInterval),
+		ourself:       ourself,
+		byName:        make(map[PeerName]*Peer),
+		byShortID:     make(map[PeerShortID]shortIDPeers),
+		healThreshold: config.PartitionHealThreshold,
+		timer:         ourself.router.clock().NewTimer(gc.interval),
+		stopChan:      make(chan struct{}),
+		gc:            gc,
+		watchers:      newTopologyWatchers(),
+	}
+	if peers.healThreshold == 0 {
+		peers.healThreshold = defaultPartitionHealThreshold
 	}
 	peers.fetchWithDefault(ourself.Peer)
 	peers.timer.Stop()
@@ -83,7 +122,7 @@ func (peers *Peers) Descriptions() []PeerDescription {
 	for _, peer := range peers.byName {
 		descriptions = append(descriptions, PeerDescription{
 			Name:           peer.Name,
-			NickName:       peer.peerSummary.NickName,
+			NickName:       peer.nickName(),
 			UID:            peer.UID,
 			Self:           peer.Name == peers.ourself.Name,
 			NumConnections: len(peer.connections),
@@ -120,8 +159,14 @@ func (peers *Peers) unlockAndNotify(pending *peersPendingNotifications) {
 	broadcastLocalPeer := (pending.reassignLocalShortID && peers.reassignLocalShortID(pending)) || pending.localPeerModified
 	onGC := peers.onGC
 	onInvalidateShortIDs := peers.onInvalidateShortIDs
+	onHealed := peers.onHealed
+	if peers.stale {
+		peers.publishView()
+	}
 	peers.Unlock()
 
+	peers.watchers.publish(pending.events)
+
 	if pending.removed != nil {
 		for _, callback := range onGC {
 			for _, peer := range pending.removed {
@@ -136,15 +181,45 @@ func (peers *Peers) unlockAndNotify(pending *peersPendingNotifications) {
 		}
 	}
 
+	if pending.healed != nil {
+		for _, callback := range onHealed {
+			callback(pending.healed.Ours, pending.healed.Theirs)
+		}
+	}
+
 	if broadcastLocalPeer {
 		peers.ourself.broadcastPeerUpdate()
 	}
 }
 
+// publishView replaces the view of the peers with a copy of the
+// current maps. Must be called with the lock held.
+func (peers *Peers) publishView() {
+	view := &peersView{
+		byName:    make(map[PeerName]*Peer, len(peers.byName)),
+		byShortID: make(map[PeerShortID]*Peer, len(peers.byShortID)),
+	}
+	for name, peer := range peers.byName {
+		view.byName[name] = peer
+	}
+	for shortID, entry := range peers.byShortID {
+		if entry.peer != nil {
+			view.byShortID[shortID] = entry.peer
+		}
+	}
+	peers.view.Store(view)
+	peers.stale = false
+}
+
+func (peers *Peers) loadView() *peersView {
+	return peers.view.Load().(*peersView)
+}
+
 func (peers *Peers) addByShortID(peer *Peer, pending *peersPendingNotifications) {
 	if !peer.HasShortID {
 		return
 	}
+	peers.stale = true
 
 	entry, ok := peers.byShortID[peer.ShortID]
 	if !ok {
@@ -181,6 +256,7 @@ func (peers *Peers) deleteByShortID(peer *Peer, pending *peersPendingNotificatio
 	if !peer.HasShortID {
 		return
 	}
+	peers.stale = true
 
 	entry := peers.byShortID[peer.ShortID]
 	var otherIndex int
@@ -247,12 +323,12 @@ func (peers *Peers) setLocalShortID(newShortID PeerShortID, pending *peersPendin
 
 // Choose an available short ID at random.
 func (peers *Peers) chooseShortID() (PeerShortID, bool) {
-	rng := rand.New(rand.NewSource(int64(randUint64())))
+	rng := rand.New(rand.NewSource(int64(peers.ourself.router.rng().Uint64())))
 
 	// First, just try picking some short IDs at random, and
 	// seeing if they are available:
 	for i := 0; i < 10; i++ {
-		shortID := PeerShortID(rng.Intn(1 << peerShortIDBits))
+		shortID := PeerShortID(rng.Intn(1 << peers.ourself.shortIDBits))
 		if peers.byShortID[shortID].peer == nil {
 			return shortID, true
 		}
@@ -260,7 +336,7 @@ func (peers *Peers) chooseShortID() (PeerShortID, bool) {
 
 	// Looks like most short IDs are used. So count the number of
 	// unused ones, and pick one at random.
-	available := int(1 << peerShortIDBits)
+	available := int(1 << peers.ourself.shortIDBits)
 	for _, entry := range peers.byShortID {
 		if entry.peer != nil {
 			available--
@@ -301,17 +377,18 @@ func (peers *Peers) fetchWithDefault(peer *Peer) *Peer {
 	}
 
 	peers.byName[peer.Name] = peer
+	peers.stale = true
 	peers.addByShortID(peer, &pending)
 	peer.localRefCount++
+	pending.events = append(pending.events, peerEvent(PeerAdded, peer))
 	return peer
 }
 
 // Fetch returns a peer matching the passed name, without incrementing its
-// refcount. If no matching peer is found, Fetch returns nil.
+// refcount. If no matching peer is found, Fetch returns nil. Fetch
+// does not take the lock, so it is cheap to call from callbacks.
 func (peers *Peers) Fetch(name PeerName) *Peer {
-	peers.RLock()
-	defer peers.RUnlock()
-	return peers.byName[name]
+	return peers.loadView().byName[name]
 }
 
 // Like fetch, but increments local refcount.
@@ -328,9 +405,7 @@ func (peers *Peers) fetchAndAddRef(name PeerName) *Peer {
 // FetchByShortID returns a peer matching the passed short ID.
 // If no matching peer is found, FetchByShortID returns nil.
 func (peers *Peers) FetchByShortID(shortID PeerShortID) *Peer {
-	peers.RLock()
-	defer peers.RUnlock()
-	return peers.byShortID[shortID].peer
+	return peers.loadView().byShortID[shortID]
 }
 
 // Dereference decrements the refcount of the matching peer.
@@ -341,6 +416,13 @@ func (peers *Peers) dereference(peer *Peer) {
 	peer.localRefCount--
 }
 
+// forEach calls fun on each peer with the read lock held. Unlike
+// Fetch, it can't iterate the copy-on-write view instead: the view
+// only makes the maps immutable, and fun may look at fields of the
+// peers, such as their connections, UID and NickName, which
+// applyUpdate changes in place under the write lock. Callers which
+// only want the names of the peers should use names, which doesn't
+// take the lock.
 func (peers *Peers) forEach(fun func(*Peer)) {
 	peers.RLock()
 	defer peers.RUnlock()
@@ -349,11 +431,27 @@ func (peers *Peers) forEach(fun func(*Peer)) {
 	}
 }
 
+// stop stops garbage collection, for a router which failed to start.
+func (peers *Peers) stop() {
+	close(peers.stopChan)
+}
+
 func (peers *Peers) actorLoop() {
-	for range peers.timer.C {
+	for {
+		select {
+		case <-peers.timer.Chan():
+		case <-peers.stopChan:
+			peers.timer.Stop()
+			return
+		}
 		peers.GarbageCollect()
 		peers.Lock()
 		peers.pendingGC = false
+		if peers.gc.recheck > 0 {
+			// some peers' grace is yet to run out
+			peers.timer.Reset(peers.gc.recheck)
+			peers.pendingGC = true
+		}
 		peers.Unlock()
 	}
 }
@@ -373,11 +471,14 @@ func (peers *Peers) applyUpdate(update []byte) (peerNameSet, peerNameSet, error)
 	if err != nil {
 		return nil, nil, err
 	}
+	peers.detectHeal(decodedUpdate, &pending)
 
 	// Add new peers
 	for name, newPeer := range newPeers {
 		peers.byName[name] = newPeer
+		peers.stale = true
 		peers.addByShortID(newPeer, &pending)
+		pending.events = append(pending.events, peerEvent(PeerAdded, newPeer))
 	}
 
 	// Now apply the updates
@@ -394,7 +495,7 @@ func (peers *Peers) applyUpdate(update []byte) (peerNameSet, peerNameSet, error)
 	if !peers.pendingGC {
 		// schedule a GarbageCollect() to run after gcInterval time period
 		// corresponding to all topology updates received during the period
-		peers.timer.Reset(gcInterval)
+		peers.timer.Reset(peers.gc.interval)
 		peers.pendingGC = true
 	}
 
@@ -402,19 +503,20 @@ func (peers *Peers) applyUpdate(update []byte) (peerNameSet, peerNameSet, error)
 }
 
 func (peers *Peers) names() peerNameSet {
-	peers.RLock()
-	defer peers.RUnlock()
-
 	names := make(peerNameSet)
-	for name := range peers.byName {
+	for name := range peers.loadView().byName {
 		names[name] = struct{}{}
 	}
 	return names
 }
 
 func (peers *Peers) encodePeers(names peerNameSet) []byte {
+	return peers.encodePeersWith(gobTopologyCodec{}, names)
+}
+
+func (peers *Peers) encodePeersWith(codec topologyCodec, names peerNameSet) []byte {
 	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
+	enc := codec.encoder(buf)
 	peers.RLock()
 	defer peers.RUnlock()
 	for name := range names {
@@ -444,13 +546,24 @@ func (peers *Peers) garbageCollect(pending *peersPendingNotifications) {
 	_, reached := peers.ourself.routes(nil, false)
 	peers.ourself.RUnlock()
 
+	now := peers.ourself.router.clock().Now()
+	peers.gc.recheck = 0
 	for name, peer := range peers.byName {
-		if _, found := reached[peer.Name]; !found && peer.localRefCount == 0 {
-			delete(peers.byName, name)
-			peers.deleteByShortID(peer, pending)
-			pending.removed = append(pending.removed, peer)
+		if _, found := reached[peer.Name]; found || peer.localRefCount > 0 {
+			peers.gc.reachable(name)
+			continue
 		}
+		if !peers.gc.due(name, now) {
+			continue
+		}
+		delete(peers.byName, name)
+		peers.stale = true
+		peers.deleteByShortID(peer, pending)
+		peers.gc.bury(peer, now)
+		pending.removed = append(pending.removed, peer)
+		pending.events = append(pending.events, peerEvent(PeerRemoved, peer))
 	}
+	peers.gc.prune(now)
 
 	if len(pending.removed) > 0 && peers.byShortID[peers.ourself.ShortID].peer != peers.ourself.Peer {
 		// The local peer doesn't own its short ID. Garbage
@@ -465,10 +578,10 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 	decodedUpdate = []*Peer{}
 	decodedConns = [][]connectionSummary{}
 
-	decoder := gob.NewDecoder(bytes.NewReader(update))
+	decoder := decodeTopology(update)
 
 	for {
-		summary, connSummaries, decErr := decodePeer(decoder)
+		summary, connSummaries, decErr := decoder.next()
 		if decErr == io.EOF {
 			break
 		} else if decErr != nil {
@@ -501,24 +614,30 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 
 func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]connectionSummary, pending *peersPendingNotifications) peerNameSet {
 	newUpdate := make(peerNameSet)
+	now := peers.ourself.router.clock().Now()
 	for idx, newPeer := range decodedUpdate {
 		connSummaries := decodedConns[idx]
 		name := newPeer.Name
 		// guaranteed to find peer in the peers.byName
 		switch peer := peers.byName[name]; peer {
 		case peers.ourself.Peer:
-			if newPeer.UID != peer.UID {
+			if newPeer.UID != peer.UID || newPeer.Version > peers.ourself.version() {
 				// The update contains information about an old
-				// incarnation of ourselves. We increase our version
-				// number beyond that which we received, so our
-				// information supersedes the old one when it is
+				// incarnation of ourselves, or about the peer we
+				// took over from (see Handover). We increase our
+				// version number beyond that which we received, so
+				// our information supersedes the old one when it is
 				// received by other peers.
 				pending.localPeerModified = peers.ourself.setVersionBeyond(newPeer.Version)
 			}
 		case newPeer:
 			peer.connections = makeConnsMap(peer, connSummaries, peers.byName)
+			pending.events = append(pending.events, diffConnections(peer, nil, peer.connections)...)
 			newUpdate[name] = struct{}{}
 		default: // existing peer
+			if peers.gc.stale(peer, newPeer, now) {
+				continue
+			}
 			if newPeer.Version < peer.Version ||
 				(newPeer.Version == peer.Version &&
 					(newPeer.UID < peer.UID ||
@@ -526,10 +645,27 @@ func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]c
 							(!newPeer.HasShortID || peer.HasShortID)))) {
 				continue
 			}
+			if newPeer.NickName != peer.NickName {
+				pending.events = append(pending.events, peerEvent(PeerRenamed, newPeer))
+			}
+			if !labelsEqual(newPeer.Labels, peer.Labels) {
+				pending.events = append(pending.events, peerEvent(PeerLabelsChanged, newPeer))
+			}
 			peer.Version = newPeer.Version
 			peer.UID = newPeer.UID
-			peer.NickName = newPeer.NickName
+			peer.setNickName(newPeer.NickName)
+			peer.Draining = newPeer.Draining
+			peer.Degraded = newPeer.Degraded
+			peer.PublicKey = newPeer.PublicKey
+			peer.Leaf = newPeer.Leaf
+			peer.Zone = newPeer.Zone
+			peer.ListenAddrs = newPeer.ListenAddrs
+			peer.Addrs = newPeer.Addrs
+			peer.Labels = newPeer.Labels
+			peer.Groups = newPeer.Groups
+			oldConnections := peer.connections
 			peer.connections = makeConnsMap(peer, connSummaries, peers.byName)
+			pending.events = append(pending.events, diffConnections(peer, oldConnections, peer.connections)...)
 
 			if newPeer.ShortID != peer.ShortID || newPeer.HasShortID != peer.HasShortID {
 				peers.deleteByShortID(peer, pending)
@@ -543,11 +679,7 @@ func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]c
 	return newUpdate
 }
 
-func (peer *Peer) encode(enc *gob.Encoder) {
-	if err := enc.Encode(peer.peerSummary); err != nil {
-		panic(err)
-	}
-
+func (peer *Peer) encode(enc topologyEncoder) {
 	connSummaries := []connectionSummary{}
 	for _, conn := range peer.connections {
 		connSummaries = append(connSummaries, connectionSummary{
@@ -555,22 +687,12 @@ func (peer *Peer) encode(enc *gob.Encoder) {
 			conn.remoteTCPAddress(),
 			conn.isOutbound(),
 			conn.isEstablished(),
+			conn.isDegraded(),
+			conn.roundTripTime(),
 		})
 	}
 
-	if err := enc.Encode(connSummaries); err != nil {
-		panic(err)
-	}
-}
-
-func decodePeer(dec *gob.Decoder) (ps peerSummary, connSummaries []connectionSummary, err error) {
-	if err = dec.Decode(&ps); err != nil {
-		return
-	}
-	if err = dec.Decode(&connSummaries); err != nil {
-		return
-	}
-	return
+	enc.encode(peer.peerSummary, connSummaries)
 }
 
 func makeConnsMap(peer *Peer, connSummaries []connectionSummary, byName map[PeerName]*Peer) map[PeerName]Connection {
@@ -579,6 +701,8 @@ func makeConnsMap(peer *Peer, connSummaries []connectionSummary, byName map[Peer
 		name := PeerNameFromBin(connSummary.NameByte)
 		remotePeer := byName[name]
 		conn := newRemoteConnection(peer, remotePeer, connSummary.RemoteTCPAddr, connSummary.Outbound, connSummary.Established)
+		conn.degraded = connSummary.Degraded
+		conn.roundTrip = connSummary.RTT
 		conns[name] = conn
 	}
 	return conns
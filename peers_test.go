@@ -24,17 +24,20 @@ func newNode(name PeerName) (*Peer, *Peers) {
 	return peer.Peer, peers
 }
 
-// Check that ApplyUpdate copies the whole topology from peers
+// Check that ApplyUpdate copies the whole topology from peers, with
+// every topology codec
 func checkApplyUpdate(t *testing.T, peers *Peers) {
 	dummyName, _ := PeerNameFromString("99:00:00:01:00:00")
-	// We need a new node outside of the network, with a connection
-	// into it.
-	_, testBedPeers := newNode(dummyName)
-	testBedPeers.AddTestConnection(peers.ourself.Peer)
-	_, _, err := testBedPeers.applyUpdate(peers.encodePeers(peers.names()))
-	require.NoError(t, err)
-
-	checkTopologyPeers(t, true, testBedPeers.allPeersExcept(dummyName), peers.allPeers()...)
+	for _, codec := range topologyCodecs {
+		// We need a new node outside of the network, with a connection
+		// into it.
+		_, testBedPeers := newNode(dummyName)
+		testBedPeers.AddTestConnection(peers.ourself.Peer)
+		_, _, err := testBedPeers.applyUpdate(peers.encodePeersWith(codec, peers.names()))
+		require.NoError(t, err, codec.name())
+
+		checkTopologyPeers(t, true, testBedPeers.allPeersExcept(dummyName), peers.allPeers()...)
+	}
 }
 
 func TestPeersEncoding(t *testing.T) {
@@ -80,6 +83,16 @@ func garbageCollect(peers *Peers) []*Peer {
 	return removed
 }
 
+func TestChooseTopologyCodec(t *testing.T) {
+	ours := newProtocolFeatures()
+	codec := func(remote map[string]string) string {
+		return chooseTopologyCodec(negotiateFeatures(ours, remote).common(featureTopologyCodec)).name()
+	}
+	require.Equal(t, topologyCodecGob, codec(map[string]string{}))
+	require.Equal(t, topologyCodecGob, codec(map[string]string{protocolFeaturesKey: "topology-codec=cbor&topology-codec=gob"}))
+	require.Equal(t, topologyCodecProtobuf, codec(map[string]string{protocolFeaturesKey: ours.encode()}))
+}
+
 func TestPeersGarbageCollection(t *testing.T) {
 	const (
 		peer1NameString = "01:00:00:01:00:00"
@@ -121,6 +134,79 @@ func TestPeersGarbageCollection(t *testing.T) {
 	checkPeerArray(t, garbageCollect(ps1), p3)
 }
 
+func TestPeersGCGrace(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:02:00:00")
+	_, ps1 := newNode(name1)
+	p2, _ := newNode(name2)
+	ps1.gc = newPeerGC(Config{PeerGCGrace: time.Hour})
+	ps1.AddTestConnection(p2)
+	ps1.DeleteTestConnection(p2)
+
+	require.Empty(t, garbageCollect(ps1), "peers removed")
+	require.True(t, ps1.gc.recheck > 0 && ps1.gc.recheck <= time.Hour)
+	ps1.gc.grace = 0
+	checkPeerArray(t, garbageCollect(ps1), p2)
+	require.Equal(t, PeerGCStats{Collected: 1, Tombstones: 1}, ps1.GCStats())
+}
+
+func TestPeersTombstones(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:02:00:00")
+	name3, _ := PeerNameFromString("03:00:00:03:00:00")
+	p1, ps1 := newNode(name1)
+	p2, ps2 := newNode(name2)
+	p3, _ := newNode(name3)
+
+	// p2's first incarnation gets ahead in version, and is collected
+	ps2.AddTestConnection(p3)
+	ps2.DeleteTestConnection(p3)
+	ps2.AddTestConnection(p1)
+	ps1.AddTestConnection(p2)
+	staleUpdate := ps2.encodePeers(peerNameSet{name2: struct{}{}})
+	_, _, err := ps1.applyUpdate(staleUpdate)
+	require.NoError(t, err)
+	ps1.DeleteTestConnection(p2)
+	checkPeerArray(t, garbageCollect(ps1), p2)
+
+	// it rejoins as a new incarnation, and gossip of the old one arrives
+	p2b, ps2b := newNode(name2)
+	ps2b.AddTestConnection(p1)
+	ps1.AddTestConnection(p2b)
+	_, _, err = ps1.applyUpdate(ps2b.encodePeers(ps2b.names()))
+	require.NoError(t, err)
+	require.True(t, p2.Version > p2b.Version)
+	_, _, err = ps1.applyUpdate(staleUpdate)
+	require.NoError(t, err)
+	require.Equal(t, p2b.UID, ps1.Fetch(name2).UID)
+
+	// but without tombstones, the old one displaces it
+	_, ps1 = newNode(name1)
+	ps1.gc = newPeerGC(Config{PeerTombstoneRetention: -1})
+	ps1.AddTestConnection(p2b)
+	_, _, err = ps1.applyUpdate(ps2b.encodePeers(ps2b.names()))
+	require.NoError(t, err)
+	_, _, err = ps1.applyUpdate(staleUpdate)
+	require.NoError(t, err)
+	require.Equal(t, p2.UID, ps1.Fetch(name2).UID)
+}
+
+func TestChooseWideShortID(t *testing.T) {
+	ourself, peers := newNode(PeerName(1 << maxPeerShortIDBits))
+	peers.ourself.shortIDBits = maxPeerShortIDBits
+	// Use up all the narrow short IDs
+	var pending peersPendingNotifications
+	for i := 0; i < 1<<peerShortIDBits; i++ {
+		if PeerShortID(i) != ourself.ShortID {
+			peers.addByShortID(newPeer(PeerName(i), "", PeerUID(i), 0, PeerShortID(i)), &pending)
+		}
+	}
+	shortID, ok := peers.chooseShortID()
+	require.True(t, ok)
+	require.True(t, shortID < 1<<maxPeerShortIDBits)
+	require.Nil(t, peers.FetchByShortID(shortID))
+}
+
 func TestShortIDCollisions(t *testing.T) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	_, peers := newNode(PeerName(1 << peerShortIDBits))
@@ -381,3 +467,69 @@ func TestDeferredShortIDReassignment(t *testing.T) {
 
 	require.Equal(t, us.ourself.Peer, us.byShortID[us.ourself.ShortID].peer)
 }
+
+func TestPeersViewTracksMembership(t *testing.T) {
+	us, peers := newNode(PeerName(1))
+	them, _ := newNode(PeerName(2))
+
+	require.Nil(t, peers.Fetch(them.Name))
+	peers.AddTestConnection(them)
+	require.NotNil(t, peers.Fetch(them.Name))
+	require.Equal(t, peers.Fetch(them.Name), peers.FetchByShortID(them.ShortID))
+	require.Contains(t, peers.names(), them.Name)
+
+	peers.DeleteTestConnection(them)
+	peers.GarbageCollect()
+	require.Nil(t, peers.Fetch(them.Name))
+	require.Equal(t, us, peers.Fetch(us.Name))
+	require.NotContains(t, peers.names(), them.Name)
+}
+
+// newBenchPeers makes a Peers connected to n others.
+func newBenchPeers(n int) (*Peers, []PeerName) {
+	_, peers := newNode(PeerName(0))
+	names := make([]PeerName, n)
+	for i := range names {
+		names[i] = PeerName(i + 1)
+		other, _ := newNode(names[i])
+		peers.AddTestConnection(other)
+	}
+	return peers, names
+}
+
+func benchmarkPeersFetch(b *testing.B, withUpdates bool) {
+	peers, names := newBenchPeers(300)
+	if withUpdates {
+		// Keep the write lock busy, as topology gossip would
+		update := peers.encodePeers(peers.names())
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					peers.applyUpdate(update)
+				}
+			}
+		}()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			peers.Fetch(names[i%len(names)])
+			i++
+		}
+	})
+}
+
+func BenchmarkPeersFetch(b *testing.B) {
+	benchmarkPeersFetch(b, false)
+}
+
+func BenchmarkPeersFetchWithUpdates(b *testing.B) {
+	benchmarkPeersFetch(b, true)
+}
@@ -0,0 +1,163 @@
+package mesh
+
+import (
+	"context"
+	"sync"
+)
+
+// TopologyEventType is the type of a TopologyEvent.
+type TopologyEventType int
+
+// The types of TopologyEvent.
+const (
+	PeerAdded TopologyEventType = iota
+	PeerRemoved
+	PeerRenamed
+	ConnectionAdded
+	ConnectionRemoved
+	PeerLabelsChanged
+	PartitionHealed
+)
+
+func (t TopologyEventType) String() string {
+	switch t {
+	case PeerAdded:
+		return "PeerAdded"
+	case PeerRemoved:
+		return "PeerRemoved"
+	case PeerRenamed:
+		return "PeerRenamed"
+	case ConnectionAdded:
+		return "ConnectionAdded"
+	case ConnectionRemoved:
+		return "ConnectionRemoved"
+	case PeerLabelsChanged:
+		return "PeerLabelsChanged"
+	case PartitionHealed:
+		return "PartitionHealed"
+	}
+	return "Unknown"
+}
+
+// TopologyEvent describes a change to the topology known to Peers.
+type TopologyEvent struct {
+	Type     TopologyEventType
+	Peer     PeerName
+	NickName string
+	// Remote is the peer at the other end of the connection from Peer,
+	// for ConnectionAdded and ConnectionRemoved. Connections are
+	// reported by each end, so a connection between two remote peers
+	// is usually reported twice.
+	Remote PeerName
+	// Ours and Theirs are the peers on each side of a partition, for
+	// PartitionHealed: those we knew of, including ourself, and those
+	// we have just learnt of; see Peers.OnPartitionHealed.
+	Ours   []PeerName
+	Theirs []PeerName
+}
+
+// Watch returns a channel of changes to the topology, from now on,
+// until ctx is done, when the channel is closed. Events are queued
+// without limit for slow readers, so the channel must be drained.
+func (peers *Peers) Watch(ctx context.Context) <-chan TopologyEvent {
+	w := &topologyWatcher{more: make(chan struct{}, 1)}
+	peers.watchers.add(w)
+	ch := make(chan TopologyEvent)
+	go func() {
+		defer close(ch)
+		defer peers.watchers.remove(w)
+		for {
+			for _, event := range w.take() {
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-w.more:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+type topologyWatcher struct {
+	sync.Mutex
+	queue []TopologyEvent
+	more  chan struct{}
+}
+
+func (w *topologyWatcher) push(events []TopologyEvent) {
+	w.Lock()
+	w.queue = append(w.queue, events...)
+	w.Unlock()
+	select {
+	case w.more <- struct{}{}:
+	default:
+	}
+}
+
+func (w *topologyWatcher) take() []TopologyEvent {
+	w.Lock()
+	defer w.Unlock()
+	events := w.queue
+	w.queue = nil
+	return events
+}
+
+// topologyWatchers is the set of watchers of Peers.
+type topologyWatchers struct {
+	sync.Mutex
+	set map[*topologyWatcher]struct{}
+}
+
+func newTopologyWatchers() *topologyWatchers {
+	return &topologyWatchers{set: make(map[*topologyWatcher]struct{})}
+}
+
+func (ws *topologyWatchers) add(w *topologyWatcher) {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.set[w] = struct{}{}
+}
+
+func (ws *topologyWatchers) remove(w *topologyWatcher) {
+	ws.Lock()
+	defer ws.Unlock()
+	delete(ws.set, w)
+}
+
+func (ws *topologyWatchers) publish(events []TopologyEvent) {
+	if len(events) == 0 {
+		return
+	}
+	ws.Lock()
+	defer ws.Unlock()
+	for w := range ws.set {
+		w.push(events)
+	}
+}
+
+// diffConnections returns the events for the difference between two
+// sets of connections of peer.
+func diffConnections(peer *Peer, before, after map[PeerName]Connection) []TopologyEvent {
+	var events []TopologyEvent
+	for name := range before {
+		if _, found := after[name]; !found {
+			events = append(events, TopologyEvent{Type: ConnectionRemoved, Peer: peer.Name, NickName: peer.NickName, Remote: name})
+		}
+	}
+	for name := range after {
+		if _, found := before[name]; !found {
+			events = append(events, TopologyEvent{Type: ConnectionAdded, Peer: peer.Name, NickName: peer.NickName, Remote: name})
+		}
+	}
+	return events
+}
+
+func peerEvent(eventType TopologyEventType, peer *Peer) TopologyEvent {
+	return TopologyEvent{Type: eventType, Peer: peer.Name, NickName: peer.NickName}
+}
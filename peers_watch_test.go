@@ -0,0 +1,115 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeersWatch(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := r1.Peers.Watch(ctx)
+	seen := make(map[string]bool)
+	waitFor := func(wanted ...string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			done := true
+			for _, event := range wanted {
+				done = done && seen[event]
+			}
+			if done {
+				return
+			}
+			select {
+			case event := <-events:
+				seen[fmt.Sprint(event.Type, " ", event.Peer, " ", event.Remote)] = true
+			case <-timeout:
+				require.FailNow(t, "timed out", "waiting for %v; seen %v", wanted, seen)
+			}
+		}
+	}
+	name1, name2, name3 := r1.Ourself.Name, r2.Ourself.Name, r3.Ourself.Name
+	none := UnknownPeerName
+
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	waitFor(
+		fmt.Sprint(PeerAdded, " ", name2, " ", none),
+		fmt.Sprint(PeerAdded, " ", name3, " ", none),
+		fmt.Sprint(ConnectionAdded, " ", name1, " ", name2),
+		fmt.Sprint(ConnectionAdded, " ", name2, " ", name1),
+		fmt.Sprint(ConnectionAdded, " ", name2, " ", name3),
+		fmt.Sprint(ConnectionAdded, " ", name3, " ", name2),
+	)
+
+	r2.DeleteTestGossipConnection(r3)
+	r3.DeleteTestGossipConnection(r2)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	forcePendingGC(r1)
+	waitFor(
+		fmt.Sprint(ConnectionRemoved, " ", name2, " ", name3),
+		fmt.Sprint(PeerRemoved, " ", name3, " ", none),
+	)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestPartitionHealed(t *testing.T) {
+	var names [5]PeerName
+	var ps [5]*Peers
+	var p [5]*Peer
+	for i := range names {
+		names[i], _ = PeerNameFromString(fmt.Sprintf("%02d:00:00:0%d:00:00", i+1, i+1))
+		p[i], ps[i] = newNode(names[i])
+	}
+	var healed [][]PeerName
+	ps[0].OnPartitionHealed(func(ours, theirs []PeerName) { healed = append(healed, ours, theirs) })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ps[0].Watch(ctx)
+
+	// 1 and 2 on one side, and 3, 4 and 5 on the other
+	ps[0].AddTestConnection(p[1])
+	ps[1].AddTestConnection(p[0])
+	_, _, err := ps[0].applyUpdate(ps[1].encodePeers(peerNameSet{names[1]: struct{}{}}))
+	require.NoError(t, err)
+	require.Empty(t, healed, "joining isn't healing")
+	ps[2].AddTestConnection(p[3])
+	ps[2].AddTestConnection(p[4])
+	ps[3].AddTestConnection(p[2])
+	ps[4].AddTestConnection(p[2])
+	ps[2].applyUpdate(ps[3].encodePeers(peerNameSet{names[3]: struct{}{}}))
+	ps[2].applyUpdate(ps[4].encodePeers(peerNameSet{names[4]: struct{}{}}))
+
+	ps[0].AddTestConnection(p[2])
+	ps[2].AddTestConnection(p[0])
+	_, _, err = ps[0].applyUpdate(ps[2].encodePeers(ps[2].names()))
+	require.NoError(t, err)
+	require.Equal(t, [][]PeerName{{names[0], names[1]}, {names[2], names[3], names[4]}}, healed)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != PartitionHealed {
+				continue
+			}
+			require.Equal(t, []PeerName{names[0], names[1]}, event.Ours)
+			require.Equal(t, []PeerName{names[2], names[3], names[4]}, event.Theirs)
+			return
+		case <-timeout:
+			require.FailNow(t, "timed out")
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package mesh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Neighbours which advertise this feature understand ProtocolPowerMode,
+// so a connection can be put into low-power mode.
+const featurePower = "power"
+
+const (
+	// The period of gossip in low-power mode, unless configured.
+	defaultLowPowerGossipInterval = 5 * time.Minute
+
+	// The period of TCP keepalives on connections in low-power mode,
+	// unless configured.
+	defaultLowPowerKeepAlive = 2 * time.Minute
+)
+
+// PowerMode is how actively a router uses the network.
+type PowerMode int
+
+// PowerModes.
+const (
+	// PowerNormal is the default.
+	PowerNormal PowerMode = iota
+	// PowerLow is for battery-powered and edge devices, which should
+	// wake the network as little as possible; see Router.SetPowerMode.
+	PowerLow
+)
+
+func (mode PowerMode) String() string {
+	switch mode {
+	case PowerNormal:
+		return "normal"
+	case PowerLow:
+		return "low"
+	}
+	return fmt.Sprintf("PowerMode(%d)", int(mode))
+}
+
+// PowerConfig configures low-power mode.
+type PowerConfig struct {
+	// Mode is the mode the router starts in.
+	Mode PowerMode
+	// GossipInterval is the period of gossip in low-power mode; zero
+	// means 5 minutes.
+	GossipInterval time.Duration
+	// KeepAlive is the period of the TCP keepalives which take the
+	// place of heartbeats in low-power mode; zero means 2 minutes.
+	KeepAlive time.Duration
+}
+
+// power is the PowerMode of a router.
+type power struct {
+	sync.Mutex
+	mode PowerMode
+}
+
+// SetPowerMode switches the router's power mode. In PowerLow:
+//
+// - periodic gossip is sent every PowerConfig.GossipInterval, and
+// anti-entropy, rather than on timers of its own, at the same wakeups;
+// - connections to neighbours which support it neither send nor expect
+// heartbeats or round-trip time measurements, and detect failure by
+// TCP keepalive instead, so are slower to notice a failed neighbour.
+//
+// Unicasts, broadcasts and topology changes are still sent straight
+// away, so the router remains reachable.
+func (router *Router) SetPowerMode(mode PowerMode) {
+	router.power.Lock()
+	if router.power.mode == mode {
+		router.power.Unlock()
+		return
+	}
+	router.power.mode = mode
+	router.power.Unlock()
+	router.logger.Printf("Power mode %s", mode)
+	router.Ourself.powerChan <- mode
+	for conn := range router.Ourself.getConnections() {
+		if lc, ok := conn.(*LocalConnection); ok {
+			lc.power.setOurs(mode == PowerLow)
+		}
+	}
+}
+
+// PowerMode returns the router's power mode.
+func (router *Router) PowerMode() PowerMode {
+	router.power.Lock()
+	defer router.power.Unlock()
+	return router.power.mode
+}
+
+// lowPowerGossipInterval returns the period of gossip in low-power mode.
+func (router *Router) lowPowerGossipInterval() time.Duration {
+	if router.Power.GossipInterval > 0 {
+		return router.Power.GossipInterval
+	}
+	return defaultLowPowerGossipInterval
+}
+
+func (router *Router) lowPowerKeepAlive() time.Duration {
+	if router.Power.KeepAlive > 0 {
+		return router.Power.KeepAlive
+	}
+	return defaultLowPowerKeepAlive
+}
+
+// connectionPower is the power mode of a connection, which is low if
+// either end wants it to be. Changes are applied by the connection's
+// actor when signalled on changed.
+type connectionPower struct {
+	sync.Mutex
+	ours    bool // do we want low power?
+	told    bool // what we last told the remote of ours
+	remote  bool // does the remote want low power?
+	low     bool // as applied
+	changed chan struct{}
+}
+
+func newConnectionPower() connectionPower {
+	return connectionPower{changed: make(chan struct{}, 1)}
+}
+
+func (p *connectionPower) setOurs(low bool) {
+	p.Lock()
+	p.ours = low
+	p.Unlock()
+	p.signal()
+}
+
+func (p *connectionPower) setRemote(low bool) {
+	p.Lock()
+	p.remote = low
+	p.Unlock()
+	p.signal()
+}
+
+func (p *connectionPower) signal() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (p *connectionPower) isLow() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.low
+}
+
+// applyPower brings the connection into line with the power modes of
+// its ends, telling the remote of ours, and returns the heartbeat
+// channel to use. Only called by the actor.
+func (conn *LocalConnection) applyPower(heartbeat <-chan time.Time) (<-chan time.Time, error) {
+	if !conn.features.both(featurePower) {
+		// the remote would time us out
+		return heartbeat, nil
+	}
+	conn.power.Lock()
+	ours, told := conn.power.ours, conn.power.told
+	low, wasLow := ours || conn.power.remote, conn.power.low
+	conn.power.told, conn.power.low = ours, low
+	conn.power.Unlock()
+	if ours != told {
+		var mode byte
+		if ours {
+			mode = 1
+		}
+		if err := conn.sendProtocolMsg(protocolMsg{ProtocolPowerMode, []byte{mode}}); err != nil {
+			return heartbeat, err
+		}
+	}
+	if low == wasLow {
+		return heartbeat, nil
+	}
+	conn.logf("low-power mode %t", low)
+	if low {
+		if ka, ok := conn.tcpConn.(interface {
+			SetKeepAlive(bool) error
+			SetKeepAlivePeriod(time.Duration) error
+		}); ok {
+			if err := ka.SetKeepAlive(true); err != nil {
+				return heartbeat, err
+			}
+			if err := ka.SetKeepAlivePeriod(conn.router.lowPowerKeepAlive()); err != nil {
+				return heartbeat, err
+			}
+		}
+		return nil, conn.extendReadDeadline()
+	}
+	// The remote may have been quiet for a long time, which is no
+	// reason to suspect it.
+	conn.detector.Heartbeat(conn.router.clock().Now())
+	if err := conn.extendReadDeadline(); err != nil {
+		return heartbeat, err
+	}
+	return conn.heartbeatTCP.Chan(), conn.sendSimpleProtocolMsg(ProtocolHeartbeat)
+}
+
+// handlePowerMode records the power mode the remote wants.
+func (conn *LocalConnection) handlePowerMode(payload []byte) error {
+	if len(payload) != 1 {
+		return fmt.Errorf("malformed power mode of %d bytes", len(payload))
+	}
+	conn.power.setRemote(payload[0] != 0)
+	return nil
+}
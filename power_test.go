@@ -0,0 +1,36 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func connectionIsLowPower(r1, r2 *Router) bool {
+	conn, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	return found && conn.(*LocalConnection).power.isLow()
+}
+
+func TestPowerMode(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{Power: PowerConfig{Mode: PowerLow}})
+	defer r2.Stop()
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	defer r3.Stop()
+
+	connectTo(t, r2, r1)
+	connectTo(t, r3, r1)
+	waitUntil(t, func() bool { return connectionIsLowPower(r1, r2) && connectionIsLowPower(r2, r1) })
+	require.False(t, connectionIsLowPower(r1, r3))
+
+	r1.SetPowerMode(PowerLow)
+	require.Equal(t, PowerLow, r1.PowerMode())
+	waitUntil(t, func() bool { return connectionIsLowPower(r1, r3) && connectionIsLowPower(r3, r1) })
+
+	// the connection to r2 stays low-power, since r2 wants it to be
+	r1.SetPowerMode(PowerNormal)
+	waitUntil(t, func() bool { return !connectionIsLowPower(r1, r3) && !connectionIsLowPower(r3, r1) })
+	require.True(t, connectionIsLowPower(r1, r2))
+	require.True(t, connectionIsLowPower(r2, r1))
+}
@@ -2,10 +2,12 @@ package mesh
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 )
 
@@ -58,6 +60,12 @@ type protocolIntroParams struct {
 	Features   map[string]string
 	Conn       protocolIntroConn
 	Password   []byte
+	Ciphers    []string        // acceptable ciphers, in order of preference
+	Context    context.Context // its deadline, if any, bounds the intro
+
+	// Zero means headerTimeout and tcpHeartbeat respectively.
+	HeaderTimeout time.Duration
+	Heartbeat     time.Duration
 }
 
 // The results from a successful protocol intro.
@@ -66,12 +74,20 @@ type protocolIntroResults struct {
 	Receiver   tcpReceiver
 	Sender     tcpSender
 	SessionKey *[32]byte
+	Cipher     string
 	Version    byte
 }
 
 // DoIntro executes the protocol introduction.
 func (params protocolIntroParams) doIntro() (res protocolIntroResults, err error) {
-	if err = params.Conn.SetDeadline(time.Now().Add(headerTimeout)); err != nil {
+	timeout, heartbeat := params.HeaderTimeout, params.Heartbeat
+	if timeout <= 0 {
+		timeout = headerTimeout
+	}
+	if heartbeat <= 0 {
+		heartbeat = tcpHeartbeat
+	}
+	if err = params.Conn.SetDeadline(params.deadline(timeout)); err != nil {
 		return
 	}
 
@@ -89,7 +105,7 @@ func (params protocolIntroParams) doIntro() (res protocolIntroResults, err error
 	if err = params.Conn.SetWriteDeadline(time.Time{}); err != nil {
 		return
 	}
-	if err = params.Conn.SetReadDeadline(time.Now().Add(tcpHeartbeat * 2)); err != nil {
+	if err = params.Conn.SetReadDeadline(params.deadline(heartbeat * 2)); err != nil {
 		return
 	}
 
@@ -105,6 +121,18 @@ func (params protocolIntroParams) doIntro() (res protocolIntroResults, err error
 	return
 }
 
+// deadline returns the time by which a step of the intro taking up to
+// timeout must complete, taking account of the deadline of the context.
+func (params protocolIntroParams) deadline(timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if params.Context != nil {
+		if ctxDeadline, ok := params.Context.Deadline(); ok && ctxDeadline.Before(deadline) {
+			return ctxDeadline
+		}
+	}
+	return deadline
+}
+
 func (params protocolIntroParams) exchangeProtocolHeader() (byte, error) {
 	// Write in a separate goroutine to avoid the possibility of
 	// deadlock.  The result channel is of size 1 so that the
@@ -297,9 +325,17 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 	}
 
 	// Features exchange
+	features := params.Features
+	if res.SessionKey != nil {
+		features = make(map[string]string, len(params.Features)+1)
+		for k, v := range params.Features {
+			features[k] = v
+		}
+		features["Ciphers"] = strings.Join(params.ciphers(), ",")
+	}
 	go func() {
 		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(&params.Features); err != nil {
+		if err := gob.NewEncoder(buf).Encode(&features); err != nil {
 			writeDone <- err
 			return
 		}
@@ -320,6 +356,44 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 		return err
 	}
 
+	if res.SessionKey != nil {
+		return res.negotiateCipher(params)
+	}
+	return nil
+}
+
+func (params protocolIntroParams) ciphers() []string {
+	if len(params.Ciphers) > 0 {
+		return params.Ciphers
+	}
+	return defaultCiphers
+}
+
+// negotiateCipher switches an encrypted V2 connection, which uses NaCl
+// secretbox up to and including the features exchange, to the cipher
+// chosen from both sides' preferences. Peers which predate cipher
+// negotiation don't send a "Ciphers" feature, and only support
+// secretbox.
+func (res *protocolIntroResults) negotiateCipher(params protocolIntroParams) error {
+	theirs := []string{CipherSecretbox}
+	if ciphers, ok := res.Features["Ciphers"]; ok {
+		theirs = strings.Split(ciphers, ",")
+	}
+	name, err := chooseCipher(params.ciphers(), theirs, params.Outbound)
+	if err != nil {
+		return err
+	}
+	res.Cipher = name
+	if name == CipherSecretbox {
+		// carry on exactly as before
+		return nil
+	}
+	aead, err := newCipherAEAD(name, res.SessionKey)
+	if err != nil {
+		return err
+	}
+	res.Sender.(*encryptedTCPSender).switchCipher(aead, params.Outbound)
+	res.Receiver.(*encryptedTCPReceiver).switchCipher(aead, params.Outbound)
 	return nil
 }
 
@@ -327,6 +401,7 @@ func (res *protocolIntroResults) setupCrypto(params protocolIntroParams, remoteP
 	var remotePubKeyArr [32]byte
 	copy(remotePubKeyArr[:], remotePubKey)
 	res.SessionKey = formSessionKey(&remotePubKeyArr, privKey, params.Password)
+	res.Cipher = CipherSecretbox
 	res.Sender = newEncryptedTCPSender(res.Sender, res.SessionKey, params.Outbound)
 	res.Receiver = newEncryptedTCPReceiver(res.Receiver, res.SessionKey, params.Outbound)
 }
@@ -351,6 +426,38 @@ const (
 	ProtocolGossipBroadcast
 	// ProtocolOverlayControlMsg identifies a control msg.
 	ProtocolOverlayControlMsg
+	// ProtocolGossipDigest identifies a gossip digest msg.
+	ProtocolGossipDigest
+	// ProtocolGossipCompressed identifies a compressed gossip msg.
+	ProtocolGossipCompressed
+	// ProtocolGossipError identifies a gossip error report msg.
+	ProtocolGossipError
+	// ProtocolDeparture identifies a msg announcing that the sender
+	// is leaving the mesh.
+	ProtocolDeparture
+	// ProtocolPing identifies a msg asking the receiver to echo its
+	// payload in a ProtocolPong.
+	ProtocolPing
+	// ProtocolPong identifies the echo of a ProtocolPing.
+	ProtocolPong
+	// ProtocolFragment identifies a fragment of a larger msg.
+	ProtocolFragment
+	// ProtocolStreamFragment identifies a fragment of a msg on a stream.
+	ProtocolStreamFragment
+	// ProtocolWindowUpdate identifies a grant of flow control window to
+	// a stream.
+	ProtocolWindowUpdate
+	// ProtocolPowerMode identifies a msg saying whether the sender
+	// wants the connection in low-power mode.
+	ProtocolPowerMode
+	// ProtocolGossipMulticast identifies a gossip (multicast) msg.
+	ProtocolGossipMulticast
+	// ProtocolIdle identifies a msg saying that the sender is closing
+	// the connection as idle.
+	ProtocolIdle
+	// ProtocolResync identifies a msg asking the receiver to send the
+	// complete state of every channel, having dropped a corrupt frame.
+	ProtocolResync
 )
 
 // ProtocolMsg combines a tag and encoded msg.
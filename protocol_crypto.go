@@ -1,6 +1,8 @@
 package mesh
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
@@ -9,10 +11,26 @@ import (
 	"io"
 	"sync"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+// Ciphers which may be negotiated for encrypted connections.
+const (
+	// CipherSecretbox is NaCl secretbox, i.e. XSalsa20 and Poly1305.
+	// It is supported by all versions of mesh.
+	CipherSecretbox = "nacl-secretbox"
+	// CipherAESGCM is AES-256 in GCM mode, which is the fastest
+	// choice on CPUs with AES instructions.
+	CipherAESGCM = "aes-gcm"
+	// CipherChaCha20Poly1305 is the IETF ChaCha20-Poly1305, which is
+	// fast on CPUs without AES instructions.
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+var defaultCiphers = []string{CipherSecretbox}
+
 // MaxTCPMsgSize is the hard limit on sends and receives. Larger messages will
 // result in errors. This applies to the LengthPrefixTCP{Sender,Receiver} i.e.
 // V2 of the protocol.
@@ -35,25 +53,29 @@ func formSessionKey(remotePublicKey, localPrivateKey *[32]byte, secretKey []byte
 
 // TCP Senders/Receivers
 
-// TCPCryptoState stores session key, nonce, and sequence state.
+// TCPCryptoState stores the cipher, nonce, and sequence state.
 //
 // The lowest 64 bits of the nonce contain the message sequence number. The
 // top most bit indicates the connection polarity at the sender - '1' for
-// outbound; the next indicates protocol type - '1' for TCP. The remaining 126
+// outbound; the next indicates protocol type - '1' for TCP. The remaining
 // bits are zero. The polarity is needed so that the two ends of a connection
 // do not use the same nonces; the protocol type so that the TCP connection
 // nonces are distinct from nonces used by overlay connections, if they share
 // the session key. This is a requirement of the NaCl Security Model; see
 // http://nacl.cr.yp.to/box.html.
 type tcpCryptoState struct {
-	sessionKey *[32]byte
-	nonce      [24]byte
-	seqNo      uint64
+	aead  cipher.AEAD
+	nonce []byte
+	seqNo uint64
 }
 
-// NewTCPCryptoState returns a valid TCPCryptoState.
+// NewTCPCryptoState returns a valid TCPCryptoState using NaCl secretbox.
 func newTCPCryptoState(sessionKey *[32]byte, outbound bool) *tcpCryptoState {
-	s := &tcpCryptoState{sessionKey: sessionKey}
+	return newTCPCryptoStateWith(secretboxAEAD{sessionKey}, outbound)
+}
+
+func newTCPCryptoStateWith(aead cipher.AEAD, outbound bool) *tcpCryptoState {
+	s := &tcpCryptoState{aead: aead, nonce: make([]byte, aead.NonceSize())}
 	if outbound {
 		s.nonce[0] |= (1 << 7)
 	}
@@ -63,7 +85,82 @@ func newTCPCryptoState(sessionKey *[32]byte, outbound bool) *tcpCryptoState {
 
 func (s *tcpCryptoState) advance() {
 	s.seqNo++
-	binary.BigEndian.PutUint64(s.nonce[16:24], s.seqNo)
+	binary.BigEndian.PutUint64(s.nonce[len(s.nonce)-8:], s.seqNo)
+}
+
+// secretboxAEAD adapts NaCl secretbox to cipher.AEAD.
+type secretboxAEAD struct {
+	key *[32]byte
+}
+
+func (secretboxAEAD) NonceSize() int { return 24 }
+
+func (secretboxAEAD) Overhead() int { return secretbox.Overhead }
+
+func (a secretboxAEAD) Seal(dst, nonce, plaintext, _ []byte) []byte {
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, a.key)
+}
+
+func (a secretboxAEAD) Open(dst, nonce, ciphertext, _ []byte) ([]byte, error) {
+	var n [24]byte
+	copy(n[:], nonce)
+	msg, success := secretbox.Open(dst, ciphertext, &n, a.key)
+	if !success {
+		return nil, fmt.Errorf("Unable to decrypt TCP msg")
+	}
+	return msg, nil
+}
+
+// newCipherAEAD returns the named cipher keyed from sessionKey. Each
+// cipher gets its own key, derived from the session key and its name.
+func newCipherAEAD(name string, sessionKey *[32]byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append(append([]byte{}, sessionKey[:]...), name...))
+	switch name {
+	case CipherSecretbox:
+		return secretboxAEAD{&key}, nil
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key[:])
+	}
+	return nil, fmt.Errorf("unknown cipher %q", name)
+}
+
+// validateCiphers checks that all of ciphers, as in Config.Ciphers,
+// are supported, so that a misspelt one is reported when the router is
+// created, rather than by the handshake of every connection.
+func validateCiphers(ciphers []string) error {
+	var key [32]byte
+	for _, name := range ciphers {
+		if _, err := newCipherAEAD(name, &key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chooseCipher picks the first cipher in the preference list of the
+// side which initiated the connection that the other side supports, so
+// that both ends reach the same decision.
+func chooseCipher(ours, theirs []string, outbound bool) (string, error) {
+	initiator, responder := theirs, ours
+	if outbound {
+		initiator, responder = ours, theirs
+	}
+	for _, name := range initiator {
+		for _, other := range responder {
+			if name == other {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no cipher in common: ours %v, theirs %v", ours, theirs)
 }
 
 // TCPSender describes anything that can send byte buffers.
@@ -104,7 +201,9 @@ func (sender *lengthPrefixTCPSender) Send(msg []byte) error {
 	}
 	// We copy the message so we can send it in a single Write
 	// operation, thus making this thread-safe without locking.
-	prefixedMsg := make([]byte, 4+l)
+	buf := getBuffer(4 + l)
+	defer putBuffer(buf)
+	prefixedMsg := (*buf)[:4+l]
 	binary.BigEndian.PutUint32(prefixedMsg, uint32(l))
 	copy(prefixedMsg[4:], msg)
 	_, err := sender.writer.Write(prefixedMsg)
@@ -126,11 +225,21 @@ func newEncryptedTCPSender(sender tcpSender, sessionKey *[32]byte, outbound bool
 func (sender *encryptedTCPSender) Send(msg []byte) error {
 	sender.Lock()
 	defer sender.Unlock()
-	encodedMsg := secretbox.Seal(nil, msg, &sender.state.nonce, sender.state.sessionKey)
+	// the senders we wrap are done with the sealed msg once sent
+	buf := getBuffer(len(msg) + sender.state.aead.Overhead())
+	defer putBuffer(buf)
+	encodedMsg := sender.state.aead.Seal(*buf, sender.state.nonce, msg, nil)
 	sender.state.advance()
 	return sender.sender.Send(encodedMsg)
 }
 
+// switchCipher makes all subsequent messages use aead.
+func (sender *encryptedTCPSender) switchCipher(aead cipher.AEAD, outbound bool) {
+	sender.Lock()
+	defer sender.Unlock()
+	sender.state = newTCPCryptoStateWith(aead, outbound)
+}
+
 // tcpReceiver describes anything that can receive byte buffers.
 // It abstracts over the different protocol version receivers.
 type tcpReceiver interface {
@@ -195,11 +304,17 @@ func (receiver *encryptedTCPReceiver) Receive() ([]byte, error) {
 		return nil, err
 	}
 
-	decodedMsg, success := secretbox.Open(nil, msg, &receiver.state.nonce, receiver.state.sessionKey)
-	if !success {
+	decodedMsg, err := receiver.state.aead.Open(nil, receiver.state.nonce, msg, nil)
+	if err != nil {
 		return nil, fmt.Errorf("Unable to decrypt TCP msg")
 	}
 
 	receiver.state.advance()
 	return decodedMsg, nil
 }
+
+// switchCipher makes all subsequent messages use aead. It must only be
+// called by the goroutine calling Receive.
+func (receiver *encryptedTCPReceiver) switchCipher(aead cipher.AEAD, outbound bool) {
+	receiver.state = newTCPCryptoStateWith(aead, !outbound)
+}
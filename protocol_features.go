@@ -0,0 +1,143 @@
+package mesh
+
+import (
+	"net/url"
+	"sync"
+)
+
+// Protocol features are optional extensions of the protocol. Each side
+// of a connection advertises the features it supports in the handshake,
+// under the "ProtocolFeatures" key, as a URL-encoded query of feature
+// names with one or more values each. An extension is used on a
+// connection only if both sides advertise it, so extensions can be
+// introduced without bumping ProtocolMaxVersion.
+const protocolFeaturesKey = "ProtocolFeatures"
+
+// Features of mesh itself.
+const (
+	// ProtocolGossipDigest frames are understood.
+	featureGossipDigests = "gossip-digests"
+	// ProtocolGossipCompressed frames are understood, with the
+	// given algorithms.
+	featureCompression = "compression"
+	// Topology gossip can be decoded with the given codecs, in
+	// order of preference.
+	featureTopologyCodec = "topology-codec"
+)
+
+// protocolFeatures are the features advertised by a router.
+type protocolFeatures struct {
+	sync.RWMutex
+	values url.Values
+}
+
+func newProtocolFeatures() *protocolFeatures {
+	features := &protocolFeatures{values: make(url.Values)}
+	features.values.Set(featureGossipDigests, "1")
+	features.values.Set(featureCompression, compressionSnappy)
+	features.values.Set(featureDeparture, "1")
+	features.values.Set(featureRTT, "1")
+	features.values.Set(featureFragments, "1")
+	features.values.Set(featureStreams, "1")
+	features.values.Set(featurePower, "1")
+	features.values.Set(featureIdle, "1")
+	features.values.Set(featureChecksums, "1")
+	features.values.Set(featureGossipErrors, "1")
+	features.values.Set(featureMulticast, "1")
+	for _, codec := range topologyCodecs {
+		features.values.Add(featureTopologyCodec, codec.name())
+	}
+	return features
+}
+
+func (features *protocolFeatures) encode() string {
+	features.RLock()
+	defer features.RUnlock()
+	return features.values.Encode()
+}
+
+func (features *protocolFeatures) snapshot() url.Values {
+	features.RLock()
+	defer features.RUnlock()
+	values := make(url.Values, len(features.values))
+	for name, vs := range features.values {
+		values[name] = append([]string{}, vs...)
+	}
+	return values
+}
+
+// AdvertiseFeature adds a protocol feature, with the given values, to
+// those advertised on new connections. Applications use this to
+// introduce their own extensions, which they can then check for with
+// LocalConnection.SupportsFeature, or roll out mesh-wide with Rollout.
+func (router *Router) AdvertiseFeature(name string, values ...string) {
+	if len(values) == 0 {
+		values = []string{"1"}
+	}
+	router.features.Lock()
+	router.features.values[name] = values
+	router.features.Unlock()
+	router.rollouts.advertise()
+}
+
+// negotiatedFeatures holds the features advertised by both sides of a
+// connection.
+type negotiatedFeatures struct {
+	ours, theirs url.Values
+}
+
+func negotiateFeatures(ours *protocolFeatures, remote map[string]string) negotiatedFeatures {
+	// Peers which predate protocol features have none; a malformed
+	// advertisement is treated likewise.
+	theirs, err := url.ParseQuery(remote[protocolFeaturesKey])
+	if err != nil {
+		theirs = make(url.Values)
+	}
+	return negotiatedFeatures{ours: ours.snapshot(), theirs: theirs}
+}
+
+// both returns true if both sides advertised the feature.
+func (f negotiatedFeatures) both(name string) bool {
+	_, ours := f.ours[name]
+	_, theirs := f.theirs[name]
+	return ours && theirs
+}
+
+// common returns the values of the feature advertised by both sides,
+// in our order of preference.
+func (f negotiatedFeatures) common(name string) []string {
+	var values []string
+	for _, ours := range f.ours[name] {
+		for _, theirs := range f.theirs[name] {
+			if ours == theirs {
+				values = append(values, ours)
+				break
+			}
+		}
+	}
+	return values
+}
+
+// SupportsFeature returns true if both we and the remote peer
+// advertised the named protocol feature.
+func (conn *LocalConnection) SupportsFeature(name string) bool {
+	return conn.features.both(name)
+}
+
+// featureConnection is implemented by connections which know the
+// features negotiated with the remote peer.
+type featureConnection interface {
+	SupportsFeature(name string) bool
+}
+
+// supportsFeature returns true if conn negotiated the named feature.
+func supportsFeature(conn Connection, name string) bool {
+	fc, ok := conn.(featureConnection)
+	return ok && fc.SupportsFeature(name)
+}
+
+// RemoteFeature returns the values of a protocol feature as advertised
+// by the remote peer.
+func (conn *LocalConnection) RemoteFeature(name string) []string {
+	return conn.features.theirs[name]
+}
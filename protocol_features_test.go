@@ -0,0 +1,29 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFeatures(t *testing.T) {
+	ours := newProtocolFeatures()
+	ours.values.Set("custom", "1")
+
+	// peers which predate protocol features support none of them
+	old := negotiateFeatures(ours, map[string]string{})
+	require.False(t, old.both(featureGossipDigests))
+	require.Empty(t, old.common(featureCompression))
+
+	theirs := newProtocolFeatures()
+	theirs.values["compression"] = []string{"zstd", compressionSnappy}
+	f := negotiateFeatures(ours, map[string]string{protocolFeaturesKey: theirs.encode()})
+	require.True(t, f.both(featureGossipDigests))
+	require.False(t, f.both("custom"))
+	require.Equal(t, []string{compressionSnappy}, f.common(featureCompression))
+	require.Equal(t, []string{"zstd", compressionSnappy}, f.theirs[featureCompression])
+
+	// a malformed advertisement counts as none
+	bad := negotiateFeatures(ours, map[string]string{protocolFeaturesKey: "%zz"})
+	require.False(t, bad.both(featureGossipDigests))
+}
@@ -44,23 +44,18 @@ func doIntro(t *testing.T, params protocolIntroParams) <-chan protocolIntroResul
 }
 
 func doProtocolIntro(t *testing.T, aver, bver byte, password []byte) byte {
+	ares, _ := doProtocolIntroWith(t,
+		protocolIntroParams{MaxVersion: aver, Password: password},
+		protocolIntroParams{MaxVersion: bver, Password: password})
+	return ares.Version
+}
+
+func doProtocolIntroWith(t *testing.T, aparams, bparams protocolIntroParams) (protocolIntroResults, protocolIntroResults) {
 	aconn, bconn := connPair()
-	aresch := doIntro(t, protocolIntroParams{
-		MinVersion: ProtocolMinVersion,
-		MaxVersion: aver,
-		Features:   map[string]string{"Name": "A"},
-		Conn:       aconn,
-		Outbound:   true,
-		Password:   password,
-	})
-	bresch := doIntro(t, protocolIntroParams{
-		MinVersion: ProtocolMinVersion,
-		MaxVersion: bver,
-		Features:   map[string]string{"Name": "B"},
-		Conn:       bconn,
-		Outbound:   false,
-		Password:   password,
-	})
+	aparams.MinVersion, aparams.Features, aparams.Conn, aparams.Outbound = ProtocolMinVersion, map[string]string{"Name": "A"}, aconn, true
+	bparams.MinVersion, bparams.Features, bparams.Conn, bparams.Outbound = ProtocolMinVersion, map[string]string{"Name": "B"}, bconn, false
+	aresch := doIntro(t, aparams)
+	bresch := doIntro(t, bparams)
 	ares := <-aresch
 	bres := <-bresch
 
@@ -83,7 +78,8 @@ func doProtocolIntro(t *testing.T, aver, bver byte, password []byte) byte {
 	require.Equal(t, "Hello from B", string(data))
 
 	require.Equal(t, ares.Version, bres.Version)
-	return ares.Version
+	require.Equal(t, ares.Cipher, bres.Cipher)
+	return ares, bres
 }
 
 func TestProtocolIntro(t *testing.T) {
@@ -94,3 +90,29 @@ func TestProtocolIntro(t *testing.T) {
 	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, nil)))
 	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, []byte("w0rd"))))
 }
+
+func TestValidateCiphers(t *testing.T) {
+	require.NoError(t, validateCiphers(nil))
+	require.NoError(t, validateCiphers([]string{CipherAESGCM, CipherChaCha20Poly1305, CipherSecretbox}))
+	require.Error(t, validateCiphers([]string{CipherAESGCM, "aes-gmc"}))
+}
+
+func TestProtocolIntroCiphers(t *testing.T) {
+	password := []byte("sekr1t")
+	cipher := func(aciphers, bciphers []string) string {
+		ares, _ := doProtocolIntroWith(t,
+			protocolIntroParams{MaxVersion: ProtocolMaxVersion, Password: password, Ciphers: aciphers},
+			protocolIntroParams{MaxVersion: ProtocolMaxVersion, Password: password, Ciphers: bciphers})
+		return ares.Cipher
+	}
+	require.Equal(t, CipherSecretbox, cipher(nil, nil))
+	require.Equal(t, CipherSecretbox, cipher([]string{CipherAESGCM, CipherSecretbox}, nil))
+	require.Equal(t, CipherAESGCM, cipher([]string{CipherAESGCM, CipherChaCha20Poly1305}, []string{CipherChaCha20Poly1305, CipherAESGCM}))
+	require.Equal(t, CipherChaCha20Poly1305, cipher([]string{CipherChaCha20Poly1305}, []string{CipherAESGCM, CipherChaCha20Poly1305}))
+
+	// V1 always uses secretbox
+	ares, _ := doProtocolIntroWith(t,
+		protocolIntroParams{MaxVersion: 1, Password: password, Ciphers: []string{CipherAESGCM}},
+		protocolIntroParams{MaxVersion: 2, Password: password, Ciphers: []string{CipherAESGCM}})
+	require.Equal(t, CipherSecretbox, ares.Cipher)
+}
@@ -0,0 +1,236 @@
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dialer dials outbound connections; see Config.DialVia. *net.Dialer
+// is a Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// ProxyDialer returns a Dialer which connects through the proxy at
+// proxyURL, which is either a SOCKS5 proxy, as socks5://host:port, or an
+// HTTP proxy supporting CONNECT, as http://host:port, with credentials,
+// if any, as its user info. It reaches the proxy via forward, or
+// directly if that is nil.
+func ProxyDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy URL %q must have host and port", proxyURL)
+	}
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	return &proxyDialer{proxy: u, forward: forward}, nil
+}
+
+type proxyDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+// String returns the proxy's URL without credentials.
+func (d *proxyDialer) String() string {
+	return d.proxy.Scheme + "://" + d.proxy.Host
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(headerTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	stopAbort := abortOnDone(ctx, conn)
+	reader := bufio.NewReader(conn)
+	if d.proxy.Scheme == "http" {
+		err = d.connect(conn, reader, address)
+	} else {
+		err = d.socks5(conn, reader, address)
+	}
+	stopAbort()
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d, err)
+	}
+	return &bufferedConn{conn, reader}, nil
+}
+
+// connect asks an HTTP proxy to connect to address.
+func (d *proxyDialer) connect(conn net.Conn, reader *bufio.Reader, address string) error {
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Opaque: address},
+		Host:       address,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("CONNECT to %s refused: %s", address, resp.Status)
+	}
+	return nil
+}
+
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5PasswordAuth = 2
+	socks5Connect      = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+var errSOCKS5Protocol = errors.New("malformed SOCKS5 reply")
+
+// socks5 asks a SOCKS5 proxy to connect to address, per RFC 1928, with
+// username/password authentication per RFC 1929.
+func (d *proxyDialer) socks5(conn net.Conn, reader *bufio.Reader, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	methods := []byte{socks5NoAuth}
+	if d.proxy.User != nil {
+		methods = []byte{socks5PasswordAuth}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(reader, reply[:]); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != socks5Version:
+		return errSOCKS5Protocol
+	case reply[1] != methods[0]:
+		return fmt.Errorf("no acceptable SOCKS5 authentication method")
+	case reply[1] == socks5PasswordAuth:
+		user := d.proxy.User.Username()
+		password, _ := d.proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 credentials too long")
+		}
+		auth := append(append([]byte{1, byte(len(user))}, user...), byte(len(password)))
+		if _, err := conn.Write(append(auth, password...)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(reader, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %q", host)
+		}
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socks5IPv4), ip4...)
+	} else {
+		req = append(append(req, socks5IPv6), ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errSOCKS5Protocol
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS5 connect to %s failed: code %d", address, header[1])
+	}
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		n, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		skip = int(n)
+	default:
+		return errSOCKS5Protocol
+	}
+	_, err = io.ReadFull(reader, make([]byte, skip+2))
+	return err
+}
+
+// bufferedConn is a connection from which reads go via reader, which
+// may hold data read during a proxy's handshake.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// describeDialer names a Dialer for connection status.
+func describeDialer(dialer Dialer) string {
+	if s, ok := dialer.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", dialer)
+}
@@ -0,0 +1,177 @@
+package mesh
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func pipeConns(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// serveSOCKS5 is a SOCKS5 proxy requiring the given credentials.
+func serveSOCKS5(ln net.Listener, user, password string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			buf := make([]byte, 512)
+			io.ReadFull(conn, buf[:2])
+			io.ReadFull(conn, buf[:buf[1]])
+			conn.Write([]byte{5, 2})
+			io.ReadFull(conn, buf[:2])
+			u := make([]byte, buf[1])
+			io.ReadFull(conn, u)
+			io.ReadFull(conn, buf[:1])
+			p := make([]byte, buf[0])
+			io.ReadFull(conn, p)
+			if string(u) != user || string(p) != password {
+				conn.Write([]byte{1, 1})
+				conn.Close()
+				return
+			}
+			conn.Write([]byte{1, 0})
+			io.ReadFull(conn, buf[:5])
+			var host string
+			switch buf[3] {
+			case 1:
+				io.ReadFull(conn, buf[5:8])
+				host = net.IP(buf[4:8]).String()
+			case 3:
+				name := make([]byte, buf[4])
+				io.ReadFull(conn, name)
+				host = string(name)
+			}
+			io.ReadFull(conn, buf[:2])
+			port := int(buf[0])<<8 | int(buf[1])
+			target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				conn.Close()
+				return
+			}
+			conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			pipeConns(conn, target)
+		}()
+	}
+}
+
+// connectProxy is an HTTP proxy supporting CONNECT.
+var connectProxy = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" || r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+		http.Error(w, "forbidden", http.StatusProxyAuthRequired)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	pipeConns(conn, target)
+})
+
+func TestProxyDialer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socks.Close()
+	go serveSOCKS5(socks, "user", "secret")
+	httpProxy := httptest.NewServer(connectProxy)
+	defer httpProxy.Close()
+	httpAddr := strings.TrimPrefix(httpProxy.URL, "http://")
+
+	for _, proxyURL := range []string{"socks5://user:secret@" + socks.Addr().String(), "http://user:secret@" + httpAddr} {
+		dialer, err := ProxyDialer(proxyURL, nil)
+		require.NoError(t, err)
+		require.NotContains(t, describeDialer(dialer), "secret")
+		conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+		require.NoError(t, err, proxyURL)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		received := make([]byte, 5)
+		_, err = io.ReadFull(conn, received)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(received))
+		conn.Close()
+	}
+
+	for _, proxyURL := range []string{"socks5://user:wrong@" + socks.Addr().String(), "http://" + httpAddr} {
+		dialer, err := ProxyDialer(proxyURL, nil)
+		require.NoError(t, err)
+		_, err = dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+		require.Error(t, err, proxyURL)
+	}
+
+	_, err = ProxyDialer("ftp://proxy:21", nil)
+	require.Error(t, err)
+}
+
+func TestDialVia(t *testing.T) {
+	socks, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer socks.Close()
+	go serveSOCKS5(socks, "user", "secret")
+	dialer, err := ProxyDialer("socks5://user:secret@"+socks.Addr().String(), nil)
+	require.NoError(t, err)
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{DialVia: dialer, TrustedSubnets: []*net.IPNet{loopback}})
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+	conn, _ := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.False(t, conn.(*LocalConnection).trustRemote)
+	statuses := makeLocalConnectionStatusSlice(r1.ConnectionMaker)
+	require.Len(t, statuses, 1)
+	require.Equal(t, "socks5://"+socks.Addr().String(), statuses[0].Via)
+}
@@ -0,0 +1,91 @@
+package mesh
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Rand is the source of randomness for a Router: the UIDs and short IDs
+// of peers, the IDs of connections and messages, and the random choices
+// of gossip, routing and retries. *math/rand.Rand implements it, so
+// that rand.New(rand.NewSource(seed)) makes a Router's choices
+// repeatable; see Clock. The Router serialises its calls. The nonces
+// of encryption always come from crypto/rand.
+type Rand interface {
+	Uint64() uint64
+	Int63n(n int64) int64
+	Intn(n int) int
+	Float64() float64
+	Shuffle(n int, swap func(i, j int))
+}
+
+// defaultRand draws IDs from crypto/rand, as they must not collide
+// between peers started at the same moment, and everything else from
+// math/rand.
+type defaultRand struct{}
+
+func (defaultRand) Uint64() uint64 { return randUint64() }
+
+func (defaultRand) Int63n(n int64) int64 { return rand.Int63n(n) }
+
+func (defaultRand) Intn(n int) int { return rand.Intn(n) }
+
+func (defaultRand) Float64() float64 { return rand.Float64() }
+
+func (defaultRand) Shuffle(n int, swap func(i, j int)) { rand.Shuffle(n, swap) }
+
+// lockedRand makes a Rand safe for concurrent use.
+type lockedRand struct {
+	sync.Mutex
+	rand Rand
+}
+
+func (r *lockedRand) Uint64() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Uint64()
+}
+
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Int63n(n)
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Intn(n)
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Float64()
+}
+
+// Shuffle holds the lock while calling swap, which mustn't call back
+// into r.
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.Lock()
+	defer r.Unlock()
+	r.rand.Shuffle(n, swap)
+}
+
+// rng returns the Rand of the router, which may be nil, e.g. in tests
+// of a lone localPeer.
+func (router *Router) rng() Rand {
+	if router == nil || router.random == nil {
+		return defaultRand{}
+	}
+	return router.random
+}
+
+// rng returns the Rand of our router; routes may have no local peer in
+// tests.
+func (r *routes) rng() Rand {
+	if r.ourself == nil {
+		return defaultRand{}
+	}
+	return r.ourself.router.rng()
+}
@@ -0,0 +1,148 @@
+package mesh
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit bounds the rate at which gossip is sent. The zero value
+// means unlimited.
+type RateLimit struct {
+	// BytesPerSecond is the sustained rate.
+	BytesPerSecond int
+
+	// Burst is how many bytes may be sent at once after a quiet
+	// period. Zero means BytesPerSecond.
+	Burst int
+}
+
+// rateLimiter is a token bucket of bytes. Unlike tokenBucket, it can
+// go into debt, so that frames larger than the burst can still be sent,
+// and unicasts, which are never held back, still count against the
+// gossip which can be.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter, or nil for an unlimited rate.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.BytesPerSecond
+	}
+	return &rateLimiter{rate: float64(limit.BytesPerSecond), burst: float64(burst), tokens: float64(burst)}
+}
+
+// take spends n bytes, returning how long to wait before sending them
+// to stay within the limit.
+func (l *rateLimiter) take(n int, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// internalChannelPrefix begins the names of the gossip channels mesh
+// itself uses, besides topology, which applications may not register.
+const internalChannelPrefix = "mesh:"
+
+// internalChannel returns whether the named gossip channel is one mesh
+// itself uses, which are exempt from Config.ConnectionRateLimit.
+func internalChannel(name string) bool {
+	return name == "topology" || strings.HasPrefix(name, internalChannelPrefix)
+}
+
+// rateLimiters are the limiters of the gossip sent on one connection.
+type rateLimiters struct {
+	sync.Mutex
+	connection *rateLimiter
+	channels   map[string]*rateLimiter
+	transfer   *rateLimiter // see Config.StateTransferRateLimit
+}
+
+func (ls *rateLimiters) limiters(c *GossipChannel) (connection, channel *rateLimiter) {
+	ls.Lock()
+	defer ls.Unlock()
+	if ls.channels == nil {
+		ls.channels = make(map[string]*rateLimiter)
+		if c.ourself.router != nil {
+			connection, transfer := c.ourself.router.rateLimits()
+			ls.connection, ls.transfer = newRateLimiter(connection), newRateLimiter(transfer)
+		}
+	}
+	channel, found := ls.channels[c.name]
+	if !found {
+		channel = newRateLimiter(c.config.RateLimit)
+		ls.channels[c.name] = channel
+	}
+	if internalChannel(c.name) {
+		return nil, channel
+	}
+	return ls.connection, channel
+}
+
+// transferLimiter returns the limiter of the state transfers of the
+// channel on the connection; the channels mesh uses itself are exempt.
+func (ls *rateLimiters) transferLimiter(c *GossipChannel) *rateLimiter {
+	ls.limiters(c)
+	if internalChannel(c.name) {
+		return nil
+	}
+	return ls.transfer
+}
+
+// throttle spends n bytes of the rate limits of the channel on conn,
+// returning how long to wait before sending them.
+func (c *GossipChannel) throttle(conn Connection, n int) time.Duration {
+	connection, channel := conn.(gossipConnection).gossipSenders().limiters.limiters(c)
+	if connection == nil && channel == nil {
+		return 0
+	}
+	now := c.clock().Now()
+	wait := channel.take(n, now)
+	if connWait := connection.take(n, now); connWait > wait {
+		wait = connWait
+	}
+	return wait
+}
+
+// pace waits, unless stopped, until the gossip already sent on conn is
+// within the rate limits, returning false if stopped.
+func (c *GossipChannel) pace(conn Connection, stop <-chan struct{}) bool {
+	wait := c.throttle(conn, 0)
+	if wait <= 0 {
+		return true
+	}
+	if c.ourself.router != nil {
+		c.ourself.router.bandwidth.throttled(conn.Remote().Name, c.name, wait)
+	}
+	timer := c.clock().NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.Chan():
+		return true
+	case <-stop:
+		return false
+	}
+}
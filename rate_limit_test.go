@@ -0,0 +1,64 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	require.Nil(t, newRateLimiter(RateLimit{}))
+	require.Zero(t, (*rateLimiter)(nil).take(1000, time.Now()))
+
+	l := newRateLimiter(RateLimit{BytesPerSecond: 1000, Burst: 500})
+	now := time.Now()
+	require.Zero(t, l.take(500, now))
+	// frames larger than the burst go into debt
+	require.Equal(t, 1500*time.Millisecond, l.take(1500, now))
+	require.Equal(t, 500*time.Millisecond, l.take(0, now.Add(time.Second)))
+	// the burst is refilled, but no further
+	require.Zero(t, l.take(500, now.Add(time.Hour)))
+	require.Equal(t, 100*time.Millisecond, l.take(100, now.Add(time.Hour)))
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	config := Config{ConnectionRateLimit: RateLimit{BytesPerSecond: 10000, Burst: 100}}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	c1, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", g2)
+	require.NoError(t, err)
+	addTestGossipConnection(t, r1, r2)
+	sendPendingTopologyUpdates(r1, r2)
+	sendPendingGossip(r1, r2)
+
+	// the first broadcast goes straight out, into debt, so the second
+	// is held back
+	large := make([]byte, 1000)
+	large[0] = 1
+	c1.GossipBroadcast(newSurrogateGossipData(large))
+	sendPendingGossip(r1)
+	large[0] = 2
+	start := time.Now()
+	c1.GossipBroadcast(newSurrogateGossipData(large))
+	sendPendingGossip(r1)
+	require.True(t, time.Since(start) > 50*time.Millisecond)
+	g2.checkHas(t, 1, 2)
+
+	// the topology isn't held back
+	r1.SetDegraded(true)
+	sendPendingTopologyUpdates(r1, r2)
+	sendPendingGossip(r1, r2)
+	require.True(t, r2.Peers.Fetch(r1.Ourself.Name).Degraded)
+	for _, usage := range r1.BandwidthUsage() {
+		switch usage.Channel {
+		case "test":
+			require.True(t, usage.Throttled > 0)
+		case "topology":
+			require.Zero(t, usage.Throttled)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// RelayRequest describes a gossip message which is about to be sent to
+// a neighbouring peer, either because it originates here or because we
+// are relaying it on behalf of another peer.
+type RelayRequest struct {
+	// Channel is the name of the gossip channel, which is "topology"
+	// for the router's own topology gossip.
+	Channel string
+	// Origin is the peer the message originates from.
+	Origin PeerName
+	// Destination is the final destination of a unicast message or
+	// error report, and UnknownPeerName for broadcast and gossip
+	// messages.
+	Destination PeerName
+	// NextHop is the neighbouring peer the message would be sent to.
+	NextHop PeerName
+	// Size is the encoded size of the message in bytes.
+	Size int
+}
+
+// RelayPolicy decides whether a gossip message may be sent to a
+// neighbour. Messages it rejects are dropped, so it can be used to
+// enforce data flow policies such as "channel X never leaves zone A".
+// It is invoked concurrently, on the hot path, so must be fast.
+type RelayPolicy func(RelayRequest) bool
+
+var errRelayDenied = fmt.Errorf("relay denied by policy")
+
+// frameRoute is the addressing of a gossip frame, as known to those
+// sending it, so that the frame needn't be decoded to check it against
+// the relay policy and the channel's ACL.
+type frameRoute struct {
+	origin PeerName
+	dst    PeerName // of unicasts and error reports
+}
+
+// allowRelay consults the configured RelayPolicy, if any, about sending
+// m, on channel, by route, to conn.
+func (router *Router) allowRelay(conn Connection, channel string, m protocolMsg, route frameRoute) bool {
+	if router == nil || router.RelayPolicy == nil {
+		return true
+	}
+	return router.RelayPolicy(RelayRequest{
+		Channel:     channel,
+		Origin:      route.origin,
+		Destination: route.dst,
+		NextHop:     conn.Remote().Name,
+		Size:        len(m.msg),
+	})
+}
+
+// decodeRelayRequest extracts the addressing of a received gossip
+// frame.
+func decodeRelayRequest(m protocolMsg) (req RelayRequest, err error) {
+	req.Size = len(m.msg)
+	dec := gob.NewDecoder(bytes.NewReader(m.msg))
+	if err = dec.Decode(&req.Channel); err != nil {
+		return
+	}
+	if err = dec.Decode(&req.Origin); err != nil {
+		return
+	}
+	if m.tag == ProtocolGossipUnicast {
+		err = dec.Decode(&req.Destination)
+	}
+	return
+}
@@ -0,0 +1,305 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Protocol features are negotiated per connection, which is enough for
+// extensions only used between neighbours, but not for changes to what
+// is gossiped across the mesh, e.g. a new encoding, which every peer
+// must understand before any peer may start using it. So each peer
+// gossips the features it advertises on the rollout channel, and a
+// Rollout activates a feature only once all peers, or a quorum of them,
+// advertise it.
+
+// The name of the gossip channel on which peers advertise their
+// features mesh-wide.
+const rolloutChannelName = internalChannelPrefix + "rollout"
+
+// rolloutAdvert is the set of features a peer advertises. Versions
+// start from the time the peer started, so that those of a restarted
+// peer supersede those of its previous incarnation.
+type rolloutAdvert struct {
+	UID      PeerUID
+	Version  uint64
+	Features []string
+}
+
+func (advert rolloutAdvert) has(feature string) bool {
+	i := sort.SearchStrings(advert.Features, feature)
+	return i < len(advert.Features) && advert.Features[i] == feature
+}
+
+// rolloutState is the state of the rollout channel: the features each
+// peer advertises.
+type rolloutState struct {
+	Peers map[PeerName]rolloutAdvert
+}
+
+// Encode implements GossipData.
+func (state *rolloutState) Encode() [][]byte {
+	return [][]byte{gobEncode(state)}
+}
+
+// Merge implements GossipData.
+func (state *rolloutState) Merge(other GossipData) GossipData {
+	merged := &rolloutState{Peers: make(map[PeerName]rolloutAdvert, len(state.Peers))}
+	merged.merge(state)
+	merged.merge(other.(*rolloutState))
+	return merged
+}
+
+// merge merges other into state, returning what changed, or nil.
+func (state *rolloutState) merge(other *rolloutState) *rolloutState {
+	var delta *rolloutState
+	for name, advert := range other.Peers {
+		if known, found := state.Peers[name]; found && known.Version >= advert.Version {
+			continue
+		}
+		state.Peers[name] = advert
+		if delta == nil {
+			delta = &rolloutState{Peers: make(map[PeerName]rolloutAdvert)}
+		}
+		delta.Peers[name] = advert
+	}
+	return delta
+}
+
+// RolloutStatus describes the progress of a Rollout.
+type RolloutStatus struct {
+	Feature    string
+	Quorum     float64
+	Active     bool
+	Supporting []PeerName
+	Holdouts   []PeerName // peers which don't advertise the feature
+}
+
+// Rollout activates a protocol feature once enough peers advertise it;
+// see Router.Rollout. Once active, it stays so, even if peers which
+// don't advertise the feature join later; they are reported as
+// holdouts.
+type Rollout struct {
+	feature   string
+	quorum    float64
+	router    *Router
+	once      sync.Once
+	activated chan struct{}
+}
+
+// Rollout returns a Rollout of the named protocol feature, as advertised
+// by AdvertiseFeature, or by mesh itself. It activates once the fraction
+// quorum of the peers in the mesh, including ourself, advertise the
+// feature; zero means all of them.
+func (router *Router) Rollout(feature string, quorum float64) *Rollout {
+	if quorum <= 0 || quorum > 1 {
+		quorum = 1
+	}
+	rollout := &Rollout{feature: feature, quorum: quorum, router: router, activated: make(chan struct{})}
+	router.rollouts.add(rollout)
+	rollout.evaluate()
+	return rollout
+}
+
+// Activated returns a channel which is closed when the rollout
+// activates.
+func (rollout *Rollout) Activated() <-chan struct{} {
+	return rollout.activated
+}
+
+// Active returns whether the rollout has activated.
+func (rollout *Rollout) Active() bool {
+	select {
+	case <-rollout.activated:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status returns the progress of the rollout.
+func (rollout *Rollout) Status() RolloutStatus {
+	status := RolloutStatus{Feature: rollout.feature, Quorum: rollout.quorum}
+	supporters := rollout.router.rollouts.supporters(rollout.feature)
+	rollout.router.Peers.forEach(func(peer *Peer) {
+		if uid, found := supporters[peer.Name]; found && uid == peer.UID {
+			status.Supporting = append(status.Supporting, peer.Name)
+		} else {
+			status.Holdouts = append(status.Holdouts, peer.Name)
+		}
+	})
+	sort.Sort(peerNames(status.Supporting))
+	sort.Sort(peerNames(status.Holdouts))
+	status.Active = rollout.Active()
+	return status
+}
+
+// evaluate activates the rollout if a quorum now supports the feature.
+func (rollout *Rollout) evaluate() {
+	if rollout.Active() {
+		return
+	}
+	status := rollout.Status()
+	total := len(status.Supporting) + len(status.Holdouts)
+	if len(status.Supporting) < int(math.Ceil(rollout.quorum*float64(total))) {
+		return
+	}
+	rollout.once.Do(func() {
+		rollout.router.logger.Printf("[gossip %s]: activating %s, supported by %d of %d peers", rolloutChannelName, rollout.feature, len(status.Supporting), total)
+		close(rollout.activated)
+	})
+}
+
+type peerNames []PeerName
+
+func (names peerNames) Len() int           { return len(names) }
+func (names peerNames) Less(i, j int) bool { return names[i] < names[j] }
+func (names peerNames) Swap(i, j int)      { names[i], names[j] = names[j], names[i] }
+
+// Rollouts returns the progress of all the rollouts, by feature.
+func (router *Router) Rollouts() []RolloutStatus {
+	router.rollouts.Lock()
+	rollouts := append([]*Rollout{}, router.rollouts.rollouts...)
+	router.rollouts.Unlock()
+	statuses := make([]RolloutStatus, 0, len(rollouts))
+	for _, rollout := range rollouts {
+		statuses = append(statuses, rollout.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Feature < statuses[j].Feature })
+	return statuses
+}
+
+// rolloutCoordinator is the Gossiper of the rollout channel.
+type rolloutCoordinator struct {
+	sync.Mutex
+	router   *Router
+	state    rolloutState
+	rollouts []*Rollout
+	gossip   Gossip
+}
+
+func newRolloutCoordinator(router *Router) *rolloutCoordinator {
+	coordinator := &rolloutCoordinator{router: router, state: rolloutState{Peers: make(map[PeerName]rolloutAdvert)}}
+	coordinator.state.Peers[router.Ourself.Name] = rolloutAdvert{
+		UID:      router.Ourself.UID,
+		Version:  uint64(router.clock().Now().UnixNano()),
+		Features: coordinator.ourFeatures(),
+	}
+	return coordinator
+}
+
+func (coordinator *rolloutCoordinator) ourFeatures() []string {
+	features := make([]string, 0)
+	for name := range coordinator.router.features.snapshot() {
+		features = append(features, name)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// supporters returns the UIDs of the incarnations of peers which
+// advertise feature.
+func (coordinator *rolloutCoordinator) supporters(feature string) map[PeerName]PeerUID {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	supporters := make(map[PeerName]PeerUID)
+	for name, advert := range coordinator.state.Peers {
+		if advert.has(feature) {
+			supporters[name] = advert.UID
+		}
+	}
+	return supporters
+}
+
+func (coordinator *rolloutCoordinator) add(rollout *Rollout) {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	coordinator.rollouts = append(coordinator.rollouts, rollout)
+}
+
+// advertise gossips our features, after they change.
+func (coordinator *rolloutCoordinator) advertise() {
+	ourself := coordinator.router.Ourself
+	coordinator.Lock()
+	advert := coordinator.state.Peers[ourself.Name]
+	advert.UID = ourself.UID
+	advert.Version++
+	advert.Features = coordinator.ourFeatures()
+	coordinator.state.Peers[ourself.Name] = advert
+	coordinator.Unlock()
+	coordinator.gossip.GossipBroadcast(&rolloutState{Peers: map[PeerName]rolloutAdvert{ourself.Name: advert}})
+	coordinator.evaluate()
+}
+
+// evaluate activates any rollouts which now have a quorum, after the
+// features advertised, or the peers in the mesh, change.
+func (coordinator *rolloutCoordinator) evaluate() {
+	coordinator.Lock()
+	rollouts := append([]*Rollout{}, coordinator.rollouts...)
+	coordinator.Unlock()
+	for _, rollout := range rollouts {
+		rollout.evaluate()
+	}
+}
+
+// forget drops a departed peer.
+func (coordinator *rolloutCoordinator) forget(name PeerName) {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	delete(coordinator.state.Peers, name)
+}
+
+// receive merges a received state, returning what was new to us, if
+// anything.
+func (coordinator *rolloutCoordinator) receive(msg []byte) (*rolloutState, error) {
+	received := &rolloutState{}
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(received); err != nil {
+		return nil, err
+	}
+	coordinator.Lock()
+	delete(received.Peers, coordinator.router.Ourself.Name) // we know best
+	delta := coordinator.state.merge(received)
+	coordinator.Unlock()
+	if delta != nil {
+		coordinator.evaluate()
+	}
+	return delta, nil
+}
+
+// OnGossipUnicast implements Gossiper.
+func (coordinator *rolloutCoordinator) OnGossipUnicast(src PeerName, msg []byte) error {
+	return fmt.Errorf("unexpected rollout gossip unicast from %s", src)
+}
+
+// OnGossipBroadcast implements Gossiper.
+func (coordinator *rolloutCoordinator) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	delta, err := coordinator.receive(update)
+	if delta == nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+// Gossip implements Gossiper.
+func (coordinator *rolloutCoordinator) Gossip() GossipData {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	complete := &rolloutState{Peers: make(map[PeerName]rolloutAdvert, len(coordinator.state.Peers))}
+	for name, advert := range coordinator.state.Peers {
+		complete.Peers[name] = advert
+	}
+	return complete
+}
+
+// OnGossip implements Gossiper.
+func (coordinator *rolloutCoordinator) OnGossip(msg []byte) (GossipData, error) {
+	delta, err := coordinator.receive(msg)
+	if delta == nil {
+		return nil, err
+	}
+	return delta, nil
+}
@@ -0,0 +1,42 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollout(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	all := r1.Rollout("wide-ids", 0)
+	quorum := r1.Rollout("wide-ids", 0.6)
+	require.False(t, all.Active())
+	r1.AdvertiseFeature("wide-ids")
+	r2.AdvertiseFeature("wide-ids")
+	sendPendingGossip(routers...)
+	require.True(t, quorum.Active())
+	require.False(t, all.Active())
+	status := all.Status()
+	require.Equal(t, []PeerName{r1.Ourself.Name, r2.Ourself.Name}, status.Supporting)
+	require.Equal(t, []PeerName{r3.Ourself.Name}, status.Holdouts)
+
+	r3.AdvertiseFeature("wide-ids")
+	sendPendingGossip(routers...)
+	select {
+	case <-all.Activated():
+	default:
+		require.FailNow(t, "rollout not activated")
+	}
+	require.Len(t, r1.Rollouts(), 2)
+	require.True(t, r1.Rollouts()[0].Active)
+
+	// mesh's own features are advertised from the start
+	require.True(t, r3.Rollout(featureGossipDigests, 0).Active())
+}
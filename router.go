@@ -2,12 +2,17 @@ package mesh
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
@@ -39,6 +44,280 @@ type Config struct {
 	PeerDiscovery      bool
 	TrustedSubnets     []*net.IPNet
 	GossipInterval     *time.Duration
+
+	// SelectiveEncryption leaves connections with peers in
+	// TrustedSubnets unencrypted, sparing them the overhead, while
+	// those with peers outside them must be encrypted, and are refused
+	// if no Password is set. Both ends decide for themselves, and the
+	// handshake fails unless they agree, so a connection goes
+	// unencrypted only if each end trusts the other.
+	SelectiveEncryption bool
+
+	// HeartbeatInterval is the period of heartbeats we send on
+	// connections, which are closed after twice the longer of ours and
+	// the remote's without hearing from the remote. HandshakeTimeout is
+	// how long a new connection has to exchange protocol headers. Zero
+	// means 30s and 10s respectively; WAN and satellite links may need
+	// longer.
+	HeartbeatInterval time.Duration
+	HandshakeTimeout  time.Duration
+
+	// WriteTimeout is how long a write to a connection may take before
+	// the connection fails, so that a peer which stops reading can't
+	// stall us for long; zero means twice the HeartbeatInterval.
+	// SlowPeer evicts the peers which read too slowly for the frames
+	// queued to them to drain.
+	WriteTimeout time.Duration
+	SlowPeer     SlowPeerPolicy
+
+	// GossipFanout is the number of neighbours that periodic gossip
+	// and neighbour-subset gossip are sent to. Zero means
+	// 2*log2(number of peers).
+	GossipFanout int
+
+	// AntiEntropyInterval, if set, is the period at which the
+	// complete state of every channel is sent to every neighbour, in
+	// addition to the periodic gossip to GossipFanout neighbours.
+	AntiEntropyInterval *time.Duration
+
+	// RelayPolicy, if set, is consulted before any gossip message is
+	// sent to a neighbour.
+	RelayPolicy RelayPolicy
+
+	// CompressGossip enables snappy compression of gossip sent to
+	// neighbours which support it. Frames smaller than
+	// CompressionThreshold bytes (default 1024) are sent as-is.
+	CompressGossip       bool
+	CompressionThreshold int
+
+	// Ciphers lists the ciphers acceptable for encrypted connections,
+	// most preferred first; see CipherSecretbox etc. The cipher is
+	// chosen per connection, from the preferences of whichever side
+	// initiated it. Nil means just CipherSecretbox. NewRouter rejects
+	// any it doesn't support.
+	Ciphers []string
+
+	// AllowObservers permits read-only observer connections; see
+	// Observe.
+	AllowObservers bool
+
+	// MeshID distinguishes meshes whose routers share a Transport.
+	// Peers must have the same MeshID to connect. Peers with an empty
+	// MeshID, the default, can connect to those which predate
+	// MeshIDs.
+	MeshID string
+
+	// FailureDetector makes the detector which judges, from its
+	// heartbeats, whether the remote peer of a connection has failed.
+	// Nil means a phi-accrual detector with default parameters; see
+	// NewPhiAccrualDetector. The TCP read deadline of twice the
+	// heartbeat interval applies regardless.
+	FailureDetector func() FailureDetector
+
+	// SuspicionThreshold is the suspicion, as reported by the failure
+	// detector, at which a connection is closed. Zero means 8.
+	SuspicionThreshold float64
+
+	// Membership selects how peers learn the membership of the mesh:
+	// MembershipTopology, the default, or MembershipSWIM for very large
+	// meshes, tuned by SWIM. All peers should use the same mode.
+	Membership string
+	SWIM       SWIMConfig
+
+	// LatencyRouting makes unicast routes those with the least total
+	// round-trip time, as measured on each connection and published in
+	// the topology, rather than the fewest hops. All peers should set
+	// it alike, lest they disagree about routes.
+	LatencyRouting bool
+
+	// Multipath spreads unicasts which we originate or relay across
+	// the next hops of all the routes with the fewest hops, keeping
+	// those from each origin on each channel on one of them, and so
+	// in order, e.g. to make use of parallel links. It is ignored
+	// with LatencyRouting.
+	Multipath bool
+
+	// ConnectionRateLimit bounds the gossip sent over each connection,
+	// across all channels but those mesh uses itself, such as the
+	// topology, which along with heartbeats are never held back; see
+	// GossipChannelConfig.RateLimit.
+	ConnectionRateLimit RateLimit
+
+	// StateTransferRateLimit bounds the state transfers sent over each
+	// connection, across all channels: the complete state sent to new
+	// neighbours and periodically, or the part of it they lack
+	// according to their digests. They aren't subject to the ordinary
+	// rate limits. Progress is reported by Router.StateTransfers.
+	StateTransferRateLimit RateLimit
+
+	// Datagrams gives each connection a UDP path, used where the remote
+	// peer has one too for the small unicasts of channels configured
+	// with GossipChannelConfig.Datagrams.
+	Datagrams bool
+
+	// WebSocketTLS configures the TLS of connections to wss://
+	// targets; nil means the defaults.
+	WebSocketTLS *tls.Config
+
+	// TopologyPolicy, if set, is consulted before connecting to a peer
+	// found by PeerDiscovery, so as to constrain the topology; see
+	// MaxDegree and HubAndSpoke. Targets given explicitly are always
+	// connected to.
+	TopologyPolicy TopologyPolicy
+
+	// Leaf makes this peer a leaf of the mesh: it gossips, and traffic
+	// addressed to it is delivered, but routes never pass through it,
+	// e.g. because it is a laptop, or on a metered link. It doesn't
+	// relay broadcasts either.
+	Leaf bool
+
+	// Zone is the failure domain, e.g. availability zone, of this
+	// peer, for a PeerScorer to take into account.
+	Zone string
+
+	// Labels are our initial labels; see localPeer.SetLabels.
+	Labels map[string]string
+
+	// FrameTTL is the number of connections a gossip frame
+	// originating here may cross before it is dropped, which bounds
+	// the damage done by routing loops while routes disagree. Zero
+	// means 64, which must be at least the diameter of the mesh.
+	FrameTTL int
+
+	// SurrogateBufferLimit bounds the memory, in bytes, used to
+	// remember the recent updates on channels we relay but haven't
+	// registered, for deduplication, and for replay to Gossipers
+	// registering late. The updates of the least recently used
+	// channels are evicted beyond it. Zero means 4 MiB.
+	SurrogateBufferLimit int
+
+	// PeerScorer, if set, scores peers as neighbours, when choosing
+	// those to gossip to, connect to or keep, and to relay broadcasts
+	// through.
+	PeerScorer PeerScorer
+
+	// Power configures low-power mode, for battery-powered and edge
+	// devices; see Router.SetPowerMode.
+	Power PowerConfig
+
+	// Backoff is how long to wait before retrying targets, e.g. more
+	// gently on flaky WAN links than on a LAN.
+	Backoff BackoffPolicy
+
+	// HandshakeLimit, if set, bounds the outbound connections whose
+	// handshakes are in progress at once, e.g. so that starting with
+	// hundreds of targets doesn't peg the CPU of a small device.
+	// HandshakeQueue decides which of the targets held back go first.
+	HandshakeLimit int
+	HandshakeQueue HandshakeQueuePolicy
+
+	// ListenOn are further addresses, in host:port format, for Start to
+	// listen on, besides Host and Port, e.g. one per interface; see
+	// Router.AddListener.
+	ListenOn []string
+
+	// Source selects the local address to dial outbound connections
+	// from.
+	Source SourceConfig
+
+	// ShortIDBits is the width of peers' short IDs, from 12, the
+	// default, to 20, which a mesh of more than about a thousand peers
+	// needs to avoid frequent collisions. All peers in a mesh must use
+	// the same width; connections between peers which don't are
+	// refused.
+	ShortIDBits uint
+
+	// NAT configures NAT traversal, for peers which can only dial out.
+	NAT NATConfig
+
+	// PeerStore, if set, persists the addresses of the peers in the
+	// mesh, so that a restarted peer can rejoin it by them, as targets
+	// of SourceCache, even if the targets it was given are down. It
+	// also records our name and nickname, which a router given
+	// UnknownPeerName, or no nickname, takes from it.
+	PeerStore PeerStore
+
+	// DialVia, if set, dials outbound connections in place of dialling
+	// them directly, e.g. through a SOCKS5 or HTTP CONNECT proxy given
+	// by ProxyDialer. Connections it dials are never deemed to be from
+	// TrustedSubnets, since their remote address needn't be the peer's.
+	DialVia Dialer
+
+	// Clock and Rand, if set, are the sources of time and randomness
+	// for the router in place of the wall clock and the rand packages,
+	// e.g. a ManualClock and a seeded math/rand.Rand, to make
+	// simulations and tests of timing reproducible.
+	Clock Clock
+	Rand  Rand
+
+	// SpanTracer, if set, records spans of the gossip sent, relayed and
+	// handled here, and propagates their context in the frames; see
+	// SpanTracer.
+	SpanTracer SpanTracer
+
+	// IdleTimeout, if set, closes connections which have carried no
+	// gossip on the application's channels, in either direction, for
+	// this long, so long as every peer remains reachable without them,
+	// e.g. in very large meshes where full connectivity is unnecessary.
+	// Neither end redials a connection closed as idle until the peer
+	// becomes unreachable, or we originate a unicast to it.
+	IdleTimeout time.Duration
+
+	// TCPKeepAlive is the period of TCP keepalives on connections; zero
+	// leaves the defaults, and negative disables them. Connections in
+	// low-power mode use PowerConfig.KeepAlive instead.
+	TCPKeepAlive time.Duration
+
+	// BanSigningKey, if set, signs the bans made by BanPeer and
+	// BanPeerUID, which are then gossiped to the other peers.
+	// BanTrustedKeys are the public keys of those whose bans we
+	// enforce, besides our own. Bans signed by other keys are ignored,
+	// so that a compromised peer can't ban the rest.
+	BanSigningKey  ed25519.PrivateKey
+	BanTrustedKeys []ed25519.PublicKey
+
+	// TrustSigningKey, if set, signs the trust bundles published by
+	// PublishTrustBundle, which are then gossiped to the other peers.
+	// TrustTrustedKeys are the public keys of those whose bundles we
+	// install, besides our own. Bundles signed by other keys are
+	// ignored, so that a compromised peer can't replace the trust
+	// anchors of the rest.
+	TrustSigningKey  ed25519.PrivateKey
+	TrustTrustedKeys []ed25519.PublicKey
+
+	// PeerGCInterval is how long after a change of topology peers which
+	// have become unreachable are garbage collected; one second if
+	// unset. PeerGCGrace, if set, keeps unreachable peers for at least
+	// that long, e.g. so that those briefly partitioned away keep their
+	// short IDs.
+	PeerGCInterval time.Duration
+	PeerGCGrace    time.Duration
+
+	// PeerTombstoneRetention is how long the incarnation of a collected
+	// peer is remembered, so that stale gossip of it doesn't displace
+	// the new incarnation of a peer which rejoins while that is still
+	// propagating; one minute if unset, and negative disables it.
+	PeerTombstoneRetention time.Duration
+
+	// NameSources derive our name, from the first of them which yields
+	// one, when NewRouter is given UnknownPeerName, e.g.
+	// PeerNameFromMachineID, or PeerNameFile. Should the derived name
+	// collide with that of a peer we connect to before we have joined
+	// the mesh, the router stops, and Stop and Run return the error. So
+	// does NewRouter, should it collide with that of another router of
+	// this process.
+	NameSources []PeerNameSource
+
+	// PartitionHealThreshold is the number of peers we must learn of
+	// from one topology update, having known of others, for it to be
+	// deemed to heal a partition of the mesh; two if unset, and negative
+	// disables detecting it. See Peers.OnPartitionHealed.
+	PartitionHealThreshold int
+
+	// StuckConnectionAge is how long a connection may be pending before
+	// Router.HealthCheck reports it as stuck; zero means twice the
+	// HeartbeatInterval.
+	StuckConnectionAge time.Duration
 }
 
 // Router manages communication between this peer and the rest of the mesh.
@@ -53,98 +332,403 @@ type Router struct {
 	gossipLock      sync.RWMutex
 	gossipChannels  gossipChannels
 	topologyGossip  Gossip
-	acceptLimiter   *tokenBucket
+	trust           *trustDistributor
+	bans            *banList
+	nat             *natTraversal
+	rollouts        *rolloutCoordinator
+	aggregator      *statusAggregator
+	tracer          *tracer
+	handover        *Handover // we took over with, if any
+	bandwidth       *bandwidthMeter
+	gossipSchedule  *gossipScheduler
+	transfers       *stateTransfers
+	observers       *observers
+	features        *protocolFeatures
+	flaps           *flapCounter
+	power           power
+	maintenance     maintenance
+	connEvents      connectionEvents
+	taps            taps
+	ctx             context.Context // done when the router stops
+	cancel          context.CancelFunc
+	transportLock   sync.Mutex
+	transport       *Transport
+	ownTransport    bool // did Start create the transport?
+	departure       departure
+	unicastKey      *[32]byte // private half of Ourself.PublicKey
+	faults          faultInjector
+	swim            *swimMembership // nil unless using MembershipSWIM
+	lifecycle       *peerLifecycle
+	surrogates      *surrogateBuffers
+	random          Rand         // Config.Rand, locked
+	configLock      sync.RWMutex // guards the Config ApplyConfig changes
+	nameClaim       nameClaim
 	logger          Logger
 }
 
+var errRouterStopped = fmt.Errorf("router stopped")
+
 // NewRouter returns a new router. It must be started.
 func NewRouter(config Config, name PeerName, nickName string, overlay Overlay, logger Logger) (*Router, error) {
-	router := &Router{Config: config, gossipChannels: make(gossipChannels)}
+	return NewRouterWithContext(context.Background(), config, name, nickName, overlay, logger)
+}
+
+// NewRouterWithContext returns a new router, which stops when ctx is
+// done. It must be started.
+func NewRouterWithContext(ctx context.Context, config Config, name PeerName, nickName string, overlay Overlay, logger Logger) (*Router, error) {
+	return newRouter(ctx, config, name, nickName, nil, overlay, logger)
+}
 
-	if overlay == nil {
-		overlay = NullOverlay{}
+func newRouter(ctx context.Context, config Config, name PeerName, nickName string, handover *Handover, overlay Overlay, logger Logger) (_ *Router, err error) {
+	router := &Router{Config: config, gossipChannels: make(gossipChannels), bandwidth: newBandwidthMeter(), transfers: newStateTransfers(), observers: newObservers(), features: newProtocolFeatures(), power: power{mode: config.Power.Mode}}
+	if err := config.Source.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateTimeouts(config); err != nil {
+		return nil, err
+	}
+	if err := validateCiphers(config.Ciphers); err != nil {
+		return nil, err
+	}
+	if err := validateFrameTTL(config.FrameTTL); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(config.Labels); err != nil {
+		return nil, err
+	}
+	if err := validateSurrogateBufferLimit(config.SurrogateBufferLimit); err != nil {
+		return nil, err
+	}
+	if err := validateSigningKeys(config); err != nil {
+		return nil, err
+	}
+	if config.ShortIDBits != 0 && (config.ShortIDBits < peerShortIDBits || config.ShortIDBits > maxPeerShortIDBits) {
+		return nil, fmt.Errorf("short ID width must be from %d to %d bits, not %d", peerShortIDBits, maxPeerShortIDBits, config.ShortIDBits)
+	}
+	router.surrogates = newSurrogateBuffers(config.SurrogateBufferLimit)
+	if config.Rand != nil {
+		router.random = &lockedRand{rand: config.Rand}
+	}
+	router.gossipSchedule = newGossipScheduler(router.rng())
+	router.flaps = newFlapCounter(router.clock())
+	router.bandwidth.now = router.clock().Now
+	router.ctx, router.cancel = context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			router.abandon()
+		}
+	}()
+
+	var cache PeerCache
+	if config.PeerStore != nil {
+		var err error
+		if cache, err = config.PeerStore.Load(); err != nil {
+			return nil, err
+		}
+		if name == UnknownPeerName {
+			name = cache.Name
+		}
+		if nickName == "" {
+			nickName = cache.NickName
+		}
+	}
+	if name == UnknownPeerName && len(config.NameSources) > 0 {
+		derived, err := DerivePeerName(config.NameSources...)
+		if err != nil {
+			return nil, err
+		}
+		name, router.nameClaim.derived = derived, true
 	}
 
-	router.Overlay = overlay
+	router.Overlay = SelectOverlay(logger, overlay)
 	router.Ourself = newLocalPeer(name, nickName, router)
+	router.Ourself.Leaf = config.Leaf
+	router.Ourself.Zone = config.Zone
+	router.Ourself.Labels = copyLabels(config.Labels)
+	publicKey, privateKey, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	router.Ourself.PublicKey, router.unicastKey = publicKey[:], privateKey
+	if handover != nil {
+		router.takeOver(handover)
+	}
 	router.Peers = newPeers(router.Ourself)
 	router.Peers.OnGC(func(peer *Peer) {
 		logger.Printf("Removed unreachable peer %s", peer)
+		router.bandwidth.forget(peer.Name)
+		router.transfers.forget(peer.Name)
+		for channel := range router.gossipChannelSet() {
+			if channel.ordering != nil {
+				channel.ordering.forget(peer.Name)
+			}
+			channel.errors.forget(peer.Name)
+		}
+		router.trust.forget(peer.Name)
+		router.nat.forget(peer.Name)
+		router.rollouts.forget(peer.Name)
+		router.flaps.forget(peer.Name)
+		router.refreshPeerStates()
 	})
+	router.lifecycle = newPeerLifecycle()
 	router.Routes = newRoutes(router.Ourself, router.Peers)
+	router.Routes.fanout = config.GossipFanout
+	router.Routes.latency = config.LatencyRouting
+	router.Routes.ecmp = config.Multipath
+	if config.PeerScorer != nil {
+		router.Routes.score = router.scoreNeighbour
+		router.Routes.broadcastRank = router.rankForBroadcast
+	}
+	if config.Membership == MembershipSWIM {
+		router.swim = newSWIMMembership(router, config.SWIM)
+		router.Routes.vector = router.swim
+	}
+	router.Routes.OnChange(func() { router.observers.sendTopology(router) })
+	router.Routes.OnChange(router.refreshPeerStates)
 	router.ConnectionMaker = newConnectionMaker(router.Ourself, router.Peers, net.JoinHostPort(router.Host, "0"), router.Port, router.PeerDiscovery, logger)
+	router.ConnectionMaker.backoff = config.Backoff
+	router.ConnectionMaker.handshakes = handshakeLimit{limit: config.HandshakeLimit, policy: config.HandshakeQueue}
 	router.logger = logger
-	gossip, err := router.NewGossip("topology", router)
+	gossip, err := router.newInternalGossip("topology", router)
 	if err != nil {
 		return nil, err
 	}
 	router.topologyGossip = gossip
-	router.acceptLimiter = newTokenBucket(acceptMaxTokens, acceptTokenDelay)
+	router.trust = newTrustDistributor(name)
+	if router.trust.gossip, err = router.newInternalGossip(trustChannelName, trustGossiper{router}); err != nil {
+		return nil, err
+	}
+	router.bans = newBanList(router)
+	if router.bans.gossip, err = router.newInternalGossip(banChannelName, router.bans); err != nil {
+		return nil, err
+	}
+	router.nat = newNATTraversal(router)
+	if router.nat.gossip, err = router.newInternalGossip(natChannelName, router.nat); err != nil {
+		return nil, err
+	}
+	router.rollouts = newRolloutCoordinator(router)
+	if router.rollouts.gossip, err = router.newInternalGossip(rolloutChannelName, router.rollouts); err != nil {
+		return nil, err
+	}
+	router.Routes.OnChange(router.rollouts.evaluate)
+	router.aggregator = newStatusAggregator(router)
+	if router.aggregator.gossip, err = router.newInternalGossip(statusChannelName, router.aggregator); err != nil {
+		return nil, err
+	}
+	router.tracer = newTracer(router)
+	if router.tracer.gossip, err = router.newInternalGossip(traceChannelName, router.tracer); err != nil {
+		return nil, err
+	}
+	switch config.Membership {
+	case "", MembershipTopology:
+	case MembershipSWIM:
+		if router.swim.gossip, err = router.newInternalGossip(swimChannelName, router.swim); err != nil {
+			return nil, err
+		}
+		go router.swim.run(router.ctx)
+	default:
+		return nil, fmt.Errorf("unknown membership mode %q", config.Membership)
+	}
+	if handover != nil {
+		// restored only now that mesh's own channels are ready
+		router.handover = handover
+		for channel := range router.gossipChannelSet() {
+			router.restoreChannel(channel)
+		}
+	}
+	if config.PeerStore != nil {
+		router.restorePeerCache(config.PeerStore, cache)
+	}
+	if router.nameClaim.derived {
+		if err := router.claimName(); err != nil {
+			return nil, err
+		}
+	}
+	if ctx.Done() != nil {
+		go func() {
+			<-router.ctx.Done()
+			router.Stop()
+		}()
+	}
 	return router, nil
 }
 
+// abandon stops what newRouter started before failing.
+func (router *Router) abandon() {
+	router.cancel()
+	if router.ConnectionMaker != nil {
+		router.ConnectionMaker.stop()
+	}
+	if router.Routes != nil {
+		router.Routes.stop()
+	}
+	if router.Peers != nil {
+		router.Peers.stop()
+	}
+	if router.Ourself != nil {
+		router.Ourself.stop()
+	}
+}
+
 // Start listening for TCP connections. This is separate from NewRouter so
 // that gossipers can register before we start forming connections.
 func (router *Router) Start() {
-	router.listenTCP()
+	transport, err := newTransport(router.Host, router.Port, router.NAT.BehindNAT, router.handshakeTimeout(), router.clock(), router.logger)
+	if err != nil {
+		panic(err)
+	}
+	for _, address := range router.ListenOn {
+		if _, err := transport.Listen(address); err != nil {
+			transport.Close()
+			panic(err)
+		}
+	}
+	if err := router.startOn(transport, true); err != nil {
+		transport.Close()
+		panic(err)
+	}
 }
 
-// Stop shuts down the router.
-func (router *Router) Stop() error {
-	router.Overlay.Stop()
-	// TODO: perform more graceful shutdown...
-	return nil
+// StartOn starts the router accepting connections from transport, which
+// may be shared with routers in other meshes, instead of listening
+// itself.
+func (router *Router) StartOn(transport *Transport) error {
+	return router.startOn(transport, false)
 }
 
-func (router *Router) usingPassword() bool {
-	return router.Password != nil
+func (router *Router) startOn(transport *Transport, own bool) error {
+	router.transportLock.Lock()
+	defer router.transportLock.Unlock()
+	if router.ctx.Err() != nil {
+		return errRouterStopped
+	}
+	if router.transport != nil {
+		return fmt.Errorf("router already started")
+	}
+	if err := transport.attach(router); err != nil {
+		return err
+	}
+	router.transport, router.ownTransport = transport, own
+	router.advertiseListenAddrs()
+	return nil
 }
 
-func (router *Router) listenTCP() {
-	localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(router.Host, fmt.Sprint(router.Port)))
-	if err != nil {
-		panic(err)
+// Run starts the router, and stops it when ctx is done, or Stop is
+// called, whichever is first.
+func (router *Router) Run(ctx context.Context) error {
+	router.Start()
+	select {
+	case <-ctx.Done():
+	case <-router.ctx.Done():
 	}
-	ln, err := net.ListenTCP("tcp", localAddr)
-	if err != nil {
-		panic(err)
+	return router.Stop()
+}
+
+// Stop shuts down the router: it stops listening, abandons any dials and
+// handshakes in progress, and closes all connections. Stop may be called
+// more than once.
+func (router *Router) Stop() error {
+	router.cancel()
+	router.detachTransport()
+	for conn := range router.Ourself.getConnections() {
+		conn.(ourConnection).shutdown(errRouterStopped)
 	}
-	go func() {
-		defer ln.Close()
-		for {
-			tcpConn, err := ln.AcceptTCP()
-			if err != nil {
-				router.logger.Printf("%v", err)
-				continue
-			}
-			router.acceptTCP(tcpConn)
-			router.acceptLimiter.wait()
+	router.Overlay.Stop()
+	router.releaseName()
+	// TODO: perform more graceful shutdown...
+	return router.nameCollision()
+}
+
+// detachTransport stops the router accepting connections.
+func (router *Router) detachTransport() {
+	router.transportLock.Lock()
+	defer router.transportLock.Unlock()
+	if router.transport != nil {
+		router.transport.detach(router)
+		if router.ownTransport {
+			router.transport.Close()
 		}
-	}()
+		router.transport = nil
+	}
+}
+
+func (router *Router) usingPassword() bool {
+	return router.password() != nil
 }
 
 func (router *Router) acceptTCP(tcpConn *net.TCPConn) {
+	router.acceptPreread(tcpConn, nil)
+}
+
+// acceptPreread accepts a connection from whose start the transport has
+// already read preread.
+func (router *Router) acceptPreread(tcpConn net.Conn, preread []byte) {
+	if router.departing() {
+		tcpConn.Close()
+		return
+	}
 	remoteAddrStr := tcpConn.RemoteAddr().String()
 	router.logger.Printf("->[%s] connection accepted", remoteAddrStr)
 	connRemote := newRemoteConnection(router.Ourself.Peer, nil, remoteAddrStr, false, false)
-	startLocalConnection(connRemote, tcpConn, router, true, router.logger)
+	startLocalConnection(connRemote, tcpConn, "", preread, router, true, router.logger)
 }
 
 // NewGossip returns a usable GossipChannel from the router.
 //
 // TODO(pb): rename?
 func (router *Router) NewGossip(channelName string, g Gossiper) (Gossip, error) {
-	channel := newGossipChannel(channelName, router.Ourself, router.Routes, g, router.logger)
+	channel, err := router.NewGossipChannel(channelName, g, GossipChannelConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// NewGossipChannel returns a usable GossipChannel from the router,
+// configured with the optional behaviours in config. Channels may be
+// registered once the router has started, taking over from the
+// surrogate which relayed the channel's gossip until then, or after a
+// channel of the same name has been closed. Names beginning "mesh:" are
+// reserved for mesh's own channels, as is "topology".
+func (router *Router) NewGossipChannel(channelName string, g Gossiper, config GossipChannelConfig) (*GossipChannel, error) {
+	if internalChannel(channelName) {
+		return nil, fmt.Errorf("[gossip] reserved channel name %s", channelName)
+	}
+	return router.registerGossipChannel(channelName, g, config)
+}
+
+// newInternalGossip registers one of mesh's own channels.
+func (router *Router) newInternalGossip(channelName string, g Gossiper) (Gossip, error) {
+	channel, err := router.registerGossipChannel(channelName, g, GossipChannelConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// registerGossipChannel registers a channel of any name.
+func (router *Router) registerGossipChannel(channelName string, g Gossiper, config GossipChannelConfig) (*GossipChannel, error) {
+	channel := newGossipChannel(channelName, config, router.Ourself, router.Routes, g, router.logger)
 	router.gossipLock.Lock()
-	defer router.gossipLock.Unlock()
-	if _, found := router.gossipChannels[channelName]; found {
+	prev, found := router.gossipChannels[channelName]
+	if found && !prev.replaceable() {
+		router.gossipLock.Unlock()
 		return nil, fmt.Errorf("[gossip] duplicate channel %s", channelName)
 	}
+	if found {
+		atomic.StoreInt32(&prev.closed, 1)
+		router.retireSenders(channelName)
+	}
 	router.gossipChannels[channelName] = channel
+	router.gossipLock.Unlock()
+	router.restoreChannel(channel)
+	if found {
+		router.replaceChannel(prev, channel)
+	}
 	return channel, nil
 }
 
-func (router *Router) gossipChannel(channelName string) *gossipChannel {
+func (router *Router) gossipChannel(channelName string) *GossipChannel {
 	router.gossipLock.RLock()
 	channel, found := router.gossipChannels[channelName]
 	router.gossipLock.RUnlock()
@@ -156,14 +740,14 @@ func (router *Router) gossipChannel(channelName string) *gossipChannel {
 	if channel, found = router.gossipChannels[channelName]; found {
 		return channel
 	}
-	channel = newGossipChannel(channelName, router.Ourself, router.Routes, &surrogateGossiper{router: router}, router.logger)
+	channel = newGossipChannel(channelName, GossipChannelConfig{}, router.Ourself, router.Routes, newSurrogateGossiper(channelName, router), router.logger)
 	channel.logf("created surrogate channel")
 	router.gossipChannels[channelName] = channel
 	return channel
 }
 
-func (router *Router) gossipChannelSet() map[*gossipChannel]struct{} {
-	channels := make(map[*gossipChannel]struct{})
+func (router *Router) gossipChannelSet() map[*GossipChannel]struct{} {
+	channels := make(map[*GossipChannel]struct{})
 	router.gossipLock.RLock()
 	defer router.gossipLock.RUnlock()
 	for _, channel := range router.gossipChannels {
@@ -180,43 +764,97 @@ func (router *Router) gossipInterval() time.Duration {
 	}
 }
 
-func (router *Router) handleGossip(tag protocolTag, payload []byte) error {
+// antiEntropyInterval returns the period of full-state exchanges with
+// all neighbours, and whether they are enabled at all.
+func (router *Router) antiEntropyInterval() (time.Duration, bool) {
+	if router.Config.AntiEntropyInterval != nil && *router.Config.AntiEntropyInterval > 0 {
+		return *router.Config.AntiEntropyInterval, true
+	}
+	return 0, false
+}
+
+// handleGossip processes a gossip frame received from the directly
+// connected peer named sender.
+func (router *Router) handleGossip(sender PeerName, tag protocolTag, payload []byte) error {
+	_, err := router.receiveGossip(sender, tag, payload)
+	return err
+}
+
+// receiveGossip is handleGossip, also returning the name of the
+// channel, once decoded.
+func (router *Router) receiveGossip(sender PeerName, tag protocolTag, payload []byte) (string, error) {
 	decoder := gob.NewDecoder(bytes.NewReader(payload))
 	var channelName string
 	if err := decoder.Decode(&channelName); err != nil {
-		return err
+		return "", err
 	}
 	channel := router.gossipChannel(channelName)
+	if channel.Quarantined() {
+		channel = channel.relayOnly()
+	}
+	if err := channel.checkFrame(payload); err != nil {
+		return channelName, err
+	}
+	if !channel.admittedFrom(protocolMsg{tag, payload}, sender) {
+		channel.logf("dropping frame from %s denied by the channel's ACL", sender)
+		channel.countDenied()
+		return channelName, nil
+	}
+	channel.countReceived(len(payload))
+	router.bandwidth.received(sender, channelName, len(payload))
+	router.observers.forward(channel, tag, payload)
+	deliver := func() error {
+		return channel.protect(func() error { return channel.deliverFrame(sender, tag, decoder, payload) })
+	}
+	if router.injectFaults(channelName, deliver) {
+		return channelName, nil
+	}
+	return channelName, deliver()
+}
+
+// deliverFrame delivers a frame received on the channel from the
+// neighbour sender, whose name has already been decoded.
+func (c *GossipChannel) deliverFrame(sender PeerName, tag protocolTag, decoder *gob.Decoder, payload []byte) error {
 	var srcName PeerName
 	if err := decoder.Decode(&srcName); err != nil {
 		return err
 	}
 	switch tag {
 	case ProtocolGossipUnicast:
-		return channel.deliverUnicast(srcName, payload, decoder)
+		return c.deliverUnicast(sender, srcName, payload, decoder)
 	case ProtocolGossipBroadcast:
-		return channel.deliverBroadcast(srcName, payload, decoder)
+		return c.deliverBroadcast(sender, srcName, payload, decoder)
 	case ProtocolGossip:
-		return channel.deliver(srcName, payload, decoder)
+		return c.deliver(srcName, payload, decoder)
+	case ProtocolGossipDigest:
+		return c.deliverDigest(srcName, payload, decoder)
+	case ProtocolGossipError:
+		return c.deliverError(srcName, payload, decoder)
+	case ProtocolGossipMulticast:
+		return c.deliverMulticast(sender, srcName, decoder)
 	}
 	return nil
 }
 
-// Relay all pending gossip data for each channel via random neighbours.
+// Relay all pending gossip data for each channel via random neighbours,
+// servicing the channels in the order chosen by the gossip scheduler.
 func (router *Router) sendAllGossip() {
-	for channel := range router.gossipChannelSet() {
-		if gossip := channel.gossiper.Gossip(); gossip != nil {
-			channel.Send(gossip)
-		}
+	for _, channel := range router.gossipSchedule.order(router.gossipChannelSet(), router.bandwidth.sentByChannel()) {
+		channel.protect(func() error { channel.gossipNeighbours(); return nil })
+	}
+}
+
+// Send the complete state of each channel to every neighbour.
+func (router *Router) sendAntiEntropy() {
+	for conn := range router.Ourself.getConnections() {
+		router.sendAllGossipDown(conn)
 	}
 }
 
 // Relay all pending gossip data for each channel via conn.
 func (router *Router) sendAllGossipDown(conn Connection) {
 	for channel := range router.gossipChannelSet() {
-		if gossip := channel.gossiper.Gossip(); gossip != nil {
-			channel.SendDown(conn, gossip)
-		}
+		channel.protect(func() error { channel.gossipDown(conn); return nil })
 	}
 }
 
@@ -232,6 +870,9 @@ func (router *Router) sendPendingGossip() bool {
 // BroadcastTopologyUpdate is invoked whenever there is a change to the mesh
 // topology, and broadcasts the new set of peers to the mesh.
 func (router *Router) broadcastTopologyUpdate(update peerNameSet) {
+	if update = router.topologyScope(update); len(update) == 0 {
+		return
+	}
 	gossipData := &topologyGossipData{peers: router.Peers, update: update}
 	router.topologyGossip.GossipNeighbourSubset(gossipData)
 }
@@ -246,7 +887,7 @@ func (router *Router) OnGossipUnicast(sender PeerName, msg []byte) error {
 // It returns the received update unchanged.
 func (router *Router) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
 	origUpdate, _, err := router.applyTopologyUpdate(update)
-	if err != nil || len(origUpdate) == 0 {
+	if origUpdate = router.topologyScope(origUpdate); err != nil || len(origUpdate) == 0 {
 		return nil, err
 	}
 	return &topologyGossipData{peers: router.Peers, update: origUpdate}, nil
@@ -254,7 +895,7 @@ func (router *Router) OnGossipBroadcast(_ PeerName, update []byte) (GossipData,
 
 // Gossip yields the current topology as GossipData.
 func (router *Router) Gossip() GossipData {
-	return &topologyGossipData{peers: router.Peers, update: router.Peers.names()}
+	return &topologyGossipData{peers: router.Peers, update: router.topologyScope(router.Peers.names())}
 }
 
 // OnGossip receives broadcasts of TopologyGossipData.
@@ -262,12 +903,26 @@ func (router *Router) Gossip() GossipData {
 // See peers.ApplyUpdate.
 func (router *Router) OnGossip(update []byte) (GossipData, error) {
 	_, newUpdate, err := router.applyTopologyUpdate(update)
-	if err != nil || len(newUpdate) == 0 {
+	if newUpdate = router.topologyScope(newUpdate); err != nil || len(newUpdate) == 0 {
 		return nil, err
 	}
 	return &topologyGossipData{peers: router.Peers, update: newUpdate}, nil
 }
 
+// topologyScope trims a topology update to the peers we gossip about:
+// all of them, except with MembershipSWIM, when it's just ourself, so
+// that our neighbours learn our connections, but no further. Routes
+// beyond our neighbours are then learnt from the routes they advertise.
+func (router *Router) topologyScope(update peerNameSet) peerNameSet {
+	if router.swim == nil {
+		return update
+	}
+	if _, found := update[router.Ourself.Name]; found {
+		return peerNameSet{router.Ourself.Name: struct{}{}}
+	}
+	return nil
+}
+
 func (router *Router) applyTopologyUpdate(update []byte) (peerNameSet, peerNameSet, error) {
 	origUpdate, newUpdate, err := router.Peers.applyUpdate(update)
 	if err != nil {
@@ -280,20 +935,44 @@ func (router *Router) applyTopologyUpdate(update []byte) (peerNameSet, peerNameS
 	return origUpdate, newUpdate, nil
 }
 
-func (router *Router) trusts(remote *remoteConnection) bool {
-	if tcpAddr, err := net.ResolveTCPAddr("tcp", remote.remoteTCPAddr); err == nil {
-		for _, trustedSubnet := range router.TrustedSubnets {
+// trustsConn reports whether the peer at the other end of conn is on a
+// trusted subnet. Connections over WebSockets never are, as they often
+// come through a proxy, whose address is all we see.
+func (router *Router) trustsConn(conn net.Conn) bool {
+	if _, ok := conn.(*webSocketConn); ok {
+		return false
+	}
+	return router.trusts(conn.RemoteAddr())
+}
+
+func (router *Router) trusts(remoteAddr net.Addr) bool {
+	if tcpAddr := tcpAddrOf(remoteAddr); tcpAddr != nil {
+		for _, trustedSubnet := range router.trustedSubnets() {
 			if trustedSubnet.Contains(tcpAddr.IP) {
 				return true
 			}
 		}
 	} else {
-		// Should not happen as remoteTCPAddr was obtained from TCPConn
-		router.logger.Printf("Unable to parse remote TCP addr: %s", err)
+		// Should not happen as remoteAddr was obtained from a TCP
+		// connection, if perhaps beneath WebSockets
+		router.logger.Printf("Unable to parse remote TCP addr: %s", remoteAddr)
 	}
 	return false
 }
 
+// tcpAddrOf returns the TCP address of a connection, or nil if it has
+// none.
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr.String())
+	if err != nil {
+		return nil
+	}
+	return tcpAddr
+}
+
 // The set of peers in the mesh network.
 // Gossiped just like anything else.
 type topologyGossipData struct {
@@ -317,3 +996,17 @@ func (d *topologyGossipData) Merge(other GossipData) GossipData {
 func (d *topologyGossipData) Encode() [][]byte {
 	return [][]byte{d.peers.encodePeers(d.update)}
 }
+
+// encodeFor implements connectionEncoder, using the topology codec
+// negotiated on conn.
+func (d *topologyGossipData) encodeFor(conn Connection) [][]byte {
+	return [][]byte{d.peers.encodePeersWith(topologyCodecFor(conn), d.update)}
+}
+
+// shortIDBits returns the width of peers' short IDs.
+func (router *Router) shortIDBits() uint {
+	if router.ShortIDBits != 0 {
+		return router.ShortIDBits
+	}
+	return peerShortIDBits
+}
@@ -0,0 +1,126 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterRunStopsOnContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	r1, err := NewRouter(Config{}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+
+	peerLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer peerLn.Close()
+	go func() {
+		for {
+			tcpConn, err := peerLn.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	// a peer which accepts connections, but never completes a handshake
+	silentLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer silentLn.Close()
+	silent := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := silentLn.Accept(); err == nil {
+			silent <- conn
+		}
+	}()
+
+	ran := make(chan error, 1)
+	go func() { ran <- r1.Run(ctx) }()
+	r1.ConnectionMaker.InitiateConnections([]string{peerLn.Addr().String(), silentLn.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		conn, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+		return found && conn.isEstablished()
+	})
+	var handshaking net.Conn
+	select {
+	case handshaking = <-silent:
+		defer handshaking.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to silent peer")
+	}
+
+	cancel()
+	select {
+	case err := <-ran:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	waitUntil(t, func() bool {
+		_, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+		return !found
+	})
+
+	// the handshake in progress was abandoned
+	require.NoError(t, handshaking.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = ioutil.ReadAll(handshaking)
+	if netErr, ok := err.(net.Error); ok {
+		require.False(t, netErr.Timeout())
+	}
+
+	gossip, err := r1.NewGossipChannel("test", newTestGossiper(), GossipChannelConfig{})
+	require.NoError(t, err)
+	require.Equal(t, context.Canceled, gossip.GossipUnicastContext(ctx, r2.Ourself.Name, []byte("hello")))
+}
+
+// waitUntil polls condition until it holds, failing after a few
+// seconds. Unlike require.Eventually, it never has more than one call
+// of condition in flight, which can be slow here while the routers are
+// busy.
+func waitUntil(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition never satisfied")
+		}
+	}
+}
+
+func TestShortIDBits(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	_, err := NewRouter(Config{ShortIDBits: maxPeerShortIDBits + 1}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.Error(t, err)
+
+	wide := Config{ShortIDBits: maxPeerShortIDBits}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", wide)
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", wide)
+	defer r2.Stop()
+	narrow := newTestRouter(t, "03:00:00:03:00:00")
+	defer narrow.Stop()
+
+	connectTo(t, r1, r2)
+	require.Equal(t, r1.Ourself.ShortID, r2.Peers.Fetch(r1.Ourself.Name).ShortID)
+
+	target := fmt.Sprintf("127.0.0.1:%d", narrow.listenPort())
+	require.Empty(t, r1.ConnectionMaker.InitiateConnections([]string{target}, false))
+	waitUntil(t, func() bool {
+		for _, conn := range NewStatus(r1).Connections {
+			if conn.Address == target && strings.Contains(conn.Info, "Short ID width mismatch") {
+				return true
+			}
+		}
+		return false
+	})
+	_, found := r1.Ourself.ConnectionTo(narrow.Ourself.Name)
+	require.False(t, found)
+}
@@ -2,7 +2,6 @@ package mesh
 
 import (
 	"math"
-	"math/rand"
 	"sync"
 	"time"
 )
@@ -15,15 +14,23 @@ type routes struct {
 	sync.RWMutex
 	ourself       *localPeer
 	peers         *Peers
+	fanout        int                    // if non-zero, overrides the number of random neighbours
+	latency       bool                   // weight unicast routes by round-trip time?
+	ecmp          bool                   // spread unicasts across equal-cost routes?
+	score         func(PeerName) float64 // if set, weights neighbours for gossip
+	broadcastRank func(*Peer) float64    // if set, ranks relays of broadcasts
+	vector        distanceVector         // if set, supplies the routes in place of the topology
 	onChange      []func()
 	unicast       unicastRoutes
 	unicastAll    unicastRoutes // [1]
 	broadcast     broadcastRoutes
 	broadcastAll  broadcastRoutes // [1]
-	recalcTimer   *time.Timer
+	multipath     multipathRoutes // [1], if ecmp
+	recalcTimer   Timer
 	pendingRecalc bool
 	wait          chan chan struct{}
 	action        chan<- func()
+	stopChan      chan struct{}
 	// [1] based on *all* connections, not just established &
 	// symmetric ones
 }
@@ -34,6 +41,18 @@ const (
 	recalcDeferTime = 100 * time.Millisecond
 )
 
+// distanceVector supplies routes learnt from the routes our neighbours
+// advertise, rather than calculated from the topology, which with
+// MembershipSWIM only extends to our neighbours.
+type distanceVector interface {
+	// nextHops returns the next hop to each peer we have a route to.
+	nextHops() unicastRoutes
+	// relaysFor returns the neighbours to relay broadcasts from src,
+	// other than ourself, to: those whose own route to src is via us,
+	// so that each peer receives them once.
+	relaysFor(src PeerName) []PeerName
+}
+
 // newRoutes returns a usable Routes based on the LocalPeer and existing Peers.
 func newRoutes(ourself *localPeer, peers *Peers) *routes {
 	wait := make(chan chan struct{})
@@ -45,9 +64,10 @@ func newRoutes(ourself *localPeer, peers *Peers) *routes {
 		unicastAll:   unicastRoutes{ourself.Name: UnknownPeerName},
 		broadcast:    broadcastRoutes{ourself.Name: []PeerName{}},
 		broadcastAll: broadcastRoutes{ourself.Name: []PeerName{}},
-		recalcTimer:  time.NewTimer(time.Hour),
+		recalcTimer:  ourself.router.clock().NewTimer(time.Hour),
 		wait:         wait,
 		action:       action,
+		stopChan:     make(chan struct{}),
 	}
 	r.recalcTimer.Stop()
 	go r.run(wait, action)
@@ -140,9 +160,14 @@ func (r *routes) lookupOrCalculate(name PeerName, broadcast *broadcastRoutes, es
 // sparsely connected peers this function returns a higher proportion of
 // neighbours than elsewhere. In extremis, on peers with fewer than
 // log2(n_peers) neighbours, all neighbours are returned.
+//
+// If a fanout is configured, we choose min(fanout, n_neighbouring_peers)
+// neighbours instead.
+//
+// If a PeerScorer is configured, the weight of each neighbour is
+// multiplied by its score.
 func (r *routes) randomNeighbours(except PeerName) []PeerName {
 	r.RLock()
-	defer r.RUnlock()
 	var total int64 = 0
 	weights := make(map[PeerName]int64)
 	// First iterate the whole set, counting how often each neighbour appears
@@ -152,11 +177,28 @@ func (r *routes) randomNeighbours(except PeerName) []PeerName {
 			weights[dst]++
 		}
 	}
-	needed := int(math.Min(2*math.Log2(float64(len(r.unicastAll))), float64(len(weights))))
+	want := 2 * math.Log2(float64(len(r.unicastAll)))
+	if r.fanout > 0 {
+		want = float64(r.fanout)
+	}
+	score := r.score
+	r.RUnlock()
+	needed := int(math.Min(want, float64(len(weights))))
 	destinations := make([]PeerName, 0, needed)
+	if score != nil {
+		// scoring takes locks of its own, so is done unlocked
+		scored := make(map[PeerName]float64, len(weights))
+		for dst, count := range weights {
+			scored[dst] = float64(count) * score(dst)
+		}
+		for len(destinations) < needed {
+			destinations = append(destinations, pickWeighted(r.rng(), scored))
+		}
+		return destinations
+	}
 	for len(destinations) < needed {
 		// Pick a random point on the distribution and linear search for it
-		rnd := rand.Int63n(total)
+		rnd := r.rng().Int63n(total)
 		for dst, count := range weights {
 			if rnd < count {
 				destinations = append(destinations, dst)
@@ -202,10 +244,15 @@ func (r *routes) ensureRecalculated() {
 	<-done
 }
 
+// stop stops recalculating routes, for a router which failed to start.
+func (r *routes) stop() {
+	close(r.stopChan)
+}
+
 func (r *routes) run(wait <-chan chan struct{}, action <-chan func()) {
 	for {
 		select {
-		case <-r.recalcTimer.C:
+		case <-r.recalcTimer.Chan():
 			r.clearPendingRecalcFlag()
 			r.calculate()
 		case done := <-wait:
@@ -213,13 +260,16 @@ func (r *routes) run(wait <-chan chan struct{}, action <-chan func()) {
 			pending := r.pendingRecalc
 			r.Unlock()
 			if pending {
-				<-r.recalcTimer.C
+				<-r.recalcTimer.Chan()
 				r.clearPendingRecalcFlag()
 				r.calculate()
 			}
 			close(done)
 		case f := <-action:
 			f()
+		case <-r.stopChan:
+			r.recalcTimer.Stop()
+			return
 		}
 	}
 }
@@ -237,6 +287,10 @@ func (r *routes) calculate() {
 	)
 	broadcast[r.ourself.Name] = r.calculateBroadcast(r.ourself.Name, true)
 	broadcastAll[r.ourself.Name] = r.calculateBroadcast(r.ourself.Name, false)
+	var multipath multipathRoutes
+	if r.ecmp && !r.latency && r.vector == nil {
+		multipath = r.calculateMultipath(unicastAll)
+	}
 	r.ourself.RUnlock()
 	r.peers.RUnlock()
 
@@ -245,6 +299,7 @@ func (r *routes) calculate() {
 	r.unicastAll = unicastAll
 	r.broadcast = broadcast
 	r.broadcastAll = broadcastAll
+	r.multipath = multipath
 	onChange := r.onChange
 	r.Unlock()
 
@@ -263,7 +318,25 @@ func (r *routes) calculate() {
 // to exchange knowledge of MAC addresses, nor any constraints on
 // the routes that we construct.
 func (r *routes) calculateUnicast(establishedAndSymmetric bool) unicastRoutes {
-	_, unicast := r.ourself.routes(nil, establishedAndSymmetric)
+	unicast := r.unicastFrom(r.ourself.Peer, establishedAndSymmetric)
+	if r.vector != nil {
+		// the topology only covers our neighbours, and perhaps theirs
+		for name, hop := range r.vector.nextHops() {
+			if _, found := unicast[name]; !found {
+				unicast[name] = hop
+			}
+		}
+	}
+	return unicast
+}
+
+// unicastFrom calculates the unicast routes from peer, which is ourself,
+// or a copy of ourself in a hypothetical topology.
+func (r *routes) unicastFrom(peer *Peer, establishedAndSymmetric bool) unicastRoutes {
+	if r.latency {
+		return peer.latencyRoutes(establishedAndSymmetric)
+	}
+	_, unicast := peer.routes(nil, establishedAndSymmetric)
 	return unicast
 }
 
@@ -288,10 +361,14 @@ func (r *routes) calculateUnicast(establishedAndSymmetric bool) unicastRoutes {
 func (r *routes) calculateBroadcast(name PeerName, establishedAndSymmetric bool) []PeerName {
 	hops := []PeerName{}
 	peer, found := r.peers.byName[name]
-	if !found {
+	if !found || (r.ourself.Leaf && name != r.ourself.Name) {
+		// leaves don't relay the broadcasts of others
 		return hops
 	}
-	if found, reached := peer.routes(r.ourself.Peer, establishedAndSymmetric); found {
+	if r.vector != nil && name != r.ourself.Name {
+		return append(hops, r.vector.relaysFor(name)...)
+	}
+	if found, reached := peer.rankedRoutes(r.ourself.Peer, establishedAndSymmetric, r.broadcastRank); found {
 		r.ourself.forEachConnectedPeer(establishedAndSymmetric, reached,
 			func(remotePeer *Peer) { hops = append(hops, remotePeer.Name) })
 	}
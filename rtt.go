@@ -0,0 +1,270 @@
+package mesh
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Neighbours which advertise this feature answer ProtocolPing with
+// ProtocolPong, so we can measure the round-trip time of connections.
+const featureRTT = "rtt"
+
+const (
+	// How often each established connection measures its round-trip
+	// time.
+	rttPingInterval = 10 * time.Second
+
+	// The weight of each new sample in the smoothed round-trip time, as
+	// in TCP's SRTT.
+	rttSmoothing = 8
+
+	// With Config.LatencyRouting, the smoothed round-trip time is
+	// republished when it has changed by more than this fraction since
+	// it was last published, so that jitter doesn't flood the mesh
+	// with topology updates.
+	rttRepublishFraction = 4
+
+	// The routing cost of connections whose round-trip time has not
+	// been measured.
+	unmeasuredRTT = 10 * time.Millisecond
+)
+
+// rttEstimator smooths the round-trip times measured on a connection,
+// and the fraction of pings which go unanswered.
+type rttEstimator struct {
+	sync.Mutex
+	smoothed  time.Duration
+	published time.Duration
+	loss      float64
+	awaiting  bool      // a pong to the last ping
+	seq       uint64    // of the last ping
+	sent      time.Time // when the last ping was sent
+}
+
+// pinged records that a ping is being sent at now, counting the last as
+// lost if it went unanswered, and returns its sequence number.
+func (e *rttEstimator) pinged(now time.Time) uint64 {
+	e.Lock()
+	defer e.Unlock()
+	if e.awaiting {
+		e.loss += (1 - e.loss) / rttSmoothing
+	}
+	e.awaiting = true
+	e.seq++
+	e.sent = now
+	return e.seq
+}
+
+// ponged returns the round-trip time of the ping with sequence number
+// seq, answered at now, or false if that isn't the ping awaiting an
+// answer.
+func (e *rttEstimator) ponged(seq uint64, now time.Time) (time.Duration, bool) {
+	e.Lock()
+	defer e.Unlock()
+	if !e.awaiting || seq != e.seq {
+		return 0, false
+	}
+	return now.Sub(e.sent), true
+}
+
+// sample records a measurement, returning the smoothed round-trip time.
+func (e *rttEstimator) sample(rtt time.Duration) time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	if e.awaiting {
+		e.loss -= e.loss / rttSmoothing
+		e.awaiting = false
+	}
+	if e.smoothed == 0 {
+		e.smoothed = rtt
+	} else {
+		e.smoothed += (rtt - e.smoothed) / rttSmoothing
+	}
+	return e.smoothed
+}
+
+func (e *rttEstimator) estimate() time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	return e.smoothed
+}
+
+func (e *rttEstimator) lossRate() float64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.loss
+}
+
+// republish returns whether the smoothed round-trip time has changed
+// enough since it was last published to be published again, recording
+// that it is.
+func (e *rttEstimator) republish() bool {
+	e.Lock()
+	defer e.Unlock()
+	change := e.smoothed - e.published
+	if change < 0 {
+		change = -change
+	}
+	if e.published != 0 && change <= e.published/rttRepublishFraction {
+		return false
+	}
+	e.published = e.smoothed
+	return true
+}
+
+// sendPing asks the remote to echo the sequence number of the ping.
+// The time it was sent is kept by us, rather than trusted to the
+// remote to echo.
+func (conn *LocalConnection) sendPing() error {
+	if !conn.features.both(featureRTT) {
+		return nil
+	}
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], conn.rtt.pinged(conn.router.clock().Now()))
+	return conn.sendProtocolMsg(protocolMsg{ProtocolPing, payload[:]})
+}
+
+// handlePong records the round-trip time of an echoed ping, publishing
+// it if routing is weighted by latency.
+func (conn *LocalConnection) handlePong(payload []byte) error {
+	if len(payload) != 8 {
+		return fmt.Errorf("malformed pong of %d bytes", len(payload))
+	}
+	rtt, ok := conn.rtt.ponged(binary.BigEndian.Uint64(payload), conn.router.clock().Now())
+	if !ok || rtt <= 0 {
+		return nil
+	}
+	smoothed := conn.rtt.sample(rtt)
+	if conn.router.LatencyRouting && conn.rtt.republish() {
+		if err := conn.router.Ourself.setConnectionRoundTripTime(conn.remote.Name, smoothed); err == nil {
+			conn.router.Routes.recalculate()
+		}
+	}
+	return nil
+}
+
+// measuredConnection is implemented by our connections, via
+// remoteConnection.
+type measuredConnection interface {
+	setRoundTripTime(rtt time.Duration) (changed bool)
+}
+
+func (peer *localPeer) setConnectionRoundTripTime(name PeerName, rtt time.Duration) error {
+	peer.Lock()
+	conn, found := peer.connections[name]
+	if !found {
+		peer.Unlock()
+		return fmt.Errorf("no connection to %s", name)
+	}
+	if !conn.(measuredConnection).setRoundTripTime(rtt) {
+		peer.Unlock()
+		return nil
+	}
+	peer.Version++
+	peer.Unlock()
+	peer.broadcastPeerUpdate()
+	return nil
+}
+
+// connectionCost returns the routing cost of passing from one peer to
+// another, which is the greater of the round-trip times they have
+// published for the connection.
+func connectionCost(from, to *Peer) time.Duration {
+	var cost time.Duration
+	if conn, found := from.connections[to.Name]; found {
+		cost = conn.roundTripTime()
+	}
+	if conn, found := to.connections[from.Name]; found && conn.roundTripTime() > cost {
+		cost = conn.roundTripTime()
+	}
+	if cost == 0 {
+		return unmeasuredRTT
+	}
+	return cost
+}
+
+// latencyRoutes is like routes, but finds the routes with the least
+// total round-trip time, rather than the fewest hops, within each tier
+// of detours.
+func (peer *Peer) latencyRoutes(establishedAndSymmetric bool) unicastRoutes {
+	routes := make(unicastRoutes)
+	routes[peer.Name] = UnknownPeerName
+	for tier := 0; tier <= maxDetour; tier++ {
+		for name, hop := range peer.shortestPaths(tier, establishedAndSymmetric) {
+			if _, found := routes[name]; !found {
+				routes[name] = hop
+			}
+		}
+	}
+	return routes
+}
+
+// shortestPaths runs Dijkstra's algorithm from the peer, through peers
+// and connections with detours of at most the given tier, returning the
+// first hop towards each peer reached. Ties are broken by peer name, so
+// the routes are deterministic.
+func (peer *Peer) shortestPaths(tier int, establishedAndSymmetric bool) map[PeerName]PeerName {
+	firstHops := make(map[PeerName]PeerName)
+	distances := map[PeerName]time.Duration{peer.Name: 0}
+	visited := make(peerNameSet)
+	queue := &pathQueue{{peer, 0, UnknownPeerName}}
+	for queue.Len() > 0 {
+		cur := heap.Pop(queue).(pathEntry)
+		if _, found := visited[cur.peer.Name]; found {
+			continue
+		}
+		visited[cur.peer.Name] = struct{}{}
+		if cur.peer != peer {
+			firstHops[cur.peer.Name] = cur.firstHop
+			if cur.peer.detour() > tier || cur.peer.Leaf {
+				continue
+			}
+		}
+		cur.peer.forEachConnectedPeer(establishedAndSymmetric, nil, func(remotePeer *Peer) {
+			if connectionDetour(cur.peer, remotePeer) > tier {
+				return
+			}
+			distance := cur.distance + connectionCost(cur.peer, remotePeer)
+			if known, found := distances[remotePeer.Name]; found && known <= distance {
+				return
+			}
+			distances[remotePeer.Name] = distance
+			firstHop := cur.firstHop
+			if cur.peer == peer {
+				firstHop = remotePeer.Name
+			}
+			heap.Push(queue, pathEntry{remotePeer, distance, firstHop})
+		})
+	}
+	return firstHops
+}
+
+type pathEntry struct {
+	peer     *Peer
+	distance time.Duration
+	firstHop PeerName
+}
+
+// pathQueue is a priority queue of paths, shortest first.
+type pathQueue []pathEntry
+
+func (q pathQueue) Len() int      { return len(q) }
+func (q pathQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q pathQueue) Less(i, j int) bool {
+	if q[i].distance != q[j].distance {
+		return q[i].distance < q[j].distance
+	}
+	return q[i].peer.Name < q[j].peer.Name
+}
+
+func (q *pathQueue) Push(x interface{}) { *q = append(*q, x.(pathEntry)) }
+
+func (q *pathQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,108 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTripTime(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+
+	// the first ping is sent once the connection is established
+	waitUntil(t, func() bool {
+		for _, conn := range NewStatus(r1).Connections {
+			if conn.Peer == r2.Ourself.Name.String() && conn.RTT > 0 {
+				return true
+			}
+		}
+		return false
+	})
+
+	// without latency routing, it isn't published
+	conn, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, found)
+	require.Zero(t, conn.roundTripTime())
+}
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+	require.Equal(t, 8*time.Millisecond, e.sample(8*time.Millisecond))
+	require.True(t, e.republish())
+	require.Equal(t, 9*time.Millisecond, e.sample(16*time.Millisecond))
+	require.False(t, e.republish())
+	e.sample(40 * time.Millisecond)
+	require.True(t, e.republish())
+}
+
+func TestRTTEstimatorPongs(t *testing.T) {
+	var e rttEstimator
+	start := time.Unix(1000, 0)
+	_, ok := e.ponged(0, start)
+	require.False(t, ok)
+	stale := e.pinged(start)
+	seq := e.pinged(start.Add(time.Second))
+	// only the answer to the last ping counts
+	_, ok = e.ponged(stale, start.Add(2*time.Second))
+	require.False(t, ok)
+	rtt, ok := e.ponged(seq, start.Add(1500*time.Millisecond))
+	require.True(t, ok)
+	require.Equal(t, 500*time.Millisecond, rtt)
+}
+
+func TestLatencyRouting(t *testing.T) {
+	config := Config{LatencyRouting: true}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", config)
+	r4 := newTestRouterWithConfig(t, "04:00:00:04:00:00", config)
+	r5 := newTestRouterWithConfig(t, "05:00:00:05:00:00", config)
+	routers := []*Router{r1, r2, r3, r4, r5}
+	// r1 reaches r3 via r2, or via r4 and r5
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r1, r4)
+	addTestGossipConnection(t, r4, r5)
+	addTestGossipConnection(t, r5, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2, r5), r4.tp(r1, r5), r5.tp(r4, r3))
+	route := func(from, to *Router) PeerName {
+		from.Routes.ensureRecalculated()
+		hop, found := from.Routes.UnicastAll(to.Ourself.Name)
+		require.True(t, found)
+		return hop
+	}
+	require.Equal(t, r2.Ourself.Name, route(r1, r3))
+	require.Equal(t, r2.Ourself.Name, route(r3, r1))
+
+	// a slow connection is routed around, despite the extra hop, by
+	// both ends
+	require.NoError(t, r2.Ourself.setConnectionRoundTripTime(r3.Ourself.Name, 50*time.Millisecond))
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.Equal(t, 50*time.Millisecond, r1.Peers.Fetch(r2.Ourself.Name).connections[r3.Ourself.Name].roundTripTime())
+	require.Equal(t, r4.Ourself.Name, route(r1, r3))
+	require.Equal(t, r5.Ourself.Name, route(r3, r1))
+
+	// broadcast routes are unaffected
+	r1.Routes.ensureRecalculated()
+	require.ElementsMatch(t, []PeerName{r2.Ourself.Name, r4.Ourself.Name}, r1.Routes.BroadcastAll(r1.Ourself.Name))
+}
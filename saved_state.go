@@ -0,0 +1,54 @@
+package mesh
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// The version of the format written by SaveState.
+const savedStateVersion = 1
+
+// savedState is the complete state of a channel's Gossiper, as
+// written by SaveState.
+type savedState struct {
+	Version  int
+	Channel  string
+	Messages [][]byte // as encoded by the Gossiper's GossipData
+}
+
+// SaveState writes the complete state of the channel's Gossiper, as
+// returned by Gossiper.Gossip, to w, for LoadState to load when the
+// peer restarts.
+func (c *GossipChannel) SaveState(w io.Writer) error {
+	saved := savedState{Version: savedStateVersion, Channel: c.name}
+	if gossip := c.gossiper.Gossip(); gossip != nil {
+		saved.Messages = gossip.Encode()
+	}
+	return gob.NewEncoder(w).Encode(saved)
+}
+
+// LoadState reads the state of the channel's Gossiper written by
+// SaveState from r, and delivers it to the Gossiper as if received by
+// gossip. Loading the state before the router starts means the peer
+// converges with the mesh from its own snapshot, only exchanging the
+// changes since, if the channel's Gossiper is a DigestGossiper,
+// instead of pulling the entire state over the network.
+func (c *GossipChannel) LoadState(r io.Reader) error {
+	var saved savedState
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return err
+	}
+	if saved.Version != savedStateVersion {
+		return fmt.Errorf("unsupported saved state version %d", saved.Version)
+	}
+	if saved.Channel != c.name {
+		return fmt.Errorf("saved state is of channel %q, not %q", saved.Channel, c.name)
+	}
+	for _, msg := range saved.Messages {
+		if _, err := c.onGossip(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
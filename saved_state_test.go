@@ -0,0 +1,33 @@
+package mesh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	g1 := newTestGossiper()
+	c1, err := r1.NewGossipChannel("Test", g1, GossipChannelConfig{})
+	require.NoError(t, err)
+	_, err = c1.onGossip([]byte{1, 2})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, c1.SaveState(&buf))
+	saved := buf.Bytes()
+
+	r2 := newTestRouter(t, "01:00:00:01:00:00")
+	g2 := newTestGossiper()
+	c2, err := r2.NewGossipChannel("Test", g2, GossipChannelConfig{})
+	require.NoError(t, err)
+	require.NoError(t, c2.LoadState(bytes.NewReader(saved)))
+	g2.checkHas(t, 1, 2)
+
+	// the state of one channel can't be loaded into another
+	other, err := r2.NewGossipChannel("Other", newTestGossiper(), GossipChannelConfig{})
+	require.NoError(t, err)
+	require.Error(t, other.LoadState(bytes.NewReader(saved)))
+	require.Error(t, other.LoadState(bytes.NewReader(saved[:len(saved)/2])))
+}
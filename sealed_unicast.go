@@ -0,0 +1,69 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const sealNonceSize = 24
+
+// sealUnicast encrypts msg so that only dst can read it, prefixed with
+// the nonce used.
+func (router *Router) sealUnicast(dst PeerName, msg []byte) ([]byte, error) {
+	peerKey, err := router.Peers.publicKey(dst)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [sealNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return box.Seal(nonce[:], msg, &nonce, peerKey, router.unicastKey), nil
+}
+
+// openUnicast decrypts a msg sealed for us by src.
+func (router *Router) openUnicast(src PeerName, sealed []byte) ([]byte, error) {
+	peerKey, err := router.Peers.publicKey(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < sealNonceSize {
+		return nil, fmt.Errorf("sealed unicast from %s too short", src)
+	}
+	var nonce [sealNonceSize]byte
+	copy(nonce[:], sealed)
+	msg, ok := box.Open(nil, sealed[sealNonceSize:], &nonce, peerKey, router.unicastKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to open sealed unicast from %s", src)
+	}
+	return msg, nil
+}
+
+// publicKey returns the public key advertised by the named peer.
+func (peers *Peers) publicKey(name PeerName) (*[32]byte, error) {
+	peers.RLock()
+	defer peers.RUnlock()
+	peer, found := peers.byName[name]
+	if !found || len(peer.PublicKey) != 32 {
+		return nil, fmt.Errorf("no public key known for peer %s", name)
+	}
+	var key [32]byte
+	copy(key[:], peer.PublicKey)
+	return &key, nil
+}
+
+// Seal encrypts msg so that only the named peer can read it, and can
+// tell from its public key that it came from us; see Open. It may be
+// used to authenticate ourself to other peers outside the mesh
+// protocol, e.g. over HTTP.
+func (router *Router) Seal(dst PeerName, msg []byte) ([]byte, error) {
+	return router.sealUnicast(dst, msg)
+}
+
+// Open decrypts a msg sealed for us by the named peer, failing unless it
+// was sealed with that peer's key.
+func (router *Router) Open(src PeerName, sealed []byte) ([]byte, error) {
+	return router.openUnicast(src, sealed)
+}
@@ -0,0 +1,63 @@
+package mesh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type unicastRecorder struct {
+	*testGossiper
+	received [][]byte
+}
+
+func (g *unicastRecorder) OnGossipUnicast(sender PeerName, msg []byte) error {
+	g.received = append(g.received, msg)
+	return nil
+}
+
+func TestEncryptUnicast(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3, where r2 relays between
+	// r1 and r3 without being able to read their unicasts
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	config := GossipChannelConfig{EncryptUnicast: true}
+	g3 := &unicastRecorder{testGossiper: newTestGossiper()}
+	s1, err := r1.NewGossipChannel("Secret", newTestGossiper(), config)
+	require.NoError(t, err)
+	_, err = r3.NewGossipChannel("Secret", g3, config)
+	require.NoError(t, err)
+
+	secret := []byte("attack at dawn")
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, secret))
+	require.Equal(t, [][]byte{secret}, g3.received)
+
+	// what r2 relays is opaque to it
+	sealed, err := r1.sealUnicast(r3.Ourself.Name, secret)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, secret))
+	_, err = r2.openUnicast(r1.Ourself.Name, sealed)
+	require.Error(t, err)
+
+	// unencrypted unicasts are refused
+	plain, err := r1.NewGossip("Plain", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r3.NewGossipChannel("Plain", g3, config)
+	require.NoError(t, err)
+	require.NoError(t, plain.GossipUnicast(r3.Ourself.Name, secret))
+	require.Len(t, g3.received, 1)
+
+	// we can't seal for peers whose key we don't know
+	unknown, _ := PeerNameFromString("04:00:00:04:00:00")
+	require.Error(t, s1.GossipUnicast(unknown, secret))
+}
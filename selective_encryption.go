@@ -0,0 +1,33 @@
+package mesh
+
+import "errors"
+
+var (
+	errEncryptionRequired = errors.New("no password specified, but connections from untrusted addresses must be encrypted")
+	errRemoteDistrusts    = errors.New("peer requested an encrypted connection, not trusting our address")
+)
+
+// introPassword returns the password with which to encrypt the
+// connection, or nil to leave it unencrypted. With
+// Config.SelectiveEncryption, that's nil for a remote in TrustedSubnets,
+// and an error if there's no password for one outside them.
+func (conn *LocalConnection) introPassword() ([]byte, error) {
+	password, selective := conn.router.encryption()
+	if !selective {
+		return password, nil
+	}
+	if conn.trustRemote {
+		return nil, nil
+	}
+	if password == nil {
+		return nil, errEncryptionRequired
+	}
+	return password, nil
+}
+
+// encryption returns Config.Password and Config.SelectiveEncryption.
+func (router *Router) encryption() ([]byte, bool) {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	return router.Password, router.SelectiveEncryption
+}
@@ -0,0 +1,49 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectiveEncryption(t *testing.T) {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	trusting := Config{Password: []byte("secret"), SelectiveEncryption: true, TrustedSubnets: []*net.IPNet{loopback}}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", trusting)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", trusting)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{Password: []byte("secret"), SelectiveEncryption: true})
+	r4 := newTestRouterWithConfig(t, "04:00:00:04:00:00", Config{SelectiveEncryption: true})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+	defer r4.Stop()
+	addr2, close2 := listenTest(t, r2)
+	defer close2()
+
+	r1.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool { return len(establishedTo(r2)) == 1 })
+	for _, conn := range NewStatus(r1).Connections {
+		require.Equal(t, "", conn.Cipher)
+	}
+
+	// r3 doesn't trust r2, which won't encrypt, and r4 has no password
+	// to encrypt with
+	r3.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	r4.ConnectionMaker.InitiateConnections([]string{addr2}, false)
+	waitUntil(t, func() bool {
+		failed := 0
+		for _, r := range []*Router{r3, r4} {
+			for _, conn := range NewStatus(r).Connections {
+				if conn.LastError != "" {
+					failed++
+				}
+			}
+		}
+		return failed == 2
+	})
+	require.Empty(t, establishedTo(r3))
+	require.Empty(t, establishedTo(r4))
+	require.Len(t, establishedTo(r2), 1)
+}
@@ -0,0 +1,137 @@
+package simulation
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/weaveworks/mesh"
+)
+
+// peerView is what a router knows of a peer.
+type peerView struct {
+	UID     mesh.PeerUID
+	ShortID mesh.PeerShortID
+	Version uint64
+}
+
+// components returns the sets of peers which are up and joined by
+// links within a side of any partition, which the mesh should connect.
+func (n *Network) components() [][]int {
+	n.Lock()
+	defer n.Unlock()
+	component := make([]int, len(n.nodes))
+	for i := range component {
+		component[i] = -1
+	}
+	var components [][]int
+	for i, node := range n.nodes {
+		if node.router == nil || component[i] >= 0 {
+			continue
+		}
+		members := []int{i}
+		component[i] = len(components)
+		for k := 0; k < len(members); k++ {
+			for l := range n.links {
+				if other, ok := l.other(members[k]); ok && component[other] < 0 &&
+					n.nodes[other].router != nil && n.groups[other] == n.groups[i] {
+					component[other] = len(components)
+					members = append(members, other)
+				}
+			}
+		}
+		components = append(components, members)
+	}
+	return components
+}
+
+func (l link) other(i int) (int, bool) {
+	switch i {
+	case l.from:
+		return l.to, true
+	case l.to:
+		return l.from, true
+	}
+	return 0, false
+}
+
+// Check returns an error describing the first invariant found not to
+// hold, if any: that the peers in each part of the mesh know each
+// other, and no others, alike; that every route from one to another
+// reaches it without visiting a peer twice; and that their short IDs
+// are unique.
+func (n *Network) Check() error {
+	for _, component := range n.components() {
+		if err := n.checkComponent(component); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Network) checkComponent(component []int) error {
+	routers := make(map[mesh.PeerName]*mesh.Router)
+	for _, i := range component {
+		if router := n.Router(i); router != nil {
+			routers[router.Ourself.Name] = router
+		}
+	}
+	var first map[mesh.PeerName]peerView
+	var firstName mesh.PeerName
+	for name, router := range routers {
+		view := make(map[mesh.PeerName]peerView)
+		for _, peer := range mesh.NewStatus(router).Peers {
+			peerName, err := mesh.PeerNameFromString(peer.Name)
+			if err != nil {
+				return err
+			}
+			if _, found := routers[peerName]; !found {
+				return fmt.Errorf("%s knows %s, which isn't reachable", name, peer.Name)
+			}
+			view[peerName] = peerView{peer.UID, peer.ShortID, peer.Version}
+		}
+		for other, otherRouter := range routers {
+			if view[other].UID != otherRouter.Ourself.UID {
+				return fmt.Errorf("%s doesn't know %s (UID %d)", name, other, otherRouter.Ourself.UID)
+			}
+		}
+		if first == nil {
+			first, firstName = view, name
+		} else if !reflect.DeepEqual(first, view) {
+			return fmt.Errorf("%s and %s disagree about the topology: %v vs %v", firstName, name, first, view)
+		}
+	}
+	owners := make(map[mesh.PeerShortID]mesh.PeerName)
+	for name, peer := range first {
+		if owner, found := owners[peer.ShortID]; found {
+			return fmt.Errorf("%s and %s have the same short ID %d", owner, name, peer.ShortID)
+		}
+		owners[peer.ShortID] = name
+	}
+	for src := range routers {
+		for dst := range routers {
+			if err := checkRoute(routers, src, dst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRoute follows the unicast route from src to dst.
+func checkRoute(routers map[mesh.PeerName]*mesh.Router, src, dst mesh.PeerName) error {
+	visited := map[mesh.PeerName]bool{src: true}
+	for cur := src; cur != dst; {
+		next, ok := routers[cur].Routes.Unicast(dst)
+		if !ok {
+			return fmt.Errorf("%s has no route to %s, on the way from %s", cur, dst, src)
+		}
+		if _, found := routers[next]; !found {
+			return fmt.Errorf("%s routes to %s via %s, which isn't reachable", cur, dst, next)
+		}
+		if visited[next] {
+			return fmt.Errorf("route from %s to %s has a cycle at %s", src, dst, next)
+		}
+		visited[next], cur = true, next
+	}
+	return nil
+}
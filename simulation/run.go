@@ -0,0 +1,61 @@
+package simulation
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Event is a step of a script, done At the given time since the start
+// of the script.
+type Event struct {
+	At   time.Duration
+	Name string
+	Do   func(*Network)
+}
+
+// Advance moves the clock forward by d, a Step at a time.
+func (n *Network) Advance(d time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += n.config.Step {
+		step := n.config.Step
+		if d-elapsed < step {
+			step = d - elapsed
+		}
+		n.clock.Advance(step)
+		time.Sleep(stepPause)
+	}
+}
+
+// Settle advances the clock until the invariants hold, returning the
+// error from Check if they don't within the given time.
+func (n *Network) Settle(within time.Duration) error {
+	const checkInterval = time.Second
+	var err error
+	for elapsed := time.Duration(0); elapsed <= within; elapsed += checkInterval {
+		if err = n.Check(); err == nil {
+			return nil
+		}
+		n.Advance(checkInterval)
+	}
+	return fmt.Errorf("not settled within %v: %v", within, err)
+}
+
+// Run does the events of script at their times, and then lets the
+// mesh settle within the given time.
+func (n *Network) Run(script []Event, settle time.Duration) error {
+	events := append([]Event{}, script...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+	var now time.Duration
+	for _, event := range events {
+		n.Advance(event.At - now)
+		now = event.At
+		event.Do(n)
+	}
+	if err := n.Settle(settle); err != nil {
+		if len(events) > 0 {
+			return fmt.Errorf("after %s: %v", events[len(events)-1].Name, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Package simulation drives many in-process routers, connected over
+// loopback and all keeping the time of one mesh.ManualClock, through
+// scripted churn, message loss and partitions, and checks the
+// invariants the mesh should restore once it settles: that every peer
+// has a consistent view of the topology of its part of the mesh, that
+// unicast routes have no cycles, and that short IDs are unique.
+//
+//	n, err := simulation.New(simulation.Config{Peers: 10, Seed: 1, Loss: 0.1})
+//	if err != nil {
+//		return err
+//	}
+//	defer n.Close()
+//	n.Ring()
+//	err = n.Run([]simulation.Event{
+//		{At: time.Minute, Name: "split", Do: func(n *simulation.Network) { n.Partition([]int{0, 1, 2}) }},
+//		{At: 2 * time.Minute, Name: "heal", Do: (*simulation.Network).Heal},
+//	}, 5*time.Minute)
+//
+// The routers' randomness is seeded from Config.Seed, but runs aren't
+// exactly repeatable, since their goroutines are scheduled as usual.
+package simulation
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Config configures a simulated Network.
+type Config struct {
+	// Peers is the number of routers.
+	Peers int
+
+	// Seed seeds the randomness of the routers and of message loss.
+	Seed int64
+
+	// Loss is the probability of each gossip message, including the
+	// topology gossip, being dropped rather than sent to a neighbour.
+	Loss float64
+
+	// SameShortIDs starts every router with the same short ID, so that
+	// the mesh has to recover from the collisions.
+	SameShortIDs bool
+
+	// Step is how far the clock is advanced at a time. Zero means
+	// 250ms.
+	Step time.Duration
+
+	// Logger logs the routers; nil means discard their logs.
+	Logger mesh.Logger
+}
+
+// The pause in real time after each step, in which the routers act on
+// the timers which fell due.
+const stepPause = time.Millisecond
+
+// Network is a mesh of simulated peers, numbered from 0, and the
+// connections intended between them.
+type Network struct {
+	sync.Mutex
+	config Config
+	clock  *mesh.ManualClock
+	loss   *rand.Rand
+	nodes  []*node
+	links  map[link]struct{}   // intended connections
+	conns  map[link][]net.Conn // those dialled, which a partition cuts
+	groups []int               // the side of the partition of each peer
+}
+
+type node struct {
+	name      mesh.PeerName
+	transport *mesh.Transport
+	router    *mesh.Router // nil while down
+	starts    int64
+}
+
+// A link between two peers, the lower-numbered of which dials it.
+type link struct{ from, to int }
+
+func newLink(i, j int) link {
+	if j < i {
+		i, j = j, i
+	}
+	return link{i, j}
+}
+
+// New returns a Network of config.Peers started, but unconnected,
+// routers.
+func New(config Config) (*Network, error) {
+	if config.Step <= 0 {
+		config.Step = 250 * time.Millisecond
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	n := &Network{
+		config: config,
+		clock:  mesh.NewManualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		loss:   rand.New(rand.NewSource(config.Seed)),
+		links:  make(map[link]struct{}),
+		conns:  make(map[link][]net.Conn),
+		groups: make([]int, config.Peers),
+	}
+	for i := 0; i < config.Peers; i++ {
+		// numbered in the last bytes, whichever the flavour of names
+		nameBytes := make([]byte, mesh.NameSize)
+		binary.BigEndian.PutUint16(nameBytes[len(nameBytes)-2:], uint16(i+1))
+		name, err := mesh.PeerNameFromBytes(nameBytes)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		transport, err := mesh.NewTransport("127.0.0.1", 0, config.Logger)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		n.nodes = append(n.nodes, &node{name: name, transport: transport})
+		if err := n.start(i); err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// start starts a router for peer i, which dials the peers it has
+// links to.
+func (n *Network) start(i int) error {
+	node := n.nodes[i]
+	node.starts++
+	rng := &startRand{Rand: rand.New(rand.NewSource(n.config.Seed*1000003 + int64(i)*1009 + node.starts))}
+	if !n.config.SameShortIDs || node.starts > 1 {
+		rng.started = 1
+	}
+	_, port, _ := net.SplitHostPort(node.transport.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	router, err := mesh.NewRouter(mesh.Config{
+		Host:        "127.0.0.1",
+		Port:        portNum,
+		Backoff:     mesh.BackoffPolicy{Initial: time.Second, Max: 10 * time.Second},
+		RelayPolicy: n.relay,
+		DialVia:     dialer{n, i},
+		Clock:       n.clock,
+		Rand:        rng,
+	}, node.name, strconv.Itoa(i), nil, n.config.Logger)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&rng.started, 1)
+	if err := router.StartOn(node.transport); err != nil {
+		return err
+	}
+	n.Lock()
+	node.router = router
+	var targets []string
+	for l := range n.links {
+		if l.from == i {
+			targets = append(targets, n.addr(l.to))
+		}
+	}
+	n.Unlock()
+	router.ConnectionMaker.InitiateConnections(targets, false)
+	return nil
+}
+
+// startRand is the Rand of a router, which, until started, always
+// returns the same number, so that every router picks the same short
+// ID.
+type startRand struct {
+	*rand.Rand
+	started int32
+}
+
+func (r *startRand) Uint64() uint64 {
+	if atomic.LoadInt32(&r.started) == 0 {
+		return 1
+	}
+	return r.Rand.Uint64()
+}
+
+func (n *Network) addr(i int) string {
+	return n.nodes[i].transport.Addr().String()
+}
+
+// Router returns the router of peer i, or nil if it is down.
+func (n *Network) Router(i int) *mesh.Router {
+	n.Lock()
+	defer n.Unlock()
+	return n.nodes[i].router
+}
+
+// Clock returns the clock of the routers.
+func (n *Network) Clock() *mesh.ManualClock {
+	return n.clock
+}
+
+// Connect adds a link between peers i and j, which the lower-numbered
+// of them dials, and redials whenever it is lost.
+func (n *Network) Connect(i, j int) {
+	l := newLink(i, j)
+	n.Lock()
+	n.links[l] = struct{}{}
+	router := n.nodes[l.from].router
+	n.Unlock()
+	if router != nil {
+		router.ConnectionMaker.InitiateConnections([]string{n.addr(l.to)}, false)
+	}
+}
+
+// Ring links each peer to the next, and the last to the first.
+func (n *Network) Ring() {
+	for i := range n.nodes {
+		n.Connect(i, (i+1)%len(n.nodes))
+	}
+}
+
+// Partition splits the peers into the groups given and one more of
+// those not in any of them, cutting the connections between groups,
+// and failing any dialled until Heal.
+func (n *Network) Partition(groups ...[]int) {
+	n.Lock()
+	for i := range n.groups {
+		n.groups[i] = 0
+	}
+	for g, group := range groups {
+		for _, i := range group {
+			n.groups[i] = g + 1
+		}
+	}
+	var cut []net.Conn
+	for l, conns := range n.conns {
+		if n.groups[l.from] != n.groups[l.to] {
+			cut = append(cut, conns...)
+			delete(n.conns, l)
+		}
+	}
+	n.Unlock()
+	for _, conn := range cut {
+		conn.Close()
+	}
+}
+
+// Heal ends any partition.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Kill stops the router of peer i.
+func (n *Network) Kill(i int) {
+	n.Lock()
+	router := n.nodes[i].router
+	n.nodes[i].router = nil
+	n.Unlock()
+	if router != nil {
+		router.Stop()
+	}
+}
+
+// Restart starts a new incarnation of peer i, stopping the old one if
+// it is still up.
+func (n *Network) Restart(i int) error {
+	n.Kill(i)
+	return n.start(i)
+}
+
+// Close stops all the routers.
+func (n *Network) Close() {
+	for i, node := range n.nodes {
+		n.Kill(i)
+		node.transport.Close()
+	}
+}
+
+// relay is the RelayPolicy of every router, which loses messages.
+func (n *Network) relay(mesh.RelayRequest) bool {
+	if n.config.Loss <= 0 {
+		return true
+	}
+	n.Lock()
+	defer n.Unlock()
+	return n.loss.Float64() >= n.config.Loss
+}
+
+// dialer dials the connections of peer from, unless a partition
+// separates it from the peer dialled.
+type dialer struct {
+	network *Network
+	from    int
+}
+
+func (d dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n := d.network
+	n.Lock()
+	to := -1
+	for i := range n.nodes {
+		if n.addr(i) == address {
+			to = i
+		}
+	}
+	if to < 0 || n.nodes[to].router == nil || n.groups[d.from] != n.groups[to] {
+		n.Unlock()
+		return nil, fmt.Errorf("simulated network: %s unreachable from peer %d", address, d.from)
+	}
+	n.Unlock()
+	var netDialer net.Dialer
+	conn, err := netDialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.groups[d.from] != n.groups[to] {
+		conn.Close()
+		return nil, fmt.Errorf("simulated network: %s unreachable from peer %d", address, d.from)
+	}
+	l := newLink(d.from, to)
+	n.conns[l] = append(n.conns[l], conn)
+	return conn, nil
+}
+
+func (d dialer) String() string {
+	return "simulated network"
+}
@@ -0,0 +1,52 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newNetwork(t *testing.T, config Config) *Network {
+	n, err := New(config)
+	require.NoError(t, err)
+	return n
+}
+
+func TestConvergence(t *testing.T) {
+	n := newNetwork(t, Config{Peers: 8, Seed: 1})
+	defer n.Close()
+	n.Ring()
+	n.Connect(0, 4)
+	require.NoError(t, n.Settle(time.Minute))
+}
+
+func TestShortIDCollisions(t *testing.T) {
+	n := newNetwork(t, Config{Peers: 8, Seed: 2, SameShortIDs: true})
+	defer n.Close()
+	n.Ring()
+	require.NoError(t, n.Settle(time.Minute))
+}
+
+func TestChurnLossAndPartitions(t *testing.T) {
+	n := newNetwork(t, Config{Peers: 10, Seed: 3, Loss: 0.1})
+	defer n.Close()
+	n.Ring()
+	n.Connect(0, 5)
+	require.NoError(t, n.Settle(5*time.Minute))
+
+	require.NoError(t, n.Run([]Event{
+		{At: 0, Name: "split in two", Do: func(n *Network) { n.Partition([]int{0, 1, 2, 3, 4}) }},
+	}, 5*time.Minute))
+
+	require.NoError(t, n.Run([]Event{
+		{At: 0, Name: "heal", Do: (*Network).Heal},
+		{At: 10 * time.Second, Name: "kill 3", Do: func(n *Network) { n.Kill(3) }},
+		{At: 20 * time.Second, Name: "isolate 7", Do: func(n *Network) { n.Partition([]int{7}) }},
+	}, 5*time.Minute))
+
+	require.NoError(t, n.Run([]Event{
+		{At: 0, Name: "heal", Do: (*Network).Heal},
+		{At: 5 * time.Second, Name: "restart 3", Do: func(n *Network) { require.NoError(t, n.Restart(3)) }},
+	}, 5*time.Minute))
+}
@@ -0,0 +1,82 @@
+package mesh
+
+import (
+	"fmt"
+	"time"
+)
+
+// SlowPeerPolicy evicts the peers which don't read what we send them
+// quickly enough, whose connections would otherwise hold up the gossip
+// to everyone routed through us. Their connections are terminated, and
+// retried with backoff like any other failure.
+type SlowPeerPolicy struct {
+	// QueueBytes is the size of the frames queued to be sent on a
+	// connection beyond which the remote is deemed slow. Zero disables
+	// eviction.
+	QueueBytes int
+	// For is how long the queue may stay beyond QueueBytes before the
+	// connection is terminated. Zero means straight away.
+	For time.Duration
+}
+
+var errSlowPeer = fmt.Errorf("peer too slow to read what we send")
+
+// writeTimeout returns how long a write to a connection may take before
+// the connection fails.
+func (router *Router) writeTimeout() time.Duration {
+	router.configLock.RLock()
+	timeout := router.WriteTimeout
+	router.configLock.RUnlock()
+	if timeout > 0 {
+		return timeout
+	}
+	return 2 * router.heartbeatInterval()
+}
+
+// writeLimits bound how long the frameWriter of a connection may be
+// held up by a remote which doesn't read.
+type writeLimits struct {
+	conn    interface{ SetWriteDeadline(time.Time) error }
+	timeout time.Duration
+	slow    SlowPeerPolicy
+	clock   Clock
+	evict   func(error)
+}
+
+// deadline sets the deadline of the next write.
+func (w *frameWriter) deadline() error {
+	w.Lock()
+	l := w.limits
+	var timeout time.Duration
+	if l != nil {
+		timeout = l.timeout
+	}
+	w.Unlock()
+	if timeout <= 0 {
+		return nil
+	}
+	return l.conn.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// checkSlow notes the size of the frames queued, evicting the remote if
+// that has been beyond the policy's threshold for too long. Only called
+// with the lock held.
+func (w *frameWriter) checkSlow() {
+	l := w.limits
+	if l == nil || l.slow.QueueBytes <= 0 || w.err != nil {
+		return
+	}
+	if w.queued <= l.slow.QueueBytes {
+		w.overSince = time.Time{}
+		return
+	}
+	now := l.clock.Now()
+	if w.overSince.IsZero() {
+		w.overSince = now
+	}
+	if now.Sub(w.overSince) >= l.slow.For {
+		w.err = errSlowPeer
+		w.ready.Signal()
+		go l.evict(errSlowPeer)
+	}
+}
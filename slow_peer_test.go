@@ -0,0 +1,51 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowPeerEviction(t *testing.T) {
+	sender := &stallingTCPSender{frames: make(chan []byte, 16), stalled: make(chan struct{}), release: make(chan struct{})}
+	clock := NewManualClock(time.Now())
+	evicted := make(chan error, 1)
+	w := newFrameWriter(sender, true, false, &writeLimits{
+		slow:  SlowPeerPolicy{QueueBytes: 100, For: time.Second},
+		clock: clock,
+		evict: func(err error) { evicted <- err },
+	})
+	defer close(sender.release)
+	defer w.close(nil)
+
+	require.NoError(t, w.post(make([]byte, 10)))
+	<-sender.stalled
+	frame := make([]byte, 60)
+	require.NoError(t, w.post(frame))
+	require.NoError(t, w.post(frame))
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, w.post(frame))
+	require.Empty(t, evicted)
+
+	// still beyond the threshold a second after first going beyond it
+	clock.Advance(500 * time.Millisecond)
+	require.NoError(t, w.post(frame))
+	require.Equal(t, errSlowPeer, <-evicted)
+	require.Equal(t, errSlowPeer, w.post(frame))
+}
+
+func TestWriteTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	w := newFrameWriter(newLengthPrefixTCPSender(local), true, false, &writeLimits{conn: local, timeout: 50 * time.Millisecond})
+	defer w.close(nil)
+
+	// nobody reads the remote end
+	err := w.send([]byte{ProtocolHeartbeat}, frameControl, "")
+	netErr, ok := err.(net.Error)
+	require.True(t, ok && netErr.Timeout(), "%v", err)
+	require.Error(t, w.post([]byte{ProtocolHeartbeat}))
+}
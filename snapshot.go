@@ -0,0 +1,74 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Snapshot returns the complete state of the Gossipers of the named
+// channels, as returned by Gossiper.Gossip, all as of one moment in the
+// deliveries to them: deliveries to the channels are held off while the
+// snapshot is taken, so applications combining the state of several
+// channels don't see one channel with an update applied and another
+// without a related one. Snapshot must not be called from a Gossiper's
+// callbacks.
+func (router *Router) Snapshot(channelNames ...string) (map[string]GossipData, error) {
+	channels := make([]*GossipChannel, 0, len(channelNames))
+	router.gossipLock.RLock()
+	for _, name := range channelNames {
+		channel, found := router.gossipChannels[name]
+		if !found {
+			router.gossipLock.RUnlock()
+			return nil, fmt.Errorf("no gossip channel %q", name)
+		}
+		channels = append(channels, channel)
+	}
+	router.gossipLock.RUnlock()
+
+	// lock in a consistent order, so concurrent snapshots can't deadlock
+	sort.Slice(channels, func(i, j int) bool { return channels[i].name < channels[j].name })
+	for i, channel := range channels {
+		if i > 0 && channel == channels[i-1] {
+			continue
+		}
+		channel.delivery.Lock()
+		defer channel.delivery.Unlock()
+	}
+	snapshot := make(map[string]GossipData, len(channels))
+	for _, channel := range channels {
+		snapshot[channel.name] = channel.gossiper.Gossip()
+	}
+	return snapshot, nil
+}
+
+// The Gossiper callbacks which update its state, held off by Snapshot.
+
+func (c *GossipChannel) onGossipUnicast(srcName PeerName, payload []byte, meta gossipFrameMeta) error {
+	c.delivery.RLock()
+	defer c.delivery.RUnlock()
+	if dg, ok := c.gossiper.(DeliveryGossiper); ok {
+		return dg.OnGossipUnicastDelivery(deliveryOf(srcName, meta), payload)
+	}
+	return c.gossiper.OnGossipUnicast(srcName, payload)
+}
+
+func (c *GossipChannel) onGossipBroadcast(srcName PeerName, payload []byte, meta gossipFrameMeta) (GossipData, error) {
+	c.delivery.RLock()
+	defer c.delivery.RUnlock()
+	if dg, ok := c.gossiper.(DeliveryGossiper); ok {
+		update, err := dg.OnGossipBroadcastDelivery(deliveryOf(srcName, meta), payload)
+		c.countMerge(update, err)
+		return update, err
+	}
+	update, err := c.gossiper.OnGossipBroadcast(srcName, payload)
+	c.countMerge(update, err)
+	return update, err
+}
+
+func (c *GossipChannel) onGossip(payload []byte) (GossipData, error) {
+	c.delivery.RLock()
+	defer c.delivery.RUnlock()
+	update, err := c.gossiper.OnGossip(payload)
+	c.countMerge(update, err)
+	return update, err
+}
@@ -0,0 +1,63 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stallingGossiper stalls in Gossip until released.
+type stallingGossiper struct {
+	*testGossiper
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (g *stallingGossiper) Gossip() GossipData {
+	close(g.stalled)
+	<-g.release
+	return g.testGossiper.Gossip()
+}
+
+func TestSnapshot(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	a := &stallingGossiper{newTestGossiper(), make(chan struct{}), make(chan struct{})}
+	b := newTestGossiper()
+	_, err := r.NewGossip("a", a)
+	require.NoError(t, err)
+	_, err = r.NewGossip("b", b)
+	require.NoError(t, err)
+	src := PeerName(2)
+	_, err = r.gossipChannel("b").onGossipBroadcast(src, []byte{1}, gossipFrameMeta{})
+	require.NoError(t, err)
+
+	_, err = r.Snapshot("a", "missing")
+	require.Error(t, err)
+
+	snapshots := make(chan map[string]GossipData)
+	go func() {
+		snapshot, err := r.Snapshot("a", "b")
+		require.NoError(t, err)
+		snapshots <- snapshot
+	}()
+	<-a.stalled
+	// deliveries are held off until the snapshot has been taken
+	delivered := make(chan struct{})
+	go func() {
+		r.gossipChannel("b").onGossipBroadcast(src, []byte{2}, gossipFrameMeta{})
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+		require.FailNow(t, "delivered during snapshot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(a.release)
+	snapshot := <-snapshots
+	<-delivered
+	require.Len(t, snapshot, 2)
+	require.Contains(t, snapshot["b"].Encode()[0], byte(1))
+	require.NotContains(t, snapshot["b"].Encode()[0], byte(2))
+	b.checkHas(t, 1, 2)
+}
@@ -0,0 +1,59 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+)
+
+// SourceConfig selects the local address outbound connections are
+// dialled from, e.g. on multi-homed hosts, or to keep mesh traffic in
+// or out of a VPN tunnel. At most one of its fields may be set; if
+// neither is, connections are dialled from Config.Host, if set, and
+// otherwise from whichever address the host routes them from.
+type SourceConfig struct {
+	// Addr is the IP address to dial from.
+	Addr string
+	// Interface is the name of the network interface to dial from,
+	// using its first address of the family of the one being dialled.
+	Interface string
+}
+
+func (config SourceConfig) validate() error {
+	if config.Addr != "" && config.Interface != "" {
+		return fmt.Errorf("at most one of source address and interface may be given")
+	}
+	if config.Addr != "" && net.ParseIP(config.Addr) == nil {
+		return fmt.Errorf("invalid source address %q", config.Addr)
+	}
+	return nil
+}
+
+// sourceAddr returns the local address from which to dial remote, which
+// is nil if unknown, e.g. when dialling via a proxy; localAddr unless
+// Config.Source says otherwise.
+func (router *Router) sourceAddr(localAddr *net.TCPAddr, remote net.IP) (*net.TCPAddr, error) {
+	switch {
+	case router.Source.Addr != "":
+		return &net.TCPAddr{IP: net.ParseIP(router.Source.Addr)}, nil
+	case router.Source.Interface != "":
+		iface, err := net.InterfaceByName(router.Source.Interface)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if remote == nil || (ipnet.IP.To4() == nil) == (remote.To4() == nil) {
+				return &net.TCPAddr{IP: ipnet.IP}, nil
+			}
+		}
+		return nil, fmt.Errorf("interface %s has no address to dial %s from", iface.Name, remote)
+	}
+	return localAddr, nil
+}
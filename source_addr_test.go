@@ -0,0 +1,53 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceAddr(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{Source: SourceConfig{Addr: "127.0.0.2"}})
+	defer r2.Stop()
+
+	connectTo(t, r2, r1)
+	var local string
+	for _, conn := range NewStatus(r2).Connections {
+		if conn.Peer == r1.Ourself.Name.String() {
+			local = conn.LocalAddr
+		}
+	}
+	require.True(t, strings.HasPrefix(local, "127.0.0.2:"), local)
+	conn, _ := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, strings.HasPrefix(conn.remoteTCPAddress(), "127.0.0.2:"), conn.remoteTCPAddress())
+}
+
+func TestSourceInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	r, err := NewRouter(Config{Source: SourceConfig{Interface: loopback}}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	defer r.Stop()
+	addr, err := r.sourceAddr(nil, net.ParseIP("127.0.0.1"))
+	require.NoError(t, err)
+	require.True(t, addr.IP.IsLoopback(), addr)
+
+	_, err = NewRouter(Config{Source: SourceConfig{Addr: "127.0.0.1", Interface: loopback}}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package mesh
+
+import "strconv"
+
+// SpanTracer records spans of the flow of gossip through the mesh, so
+// that a broadcast or unicast can be followed hop by hop in a tracing
+// system such as Jaeger or Tempo, e.g. when diagnosing slow fan-out.
+// It is deliberately small, so that mesh needn't depend on any
+// particular tracing library; an OpenTelemetry adapter extracts the
+// parent from a propagation.MapCarrier holding the traceparent and
+// tracestate of the TraceContext, starts an OpenTelemetry span with
+// the attributes, and injects its context likewise.
+//
+// Spans are started for gossip originating here, and for gossip
+// received which carries a trace context, i.e. which was traced by
+// its origin, so tracing can be enabled on some peers only. Gossip
+// merged while queued for a neighbour carries the trace of just one
+// of the updates merged.
+type SpanTracer interface {
+	// StartSpan starts a span named name, as a child of the span
+	// whose context parent is, unless that is empty.
+	StartSpan(name string, parent TraceContext, attributes map[string]string) Span
+}
+
+// Span is a span started by a SpanTracer.
+type Span interface {
+	// Context returns the context of the span, which is propagated to
+	// the next hop.
+	Context() TraceContext
+
+	// End ends the span, recording err, unless it is nil.
+	End(err error)
+}
+
+// TraceContext is the propagated context of a span, as the values of
+// the W3C Trace Context traceparent and tracestate headers.
+type TraceContext struct {
+	Parent string
+	State  string
+}
+
+// The names of the spans of gossip.
+const (
+	spanBroadcast = "mesh.gossip.broadcast" // originating here
+	spanUnicast   = "mesh.gossip.unicast"   // originating here
+	spanReceive   = "mesh.gossip.receive"   // handled by our Gossiper
+	spanRelay     = "mesh.gossip.relay"     // relayed to the next hops
+)
+
+// noSpan is the Span of gossip which isn't traced.
+type noSpan struct{}
+
+func (noSpan) Context() TraceContext { return TraceContext{} }
+
+func (noSpan) End(error) {}
+
+func (meta gossipFrameMeta) trace() TraceContext {
+	return TraceContext{Parent: meta.TraceParent, State: meta.TraceState}
+}
+
+// spanTracer returns the SpanTracer of the channel's router, if any.
+func (c *GossipChannel) spanTracer() SpanTracer {
+	if c.ourself.router == nil {
+		return nil
+	}
+	return c.ourself.router.SpanTracer
+}
+
+// traceOrigin starts the span of gossip originating here, to dst
+// unless it is a broadcast, stamping its context into meta.
+func (c *GossipChannel) traceOrigin(name string, dst PeerName, meta *gossipFrameMeta) Span {
+	tracer := c.spanTracer()
+	if tracer == nil {
+		return noSpan{}
+	}
+	attributes := c.spanAttributes(c.ourself.Name, *meta)
+	if dst != UnknownPeerName {
+		attributes["mesh.destination"] = dst.String()
+	}
+	return c.startSpan(tracer, name, attributes, meta)
+}
+
+// traceHop starts a span of gossip from srcName received here, if it
+// is traced, as a child of the span of the previous hop, stamping its
+// own context into meta in place of that.
+func (c *GossipChannel) traceHop(name string, srcName PeerName, meta *gossipFrameMeta) Span {
+	tracer := c.spanTracer()
+	if tracer == nil || meta.TraceParent == "" {
+		return noSpan{}
+	}
+	return c.startSpan(tracer, name, c.spanAttributes(srcName, *meta), meta)
+}
+
+func (c *GossipChannel) startSpan(tracer SpanTracer, name string, attributes map[string]string, meta *gossipFrameMeta) Span {
+	span := tracer.StartSpan(name, meta.trace(), attributes)
+	trace := span.Context()
+	meta.TraceParent, meta.TraceState = trace.Parent, trace.State
+	return span
+}
+
+func (c *GossipChannel) spanAttributes(srcName PeerName, meta gossipFrameMeta) map[string]string {
+	attributes := map[string]string{
+		"mesh.channel": c.name,
+		"mesh.peer":    c.ourself.Name.String(),
+		"mesh.origin":  srcName.String(),
+		"mesh.hops":    strconv.FormatUint(uint64(meta.Hops), 10),
+	}
+	if meta.sender != UnknownPeerName {
+		attributes["mesh.sender"] = meta.sender.String()
+	}
+	return attributes
+}
@@ -0,0 +1,115 @@
+package mesh
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTracer records the spans started by the routers sharing it.
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name       string
+	id         string
+	parent     string
+	attributes map[string]string
+	ended      bool
+	err        error
+}
+
+func (t *recordingTracer) StartSpan(name string, parent TraceContext, attributes map[string]string) Span {
+	t.Lock()
+	defer t.Unlock()
+	span := &recordedSpan{name: name, id: fmt.Sprintf("span-%d", len(t.spans)+1), parent: parent.Parent, attributes: attributes}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (s *recordedSpan) Context() TraceContext { return TraceContext{Parent: s.id} }
+
+func (s *recordedSpan) End(err error) { s.ended, s.err = true, err }
+
+// chain returns the names and peers of the spans leading to the last
+// one started, from the root.
+func (t *recordingTracer) chain() []string {
+	t.Lock()
+	defer t.Unlock()
+	byID := make(map[string]*recordedSpan)
+	for _, span := range t.spans {
+		byID[span.id] = span
+	}
+	var chain []string
+	for span := t.spans[len(t.spans)-1]; span != nil; span = byID[span.parent] {
+		chain = append([]string{span.name + "@" + span.attributes["mesh.peer"]}, chain...)
+	}
+	return chain
+}
+
+func TestGossipSpans(t *testing.T) {
+	tracer := &recordingTracer{}
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{SpanTracer: tracer})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{SpanTracer: tracer})
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{SpanTracer: tracer})
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	g3 := &deliveryRecorder{testGossiper: newTestGossiper()}
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	require.Equal(t, []string{
+		spanBroadcast + "@" + r1.Ourself.Name.String(),
+		spanReceive + "@" + r2.Ourself.Name.String(),
+		spanRelay + "@" + r2.Ourself.Name.String(),
+		spanReceive + "@" + r3.Ourself.Name.String(),
+	}, tracer.chain())
+	last := tracer.spans[len(tracer.spans)-1]
+	require.Equal(t, r2.Ourself.Name.String(), last.attributes["mesh.sender"])
+	require.Equal(t, last.id, g3.deliveries[0].Trace.Parent)
+
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte("hello")))
+	require.Equal(t, []string{
+		spanUnicast + "@" + r1.Ourself.Name.String(),
+		spanRelay + "@" + r2.Ourself.Name.String(),
+		spanReceive + "@" + r3.Ourself.Name.String(),
+	}, tracer.chain())
+	require.Equal(t, r3.Ourself.Name.String(), tracer.spans[len(tracer.spans)-3].attributes["mesh.destination"])
+	for _, span := range tracer.spans {
+		require.True(t, span.ended, span.name)
+	}
+}
+
+func TestGossipSpansUntraced(t *testing.T) {
+	// Gossip from a peer without a tracer isn't traced by the others.
+	tracer := &recordingTracer{}
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{SpanTracer: tracer})
+	routers := []*Router{r1, r2}
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("hello")))
+	require.Empty(t, tracer.spans)
+}
@@ -0,0 +1,162 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// State transfers are the complete state, or the part of it a neighbour
+// lacks according to its digest, which channels send to each new
+// neighbour and periodically for anti-entropy. They are sent by a
+// gossipSender of their own on each connection, so that they don't hold
+// up ordinary gossip, and bounded by Config.StateTransferRateLimit
+// rather than the ordinary rate limits.
+
+// StateTransfer describes the state transfers of a channel to a
+// directly connected peer.
+type StateTransfer struct {
+	Peer      PeerName
+	Channel   string
+	Active    bool          // whether a transfer is in progress
+	BytesSent uint64        // of the transfer in progress, or the last one
+	BytesSize uint64        // of the transfer in progress, or the last one
+	Completed uint64        // transfers completed
+	Throttled time.Duration // held back by the rate limit, in total
+}
+
+// stateTransfers tracks the progress of the state transfers to each
+// neighbour.
+type stateTransfers struct {
+	sync.Mutex
+	transfers map[bandwidthKey]*StateTransfer
+}
+
+func newStateTransfers() *stateTransfers {
+	return &stateTransfers{transfers: make(map[bandwidthKey]*StateTransfer)}
+}
+
+func (ts *stateTransfers) transfer(peer PeerName, channel string) *StateTransfer {
+	key := bandwidthKey{peer, channel}
+	t, found := ts.transfers[key]
+	if !found {
+		t = &StateTransfer{Peer: peer, Channel: channel}
+		ts.transfers[key] = t
+	}
+	return t
+}
+
+// begin records the start of a transfer of size bytes.
+func (ts *stateTransfers) begin(peer PeerName, channel string, size int) {
+	ts.Lock()
+	defer ts.Unlock()
+	t := ts.transfer(peer, channel)
+	t.Active, t.BytesSent, t.BytesSize = true, 0, uint64(size)
+}
+
+func (ts *stateTransfers) sent(peer PeerName, channel string, n int) {
+	ts.Lock()
+	defer ts.Unlock()
+	t := ts.transfer(peer, channel)
+	if t.BytesSent += uint64(n); t.Active && t.BytesSent >= t.BytesSize {
+		t.Active = false
+		t.Completed++
+	}
+}
+
+func (ts *stateTransfers) throttled(peer PeerName, channel string, d time.Duration) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.transfer(peer, channel).Throttled += d
+}
+
+func (ts *stateTransfers) forget(peer PeerName) {
+	ts.Lock()
+	defer ts.Unlock()
+	for key := range ts.transfers {
+		if key.peer == peer {
+			delete(ts.transfers, key)
+		}
+	}
+}
+
+// StateTransfers returns the progress of the state transfers to each
+// directly connected peer, by channel.
+func (router *Router) StateTransfers() []StateTransfer {
+	router.transfers.Lock()
+	defer router.transfers.Unlock()
+	result := make([]StateTransfer, 0, len(router.transfers.transfers))
+	for _, t := range router.transfers.transfers {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Peer != result[j].Peer {
+			return result[i].Peer < result[j].Peer
+		}
+		return result[i].Channel < result[j].Channel
+	})
+	return result
+}
+
+// transferDown sends data, part of the state of the channel, via conn as
+// a state transfer.
+func (c *GossipChannel) transferDown(conn Connection, data GossipData) {
+	gc, ok := conn.(gossipConnection)
+	if !ok {
+		c.SendDown(conn, data)
+		return
+	}
+	gc.gossipSenders().Transfer(c.name, c.makeTransferSender).Send(data)
+}
+
+func (c *GossipChannel) makeTransferSender(sender protocolSender, stop <-chan struct{}) *gossipSender {
+	if conn, ok := sender.(Connection); ok {
+		sender = &channelSender{channel: c, conn: conn, stop: stop, transfer: true}
+	}
+	return newGossipSender(c.makeMsg, c.makeBroadcastMsg, sender, gossipQueue{}, stop)
+}
+
+// begin implements batchSender, recording the start of a transfer.
+func (s *channelSender) begin(size int) {
+	if router := s.channel.ourself.router; s.transfer && router != nil {
+		router.transfers.begin(s.conn.Remote().Name, s.channel.name, size)
+	}
+}
+
+// paceTransfer is pace for state transfers.
+func (c *GossipChannel) paceTransfer(conn Connection, stop <-chan struct{}) bool {
+	limiter := conn.(gossipConnection).gossipSenders().limiters.transferLimiter(c)
+	wait := limiter.take(0, c.clock().Now())
+	if wait <= 0 {
+		return true
+	}
+	if c.ourself.router != nil {
+		c.ourself.router.transfers.throttled(conn.Remote().Name, c.name, wait)
+	}
+	timer := c.clock().NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.Chan():
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// sendTransfer is sendTo for state transfers, which count against
+// Config.StateTransferRateLimit rather than the ordinary rate limits.
+func (c *GossipChannel) sendTransfer(conn Connection, m protocolMsg, route frameRoute) error {
+	if !c.ourself.router.allowRelay(conn, c.name, m, route) || !c.allowedBy(m, route, conn.Remote().Name) {
+		return errRelayDenied
+	}
+	if err := c.send(conn, m); err != nil {
+		return err
+	}
+	c.countSent(len(m.msg))
+	conn.(gossipConnection).gossipSenders().limiters.transferLimiter(c).take(len(m.msg), c.clock().Now())
+	if router := c.ourself.router; router != nil {
+		router.bandwidth.sent(conn.Remote().Name, c.name, len(m.msg))
+		router.transfers.sent(conn.Remote().Name, c.name, len(m.msg))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// framesData is GossipData which is already encoded.
+type framesData [][]byte
+
+func (d framesData) Encode() [][]byte                  { return d }
+func (d framesData) Merge(other GossipData) GossipData { return append(d, other.(framesData)...) }
+
+// largeStateGossiper has a complete state of several large frames.
+type largeStateGossiper struct {
+	*testGossiper
+}
+
+func (g *largeStateGossiper) Gossip() GossipData {
+	return framesData{make([]byte, 1000), make([]byte, 1000)}
+}
+
+func TestStateTransferRateLimit(t *testing.T) {
+	config := Config{StateTransferRateLimit: RateLimit{BytesPerSecond: 10000, Burst: 100}}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	_, err := r1.NewGossip("test", &largeStateGossiper{newTestGossiper()})
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	addTestGossipConnection(t, r1, r2)
+
+	// the second frame of the complete state is held back by the
+	// debt of the first
+	start := time.Now()
+	sendPendingGossip(r1)
+	require.True(t, time.Since(start) > 50*time.Millisecond)
+
+	var transfer *StateTransfer
+	transfers := r1.StateTransfers()
+	for i := range transfers {
+		if transfers[i].Peer == r2.Ourself.Name && transfers[i].Channel == "test" {
+			transfer = &transfers[i]
+		}
+	}
+	require.NotNil(t, transfer)
+	require.False(t, transfer.Active)
+	require.Equal(t, uint64(1), transfer.Completed)
+	require.Equal(t, transfer.BytesSize, transfer.BytesSent)
+	require.True(t, transfer.BytesSent > 2000)
+	require.True(t, transfer.Throttled > 0)
+
+	// the ordinary gossip of the channel isn't held back, nor is the
+	// topology
+	for _, usage := range r1.BandwidthUsage() {
+		require.Zero(t, usage.Throttled)
+	}
+	for _, transfer := range transfers {
+		if transfer.Channel == "topology" {
+			require.Zero(t, transfer.Throttled)
+		}
+	}
+}
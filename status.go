@@ -3,10 +3,13 @@ package mesh
 import (
 	"fmt"
 	"net"
+	"sort"
+	"time"
 )
 
 // Status is our current state as a peer, as taken from a router.
-// This is designed to be used as diagnostic information.
+// This is designed to be used as diagnostic information, and may be
+// serialised as JSON.
 type Status struct {
 	Protocol           string
 	ProtocolMinVersion int
@@ -17,13 +20,27 @@ type Status struct {
 	NickName           string
 	Port               int
 	Peers              []PeerStatus
-	UnicastRoutes      []unicastRouteStatus
-	BroadcastRoutes    []broadcastRouteStatus
+	UnicastRoutes      []UnicastRouteStatus
+	BroadcastRoutes    []BroadcastRouteStatus
+	MultipathRoutes    []MultipathRouteStatus
 	Connections        []LocalConnectionStatus
 	TerminationCount   int
 	Targets            []string
+	PinnedTargets      []string
+	SecondaryTargets   []string
+	ConnectionMaker    ConnectionMakerStatus
 	OverlayDiagnostics interface{}
 	TrustedSubnets     []string
+	BandwidthUsage     []BandwidthUsage
+	StateTransfers     []StateTransfer
+	Rollouts           []RolloutStatus
+	TTLExceeded        map[string]uint64 // by channel
+	DeadLetters        []DeadLetterStats
+	GossipPanics       map[string]uint64 // by channel
+	Quarantined        []string          // channels
+	Surrogates         []SurrogateStatus
+	PeerGC             PeerGCStats
+	Channels           []ChannelStats
 }
 
 // NewStatus returns a Status object, taken as a snapshot from the router.
@@ -35,16 +52,30 @@ func NewStatus(router *Router) *Status {
 		Encryption:         router.usingPassword(),
 		PeerDiscovery:      router.PeerDiscovery,
 		Name:               router.Ourself.Name.String(),
-		NickName:           router.Ourself.NickName,
+		NickName:           router.Ourself.nickName(),
 		Port:               router.Port,
 		Peers:              makePeerStatusSlice(router.Peers),
 		UnicastRoutes:      makeUnicastRouteStatusSlice(router.Routes),
 		BroadcastRoutes:    makeBroadcastRouteStatusSlice(router.Routes),
+		MultipathRoutes:    makeMultipathRouteStatusSlice(router.Routes),
 		Connections:        makeLocalConnectionStatusSlice(router.ConnectionMaker),
-		TerminationCount:   router.ConnectionMaker.terminationCount,
+		TerminationCount:   router.ConnectionMaker.terminations(),
 		Targets:            router.ConnectionMaker.Targets(false),
+		PinnedTargets:      router.ConnectionMaker.targetsWithPriority(PriorityPinned),
+		SecondaryTargets:   router.ConnectionMaker.targetsWithPriority(PrioritySecondary),
+		ConnectionMaker:    router.ConnectionMaker.Status(),
 		OverlayDiagnostics: router.Overlay.Diagnostics(),
-		TrustedSubnets:     makeTrustedSubnetsSlice(router.TrustedSubnets),
+		TrustedSubnets:     makeTrustedSubnetsSlice(router.trustedSubnets()),
+		BandwidthUsage:     router.BandwidthUsage(),
+		StateTransfers:     router.StateTransfers(),
+		Rollouts:           router.Rollouts(),
+		TTLExceeded:        router.TTLExceeded(),
+		DeadLetters:        router.DeadLetters(),
+		GossipPanics:       router.GossipPanics(),
+		Quarantined:        router.QuarantinedChannels(),
+		Surrogates:         router.Surrogates(),
+		PeerGC:             router.Peers.GCStats(),
+		Channels:           router.ChannelStats(),
 	}
 }
 
@@ -55,6 +86,14 @@ type PeerStatus struct {
 	UID         PeerUID
 	ShortID     PeerShortID
 	Version     uint64
+	Draining    bool
+	Degraded    bool
+	Leaf        bool
+	Zone        string
+	ListenAddrs []string
+	Addrs       []PeerAddress
+	Labels      map[string]string
+	Groups      []string
 	Connections []connectionStatus
 }
 
@@ -68,6 +107,9 @@ func makePeerStatusSlice(peers *Peers) []PeerStatus {
 			for conn := range peers.ourself.getConnections() {
 				connections = append(connections, makeConnectionStatus(conn))
 			}
+			// our fields are modified holding our own lock
+			peers.ourself.RLock()
+			defer peers.ourself.RUnlock()
 		} else {
 			// Modifying peer.connections requires a write lock on
 			// Peers, and since we are holding a read lock (due to the
@@ -82,6 +124,14 @@ func makePeerStatusSlice(peers *Peers) []PeerStatus {
 			peer.UID,
 			peer.ShortID,
 			peer.Version,
+			peer.Draining,
+			peer.Degraded,
+			peer.Leaf,
+			peer.Zone,
+			peer.ListenAddrs,
+			makePeerAddresses(peer.Addrs),
+			peer.Labels,
+			peer.Groups,
 			connections,
 		})
 	})
@@ -95,54 +145,90 @@ type connectionStatus struct {
 	Address     string
 	Outbound    bool
 	Established bool
+	Degraded    bool
 }
 
 func makeConnectionStatus(c Connection) connectionStatus {
 	return connectionStatus{
 		Name:        c.Remote().Name.String(),
-		NickName:    c.Remote().NickName,
+		NickName:    c.Remote().nickName(),
 		Address:     c.remoteTCPAddress(),
 		Outbound:    c.isOutbound(),
 		Established: c.isEstablished(),
+		Degraded:    c.isDegraded(),
 	}
 }
 
-// unicastRouteStatus is the current state of an established unicast route.
-type unicastRouteStatus struct {
+// UnicastRouteStatus is the current state of an established unicast
+// route: traffic to Dest is sent to Via, which is Dest itself if we are
+// directly connected to it, or UnknownPeerName if Dest is unreachable.
+type UnicastRouteStatus struct {
 	Dest, Via string
 }
 
-// makeUnicastRouteStatusSlice takes a snapshot of the unicast routes in routes.
-func makeUnicastRouteStatusSlice(r *routes) []unicastRouteStatus {
+// makeUnicastRouteStatusSlice takes a snapshot of the unicast routes in
+// routes, ordered by destination.
+func makeUnicastRouteStatusSlice(r *routes) []UnicastRouteStatus {
 	r.RLock()
 	defer r.RUnlock()
 
-	var slice []unicastRouteStatus
+	var slice []UnicastRouteStatus
 	for dest, via := range r.unicast {
-		slice = append(slice, unicastRouteStatus{dest.String(), via.String()})
+		slice = append(slice, UnicastRouteStatus{dest.String(), via.String()})
 	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i].Dest < slice[j].Dest })
 	return slice
 }
 
-// BroadcastRouteStatus is the current state of an established broadcast route.
-type broadcastRouteStatus struct {
+// MultipathRouteStatus is the current state of the equal-cost routes to
+// Dest, when there is more than one: unicasts are spread across the
+// peers in Via; see Config.Multipath.
+type MultipathRouteStatus struct {
+	Dest string
+	Via  []string
+}
+
+// makeMultipathRouteStatusSlice takes a snapshot of the multipath
+// routes in routes, ordered by destination.
+func makeMultipathRouteStatusSlice(r *routes) []MultipathRouteStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	var slice []MultipathRouteStatus
+	for dest, hops := range r.multipath {
+		var via []string
+		for _, hop := range hops {
+			via = append(via, hop.String())
+		}
+		slice = append(slice, MultipathRouteStatus{dest.String(), via})
+	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i].Dest < slice[j].Dest })
+	return slice
+}
+
+// BroadcastRouteStatus is the current state of an established broadcast
+// route: broadcasts from Source are relayed to the peers in Via.
+type BroadcastRouteStatus struct {
 	Source string
 	Via    []string
 }
 
-// makeBroadcastRouteStatusSlice takes a snapshot of the broadcast routes in routes.
-func makeBroadcastRouteStatusSlice(r *routes) []broadcastRouteStatus {
+// makeBroadcastRouteStatusSlice takes a snapshot of the broadcast routes
+// in routes, ordered by source.
+func makeBroadcastRouteStatusSlice(r *routes) []BroadcastRouteStatus {
 	r.RLock()
 	defer r.RUnlock()
 
-	var slice []broadcastRouteStatus
+	var slice []BroadcastRouteStatus
 	for source, via := range r.broadcast {
 		var hops []string
 		for _, hop := range via {
 			hops = append(hops, hop.String())
 		}
-		slice = append(slice, broadcastRouteStatus{source.String(), hops})
+		sort.Strings(hops)
+		slice = append(slice, BroadcastRouteStatus{source.String(), hops})
 	}
+	sort.Slice(slice, func(i, j int) bool { return slice[i].Source < slice[j].Source })
 	return slice
 }
 
@@ -153,6 +239,36 @@ type LocalConnectionStatus struct {
 	State    string
 	Info     string
 	Attrs    map[string]interface{}
+
+	// Peer is the name of the remote peer, once known; Stats are nil
+	// for connections still being attempted.
+	Peer      string
+	Stats     *ConnectionStats
+	LastError string
+
+	// Suspicion is how strongly the remote peer is suspected of having
+	// failed, as judged by the connection's FailureDetector, so that a
+	// slow peer can be told from a dead one; see
+	// Config.SuspicionThreshold.
+	Suspicion float64
+
+	// RTT is the smoothed round-trip time of the connection, or zero
+	// until it has been measured, which requires the remote to support
+	// it.
+	RTT time.Duration
+
+	// Via describes the Config.DialVia, e.g. a proxy, through which an
+	// outbound connection was dialled, if any.
+	Via string
+
+	// LocalAddr is the local address of the connection, e.g. the
+	// source address an outbound connection was dialled from; see
+	// Config.Source.
+	LocalAddr string
+
+	// Cipher is the cipher encrypting the connection, or empty if it
+	// isn't encrypted; see Config.SelectiveEncryption.
+	Cipher string
 }
 
 // makeLocalConnectionStatusSlice takes a snapshot of the active local
@@ -183,11 +299,41 @@ func makeLocalConnectionStatusSlice(cm *connectionMaker) []LocalConnectionStatus
 					info = fmt.Sprintf("%-11v %v", "unencrypted", info)
 				}
 			}
-			slice = append(slice, LocalConnectionStatus{conn.remoteTCPAddress(), conn.isOutbound(), state, info, attrs})
+			stats, lastError := lc.stats.snapshot()
+			slice = append(slice, LocalConnectionStatus{
+				Address:   conn.remoteTCPAddress(),
+				Outbound:  conn.isOutbound(),
+				State:     state,
+				Info:      info,
+				Attrs:     attrs,
+				Peer:      conn.Remote().Name.String(),
+				Stats:     &stats,
+				LastError: lastError,
+				Suspicion: lc.detector.Suspicion(lc.router.clock().Now()),
+				RTT:       lc.rtt.estimate(),
+				Via:       lc.via,
+				LocalAddr: lc.tcpConn.LocalAddr().String(),
+				Cipher:    lc.cipher,
+			})
+		}
+		var via string
+		if router := cm.ourself.router; router != nil && router.DialVia != nil {
+			via = describeDialer(router.DialVia)
 		}
 		for address, target := range cm.targets {
+			var lastError string
+			if target.lastError != nil {
+				lastError = target.lastError.Error()
+			}
 			add := func(state, info string) {
-				slice = append(slice, LocalConnectionStatus{address, true, state, info, nil})
+				slice = append(slice, LocalConnectionStatus{
+					Address:   address,
+					Outbound:  true,
+					State:     state,
+					Info:      info,
+					LastError: lastError,
+					Via:       via,
+				})
 			}
 			switch target.state {
 			case targetWaiting:
@@ -195,7 +341,9 @@ func makeLocalConnectionStatusSlice(cm *connectionMaker) []LocalConnectionStatus
 				if !target.tryAfter.IsZero() {
 					until = target.tryAfter.String()
 				}
-				if target.lastError == nil { // shouldn't happen
+				if target.queued {
+					add("queued", "waiting for a handshake to complete")
+				} else if target.lastError == nil { // shouldn't happen
 					add("waiting", "until: "+until)
 				} else {
 					add("failed", target.lastError.Error()+", retry: "+until)
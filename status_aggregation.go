@@ -0,0 +1,258 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The name of the gossip channel on which peers are asked for, and
+// reply with, summaries of their status.
+const statusChannelName = internalChannelPrefix + "status"
+
+// PeerSummary summarises the status of a peer, for AggregateStatus.
+type PeerSummary struct {
+	Peer            PeerName
+	NickName        string
+	UID             PeerUID
+	ProtocolVersion byte     // the highest the peer supports
+	Features        []string // the protocol features it advertises
+	Peers           int      // how many peers it knows of
+	Connections     int
+	// Channels holds a digest of the state of each of the peer's
+	// application channels. It is the hash of the Digest of a
+	// DigestGossiper, and otherwise of the encoded complete state, so
+	// is only comparable between peers if the encoding is
+	// deterministic, e.g. doesn't encode a map.
+	Channels map[string]string
+}
+
+// Divergence is an aspect of their status in which peers differ, e.g.
+// "peers" or "channel counter".
+type Divergence struct {
+	Aspect string
+	Values map[string][]PeerName // the peers with each value
+}
+
+// StatusReport is the status of the whole mesh; see AggregateStatus.
+type StatusReport struct {
+	Summaries   map[PeerName]PeerSummary
+	Missing     []PeerName // peers which didn't reply in time
+	Divergences []Divergence
+}
+
+// AggregateStatus asks every peer for a summary of its status, and
+// reports where they differ, so that the mesh can be diagnosed from any
+// one peer. It waits for all the peers we know of to reply, or for ctx
+// to be done, when those which haven't are reported as missing.
+func (router *Router) AggregateStatus(ctx context.Context) StatusReport {
+	return router.aggregator.aggregate(ctx)
+}
+
+// statusRequests are the IDs of requests for status, as broadcast.
+type statusRequests struct {
+	IDs []uint64
+}
+
+// Encode implements GossipData.
+func (requests *statusRequests) Encode() [][]byte {
+	return [][]byte{gobEncode(requests)}
+}
+
+// Merge implements GossipData.
+func (requests *statusRequests) Merge(other GossipData) GossipData {
+	return &statusRequests{IDs: append(append([]uint64{}, requests.IDs...), other.(*statusRequests).IDs...)}
+}
+
+// statusReply is the reply to a request for status.
+type statusReply struct {
+	ID      uint64
+	Summary PeerSummary
+}
+
+// statusAggregator is the Gossiper of the status channel.
+type statusAggregator struct {
+	sync.Mutex
+	router  *Router
+	gossip  Gossip
+	pending map[uint64]chan<- PeerSummary
+}
+
+func newStatusAggregator(router *Router) *statusAggregator {
+	return &statusAggregator{router: router, pending: make(map[uint64]chan<- PeerSummary)}
+}
+
+func (agg *statusAggregator) aggregate(ctx context.Context) StatusReport {
+	var expected []PeerName
+	for name := range agg.router.Peers.names() {
+		if name != agg.router.Ourself.Name {
+			expected = append(expected, name)
+		}
+	}
+	id := agg.router.rng().Uint64()
+	replies := make(chan PeerSummary, len(expected))
+	agg.Lock()
+	agg.pending[id] = replies
+	agg.Unlock()
+	defer func() {
+		agg.Lock()
+		delete(agg.pending, id)
+		agg.Unlock()
+	}()
+	agg.gossip.GossipBroadcast(&statusRequests{IDs: []uint64{id}})
+
+	summaries := map[PeerName]PeerSummary{agg.router.Ourself.Name: agg.router.summary()}
+	for waiting := true; waiting && len(summaries) <= len(expected); {
+		select {
+		case summary := <-replies:
+			summaries[summary.Peer] = summary
+		case <-ctx.Done():
+			waiting = false
+		}
+	}
+	report := StatusReport{Summaries: summaries}
+	for _, name := range expected {
+		if _, found := summaries[name]; !found {
+			report.Missing = append(report.Missing, name)
+		}
+	}
+	sort.Sort(peerNames(report.Missing))
+	report.Divergences = divergences(summaries)
+	return report
+}
+
+// summary summarises the status of our peer.
+func (router *Router) summary() PeerSummary {
+	summary := PeerSummary{
+		Peer:            router.Ourself.Name,
+		NickName:        router.Ourself.nickName(),
+		UID:             router.Ourself.UID,
+		ProtocolVersion: ProtocolMaxVersion,
+		Connections:     router.Ourself.connectionCount(),
+		Channels:        make(map[string]string),
+	}
+	summary.Peers = len(router.Peers.names())
+	for feature := range router.features.snapshot() {
+		summary.Features = append(summary.Features, feature)
+	}
+	sort.Strings(summary.Features)
+	for channel := range router.gossipChannelSet() {
+		if internalChannel(channel.name) {
+			continue
+		}
+		if _, surrogate := channel.gossiper.(*surrogateGossiper); surrogate {
+			continue
+		}
+		summary.Channels[channel.name] = channelDigest(channel.gossiper)
+	}
+	return summary
+}
+
+// channelDigest returns a digest of the state of gossiper; see
+// PeerSummary.Channels.
+func channelDigest(gossiper Gossiper) string {
+	hash := sha256.New()
+	if dg, ok := gossiper.(DigestGossiper); ok {
+		hash.Write(dg.Digest())
+	} else if data := gossiper.Gossip(); data != nil {
+		for _, msg := range data.Encode() {
+			hash.Write(msg)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// divergences returns the aspects in which the summaries differ.
+func divergences(summaries map[PeerName]PeerSummary) []Divergence {
+	aspects := make(map[string]map[string][]PeerName)
+	note := func(aspect, value string, peer PeerName) {
+		if aspects[aspect] == nil {
+			aspects[aspect] = make(map[string][]PeerName)
+		}
+		aspects[aspect][value] = append(aspects[aspect][value], peer)
+	}
+	channels := make(map[string]struct{})
+	for _, summary := range summaries {
+		for channel := range summary.Channels {
+			channels[channel] = struct{}{}
+		}
+	}
+	for _, summary := range summaries {
+		note("peers", strconv.Itoa(summary.Peers), summary.Peer)
+		note("protocol version", strconv.Itoa(int(summary.ProtocolVersion)), summary.Peer)
+		note("features", strings.Join(summary.Features, ","), summary.Peer)
+		for channel := range channels {
+			note("channel "+channel, summary.Channels[channel], summary.Peer)
+		}
+	}
+	var divergences []Divergence
+	for aspect, values := range aspects {
+		if len(values) < 2 {
+			continue
+		}
+		for _, peers := range values {
+			sort.Sort(peerNames(peers))
+		}
+		divergences = append(divergences, Divergence{Aspect: aspect, Values: values})
+	}
+	sort.Slice(divergences, func(i, j int) bool { return divergences[i].Aspect < divergences[j].Aspect })
+	return divergences
+}
+
+// OnGossipBroadcast implements Gossiper, replying to requests for our
+// status.
+func (agg *statusAggregator) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	var requests statusRequests
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&requests); err != nil {
+		return nil, err
+	}
+	if src == agg.router.Ourself.Name {
+		return nil, nil
+	}
+	summary := agg.router.summary()
+	for _, id := range requests.IDs {
+		if err := agg.gossip.GossipUnicast(src, gobEncode(statusReply{id, summary})); err != nil {
+			agg.router.logger.Printf("[gossip %s]: unable to reply to %s: %v", statusChannelName, src, err)
+		}
+	}
+	return &requests, nil
+}
+
+// OnGossipUnicast implements Gossiper, receiving replies to our
+// requests.
+func (agg *statusAggregator) OnGossipUnicast(src PeerName, msg []byte) error {
+	var reply statusReply
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Summary.Peer != src {
+		return fmt.Errorf("status of %s from %s", reply.Summary.Peer, src)
+	}
+	agg.Lock()
+	replies, found := agg.pending[reply.ID]
+	agg.Unlock()
+	if found {
+		select {
+		case replies <- reply.Summary:
+		default: // from a peer which joined since we asked
+		}
+	}
+	return nil
+}
+
+// Gossip implements Gossiper. There is no state.
+func (agg *statusAggregator) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper.
+func (agg *statusAggregator) OnGossip(msg []byte) (GossipData, error) {
+	return nil, nil
+}
@@ -0,0 +1,39 @@
+package mesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateStatus(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	defer r3.Stop()
+	// only r3 has the channel
+	_, err := r3.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	connectTo(t, r2, r1)
+	connectTo(t, r3, r2)
+	waitUntil(t, func() bool {
+		_, found := r1.Routes.Unicast(r3.Ourself.Name)
+		return found
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report := r1.AggregateStatus(ctx)
+	require.Empty(t, report.Missing)
+	require.Len(t, report.Summaries, 3)
+	require.Equal(t, 2, report.Summaries[r2.Ourself.Name].Connections)
+	require.Len(t, report.Divergences, 1)
+	divergence := report.Divergences[0]
+	require.Equal(t, "channel Test", divergence.Aspect)
+	require.Equal(t, []PeerName{r1.Ourself.Name, r2.Ourself.Name}, divergence.Values[""])
+	require.Equal(t, []PeerName{r3.Ourself.Name}, divergence.Values[report.Summaries[r3.Ourself.Name].Channels["Test"]])
+}
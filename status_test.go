@@ -0,0 +1,60 @@
+package mesh
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusRoutesAndStats(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	var status *Status
+	require.Eventually(t, func() bool {
+		status = NewStatus(r1)
+		return len(status.Connections) == 1 && status.Connections[0].State == "established" &&
+			status.Connections[0].Stats.MessagesReceived > 0 && len(status.UnicastRoutes) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn := status.Connections[0]
+	require.Equal(t, r2.Ourself.Name.String(), conn.Peer)
+	require.NotZero(t, conn.Stats.BytesSent)
+	require.NotZero(t, conn.Stats.MessagesSent)
+	require.NotZero(t, conn.Stats.BytesReceived)
+	require.False(t, conn.Stats.EstablishedAt.IsZero())
+	require.Empty(t, conn.LastError)
+	require.Contains(t, status.UnicastRoutes, UnicastRouteStatus{r2.Ourself.Name.String(), r2.Ourself.Name.String()})
+
+	data, err := json.Marshal(status)
+	require.NoError(t, err)
+	var decoded Status
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, status.UnicastRoutes, decoded.UnicastRoutes)
+	require.Equal(t, status.BroadcastRoutes, decoded.BroadcastRoutes)
+	require.Equal(t, conn.Stats.BytesSent, decoded.Connections[0].Stats.BytesSent)
+
+	r1.ConnectionMaker.ForgetConnections([]string{ln.Addr().String()})
+	lc, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, found)
+	lc.(ourConnection).shutdown(errConnectToSelf)
+	_, lastError := lc.(*LocalConnection).stats.snapshot()
+	require.Equal(t, errConnectToSelf.Error(), lastError)
+}
@@ -0,0 +1,235 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Neighbours which advertise this feature, as well as featureFragments,
+// multiplex the bulk frames of each gossip channel as a stream of its
+// own. The fragments of the streams are interleaved, so a channel
+// sending large updates doesn't hold up the small ones of another, and
+// the frames of each stream are handled by a goroutine of its own, so a
+// channel whose Gossiper is slow doesn't hold up the others either.
+// Each stream is flow controlled: we only send streamWindow bytes
+// beyond what the remote has granted with a ProtocolWindowUpdate, which
+// it does as it handles them.
+const featureStreams = "streams"
+
+// streamWindow is the flow control window of each stream, in bytes.
+const streamWindow = 256 * 1024
+
+// maxStreams bounds the streams a remote may open on a connection, each
+// of which has a goroutine, and buffers, of its own.
+const maxStreams = 256
+
+// appendStreamHeader appends the name of a stream, as it prefixes
+// ProtocolStreamFragment and ProtocolWindowUpdate frames.
+func appendStreamHeader(buf []byte, name string) []byte {
+	var length [binary.MaxVarintLen64]byte
+	buf = append(buf, length[:binary.PutUvarint(length[:], uint64(len(name)))]...)
+	return append(buf, name...)
+}
+
+// parseStreamHeader returns the name of the stream a frame is for, and
+// the rest of its payload.
+func parseStreamHeader(payload []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < length {
+		return "", nil, fmt.Errorf("malformed stream header")
+	}
+	return string(payload[n : n+int(length)]), payload[n+int(length):], nil
+}
+
+// recvStream reassembles and handles the frames of one stream.
+type recvStream struct {
+	sync.Mutex
+	ready       *sync.Cond
+	name        string
+	partial     []byte // of the frame being received
+	frames      []streamFrame
+	held        int // bytes of partial not yet released
+	outstanding int // bytes received and not yet granted
+	ungranted   int // bytes handled or released and not yet granted
+	closed      bool
+}
+
+// streamFrame is a complete frame waiting to be handled.
+type streamFrame struct {
+	msg        []byte
+	unreleased int // bytes to release once handled
+}
+
+// recvStreams are the streams received on a connection.
+type recvStreams struct {
+	sync.Mutex
+	streams map[string]*recvStream
+	closed  bool
+}
+
+// handleStreamFragment is called from the receive goroutine.
+func (conn *LocalConnection) handleStreamFragment(payload []byte) error {
+	name, payload, err := parseStreamHeader(payload)
+	if err != nil {
+		return err
+	}
+	if len(payload) < 1 {
+		return fmt.Errorf("empty fragment of stream %q", name)
+	}
+	s, err := conn.streams.stream(conn, name)
+	if err != nil {
+		return err
+	}
+	flags, chunk := payload[0], payload[1:]
+
+	s.Lock()
+	s.outstanding += len(chunk)
+	if s.outstanding > streamWindow+fragmentSize {
+		s.Unlock()
+		return fmt.Errorf("stream %q exceeded its window", name)
+	}
+	s.partial = append(s.partial, chunk...)
+	if len(s.partial) > maxTCPMsgSize {
+		s.Unlock()
+		return fmt.Errorf("fragmented message exceeds maximum size: %d > %d", len(s.partial), maxTCPMsgSize)
+	}
+	if flags&fragmentLast == 0 {
+		s.held += len(chunk)
+	} else {
+		msg := s.partial
+		s.partial = nil
+		if len(msg) < 1 || !bulkTag(protocolTag(msg[0])) {
+			s.Unlock()
+			return fmt.Errorf("malformed message on stream %q", name)
+		}
+		s.frames = append(s.frames, streamFrame{msg, s.held + len(chunk)})
+		s.held = 0
+		s.ready.Signal()
+	}
+	grant := s.release()
+	s.Unlock()
+	return conn.grant(name, grant)
+}
+
+// release returns how many bytes to grant the sender, if enough have
+// been handled to be worth it; the lock must be held. The bytes of a
+// partial frame are released once the frames before it have been
+// handled, so that frames larger than the window can be received.
+func (s *recvStream) release() int {
+	if len(s.frames) == 0 {
+		s.ungranted += s.held
+		s.held = 0
+	}
+	if s.ungranted < streamWindow/4 {
+		return 0
+	}
+	grant := s.ungranted
+	s.outstanding -= grant
+	s.ungranted = 0
+	return grant
+}
+
+func (conn *LocalConnection) grant(name string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	var length [binary.MaxVarintLen64]byte
+	payload := appendStreamHeader(nil, name)
+	payload = append(payload, length[:binary.PutUvarint(length[:], uint64(n))]...)
+	return conn.postProtocolMsg(protocolMsg{ProtocolWindowUpdate, payload})
+}
+
+func (conn *LocalConnection) handleWindowUpdate(payload []byte) error {
+	name, payload, err := parseStreamHeader(payload)
+	if err != nil {
+		return err
+	}
+	n, size := binary.Uvarint(payload)
+	if size <= 0 || n > streamWindow+fragmentSize {
+		return fmt.Errorf("malformed window update for stream %q", name)
+	}
+	if conn.frames == nil {
+		return nil
+	}
+	return conn.frames.grant(name, int(n))
+}
+
+// postProtocolMsg sends a control msg without waiting for it to be
+// written.
+func (conn *LocalConnection) postProtocolMsg(m protocolMsg) error {
+	msg := append([]byte{byte(m.tag)}, m.msg...)
+	if err := conn.frames.post(msg); err != nil {
+		return err
+	}
+	conn.stats.sent(len(msg))
+	return nil
+}
+
+// stream returns the named stream, starting it if need be, unless the
+// streams are closed, or there are too many of them.
+func (ss *recvStreams) stream(conn *LocalConnection, name string) (*recvStream, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.closed {
+		return nil, errConnectionClosed
+	}
+	if ss.streams == nil {
+		ss.streams = make(map[string]*recvStream)
+	}
+	s, found := ss.streams[name]
+	if !found {
+		if len(ss.streams) >= maxStreams {
+			return nil, fmt.Errorf("too many streams: stream %q would be more than %d", name, maxStreams)
+		}
+		s = &recvStream{name: name}
+		s.ready = sync.NewCond(s)
+		ss.streams[name] = s
+		go s.run(conn)
+	}
+	return s, nil
+}
+
+func (ss *recvStreams) close() {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.closed = true
+	for _, s := range ss.streams {
+		s.Lock()
+		s.closed = true
+		s.ready.Signal()
+		s.Unlock()
+	}
+}
+
+// run handles the frames of the stream in turn.
+func (s *recvStream) run(conn *LocalConnection) {
+	for {
+		s.Lock()
+		for len(s.frames) == 0 && !s.closed {
+			s.ready.Wait()
+		}
+		if s.closed {
+			s.Unlock()
+			return
+		}
+		f := s.frames[0]
+		s.frames[0] = streamFrame{}
+		s.frames = s.frames[1:]
+		s.Unlock()
+
+		if err := conn.handleProtocolMsg(protocolTag(f.msg[0]), f.msg[1:]); err != nil {
+			conn.shutdown(err)
+			return
+		}
+
+		s.Lock()
+		s.ungranted += f.unreleased
+		grant := s.release()
+		s.Unlock()
+		if err := conn.grant(s.name, grant); err != nil {
+			conn.shutdown(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamFlowControl(t *testing.T) {
+	sender := &stallingTCPSender{frames: make(chan []byte, 64), stalled: make(chan struct{}), release: make(chan struct{})}
+	w := newFrameWriter(sender, true, true, nil)
+	defer w.close(nil)
+
+	large := make([]byte, streamWindow+2*fragmentSize)
+	large[0] = ProtocolGossipBroadcast
+	errs := make(chan error, 2)
+	go func() { errs <- w.send(large, frameBulk, "a") }()
+	<-sender.stalled
+	go func() { errs <- w.send([]byte{ProtocolGossipBroadcast, 1}, frameBulk, "b") }()
+	waitUntil(t, func() bool {
+		w.Lock()
+		defer w.Unlock()
+		return len(w.active) == 2
+	})
+	close(sender.release)
+
+	received := func() (string, bool) {
+		select {
+		case frame := <-sender.frames:
+			require.Equal(t, protocolTag(ProtocolStreamFragment), protocolTag(frame[0]))
+			name, rest, err := parseStreamHeader(frame[1:])
+			require.NoError(t, err)
+			return name, rest[0]&fragmentLast != 0
+		case <-time.After(100 * time.Millisecond):
+			return "", false
+		}
+	}
+	// the small frame of b needn't wait for the large one of a
+	var order []string
+	for i := 0; i < 3; i++ {
+		name, _ := received()
+		order = append(order, name)
+	}
+	require.Equal(t, []string{"a", "a", "b"}, order)
+	require.NoError(t, <-errs)
+
+	// a sends its window, and then waits for a grant
+	for i := 2; i < streamWindow/fragmentSize; i++ {
+		name, last := received()
+		require.Equal(t, "a", name)
+		require.False(t, last)
+	}
+	name, _ := received()
+	require.Empty(t, name)
+	require.NoError(t, w.grant("a", 2*fragmentSize))
+	for _, expectLast := range []bool{false, true} {
+		name, last := received()
+		require.Equal(t, "a", name)
+		require.Equal(t, expectLast, last)
+	}
+	require.NoError(t, <-errs)
+
+	// the remote may only grant streams we opened
+	require.Error(t, w.grant("c", fragmentSize))
+}
+
+func TestStreamLimit(t *testing.T) {
+	var streams recvStreams
+	conn := &LocalConnection{}
+	defer streams.close()
+	for i := 0; i < maxStreams; i++ {
+		_, err := streams.stream(conn, fmt.Sprint(i))
+		require.NoError(t, err)
+	}
+	_, err := streams.stream(conn, "0")
+	require.NoError(t, err)
+	_, err = streams.stream(conn, "one too many")
+	require.Error(t, err)
+}
+
+// blockingGossiper blocks on broadcasts until released.
+type blockingGossiper struct {
+	*testGossiper
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (g *blockingGossiper) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	g.blocked <- struct{}{}
+	<-g.release
+	return g.testGossiper.OnGossipBroadcast(src, update)
+}
+
+func TestStreamHeadOfLineBlocking(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	defer r1.Stop()
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	defer r2.Stop()
+	slow := &blockingGossiper{newTestGossiper(), make(chan struct{}, 1), make(chan struct{})}
+	defer close(slow.release)
+	fast := newTestGossiper()
+	slow1, err := r1.NewGossip("slow", newTestGossiper())
+	require.NoError(t, err)
+	fast1, err := r1.NewGossip("fast", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("slow", slow)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("fast", fast)
+	require.NoError(t, err)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		return found
+	})
+
+	slow1.GossipBroadcast(newSurrogateGossipData([]byte{1}))
+	<-slow.blocked
+	// while the slow channel's gossiper is stuck, the fast one isn't
+	fast1.GossipBroadcast(newSurrogateGossipData([]byte{2}))
+	waitUntil(t, func() bool {
+		fast.RLock()
+		defer fast.RUnlock()
+		_, found := fast.state[2]
+		return found
+	})
+}
@@ -0,0 +1,102 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// The default bound on the memory used to remember the updates relayed
+// by surrogate gossipers; see Config.SurrogateBufferLimit.
+const defaultSurrogateBufferLimit = 4 << 20
+
+// surrogateBuffers accounts for the updates remembered by a router's
+// surrogate gossipers, evicting those of the least recently used
+// channels when they take more than the limit between them. Its lock
+// guards the state of all the surrogates.
+type surrogateBuffers struct {
+	sync.Mutex
+	limit      int
+	size       int
+	surrogates map[*surrogateGossiper]struct{}
+}
+
+func newSurrogateBuffers(limit int) *surrogateBuffers {
+	if limit == 0 {
+		limit = defaultSurrogateBufferLimit
+	}
+	return &surrogateBuffers{limit: limit, surrogates: make(map[*surrogateGossiper]struct{})}
+}
+
+func validateSurrogateBufferLimit(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid surrogate buffer limit %d", limit)
+	}
+	return nil
+}
+
+func (b *surrogateBuffers) add(s *surrogateGossiper) {
+	b.Lock()
+	defer b.Unlock()
+	b.surrogates[s] = struct{}{}
+}
+
+// remove stops accounting for s. Must be called with the lock held.
+func (b *surrogateBuffers) remove(s *surrogateGossiper) {
+	delete(b.surrogates, s)
+}
+
+// evict drops the oldest updates of the least recently used surrogates
+// until those remaining are within the limit. Must be called with the
+// lock held.
+func (b *surrogateBuffers) evict() {
+	for b.size > b.limit {
+		var lru *surrogateGossiper
+		for s := range b.surrogates {
+			if len(s.prevUpdates) > 0 && (lru == nil || s.lastUsed.Before(lru.lastUsed)) {
+				lru = s
+			}
+		}
+		if lru == nil {
+			return
+		}
+		lru.forget(1)
+		lru.evicted++
+	}
+}
+
+// SurrogateStatus describes a channel which we relay, but haven't
+// registered a Gossiper for, and the updates remembered for it, which
+// are replayed to a Gossiper registering later.
+type SurrogateStatus struct {
+	Channel string
+	Updates int    // remembered
+	Bytes   int    // of the remembered updates
+	Relayed uint64 // updates relayed, excluding duplicates
+	Evicted uint64 // updates evicted to stay within Config.SurrogateBufferLimit
+}
+
+// Surrogates returns the status of the channels relayed by surrogate
+// gossipers, those using the most memory first.
+func (router *Router) Surrogates() []SurrogateStatus {
+	b := router.surrogates
+	b.Lock()
+	defer b.Unlock()
+	result := make([]SurrogateStatus, 0, len(b.surrogates))
+	for s := range b.surrogates {
+		result = append(result, SurrogateStatus{
+			Channel: s.channel,
+			Updates: len(s.prevUpdates),
+			Bytes:   s.size,
+			Relayed: s.relayed,
+			Evicted: s.evicted,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].Channel < result[j].Channel
+	})
+	return result
+}
@@ -9,8 +9,14 @@ import (
 
 // surrogateGossiper ignores unicasts and relays broadcasts and gossips.
 type surrogateGossiper struct {
-	sync.Mutex
+	sync.Mutex  // unless buffers is set, when its lock is used instead
 	prevUpdates []prevUpdate
+	size        int // of the prevUpdates
+	lastUsed    time.Time
+	relayed     uint64
+	evicted     uint64
+	channel     string
+	buffers     *surrogateBuffers
 	router      *Router
 }
 
@@ -18,12 +24,26 @@ type prevUpdate struct {
 	update []byte
 	hash   uint64
 	t      time.Time
+	// broadcasts are remembered too, though not deduplicated, so they
+	// can be replayed to a Gossiper taking over the channel
+	broadcast bool
+	src       PeerName
 }
 
 var _ Gossiper = &surrogateGossiper{}
 
-// Hook to mock time for testing
-var now = func() time.Time { return time.Now() }
+func newSurrogateGossiper(channelName string, router *Router) *surrogateGossiper {
+	s := &surrogateGossiper{channel: channelName, router: router, buffers: router.surrogates}
+	s.buffers.add(s)
+	return s
+}
+
+func (s *surrogateGossiper) mutex() sync.Locker {
+	if s.buffers != nil {
+		return s.buffers
+	}
+	return s
+}
 
 // OnGossipUnicast implements Gossiper.
 func (*surrogateGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
@@ -31,7 +51,11 @@ func (*surrogateGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
 }
 
 // OnGossipBroadcast implements Gossiper.
-func (*surrogateGossiper) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+func (s *surrogateGossiper) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	mu := s.mutex()
+	mu.Lock()
+	defer mu.Unlock()
+	s.remember(prevUpdate{update: update, t: s.router.clock().Now(), broadcast: true, src: src})
 	return newSurrogateGossipData(update), nil
 }
 
@@ -46,31 +70,75 @@ func (s *surrogateGossiper) OnGossip(update []byte) (GossipData, error) {
 	hash := fnv.New64a()
 	_, _ = hash.Write(update)
 	updateHash := hash.Sum64()
-	s.Lock()
-	defer s.Unlock()
+	mu := s.mutex()
+	mu.Lock()
+	defer mu.Unlock()
 	for _, p := range s.prevUpdates {
-		if updateHash == p.hash && bytes.Equal(update, p.update) {
+		if !p.broadcast && updateHash == p.hash && bytes.Equal(update, p.update) {
+			s.lastUsed = s.router.clock().Now()
 			return nil, nil
 		}
 	}
+	s.remember(prevUpdate{update: update, hash: updateHash, t: s.router.clock().Now()})
+	return newSurrogateGossipData(update), nil
+}
+
+// remember adds p to the previous updates. Must be called with the lock
+// held.
+func (s *surrogateGossiper) remember(p prevUpdate) {
 	// Delete anything that's older than the gossip interval, so we don't grow forever
 	// (this time limit is arbitrary; surrogateGossiper should pass on new gossip immediately
 	// so there should be no reason for a duplicate to show up after a long time)
-	updateTime := now()
 	gossipInterval := defaultGossipInterval
 	if s.router != nil {
 		gossipInterval = s.router.gossipInterval()
 	}
-	deleteBefore := updateTime.Add(-gossipInterval)
+	deleteBefore := p.t.Add(-gossipInterval)
 	keepFrom := len(s.prevUpdates)
-	for i, p := range s.prevUpdates {
-		if p.t.After(deleteBefore) {
+	for i, prev := range s.prevUpdates {
+		if prev.t.After(deleteBefore) {
 			keepFrom = i
 			break
 		}
 	}
-	s.prevUpdates = append(s.prevUpdates[keepFrom:], prevUpdate{update, updateHash, updateTime})
-	return newSurrogateGossipData(update), nil
+	s.forget(keepFrom)
+	s.prevUpdates = append(s.prevUpdates, p)
+	s.resize(len(p.update))
+	s.lastUsed = p.t
+	s.relayed++
+	if s.buffers != nil {
+		s.buffers.evict()
+	}
+}
+
+// forget drops the oldest n of the previous updates. Must be called
+// with the lock held.
+func (s *surrogateGossiper) forget(n int) {
+	for _, p := range s.prevUpdates[:n] {
+		s.resize(-len(p.update))
+	}
+	s.prevUpdates = s.prevUpdates[n:]
+}
+
+func (s *surrogateGossiper) resize(delta int) {
+	s.size += delta
+	if s.buffers != nil {
+		s.buffers.size += delta
+	}
+}
+
+// takeUpdates returns, and forgets, the updates we still remember,
+// oldest first, as the channel is taken over by a registered Gossiper.
+func (s *surrogateGossiper) takeUpdates() []prevUpdate {
+	mu := s.mutex()
+	mu.Lock()
+	defer mu.Unlock()
+	updates := s.prevUpdates
+	s.forget(len(updates))
+	if s.buffers != nil {
+		s.buffers.remove(s)
+	}
+	return updates
 }
 
 // surrogateGossipData is a simple in-memory GossipData.
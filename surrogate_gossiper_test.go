@@ -1,8 +1,12 @@
 package mesh
 
-import "testing"
-import "time"
-import "github.com/stretchr/testify/require"
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
 
 func TestSurrogateGossiperUnicast(t *testing.T) {
 	t.Skip("TODO")
@@ -29,25 +33,61 @@ func checkOnGossip(t *testing.T, s Gossiper, input, expected []byte) {
 }
 
 func TestSurrogateGossiperOnGossip(t *testing.T) {
-	myTime := time.Now()
-	now = func() time.Time { return myTime }
-	s := &surrogateGossiper{}
+	clock := NewManualClock(time.Now())
+	s := &surrogateGossiper{router: &Router{Config: Config{Clock: clock}}}
 	msg := [][]byte{[]byte("test 1"), []byte("test 2"), []byte("test 3"), []byte("test 4")}
 	checkOnGossip(t, s, msg[0], msg[0])
 	checkOnGossip(t, s, msg[1], msg[1])
 	checkOnGossip(t, s, msg[0], nil)
 	checkOnGossip(t, s, msg[1], nil)
-	myTime = myTime.Add(defaultGossipInterval / 2) // Should not trigger cleardown
-	checkOnGossip(t, s, msg[2], msg[2])            // Only clears out old ones on new entry
+	clock.Advance(defaultGossipInterval / 2) // Should not trigger cleardown
+	checkOnGossip(t, s, msg[2], msg[2])      // Only clears out old ones on new entry
 	checkOnGossip(t, s, msg[0], nil)
 	checkOnGossip(t, s, msg[1], nil)
-	myTime = myTime.Add(defaultGossipInterval)
+	clock.Advance(defaultGossipInterval)
 	checkOnGossip(t, s, msg[0], nil)
 	checkOnGossip(t, s, msg[3], msg[3]) // Only clears out old ones on new entry
 	checkOnGossip(t, s, msg[0], msg[0])
 	checkOnGossip(t, s, msg[0], nil)
 }
 
+func TestSurrogateBufferLimit(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	update := func(s *surrogateGossiper, size int, b byte) {
+		clock.Advance(time.Millisecond)
+		_, err := s.OnGossip(bytes.Repeat([]byte{b}, size))
+		require.NoError(t, err)
+	}
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{SurrogateBufferLimit: 100, Clock: clock})
+	a := r.gossipChannel("A").gossiper.(*surrogateGossiper)
+	b := r.gossipChannel("B").gossiper.(*surrogateGossiper)
+
+	// the least recently used channel loses its oldest update
+	update(a, 40, 1)
+	update(a, 40, 2)
+	update(b, 50, 3)
+	require.Equal(t, []SurrogateStatus{
+		{Channel: "B", Updates: 1, Bytes: 50, Relayed: 1},
+		{Channel: "A", Updates: 1, Bytes: 40, Relayed: 2, Evicted: 1},
+	}, r.Surrogates())
+
+	// duplicates count as use, but aren't relayed again
+	c := r.gossipChannel("C").gossiper.(*surrogateGossiper)
+	update(a, 40, 2)
+	update(c, 20, 4)
+	require.Equal(t, []SurrogateStatus{
+		{Channel: "A", Updates: 1, Bytes: 40, Relayed: 2, Evicted: 1},
+		{Channel: "C", Updates: 1, Bytes: 20, Relayed: 1},
+		{Channel: "B", Updates: 0, Bytes: 0, Relayed: 1, Evicted: 1},
+	}, r.Surrogates())
+
+	// channels taken over are no longer accounted for
+	_, err := r.NewGossip("A", newTestGossiper())
+	require.NoError(t, err)
+	require.Len(t, r.Surrogates(), 2)
+	require.Equal(t, 20, r.surrogates.size)
+}
+
 func TestSurrogateGossipDataEncode(t *testing.T) {
 	t.Skip("TODO")
 }
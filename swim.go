@@ -0,0 +1,680 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Membership modes; see Config.Membership.
+const (
+	// MembershipTopology is the default mode, in which every peer
+	// learns the complete topology of the mesh, i.e. all the peers and
+	// all their connections, by gossip.
+	MembershipTopology = "topology"
+
+	// MembershipSWIM confines topology gossip to neighbours, and
+	// learns the membership of the mesh with SWIM (Das et al.): each
+	// peer probes its neighbours, directly and via other neighbours,
+	// and piggybacks membership changes on the probes, so the cost to
+	// each peer doesn't grow with the mesh. Members appear in Peers like
+	// any other peer, but without their connections. Each peer instead
+	// advertises its routes to its neighbours, once per probe interval,
+	// and GossipUnicast and GossipBroadcast follow the routes so learnt.
+	MembershipSWIM = "swim"
+)
+
+// The name of the gossip channel used by MembershipSWIM.
+const swimChannelName = internalChannelPrefix + "swim"
+
+const (
+	defaultSWIMProbeInterval  = 1 * time.Second
+	defaultSWIMIndirectProbes = 3
+	defaultSWIMRetransmitMult = 3
+
+	// The most membership changes piggybacked on each probe.
+	swimMaxPiggyback = 16
+
+	// How many times longer than SuspicionTimeout dead members are
+	// remembered, so that stale news of them being alive is ignored.
+	swimDeadRetention = 10
+
+	// The most hops a route learnt from neighbours may take, beyond
+	// which the member counts as unreachable, so that routes to a
+	// member which has gone are withdrawn in bounded time.
+	swimMaxHops = 32
+)
+
+// SWIMConfig tunes MembershipSWIM.
+type SWIMConfig struct {
+	// ProbeInterval is how often a peer probes one of its neighbours.
+	// Zero means 1s.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout is how long a probe waits for an ack before asking
+	// other neighbours to probe on its behalf. Zero means half of
+	// ProbeInterval.
+	ProbeTimeout time.Duration
+
+	// IndirectProbes is the number of neighbours asked to probe a
+	// member which didn't ack. Zero means 3.
+	IndirectProbes int
+
+	// SuspicionTimeout is how long a member is suspected of having
+	// failed, giving it the chance to refute that, before it is
+	// declared dead. Zero means five times ProbeInterval.
+	SuspicionTimeout time.Duration
+
+	// RetransmitMult scales the number of probes each membership change
+	// is piggybacked on, which is RetransmitMult times the log10 of the
+	// number of members. Zero means 3.
+	RetransmitMult int
+}
+
+func (config SWIMConfig) withDefaults() SWIMConfig {
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = defaultSWIMProbeInterval
+	}
+	if config.ProbeTimeout <= 0 || config.ProbeTimeout > config.ProbeInterval {
+		config.ProbeTimeout = config.ProbeInterval / 2
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = defaultSWIMIndirectProbes
+	}
+	if config.SuspicionTimeout <= 0 {
+		config.SuspicionTimeout = 5 * config.ProbeInterval
+	}
+	if config.RetransmitMult <= 0 {
+		config.RetransmitMult = defaultSWIMRetransmitMult
+	}
+	return config
+}
+
+type swimStatus uint8
+
+const (
+	swimAlive swimStatus = iota
+	swimSuspect
+	swimDead
+)
+
+// swimUpdate is what a peer knows of a member.
+type swimUpdate struct {
+	Name        PeerName
+	NickName    string
+	UID         PeerUID
+	Incarnation uint64 // incremented by the member to refute suspicion
+	Status      swimStatus
+}
+
+// supersedes reports whether u is newer than known, according to the
+// SWIM rules. A member with a new UID has restarted, so is alive
+// whatever was known of its previous incarnation.
+func (u swimUpdate) supersedes(known swimUpdate) bool {
+	if u.UID != known.UID {
+		return u.Status == swimAlive
+	}
+	switch u.Status {
+	case swimAlive:
+		return known.Status != swimDead && u.Incarnation > known.Incarnation
+	case swimSuspect:
+		return (known.Status == swimAlive && u.Incarnation >= known.Incarnation) ||
+			(known.Status == swimSuspect && u.Incarnation > known.Incarnation)
+	default:
+		return known.Status != swimDead
+	}
+}
+
+type swimMessageKind uint8
+
+const (
+	swimPing swimMessageKind = iota
+	swimAck
+	swimPingReq // asks for Target to be probed on the sender's behalf
+	swimRoutes  // advertises the sender's Routes
+)
+
+type swimMessage struct {
+	Kind    swimMessageKind
+	Seq     uint64
+	Target  PeerName
+	Updates []swimUpdate
+	Routes  []swimRoute
+}
+
+// swimRoute is a route to Dest, as advertised by a peer: Hops away from
+// it, via its neighbour Via.
+type swimRoute struct {
+	Dest PeerName
+	Hops uint8
+	Via  PeerName
+}
+
+// swimMember is a member of the mesh, other than ourself.
+type swimMember struct {
+	swimUpdate
+	changed time.Time // when Status last changed
+	peer    *Peer     // our reference to it in Peers, unless dead
+}
+
+// swimBroadcast is a membership change to be piggybacked on probes.
+type swimBroadcast struct {
+	update    swimUpdate
+	transmits int
+}
+
+// swimMembership implements MembershipSWIM, as the Gossiper of the swim
+// channel.
+type swimMembership struct {
+	sync.Mutex
+	router      *Router
+	config      SWIMConfig
+	gossip      Gossip
+	incarnation uint64
+	members     map[PeerName]*swimMember
+	broadcasts  []*swimBroadcast
+	probeOrder  []PeerName
+	neighbours  peerNameSet // as of the last probe
+	seq         uint64
+	acks        map[uint64]chan struct{} // awaited, by probe sequence number
+	// the routes each neighbour last advertised, and ours learnt from
+	// them, by destination
+	adverts map[PeerName]map[PeerName]swimRoute
+	routes  map[PeerName]swimRoute
+}
+
+func newSWIMMembership(router *Router, config SWIMConfig) *swimMembership {
+	m := &swimMembership{
+		router:     router,
+		config:     config.withDefaults(),
+		members:    make(map[PeerName]*swimMember),
+		neighbours: make(peerNameSet),
+		acks:       make(map[uint64]chan struct{}),
+		adverts:    make(map[PeerName]map[PeerName]swimRoute),
+		routes:     make(map[PeerName]swimRoute),
+	}
+	m.broadcast(m.self())
+	return m
+}
+
+// self returns our own membership; it must be called with m locked.
+func (m *swimMembership) self() swimUpdate {
+	ourself := m.router.Ourself
+	return swimUpdate{Name: ourself.Name, NickName: ourself.nickName(), UID: ourself.UID, Incarnation: m.incarnation}
+}
+
+// broadcast queues u to be piggybacked on probes; it must be called
+// with m locked.
+func (m *swimMembership) broadcast(u swimUpdate) {
+	for _, b := range m.broadcasts {
+		if b.update.Name == u.Name {
+			b.update, b.transmits = u, 0
+			return
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &swimBroadcast{update: u})
+}
+
+// piggyback returns the membership changes to send on a probe; it must
+// be called with m locked.
+func (m *swimMembership) piggyback() []swimUpdate {
+	limit := m.config.RetransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+2))))
+	sort.SliceStable(m.broadcasts, func(i, j int) bool { return m.broadcasts[i].transmits < m.broadcasts[j].transmits })
+	var updates []swimUpdate
+	remaining := m.broadcasts[:0]
+	for _, b := range m.broadcasts {
+		if len(updates) < swimMaxPiggyback {
+			updates = append(updates, b.update)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			remaining = append(remaining, b)
+		}
+	}
+	m.broadcasts = remaining
+	return updates
+}
+
+// apply merges updates into the membership, returning those which were
+// news to us.
+func (m *swimMembership) apply(updates []swimUpdate) []swimUpdate {
+	var news []swimUpdate
+	var joined, departed []*swimMember
+	now := m.router.clock().Now()
+	m.Lock()
+	for _, u := range updates {
+		if u.Name == m.router.Ourself.Name {
+			if u.UID == m.router.Ourself.UID && u.Status != swimAlive && u.Incarnation >= m.incarnation {
+				// refute the suspicion
+				m.incarnation = u.Incarnation + 1
+				self := m.self()
+				m.broadcast(self)
+				news = append(news, self)
+			}
+			continue
+		}
+		member, found := m.members[u.Name]
+		if found && !u.supersedes(member.swimUpdate) {
+			continue
+		}
+		if !found {
+			member = &swimMember{}
+			m.members[u.Name] = member
+		}
+		if !found || u.Status != member.Status {
+			member.changed = now
+		}
+		wasDead := !found || member.Status == swimDead
+		member.swimUpdate = u
+		switch {
+		case wasDead && u.Status != swimDead:
+			joined = append(joined, member)
+		case !wasDead && u.Status == swimDead:
+			departed = append(departed, member)
+		}
+		m.broadcast(u)
+		news = append(news, u)
+	}
+	m.Unlock()
+	m.updatePeers(joined, departed)
+	return news
+}
+
+// updatePeers makes members that have joined appear in Peers, and those
+// which have departed disappear, unless we still have a route to them.
+func (m *swimMembership) updatePeers(joined, departed []*swimMember) {
+	for _, member := range joined {
+		peer := m.router.Peers.fetchWithDefault(newPeerFromSummary(peerSummary{
+			NameByte: member.Name.bytes(),
+			NickName: member.NickName,
+			UID:      member.UID,
+		}))
+		m.Lock()
+		if member.peer == nil && member.Status != swimDead {
+			member.peer, peer = peer, nil
+		}
+		m.Unlock()
+		if peer != nil {
+			m.router.Peers.dereference(peer)
+		}
+	}
+	var released bool
+	for _, member := range departed {
+		m.Lock()
+		peer := member.peer
+		member.peer = nil
+		m.Unlock()
+		if peer != nil {
+			m.router.Peers.dereference(peer)
+			released = true
+		}
+	}
+	if released {
+		m.router.Peers.GarbageCollect()
+	}
+}
+
+// send sends a message to dst, piggybacking membership changes on it.
+func (m *swimMembership) send(dst PeerName, kind swimMessageKind, seq uint64, target PeerName) error {
+	m.Lock()
+	msg := swimMessage{Kind: kind, Seq: seq, Target: target, Updates: m.piggyback()}
+	m.Unlock()
+	return m.gossip.GossipUnicast(dst, gobEncode(msg))
+}
+
+// probe sends a ping to target, or pingReqs for it to each of via, and
+// reports whether an ack arrived within timeout.
+func (m *swimMembership) probe(target PeerName, via []PeerName, timeout time.Duration) bool {
+	m.Lock()
+	m.seq++
+	seq := m.seq
+	ack := make(chan struct{}, 1)
+	m.acks[seq] = ack
+	m.Unlock()
+	defer func() {
+		m.Lock()
+		delete(m.acks, seq)
+		m.Unlock()
+	}()
+
+	var sent bool
+	if via == nil {
+		sent = m.send(target, swimPing, seq, UnknownPeerName) == nil
+	}
+	for _, intermediary := range via {
+		sent = m.send(intermediary, swimPingReq, seq, target) == nil || sent
+	}
+	if !sent {
+		return false
+	}
+	timer := m.router.clock().NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ack:
+		return true
+	case <-timer.Chan():
+		return false
+	}
+}
+
+// intermediaries chooses the neighbours to ask to probe target.
+func (m *swimMembership) intermediaries(target PeerName) []PeerName {
+	var candidates []PeerName
+	peers := m.router.Peers
+	for conn := range m.router.Ourself.getConnections() {
+		remote := conn.Remote()
+		if remote.Name == target || !conn.isEstablished() {
+			continue
+		}
+		peers.RLock()
+		_, connected := remote.connections[target]
+		peers.RUnlock()
+		if connected {
+			candidates = append(candidates, remote.Name)
+		}
+	}
+	m.router.rng().Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > m.config.IndirectProbes {
+		candidates = candidates[:m.config.IndirectProbes]
+	}
+	return candidates
+}
+
+// tick runs one protocol period: it probes the next neighbour, and any
+// member which has ceased to be a neighbour, suspecting those which
+// don't ack, and declares dead those which have been suspected for too
+// long.
+func (m *swimMembership) tick() {
+	m.expireSuspicions(m.router.clock().Now())
+
+	neighbours := make(peerNameSet)
+	for conn := range m.router.Ourself.getConnections() {
+		if conn.isEstablished() {
+			neighbours[conn.Remote().Name] = struct{}{}
+		}
+	}
+	m.Lock()
+	var lost []PeerName
+	for name := range m.neighbours {
+		if _, found := neighbours[name]; !found && m.live(name) {
+			lost = append(lost, name)
+		}
+	}
+	m.neighbours = neighbours
+	for name := range m.adverts {
+		if _, found := neighbours[name]; !found {
+			delete(m.adverts, name)
+		}
+	}
+	changed := m.recalculateRoutes()
+	advert := m.advert()
+	target, found := m.nextProbeTarget()
+	m.Unlock()
+
+	if changed {
+		m.router.Routes.recalculate()
+	}
+	for name := range neighbours {
+		m.gossip.GossipUnicast(name, gobEncode(swimMessage{Kind: swimRoutes, Routes: advert}))
+	}
+
+	indirectTimeout := m.config.ProbeInterval - m.config.ProbeTimeout
+	for _, name := range lost {
+		// we can no longer reach it directly; maybe others can
+		if via := m.intermediaries(name); len(via) == 0 || !m.probe(name, via, indirectTimeout) {
+			m.suspect(name)
+		}
+	}
+	if found && !m.probe(target, nil, m.config.ProbeTimeout) {
+		if via := m.intermediaries(target); len(via) == 0 || !m.probe(target, via, indirectTimeout) {
+			m.suspect(target)
+		}
+	}
+}
+
+// recalculateRoutes derives our routes from those our neighbours
+// advertised, preferring the fewest hops, and then the neighbour with
+// the lowest name, and reports whether they changed; it must be called
+// with m locked.
+func (m *swimMembership) recalculateRoutes() bool {
+	ourName := m.router.Ourself.Name
+	routes := make(map[PeerName]swimRoute)
+	for name := range m.neighbours {
+		routes[name] = swimRoute{Dest: name, Hops: 1, Via: name}
+	}
+	for neighbour := range m.neighbours {
+		for dest, route := range m.adverts[neighbour] {
+			// a route via us is of no use to us
+			if dest == ourName || route.Via == ourName || route.Hops >= swimMaxHops {
+				continue
+			}
+			if member, found := m.members[dest]; found && member.Status == swimDead {
+				continue
+			}
+			candidate := swimRoute{Dest: dest, Hops: route.Hops + 1, Via: neighbour}
+			if known, found := routes[dest]; !found || candidate.Hops < known.Hops ||
+				(candidate.Hops == known.Hops && candidate.Via < known.Via) {
+				routes[dest] = candidate
+			}
+		}
+	}
+	changed := len(routes) != len(m.routes)
+	for dest, route := range routes {
+		if known, found := m.routes[dest]; !found || known != route {
+			changed = true
+		}
+	}
+	m.routes = routes
+	return changed
+}
+
+// advert returns our routes, including to ourself, to advertise to our
+// neighbours; it must be called with m locked.
+func (m *swimMembership) advert() []swimRoute {
+	ourName := m.router.Ourself.Name
+	advert := []swimRoute{{Dest: ourName, Via: ourName}}
+	for _, route := range m.routes {
+		advert = append(advert, route)
+	}
+	return advert
+}
+
+// nextHops implements distanceVector.
+func (m *swimMembership) nextHops() unicastRoutes {
+	m.Lock()
+	defer m.Unlock()
+	hops := unicastRoutes{m.router.Ourself.Name: UnknownPeerName}
+	for dest, route := range m.routes {
+		hops[dest] = route.Via
+	}
+	return hops
+}
+
+// relaysFor implements distanceVector.
+func (m *swimMembership) relaysFor(src PeerName) []PeerName {
+	ourName := m.router.Ourself.Name
+	var relays []PeerName
+	m.Lock()
+	for name := range m.neighbours {
+		if route, found := m.adverts[name][src]; found && name != src && route.Via == ourName {
+			relays = append(relays, name)
+		}
+	}
+	m.Unlock()
+	sort.Slice(relays, func(i, j int) bool { return relays[i] < relays[j] })
+	return relays
+}
+
+// live reports whether the named member is alive or merely suspected;
+// it must be called with m locked.
+func (m *swimMembership) live(name PeerName) bool {
+	member, found := m.members[name]
+	return found && member.Status != swimDead
+}
+
+// nextProbeTarget chooses the neighbour to probe, round-robin in a
+// random order, as SWIM prescribes; it must be called with m locked.
+func (m *swimMembership) nextProbeTarget() (PeerName, bool) {
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(m.probeOrder) > 0 {
+			name := m.probeOrder[0]
+			m.probeOrder = m.probeOrder[1:]
+			if _, found := m.neighbours[name]; found && m.live(name) {
+				return name, true
+			}
+		}
+		for name := range m.neighbours {
+			m.probeOrder = append(m.probeOrder, name)
+		}
+		m.router.rng().Shuffle(len(m.probeOrder), func(i, j int) { m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i] })
+	}
+	return UnknownPeerName, false
+}
+
+// suspect marks a live member as suspected of having failed.
+func (m *swimMembership) suspect(name PeerName) {
+	m.Lock()
+	defer m.Unlock()
+	if member, found := m.members[name]; found && member.Status == swimAlive {
+		member.Status, member.changed = swimSuspect, m.router.clock().Now()
+		m.broadcast(member.swimUpdate)
+	}
+}
+
+// expireSuspicions declares dead the members suspected for longer than
+// SuspicionTimeout, and forgets those long dead.
+func (m *swimMembership) expireSuspicions(now time.Time) {
+	var departed []*swimMember
+	m.Lock()
+	for name, member := range m.members {
+		switch {
+		case member.Status == swimSuspect && now.Sub(member.changed) >= m.config.SuspicionTimeout:
+			member.Status, member.changed = swimDead, now
+			m.broadcast(member.swimUpdate)
+			departed = append(departed, member)
+		case member.Status == swimDead && now.Sub(member.changed) >= swimDeadRetention*m.config.SuspicionTimeout:
+			delete(m.members, name)
+		}
+	}
+	m.Unlock()
+	m.updatePeers(nil, departed)
+}
+
+func (m *swimMembership) run(ctx context.Context) {
+	ticker := m.router.clock().NewTicker(m.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+			m.tick()
+		}
+	}
+}
+
+// OnGossipUnicast receives probes and their acks.
+func (m *swimMembership) OnGossipUnicast(src PeerName, payload []byte) error {
+	var msg swimMessage
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err != nil {
+		return err
+	}
+	m.apply(msg.Updates)
+	switch msg.Kind {
+	case swimPing:
+		return m.send(src, swimAck, msg.Seq, UnknownPeerName)
+	case swimAck:
+		m.Lock()
+		if ack, found := m.acks[msg.Seq]; found {
+			select {
+			case ack <- struct{}{}:
+			default:
+			}
+		}
+		m.Unlock()
+	case swimPingReq:
+		go func() {
+			if m.probe(msg.Target, nil, m.config.ProbeTimeout) {
+				m.send(src, swimAck, msg.Seq, UnknownPeerName)
+			}
+		}()
+	case swimRoutes:
+		if _, found := m.router.Ourself.ConnectionTo(src); !found {
+			return nil
+		}
+		advert := make(map[PeerName]swimRoute, len(msg.Routes))
+		for _, route := range msg.Routes {
+			advert[route.Dest] = route
+		}
+		m.Lock()
+		m.adverts[src] = advert
+		changed := m.recalculateRoutes()
+		m.Unlock()
+		if changed {
+			m.router.Routes.recalculate()
+		}
+	default:
+		return fmt.Errorf("unknown swim message kind %d", msg.Kind)
+	}
+	return nil
+}
+
+func (m *swimMembership) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	return m.OnGossip(update)
+}
+
+// Gossip returns the complete membership, so that peers exchanging it
+// periodically, and new neighbours, converge on it.
+func (m *swimMembership) Gossip() GossipData {
+	m.Lock()
+	defer m.Unlock()
+	updates := []swimUpdate{m.self()}
+	for _, member := range m.members {
+		updates = append(updates, member.swimUpdate)
+	}
+	return &swimGossipData{updates}
+}
+
+func (m *swimMembership) OnGossip(update []byte) (GossipData, error) {
+	var updates []swimUpdate
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&updates); err != nil {
+		return nil, err
+	}
+	if news := m.apply(updates); len(news) > 0 {
+		return &swimGossipData{news}, nil
+	}
+	return nil, nil
+}
+
+// swimGossipData is a set of membership updates.
+type swimGossipData struct {
+	updates []swimUpdate
+}
+
+// Encode implements GossipData.
+func (d *swimGossipData) Encode() [][]byte {
+	return [][]byte{gobEncode(d.updates)}
+}
+
+// Merge implements GossipData, keeping the newest update of each
+// member.
+func (d *swimGossipData) Merge(other GossipData) GossipData {
+	merged := make(map[PeerName]swimUpdate, len(d.updates))
+	for _, updates := range [][]swimUpdate{d.updates, other.(*swimGossipData).updates} {
+		for _, u := range updates {
+			if known, found := merged[u.Name]; !found || u.supersedes(known) {
+				merged[u.Name] = u
+			}
+		}
+	}
+	result := &swimGossipData{make([]swimUpdate, 0, len(merged))}
+	for _, u := range merged {
+		result.updates = append(result.updates, u)
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func exchangeSWIMGossip(routers ...*Router) {
+	for i := 0; i < len(routers); i++ {
+		for _, r := range routers {
+			r.swim.gossip.(*GossipChannel).Send(r.swim.Gossip())
+		}
+		sendPendingGossip(routers...)
+	}
+}
+
+func TestSWIMMembership(t *testing.T) {
+	// create the line r1 <-> r2 <-> r3 <-> r4; probing is driven by
+	// the test, rather than the ticker
+	config := Config{Membership: MembershipSWIM, SWIM: SWIMConfig{
+		ProbeInterval:    time.Hour,
+		ProbeTimeout:     100 * time.Millisecond,
+		SuspicionTimeout: 10 * time.Millisecond,
+	}}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", config)
+	r4 := newTestRouterWithConfig(t, "04:00:00:04:00:00", config)
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r3, r4)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	// topology only reaches neighbours, but membership the whole mesh
+	exchangeSWIMGossip(routers...)
+	for _, r := range routers {
+		require.Len(t, r.Peers.Descriptions(), 4)
+	}
+	peer := r1.Peers.Fetch(r4.Ourself.Name)
+	require.NotNil(t, peer)
+	require.Empty(t, peer.connections)
+
+	// probes are acked, directly
+	for _, r := range []*Router{r2, r3} {
+		r.swim.tick()
+		r.swim.Lock()
+		for _, member := range r.swim.members {
+			require.Equal(t, swimAlive, member.Status)
+		}
+		r.swim.Unlock()
+	}
+
+	// a suspected peer refutes the suspicion
+	news := r2.swim.apply([]swimUpdate{{Name: r2.Ourself.Name, UID: r2.Ourself.UID, Status: swimSuspect}})
+	require.Equal(t, []swimUpdate{{Name: r2.Ourself.Name, NickName: "nick", UID: r2.Ourself.UID, Incarnation: 1}}, news)
+
+	// r4 fails; r3 suspects it, then declares it dead, which the
+	// others learn
+	r3.DeleteTestGossipConnection(r4)
+	r4.DeleteTestGossipConnection(r3)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	r3.swim.tick()
+	r3.swim.Lock()
+	require.Equal(t, swimSuspect, r3.swim.members[r4.Ourself.Name].Status)
+	r3.swim.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	r3.swim.tick()
+	exchangeSWIMGossip(r1, r2, r3)
+	for _, r := range []*Router{r1, r2, r3} {
+		require.Nil(t, r.Peers.Fetch(r4.Ourself.Name))
+		require.Len(t, r.Peers.Descriptions(), 3)
+	}
+}
+
+func TestSWIMRoutes(t *testing.T) {
+	// create the line r1 <-> r2 <-> r3 <-> r4 <-> r5
+	config := Config{Membership: MembershipSWIM, SWIM: SWIMConfig{
+		ProbeInterval: time.Hour,
+		ProbeTimeout:  100 * time.Millisecond,
+	}}
+	var routers []*Router
+	for _, name := range []string{"01:00:00:01:00:00", "02:00:00:02:00:00", "03:00:00:03:00:00", "04:00:00:04:00:00", "05:00:00:05:00:00"} {
+		r := newTestRouterWithConfig(t, name, config)
+		if len(routers) > 0 {
+			addTestGossipConnection(t, routers[len(routers)-1], r)
+		}
+		routers = append(routers, r)
+	}
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	exchangeSWIMGossip(routers...)
+
+	// routes are learnt a hop further on each probe interval
+	for range routers {
+		for _, r := range routers {
+			r.swim.tick()
+		}
+	}
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+	r1, r5 := routers[0], routers[4]
+	hop, found := r1.Routes.UnicastAll(r5.Ourself.Name)
+	require.True(t, found)
+	require.Equal(t, routers[1].Ourself.Name, hop)
+
+	var gossipers []*unicastRecorder
+	var channels []Gossip
+	for _, r := range routers {
+		g := &unicastRecorder{testGossiper: newTestGossiper()}
+		s, err := r.NewGossip("Test", g)
+		require.NoError(t, err)
+		gossipers, channels = append(gossipers, g), append(channels, s)
+	}
+
+	// unicasts and broadcasts reach the far end of the line, and
+	// broadcasts from the middle reach both ends
+	require.NoError(t, channels[0].GossipUnicast(r5.Ourself.Name, []byte("hello")))
+	require.Equal(t, [][]byte{[]byte("hello")}, gossipers[4].received)
+	require.NoError(t, channels[4].GossipUnicast(r1.Ourself.Name, []byte("hi")))
+	require.Equal(t, [][]byte{[]byte("hi")}, gossipers[0].received)
+	broadcast(channels[0], 1)
+	broadcast(channels[2], 3)
+	sendPendingGossip(routers...)
+	gossipers[0].checkHas(t, 3)
+	gossipers[2].checkHas(t, 1)
+	for _, g := range []*unicastRecorder{gossipers[1], gossipers[3], gossipers[4]} {
+		g.checkHas(t, 1, 3)
+	}
+}
@@ -0,0 +1,299 @@
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TapDirection is whether a tapped frame was sent or received.
+type TapDirection byte
+
+// The directions of tapped frames.
+const (
+	TapReceived TapDirection = iota
+	TapSent
+)
+
+func (d TapDirection) String() string {
+	if d == TapSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// The kinds of tapped frames.
+const (
+	TapHeartbeat    = "heartbeat"
+	TapOverlay      = "overlay"
+	TapGossip       = "gossip"
+	TapUnicast      = "unicast"
+	TapBroadcast    = "broadcast"
+	TapMulticast    = "multicast"
+	TapDigest       = "digest"
+	TapGossipError  = "gossip-error"
+	TapDeparture    = "departure"
+	TapPing         = "ping"
+	TapPong         = "pong"
+	TapWindowUpdate = "window-update"
+	TapPowerMode    = "power-mode"
+	TapIdle         = "idle"
+)
+
+// tapKinds are the kinds of the frames with each tag. Fragments aren't
+// tapped, but the frames reassembled from them are, and compressed
+// frames are tapped uncompressed.
+var tapKinds = map[protocolTag]string{
+	ProtocolHeartbeat:         TapHeartbeat,
+	ProtocolReserved1:         TapOverlay,
+	ProtocolReserved2:         TapOverlay,
+	ProtocolReserved3:         TapOverlay,
+	ProtocolOverlayControlMsg: TapOverlay,
+	ProtocolGossip:            TapGossip,
+	ProtocolGossipUnicast:     TapUnicast,
+	ProtocolGossipBroadcast:   TapBroadcast,
+	ProtocolGossipMulticast:   TapMulticast,
+	ProtocolGossipDigest:      TapDigest,
+	ProtocolGossipError:       TapGossipError,
+	ProtocolDeparture:         TapDeparture,
+	ProtocolPing:              TapPing,
+	ProtocolPong:              TapPong,
+	ProtocolWindowUpdate:      TapWindowUpdate,
+	ProtocolPowerMode:         TapPowerMode,
+	ProtocolIdle:              TapIdle,
+}
+
+// TapFrame is a protocol frame sent to or received from a neighbour.
+type TapFrame struct {
+	Time      time.Time
+	Direction TapDirection
+	// Peer is the neighbour the frame was sent to or received from.
+	Peer PeerName
+	// Kind is one of TapHeartbeat etc.
+	Kind string
+	// Channel and Origin are those of gossip frames; the topology is
+	// gossiped on the "topology" channel. Destination is that of
+	// unicasts.
+	Channel     string
+	Origin      PeerName
+	Destination PeerName
+	// Size is that of the encoded frame, uncompressed.
+	Size int
+	// Payload is the encoded frame, if TapFilter.Payloads.
+	Payload []byte
+	// Dropped is the number of frames which passed the filter, but
+	// were dropped because the function tapping them fell behind,
+	// since the one before this.
+	Dropped uint64
+
+	tag protocolTag
+}
+
+// TapFilter selects the frames to tap. Empty fields select all frames.
+type TapFilter struct {
+	Kinds    []string
+	Channels []string // excludes all but gossip on these channels
+	Peers    []PeerName
+	// Payloads includes the encoded frames, not just their addressing.
+	Payloads bool
+}
+
+func (filter TapFilter) match(frame TapFrame) bool {
+	return (len(filter.Kinds) == 0 || containsString(filter.Kinds, frame.Kind)) &&
+		(len(filter.Channels) == 0 || (frame.Channel != "" && containsString(filter.Channels, frame.Channel))) &&
+		(len(filter.Peers) == 0 || containsPeerName(filter.Peers, frame.Peer))
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPeerName(names []PeerName, name PeerName) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of frames queued for each tap; beyond it, they are
+// dropped.
+const tapQueueSize = 1024
+
+// Tap calls f with each frame the router sends to or receives from its
+// neighbours which passes filter, from now until ctx is done or the
+// router stops, so that operators can inspect the traffic of the mesh,
+// e.g. written to a file by a PcapWriter. f is called from a goroutine
+// of its own, one frame at a time; frames are dropped rather than held
+// up while it falls behind.
+func (router *Router) Tap(ctx context.Context, filter TapFilter, f func(TapFrame)) {
+	t := &tap{filter: filter, frames: make(chan TapFrame, tapQueueSize)}
+	router.taps.add(t)
+	go func() {
+		defer router.taps.remove(t)
+		for {
+			select {
+			case frame := <-t.frames:
+				frame.Dropped = atomic.SwapUint64(&t.dropped, 0)
+				f(frame)
+			case <-ctx.Done():
+				return
+			case <-router.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+type tap struct {
+	dropped uint64 // accessed atomically, so first for 64-bit alignment
+	filter  TapFilter
+	frames  chan TapFrame
+}
+
+// taps are those of a router.
+type taps struct {
+	sync.RWMutex
+	count int32 // accessed atomically, so tapping is all but free when there are no taps
+	taps  map[*tap]struct{}
+}
+
+func (ts *taps) add(t *tap) {
+	ts.Lock()
+	defer ts.Unlock()
+	if ts.taps == nil {
+		ts.taps = make(map[*tap]struct{})
+	}
+	ts.taps[t] = struct{}{}
+	atomic.StoreInt32(&ts.count, int32(len(ts.taps)))
+}
+
+func (ts *taps) remove(t *tap) {
+	ts.Lock()
+	defer ts.Unlock()
+	delete(ts.taps, t)
+	atomic.StoreInt32(&ts.count, int32(len(ts.taps)))
+}
+
+// tap offers m, sent to or received from peer, to the taps of the
+// router, which may be nil in tests.
+func (router *Router) tap(direction TapDirection, peer PeerName, m protocolMsg) {
+	if router == nil || atomic.LoadInt32(&router.taps.count) == 0 {
+		return
+	}
+	kind, found := tapKinds[m.tag]
+	if !found {
+		return
+	}
+	frame := TapFrame{Time: router.clock().Now(), Direction: direction, Peer: peer, Kind: kind, Size: len(m.msg), tag: m.tag}
+	if gossipTag(m.tag) {
+		if req, err := decodeRelayRequest(m); err == nil {
+			frame.Channel, frame.Origin, frame.Destination = req.Channel, req.Origin, req.Destination
+		}
+	}
+	var payload []byte
+	router.taps.RLock()
+	defer router.taps.RUnlock()
+	for t := range router.taps.taps {
+		if !t.filter.match(frame) {
+			continue
+		}
+		frame := frame
+		if t.filter.Payloads {
+			// m.msg is recycled once sent
+			if payload == nil {
+				payload = append([]byte{}, m.msg...)
+			}
+			frame.Payload = payload
+		}
+		select {
+		case t.frames <- frame:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+}
+
+// gossipTag returns whether frames with the tag are addressed like
+// gossip.
+func gossipTag(tag protocolTag) bool {
+	return bulkTag(tag) && tag != ProtocolGossipCompressed
+}
+
+// The link type of PcapWriter captures, LINKTYPE_USER0.
+const pcapLinkType = 147
+
+// PcapWriter writes frames tapped by Router.Tap in the pcap capture
+// file format, with a link type, LINKTYPE_USER0, which tools such as
+// Wireshark leave to the user to dissect. Each packet is: the direction,
+// 0 for received and 1 for sent; the protocol tag; the neighbour's
+// name and the channel, each preceded by its length in a byte; and the
+// payload, if tapped, which gob encodes the channel and the origin,
+// then the destination of unicasts, the message and any metadata.
+type PcapWriter struct {
+	sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewPcapWriter writes the header of a capture to w, and returns a
+// PcapWriter of the packets which follow it.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], maxTCPMsgSize)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkType)
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// WriteFrame writes a packet of frame, and is to be passed to
+// Router.Tap. Any error writing it is kept for Err, and no more frames
+// are written.
+func (p *PcapWriter) WriteFrame(frame TapFrame) {
+	peer, channel := frame.Peer.String(), frame.Channel
+	if len(peer) > 255 || len(channel) > 255 {
+		return
+	}
+	packet := make([]byte, 16, 16+4+len(peer)+len(channel)+len(frame.Payload))
+	packet = append(packet, byte(frame.Direction), byte(frame.tag), byte(len(peer)))
+	packet = append(packet, peer...)
+	packet = append(packet, byte(len(channel)))
+	packet = append(packet, channel...)
+	headerLen := len(packet) - 16
+	packet = append(packet, frame.Payload...)
+	usec := frame.Time.UnixNano() / int64(time.Microsecond)
+	binary.LittleEndian.PutUint32(packet[0:], uint32(usec/1e6))
+	binary.LittleEndian.PutUint32(packet[4:], uint32(usec%1e6))
+	binary.LittleEndian.PutUint32(packet[8:], uint32(len(packet)-16))
+	binary.LittleEndian.PutUint32(packet[12:], uint32(headerLen+frame.Size))
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return
+	}
+	if _, err := p.w.Write(packet); err != nil {
+		p.err = fmt.Errorf("writing capture: %v", err)
+	}
+}
+
+// Err returns the error, if any, which stopped the writing of frames.
+func (p *PcapWriter) Err() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
@@ -0,0 +1,98 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTap(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{CompressGossip: true, CompressionThreshold: 1})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{CompressGossip: true, CompressionThreshold: 1})
+	defer r1.Stop()
+	defer r2.Stop()
+	c1, err := r1.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := &unicastChannel{newTestGossiper(), make(chan []byte, 1)}
+	_, err = r2.NewGossip("test", g2)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan TapFrame, tapQueueSize)
+	r1.Tap(ctx, TapFilter{Kinds: []string{TapUnicast}, Channels: []string{"test"}}, func(frame TapFrame) { sent <- frame })
+	received := make(chan TapFrame, tapQueueSize)
+	r2.Tap(ctx, TapFilter{Kinds: []string{TapUnicast}, Peers: []PeerName{r1.Ourself.Name}, Payloads: true}, func(frame TapFrame) { received <- frame })
+	topology := make(chan TapFrame, tapQueueSize)
+	r2.Tap(ctx, TapFilter{Channels: []string{"topology"}}, func(frame TapFrame) { topology <- frame })
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			r2.acceptTCP(tcpConn)
+		}
+	}()
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	waitUntil(t, func() bool {
+		r1.Routes.ensureRecalculated()
+		_, found := r1.Routes.UnicastAll(r2.Ourself.Name)
+		return found
+	})
+	require.NoError(t, c1.GossipUnicast(r2.Ourself.Name, []byte("hello")))
+	<-g2.unicasts
+
+	frame := <-sent
+	require.Equal(t, TapSent, frame.Direction)
+	require.Equal(t, r2.Ourself.Name, frame.Peer)
+	require.Equal(t, TapUnicast, frame.Kind)
+	require.Equal(t, "test", frame.Channel)
+	require.Equal(t, r1.Ourself.Name, frame.Origin)
+	require.Equal(t, r2.Ourself.Name, frame.Destination)
+	require.Nil(t, frame.Payload)
+
+	// received compressed, but tapped uncompressed
+	frame = <-received
+	require.Equal(t, TapReceived, frame.Direction)
+	require.Equal(t, r1.Ourself.Name, frame.Peer)
+	require.Equal(t, "test", frame.Channel)
+	require.Equal(t, frame.Size, len(frame.Payload))
+	require.True(t, bytes.Contains(frame.Payload, []byte("hello")))
+
+	frame = <-topology
+	require.Equal(t, "topology", frame.Channel)
+	require.Equal(t, r1.Ourself.Name, frame.Peer)
+}
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf)
+	require.NoError(t, err)
+	peer, _ := PeerNameFromString("01:00:00:01:00:00")
+	at := time.Unix(1500000000, 123456000)
+	w.WriteFrame(TapFrame{Time: at, Direction: TapSent, Peer: peer, Kind: TapBroadcast, Channel: "test", Size: 10, Payload: []byte("abc"), tag: ProtocolGossipBroadcast})
+	require.NoError(t, w.Err())
+
+	data := buf.Bytes()
+	require.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(data[0:]))
+	require.Equal(t, uint32(pcapLinkType), binary.LittleEndian.Uint32(data[20:]))
+	record := data[24:]
+	require.Equal(t, uint32(1500000000), binary.LittleEndian.Uint32(record[0:]))
+	require.Equal(t, uint32(123456), binary.LittleEndian.Uint32(record[4:]))
+	packet := record[16:]
+	header := append([]byte{1, ProtocolGossipBroadcast, byte(len(peer.String()))}, peer.String()...)
+	header = append(append(header, 4), "test"...)
+	require.Equal(t, append(header, "abc"...), packet)
+	require.Equal(t, uint32(len(packet)), binary.LittleEndian.Uint32(record[8:]))
+	require.Equal(t, uint32(len(header)+10), binary.LittleEndian.Uint32(record[12:]))
+}
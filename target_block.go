@@ -0,0 +1,151 @@
+package mesh
+
+import (
+	"net"
+	"path"
+	"time"
+)
+
+// TargetMatch selects targets by the peers they lead to, or by their
+// addresses; see ForgetMatching. A target matches if it matches any of
+// the fields.
+type TargetMatch struct {
+	// Peers matches the targets last connected to these peers.
+	Peers []PeerName
+
+	// Networks matches the targets whose IP address is in these
+	// networks, e.g. those parsed by net.ParseCIDR.
+	Networks []*net.IPNet
+
+	// Patterns matches targets, as given in host:port format or as
+	// WebSocket URLs, with the shell patterns of path.Match, e.g.
+	// "10.0.*:6783" or "*.example.com:*".
+	Patterns []string
+}
+
+func (m TargetMatch) match(target string, ip net.IP, peer PeerName) bool {
+	if peer != UnknownPeerName && containsPeerName(m.Peers, peer) {
+		return true
+	}
+	if ip != nil {
+		for _, network := range m.Networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range m.Patterns {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetMatching removes the targets of SourceManual which match m, as
+// ForgetConnections does, returning them. If block is positive, the
+// targets which match, from whichever source, and the peers of m, are
+// then not dialled for that long, e.g. so that dead targets which keep
+// flapping aren't redialled straight away. Connections already made
+// are kept. InitiateConnections lifts the block of the targets it is
+// given.
+func (cm *connectionMaker) ForgetMatching(m TargetMatch, block time.Duration) []string {
+	resultChan := make(chan []string)
+	cm.actionChan <- func() bool {
+		var (
+			forgotten []string
+			until     = cm.ourself.router.clock().Now().Add(block)
+		)
+		for peer, direct := range cm.directPeers {
+			address := cm.targetAddr(peer, direct)
+			if !m.match(peer, direct.ip(), cm.targetPeer(address)) {
+				continue
+			}
+			if _, contributed := direct.sources[SourceManual]; contributed {
+				cm.removeTarget(SourceManual, peer)
+				forgotten = append(forgotten, peer)
+			}
+			if block > 0 {
+				cm.blockedAddrs[address] = until
+			}
+		}
+		if block > 0 {
+			for address, target := range cm.targets {
+				if m.match(address, addressIP(address), target.peer) {
+					cm.blockedAddrs[address] = until
+				}
+			}
+			for _, peer := range m.Peers {
+				cm.blockedPeers[peer] = until
+			}
+		}
+		resultChan <- forgotten
+		return true
+	}
+	return <-resultChan
+}
+
+// BlockedTargets returns the addresses of the targets blocked by
+// ForgetMatching, and until when.
+func (cm *connectionMaker) BlockedTargets() map[string]time.Time {
+	resultChan := make(chan map[string]time.Time)
+	cm.actionChan <- func() bool {
+		cm.pruneBlocks(cm.ourself.router.clock().Now())
+		result := make(map[string]time.Time, len(cm.blockedAddrs))
+		for address, until := range cm.blockedAddrs {
+			result[address] = until
+		}
+		resultChan <- result
+		return false
+	}
+	return <-resultChan
+}
+
+// blockedUntil returns when the block on dialling the target at
+// address, which last led to peer, ends, if it is blocked.
+func (cm *connectionMaker) blockedUntil(address string, peer PeerName) (time.Time, bool) {
+	until, blocked := cm.blockedAddrs[address]
+	if peerUntil, found := cm.blockedPeers[peer]; found && peer != UnknownPeerName && peerUntil.After(until) {
+		until, blocked = peerUntil, true
+	}
+	return until, blocked
+}
+
+func (cm *connectionMaker) pruneBlocks(now time.Time) {
+	for address, until := range cm.blockedAddrs {
+		if !until.After(now) {
+			delete(cm.blockedAddrs, address)
+		}
+	}
+	for peer, until := range cm.blockedPeers {
+		if !until.After(now) {
+			delete(cm.blockedPeers, peer)
+		}
+	}
+}
+
+// targetPeer returns the peer the target at address last led to, if
+// known.
+func (cm *connectionMaker) targetPeer(address string) PeerName {
+	if target, found := cm.targets[address]; found {
+		return target.peer
+	}
+	return UnknownPeerName
+}
+
+func (direct *directPeer) ip() net.IP {
+	if direct.addr == nil {
+		return nil
+	}
+	return direct.addr.IP
+}
+
+// addressIP returns the IP of an address in host:port format, if it is
+// one.
+func addressIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
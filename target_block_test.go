@@ -0,0 +1,40 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForgetMatching(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	cm := r.ConnectionMaker
+	const a, b, c, d = "10.0.0.1:6783", "10.0.1.2:6783", "ws://peer.example.com:6783/mesh", "10.0.1.3:6783"
+
+	require.Empty(t, cm.InitiateConnections([]string{a, b, c}, false))
+	require.Empty(t, cm.AddTargets(SourceDNS, []string{d}))
+	_, network, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	require.Equal(t, []string{a}, cm.ForgetMatching(TargetMatch{Networks: []*net.IPNet{network}}, 0))
+	require.Equal(t, []string{c}, cm.ForgetMatching(TargetMatch{Patterns: []string{"ws://*.example.com:*/mesh"}}, 0))
+	require.Empty(t, cm.BlockedTargets())
+
+	// targets of other sources are blocked, but not forgotten
+	_, network, err = net.ParseCIDR("10.0.1.0/24")
+	require.NoError(t, err)
+	require.Equal(t, []string{b}, cm.ForgetMatching(TargetMatch{Networks: []*net.IPNet{network}}, time.Minute))
+	require.Equal(t, map[string][]TargetSource{d: {SourceDNS}}, cm.TargetSources())
+	blocked := cm.BlockedTargets()
+	require.Len(t, blocked, 2)
+	require.Contains(t, blocked, b)
+	require.True(t, blocked[d].After(time.Now()))
+
+	// until added again by hand
+	require.Empty(t, cm.InitiateConnections([]string{b}, false))
+	blocked = cm.BlockedTargets()
+	require.NotContains(t, blocked, b)
+	require.Contains(t, blocked, d)
+}
@@ -0,0 +1,103 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TargetPriority is how keen the ConnectionMaker is to connect to a
+// target.
+type TargetPriority int
+
+// TargetPriorities.
+const (
+	// PriorityNormal is the default.
+	PriorityNormal TargetPriority = iota
+	// PriorityPinned targets are the primary ones. They are retried
+	// without backing off any further than the first retry.
+	PriorityPinned
+	// PrioritySecondary targets are only dialled once all of the
+	// others have failed, and until one of them is connected, e.g.
+	// fallbacks in another region.
+	PrioritySecondary
+)
+
+func (priority TargetPriority) String() string {
+	switch priority {
+	case PriorityNormal:
+		return "normal"
+	case PriorityPinned:
+		return "pinned"
+	case PrioritySecondary:
+		return "secondary"
+	}
+	return fmt.Sprintf("TargetPriority(%d)", int(priority))
+}
+
+// InitiateConnectionsWithPriorities is InitiateConnections, giving each
+// of the peers the priority it maps to. A target keeps its priority
+// while it remains a target, unless given another.
+func (cm *connectionMaker) InitiateConnectionsWithPriorities(peers map[string]TargetPriority, replace bool) []error {
+	list := make([]string, 0, len(peers))
+	keep := make(map[string]struct{}, len(peers))
+	for peer := range peers {
+		list = append(list, peer)
+		keep[peer] = struct{}{}
+	}
+	sort.Strings(list)
+	addrs, errors := parsePeerAddrs(list)
+	cm.actionChan <- func() bool {
+		if replace {
+			cm.reconcileTargets(SourceManual, addrs, keep)
+		} else {
+			cm.addTargets(SourceManual, addrs)
+		}
+		for peer := range addrs {
+			cm.directPeers[peer].priority = peers[peer]
+		}
+		return true
+	}
+	return errors
+}
+
+// TargetPriorities returns the priorities of the targets which aren't
+// PriorityNormal.
+func (cm *connectionMaker) TargetPriorities() map[string]TargetPriority {
+	resultChan := make(chan map[string]TargetPriority)
+	cm.actionChan <- func() bool {
+		result := make(map[string]TargetPriority)
+		for peer, direct := range cm.directPeers {
+			if direct.priority != PriorityNormal {
+				result[peer] = direct.priority
+			}
+		}
+		resultChan <- result
+		return false
+	}
+	return <-resultChan
+}
+
+// retryLater schedules the next retry of the target at address, which
+// if pinned doesn't back off.
+func (cm *connectionMaker) retryLater(address string, target *target) {
+	for peer, direct := range cm.directPeers {
+		if direct.priority == PriorityPinned && cm.targetAddr(peer, direct) == address {
+			target.attempts = 0
+			break
+		}
+	}
+	target.nextTryLater(cm.backoff, cm.ourself.router.clock(), cm.ourself.router.rng())
+}
+
+// targetsWithPriority returns the targets with the given priority, in
+// order.
+func (cm *connectionMaker) targetsWithPriority(priority TargetPriority) []string {
+	var targets []string
+	for peer, p := range cm.TargetPriorities() {
+		if p == priority {
+			targets = append(targets, peer)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
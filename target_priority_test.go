@@ -0,0 +1,67 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondaryTargets(t *testing.T) {
+	primary := newTestRouter(t, "01:00:00:01:00:00")
+	secondary := newTestRouter(t, "02:00:00:02:00:00")
+	defer secondary.Stop()
+	r := newTestRouter(t, "03:00:00:03:00:00")
+	defer r.Stop()
+	primaryAddr := fmt.Sprintf("127.0.0.1:%d", primary.listenPort())
+	secondaryAddr := fmt.Sprintf("127.0.0.1:%d", secondary.listenPort())
+
+	require.Empty(t, r.ConnectionMaker.InitiateConnectionsWithPriorities(map[string]TargetPriority{
+		primaryAddr:   PriorityPinned,
+		secondaryAddr: PrioritySecondary,
+	}, true))
+	require.Equal(t, map[string]TargetPriority{primaryAddr: PriorityPinned, secondaryAddr: PrioritySecondary}, r.ConnectionMaker.TargetPriorities())
+	status := NewStatus(r)
+	require.Equal(t, []string{primaryAddr}, status.PinnedTargets)
+	require.Equal(t, []string{secondaryAddr}, status.SecondaryTargets)
+
+	waitUntil(t, func() bool {
+		_, found := r.Ourself.ConnectionTo(primary.Ourself.Name)
+		return found
+	})
+	time.Sleep(100 * time.Millisecond)
+	_, found := r.Ourself.ConnectionTo(secondary.Ourself.Name)
+	require.False(t, found)
+
+	// fall back to the secondary once the primary is unreachable
+	primary.Stop()
+	waitUntil(t, func() bool {
+		_, found := r.Ourself.ConnectionTo(secondary.Ourself.Name)
+		return found
+	})
+}
+
+func TestPinnedTargetsDontBackOff(t *testing.T) {
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Backoff: BackoffPolicy{Jitter: -1}})
+	defer r.Stop()
+	cm := r.ConnectionMaker
+	const pinned, normal = "10.0.0.1:6783", "10.0.0.2:6783"
+	require.Empty(t, cm.InitiateConnectionsWithPriorities(map[string]TargetPriority{pinned: PriorityPinned, normal: PriorityNormal}, false))
+	delays := make(chan [2]time.Duration)
+	cm.actionChan <- func() bool {
+		var result [2]time.Duration
+		for i, address := range []string{pinned, normal} {
+			tgt := &target{state: targetWaiting}
+			for j := 0; j < 5; j++ {
+				cm.retryLater(address, tgt)
+			}
+			result[i] = time.Until(tgt.tryAfter)
+		}
+		delays <- result
+		return false
+	}
+	result := <-delays
+	require.InDelta(t, float64(initialInterval), float64(result[0]), float64(time.Second))
+	require.True(t, result[1] > 5*time.Second, result[1])
+}
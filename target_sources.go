@@ -0,0 +1,152 @@
+package mesh
+
+import (
+	"net"
+	"sort"
+)
+
+// TargetSource identifies a component contributing connection targets
+// to the ConnectionMaker, e.g. static configuration or some discovery
+// mechanism. Each source adds, removes and reconciles only the targets
+// it contributed, so that one can't remove the targets of another; a
+// target is forgotten once no source contributes it. Applications may
+// define sources of their own.
+type TargetSource string
+
+// The sources of targets known to mesh.
+const (
+	// SourceManual contributes the targets of InitiateConnections and
+	// ForgetConnections, e.g. from the admin API.
+	SourceManual TargetSource = "manual"
+	// SourceStatic is for targets from static configuration.
+	SourceStatic TargetSource = "static"
+	// SourceDNS is for targets from DNS discovery.
+	SourceDNS TargetSource = "dns"
+	// SourceMDNS is for targets from multicast DNS discovery.
+	SourceMDNS TargetSource = "mdns"
+	// SourceKubernetes is for targets from the Kubernetes API.
+	SourceKubernetes TargetSource = "kubernetes"
+	// SourcePEX is for targets learnt by peer exchange.
+	SourcePEX TargetSource = "pex"
+	// SourceBootstrap contributes the targets of Router.Bootstrap.
+	SourceBootstrap TargetSource = "bootstrap"
+	// SourceCache is for targets from the peer cache; see
+	// Config.PeerStore.
+	SourceCache TargetSource = "cache"
+)
+
+// directPeer is a target, specified in host[:port] format or as a
+// WebSocket URL, along with the sources which contributed it.
+type directPeer struct {
+	addr     *net.TCPAddr // nil for WebSocket URLs
+	sources  map[TargetSource]struct{}
+	priority TargetPriority
+}
+
+// AddTargets adds the provided peers, specified in host:port format, to
+// the targets of source, and creates connections to them.
+func (cm *connectionMaker) AddTargets(source TargetSource, peers []string) []error {
+	addrs, errors := parsePeerAddrs(peers)
+	cm.actionChan <- func() bool {
+		cm.addTargets(source, addrs)
+		return true
+	}
+	return errors
+}
+
+// CheckTargets returns the errors AddTargets or ReconcileTargets would
+// return for the provided peers, without adding any, so that callers
+// can reject a list of peers as a whole.
+func (cm *connectionMaker) CheckTargets(peers []string) []error {
+	_, errors := parsePeerAddrs(peers)
+	return errors
+}
+
+// RemoveTargets removes the provided peers, specified in host:port
+// format, from the targets of source.
+func (cm *connectionMaker) RemoveTargets(source TargetSource, peers []string) {
+	cm.actionChan <- func() bool {
+		for _, peer := range peers {
+			cm.removeTarget(source, peer)
+		}
+		return true
+	}
+}
+
+// ReconcileTargets makes the provided peers, specified in host:port
+// format, the targets of source, adding those it lacks and removing
+// those it has but which aren't provided. Peers which can't be resolved
+// are neither added nor removed.
+func (cm *connectionMaker) ReconcileTargets(source TargetSource, peers []string) []error {
+	addrs, errors := parsePeerAddrs(peers)
+	keep := make(map[string]struct{}, len(peers))
+	for _, peer := range peers {
+		keep[peer] = struct{}{}
+	}
+	cm.actionChan <- func() bool {
+		cm.reconcileTargets(source, addrs, keep)
+		return true
+	}
+	return errors
+}
+
+// TargetSources returns the sources which contributed each target.
+func (cm *connectionMaker) TargetSources() map[string][]TargetSource {
+	resultChan := make(chan map[string][]TargetSource)
+	cm.actionChan <- func() bool {
+		result := make(map[string][]TargetSource, len(cm.directPeers))
+		for peer, direct := range cm.directPeers {
+			sources := make([]TargetSource, 0, len(direct.sources))
+			for source := range direct.sources {
+				sources = append(sources, source)
+			}
+			sort.Slice(sources, func(i, j int) bool { return sources[i] < sources[j] })
+			result[peer] = sources
+		}
+		resultChan <- result
+		return false
+	}
+	return <-resultChan
+}
+
+func (cm *connectionMaker) reconcileTargets(source TargetSource, addrs peerAddrs, keep map[string]struct{}) {
+	for peer, direct := range cm.directPeers {
+		if _, contributed := direct.sources[source]; !contributed {
+			continue
+		}
+		if _, found := keep[peer]; !found {
+			cm.removeTarget(source, peer)
+		}
+	}
+	cm.addTargets(source, addrs)
+}
+
+func (cm *connectionMaker) addTargets(source TargetSource, addrs peerAddrs) {
+	for peer, addr := range addrs {
+		direct, found := cm.directPeers[peer]
+		if !found {
+			direct = &directPeer{sources: make(map[TargetSource]struct{})}
+			cm.directPeers[peer] = direct
+		}
+		direct.addr = addr
+		direct.sources[source] = struct{}{}
+		if source == SourceManual {
+			delete(cm.blockedAddrs, cm.targetAddr(peer, direct))
+		}
+		// curtail any existing reconnect interval
+		if target, found := cm.targets[cm.targetAddr(peer, direct)]; found {
+			target.nextTryNow(cm.ourself.router.clock())
+		}
+	}
+}
+
+func (cm *connectionMaker) removeTarget(source TargetSource, peer string) {
+	direct, found := cm.directPeers[peer]
+	if !found {
+		return
+	}
+	delete(direct.sources, source)
+	if len(direct.sources) == 0 {
+		delete(cm.directPeers, peer)
+	}
+}
@@ -0,0 +1,36 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetSources(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	cm := r.ConnectionMaker
+	const a, b, c = "10.0.0.1:6783", "10.0.0.2:6783", "10.0.0.3:6783"
+
+	require.Empty(t, cm.AddTargets(SourceDNS, []string{a, b}))
+	require.Empty(t, cm.InitiateConnections([]string{b, c}, false))
+	require.Equal(t, map[string][]TargetSource{
+		a: {SourceDNS},
+		b: {SourceDNS, SourceManual},
+		c: {SourceManual},
+	}, cm.TargetSources())
+
+	// each source only removes its own contributions
+	require.Empty(t, cm.ReconcileTargets(SourceDNS, []string{a}))
+	cm.ForgetConnections([]string{a})
+	require.Equal(t, map[string][]TargetSource{
+		a: {SourceDNS},
+		b: {SourceManual},
+		c: {SourceManual},
+	}, cm.TargetSources())
+
+	require.Empty(t, cm.InitiateConnections([]string{c}, true))
+	require.ElementsMatch(t, []string{a, c}, cm.Targets(false))
+	cm.RemoveTargets(SourceDNS, []string{a})
+	require.Equal(t, []string{c}, cm.Targets(false))
+}
@@ -0,0 +1,62 @@
+package mesh
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timeouts shorter than this are surely mistakes, e.g. a number of
+// seconds given as a time.Duration.
+const minTimeout = 10 * time.Millisecond
+
+// validateTimeouts checks the durations in config, zero meaning the
+// default for each.
+func validateTimeouts(config Config) error {
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"heartbeat interval", config.HeartbeatInterval},
+		{"handshake timeout", config.HandshakeTimeout},
+		{"write timeout", config.WriteTimeout},
+	}
+	if config.GossipInterval != nil {
+		if *config.GossipInterval <= 0 {
+			return fmt.Errorf("gossip interval must be positive, not %v", *config.GossipInterval)
+		}
+		durations = append(durations, struct {
+			name  string
+			value time.Duration
+		}{"gossip interval", *config.GossipInterval})
+	}
+	for _, d := range durations {
+		if d.value < 0 || (d.value > 0 && d.value < minTimeout) {
+			return fmt.Errorf("%s of %v is too short", d.name, d.value)
+		}
+	}
+	if config.SlowPeer.QueueBytes < 0 || config.SlowPeer.For < 0 {
+		return fmt.Errorf("slow peer policy must not be negative")
+	}
+	return nil
+}
+
+// heartbeatInterval returns the period of heartbeats on connections.
+func (router *Router) heartbeatInterval() time.Duration {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	if router.HeartbeatInterval > 0 {
+		return router.HeartbeatInterval
+	}
+	return tcpHeartbeat
+}
+
+// handshakeTimeout returns how long a new connection has to exchange
+// protocol headers.
+func (router *Router) handshakeTimeout() time.Duration {
+	router.configLock.RLock()
+	defer router.configLock.RUnlock()
+	if router.HandshakeTimeout > 0 {
+		return router.HandshakeTimeout
+	}
+	return headerTimeout
+}
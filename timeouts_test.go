@@ -0,0 +1,57 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTimeouts(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	negative, zero := -time.Second, time.Duration(0)
+	for _, config := range []Config{
+		{HeartbeatInterval: -time.Second},
+		{HeartbeatInterval: time.Nanosecond},
+		{HandshakeTimeout: -time.Second},
+		{GossipInterval: &negative},
+		{GossipInterval: &zero},
+	} {
+		_, err := NewRouter(config, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+		require.Error(t, err, "%+v", config)
+	}
+}
+
+func TestShortHeartbeat(t *testing.T) {
+	config := Config{HeartbeatInterval: 50 * time.Millisecond, HandshakeTimeout: time.Second}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	defer r2.Stop()
+	require.Equal(t, 50*time.Millisecond, r1.heartbeatInterval())
+	require.Equal(t, time.Second, r1.handshakeTimeout())
+
+	connectTo(t, r1, r2)
+	// Heartbeats keep the connection up well beyond twice the interval.
+	time.Sleep(10 * config.HeartbeatInterval)
+	_, ok := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, ok)
+}
+
+func TestMismatchedHeartbeats(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{HeartbeatInterval: 50 * time.Millisecond})
+	defer r1.Stop()
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{HeartbeatInterval: 300 * time.Millisecond})
+	defer r2.Stop()
+
+	connectTo(t, r1, r2)
+	// r1 waits for the heartbeats r2 sends at its own, longer, interval,
+	// rather than timing r2 out after twice its own.
+	time.Sleep(10 * 50 * time.Millisecond)
+	_, ok := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.True(t, ok)
+	_, ok = r2.Ourself.ConnectionTo(r1.Ourself.Name)
+	require.True(t, ok)
+}
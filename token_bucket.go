@@ -11,15 +11,17 @@ type tokenBucket struct {
 	tokenInterval        time.Duration // Token replenishment rate
 	refillDuration       time.Duration // Time to refill from empty
 	earliestUnspentToken time.Time
+	clock                Clock
 }
 
 // newTokenBucket returns a bucket containing capacity tokens, refilled at a
-// rate of one token per tokenInterval.
-func newTokenBucket(capacity int64, tokenInterval time.Duration) *tokenBucket {
+// rate of one token per tokenInterval according to clock.
+func newTokenBucket(capacity int64, tokenInterval time.Duration, clock Clock) *tokenBucket {
 	tb := tokenBucket{
 		capacity:       capacity,
 		tokenInterval:  tokenInterval,
-		refillDuration: tokenInterval * time.Duration(capacity)}
+		refillDuration: tokenInterval * time.Duration(capacity),
+		clock:          clock}
 
 	tb.earliestUnspentToken = tb.capacityToken()
 
@@ -30,7 +32,7 @@ func newTokenBucket(capacity int64, tokenInterval time.Duration) *tokenBucket {
 // Not safe for concurrent use by multiple goroutines.
 func (tb *tokenBucket) wait() {
 	// If earliest unspent token is in the future, sleep until then
-	time.Sleep(time.Until(tb.earliestUnspentToken))
+	sleep(tb.clock, tb.earliestUnspentToken.Sub(tb.clock.Now()))
 
 	// Alternatively, enforce bucket capacity if necessary
 	capacityToken := tb.capacityToken()
@@ -44,5 +46,5 @@ func (tb *tokenBucket) wait() {
 
 // Determine the historic token timestamp representing a full bucket
 func (tb *tokenBucket) capacityToken() time.Time {
-	return time.Now().Add(-tb.refillDuration).Truncate(tb.tokenInterval)
+	return tb.clock.Now().Add(-tb.refillDuration).Truncate(tb.tokenInterval)
 }
@@ -0,0 +1,401 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Names of the topology codecs, as advertised in the handshake as values
+// of featureTopologyCodec.
+const (
+	topologyCodecGob      = "gob"
+	topologyCodecProtobuf = "protobuf"
+)
+
+// topologyCodec serialises topology updates, i.e. a sequence of peers
+// with their connections.
+type topologyCodec interface {
+	name() string
+	encoder(buf *bytes.Buffer) topologyEncoder
+	decoder(update []byte) topologyDecoder
+}
+
+// topologyEncoder appends the peers of an update to a buffer in turn.
+type topologyEncoder interface {
+	encode(ps peerSummary, conns []connectionSummary)
+}
+
+// topologyDecoder yields the peers of an update in turn, returning
+// io.EOF after the last.
+type topologyDecoder interface {
+	next() (peerSummary, []connectionSummary, error)
+}
+
+// Codecs we support, most preferred first.
+var topologyCodecs = []topologyCodec{protobufTopologyCodec{}, gobTopologyCodec{}}
+
+// chooseTopologyCodec picks the first of the named codecs, which both
+// sides of a connection support, in order of preference. Peers which
+// don't advertise any codecs only know gob.
+func chooseTopologyCodec(names []string) topologyCodec {
+	for _, name := range names {
+		for _, codec := range topologyCodecs {
+			if codec.name() == name {
+				return codec
+			}
+		}
+	}
+	return gobTopologyCodec{}
+}
+
+// topologyCodecFor returns the codec negotiated on conn.
+func topologyCodecFor(conn Connection) topologyCodec {
+	if cc, ok := conn.(interface{ topologyCodec() topologyCodec }); ok {
+		return cc.topologyCodec()
+	}
+	return gobTopologyCodec{}
+}
+
+// decodeTopology returns a decoder for update in whichever codec it was
+// encoded with. Protobuf updates start with protobufTopologyMagic,
+// which can never start a gob stream, so updates are self-describing
+// and received updates needn't be matched to the connection.
+func decodeTopology(update []byte) topologyDecoder {
+	if len(update) > 0 && update[0] == protobufTopologyMagic {
+		return protobufTopologyCodec{}.decoder(update)
+	}
+	return gobTopologyCodec{}.decoder(update)
+}
+
+// gobTopologyCodec is the original encoding: a gob stream of
+// alternating peerSummary and []connectionSummary values.
+type gobTopologyCodec struct{}
+
+func (gobTopologyCodec) name() string { return topologyCodecGob }
+
+type gobTopologyEncoder struct {
+	enc *gob.Encoder
+}
+
+func (gobTopologyCodec) encoder(buf *bytes.Buffer) topologyEncoder {
+	return &gobTopologyEncoder{gob.NewEncoder(buf)}
+}
+
+func (e *gobTopologyEncoder) encode(ps peerSummary, conns []connectionSummary) {
+	if err := e.enc.Encode(ps); err != nil {
+		panic(err)
+	}
+	if err := e.enc.Encode(conns); err != nil {
+		panic(err)
+	}
+}
+
+type gobTopologyDecoder struct {
+	dec *gob.Decoder
+	err error // from checking the update
+}
+
+func (gobTopologyCodec) decoder(update []byte) topologyDecoder {
+	return &gobTopologyDecoder{
+		dec: gob.NewDecoder(bytes.NewReader(update)),
+		err: CheckGob(update, DecodeLimits{AllowedTypes: meshGobTypes}),
+	}
+}
+
+func (d *gobTopologyDecoder) next() (ps peerSummary, connSummaries []connectionSummary, err error) {
+	if d.err != nil {
+		return ps, nil, d.err
+	}
+	if err = d.dec.Decode(&ps); err != nil {
+		return
+	}
+	err = d.dec.Decode(&connSummaries)
+	return
+}
+
+// The first byte of a protobuf-encoded topology update. Gob streams
+// start with a message length, whose first byte is either below 0x80
+// or a negated byte count of at least 0xf8.
+const protobufTopologyMagic = 0x80
+
+// protobufTopologyCodec encodes updates as the protobuf message
+//
+//	message TopologyUpdate {
+//	  repeated Peer peers = 1;
+//	}
+//	message Peer {
+//	  bytes name = 1;
+//	  string nick_name = 2;
+//	  uint64 uid = 3;
+//	  uint64 version = 4;
+//	  uint32 short_id = 5;
+//	  bool has_short_id = 6;
+//	  repeated Connection connections = 7;
+//	  bool draining = 8;
+//	  bool degraded = 9;
+//	  bytes public_key = 10;
+//	  bool leaf = 11;
+//	  string zone = 12;
+//	  repeated string listen_addrs = 13;
+//	  repeated string addrs = 14;
+//	  map<string, string> labels = 15;
+//	  repeated string groups = 16;
+//	}
+//	message Connection {
+//	  bytes name = 1;
+//	  string remote_tcp_addr = 2;
+//	  bool outbound = 3;
+//	  bool established = 4;
+//	  bool degraded = 5;
+//	  int64 rtt_nanos = 6;
+//	}
+//
+// preceded by protobufTopologyMagic.
+type protobufTopologyCodec struct{}
+
+func (protobufTopologyCodec) name() string { return topologyCodecProtobuf }
+
+type protobufTopologyEncoder struct {
+	buf *bytes.Buffer
+}
+
+func (protobufTopologyCodec) encoder(buf *bytes.Buffer) topologyEncoder {
+	buf.WriteByte(protobufTopologyMagic)
+	return &protobufTopologyEncoder{buf}
+}
+
+func (e *protobufTopologyEncoder) encode(ps peerSummary, conns []connectionSummary) {
+	var peer []byte
+	peer = appendProtoBytes(peer, 1, ps.NameByte)
+	peer = appendProtoBytes(peer, 2, []byte(ps.NickName))
+	peer = appendProtoVarint(peer, 3, uint64(ps.UID))
+	peer = appendProtoVarint(peer, 4, ps.Version)
+	peer = appendProtoVarint(peer, 5, uint64(ps.ShortID))
+	peer = appendProtoBool(peer, 6, ps.HasShortID)
+	peer = appendProtoBool(peer, 8, ps.Draining)
+	peer = appendProtoBool(peer, 9, ps.Degraded)
+	peer = appendProtoBytes(peer, 10, ps.PublicKey)
+	peer = appendProtoBool(peer, 11, ps.Leaf)
+	peer = appendProtoBytes(peer, 12, []byte(ps.Zone))
+	for _, addr := range ps.ListenAddrs {
+		peer = appendProtoBytes(peer, 13, []byte(addr))
+	}
+	for _, addr := range ps.Addrs {
+		peer = appendProtoBytes(peer, 14, []byte(addr))
+	}
+	for _, key := range sortedLabelKeys(ps.Labels) {
+		var label []byte
+		label = appendProtoBytes(label, 1, []byte(key))
+		label = appendProtoBytes(label, 2, []byte(ps.Labels[key]))
+		peer = appendProtoBytes(peer, 15, label)
+	}
+	for _, group := range ps.Groups {
+		peer = appendProtoBytes(peer, 16, []byte(group))
+	}
+	for _, cs := range conns {
+		var conn []byte
+		conn = appendProtoBytes(conn, 1, cs.NameByte)
+		conn = appendProtoBytes(conn, 2, []byte(cs.RemoteTCPAddr))
+		conn = appendProtoBool(conn, 3, cs.Outbound)
+		conn = appendProtoBool(conn, 4, cs.Established)
+		conn = appendProtoBool(conn, 5, cs.Degraded)
+		conn = appendProtoVarint(conn, 6, uint64(cs.RTT))
+		peer = appendProtoBytes(peer, 7, conn)
+	}
+	e.buf.Write(appendProtoBytes(nil, 1, peer))
+}
+
+type protobufTopologyDecoder struct {
+	update []byte
+}
+
+func (protobufTopologyCodec) decoder(update []byte) topologyDecoder {
+	if len(update) > 0 {
+		update = update[1:]
+	}
+	return &protobufTopologyDecoder{update}
+}
+
+func (d *protobufTopologyDecoder) next() (ps peerSummary, connSummaries []connectionSummary, err error) {
+	for len(d.update) > 0 {
+		var field uint64
+		var value []byte
+		if field, _, value, d.update, err = readProtoField(d.update); err != nil {
+			return
+		}
+		if field != 1 {
+			continue
+		}
+		err = forEachProtoField(value, func(field, n uint64, value []byte) error {
+			switch field {
+			case 1:
+				ps.NameByte = append([]byte{}, value...)
+			case 2:
+				ps.NickName = string(value)
+			case 3:
+				ps.UID = PeerUID(n)
+			case 4:
+				ps.Version = n
+			case 5:
+				ps.ShortID = PeerShortID(n)
+			case 6:
+				ps.HasShortID = n != 0
+			case 7:
+				var cs connectionSummary
+				if err := forEachProtoField(value, func(field, n uint64, value []byte) error {
+					switch field {
+					case 1:
+						cs.NameByte = append([]byte{}, value...)
+					case 2:
+						cs.RemoteTCPAddr = string(value)
+					case 3:
+						cs.Outbound = n != 0
+					case 4:
+						cs.Established = n != 0
+					case 5:
+						cs.Degraded = n != 0
+					case 6:
+						cs.RTT = time.Duration(n)
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+				connSummaries = append(connSummaries, cs)
+			case 8:
+				ps.Draining = n != 0
+			case 9:
+				ps.Degraded = n != 0
+			case 10:
+				ps.PublicKey = append([]byte{}, value...)
+			case 11:
+				ps.Leaf = n != 0
+			case 12:
+				ps.Zone = string(value)
+			case 13:
+				ps.ListenAddrs = append(ps.ListenAddrs, string(value))
+			case 14:
+				ps.Addrs = append(ps.Addrs, string(value))
+			case 15:
+				var key, val string
+				if err := forEachProtoField(value, func(field, n uint64, value []byte) error {
+					switch field {
+					case 1:
+						key = string(value)
+					case 2:
+						val = string(value)
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+				if ps.Labels == nil {
+					ps.Labels = make(map[string]string)
+				}
+				ps.Labels[key] = val
+			case 16:
+				ps.Groups = append(ps.Groups, string(value))
+			}
+			return nil
+		})
+		if connSummaries == nil {
+			connSummaries = []connectionSummary{}
+		}
+		return
+	}
+	err = io.EOF
+	return
+}
+
+// Minimal protobuf wire format support.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func appendProtoVarint(buf []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendUvarint(buf, uint64(field)<<3|protoVarint)
+	return appendUvarint(buf, v)
+}
+
+func appendProtoBool(buf []byte, field int, v bool) []byte {
+	if !v {
+		return buf
+	}
+	return appendProtoVarint(buf, field, 1)
+}
+
+func appendProtoBytes(buf []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return buf
+	}
+	buf = appendUvarint(buf, uint64(field)<<3|protoBytes)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// readProtoField reads one field from buf, returning its number, its
+// value if it's a varint, or its contents if it's length-delimited,
+// and the rest of buf. Fixed-size fields are skipped.
+func readProtoField(buf []byte) (field, n uint64, value, rest []byte, err error) {
+	key, l := binary.Uvarint(buf)
+	if l <= 0 {
+		return 0, 0, nil, nil, fmt.Errorf("malformed protobuf field key")
+	}
+	buf = buf[l:]
+	field = key >> 3
+	switch key & 7 {
+	case protoVarint:
+		if n, l = binary.Uvarint(buf); l <= 0 {
+			return 0, 0, nil, nil, fmt.Errorf("malformed protobuf varint")
+		}
+		return field, n, nil, buf[l:], nil
+	case protoBytes:
+		size, l := binary.Uvarint(buf)
+		if l <= 0 || size > uint64(len(buf)-l) {
+			return 0, 0, nil, nil, fmt.Errorf("malformed protobuf length")
+		}
+		buf = buf[l:]
+		return field, 0, buf[:size], buf[size:], nil
+	case protoFixed64:
+		if len(buf) < 8 {
+			return 0, 0, nil, nil, fmt.Errorf("truncated protobuf fixed64")
+		}
+		return field, 0, nil, buf[8:], nil
+	case protoFixed32:
+		if len(buf) < 4 {
+			return 0, 0, nil, nil, fmt.Errorf("truncated protobuf fixed32")
+		}
+		return field, 0, nil, buf[4:], nil
+	}
+	return 0, 0, nil, nil, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+}
+
+func forEachProtoField(buf []byte, f func(field, n uint64, value []byte) error) error {
+	for len(buf) > 0 {
+		field, n, value, rest, err := readProtoField(buf)
+		if err != nil {
+			return err
+		}
+		if err := f(field, n, value); err != nil {
+			return err
+		}
+		buf = rest
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package mesh
+
+// ConnectRequest describes a peer found by PeerDiscovery, which the
+// ConnectionMaker would connect to.
+type ConnectRequest struct {
+	Peer     PeerName
+	NickName string
+	// Connections is the number of connections we have, or are making,
+	// including those to peers the policy has already allowed.
+	Connections int
+}
+
+// TopologyPolicy decides whether the ConnectionMaker may connect to a
+// peer it has discovered. Peers it rejects can still connect to us, and
+// are reached via other peers.
+type TopologyPolicy func(ConnectRequest) bool
+
+// MaxDegree returns a TopologyPolicy under which we stop connecting to
+// the peers we discover once we have n connections.
+func MaxDegree(n int) TopologyPolicy {
+	return func(req ConnectRequest) bool {
+		return req.Connections < n
+	}
+}
+
+// HubAndSpoke returns a TopologyPolicy for a mesh of hubs, which
+// connect to each other, and spokes, which connect only to hubs. Either
+// way, only hubs are connected to. isHub says whether a peer is a hub,
+// e.g. by its nickname.
+func HubAndSpoke(isHub func(name PeerName, nickName string) bool) TopologyPolicy {
+	return func(req ConnectRequest) bool {
+		return isHub(req.Peer, req.NickName)
+	}
+}
+
+// AllPolicies returns a TopologyPolicy allowing only connections which
+// all of policies allow.
+func AllPolicies(policies ...TopologyPolicy) TopologyPolicy {
+	return func(req ConnectRequest) bool {
+		for _, policy := range policies {
+			if !policy(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,51 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// discoveredPeers returns the peers router would connect to by
+// discovery under policy.
+func discoveredPeers(router *Router, policy TopologyPolicy) peerNameSet {
+	allowed := make(peerNameSet)
+	router.TopologyPolicy = func(req ConnectRequest) bool {
+		if policy(req) {
+			allowed[req.Peer] = struct{}{}
+			return true
+		}
+		return false
+	}
+	ourConnectedPeers := make(peerNameSet)
+	for conn := range router.Ourself.getConnections() {
+		ourConnectedPeers[conn.Remote().Name] = struct{}{}
+	}
+	done := make(chan struct{})
+	router.ConnectionMaker.actionChan <- func() bool {
+		router.ConnectionMaker.addPeerTargets(ourConnectedPeers, func(string, time.Duration) {})
+		close(done)
+		return false
+	}
+	<-done
+	return allowed
+}
+
+func TestTopologyPolicy(t *testing.T) {
+	hub := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{hub, r2, r3, r4}
+	addTestGossipConnection(t, hub, r2)
+	addTestGossipConnection(t, hub, r3)
+	addTestGossipConnection(t, hub, r4)
+	flushAndCheckTopology(t, routers, hub.tp(r2, r3, r4), r2.tp(hub), r3.tp(hub), r4.tp(hub))
+
+	require.Len(t, discoveredPeers(r2, MaxDegree(3)), 2)
+	require.Len(t, discoveredPeers(r2, MaxDegree(2)), 1)
+	require.Empty(t, discoveredPeers(r2, AllPolicies(MaxDegree(3), HubAndSpoke(func(name PeerName, _ string) bool {
+		return name == hub.Ourself.Name
+	}))))
+}
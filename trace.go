@@ -0,0 +1,215 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The name of the gossip channel on which traceroute probes, and the
+// replies to them, are sent.
+const traceChannelName = internalChannelPrefix + "trace"
+
+// Trace returns the path that unicasts to dst would take, according to
+// the routing tables we would expect each peer along it to have, given
+// the topology as we know it: the peers they would be relayed by, in
+// order, followed by dst. It is empty if dst is ourselves.
+func (router *Router) Trace(dst PeerName) ([]PeerName, error) {
+	return router.Routes.trace(dst)
+}
+
+func (r *routes) trace(dst PeerName) ([]PeerName, error) {
+	r.peers.RLock()
+	defer r.peers.RUnlock()
+	r.ourself.RLock()
+	defer r.ourself.RUnlock()
+	if _, found := r.peers.byName[dst]; !found {
+		return nil, fmt.Errorf("unknown peer %s", dst)
+	}
+	var path []PeerName
+	visited := map[PeerName]struct{}{r.ourself.Name: {}}
+	for cur := r.ourself.Peer; cur.Name != dst; {
+		hop, found := r.unicastFrom(cur, false)[dst]
+		if !found || hop == UnknownPeerName {
+			return path, fmt.Errorf("no route from %s to %s", cur.Name, dst)
+		}
+		path = append(path, hop)
+		if _, found := visited[hop]; found {
+			return path, fmt.Errorf("routing loop at %s", hop)
+		}
+		visited[hop] = struct{}{}
+		if cur = r.peers.byName[hop]; cur == nil {
+			return path, fmt.Errorf("unknown peer %s", hop)
+		}
+	}
+	return path, nil
+}
+
+// TraceHop is a peer which a traceroute probe reached.
+type TraceHop struct {
+	Peer     PeerName
+	NickName string
+	// RTT is the time from sending the probe to receiving the peer's
+	// reply, which takes the peer's route back to us.
+	RTT time.Duration
+}
+
+// Traceroute sends a probe towards dst, which each peer it reaches
+// replies to, and relays to the next hop of its route to dst, so
+// revealing the path unicasts to dst actually take. It returns the
+// peers which replied, in order along the path, once dst and all those
+// before it have, or ctx is done. The error is nil if dst replied;
+// peers which didn't are left zero.
+func (router *Router) Traceroute(ctx context.Context, dst PeerName) ([]TraceHop, error) {
+	return router.tracer.traceroute(ctx, dst)
+}
+
+// traceProbe is relayed from peer to peer towards Dst.
+type traceProbe struct {
+	ID     uint64
+	Origin PeerName
+	Dst    PeerName
+	Hop    int // of the next peer to receive it
+}
+
+// traceReply is a peer's reply to a probe.
+type traceReply struct {
+	ID       uint64
+	Hop      int
+	Peer     PeerName
+	NickName string
+	Error    string // why the peer couldn't relay the probe
+}
+
+type traceMsg struct {
+	Probe *traceProbe
+	Reply *traceReply
+}
+
+// tracer is the Gossiper of the trace channel.
+type tracer struct {
+	sync.Mutex
+	router  *Router
+	gossip  Gossip
+	pending map[uint64]chan<- traceReply
+}
+
+func newTracer(router *Router) *tracer {
+	return &tracer{router: router, pending: make(map[uint64]chan<- traceReply)}
+}
+
+func (t *tracer) traceroute(ctx context.Context, dst PeerName) ([]TraceHop, error) {
+	if dst == t.router.Ourself.Name {
+		return nil, nil
+	}
+	id := t.router.rng().Uint64()
+	replies := make(chan traceReply, 16)
+	t.Lock()
+	t.pending[id] = replies
+	t.Unlock()
+	defer func() {
+		t.Lock()
+		delete(t.pending, id)
+		t.Unlock()
+	}()
+	start := t.router.clock().Now()
+	if err := t.relay(traceProbe{ID: id, Origin: t.router.Ourself.Name, Dst: dst}); err != nil {
+		return nil, err
+	}
+	var (
+		hops    []TraceHop
+		replied int
+		reached bool
+	)
+	// Replies take their own routes back, so needn't arrive in order.
+	for !reached || replied < len(hops) {
+		select {
+		case reply := <-replies:
+			if reply.Hop < 0 || reply.Hop > len(hops)+16 {
+				continue
+			}
+			for len(hops) <= reply.Hop {
+				hops = append(hops, TraceHop{})
+			}
+			if hops[reply.Hop].Peer == UnknownPeerName {
+				replied++
+			}
+			hops[reply.Hop] = TraceHop{Peer: reply.Peer, NickName: reply.NickName, RTT: t.router.clock().Now().Sub(start)}
+			switch {
+			case reply.Error != "":
+				return hops, fmt.Errorf("%s: %s", reply.Peer, reply.Error)
+			case reply.Peer == dst:
+				hops, reached = hops[:reply.Hop+1], true
+			}
+		case <-ctx.Done():
+			if reached {
+				return hops, nil
+			}
+			return hops, ctx.Err()
+		}
+	}
+	return hops, nil
+}
+
+// relay sends probe to the next hop of our route to its destination.
+func (t *tracer) relay(probe traceProbe) error {
+	hop, found := t.router.Routes.UnicastAll(probe.Dst)
+	if !found || hop == UnknownPeerName {
+		return fmt.Errorf("no route to %s", probe.Dst)
+	}
+	return t.gossip.GossipUnicast(hop, gobEncode(traceMsg{Probe: &probe}))
+}
+
+// OnGossipUnicast implements Gossiper, replying to and relaying probes,
+// and receiving replies to ours.
+func (t *tracer) OnGossipUnicast(src PeerName, msg []byte) error {
+	var m traceMsg
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+		return err
+	}
+	if m.Reply != nil {
+		if m.Reply.Peer != src {
+			return fmt.Errorf("trace reply for %s from %s", m.Reply.Peer, src)
+		}
+		t.Lock()
+		replies, found := t.pending[m.Reply.ID]
+		t.Unlock()
+		if found {
+			select {
+			case replies <- *m.Reply:
+			default:
+			}
+		}
+		return nil
+	}
+	if m.Probe == nil {
+		return nil
+	}
+	probe := *m.Probe
+	reply := traceReply{ID: probe.ID, Hop: probe.Hop, Peer: t.router.Ourself.Name, NickName: t.router.Ourself.nickName()}
+	if probe.Dst != t.router.Ourself.Name {
+		probe.Hop++
+		if err := t.relay(probe); err != nil {
+			reply.Error = err.Error()
+		}
+	}
+	return t.gossip.GossipUnicast(probe.Origin, gobEncode(traceMsg{Reply: &reply}))
+}
+
+// OnGossipBroadcast implements Gossiper. Nothing is broadcast.
+func (t *tracer) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+// Gossip implements Gossiper. There is no state.
+func (t *tracer) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper.
+func (t *tracer) OnGossip(msg []byte) (GossipData, error) {
+	return nil, nil
+}
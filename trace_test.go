@@ -0,0 +1,42 @@
+package mesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	// create the line r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	path, err := r1.Trace(r3.Ourself.Name)
+	require.NoError(t, err)
+	require.Equal(t, []PeerName{r2.Ourself.Name, r3.Ourself.Name}, path)
+	path, err = r1.Trace(r1.Ourself.Name)
+	require.NoError(t, err)
+	require.Empty(t, path)
+	unknown, _ := PeerNameFromString("09:00:00:09:00:00")
+	_, err = r1.Trace(unknown)
+	require.Error(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hops, err := r1.Traceroute(ctx, r3.Ourself.Name)
+	require.NoError(t, err)
+	require.Len(t, hops, 2)
+	require.Equal(t, r2.Ourself.Name, hops[0].Peer)
+	require.Equal(t, r3.Ourself.Name, hops[1].Peer)
+	require.Equal(t, "nick", hops[1].NickName)
+}
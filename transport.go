@@ -0,0 +1,262 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connections to a peer in a mesh with a MeshID start with this
+// preamble, then a byte giving the length of the MeshID, then the
+// MeshID, before the protocol header. It's the same length as the
+// protocol header, so whichever comes first can be read in one go.
+var meshIDPreamble = []byte("mesh:")
+
+const maxMeshIDLength = 255
+
+// Transport listens for connections on behalf of one or more Routers,
+// in different meshes, so that e.g. a gateway can bridge several meshes
+// from one process and port. Each Router on a Transport must have a
+// different MeshID, and the same Port as the Transport, which it
+// advertises to its peers. It may listen on further addresses, e.g. one
+// per interface; see Listen.
+type Transport struct {
+	sync.Mutex
+	listener      *net.TCPListener   // the first, on the Port
+	listeners     []*net.TCPListener // including the first
+	acceptLimiter *tokenBucket
+	routers       map[string]*Router // by MeshID
+	headerTimeout time.Duration      // for the MeshID to arrive
+	closed        bool
+	logger        Logger
+}
+
+// NewTransport returns a Transport listening on host and port.
+func NewTransport(host string, port int, logger Logger) (*Transport, error) {
+	return newTransport(host, port, false, headerTimeout, realClock{}, logger)
+}
+
+// newTransport returns a Transport listening on host and port, sharing
+// the port with the connections dialled from it if shared; see
+// NATConfig. Connections must send their MeshID within timeout. Accepts
+// are rate limited according to clock.
+func newTransport(host string, port int, shared bool, timeout time.Duration, clock Clock, logger Logger) (*Transport, error) {
+	localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	var config net.ListenConfig
+	if shared && reusePortSupported {
+		config.Control = reusePort
+	}
+	ln, err := config.Listen(context.Background(), "tcp", localAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	transport := &Transport{
+		listener:      ln.(*net.TCPListener),
+		listeners:     []*net.TCPListener{ln.(*net.TCPListener)},
+		acceptLimiter: newTokenBucket(acceptMaxTokens, acceptTokenDelay, clock),
+		routers:       make(map[string]*Router),
+		headerTimeout: timeout,
+		logger:        logger,
+	}
+	go transport.acceptLoop(transport.listener)
+	return transport, nil
+}
+
+// Addr returns the address the Transport was created listening on.
+func (transport *Transport) Addr() net.Addr {
+	return transport.listener.Addr()
+}
+
+// Addrs returns all the addresses the Transport is listening on.
+func (transport *Transport) Addrs() []net.Addr {
+	transport.Lock()
+	defer transport.Unlock()
+	addrs := make([]net.Addr, len(transport.listeners))
+	for i, ln := range transport.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// Listen starts listening on a further address, in host:port format,
+// returning the address listened on, e.g. with the port chosen if it
+// is zero.
+func (transport *Transport) Listen(address string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	transport.Lock()
+	defer transport.Unlock()
+	if transport.closed {
+		ln.Close()
+		return nil, fmt.Errorf("transport closed")
+	}
+	transport.listeners = append(transport.listeners, ln.(*net.TCPListener))
+	go transport.acceptLoop(ln.(*net.TCPListener))
+	return ln.Addr(), nil
+}
+
+// Unlisten stops listening on the address, as returned by Addrs, other
+// than the one the Transport was created listening on. Connections
+// already accepted on it are unaffected.
+func (transport *Transport) Unlisten(address string) error {
+	transport.Lock()
+	defer transport.Unlock()
+	for i, ln := range transport.listeners {
+		if ln.Addr().String() != address {
+			continue
+		}
+		if ln == transport.listener {
+			return fmt.Errorf("cannot stop listening on %s, the transport's own address", address)
+		}
+		transport.listeners = append(transport.listeners[:i:i], transport.listeners[i+1:]...)
+		return ln.Close()
+	}
+	return fmt.Errorf("not listening on %s", address)
+}
+
+// Close stops listening. Connections already handed to routers are
+// unaffected.
+func (transport *Transport) Close() error {
+	transport.Lock()
+	transport.closed = true
+	listeners := transport.listeners
+	transport.listeners = nil
+	transport.Unlock()
+	var err error
+	for _, ln := range listeners {
+		if e := ln.Close(); e != nil && ln == transport.listener {
+			err = e
+		}
+	}
+	return err
+}
+
+// listening reports whether ln is still one of our listeners.
+func (transport *Transport) listening(ln *net.TCPListener) bool {
+	transport.Lock()
+	defer transport.Unlock()
+	for _, l := range transport.listeners {
+		if l == ln {
+			return true
+		}
+	}
+	return false
+}
+
+func (transport *Transport) attach(router *Router) error {
+	if len(router.MeshID) > maxMeshIDLength {
+		return fmt.Errorf("MeshID longer than %d bytes", maxMeshIDLength)
+	}
+	transport.Lock()
+	defer transport.Unlock()
+	if transport.closed {
+		return fmt.Errorf("transport closed")
+	}
+	if _, found := transport.routers[router.MeshID]; found {
+		return fmt.Errorf("transport already has a router for mesh %q", router.MeshID)
+	}
+	transport.routers[router.MeshID] = router
+	return nil
+}
+
+func (transport *Transport) detach(router *Router) {
+	transport.Lock()
+	defer transport.Unlock()
+	if transport.routers[router.MeshID] == router {
+		delete(transport.routers, router.MeshID)
+	}
+}
+
+func (transport *Transport) acceptLoop(ln *net.TCPListener) {
+	for {
+		tcpConn, err := ln.AcceptTCP()
+		if err != nil {
+			if !transport.listening(ln) {
+				return
+			}
+			transport.logger.Printf("%v", err)
+			continue
+		}
+		go transport.dispatch(tcpConn)
+		transport.acceptLimiter.wait()
+	}
+}
+
+// dispatch hands an accepted connection to the router for its mesh.
+func (transport *Transport) dispatch(tcpConn *net.TCPConn) {
+	meshID, preread, err := readMeshID(tcpConn, transport.headerTimeout)
+	if err != nil {
+		transport.logger.Printf("->[%s] rejecting connection: %v", tcpConn.RemoteAddr(), err)
+		tcpConn.Close()
+		return
+	}
+	transport.Lock()
+	router, found := transport.routers[meshID]
+	transport.Unlock()
+	if !found {
+		transport.logger.Printf("->[%s] rejecting connection for unknown mesh %q", tcpConn.RemoteAddr(), meshID)
+		tcpConn.Close()
+		return
+	}
+	router.acceptPreread(tcpConn, preread)
+}
+
+// readMeshID reads the MeshID preamble, if any, from a new connection,
+// returning whatever it read of the protocol header instead.
+func readMeshID(tcpConn net.Conn, timeout time.Duration) (meshID string, preread []byte, err error) {
+	if err := tcpConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", nil, err
+	}
+	start := make([]byte, len(meshIDPreamble))
+	if _, err := io.ReadFull(tcpConn, start); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(start, meshIDPreamble) {
+		return "", start, nil
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(tcpConn, length); err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, length[0])
+	if _, err := io.ReadFull(tcpConn, id); err != nil {
+		return "", nil, err
+	}
+	return string(id), nil, nil
+}
+
+// writeMeshID writes the MeshID preamble to a new connection; peers in
+// the default mesh don't send one, for compatibility with those which
+// don't know about them.
+func writeMeshID(w io.Writer, meshID string) error {
+	if meshID == "" {
+		return nil
+	}
+	_, err := w.Write(append(append(append([]byte{}, meshIDPreamble...), byte(len(meshID))), meshID...))
+	return err
+}
+
+// prereadConn is a connection from which we have already read the
+// start, which it returns first.
+type prereadConn struct {
+	protocolIntroConn
+	preread []byte
+}
+
+func (conn *prereadConn) Read(b []byte) (int, error) {
+	if len(conn.preread) > 0 {
+		n := copy(b, conn.preread)
+		conn.preread = conn.preread[n:]
+		return n, nil
+	}
+	return conn.protocolIntroConn.Read(b)
+}
@@ -0,0 +1,59 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportSharedByMeshes(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	transport, err := NewTransport("127.0.0.1", 0, logger)
+	require.NoError(t, err)
+	defer transport.Close()
+
+	newRouter := func(name, meshID string, password string) *Router {
+		peerName, _ := PeerNameFromString(name)
+		config := Config{MeshID: meshID}
+		if password != "" {
+			config.Password = []byte(password)
+		}
+		router, err := NewRouter(config, peerName, "nick", nil, logger)
+		require.NoError(t, err)
+		return router
+	}
+	gatewayA := newRouter("01:00:00:01:00:00", "a", "secret a")
+	gatewayB := newRouter("01:00:00:02:00:00", "b", "secret b")
+	gatewayDefault := newRouter("01:00:00:03:00:00", "", "")
+	for _, router := range []*Router{gatewayA, gatewayB, gatewayDefault} {
+		require.NoError(t, router.StartOn(transport))
+		defer router.Stop()
+	}
+	require.Error(t, newRouter("01:00:00:04:00:00", "a", "").StartOn(transport))
+
+	peerA := newRouter("02:00:00:01:00:00", "a", "secret a")
+	peerB := newRouter("02:00:00:02:00:00", "b", "secret b")
+	peerDefault := newRouter("02:00:00:03:00:00", "", "")
+	peerUnknown := newRouter("02:00:00:04:00:00", "c", "")
+	peers := []*Router{peerA, peerB, peerDefault, peerUnknown}
+	for _, router := range peers {
+		router.Start()
+		defer router.Stop()
+		router.ConnectionMaker.InitiateConnections([]string{transport.Addr().String()}, false)
+	}
+
+	connected := func(router, to *Router) bool {
+		conn, found := router.Ourself.ConnectionTo(to.Ourself.Name)
+		return found && conn.isEstablished()
+	}
+	require.Eventually(t, func() bool {
+		return connected(peerA, gatewayA) && connected(peerB, gatewayB) && connected(peerDefault, gatewayDefault)
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, gateway := range []*Router{gatewayA, gatewayB, gatewayDefault} {
+		require.Len(t, gateway.Ourself.getConnections(), 1)
+	}
+	require.Empty(t, peerUnknown.Ourself.getConnections())
+}
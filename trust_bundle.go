@@ -0,0 +1,253 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The name of the gossip channel on which trust bundles are distributed.
+const trustChannelName = internalChannelPrefix + "trust"
+
+// TrustBundle is a set of trust anchors, e.g. CA certificates or public
+// keys, in whatever encoding the application chooses, distributed to
+// every peer in the mesh. Bundles with higher versions replace those
+// with lower. Signature is that of Config.TrustSigningKey of the
+// publisher, if set.
+type TrustBundle struct {
+	Version   uint64
+	Data      []byte
+	Signature []byte
+}
+
+// signed returns what is signed to publish bundle in the mesh with
+// meshID, so that the bundle can't be installed in any other.
+func (bundle TrustBundle) signed(meshID string) []byte {
+	return append([]byte(fmt.Sprintf("mesh trust bundle %q %d ", meshID, bundle.Version)), bundle.Data...)
+}
+
+// newer reports whether bundle supersedes other. Bundles published
+// concurrently with the same version are ordered by their data, so all
+// peers settle on the same one.
+func (bundle TrustBundle) newer(other TrustBundle) bool {
+	if bundle.Version != other.Version {
+		return bundle.Version > other.Version
+	}
+	return bytes.Compare(bundle.Data, other.Data) > 0
+}
+
+// PublishTrustBundle installs data as the new trust bundle, returning
+// its version. If Config.TrustSigningKey is set, the bundle is signed
+// with it and gossiped, and the peers which trust that key, by
+// Config.TrustTrustedKeys, install it likewise.
+func (router *Router) PublishTrustBundle(data []byte) uint64 {
+	update := router.trust.publish(data, router.MeshID, router.TrustSigningKey)
+	if update.Bundle.Signature != nil {
+		router.trust.gossip.GossipBroadcast(update)
+	}
+	router.trust.installed(router, update.Bundle)
+	return update.Bundle.Version
+}
+
+// TrustBundle returns the current trust bundle, which has a zero
+// Version if none has been published.
+func (router *Router) TrustBundle() TrustBundle {
+	router.trust.Lock()
+	defer router.trust.Unlock()
+	return router.trust.state.Bundle
+}
+
+// OnTrustBundle adds a function to be called with each new trust bundle
+// received, e.g. to install it. A peer acknowledges a bundle once all
+// the functions have returned nil for it; see TrustBundleAcks.
+// Callbacks are invoked synchronously, and so must not block.
+func (router *Router) OnTrustBundle(callback func(TrustBundle) error) {
+	router.trust.Lock()
+	defer router.trust.Unlock()
+	router.trust.onBundle = append(router.trust.onBundle, callback)
+}
+
+// TrustBundleAcks returns the latest trust bundle version acknowledged
+// by each peer, including ourself, so that e.g. an old trust anchor can
+// be retired once all peers have the bundle replacing it.
+//
+// Acknowledgements are advisory: unlike bundles, they aren't signed, so
+// any member of the mesh can claim one for any peer, and, since the
+// highest claimed is kept, overstate it for good. Where retiring an
+// anchor early matters, confirm the peers have the bundle by other
+// means, e.g. by asking each over an authenticated channel.
+func (router *Router) TrustBundleAcks() map[PeerName]uint64 {
+	router.trust.Lock()
+	defer router.trust.Unlock()
+	acks := make(map[PeerName]uint64, len(router.trust.state.Acks))
+	for name, version := range router.trust.state.Acks {
+		acks[name] = version
+	}
+	return acks
+}
+
+// trustState is the state of the trust channel: the current bundle, and
+// the acknowledgements of it and its predecessors.
+type trustState struct {
+	Bundle TrustBundle
+	Acks   map[PeerName]uint64
+}
+
+// Encode implements GossipData.
+func (state *trustState) Encode() [][]byte {
+	return [][]byte{gobEncode(state)}
+}
+
+// Merge implements GossipData.
+func (state *trustState) Merge(other GossipData) GossipData {
+	merged := &trustState{Bundle: state.Bundle, Acks: make(map[PeerName]uint64)}
+	merged.merge(other.(*trustState))
+	merged.merge(state)
+	return merged
+}
+
+// merge merges other into state, returning what changed, or nil.
+func (state *trustState) merge(other *trustState) *trustState {
+	var delta trustState
+	if other.Bundle.newer(state.Bundle) {
+		state.Bundle = other.Bundle
+		delta.Bundle = other.Bundle
+	}
+	for name, version := range other.Acks {
+		if version > state.Acks[name] {
+			state.Acks[name] = version
+			if delta.Acks == nil {
+				delta.Acks = make(map[PeerName]uint64)
+			}
+			delta.Acks[name] = version
+		}
+	}
+	if delta.Bundle.Version == 0 && delta.Acks == nil {
+		return nil
+	}
+	return &delta
+}
+
+// trustDistributor is the Gossiper of the trust channel.
+type trustDistributor struct {
+	sync.Mutex
+	state    trustState
+	ourself  PeerName
+	onBundle []func(TrustBundle) error
+	gossip   Gossip
+}
+
+func newTrustDistributor(ourself PeerName) *trustDistributor {
+	return &trustDistributor{state: trustState{Acks: make(map[PeerName]uint64)}, ourself: ourself}
+}
+
+func (d *trustDistributor) publish(data []byte, meshID string, key ed25519.PrivateKey) *trustState {
+	d.Lock()
+	defer d.Unlock()
+	bundle := TrustBundle{Version: d.state.Bundle.Version + 1, Data: data}
+	if key != nil {
+		bundle.Signature = ed25519.Sign(key, bundle.signed(meshID))
+	}
+	d.state.Bundle = bundle
+	return &trustState{Bundle: bundle}
+}
+
+// installed runs the callbacks for a new bundle, and acknowledges it if
+// they all succeed.
+func (d *trustDistributor) installed(router *Router, bundle TrustBundle) {
+	d.Lock()
+	callbacks := d.onBundle
+	d.Unlock()
+	for _, callback := range callbacks {
+		if err := callback(bundle); err != nil {
+			router.logger.Printf("[gossip %s]: unable to install trust bundle version %d: %v", trustChannelName, bundle.Version, err)
+			return
+		}
+	}
+	d.Lock()
+	if d.state.Bundle.newer(bundle) || d.state.Acks[d.ourself] >= bundle.Version {
+		// superseded while we were installing it
+		d.Unlock()
+		return
+	}
+	d.state.Acks[d.ourself] = bundle.Version
+	update := &trustState{Bundle: bundle, Acks: map[PeerName]uint64{d.ourself: bundle.Version}}
+	d.Unlock()
+	d.gossip.GossipBroadcast(update)
+}
+
+// forget drops the acknowledgements of a departed peer.
+func (d *trustDistributor) forget(name PeerName) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.state.Acks, name)
+}
+
+// receive merges a received state, installing any new bundle signed by
+// a trusted key, and returns it, less any bundle not, along with what
+// was new to us, if anything.
+func (d *trustDistributor) receive(router *Router, msg []byte) (received, delta *trustState, err error) {
+	received = &trustState{}
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(received); err != nil {
+		return nil, nil, err
+	}
+	if bundle := received.Bundle; bundle.Version != 0 && !signedBy(bundle.signed(router.MeshID), bundle.Signature, router.TrustSigningKey, router.TrustTrustedKeys) {
+		received.Bundle = TrustBundle{}
+	}
+	d.Lock()
+	delta = d.state.merge(received)
+	d.Unlock()
+	if delta != nil && delta.Bundle.Version != 0 {
+		d.installed(router, delta.Bundle)
+	}
+	return received, delta, nil
+}
+
+// trustGossiper adapts trustDistributor to Gossiper.
+type trustGossiper struct {
+	router *Router
+}
+
+func (g trustGossiper) OnGossipUnicast(src PeerName, msg []byte) error {
+	return fmt.Errorf("unexpected trust gossip unicast from %s", src)
+}
+
+// OnGossipBroadcast relays what it received as-is, as for topology, so
+// that it reaches the peers beyond us even if it isn't news to us.
+func (g trustGossiper) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	received, _, err := g.router.trust.receive(g.router, update)
+	if err != nil {
+		return nil, err
+	}
+	return received, nil
+}
+
+// Gossip implements Gossiper, with the bundle only if it is signed.
+func (g trustGossiper) Gossip() GossipData {
+	d := g.router.trust
+	d.Lock()
+	defer d.Unlock()
+	var bundle TrustBundle
+	if d.state.Bundle.Signature != nil {
+		bundle = d.state.Bundle
+	}
+	if bundle.Version == 0 && len(d.state.Acks) == 0 {
+		return nil
+	}
+	complete := &trustState{Bundle: bundle, Acks: make(map[PeerName]uint64, len(d.state.Acks))}
+	for name, version := range d.state.Acks {
+		complete.Acks[name] = version
+	}
+	return complete
+}
+
+func (g trustGossiper) OnGossip(msg []byte) (GossipData, error) {
+	_, delta, err := g.router.trust.receive(g.router, msg)
+	if delta == nil {
+		return nil, err
+	}
+	return delta, nil
+}
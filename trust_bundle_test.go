@@ -0,0 +1,95 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// requireBundle checks the version and data of a trust bundle.
+func requireBundle(t *testing.T, version uint64, data string, bundle TrustBundle) {
+	require.Equal(t, version, bundle.Version)
+	require.Equal(t, data, string(bundle.Data))
+}
+
+func TestTrustBundleDistribution(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, untrusted, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	trusting := Config{TrustTrustedKeys: []ed25519.PublicKey{public}}
+
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{TrustSigningKey: private})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{TrustSigningKey: private})
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", trusting)
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	var installed []TrustBundle
+	r3.OnTrustBundle(func(bundle TrustBundle) error {
+		if string(bundle.Data) == "bad" {
+			return fmt.Errorf("malformed bundle")
+		}
+		installed = append(installed, bundle)
+		return nil
+	})
+
+	require.Equal(t, uint64(1), r1.PublishTrustBundle([]byte("ca1")))
+	sendPendingGossip(routers...)
+	for _, r := range routers {
+		requireBundle(t, 1, "ca1", r.TrustBundle())
+	}
+	require.Len(t, installed, 1)
+	requireBundle(t, 1, "ca1", installed[0])
+	acks := map[PeerName]uint64{r1.Ourself.Name: 1, r2.Ourself.Name: 1, r3.Ourself.Name: 1}
+	for _, r := range routers {
+		require.Equal(t, acks, r.TrustBundleAcks())
+	}
+
+	// r3 fails to install the next bundle, so doesn't acknowledge it
+	require.Equal(t, uint64(2), r2.PublishTrustBundle([]byte("bad")))
+	sendPendingGossip(routers...)
+	requireBundle(t, 2, "bad", r3.TrustBundle())
+	acks = map[PeerName]uint64{r1.Ourself.Name: 2, r2.Ourself.Name: 2, r3.Ourself.Name: 1}
+	require.Equal(t, acks, r1.TrustBundleAcks())
+
+	// periodic gossip brings a newly connected peer up to date
+	r4 := newTestRouterWithConfig(t, "04:00:00:04:00:00", trusting)
+	addTestGossipConnection(t, r4, r1)
+	routers = append(routers, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2), r4.tp(r1))
+	r1.trust.gossip.(*GossipChannel).Send(trustGossiper{r1}.Gossip())
+	sendPendingGossip(routers...)
+	requireBundle(t, 2, "bad", r4.TrustBundle())
+	require.Equal(t, uint64(2), r1.TrustBundleAcks()[r4.Ourself.Name])
+
+	// bundles signed by untrusted keys, or not at all, are installed
+	// only by those who publish them
+	r4.TrustSigningKey = untrusted
+	require.Equal(t, uint64(3), r4.PublishTrustBundle([]byte("forged")))
+	sendPendingGossip(routers...)
+	require.Equal(t, uint64(3), r3.PublishTrustBundle([]byte("local")))
+	sendPendingGossip(routers...)
+	for _, r := range routers[:2] {
+		requireBundle(t, 2, "bad", r.TrustBundle())
+	}
+	requireBundle(t, 3, "local", r3.TrustBundle())
+	requireBundle(t, 3, "forged", r4.TrustBundle())
+
+	// a bundle signed for one mesh isn't installed in another
+	other := newTestRouterWithConfig(t, "05:00:00:05:00:00", Config{MeshID: "other", TrustTrustedKeys: trusting.TrustTrustedKeys})
+	bundle := TrustBundle{Version: 4, Data: []byte("replayed")}
+	bundle.Signature = ed25519.Sign(private, bundle.signed(""))
+	_, delta, err := other.trust.receive(other, gobEncode(&trustState{Bundle: bundle}))
+	require.NoError(t, err)
+	require.Nil(t, delta)
+	require.Zero(t, other.TrustBundle().Version)
+}
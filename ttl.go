@@ -0,0 +1,61 @@
+package mesh
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// The default number of hops a frame may make; see Config.FrameTTL.
+const defaultFrameTTL = 64
+
+func validateFrameTTL(ttl int) error {
+	if ttl < 0 || ttl > 1<<16 {
+		return fmt.Errorf("invalid frame TTL %d", ttl)
+	}
+	return nil
+}
+
+// frameTTL returns the TTL given to frames originating here.
+func (router *Router) frameTTL() uint32 {
+	if router.FrameTTL > 0 {
+		return uint32(router.FrameTTL)
+	}
+	return defaultFrameTTL
+}
+
+// stampTTL gives meta, of a frame originating here, its TTL.
+func (c *GossipChannel) stampTTL(meta gossipFrameMeta) gossipFrameMeta {
+	if c.ourself.router != nil {
+		meta.TTL = c.ourself.router.frameTTL()
+	}
+	return meta
+}
+
+// hop accounts for relaying a frame with meta one more hop, returning
+// false, and counting it, if its TTL is exhausted. Frames from peers
+// which don't set TTLs have none.
+func (c *GossipChannel) hop(meta *gossipFrameMeta) bool {
+	if meta.TTL == 1 {
+		atomic.AddUint64(&c.ttlExceeded, 1)
+		return false
+	}
+	if meta.TTL > 1 {
+		meta.TTL--
+	}
+	meta.Hops++
+	return true
+}
+
+// TTLExceeded returns the number of frames received, on each channel
+// which has dropped any, which weren't relayed any further because
+// their TTL was exhausted, e.g. because routes which disagreed while
+// the topology was changing relayed them round in circles.
+func (router *Router) TTLExceeded() map[string]uint64 {
+	result := make(map[string]uint64)
+	for channel := range router.gossipChannelSet() {
+		if n := atomic.LoadUint64(&channel.ttlExceeded); n > 0 {
+			result[channel.name] = n
+		}
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameTTL(t *testing.T) {
+	// create the line r1 <-> r2 <-> r3 <-> r4, where frames from r1
+	// only get as far as r3
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{FrameTTL: 2})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2, r4), r4.tp(r3))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	var gossipers []*broadcastRecorder
+	var channels []*GossipChannel
+	for _, r := range routers {
+		g := &broadcastRecorder{testGossiper: newTestGossiper()}
+		c, err := r.NewGossipChannel("Test", g, GossipChannelConfig{})
+		require.NoError(t, err)
+		gossipers, channels = append(gossipers, g), append(channels, c)
+	}
+
+	channels[0].GossipBroadcast(newSurrogateGossipData([]byte{1}))
+	sendPendingGossip(routers...)
+	require.Len(t, gossipers[1].received, 1)
+	require.Len(t, gossipers[2].received, 1)
+	require.Empty(t, gossipers[3].received)
+	require.Equal(t, map[string]uint64{"Test": 1}, r3.TTLExceeded())
+
+	// r4's frames have the default TTL
+	channels[3].GossipBroadcast(newSurrogateGossipData([]byte{2}))
+	sendPendingGossip(routers...)
+	require.Len(t, gossipers[0].received, 1)
+
+	// unicasts are limited too
+	require.NoError(t, channels[0].GossipUnicast(r4.Ourself.Name, []byte("far")))
+	require.Equal(t, map[string]uint64{"Test": 2}, NewStatus(r3).TTLExceeded)
+	require.Empty(t, r2.TTLExceeded())
+}
@@ -0,0 +1,108 @@
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// UnicastAck is the acknowledgement GossipUnicastConfirmed waits for.
+type UnicastAck int
+
+// The acknowledgements of unicasts.
+const (
+	// AckNone waits only for the unicast to be sent on its way.
+	AckNone UnicastAck = iota
+	// AckHop waits for the first peer on the way to the destination,
+	// which may be the destination itself, to receive the unicast.
+	AckHop
+	// AckEndToEnd waits for the destination's Gossiper to accept the
+	// unicast, i.e. for its OnGossipUnicast to return nil.
+	AckEndToEnd
+)
+
+// GossipUnicastConfirmed is GossipUnicast, except that it fails straight
+// away if there is no route to dst, and then waits for the unicast to
+// be acknowledged as ack says, or for ctx to be done, when it returns
+// ctx.Err(). Since peers which predate it never acknowledge unicasts,
+// ctx should have a deadline.
+func (c *GossipChannel) GossipUnicastConfirmed(ctx context.Context, dstPeerName PeerName, msg []byte, ack UnicastAck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.isClosed() {
+		return errChannelClosed
+	}
+	if _, found := c.routes.UnicastAll(dstPeerName); !found {
+		return unroutableError{fmt.Errorf("no route to %s", dstPeerName)}
+	}
+	if ack == AckNone {
+		return c.GossipUnicastContext(ctx, dstPeerName, msg)
+	}
+	id := c.ourself.router.rng().Uint64()
+	acked := c.confirms.add(id)
+	defer c.confirms.remove(id)
+	result := make(chan error, 1)
+	go func() {
+		result <- c.originateUnicast(dstPeerName, msg, gossipFrameMeta{MsgIDs: []uint64{id}, HopAck: ack == AckHop})
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-acked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ackHop acknowledges a unicast from srcName carried by the frame with
+// meta, if it asks us to as its first hop, even if we relay it without
+// being a member of the channel.
+func (c *GossipChannel) ackHop(srcName PeerName, meta gossipFrameMeta) {
+	if meta.HopAck && meta.sender == srcName {
+		c.acknowledge(srcName, meta.MsgIDs)
+	}
+}
+
+// unicastConfirms are the unicasts of a channel awaiting
+// acknowledgement, by message ID.
+type unicastConfirms struct {
+	sync.Mutex
+	byID map[uint64]chan struct{}
+}
+
+func (uc *unicastConfirms) add(id uint64) <-chan struct{} {
+	uc.Lock()
+	defer uc.Unlock()
+	if uc.byID == nil {
+		uc.byID = make(map[uint64]chan struct{})
+	}
+	acked := make(chan struct{})
+	uc.byID[id] = acked
+	return acked
+}
+
+func (uc *unicastConfirms) remove(id uint64) {
+	uc.Lock()
+	defer uc.Unlock()
+	delete(uc.byID, id)
+}
+
+// ack records the acknowledgement of the unicasts with the given ids.
+func (uc *unicastConfirms) ack(ids []uint64) {
+	uc.Lock()
+	defer uc.Unlock()
+	for _, id := range ids {
+		if acked, found := uc.byID[id]; found {
+			close(acked)
+			delete(uc.byID, id)
+		}
+	}
+}
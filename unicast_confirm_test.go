@@ -0,0 +1,44 @@
+package mesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipUnicastConfirmed(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	for _, r := range routers {
+		defer r.Stop()
+	}
+	gossip, err := r1.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	c1 := gossip.(*GossipChannel)
+	g3 := &unicastChannel{newTestGossiper(), make(chan []byte, 3)}
+	_, err = r3.NewGossip("test", g3)
+	require.NoError(t, err)
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// r2 acknowledges as the first hop, though it isn't a member
+	for _, ack := range []UnicastAck{AckNone, AckHop, AckEndToEnd} {
+		require.NoError(t, c1.GossipUnicastConfirmed(ctx, r3.Ourself.Name, []byte("hello"), ack))
+		require.Equal(t, []byte("hello"), <-g3.unicasts)
+	}
+
+	unknown, _ := PeerNameFromString("04:00:00:04:00:00")
+	require.Error(t, c1.GossipUnicastConfirmed(ctx, unknown, []byte("hello"), AckNone))
+
+	// a unicast to a peer which isn't a member is never accepted
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, c1.GossipUnicastConfirmed(ctx, r2.Ourself.Name, []byte("hello"), AckEndToEnd))
+}
@@ -0,0 +1,343 @@
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peers which can only reach each other via HTTP, e.g. through proxies
+// which allow nothing but port 443 and HTTP upgrades, can connect over
+// WebSockets instead of plain TCP. Router.WebSocketHandler accepts
+// connections, and targets given as ws:// or wss:// URLs, rather than
+// in host[:port] format, are dialled over WebSockets. The connection
+// then proceeds as if over TCP, its byte stream carried in binary
+// WebSocket frames.
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsFinal  = 0x80
+	wsMasked = 0x80
+
+	maxWSControlPayload = 125
+)
+
+var errWebSocketHandshake = errors.New("websocket handshake failed")
+
+// isWebSocketURL returns whether a target is a WebSocket URL, rather
+// than in host[:port] format.
+func isWebSocketURL(peer string) bool {
+	return strings.HasPrefix(peer, "ws://") || strings.HasPrefix(peer, "wss://")
+}
+
+// parseWebSocketURL checks a WebSocket target, returning the host:port
+// to dial.
+func parseWebSocketURL(peer string) (*url.URL, string, error) {
+	u, err := url.Parse(peer)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Hostname() == "" {
+		return nil, "", fmt.Errorf("invalid peer URL %q, has no host", peer)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	return u, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept for a
+// Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// dialWebSocket dials a ws:// or wss:// target, and completes the
+// WebSocket handshake.
+func dialWebSocket(ctx context.Context, dialer Dialer, peer string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	u, hostPort, err := parseWebSocketURL(peer)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, config)
+	}
+	ws, err := webSocketClientHandshake(conn, u, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func webSocketClientHandshake(conn net.Conn, u *url.URL, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%v: %s", errWebSocketHandshake, resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errWebSocketHandshake
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+// WebSocketHandler returns a handler accepting connections from peers
+// over WebSockets, for mounting wherever the application serves HTTP;
+// peers connect to it by its ws:// or wss:// URL.
+func (router *Router) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+			http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "websocket upgrade unsupported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			router.logger.Printf("->[%s] websocket upgrade failed: %v", r.RemoteAddr, err)
+			return
+		}
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return
+		}
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+		ws := newWebSocketConn(conn, rw.Reader, false)
+		meshID, preread, err := readMeshID(ws, router.handshakeTimeout())
+		if err == nil && meshID != router.MeshID {
+			err = fmt.Errorf("connection for unknown mesh %q", meshID)
+		}
+		if err != nil {
+			router.logger.Printf("->[%s] rejecting connection: %v", ws.RemoteAddr(), err)
+			ws.Close()
+			return
+		}
+		router.acceptPreread(ws, preread)
+	})
+}
+
+// webSocketConn carries the byte stream of a connection in binary
+// WebSocket frames. Its addresses and deadlines are those of the
+// underlying connection.
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool // we mask the frames we send, and the remote doesn't
+
+	writeLock sync.Mutex
+
+	// of the data frame being read
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{Conn: conn, reader: reader, client: client}
+}
+
+func (ws *webSocketConn) Read(b []byte) (int, error) {
+	for ws.remaining == 0 {
+		if err := ws.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > ws.remaining {
+		b = b[:ws.remaining]
+	}
+	n, err := ws.reader.Read(b)
+	ws.remaining -= uint64(n)
+	if ws.masked {
+		for i := range b[:n] {
+			b[i] ^= ws.mask[ws.maskPos]
+			ws.maskPos = (ws.maskPos + 1) & 3
+		}
+	}
+	return n, err
+}
+
+// readHeader reads the header of the next frame, handling control
+// frames as they come.
+func (ws *webSocketConn) readHeader() error {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&wsMasked != 0
+	if masked == ws.client {
+		return fmt.Errorf("websocket frame masking violates protocol")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return err
+		}
+	}
+	switch opcode {
+	case wsOpBinary, wsOpContinuation:
+		ws.remaining, ws.masked, ws.mask, ws.maskPos = length, masked, mask, 0
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > maxWSControlPayload {
+			return fmt.Errorf("websocket control frame too large: %d", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+		switch opcode {
+		case wsOpClose:
+			return io.EOF
+		case wsOpPing:
+			return ws.writeFrame(wsOpPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected websocket opcode: %d", opcode)
+	}
+}
+
+func (ws *webSocketConn) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, wsFinal|opcode)
+	var maskBit byte
+	if ws.client {
+		maskBit = wsMasked
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(append(frame, maskBit|127), ext[:]...)
+	}
+	if ws.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, c := range payload {
+			frame = append(frame, c^mask[i&3])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	_, err := ws.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,114 @@
+package mesh
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketConn(t *testing.T) {
+	a, b := net.Pipe()
+	client := newWebSocketConn(a, bufio.NewReader(a), true)
+	server := newWebSocketConn(b, bufio.NewReader(b), false)
+
+	for _, size := range []int{1, 125, 126, 70000} {
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		go client.Write(msg)
+		received := make([]byte, size)
+		_, err := io.ReadFull(server, received)
+		require.NoError(t, err)
+		require.Equal(t, msg, received)
+	}
+
+	// pings are answered, and don't disturb the byte stream
+	pong := make(chan error, 1)
+	go func() {
+		_, err := server.reader.Peek(2)
+		pong <- err
+	}()
+	go func() {
+		server.writeFrame(wsOpPing, []byte("ping"))
+		server.Write([]byte("data"))
+	}()
+	received := make([]byte, 4)
+	_, err := io.ReadFull(client, received)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), received)
+	require.NoError(t, <-pong)
+	a.Close()
+
+	// unmasked frames from clients violate the protocol
+	a, b = net.Pipe()
+	defer a.Close()
+	server = newWebSocketConn(b, bufio.NewReader(b), false)
+	go (&webSocketConn{Conn: a}).writeFrame(wsOpBinary, []byte("x"))
+	_, err = server.Read(received)
+	require.Error(t, err)
+}
+
+func TestWebSocketConnection(t *testing.T) {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	for _, meshID := range []string{"", "mesh"} {
+		r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{MeshID: meshID, TrustedSubnets: []*net.IPNet{loopback}})
+		g2 := &unicastChannel{newTestGossiper(), make(chan []byte, 1)}
+		_, err := r2.NewGossip("test", g2)
+		require.NoError(t, err)
+		server := httptest.NewTLSServer(r2.WebSocketHandler())
+
+		tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+		r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{MeshID: meshID, WebSocketTLS: tlsConfig})
+		c1, err := r1.NewGossip("test", newTestGossiper())
+		require.NoError(t, err)
+
+		target := strings.Replace(server.URL, "https://", "wss://", 1) + "/mesh"
+		require.Empty(t, r1.ConnectionMaker.InitiateConnections([]string{target}, false))
+		waitUntil(t, func() bool {
+			r1.Routes.ensureRecalculated()
+			_, found := r1.Routes.UnicastAll(r2.Ourself.Name)
+			return found
+		})
+		conn, _ := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+		require.Equal(t, target, conn.remoteTCPAddress())
+		require.NoError(t, c1.GossipUnicast(r2.Ourself.Name, []byte("hello")))
+		require.Equal(t, []byte("hello"), <-g2.unicasts)
+		// whatever the subnets trusted, the proxy may be on one of them
+		conn, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+		require.True(t, found)
+		require.False(t, conn.(*LocalConnection).trustRemote)
+
+		r1.Stop()
+		r2.Stop()
+		server.Close()
+	}
+}
+
+func TestWebSocketHandlerRejectsPlainRequests(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	defer r.Stop()
+	server := httptest.NewServer(r.WebSocketHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestParseWebSocketTargets(t *testing.T) {
+	addrs, errs := parsePeerAddrs([]string{"wss://example.com/mesh", "ws://:80", "127.0.0.1:6783"})
+	require.Len(t, errs, 1)
+	require.Len(t, addrs, 2)
+	require.Nil(t, addrs["wss://example.com/mesh"])
+	_, hostPort, err := parseWebSocketURL("wss://example.com/mesh")
+	require.NoError(t, err)
+	require.Equal(t, "example.com:443", hostPort)
+}
@@ -0,0 +1,137 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TopologyChange is a hypothetical change to the topology; see
+// Router.WhatIf. To see the effect of losing a whole zone, say, list
+// the peers in it.
+type TopologyChange struct {
+	RemovePeers []PeerName
+	AddLinks    [][2]PeerName // established connections, in both directions
+	RemoveLinks [][2]PeerName
+}
+
+// RouteChange is the change in the next hop towards Dest, which is
+// UnknownPeerName when Dest is unreachable.
+type RouteChange struct {
+	Dest          PeerName
+	Before, After PeerName
+}
+
+// WhatIfReport describes how a TopologyChange would affect our unicast
+// routes. Removed peers are not reported.
+type WhatIfReport struct {
+	// Unreachable lists the destinations we can reach now, but
+	// couldn't after the change.
+	Unreachable []PeerName
+
+	// Rerouted lists the destinations we could still reach after the
+	// change, but via a different next hop.
+	Rerouted []RouteChange
+}
+
+// WhatIf reports how our unicast routes would change, were the topology
+// changed, e.g. to check that taking a peer down for maintenance won't
+// partition the mesh. The routes are recalculated on a copy of the
+// topology, which is left untouched.
+func (router *Router) WhatIf(change TopologyChange) (WhatIfReport, error) {
+	before := router.topologySnapshot()
+	after := router.topologySnapshot()
+	if err := after.apply(change, router.Ourself.Name); err != nil {
+		return WhatIfReport{}, err
+	}
+	beforeRoutes := router.Routes.unicastFrom(before[router.Ourself.Name], false)
+	afterRoutes := router.Routes.unicastFrom(after[router.Ourself.Name], false)
+
+	var report WhatIfReport
+	for dest, hop := range beforeRoutes {
+		if dest == router.Ourself.Name {
+			continue
+		}
+		if _, found := after[dest]; !found {
+			continue
+		}
+		switch newHop, found := afterRoutes[dest]; {
+		case !found:
+			report.Unreachable = append(report.Unreachable, dest)
+		case newHop != hop:
+			report.Rerouted = append(report.Rerouted, RouteChange{dest, hop, newHop})
+		}
+	}
+	sort.Slice(report.Unreachable, func(i, j int) bool { return report.Unreachable[i] < report.Unreachable[j] })
+	sort.Slice(report.Rerouted, func(i, j int) bool { return report.Rerouted[i].Dest < report.Rerouted[j].Dest })
+	return report, nil
+}
+
+// topology is a copy of the peers and their connections, by name.
+type topology map[PeerName]*Peer
+
+// topologySnapshot copies the topology, so routes can be calculated on
+// it without holding any locks.
+func (router *Router) topologySnapshot() topology {
+	router.Peers.RLock()
+	defer router.Peers.RUnlock()
+	router.Ourself.RLock()
+	defer router.Ourself.RUnlock()
+	snapshot := make(topology, len(router.Peers.byName))
+	for name, peer := range router.Peers.byName {
+		snapshot[name] = newPeerFromSummary(peer.peerSummary)
+	}
+	for name, peer := range router.Peers.byName {
+		from := snapshot[name]
+		for remoteName, conn := range peer.connections {
+			to, found := snapshot[remoteName]
+			if !found {
+				continue
+			}
+			copied := newRemoteConnection(from, to, conn.remoteTCPAddress(), conn.isOutbound(), conn.isEstablished())
+			copied.degraded, copied.roundTrip = conn.isDegraded(), conn.roundTripTime()
+			from.connections[remoteName] = copied
+		}
+	}
+	return snapshot
+}
+
+func (t topology) apply(change TopologyChange, ourself PeerName) error {
+	lookup := func(name PeerName) (*Peer, error) {
+		if peer, found := t[name]; found {
+			return peer, nil
+		}
+		return nil, fmt.Errorf("unknown peer %s", name)
+	}
+	for _, link := range change.RemoveLinks {
+		t.unlink(link[0], link[1])
+		t.unlink(link[1], link[0])
+	}
+	for _, link := range change.AddLinks {
+		a, err := lookup(link[0])
+		if err != nil {
+			return err
+		}
+		b, err := lookup(link[1])
+		if err != nil {
+			return err
+		}
+		a.connections[b.Name] = newRemoteConnection(a, b, "", true, true)
+		b.connections[a.Name] = newRemoteConnection(b, a, "", false, true)
+	}
+	for _, name := range change.RemovePeers {
+		if name == ourself {
+			return fmt.Errorf("cannot remove ourself")
+		}
+		delete(t, name)
+		for _, peer := range t {
+			delete(peer.connections, name)
+		}
+	}
+	return nil
+}
+
+func (t topology) unlink(from, to PeerName) {
+	if peer, found := t[from]; found {
+		delete(peer.connections, to)
+	}
+}
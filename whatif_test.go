@@ -0,0 +1,43 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhatIf(t *testing.T) {
+	routers, route := newTestDiamond(t)
+	r1, r2, r3, r4 := routers[0], routers[1], routers[2], routers[3]
+	n2, n3, n4 := r2.Ourself.Name, r3.Ourself.Name, r4.Ourself.Name
+	require.Equal(t, n2, route())
+
+	// taking r2 down reroutes r3 via r4
+	report, err := r1.WhatIf(TopologyChange{RemovePeers: []PeerName{n2}})
+	require.NoError(t, err)
+	require.Empty(t, report.Unreachable)
+	require.Equal(t, []RouteChange{{n3, n2, n4}}, report.Rerouted)
+
+	// taking down both r2 and r4 cuts off r3
+	report, err = r1.WhatIf(TopologyChange{RemovePeers: []PeerName{n2, n4}})
+	require.NoError(t, err)
+	require.Equal(t, []PeerName{n3}, report.Unreachable)
+	require.Empty(t, report.Rerouted)
+
+	// unless r1 is linked to r3 directly
+	report, err = r1.WhatIf(TopologyChange{RemovePeers: []PeerName{n2, n4}, AddLinks: [][2]PeerName{{r1.Ourself.Name, n3}}})
+	require.NoError(t, err)
+	require.Empty(t, report.Unreachable)
+	require.Equal(t, []RouteChange{{n3, n2, n3}}, report.Rerouted)
+
+	// cutting the link r1-r2 reroutes r2 too
+	report, err = r1.WhatIf(TopologyChange{RemoveLinks: [][2]PeerName{{n2, r1.Ourself.Name}}})
+	require.NoError(t, err)
+	require.Equal(t, []RouteChange{{n2, n2, n4}, {n3, n2, n4}}, report.Rerouted)
+
+	_, err = r1.WhatIf(TopologyChange{RemovePeers: []PeerName{r1.Ourself.Name}})
+	require.Error(t, err)
+
+	// the real routes are untouched
+	require.Equal(t, n2, route())
+}